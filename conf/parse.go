@@ -57,6 +57,10 @@ type parser struct {
 
 	// pedantic reports error when configuration is not correct.
 	pedantic bool
+
+	// Absolute paths of the files being parsed, from the top level file
+	// to the current one, used to detect include cycles.
+	includes []string
 }
 
 // Parse will return a map of keys to interface{}, although concrete types
@@ -77,7 +81,7 @@ func ParseFile(fp string) (map[string]interface{}, error) {
 		return nil, fmt.Errorf("error opening config file: %v", err)
 	}
 
-	p, err := parse(string(data), fp, false)
+	p, err := parseIncluded(string(data), fp, false, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -91,7 +95,7 @@ func ParseFileWithChecks(fp string) (map[string]interface{}, error) {
 		return nil, err
 	}
 
-	p, err := parse(string(data), fp, true)
+	p, err := parseIncluded(string(data), fp, true, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -127,6 +131,19 @@ func (t *token) Position() int {
 }
 
 func parse(data, fp string, pedantic bool) (p *parser, err error) {
+	return parseIncluded(data, fp, pedantic, nil)
+}
+
+// parseIncluded parses the content of the file fp, which has been included
+// through the given chain of files.
+func parseIncluded(data, fp string, pedantic bool, includes []string) (p *parser, err error) {
+	if fp != "" {
+		afp, err := filepath.Abs(fp)
+		if err != nil {
+			afp = fp
+		}
+		includes = append(includes[:len(includes):len(includes)], afp)
+	}
 	p = &parser{
 		mapping:  make(map[string]interface{}),
 		lx:       lex(data),
@@ -135,6 +152,7 @@ func parse(data, fp string, pedantic bool) (p *parser, err error) {
 		ikeys:    make([]item, 0, 4),
 		fp:       filepath.Dir(fp),
 		pedantic: pedantic,
+		includes: includes,
 	}
 	p.pushContext(p.mapping)
 
@@ -324,15 +342,7 @@ func (p *parser) processItem(it item, fp string) error {
 			p.setValue(value)
 		}
 	case itemInclude:
-		var (
-			m   map[string]interface{}
-			err error
-		)
-		if p.pedantic {
-			m, err = ParseFileWithChecks(filepath.Join(p.fp, it.val))
-		} else {
-			m, err = ParseFile(filepath.Join(p.fp, it.val))
-		}
+		m, err := p.parseInclude(filepath.Join(p.fp, it.val))
 		if err != nil {
 			return fmt.Errorf("error parsing include file '%s', %v", it.val, err)
 		}
@@ -352,6 +362,33 @@ func (p *parser) processItem(it item, fp string) error {
 	return nil
 }
 
+// parseInclude parses an included file, failing if that file is already
+// being parsed, that is, if it directly or indirectly includes itself.
+func (p *parser) parseInclude(fp string) (map[string]interface{}, error) {
+	afp, err := filepath.Abs(fp)
+	if err != nil {
+		afp = fp
+	}
+	for i, inc := range p.includes {
+		if inc == afp {
+			chain := append(p.includes[i:len(p.includes):len(p.includes)], afp)
+			return nil, fmt.Errorf("include cycle detected: %s", strings.Join(chain, " -> "))
+		}
+	}
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		if p.pedantic {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error opening config file: %v", err)
+	}
+	ip, err := parseIncluded(string(data), fp, p.pedantic, p.includes)
+	if err != nil {
+		return nil, err
+	}
+	return ip.mapping, nil
+}
+
 // Used to map an environment value into a temporary map to pass to secondary Parse call.
 const pkey = "pk"
 
@@ -2,7 +2,9 @@ package conf
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -359,3 +361,57 @@ func TestIncludeVariablesWithChecks(t *testing.T) {
 	expectKeyVal(t, m, "BOB_PASS", "$2a$11$dZM98SpGeI7dCFFGSpt.JObQcix8YHml4TBUZoge9R1uxnMIln5ly", 3, 1)
 	expectKeyVal(t, m, "CAROL_PASS", "foo", 6, 3)
 }
+
+func TestIncludeCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf_include_cycle")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConf := func(name, content string) string {
+		t.Helper()
+		fp := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(fp, []byte(content), 0644); err != nil {
+			t.Fatalf("Error writing file: %v", err)
+		}
+		return fp
+	}
+
+	self := writeConf("self.conf", "port: 4222\ninclude ./self.conf\n")
+	a := writeConf("a.conf", "port: 4222\ninclude ./b.conf\n")
+	writeConf("b.conf", "authorization {\n  include ./c.conf\n}\n")
+	writeConf("c.conf", "include ./a.conf\n")
+	ok := writeConf("ok.conf", "include ./d.conf\nauthorization {\n  include ./d.conf\n}\n")
+	writeConf("d.conf", "timeout: 1\n")
+
+	for _, test := range []struct {
+		name string
+		fp   string
+	}{
+		{"self", self},
+		{"indirect", a},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, parse := range []func(string) (map[string]interface{}, error){ParseFile, ParseFileWithChecks} {
+				_, err := parse(test.fp)
+				if err == nil || !strings.Contains(err.Error(), "include cycle detected") {
+					t.Fatalf("Expected include cycle error, got %v", err)
+				}
+			}
+		})
+	}
+
+	// Including the same file more than once is not a cycle.
+	m, err := ParseFile(ok)
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	ex := map[string]interface{}{
+		"timeout":       int64(1),
+		"authorization": map[string]interface{}{"timeout": int64(1)},
+	}
+	if !reflect.DeepEqual(m, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m, ex)
+	}
+}
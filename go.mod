@@ -2,6 +2,7 @@ module github.com/nats-io/nats-server/v2
 
 require (
 	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/klauspost/compress v1.11.13
 	github.com/nats-io/jwt v0.3.2
 	github.com/nats-io/nats.go v1.9.1
 	github.com/nats-io/nkeys v0.1.3
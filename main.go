@@ -23,6 +23,8 @@ import (
 
 var usageStr = `
 Usage: nats-server [options]
+       nats-server signal <ldm|reload|reopen|stop|quit|upgrade> [--pid <pid>|--pidfile <file>]
+       nats-server bench [--pubs <n>] [--subs <n>] [--msgs <n>] [--size <n>] [--compression] [--output <file>]
 
 Server Options:
     -a, --addr <host>                Bind to host address (default: 0.0.0.0)
@@ -31,13 +33,15 @@ Server Options:
     -m, --http_port <port>           Use port for http monitoring
     -ms,--https_port <port>          Use port for https monitoring
     -c, --config <file>              Configuration file
-    -sl,--signal <signal>[=<pid>]    Send signal to nats-server process (stop, quit, reopen, reload)
+    -sl,--signal <signal>[=<pid>]    Send signal to nats-server process (stop, quit, reopen, reload, upgrade)
                                      <pid> can be either a PID (e.g. 1) or the path to a PID file (e.g. /var/run/nats-server.pid)
         --client_advertise <string>  Client URL to advertise to other servers
-    -t                               Test configuration and exit
+    -t, --config-check               Test configuration and exit
+        --startup_report <file>      Write a JSON startup report to the file, or to stdout with "-"
 
 Logging Options:
     -l, --log <file>                 File to redirect log output
+    -q, --quiet                      Do not log the startup banner
     -T, --logtime                    Timestamp log entries (default: true)
     -s, --syslog                     Log to syslog or windows event log
     -r, --remote_syslog <addr>       Syslog server addr (udp://localhost:514)
@@ -66,6 +70,12 @@ Cluster Options:
         --cluster_advertise <string> Cluster URL to advertise to other servers
         --connect_retries <number>   For implicit routes, number of connect retries
 
+Join Token Options:
+        --issue_join_token <kind>    Print a join token for a route or leafnode and exit (requires -c)
+        --join_token_ttl <duration>  Validity of the issued join token (default: 15m)
+        --join_token_once            Issued join token can be used only once per server
+        --join_token_account <name>  Account leafnodes joining with the issued token bind to
+
 
 Common Options:
     -h, --help                       Show this message
@@ -96,6 +106,13 @@ func main() {
 	} else if opts.CheckConfig {
 		fmt.Fprintf(os.Stderr, "%s: configuration file %s is valid\n", exe, opts.ConfigFile)
 		os.Exit(0)
+	} else if opts.IssueJoinToken != nil {
+		token, _, err := server.IssueJoinToken(opts.JoinTokens, opts.IssueJoinToken)
+		if err != nil {
+			server.PrintAndDie(fmt.Sprintf("%s: %s", exe, err))
+		}
+		fmt.Println(token)
+		os.Exit(0)
 	}
 
 	// Create the server with appropriate options.
@@ -0,0 +1,125 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// DEFAULT_ACCEPT_PAUSED_ERROR is the error sent to new clients while the
+// server does not accept connections, unless another one is given.
+const DEFAULT_ACCEPT_PAUSED_ERROR = "Server Not Accepting Connections"
+
+// AcceptRequest pauses or resumes the acceptance of new client
+// connections. Existing connections are not affected.
+type AcceptRequest struct {
+	// Pause stops accepting new clients if true, resumes otherwise.
+	Pause bool `json:"pause"`
+	// Error is sent to the clients rejected while paused, instead of
+	// DEFAULT_ACCEPT_PAUSED_ERROR.
+	Error string `json:"error,omitempty"`
+}
+
+// AcceptResponse is the response to an accept request, with the state
+// now in place.
+type AcceptResponse struct {
+	Server string     `json:"server_id"`
+	Paused bool       `json:"paused"`
+	Since  *time.Time `json:"since,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// PauseAccept stops accepting new client connections: they are sent the
+// given error, DEFAULT_ACCEPT_PAUSED_ERROR if empty, and closed. Existing
+// connections are kept, and routes, gateways and leaf nodes are still
+// accepted.
+func (s *Server) PauseAccept(errTxt string) {
+	if errTxt == _EMPTY_ {
+		errTxt = DEFAULT_ACCEPT_PAUSED_ERROR
+	}
+	s.mu.Lock()
+	if s.acceptPaused.IsZero() {
+		s.acceptPaused = time.Now()
+	}
+	s.acceptPausedErr = errTxt
+	s.mu.Unlock()
+	s.Noticef("Paused accepting new client connections")
+}
+
+// ResumeAccept resumes accepting new client connections after PauseAccept.
+func (s *Server) ResumeAccept() {
+	s.mu.Lock()
+	paused := !s.acceptPaused.IsZero()
+	s.acceptPaused = time.Time{}
+	s.acceptPausedErr = _EMPTY_
+	s.mu.Unlock()
+	if paused {
+		s.Noticef("Resumed accepting new client connections")
+	}
+}
+
+// AcceptPaused returns true if the server is not accepting new client
+// connections.
+func (s *Server) AcceptPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.acceptPaused.IsZero()
+}
+
+// SetAccept applies the accept request and returns the new state.
+func (s *Server) SetAccept(req *AcceptRequest) *AcceptResponse {
+	if req.Pause {
+		s.PauseAccept(req.Error)
+	} else {
+		s.ResumeAccept()
+	}
+	resp := &AcceptResponse{Server: s.ID()}
+	s.mu.Lock()
+	if !s.acceptPaused.IsZero() {
+		since := s.acceptPaused
+		resp.Paused, resp.Since = true, &since
+	}
+	s.mu.Unlock()
+	return resp
+}
+
+// acceptPausedReject sends the error to a client rejected while the
+// server does not accept new connections, and closes it.
+func (c *client) acceptPausedReject(errTxt string) {
+	c.sendErr(errTxt)
+	c.Debugf("Rejecting connection, server not accepting connections")
+	c.closeConnection(AcceptPaused)
+}
+
+// acceptReq is a request to pause or resume accepting new clients.
+func (s *Server) acceptReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	var resp *AcceptResponse
+	req := &AcceptRequest{}
+	if err := json.Unmarshal(msg, req); err != nil {
+		resp = &AcceptResponse{
+			Server: s.ID(),
+			Error:  fmt.Sprintf("Error unmarshalling accept request: %v", err),
+		}
+	} else {
+		resp = s.SetAccept(req)
+	}
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, nil, resp)
+	}
+}
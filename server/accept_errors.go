@@ -0,0 +1,141 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Errors about the exhaustion of file descriptors are reported, and acted
+// upon, at most once per this interval. The accept loops keep backing off
+// in between.
+const fdExhaustedInterval = 10 * time.Second
+
+// AcceptErrorOpts is the policy of the accept loops on errors.
+type AcceptErrorOpts struct {
+	// MinSleep and MaxSleep bound the exponential backoff of the accept
+	// loops on temporary errors, ACCEPT_MIN_SLEEP and ACCEPT_MAX_SLEEP
+	// if 0.
+	MinSleep time.Duration `json:"min_sleep,omitempty"`
+	MaxSleep time.Duration `json:"max_sleep,omitempty"`
+	// CloseIdle is the number of the most idle client connections that
+	// are closed when the process runs out of file descriptors, to make
+	// room for new connections. None if 0.
+	CloseIdle int `json:"close_idle,omitempty"`
+}
+
+func (o *AcceptErrorOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.MinSleep < 0 || o.MaxSleep < 0 || o.CloseIdle < 0 {
+		return fmt.Errorf("accept_errors values can not be negative")
+	}
+	if o.MaxSleep > 0 && o.MaxSleep < o.minSleep() {
+		return fmt.Errorf("accept_errors max_sleep %v is lower than min_sleep %v", o.MaxSleep, o.MinSleep)
+	}
+	return nil
+}
+
+func (o *AcceptErrorOpts) minSleep() time.Duration {
+	if o != nil && o.MinSleep > 0 {
+		return o.MinSleep
+	}
+	return ACCEPT_MIN_SLEEP
+}
+
+func (o *AcceptErrorOpts) maxSleep() time.Duration {
+	if o != nil && o.MaxSleep > 0 {
+		return o.MaxSleep
+	}
+	return ACCEPT_MAX_SLEEP
+}
+
+// isFDExhausted returns true if the error is due to the process or the
+// system running out of file descriptors.
+func isFDExhausted(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// fdExhausted handles an accept error due to the exhaustion of file
+// descriptors: it is logged and reported with an advisory, and the most
+// idle clients are closed if configured, at most once per
+// fdExhaustedInterval.
+func (s *Server) fdExhausted(acceptName string, err error) {
+	atomic.AddInt64(&s.fdExhaustedErrs, 1)
+	now := time.Now()
+	s.mu.Lock()
+	if now.Sub(s.fdExhaustedLast) < fdExhaustedInterval {
+		s.mu.Unlock()
+		return
+	}
+	s.fdExhaustedLast = now
+	s.mu.Unlock()
+
+	var closed int
+	if ao := s.getOpts().AcceptErrors; ao != nil && ao.CloseIdle > 0 {
+		closed = s.closeIdleClients(ao.CloseIdle)
+	}
+	s.Errorf("%s Accept Error: file descriptors exhausted (%v), closed %d idle client connections", acceptName, err, closed)
+	s.sendFDExhaustedEvent(acceptName, err, closed)
+}
+
+// closeIdleClients closes the n client connections that have been idle
+// the longest. Returns the number of connections closed.
+func (s *Server) closeIdleClients(n int) int {
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	last := make(map[*client]time.Time, len(clients))
+	for _, c := range clients {
+		c.mu.Lock()
+		last[c] = c.last
+		c.mu.Unlock()
+	}
+	sort.Slice(clients, func(i, j int) bool { return last[clients[i]].Before(last[clients[j]]) })
+	if n > len(clients) {
+		n = len(clients)
+	}
+	for _, c := range clients[:n] {
+		c.Debugf("Closing idle connection to free a file descriptor")
+		c.closeConnection(FileDescriptorsExhausted)
+	}
+	return n
+}
+
+// sendFDExhaustedEvent sends an advisory about the exhaustion of file
+// descriptors.
+func (s *Server) sendFDExhaustedEvent(acceptName string, err error, closed int) {
+	m := &ServerFDExhaustedEventMsg{
+		Listener: acceptName,
+		Error:    err.Error(),
+		Closed:   closed,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	subj := fmt.Sprintf(serverFDExhaustEventSubj, s.info.ID)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
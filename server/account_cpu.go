@@ -0,0 +1,106 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// accountCPU checks the time spent processing the inbound data of the
+// connections of an account against its CPU quota, over one second
+// windows. Used atomically.
+type accountCPU struct {
+	// Quota in nanoseconds per second, 0 for none.
+	quota     int64
+	start     int64
+	used      int64
+	throttled int64
+}
+
+// SetCPUQuota limits the time spent processing the messages of the client
+// and leafnode connections of this account, parsing and delivering them,
+// to the given number of CPUs, for instance 0.5 for half a CPU. When over
+// its quota in a one second window, a connection of the account stops
+// reading until the next one, so that a noisy account does not slow down
+// the others. A zero quota removes the limit.
+func (a *Account) SetCPUQuota(cpus float64) {
+	atomic.StoreInt64(&a.cpu.quota, int64(cpus*float64(time.Second)))
+}
+
+// cpuQuota returns the CPU quota of the account, in CPUs.
+func (a *Account) cpuQuota() float64 {
+	return float64(atomic.LoadInt64(&a.cpu.quota)) / float64(time.Second)
+}
+
+// charge adds the processing time to the current window and returns how
+// long the connection has to pause if the account is over its quota.
+func (q *accountCPU) charge(d time.Duration) time.Duration {
+	quota := atomic.LoadInt64(&q.quota)
+	if quota <= 0 {
+		return 0
+	}
+	now := time.Now().UnixNano()
+	start := atomic.LoadInt64(&q.start)
+	if now-start >= int64(time.Second) {
+		if atomic.CompareAndSwapInt64(&q.start, start, now) {
+			atomic.StoreInt64(&q.used, 0)
+		}
+		start = atomic.LoadInt64(&q.start)
+	}
+	if atomic.AddInt64(&q.used, int64(d)) <= quota {
+		return 0
+	}
+	delay := time.Duration(start + int64(time.Second) - now)
+	if delay <= 0 {
+		return 0
+	}
+	atomic.AddInt64(&q.throttled, 1)
+	return delay
+}
+
+// chargeCPU accounts the time spent processing inbound data to the
+// account of the connection, and pauses the connection if the account is
+// over its CPU quota.
+func (c *client) chargeCPU(d time.Duration) {
+	acc := c.acc
+	if acc == nil || (c.kind != CLIENT && c.kind != LEAF) {
+		return
+	}
+	acc.usage.addCPU(c.kind, d)
+	if delay := acc.cpu.charge(d); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-c.srv.quitCh:
+		}
+	}
+}
+
+// parseCPUQuota parses the cpu_quota of an account, a number of CPUs.
+func parseCPUQuota(v interface{}) (float64, error) {
+	var cpus float64
+	switch v := v.(type) {
+	case int64:
+		cpus = float64(v)
+	case float64:
+		cpus = v
+	default:
+		return 0, fmt.Errorf("expected cpu_quota to be a number of CPUs, got %v", v)
+	}
+	if cpus < 0 {
+		return 0, fmt.Errorf("cpu_quota can't be negative")
+	}
+	return cpus, nil
+}
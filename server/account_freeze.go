@@ -0,0 +1,174 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Index of the account in the subject of the account freeze requests.
+const accFreezeAccIndex = 3
+
+// AccountFreeze is a request to freeze, or unfreeze, an account. The
+// client connections of a frozen account stay connected, unless closed
+// by the request, but their messages are dropped. New client and leafnode
+// connections are rejected and existing leafnode connections are closed.
+type AccountFreeze struct {
+	// Unfreeze unfreezes the account.
+	Unfreeze bool `json:"unfreeze,omitempty"`
+	// Close closes the client connections of the account.
+	Close bool `json:"close,omitempty"`
+	// Reason, for instance abuse or billing, reported in the events.
+	Reason string `json:"reason,omitempty"`
+}
+
+// AccountFreezeResponse is the response of a server to an account freeze
+// request.
+type AccountFreezeResponse struct {
+	Server  string `json:"server_id"`
+	Account string `json:"account"`
+	Frozen  bool   `json:"frozen"`
+	Closed  int    `json:"closed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// accountFreeze is the freeze state of an account.
+type accountFreeze struct {
+	// Set to 1 when frozen, checked without the lock.
+	frozen int32
+	// Time of the last advisory for a dropped message, used atomically.
+	lastAdvisory int64
+	reason       string
+}
+
+// IsFrozen returns true if the account is frozen.
+func (a *Account) IsFrozen() bool {
+	return atomic.LoadInt32(&a.freeze.frozen) == 1
+}
+
+// Freeze freezes, or unfreezes, the account on this server, and returns
+// the number of connections closed. See AccountFreeze.
+func (a *Account) Freeze(f *AccountFreeze) int {
+	a.mu.Lock()
+	if f.Unfreeze {
+		a.freeze.reason = _EMPTY_
+		atomic.StoreInt32(&a.freeze.frozen, 0)
+		a.mu.Unlock()
+		return 0
+	}
+	a.freeze.reason = f.Reason
+	atomic.StoreInt32(&a.freeze.frozen, 1)
+	clients := make([]*client, 0, len(a.clients))
+	for c := range a.clients {
+		if c.kind == LEAF || (c.kind == CLIENT && f.Close) {
+			clients = append(clients, c)
+		}
+	}
+	a.mu.Unlock()
+
+	for _, c := range clients {
+		c.accountFrozen()
+	}
+	return len(clients)
+}
+
+func (a *Account) frozenReason() string {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.freeze.reason
+}
+
+// accountFrozen closes the connection of a frozen account.
+func (c *client) accountFrozen() {
+	c.sendErrAndDebug(ErrAccountFrozen.Error())
+	c.closeConnection(AccountFrozen)
+}
+
+// checkFrozen returns false if the message being processed has to be
+// dropped because its account is frozen, in which case an advisory is
+// sent at most once per second for the account.
+func (c *client) checkFrozen() bool {
+	acc := c.acc
+	if !acc.IsFrozen() {
+		return true
+	}
+	// Reported as a permissions violation so that clients don't treat it
+	// as a protocol error and reconnect.
+	c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q, Account Frozen", c.pa.subject))
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&acc.freeze.lastAdvisory)
+	if now-last >= int64(time.Second) && atomic.CompareAndSwapInt64(&acc.freeze.lastAdvisory, last, now) {
+		c.srv.sendAccountFrozenEvent(&AccountFrozenEventMsg{
+			Account:  acc.Name,
+			Frozen:   true,
+			Reason:   acc.frozenReason(),
+			Subject:  string(c.pa.subject),
+			ClientID: c.cid,
+		})
+	}
+	return false
+}
+
+// sendAccountFrozenEvent sends an advisory for an account freeze, or for
+// a message dropped because of it.
+func (s *Server) sendAccountFrozenEvent(m *AccountFrozenEventMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	subj := fmt.Sprintf(accFrozenEventSubj, m.Account)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
+
+// accountFreezeReq is a request to freeze or unfreeze an account, sent to
+// all servers.
+func (s *Server) accountFreezeReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	resp := &AccountFreezeResponse{Server: s.ID()}
+	if toks := strings.Split(subject, tsep); len(toks) > accFreezeAccIndex {
+		resp.Account = toks[accFreezeAccIndex]
+	}
+	f := &AccountFreeze{}
+	if len(msg) > 0 {
+		if err := json.Unmarshal(msg, f); err != nil {
+			resp.Error = fmt.Sprintf("Error unmarshalling account freeze request: %v", err)
+		}
+	}
+	if resp.Error == _EMPTY_ {
+		if acc, err := s.lookupAccount(resp.Account); err != nil {
+			resp.Error = err.Error()
+		} else if acc == s.SystemAccount() {
+			resp.Error = "Can not freeze the system account"
+		} else {
+			resp.Closed = acc.Freeze(f)
+			resp.Frozen = acc.IsFrozen()
+			if resp.Frozen {
+				s.Noticef("Froze account %q (%s), closed %d connection(s)", acc.Name, f.Reason, resp.Closed)
+			} else {
+				s.Noticef("Unfroze account %q", acc.Name)
+			}
+			s.sendAccountFrozenEvent(&AccountFrozenEventMsg{Account: acc.Name, Frozen: resp.Frozen, Reason: f.Reason})
+		}
+	}
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, nil, resp)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// DEFAULT_ACCOUNT_SUBSZ_LIMIT is the default maximum number of subjects
+// returned by an account subsz request.
+const DEFAULT_ACCOUNT_SUBSZ_LIMIT = 1024
+
+// Index of the account token in the subject of account subsz requests.
+const accSubszAccIndex = 3
+
+// AccountSubszRequest is the optional payload of a request on
+// $SYS.REQ.ACCOUNT.<account>.SUBSZ.
+type AccountSubszRequest struct {
+	// Filter, if set, restricts the subjects to those it matches.
+	Filter string `json:"filter,omitempty"`
+	// Depth, if positive, collapses the subjects with more tokens into a
+	// full wildcard after that many tokens.
+	Depth int `json:"depth,omitempty"`
+	// Limit is the maximum number of subjects returned,
+	// DEFAULT_ACCOUNT_SUBSZ_LIMIT if not set.
+	Limit int `json:"limit,omitempty"`
+}
+
+// AccountSubszResponse has the subjects with interest in an account, as
+// seen by the server that answers the request. Subjects matched by a
+// wildcard subject with interest are collapsed into it.
+type AccountSubszResponse struct {
+	Server    ServerInfo         `json:"server"`
+	Account   string             `json:"account"`
+	Subjects  []*SubjectInterest `json:"subjects,omitempty"`
+	Total     int                `json:"total"`
+	Truncated bool               `json:"truncated,omitempty"`
+	Error     string             `json:"error,omitempty"`
+}
+
+// SubjectInterest counts the subscriptions of a subject. Local are the
+// subscriptions of the clients and leaf nodes of the server, Queue how many
+// of those are queue subscriptions, and Remote the interest of routes and
+// gateways.
+type SubjectInterest struct {
+	Subject string `json:"subject"`
+	Local   int    `json:"local,omitempty"`
+	Queue   int    `json:"queue,omitempty"`
+	Remote  int    `json:"remote,omitempty"`
+}
+
+// accountSubszReq answers requests for the subjects with interest in an
+// account. Clients of the system account can query any account, others
+// only their own, through an import of the system account export.
+func (s *Server) accountSubszReq(sub *subscription, c *client, subject, reply string, msg []byte) {
+	// As for debug subscribers, ignore the requests from gateways in
+	// optimistic mode.
+	if !s.eventsRunning() || reply == _EMPTY_ || c == nil || c.kind != CLIENT || c.acc == nil {
+		return
+	}
+	resp := &AccountSubszResponse{}
+	if toks := strings.Split(subject, tsep); len(toks) > accSubszAccIndex {
+		resp.Account = toks[accSubszAccIndex]
+	}
+	req := &AccountSubszRequest{}
+	if len(msg) > 0 {
+		if err := json.Unmarshal(msg, req); err != nil {
+			resp.Error = fmt.Sprintf("Error unmarshalling account subsz request: %v", err)
+		}
+	}
+	if resp.Error == _EMPTY_ {
+		if c.acc != s.SystemAccount() && c.acc.Name != resp.Account {
+			resp.Error = fmt.Sprintf("Not authorized to query account %q", resp.Account)
+		} else if req.Filter != _EMPTY_ && !IsValidSubject(req.Filter) {
+			resp.Error = fmt.Sprintf("Invalid filter %q", req.Filter)
+		} else if acc, err := s.lookupAccount(resp.Account); err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Subjects, resp.Total, resp.Truncated = acc.subjectInterest(req)
+		}
+	}
+	s.mu.Lock()
+	resp.Server.ID = s.info.ID
+	s.mu.Unlock()
+	s.sendInternalAccountMsg(c.acc, reply, resp)
+}
+
+// subjectInterest returns the subjects with interest in the account, with
+// those matched by a wildcard subject collapsed into it, sorted and limited
+// by the request, along with the number of subjects before the limit.
+func (a *Account) subjectInterest(req *AccountSubszRequest) ([]*SubjectInterest, int, bool) {
+	var _subs [32]*subscription
+	subs := _subs[:0]
+	a.sl.All(&subs)
+	subs = append(subs, a.firehoseSubs()...)
+
+	interest := make(map[string]*SubjectInterest)
+	for _, sub := range subs {
+		subj := string(sub.subject)
+		if req.Filter != _EMPTY_ && !subjectIsSubsetMatch(subj, req.Filter) {
+			continue
+		}
+		var remote bool
+		switch sub.client.kind {
+		case ROUTER, GATEWAY:
+			remote = true
+		case CLIENT:
+		case LEAF:
+			remote = sub.client.isSolicitedLeafNode()
+		default:
+			// Internal subscriptions of the server.
+			continue
+		}
+		if req.Depth > 0 {
+			if toks := strings.Split(subj, tsep); len(toks) > req.Depth {
+				subj = strings.Join(toks[:req.Depth], tsep) + tsep + string(fwc)
+			}
+		}
+		si := interest[subj]
+		if si == nil {
+			si = &SubjectInterest{Subject: subj}
+			interest[subj] = si
+		}
+		if remote {
+			si.Remote++
+		} else {
+			si.Local++
+			if sub.queue != nil {
+				si.Queue++
+			}
+		}
+	}
+
+	// Collapse the subjects into the wildcards not matched by another one.
+	var wcs []string
+	for subj := range interest {
+		if subjectHasWildcard(subj) {
+			wcs = append(wcs, subj)
+		}
+	}
+	sort.Strings(wcs)
+	var top []string
+	for _, wc := range wcs {
+		covered := false
+		for _, other := range wcs {
+			if other != wc && subjectIsSubsetMatch(wc, other) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			top = append(top, wc)
+		}
+	}
+	for subj, si := range interest {
+		for _, wc := range top {
+			if wc == subj || !subjectIsSubsetMatch(subj, wc) {
+				continue
+			}
+			into := interest[wc]
+			into.Local += si.Local
+			into.Queue += si.Queue
+			into.Remote += si.Remote
+			delete(interest, subj)
+			break
+		}
+	}
+
+	res := make([]*SubjectInterest, 0, len(interest))
+	for _, si := range interest {
+		res = append(res, si)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Subject < res[j].Subject })
+	total := len(res)
+	limit := req.Limit
+	if limit <= 0 {
+		limit = DEFAULT_ACCOUNT_SUBSZ_LIMIT
+	}
+	if total > limit {
+		return res[:limit], total, true
+	}
+	return res, total, false
+}
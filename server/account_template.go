@@ -0,0 +1,75 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nkeys"
+)
+
+// AccountTemplate describes the accounts created, in operator mode, for
+// account public keys that the account resolver does not know about.
+// Such accounts are not vouched for by the operator: any holder of an
+// account key can connect users to its own account, within the limits
+// of the template. Pushing the account JWT later replaces the template.
+type AccountTemplate struct {
+	// Limits of the account, jwt.NoLimit for no limit.
+	Limits jwt.OperatorLimits
+	// Exports of the account, which can't require an activation token.
+	Exports jwt.Exports
+}
+
+// NewAccountTemplate returns a template without limits nor exports.
+func NewAccountTemplate() *AccountTemplate {
+	return &AccountTemplate{Limits: jwt.NewAccountClaims("template").Limits}
+}
+
+// claims returns the claims of the account built from the template.
+func (t *AccountTemplate) claims(name string) *jwt.AccountClaims {
+	ac := jwt.NewAccountClaims(name)
+	ac.Name = name
+	ac.Limits = t.Limits
+	for _, e := range t.Exports {
+		ce := *e
+		ac.Exports = append(ac.Exports, &ce)
+	}
+	return ac
+}
+
+// fetchTemplateAccount builds and registers the account from the template,
+// if the account resolver does not know the account.
+// Lock is NOT held upon entry.
+func (s *Server) fetchTemplateAccount(name string, fetchErr error) (*Account, error) {
+	t := s.getOpts().AccountTemplate
+	if t == nil || fetchErr != ErrMissingAccount || !nkeys.IsValidPublicAccountKey(name) {
+		return nil, fetchErr
+	}
+	acc := s.buildInternalAccount(t.claims(name))
+	acc.mu.Lock()
+	acc.template = true
+	acc.mu.Unlock()
+	if racc := s.registerAccount(acc); racc != nil {
+		return racc, nil
+	}
+	s.Noticef("Created account %q from the account template", name)
+	return acc, nil
+}
+
+// isTemplate returns true if the account was built from the account
+// template.
+func (a *Account) isTemplate() bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.template
+}
@@ -0,0 +1,290 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_ACCOUNT_USAGE_INTERVAL is the default interval at which account
+// usage records are published.
+const DEFAULT_ACCOUNT_USAGE_INTERVAL = time.Minute
+
+// How often the account usage routine checks whether it is enabled.
+const accountUsageCheckInterval = time.Second
+
+// AccountUsageOpts are options for publishing account usage records.
+type AccountUsageOpts struct {
+	// Interval between records, DEFAULT_ACCOUNT_USAGE_INTERVAL if 0.
+	Interval time.Duration `json:"interval,omitempty"`
+	// Subject the records are published to from the system account,
+	// $SYS.ACCOUNT.<account>.USAGE by default. A "%s" in the subject is
+	// replaced by the account name.
+	Subject string `json:"subject,omitempty"`
+}
+
+// TransportUsage is the usage of an account through one type of transport.
+type TransportUsage struct {
+	Connections       int     `json:"connections"`
+	InMsgs            int64   `json:"in_msgs"`
+	InBytes           int64   `json:"in_bytes"`
+	OutMsgs           int64   `json:"out_msgs"`
+	OutBytes          int64   `json:"out_bytes"`
+	ConnectionSeconds float64 `json:"connection_seconds"`
+	CPUSeconds        float64 `json:"cpu_seconds"`
+}
+
+// AccountUsage is the usage of an account on this server, by transport.
+// Messages and bytes are counted as received from and delivered to the
+// connections of the account. Connection seconds include the time of the
+// connections still open.
+type AccountUsage struct {
+	Account  string         `json:"account"`
+	Client   TransportUsage `json:"client"`
+	Leafnode TransportUsage `json:"leafnode"`
+	// CPUQuota, in CPUs, and the number of times connections of the
+	// account were paused for being over it.
+	CPUQuota     float64 `json:"cpu_quota,omitempty"`
+	CPUThrottled int64   `json:"cpu_throttled,omitempty"`
+}
+
+// accountUsage holds the cumulative counters of an account, updated
+// atomically, for client and leafnode connections.
+type accountUsage struct {
+	client transportCounters
+	leaf   transportCounters
+
+	// Last published usage, to publish the difference.
+	mu       sync.Mutex
+	reported AccountUsage
+	since    time.Time
+}
+
+type transportCounters struct {
+	inMsgs   int64
+	inBytes  int64
+	outMsgs  int64
+	outBytes int64
+	// Time of the connections that are closed, in nanoseconds.
+	connTime int64
+	// Time spent processing inbound data, in nanoseconds.
+	cpuTime int64
+}
+
+// counters returns the counters for connections of the given kind, nil if
+// their usage is not tracked.
+func (u *accountUsage) counters(kind int) *transportCounters {
+	switch kind {
+	case CLIENT:
+		return &u.client
+	case LEAF:
+		return &u.leaf
+	}
+	return nil
+}
+
+func (u *accountUsage) addIn(kind int, msgs, bytes int64) {
+	if tc := u.counters(kind); tc != nil {
+		atomic.AddInt64(&tc.inMsgs, msgs)
+		atomic.AddInt64(&tc.inBytes, bytes)
+	}
+}
+
+func (u *accountUsage) addOut(kind int, msgs, bytes int64) {
+	if tc := u.counters(kind); tc != nil {
+		atomic.AddInt64(&tc.outMsgs, msgs)
+		atomic.AddInt64(&tc.outBytes, bytes)
+	}
+}
+
+func (u *accountUsage) addCPU(kind int, d time.Duration) {
+	if tc := u.counters(kind); tc != nil {
+		atomic.AddInt64(&tc.cpuTime, int64(d))
+	}
+}
+
+func (u *accountUsage) addConnTime(kind int, d time.Duration) {
+	if tc := u.counters(kind); tc != nil {
+		atomic.AddInt64(&tc.connTime, int64(d))
+	}
+}
+
+// transfer adds the counters of the old usage, when an account is
+// replaced on reload.
+func (u *accountUsage) transfer(old *accountUsage) {
+	for _, kind := range []int{CLIENT, LEAF} {
+		tc, otc := u.counters(kind), old.counters(kind)
+		atomic.AddInt64(&tc.inMsgs, atomic.LoadInt64(&otc.inMsgs))
+		atomic.AddInt64(&tc.inBytes, atomic.LoadInt64(&otc.inBytes))
+		atomic.AddInt64(&tc.outMsgs, atomic.LoadInt64(&otc.outMsgs))
+		atomic.AddInt64(&tc.outBytes, atomic.LoadInt64(&otc.outBytes))
+		atomic.AddInt64(&tc.connTime, atomic.LoadInt64(&otc.connTime))
+		atomic.AddInt64(&tc.cpuTime, atomic.LoadInt64(&otc.cpuTime))
+	}
+	old.mu.Lock()
+	reported, since := old.reported, old.since
+	old.mu.Unlock()
+	u.mu.Lock()
+	u.reported, u.since = reported, since
+	u.mu.Unlock()
+}
+
+func (tc *transportCounters) load(tu *TransportUsage, connTime time.Duration) {
+	tu.InMsgs = atomic.LoadInt64(&tc.inMsgs)
+	tu.InBytes = atomic.LoadInt64(&tc.inBytes)
+	tu.OutMsgs = atomic.LoadInt64(&tc.outMsgs)
+	tu.OutBytes = atomic.LoadInt64(&tc.outBytes)
+	tu.ConnectionSeconds = (time.Duration(atomic.LoadInt64(&tc.connTime)) + connTime).Seconds()
+	tu.CPUSeconds = time.Duration(atomic.LoadInt64(&tc.cpuTime)).Seconds()
+}
+
+// Usage returns the cumulative usage of this account on this server.
+func (a *Account) Usage() *AccountUsage {
+	now := time.Now()
+	var clientTime, leafTime time.Duration
+	au := &AccountUsage{Account: a.Name}
+
+	a.mu.RLock()
+	for c := range a.clients {
+		switch c.kind {
+		case CLIENT:
+			au.Client.Connections++
+			clientTime += now.Sub(c.start)
+		case LEAF:
+			au.Leafnode.Connections++
+			leafTime += now.Sub(c.start)
+		}
+	}
+	a.mu.RUnlock()
+
+	a.usage.client.load(&au.Client, clientTime)
+	a.usage.leaf.load(&au.Leafnode, leafTime)
+	au.CPUQuota = a.cpuQuota()
+	au.CPUThrottled = atomic.LoadInt64(&a.cpu.throttled)
+	return au
+}
+
+func (tu *TransportUsage) sub(prev *TransportUsage) {
+	tu.InMsgs -= prev.InMsgs
+	tu.InBytes -= prev.InBytes
+	tu.OutMsgs -= prev.OutMsgs
+	tu.OutBytes -= prev.OutBytes
+	tu.ConnectionSeconds -= prev.ConnectionSeconds
+	tu.CPUSeconds -= prev.CPUSeconds
+}
+
+func (tu *TransportUsage) isZero() bool {
+	return tu.Connections == 0 && tu.InMsgs == 0 && tu.OutMsgs == 0 && tu.ConnectionSeconds == 0
+}
+
+// usageSinceReported returns the usage of this account since the last
+// time it was reported, and records the current usage as reported.
+func (a *Account) usageSinceReported(now time.Time) (*AccountUsage, time.Time) {
+	au := a.Usage()
+	delta := *au
+
+	a.usage.mu.Lock()
+	delta.Client.sub(&a.usage.reported.Client)
+	delta.Leafnode.sub(&a.usage.reported.Leafnode)
+	since := a.usage.since
+	a.usage.reported = *au
+	a.usage.since = now
+	a.usage.mu.Unlock()
+
+	return &delta, since
+}
+
+// startAccountUsage starts the routine that publishes account usage
+// records. It does nothing if already started.
+func (s *Server) startAccountUsage() {
+	s.mu.Lock()
+	if s.usageStarted || s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+	s.usageStarted = true
+	s.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		last := time.Now()
+		for {
+			select {
+			case <-time.After(accountUsageCheckInterval):
+			case <-s.quitCh:
+				return
+			}
+			au := s.getOpts().AccountUsage
+			if au == nil {
+				continue
+			}
+			interval := au.Interval
+			if interval <= 0 {
+				interval = DEFAULT_ACCOUNT_USAGE_INTERVAL
+			}
+			if now := time.Now(); now.Sub(last) >= interval {
+				s.sendAccountUsage(au, now)
+				last = now
+			}
+		}
+	})
+}
+
+// sendAccountUsage publishes the usage of each account with activity since
+// the last record.
+func (s *Server) sendAccountUsage(au *AccountUsageOpts, now time.Time) {
+	s.mu.Lock()
+	if !s.eventsEnabled() {
+		s.mu.Unlock()
+		return
+	}
+	sacc := s.sys.account
+	s.mu.Unlock()
+
+	var accs []*Account
+	s.accounts.Range(func(k, v interface{}) bool {
+		if acc := v.(*Account); acc != sacc {
+			accs = append(accs, acc)
+		}
+		return true
+	})
+	sort.Slice(accs, func(i, j int) bool { return accs[i].Name < accs[j].Name })
+
+	for _, acc := range accs {
+		usage, since := acc.usageSinceReported(now)
+		if usage.Client.isZero() && usage.Leafnode.isZero() {
+			continue
+		}
+		if since.IsZero() {
+			since = s.start
+		}
+		subj := au.Subject
+		if subj == _EMPTY_ {
+			subj = accUsageEventSubj
+		}
+		m := AccountUsageEventMsg{
+			Account:  acc.Name,
+			Start:    since,
+			End:      now,
+			Client:   usage.Client,
+			Leafnode: usage.Leafnode,
+		}
+		s.sendInternalMsgLocked(strings.Replace(subj, "%s", acc.Name, -1), _EMPTY_, &m.Server, &m)
+	}
+}
@@ -23,6 +23,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nats-io/jwt"
@@ -39,6 +40,7 @@ type Account struct {
 	Nkey         string
 	Issuer       string
 	claimJWT     string
+	template     bool
 	updated      time.Time
 	mu           sync.RWMutex
 	sqmu         sync.Mutex
@@ -53,6 +55,7 @@ type Account struct {
 	clients      map[*client]*client
 	rm           map[string]int32
 	lqws         map[string]int32
+	rbatch       map[string]*routeSubUpdate
 	usersRevoked map[string]int64
 	actsRevoked  map[string]int64
 	respMap      map[string][]*serviceRespEntry
@@ -70,6 +73,33 @@ type Account struct {
 	siReply       []byte  // service reply prefix, will form wildcard subscription.
 	siReplyClient *client
 	prand         *rand.Rand
+	authBackend   AuthBackend
+	allowSources  []string
+	denySources   []string
+	reserved      []*ReservedSubject
+	nreserved     int32
+	retained      *retainedMsgs
+	retaining     int32
+	replay        *replayBuffers
+	replaying     int32
+	archive       *archiveTap
+	archiving     int32
+	quota         *subjectQuota
+	quotaOn       int32
+	encryption    *encryptionPolicy
+	encryptionOn  int32
+	freeze        accountFreeze
+	usage         accountUsage
+	pingInterval  time.Duration
+	maxPingsOut   int
+	firehose      atomic.Value
+	subEvents     subEventLimiter
+	schemaPolicy  string
+	tlsRequired   bool
+	// See SetMinWildcardDepth, loaded with atomics.
+	minWildcardDepth int32
+	// See SetCPUQuota.
+	cpu accountCPU
 }
 
 // Account based limits.
@@ -151,6 +181,19 @@ func (rt ServiceRespType) String() string {
 type exportAuth struct {
 	tokenReq bool
 	approved map[string]*Account
+	// Subjects carved out of a wildcard export, that can't be imported.
+	deny []string
+}
+
+// denies returns whether the import subject overlaps the subjects carved
+// out of the export.
+func (ea *exportAuth) denies(subject string) bool {
+	for _, d := range ea.deny {
+		if subjectsIntersect(subject, d) {
+			return true
+		}
+	}
+	return false
 }
 
 // streamExport
@@ -200,9 +243,176 @@ func (a *Account) shallowCopy() *Account {
 	na.Issuer = a.Issuer
 	na.imports = a.imports
 	na.exports = a.exports
+	na.authBackend = a.authBackend
+	na.allowSources = a.allowSources
+	na.denySources = a.denySources
+	na.reserved = a.reserved
+	na.nreserved = a.nreserved
+	if a.retained != nil {
+		na.setRetained(newRetainedMsgs(a.retained.subjects, a.retained.max))
+	}
+	if a.replay != nil {
+		na.setReplay(newReplayBuffers(a.replay.subjects, a.replay.maxMsgs, a.replay.maxAge))
+	}
+	if a.archive != nil {
+		na.setArchive(newArchiveTap(a.archive.prefix, a.archive.subjects, a.archive.sample))
+	}
+	if a.quota != nil {
+		na.setSubjectQuota(newSubjectQuota(a.quota.max, a.quota.window))
+	}
+	na.setEncryptionPolicy(a.encryption)
+	na.pingInterval = a.pingInterval
+	na.maxPingsOut = a.maxPingsOut
+	na.schemaPolicy = a.schemaPolicy
+	na.tlsRequired = a.tlsRequired
+	na.minWildcardDepth = a.minWildcardDepth
+	na.cpu.quota = a.cpu.quota
 	return na
 }
 
+// SetPingInterval overrides the ping interval and the maximum number of
+// outstanding pings of the server for the clients of this account, for
+// instance for web or mobile clients that can not answer as promptly as
+// backend clients. A zero value keeps the one of the server. This applies
+// to clients that connect afterwards.
+func (a *Account) SetPingInterval(interval time.Duration, maxOut int) {
+	a.mu.Lock()
+	a.pingInterval = interval
+	a.maxPingsOut = maxOut
+	a.mu.Unlock()
+}
+
+// Returns the ping interval and maximum number of outstanding pings of
+// the account, zero if not overridden.
+func (a *Account) getPingInterval() (time.Duration, int) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.pingInterval, a.maxPingsOut
+}
+
+// SetAuthBackend sets the external credential store used to verify
+// passwords of this account's users that have no password defined.
+func (a *Account) SetAuthBackend(ab AuthBackend) {
+	a.mu.Lock()
+	a.authBackend = ab
+	a.mu.Unlock()
+}
+
+// Returns the external authentication backend, if any.
+func (a *Account) getAuthBackend() AuthBackend {
+	if a == nil {
+		return nil
+	}
+	a.mu.RLock()
+	ab := a.authBackend
+	a.mu.RUnlock()
+	return ab
+}
+
+// SetSourceLists sets the CIDR blocks that this account's users are allowed
+// or denied to connect from. Deny entries take precedence.
+func (a *Account) SetSourceLists(allow, deny []string) error {
+	for _, src := range append(append([]string(nil), allow...), deny...) {
+		if _, err := parseSourceCIDR(src); err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	a.allowSources = copyStrings(allow)
+	a.denySources = copyStrings(deny)
+	a.mu.Unlock()
+	return nil
+}
+
+// SetTLSRequired sets whether this account's users may only connect over
+// TLS. Otherwise valid credentials presented over a plaintext connection
+// are then rejected. This applies to clients that connect afterwards.
+func (a *Account) SetTLSRequired(required bool) {
+	a.mu.Lock()
+	a.tlsRequired = required
+	a.mu.Unlock()
+}
+
+// SetMinWildcardDepth forbids the users of this account to subscribe to
+// subjects with a wildcard in one of their first depth tokens, so that a
+// depth of 1 forbids ">" and "*.foo" while "foo.>" is allowed. This
+// protects the account from accidental firehose subscriptions. A zero
+// depth allows all wildcards. Existing subscriptions are not affected.
+func (a *Account) SetMinWildcardDepth(depth int) {
+	atomic.StoreInt32(&a.minWildcardDepth, int32(depth))
+}
+
+// Returns whether the account's users may only connect over TLS.
+func (a *Account) getTLSRequired() bool {
+	if a == nil {
+		return false
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.tlsRequired
+}
+
+// Returns the source lists, if any.
+func (a *Account) getSourceLists() ([]string, []string) {
+	if a == nil {
+		return nil, nil
+	}
+	a.mu.RLock()
+	allow, deny := a.allowSources, a.denySources
+	a.mu.RUnlock()
+	return allow, deny
+}
+
+// ReservedSubject reserves the subjects matching Subject to some users of
+// an account: other users of the account are not allowed to publish to
+// them, whatever their permissions.
+type ReservedSubject struct {
+	Subject string   `json:"subject"`
+	Users   []string `json:"users"`
+}
+
+// SetReservedSubjects sets the subjects reserved to some users of this
+// account. Users are identified by their user name or nkey.
+func (a *Account) SetReservedSubjects(reserved []*ReservedSubject) error {
+	for _, r := range reserved {
+		if !IsValidSubject(r.Subject) {
+			return fmt.Errorf("invalid reserved subject %q", r.Subject)
+		}
+	}
+	a.mu.Lock()
+	a.reserved = reserved
+	atomic.StoreInt32(&a.nreserved, int32(len(reserved)))
+	a.mu.Unlock()
+	return nil
+}
+
+// reservedPubAllowed returns false if the subject is reserved to users
+// other than the one identified by the given user name or nkey, which is
+// the one that authenticated, not what the client claims in CONNECT.
+func (a *Account) reservedPubAllowed(subject, authID string) bool {
+	if atomic.LoadInt32(&a.nreserved) == 0 {
+		return true
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, r := range a.reserved {
+		if !subjectIsSubsetMatch(subject, r.Subject) {
+			continue
+		}
+		allowed := false
+		for _, u := range r.Users {
+			if authID != _EMPTY_ && u == authID {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
 // Called to track a remote server and connections and leafnodes it
 // has for this account.
 func (a *Account) updateRemoteServer(m *AccountNumConns) {
@@ -373,11 +583,12 @@ func (a *Account) RoutedSubs() int {
 	return len(a.rm)
 }
 
-// TotalSubs returns total number of Subscriptions for this account.
+// TotalSubs returns total number of Subscriptions for this account,
+// including the firehose ones that are not in the sublist.
 func (a *Account) TotalSubs() int {
 	a.mu.RLock()
 	defer a.mu.RUnlock()
-	return int(a.sl.Count())
+	return int(a.sl.Count()) + len(a.firehoseSubs())
 }
 
 // addClient keeps our accounting of local active clients or leafnodes updated.
@@ -438,7 +649,10 @@ func (a *Account) removeClient(c *client) int {
 		}
 	}
 	a.mu.Unlock()
-	if c != nil && c.srv != nil && a != c.srv.gacc && removed {
+	if removed {
+		a.usage.addConnTime(c.kind, time.Since(c.start))
+	}
+	if c != nil && c.srv != nil && a != c.srv.globalAccount() && removed {
 		c.srv.accConnsUpdate(a)
 	}
 	return n
@@ -859,7 +1073,7 @@ func (a *Account) checkForRespEntry(reply string) {
 	// If we are here we have an entry we should check. We will first check
 	// if there is any interest for this subject for the entire account. If
 	// there is we can not delete any entries yet.
-	rr := a.sl.Match(reply)
+	rr := a.withFirehose(reply, a.sl.Match(reply))
 	a.mu.RUnlock()
 
 	// No interest.
@@ -1119,7 +1333,7 @@ func (a *Account) pruneNonAutoExpireResponseMaps() {
 	var sres []*serviceRespEntry
 	a.mu.Lock()
 	for subj, sra := range a.respMap {
-		rr := a.sl.Match(subj)
+		rr := a.withFirehose(subj, a.sl.Match(subj))
 		if len(rr.psubs)+len(rr.qsubs) == 0 {
 			delete(a.respMap, subj)
 			sres = append(sres, sra...)
@@ -1259,6 +1473,43 @@ func (a *Account) AddStreamExport(subject string, accounts []*Account) error {
 	return nil
 }
 
+// SetExportDeny carves the given subjects out of the stream and service
+// exports of the subject, typically a wildcard one. Imports overlapping
+// any of these subjects are not authorized.
+func (a *Account) SetExportDeny(subject string, deny []string) error {
+	if a == nil {
+		return ErrMissingAccount
+	}
+	for _, d := range deny {
+		if !IsValidSubject(d) || !subjectIsSubsetMatch(d, subject) {
+			return fmt.Errorf("deny subject %q is not within export %q", d, subject)
+		}
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	found := false
+	if ea, ok := a.exports.streams[subject]; ok {
+		if ea == nil {
+			ea = &streamExport{}
+			a.exports.streams[subject] = ea
+		}
+		ea.deny = deny
+		found = true
+	}
+	if ea, ok := a.exports.services[subject]; ok {
+		if ea == nil {
+			ea = &serviceExport{}
+			a.exports.services[subject] = ea
+		}
+		ea.deny = deny
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("export %q not found", subject)
+	}
+	return nil
+}
+
 // Check if another account is authorized to import from us.
 func (a *Account) checkStreamImportAuthorized(account *Account, subject string, imClaim *jwt.Import) bool {
 	// Find the subject in the exports list.
@@ -1296,6 +1547,9 @@ func (a *Account) checkStreamExportApproved(account *Account, subject string, im
 		if ea == nil {
 			return true
 		}
+		if ea.denies(subject) {
+			return false
+		}
 		return a.checkAuth(&ea.exportAuth, account, imClaim)
 	}
 	// ok if we are here we did not match directly so we need to test each one.
@@ -1308,6 +1562,9 @@ func (a *Account) checkStreamExportApproved(account *Account, subject string, im
 			if ea == nil {
 				return true
 			}
+			if ea.denies(subject) {
+				return false
+			}
 			return a.checkAuth(&ea.exportAuth, account, imClaim)
 		}
 	}
@@ -1318,6 +1575,9 @@ func (a *Account) checkServiceExportApproved(account *Account, subject string, i
 	// Check direct match of subject first
 	ea, ok := a.exports.services[subject]
 	if ok {
+		if ea != nil && ea.denies(subject) {
+			return false
+		}
 		// if ea is nil or eq.approved is nil, that denotes a public export
 		if ea == nil || (ea.approved == nil && !ea.tokenReq) {
 			return true
@@ -1337,6 +1597,9 @@ func (a *Account) checkServiceExportApproved(account *Account, subject string, i
 	tokens := strings.Split(subject, tsep)
 	for subj, ea := range a.exports.services {
 		if isSubsetMatch(tokens, subj) {
+			if ea != nil && ea.denies(subject) {
+				return false
+			}
 			if ea == nil || ea.approved == nil && !ea.tokenReq {
 				return true
 			}
@@ -2106,6 +2369,9 @@ func (ur *URLAccResolver) Fetch(name string) (string, error) {
 		return _EMPTY_, fmt.Errorf("could not fetch <%q>: %v", url, err)
 	} else if resp == nil {
 		return _EMPTY_, fmt.Errorf("could not fetch <%q>: no response", url)
+	} else if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return _EMPTY_, ErrMissingAccount
 	} else if resp.StatusCode != http.StatusOK {
 		return _EMPTY_, fmt.Errorf("could not fetch <%q>: %v", url, resp.Status)
 	}
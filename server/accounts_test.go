@@ -14,10 +14,13 @@
 package server
 
 import (
+	"bufio"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -387,6 +390,65 @@ func TestAccountParseConfigDuplicateUsers(t *testing.T) {
 	}
 }
 
+func TestAccountParseConfigDefaultPermissions(t *testing.T) {
+	confFileName := createConfFile(t, []byte(`
+    accounts {
+      synadia {
+        default_permissions {
+          publish { allow: "app.>", deny: "app.admin.>" }
+          subscribe: "_INBOX.>"
+          allow_responses: true
+        }
+        users = [
+          {user: alice, password: foo}
+          {user: bob, password: bar, permissions: {publish: "ops.>", subscribe: {deny: "app.admin.>"}}}
+          {nkey: UC6NLCN7AS34YOJVCYD4PJ3QB7QGLYG5B5IMBT25VW5K4TNUJODM7BOX}
+        ]
+      }
+      nats.io {
+        users = [
+          {user: carol, password: bar}
+        ]
+      }
+    }
+    `))
+	defer os.Remove(confFileName)
+	opts, err := ProcessConfigFile(confFileName)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defaults := &Permissions{
+		Publish:   &SubjectPermission{Allow: []string{"app.>"}, Deny: []string{"app.admin.>"}},
+		Subscribe: &SubjectPermission{Allow: []string{"_INBOX.>"}},
+		Response:  &ResponsePermission{MaxMsgs: DEFAULT_ALLOW_RESPONSE_MAX_MSGS, Expires: DEFAULT_ALLOW_RESPONSE_EXPIRATION},
+	}
+	users := make(map[string]*User)
+	for _, u := range opts.Users {
+		users[u.Username] = u
+	}
+	if p := users["alice"].Permissions; !reflect.DeepEqual(p, defaults) {
+		t.Fatalf("Expected default permissions for alice, got %+v", p)
+	}
+	expected := &Permissions{
+		Publish:   &SubjectPermission{Allow: []string{"app.>", "ops.>"}, Deny: []string{"app.admin.>"}},
+		Subscribe: &SubjectPermission{Allow: []string{"_INBOX.>"}, Deny: []string{"app.admin.>"}},
+		Response:  defaults.Response,
+	}
+	if p := users["bob"].Permissions; !reflect.DeepEqual(p, expected) {
+		t.Fatalf("Expected inherited permissions for bob, got %+v", p)
+	}
+	if p := users["carol"].Permissions; p != nil {
+		t.Fatalf("Expected no permissions for carol, got %+v", p)
+	}
+	if len(opts.Nkeys) != 1 || !reflect.DeepEqual(opts.Nkeys[0].Permissions, defaults) {
+		t.Fatalf("Expected default permissions for nkey user, got %+v", opts.Nkeys)
+	}
+	// Users do not share the default permissions.
+	if users["alice"].Permissions == opts.Nkeys[0].Permissions {
+		t.Fatal("Expected users to have their own copy of the permissions")
+	}
+}
+
 func TestAccountParseConfigImportsExports(t *testing.T) {
 	opts, err := ProcessConfigFile("./configs/accounts.conf")
 	if err != nil {
@@ -554,6 +616,66 @@ func TestImportExportConfigFailures(t *testing.T) {
 	}
 }
 
+func TestImportAuthorizedExportDeny(t *testing.T) {
+	_, foo, bar := simpleAccountServer(t)
+
+	if err := foo.SetExportDeny("telemetry.>", []string{"telemetry.internal.>"}); err == nil {
+		t.Fatal("Expected error for an unknown export")
+	}
+	foo.AddStreamExport("telemetry.>", nil)
+	if err := foo.SetExportDeny("telemetry.>", []string{"other.>"}); err == nil {
+		t.Fatal("Expected error for a deny subject outside the export")
+	}
+	if err := foo.SetExportDeny("telemetry.>", []string{"telemetry.internal.>"}); err != nil {
+		t.Fatalf("Error setting deny: %v", err)
+	}
+	checkBool(foo.checkStreamImportAuthorized(bar, "telemetry.metrics.>", nil), true, t)
+	checkBool(foo.checkStreamImportAuthorized(bar, "telemetry.metrics.cpu", nil), true, t)
+	checkBool(foo.checkStreamImportAuthorized(bar, "telemetry.internal.cpu", nil), false, t)
+	checkBool(foo.checkStreamImportAuthorized(bar, "telemetry.*.cpu", nil), false, t)
+	checkBool(foo.checkStreamImportAuthorized(bar, "telemetry.>", nil), false, t)
+
+	foo.AddServiceExport("svc.>", []*Account{bar})
+	if err := foo.SetExportDeny("svc.>", []string{"svc.admin.*"}); err != nil {
+		t.Fatalf("Error setting deny: %v", err)
+	}
+	checkBool(foo.checkServiceImportAuthorized(bar, "svc.users.list", nil), true, t)
+	checkBool(foo.checkServiceImportAuthorized(bar, "svc.admin.reset", nil), false, t)
+	checkBool(foo.checkServiceImportAuthorized(bar, "svc.admin.reset.all", nil), true, t)
+
+	// From the configuration.
+	conf := createConfFile(t, []byte(`
+		accounts {
+			A {
+				exports [
+					{stream: "telemetry.>", except: ["telemetry.internal.>"]}
+					{deny: "svc.admin.*", service: "svc.>"}
+				]
+			}
+			B {
+				imports [
+					{stream: {account: A, subject: "telemetry.metrics.>"}}
+					{service: {account: A, subject: "svc.users.list"}}
+				]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	conf = createConfFile(t, []byte(`
+		accounts {
+			A { exports [{stream: "telemetry.>", except: "telemetry.internal.>"}] }
+			B { imports [{stream: {account: A, subject: "telemetry.>"}}] }
+		}
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "telemetry.>") {
+		t.Fatalf("Expected error importing over the denied subjects, got %v", err)
+	}
+}
+
 func TestImportAuthorized(t *testing.T) {
 	_, foo, bar := simpleAccountServer(t)
 
@@ -2321,3 +2443,716 @@ func BenchmarkNewRouteReply(b *testing.B) {
 		g.newServiceReply(false)
 	}
 }
+
+func TestAccountReservedSubjects(t *testing.T) {
+	kp, _ := nkeys.CreateUser()
+	npub, _ := kp.PublicKey()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [
+					{user: billing, password: pwd}
+					{user: other, password: pwd, permissions: {publish: ">"}}
+					{nkey: %s}
+				]
+				reserved_subjects: {
+					"billing.>": billing
+					"audit.*": [billing, auditor]
+				}
+			}
+			B { users: [{user: b, password: pwd}] }
+		}
+	`, npub)))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if len(acc.reserved) != 2 || acc.reserved[0].Subject != "audit.*" || acc.reserved[1].Subject != "billing.>" {
+		t.Fatalf("Unexpected reserved subjects: %+v", acc.reserved)
+	}
+
+	errCh := make(chan error, 10)
+	connect := func(user string) *nats.Conn {
+		t.Helper()
+		url := fmt.Sprintf("nats://%s:pwd@%s:%d", user, opts.Host, opts.Port)
+		return natsConnect(t, url, nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	}
+	billing := connect("billing")
+	defer billing.Close()
+	other := connect("other")
+	defer other.Close()
+	b := connect("b")
+	defer b.Close()
+
+	sub := natsSubSync(t, billing, ">")
+	natsFlush(t, billing)
+	subB := natsSubSync(t, b, ">")
+	natsFlush(t, b)
+
+	expectPub := func(nc *nats.Conn, s *nats.Subscription, subject string, allowed bool) {
+		t.Helper()
+		natsPub(t, nc, subject, []byte("hello"))
+		natsFlush(t, nc)
+		if allowed {
+			if msg := natsNexMsg(t, s, time.Second); msg.Subject != subject {
+				t.Fatalf("Expected message on %q, got %q", subject, msg.Subject)
+			}
+			return
+		}
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), "Permissions Violation") {
+				t.Fatalf("Expected permissions violation, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected publish to %q to be rejected", subject)
+		}
+		if msg, err := s.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+			t.Fatalf("Expected no message, got %v, %v", msg, err)
+		}
+	}
+	expectPub(billing, sub, "billing.invoices", true)
+	expectPub(billing, sub, "audit.log", true)
+	expectPub(other, sub, "billing.invoices", false)
+	expectPub(other, sub, "audit.log", false)
+	expectPub(other, sub, "orders", true)
+	// Reservations only apply to their account.
+	expectPub(b, subB, "billing.invoices", true)
+
+	// The user name sent in CONNECT by an nkey user is not its identity.
+	spoof, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer spoof.Close()
+	spoof.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(spoof)
+	l, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	var info Info
+	if err := json.Unmarshal([]byte(l[len("INFO "):]), &info); err != nil {
+		t.Fatalf("Error unmarshalling INFO: %v", err)
+	}
+	sig, _ := kp.Sign([]byte(info.Nonce))
+	cproto := fmt.Sprintf("CONNECT {\"verbose\":false,\"user\":\"billing\",\"nkey\":%q,\"sig\":%q}\r\n",
+		npub, base64.RawURLEncoding.EncodeToString(sig))
+	if _, err := spoof.Write([]byte(cproto + "PUB billing.invoices 5\r\nhello\r\nPING\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if l, err := br.ReadString('\n'); err != nil || !strings.Contains(l, "Permissions Violation") {
+		t.Fatalf("Expected permissions violation, got %q, %v", l, err)
+	}
+	if msg, err := sub.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected no message, got %v, %v", msg, err)
+	}
+
+	// Reservations can be set programmatically.
+	if err := acc.SetReservedSubjects([]*ReservedSubject{{Subject: "orders", Users: []string{"billing"}}}); err != nil {
+		t.Fatalf("Error setting reserved subjects: %v", err)
+	}
+	expectPub(other, sub, "orders", false)
+	expectPub(other, sub, "billing.invoices", true)
+	if err := acc.SetReservedSubjects([]*ReservedSubject{{Subject: "foo..bar"}}); err == nil {
+		t.Fatal("Expected error for invalid subject")
+	}
+}
+
+func TestAccountRetainedMessages(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [{user: a, password: pwd}]
+				retain: {subjects: ["prices.>", "status"], max_msgs: 100}
+			}
+			B { users: [{user: b, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if acc.retained == nil || acc.retained.max != 100 || len(acc.retained.subjects) != 2 {
+		t.Fatalf("Unexpected retained config: %+v", acc.retained)
+	}
+
+	nc := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s:%d", opts.Host, opts.Port))
+	defer nc.Close()
+	natsPub(t, nc, "prices.foo", []byte("1"))
+	natsPub(t, nc, "prices.foo", []byte("2"))
+	natsPub(t, nc, "prices.bar", []byte("3"))
+	natsPub(t, nc, "status", []byte("up"))
+	natsPub(t, nc, "other", []byte("x"))
+	natsFlush(t, nc)
+
+	expectMsgs := func(sub *nats.Subscription, expected map[string]string) {
+		t.Helper()
+		for i := 0; i < len(expected); i++ {
+			msg := natsNexMsg(t, sub, time.Second)
+			if data, ok := expected[msg.Subject]; !ok || data != string(msg.Data) {
+				t.Fatalf("Unexpected message %q on %q", msg.Data, msg.Subject)
+			}
+		}
+		if msg, err := sub.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+			t.Fatalf("Expected no more message, got %v, %v", msg, err)
+		}
+	}
+
+	sub := natsSubSync(t, nc, "prices.*")
+	expectMsgs(sub, map[string]string{"prices.foo": "2", "prices.bar": "3"})
+	sub = natsSubSync(t, nc, ">")
+	expectMsgs(sub, map[string]string{"prices.foo": "2", "prices.bar": "3", "status": "up"})
+
+	// Queue subscriptions don't get the retained messages.
+	qsub := natsQueueSubSync(t, nc, "prices.foo", "queue")
+	expectMsgs(qsub, nil)
+
+	// An empty message clears the retained one.
+	natsPub(t, nc, "prices.foo", nil)
+	natsFlush(t, nc)
+	sub = natsSubSync(t, nc, "prices.foo")
+	expectMsgs(sub, nil)
+
+	// Other accounts are not affected.
+	ncb := natsConnect(t, fmt.Sprintf("nats://b:pwd@%s:%d", opts.Host, opts.Port))
+	defer ncb.Close()
+	natsPub(t, ncb, "status", []byte("down"))
+	natsFlush(t, ncb)
+	sub = natsSubSync(t, ncb, ">")
+	expectMsgs(sub, nil)
+
+	// Changing the retained subjects keeps the messages still retained.
+	if err := acc.SetRetainedSubjects([]string{"status"}, 0); err != nil {
+		t.Fatalf("Error setting retained subjects: %v", err)
+	}
+	sub = natsSubSync(t, nc, ">")
+	expectMsgs(sub, map[string]string{"status": "up"})
+	if err := acc.SetRetainedSubjects([]string{"foo..bar"}, 0); err == nil {
+		t.Fatal("Expected error for invalid subject")
+	}
+
+	// Retained messages survive a config reload.
+	reloadUpdateConfig(t, s, conf, `
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [{user: a, password: pwd}]
+				retain: ["prices.>", "status"]
+			}
+			B { users: [{user: b, password: pwd}] }
+		}
+	`)
+	sub = natsSubSync(t, nc, ">")
+	expectMsgs(sub, map[string]string{"status": "up"})
+}
+
+func TestAccountReplayMessages(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [{user: a, password: pwd}]
+				replay: {subjects: ["prices.>"], max_msgs: 3, max_age: "1m"}
+			}
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if acc.replay == nil || acc.replay.maxMsgs != 3 || acc.replay.maxAge != time.Minute {
+		t.Fatalf("Unexpected replay config: %+v", acc.replay)
+	}
+
+	nc := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s:%d", opts.Host, opts.Port))
+	defer nc.Close()
+	publish := func() {
+		t.Helper()
+		for i := 1; i <= 5; i++ {
+			natsPub(t, nc, "prices.foo", []byte(fmt.Sprintf("foo%d", i)))
+			natsPub(t, nc, "prices.bar", []byte(fmt.Sprintf("bar%d", i)))
+		}
+		natsPub(t, nc, "other", []byte("x"))
+		natsFlush(t, nc)
+	}
+	publish()
+
+	// Subscribes on a raw connection and returns the payloads received
+	// before the PONG.
+	subscribe := func(replay bool, subject string) []string {
+		t.Helper()
+		c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		br := bufio.NewReader(c)
+		if _, err := br.ReadString('\n'); err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		connect := fmt.Sprintf(`CONNECT {"user":"a","pass":"pwd","verbose":false,"replay":%v}`, replay)
+		if _, err := c.Write([]byte(fmt.Sprintf("%s\r\nSUB %s 1\r\nPING\r\n", connect, subject))); err != nil {
+			t.Fatalf("Error subscribing: %v", err)
+		}
+		var payloads []string
+		for {
+			l, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading: %v", err)
+			}
+			switch {
+			case strings.HasPrefix(l, "PONG"):
+				return payloads
+			case strings.HasPrefix(l, "MSG "):
+				p, err := br.ReadString('\n')
+				if err != nil {
+					t.Fatalf("Error reading: %v", err)
+				}
+				payloads = append(payloads, strings.TrimSuffix(p, "\r\n"))
+			default:
+				t.Fatalf("Unexpected protocol: %q", l)
+			}
+		}
+	}
+	check := func(payloads []string, expected ...string) {
+		t.Helper()
+		if strings.Join(payloads, " ") != strings.Join(expected, " ") {
+			t.Fatalf("Expected %q, got %q", expected, payloads)
+		}
+	}
+
+	// Only the last 3 messages of each subject are replayed, in order.
+	check(subscribe(true, "prices.*"), "foo3", "bar3", "foo4", "bar4", "foo5", "bar5")
+	check(subscribe(true, "prices.bar"), "bar3", "bar4", "bar5")
+	check(subscribe(true, "other"))
+	// Clients that did not ask for replay don't get anything.
+	check(subscribe(false, "prices.*"))
+
+	// Messages are kept across config reloads.
+	reloadUpdateConfig(t, s, conf, `
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [{user: a, password: pwd}]
+				replay: {subjects: ["prices.foo"], max_msgs: 2}
+			}
+		}
+	`)
+	check(subscribe(true, ">"), "foo4", "foo5")
+
+	// Messages older than the maximum age are not replayed.
+	acc, err = s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if err := acc.SetReplaySubjects([]string{"prices.>"}, 0, 100*time.Millisecond); err != nil {
+		t.Fatalf("Error setting replay subjects: %v", err)
+	}
+	check(subscribe(true, ">"), "foo4", "foo5")
+	time.Sleep(150 * time.Millisecond)
+	check(subscribe(true, ">"))
+	publish()
+	check(subscribe(true, "prices.foo"), "foo1", "foo2", "foo3", "foo4", "foo5")
+
+	if err := acc.SetReplaySubjects(nil, 0, 0); err != nil {
+		t.Fatalf("Error disabling replay: %v", err)
+	}
+	check(subscribe(true, ">"))
+}
+
+// verboseClient connects a verbose client with the given user and "pwd" as
+// password, and returns the connection and a function sending protocols
+// followed by a PING that returns the lines received up to the PONG included.
+func verboseClient(t *testing.T, opts *Options, user string) (net.Conn, func(proto string) []string) {
+	t.Helper()
+	c, err := net.Dial("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br.ReadString('\n')
+	send := func(proto string) []string {
+		t.Helper()
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		fmt.Fprintf(c, "%sPING\r\n", proto)
+		var lines []string
+		for {
+			l, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading: %v", err)
+			}
+			lines = append(lines, l)
+			if l == "PONG\r\n" {
+				return lines
+			}
+		}
+	}
+	if lines := send(fmt.Sprintf("CONNECT {\"user\":%q,\"pass\":\"pwd\",\"verbose\":true}\r\n", user)); len(lines) != 2 || lines[0] != "+OK\r\n" {
+		c.Close()
+		t.Fatalf("Unexpected CONNECT response: %q", lines)
+	}
+	return c, send
+}
+
+func TestAccountSubjectQuota(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [{user: a, password: pwd}]
+				subject_quota: {max_subjects: 2, window: "500ms"}
+			}
+			B {
+				users: [{user: b, password: pwd}]
+				subject_quota: 1
+			}
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if acc.quota == nil || acc.quota.max != 2 || acc.quota.window != 500*time.Millisecond {
+		t.Fatalf("Unexpected subject quota: %+v", acc.quota)
+	}
+	accB, err := s.LookupAccount("B")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if accB.quota == nil || accB.quota.max != 1 || accB.quota.window != DEFAULT_SUBJECT_QUOTA_WINDOW {
+		t.Fatalf("Unexpected subject quota: %+v", accB.quota)
+	}
+
+	errCh := make(chan error, 10)
+	nc := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s:%d", opts.Host, opts.Port),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, ">")
+	natsFlush(t, nc)
+
+	expectPub := func(subject string, allowed bool) {
+		t.Helper()
+		natsPub(t, nc, subject, []byte("hello"))
+		natsFlush(t, nc)
+		if allowed {
+			if msg := natsNexMsg(t, sub, time.Second); msg.Subject != subject {
+				t.Fatalf("Expected message on %q, got %q", subject, msg.Subject)
+			}
+			return
+		}
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), "Maximum Account Subjects Exceeded") {
+				t.Fatalf("Expected subject quota error, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected publish to %q to be rejected", subject)
+		}
+		if msg, err := sub.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+			t.Fatalf("Expected no message, got %v, %v", msg, err)
+		}
+	}
+	expectPub("foo", true)
+	expectPub("bar", true)
+	expectPub("baz", false)
+	// Subjects already seen in the window are still allowed.
+	expectPub("foo", true)
+	if !nc.IsConnected() {
+		t.Fatal("Expected client to still be connected")
+	}
+
+	// A verbose client does not get a +OK for a rejected message.
+	vc, send := verboseClient(t, opts, "b")
+	defer vc.Close()
+	if lines := send("PUB foo 5\r\nhello\r\n"); len(lines) != 2 || lines[0] != "+OK\r\n" {
+		t.Fatalf("Expected +OK, got %q", lines)
+	}
+	if lines := send("PUB bar 5\r\nhello\r\n"); len(lines) != 2 || !strings.Contains(lines[0], "Maximum Account Subjects Exceeded") {
+		t.Fatalf("Expected only the subject quota error, got %q", lines)
+	}
+
+	// The subjects are counted again in the next window.
+	time.Sleep(500 * time.Millisecond)
+	expectPub("baz", true)
+
+	// The quota can be removed programmatically.
+	if err := acc.SetSubjectQuota(0, 0); err != nil {
+		t.Fatalf("Error setting subject quota: %v", err)
+	}
+	for _, subj := range []string{"a", "b", "c", "d"} {
+		expectPub(subj, true)
+	}
+	if err := acc.SetSubjectQuota(-1, 0); err == nil {
+		t.Fatal("Expected error for negative max subjects")
+	}
+}
+
+func TestAccountEncryptionPolicy(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [{user: a, password: pwd}]
+				encryption: {subjects: ["secure.>"], key_ids: ["k1", "k2"]}
+			}
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	errCh := make(chan error, 10)
+	nc := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s:%d", opts.Host, opts.Port),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+			errCh <- err
+		}))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, ">")
+	natsFlush(t, nc)
+
+	sealed := "0123456789abcdef0123"
+	nonce := base64.StdEncoding.EncodeToString(make([]byte, 12))
+	expectPub := func(subject, payload string, allowed bool) {
+		t.Helper()
+		natsPub(t, nc, subject, []byte(payload))
+		natsFlush(t, nc)
+		if allowed {
+			if msg := natsNexMsg(t, sub, time.Second); string(msg.Data) != payload {
+				t.Fatalf("Expected message %q, got %q", payload, msg.Data)
+			}
+			return
+		}
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), "Encryption Envelope Required") {
+				t.Fatalf("Expected encryption error, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected publish of %q to be rejected", payload)
+		}
+		if msg, err := sub.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+			t.Fatalf("Expected no message, got %v, %v", msg, err)
+		}
+	}
+	expectPub("foo", "plaintext", true)
+	expectPub("secure.foo", "plaintext", false)
+	expectPub("secure.foo", "NATS-ENC/1 k1 "+nonce+"\r\n"+sealed, true)
+	expectPub("secure.foo", "NATS-ENC/1 k3 "+nonce+"\r\n"+sealed, false)
+	expectPub("secure.foo", "NATS-ENC/1 k2 bad\r\n"+sealed, false)
+	expectPub("secure.foo", "NATS-ENC/1 k2 "+nonce+"\r\nshort", false)
+	expectPub("secure.foo", "NATS-ENC/1 k2 "+nonce+" "+sealed, false)
+	if !nc.IsConnected() {
+		t.Fatal("Expected client to still be connected")
+	}
+
+	// A verbose client does not get a +OK for a rejected message.
+	vc, send := verboseClient(t, opts, "a")
+	defer vc.Close()
+	if lines := send("PUB secure.foo 9\r\nplaintext\r\n"); len(lines) != 2 || !strings.Contains(lines[0], "Encryption Envelope Required") {
+		t.Fatalf("Expected only the encryption error, got %q", lines)
+	}
+
+	// The policy can be removed programmatically.
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if err := acc.SetEncryptionPolicy(nil, nil); err != nil {
+		t.Fatalf("Error removing policy: %v", err)
+	}
+	expectPub("secure.foo", "plaintext", true)
+	if err := acc.SetEncryptionPolicy([]string{"foo..bar"}, nil); err == nil {
+		t.Fatal("Expected error for invalid subject")
+	}
+}
+
+func TestAccountArchiveTap(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [{user: a, password: pwd}]
+				archive: {subject: "_ARCHIVE", subjects: ["orders.>"]}
+			}
+			B {
+				users: [{user: b, password: pwd}]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount("A")
+	if err != nil {
+		t.Fatalf("Error looking up account: %v", err)
+	}
+	if acc.archive == nil || acc.archive.prefix != "_ARCHIVE" || acc.archive.sample != 1 {
+		t.Fatalf("Unexpected archive config: %+v", acc.archive)
+	}
+
+	nca := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s:%d", opts.Host, opts.Port))
+	defer nca.Close()
+	ncb := natsConnect(t, fmt.Sprintf("nats://b:pwd@%s:%d", opts.Host, opts.Port))
+	defer ncb.Close()
+
+	archived := natsSubSync(t, nca, "_ARCHIVE.>")
+	orders := natsSubSync(t, nca, "orders.*")
+	other := natsSubSync(t, ncb, "_ARCHIVE.>")
+	natsFlush(t, nca)
+	natsFlush(t, ncb)
+
+	natsPub(t, nca, "orders.1", []byte("o1"))
+	natsPub(t, nca, "other", []byte("x"))
+	natsPub(t, nca, "_ARCHIVE.orders.2", []byte("replayed"))
+	natsPub(t, ncb, "orders.3", []byte("o3"))
+	natsFlush(t, nca)
+	natsFlush(t, ncb)
+
+	if m := natsNexMsg(t, orders, time.Second); string(m.Data) != "o1" {
+		t.Fatalf("Unexpected message: %q", m.Data)
+	}
+	// The archive copy, then the message published on the archive subject
+	// which is not archived again.
+	for _, expected := range []string{"_ARCHIVE.orders.1 o1", "_ARCHIVE.orders.2 replayed"} {
+		m := natsNexMsg(t, archived, time.Second)
+		if got := m.Subject + " " + string(m.Data); got != expected {
+			t.Fatalf("Expected %q, got %q", expected, got)
+		}
+	}
+	if m, err := archived.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected archived message: %q %q", m.Subject, m.Data)
+	}
+	// Account B has no archive.
+	if m, err := other.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected archived message: %q %q", m.Subject, m.Data)
+	}
+
+	// Only about half of the messages with sampling.
+	if err := acc.SetArchive("_ARCHIVE", nil, 0.5); err != nil {
+		t.Fatalf("Error setting archive: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		natsPub(t, nca, "foo", []byte("x"))
+	}
+	natsFlush(t, nca)
+	if n, _, _ := archived.Pending(); n < 350 || n > 650 {
+		t.Fatalf("Expected about 500 archived messages, got %d", n)
+	}
+
+	if err := acc.SetArchive("_ARCHIVE.*", nil, 1); err == nil {
+		t.Fatal("Expected error for a wildcard archive subject")
+	}
+	if err := acc.SetArchive("_ARCHIVE", nil, 2); err == nil {
+		t.Fatal("Expected error for an invalid sample")
+	}
+}
+
+func TestAccountMinWildcardDepth(t *testing.T) {
+	for _, test := range []struct {
+		subject string
+		depth   int
+	}{
+		{"foo", -1},
+		{"foo.bar", -1},
+		{">", 0},
+		{"*.foo", 0},
+		{"foo.>", 1},
+		{"foo.*.bar", 1},
+		{"foo.bar.*", 2},
+		{"foo.b*r.>", 2},
+	} {
+		if d := wildcardDepth([]byte(test.subject)); d != test.depth {
+			t.Fatalf("Expected depth %d for %q, got %d", test.depth, test.subject, d)
+		}
+	}
+
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				min_wildcard_depth: 1
+				users: [
+					{user: a, password: pwd}
+					{user: b, password: pwd, permissions: {min_wildcard_depth: 2}}
+				]
+			}
+			B {
+				users: [{user: c, password: pwd}]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	subscribe := func(user, subject string) bool {
+		t.Helper()
+		errCh := make(chan error, 1)
+		nc, err := nats.Connect(fmt.Sprintf("nats://%s:pwd@%s:%d", user, opts.Host, opts.Port),
+			nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer nc.Close()
+		natsSubSync(t, nc, subject)
+		natsFlush(t, nc)
+		select {
+		case err := <-errCh:
+			if !strings.Contains(err.Error(), "Permissions Violation") {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			return false
+		case <-time.After(100 * time.Millisecond):
+			return true
+		}
+	}
+	for _, test := range []struct {
+		user    string
+		subject string
+		allowed bool
+	}{
+		{"a", ">", false},
+		{"a", "*.bar", false},
+		{"a", "foo.>", true},
+		{"a", "foo", true},
+		{"b", "foo.>", false},
+		{"b", "foo.bar.>", true},
+		{"c", ">", true},
+	} {
+		if allowed := subscribe(test.user, test.subject); allowed != test.allowed {
+			t.Fatalf("Expected subscription of %q to %q allowed to be %v", test.user, test.subject, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server/pse"
+)
+
+// DEFAULT_ADMISSION_RETRY_AFTER is the default delay after which clients
+// rejected while the server is overloaded are told to retry.
+const DEFAULT_ADMISSION_RETRY_AFTER = 5 * time.Second
+
+const (
+	// How often the CPU and memory usage of the process are checked when
+	// admission control is configured.
+	admissionCheckInterval = time.Second
+
+	// The server is no longer overloaded once the CPU and memory usage
+	// go back below this percentage of their threshold.
+	admissionResumePercent = 90
+
+	// How often a deferred connection checks if it can be admitted.
+	admissionDeferWait = 50 * time.Millisecond
+)
+
+// AdmissionOpts rejects new client connections while the CPU or memory
+// usage of the process is above a threshold, so that the server degrades
+// gracefully under overload instead of taking on more work.
+type AdmissionOpts struct {
+	// MaxCPU is the CPU usage, in percent, above which the server is
+	// overloaded. It may be over 100 on multi-core hosts. No limit if 0.
+	MaxCPU float64 `json:"max_cpu,omitempty"`
+	// MaxRSS is the resident memory, in bytes, above which the server is
+	// overloaded. No limit if 0.
+	MaxRSS int64 `json:"max_rss,omitempty"`
+	// RetryAfter is the delay after which rejected clients are told to
+	// retry, DEFAULT_ADMISSION_RETRY_AFTER if 0.
+	RetryAfter time.Duration `json:"retry_after,omitempty"`
+	// Defer is how long a new connection is held, waiting for the server
+	// to no longer be overloaded, before being rejected. Connections are
+	// rejected right away if 0.
+	Defer time.Duration `json:"defer,omitempty"`
+}
+
+func (o *AdmissionOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.MaxCPU < 0 || o.MaxRSS < 0 {
+		return fmt.Errorf("admission thresholds can not be negative")
+	}
+	if o.RetryAfter < 0 || o.Defer < 0 {
+		return fmt.Errorf("admission retry_after and defer can not be negative")
+	}
+	return nil
+}
+
+func (o *AdmissionOpts) retryAfter() time.Duration {
+	if o != nil && o.RetryAfter > 0 {
+		return o.RetryAfter
+	}
+	return DEFAULT_ADMISSION_RETRY_AFTER
+}
+
+// startAdmissionControl starts the routine that checks the CPU and memory
+// usage of the process against the admission thresholds. It does nothing
+// if already started.
+func (s *Server) startAdmissionControl() {
+	s.mu.Lock()
+	if s.admissionStarted || s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+	s.admissionStarted = true
+	s.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		t := time.NewTicker(admissionCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.checkAdmission(s.getOpts().Admission)
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// checkAdmission sets the server as overloaded when the CPU or memory
+// usage is above its threshold, and clears it once both are back below
+// admissionResumePercent of their threshold.
+// This is invoked from the admission control routine only.
+func (s *Server) checkAdmission(ao *AdmissionOpts) {
+	if ao == nil || (ao.MaxCPU <= 0 && ao.MaxRSS <= 0) {
+		s.setOverloaded(false, _EMPTY_)
+		return
+	}
+	var pcpu float64
+	var rss, vss int64
+	pse.ProcUsage(&pcpu, &rss, &vss)
+
+	overloaded := atomic.LoadInt32(&s.overloaded) == 1
+	percent := float64(100)
+	if overloaded {
+		percent = admissionResumePercent
+	}
+	var reason string
+	if ao.MaxCPU > 0 && pcpu > ao.MaxCPU*percent/100 {
+		reason = fmt.Sprintf("CPU usage of %.1f%% is above the threshold of %.1f%%", pcpu, ao.MaxCPU)
+	} else if ao.MaxRSS > 0 && rss > ao.MaxRSS/100*int64(percent) {
+		reason = fmt.Sprintf("memory usage of %d bytes is above the threshold of %d bytes", rss, ao.MaxRSS)
+	}
+	s.setOverloaded(reason != _EMPTY_, reason)
+}
+
+// setOverloaded sets or clears the overloaded state, which defers or
+// rejects new client connections.
+func (s *Server) setOverloaded(on bool, reason string) {
+	if on {
+		if atomic.CompareAndSwapInt32(&s.overloaded, 0, 1) {
+			s.Warnf("Server overloaded, %s, rejecting new client connections", reason)
+		}
+	} else if atomic.CompareAndSwapInt32(&s.overloaded, 1, 0) {
+		s.Noticef("Server no longer overloaded, accepting new client connections")
+	}
+}
+
+// admitClient returns true if a new client connection can be admitted.
+// While the server is overloaded, it waits for up to the configured defer
+// delay for it to no longer be, and returns false if it still is.
+func (s *Server) admitClient(ao *AdmissionOpts) bool {
+	if atomic.LoadInt32(&s.overloaded) == 0 {
+		return true
+	}
+	if ao == nil || ao.Defer <= 0 {
+		return false
+	}
+	deadline := time.Now().Add(ao.Defer)
+	for time.Now().Before(deadline) {
+		select {
+		case <-time.After(admissionDeferWait):
+		case <-s.quitCh:
+			return false
+		}
+		if atomic.LoadInt32(&s.overloaded) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// overloadedReject sends the error to a client rejected while the server
+// is overloaded, with the delay after which it should retry, and closes it.
+func (c *client) overloadedReject(retryAfter time.Duration) {
+	atomic.AddInt64(&c.srv.admissionRejected, 1)
+	c.sendErr(fmt.Sprintf("Server Overloaded, Retry After %v", retryAfter))
+	c.Debugf("Rejecting connection, server overloaded")
+	c.closeConnection(ServerOverloaded)
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// With advertise_resolve_interval, a client_advertise host name is
+// resolved and the server advertises the addresses, instead of the name,
+// to clients and routes. The name is resolved again at that interval and,
+// when the addresses change, clients are sent the new connect URLs in an
+// async INFO, and routes in an INFO with ConnectURLsUpdate set so that
+// they replace the connect URLs of this server with the new ones.
+
+// advertiseLookupHost resolves the advertised host names.
+var advertiseLookupHost = net.LookupHost
+
+// resolvedAdvertise returns the sorted connect URLs from the resolution of
+// the client advertise host name, with the given port if it has none. It
+// returns nil if not resolved this way or if the resolution fails.
+func resolvedAdvertise(opts *Options, defaultPort int) []string {
+	if opts.AdvertiseResolveInterval <= 0 || opts.ClientAdvertise == _EMPTY_ {
+		return nil
+	}
+	host, port, err := parseHostPort(opts.ClientAdvertise, defaultPort)
+	if err != nil || net.ParseIP(host) != nil {
+		return nil
+	}
+	addrs, err := advertiseLookupHost(host)
+	if err != nil || len(addrs) == 0 {
+		return nil
+	}
+	sPort := strconv.Itoa(port)
+	urls := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		urls = append(urls, net.JoinHostPort(addr, sPort))
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// startAdvertiseResolve starts the routine that periodically resolves the
+// client advertise host name. It does nothing if already started or if
+// the advertise value is not a host name.
+func (s *Server) startAdvertiseResolve() {
+	opts := s.getOpts()
+	if opts.AdvertiseResolveInterval <= 0 || opts.ClientAdvertise == _EMPTY_ {
+		return
+	}
+	s.mu.Lock()
+	if s.advResolveStarted || s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+	s.advResolveStarted = true
+	s.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		for {
+			opts := s.getOpts()
+			if opts.AdvertiseResolveInterval <= 0 {
+				s.mu.Lock()
+				s.advResolveStarted = false
+				s.mu.Unlock()
+				return
+			}
+			select {
+			case <-time.After(opts.AdvertiseResolveInterval):
+			case <-s.quitCh:
+				return
+			}
+			// The listen port may have been picked at random.
+			s.mu.Lock()
+			port := s.getOpts().Port
+			s.mu.Unlock()
+			if urls := resolvedAdvertise(s.getOpts(), port); urls != nil {
+				s.updateAdvertisedURLs(urls)
+			}
+		}
+	})
+}
+
+// updateAdvertisedURLs replaces the connect URLs of this server, if they
+// changed, and sends them to clients and routes.
+func (s *Server) updateAdvertisedURLs(urls []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown || stringsEqual(s.clientConnectURLs, urls) {
+		return
+	}
+	s.Noticef("Advertised addresses changed from %v to %v", s.clientConnectURLs, urls)
+	s.clientConnectURLs = urls
+	// Clients are sent connect URLs only once there are routes.
+	if len(s.info.ClientConnectURLs) > 0 {
+		s.rebuildClientConnectURLs()
+		s.sendAsyncInfoToClients()
+	}
+
+	if s.getOpts().Cluster.NoAdvertise || s.routeInfoJSON == nil {
+		return
+	}
+	s.routeInfo.ClientConnectURLs = urls
+	s.generateRouteInfoJSON()
+	info := s.routeInfo
+	info.ConnectURLsUpdate = true
+	b, _ := json.Marshal(&info)
+	proto := []byte(fmt.Sprintf(InfoProto, b))
+	for _, r := range s.routes {
+		r.mu.Lock()
+		r.enqueueProto(proto)
+		r.mu.Unlock()
+	}
+}
+
+// processRouteConnectURLsUpdate replaces the connect URLs of a route with
+// the ones in its INFO.
+// Lock is held on entry, and released.
+func (c *client) processRouteConnectURLsUpdate(urls []string) {
+	old := c.route.connectURLs
+	c.route.connectURLs = urls
+	c.mu.Unlock()
+
+	s := c.srv
+	if s.getOpts().Cluster.NoAdvertise {
+		return
+	}
+	s.updateServerINFOAndSendINFOToClients(urls, old)
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
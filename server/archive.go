@@ -0,0 +1,137 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// archiveTap tees the messages published in an account, on the subjects
+// matching one of its filters or all of them if none, to the archive
+// prefix: a message on "foo" is also published on "<prefix>.foo", for
+// the archiver of the account to subscribe to "<prefix>.>". Only a
+// fraction of the messages is tapped if sampled.
+type archiveTap struct {
+	prefix   string
+	subjects []string
+	sample   float64
+}
+
+func newArchiveTap(prefix string, subjects []string, sample float64) *archiveTap {
+	if sample <= 0 {
+		sample = 1
+	}
+	return &archiveTap{prefix: prefix, subjects: subjects, sample: sample}
+}
+
+// validateArchiveTap checks the archive prefix, filters and sampling rate.
+func validateArchiveTap(prefix string, subjects []string, sample float64) error {
+	if !IsValidLiteralSubject(prefix) {
+		return fmt.Errorf("invalid archive subject %q", prefix)
+	}
+	for _, subject := range subjects {
+		if !IsValidSubject(subject) {
+			return fmt.Errorf("invalid archive filter %q", subject)
+		}
+	}
+	if sample < 0 || sample > 1 {
+		return fmt.Errorf("archive sample must be between 0 and 1, got %v", sample)
+	}
+	return nil
+}
+
+// taps returns true if the message published on this subject is archived.
+// Messages on the archive subjects are not, to not archive them again.
+func (t *archiveTap) taps(subject string) bool {
+	if len(subject) > len(t.prefix) && subject[len(t.prefix)] == btsep && subject[:len(t.prefix)] == t.prefix {
+		return false
+	}
+	if len(t.subjects) == 0 {
+		return true
+	}
+	for _, filter := range t.subjects {
+		if matchLiteral(subject, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetArchive tees the messages published in this account on the subjects
+// matching one of the given filters, or all if empty, to the subject
+// "<prefix>.<original subject>". With a sample lower than 1, only this
+// fraction of the messages is. An empty prefix disables the archival.
+func (a *Account) SetArchive(prefix string, subjects []string, sample float64) error {
+	var t *archiveTap
+	if prefix != _EMPTY_ {
+		if err := validateArchiveTap(prefix, subjects, sample); err != nil {
+			return err
+		}
+		t = newArchiveTap(prefix, copyStrings(subjects), sample)
+	}
+	a.mu.Lock()
+	a.setArchive(t)
+	a.mu.Unlock()
+	return nil
+}
+
+// Account lock is held on entry if the account is registered.
+func (a *Account) setArchive(t *archiveTap) {
+	a.archive = t
+	if t != nil {
+		atomic.StoreInt32(&a.archiving, 1)
+	} else {
+		atomic.StoreInt32(&a.archiving, 0)
+	}
+}
+
+// archiveMsg publishes the message being processed on the archive subject
+// of the account, if tapped.
+func (c *client) archiveMsg(acc *Account, msg []byte) {
+	if atomic.LoadInt32(&acc.archiving) == 0 {
+		return
+	}
+	acc.mu.RLock()
+	t := acc.archive
+	acc.mu.RUnlock()
+	if t == nil || !t.taps(string(c.pa.subject)) {
+		return
+	}
+	if t.sample < 1 {
+		if c.in.prand == nil {
+			c.in.prand = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		if c.in.prand.Float64() >= t.sample {
+			return
+		}
+	}
+	subject := make([]byte, 0, len(t.prefix)+1+len(c.pa.subject))
+	subject = append(subject, t.prefix...)
+	subject = append(subject, btsep)
+	subject = append(subject, c.pa.subject...)
+
+	r := acc.sl.Match(string(subject))
+	if len(r.psubs)+len(r.qsubs) == 0 && !c.srv.gateway.enabled {
+		return
+	}
+	if c.srv.gateway.enabled {
+		queues := c.processMsgResults(acc, r, msg, subject, c.pa.reply, pmrCollectQueueNames)
+		c.sendMsgToGateways(acc, msg, subject, c.pa.reply, queues)
+	} else {
+		c.processMsgResults(acc, r, msg, subject, c.pa.reply, pmrNoFlag)
+	}
+}
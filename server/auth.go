@@ -14,9 +14,13 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
+	"fmt"
 	"net"
+	"os/exec"
 	"strings"
 	"time"
 
@@ -43,20 +47,34 @@ type ClientAuthentication interface {
 	RemoteAddress() net.Addr
 }
 
+// AuthBackend is an interface for implementing an external credential
+// store (LDAP bind, PAM, etc..) used to verify the password of users that
+// belong to an account but have no password defined in the configuration.
+type AuthBackend interface {
+	// Authenticate returns true if the username/password pair is valid.
+	Authenticate(username, password string) bool
+}
+
 // NkeyUser is for multiple nkey based users
 type NkeyUser struct {
-	Nkey        string       `json:"user"`
-	Permissions *Permissions `json:"permissions,omitempty"`
-	Account     *Account     `json:"account,omitempty"`
-	SigningKey  string       `json:"signing_key,omitempty"`
+	Nkey            string          `json:"user"`
+	Permissions     *Permissions    `json:"permissions,omitempty"`
+	Account         *Account        `json:"account,omitempty"`
+	SigningKey      string          `json:"signing_key,omitempty"`
+	ConnectionTimes []jwt.TimeRange `json:"connection_times,omitempty"`
+	AllowedSources  []string        `json:"allowed_sources,omitempty"`
+	DeniedSources   []string        `json:"denied_sources,omitempty"`
 }
 
 // User is for multiple accounts/users.
 type User struct {
-	Username    string       `json:"user"`
-	Password    string       `json:"password"`
-	Permissions *Permissions `json:"permissions,omitempty"`
-	Account     *Account     `json:"account,omitempty"`
+	Username        string          `json:"user"`
+	Password        string          `json:"password"`
+	Permissions     *Permissions    `json:"permissions,omitempty"`
+	Account         *Account        `json:"account,omitempty"`
+	ConnectionTimes []jwt.TimeRange `json:"connection_times,omitempty"`
+	AllowedSources  []string        `json:"allowed_sources,omitempty"`
+	DeniedSources   []string        `json:"denied_sources,omitempty"`
 }
 
 // clone performs a deep copy of the User struct, returning a new clone with
@@ -68,6 +86,9 @@ func (u *User) clone() *User {
 	clone := &User{}
 	*clone = *u
 	clone.Permissions = u.Permissions.clone()
+	clone.ConnectionTimes = cloneTimeRanges(u.ConnectionTimes)
+	clone.AllowedSources = copyStrings(u.AllowedSources)
+	clone.DeniedSources = copyStrings(u.DeniedSources)
 	return clone
 }
 
@@ -80,9 +101,120 @@ func (n *NkeyUser) clone() *NkeyUser {
 	clone := &NkeyUser{}
 	*clone = *n
 	clone.Permissions = n.Permissions.clone()
+	clone.ConnectionTimes = cloneTimeRanges(n.ConnectionTimes)
+	clone.AllowedSources = copyStrings(n.AllowedSources)
+	clone.DeniedSources = copyStrings(n.DeniedSources)
+	return clone
+}
+
+func cloneTimeRanges(times []jwt.TimeRange) []jwt.TimeRange {
+	if times == nil {
+		return nil
+	}
+	clone := make([]jwt.TimeRange, len(times))
+	copy(clone, times)
 	return clone
 }
 
+func copyStrings(src []string) []string {
+	if src == nil {
+		return nil
+	}
+	dst := make([]string, len(src))
+	copy(dst, src)
+	return dst
+}
+
+// parseSourceCIDR parses a CIDR block. A single IP address is
+// accepted and treated as a block containing only that address.
+func parseSourceCIDR(src string) (*net.IPNet, error) {
+	src = strings.TrimSpace(src)
+	if !strings.Contains(src, "/") {
+		ip := net.ParseIP(src)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q", src)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(src)
+	return ipNet, err
+}
+
+// Returns true if the IP is contained in one of the given CIDR blocks.
+func sourceInList(ip net.IP, list []string) bool {
+	for _, src := range list {
+		if ipNet, err := parseSourceCIDR(src); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSource checks the given host against allow and deny lists of
+// CIDR blocks. Deny entries take precedence. If the allow list is not
+// empty, the host has to be in it. If there are lists and the host is
+// not a valid IP, the source is rejected.
+func validateSource(host string, allow, deny []string) bool {
+	if len(allow) == 0 && len(deny) == 0 {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if sourceInList(ip, deny) {
+		return false
+	}
+	return len(allow) == 0 || sourceInList(ip, allow)
+}
+
+// validateTimes checks that `now` falls within one of the given time windows,
+// expressed in local time with the "15:04:05" format. A window whose end is
+// before its start spans midnight. If allowed, the time remaining until the
+// window closes is returned. An empty list allows connections at any time and
+// returns a remaining time of 0.
+func validateTimes(times []jwt.TimeRange, now time.Time) (bool, time.Duration) {
+	if len(times) == 0 {
+		return true, 0
+	}
+	const format = "15:04:05"
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := func(t time.Time) time.Duration {
+		return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	}
+	cur := now.Sub(midnight)
+	var remaining time.Duration
+	allowed := false
+	for _, tr := range times {
+		st, err1 := time.Parse(format, tr.Start)
+		et, err2 := time.Parse(format, tr.End)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		start, end := offset(st), offset(et)
+		var left time.Duration
+		switch {
+		case start <= end && cur >= start && cur < end:
+			left = end - cur
+		case start > end && cur >= start:
+			left = 24*time.Hour - cur + end
+		case start > end && cur < end:
+			left = end - cur
+		default:
+			continue
+		}
+		allowed = true
+		if left > remaining {
+			remaining = left
+		}
+	}
+	return allowed, remaining
+}
+
 // SubjectPermission is an individual allow and deny struct for publish
 // and subscribe authorizations.
 type SubjectPermission struct {
@@ -103,6 +235,9 @@ type Permissions struct {
 	Publish   *SubjectPermission  `json:"publish"`
 	Subscribe *SubjectPermission  `json:"subscribe"`
 	Response  *ResponsePermission `json:"responses,omitempty"`
+	// MinWildcardDepth forbids subscriptions with a wildcard in one of
+	// their first MinWildcardDepth tokens, so 1 forbids ">" and "*.foo".
+	MinWildcardDepth int `json:"min_wildcard_depth,omitempty"`
 }
 
 // RoutePermissions are similar to user permissions
@@ -136,7 +271,7 @@ func (p *Permissions) clone() *Permissions {
 	if p == nil {
 		return nil
 	}
-	clone := &Permissions{}
+	clone := &Permissions{MinWildcardDepth: p.MinWildcardDepth}
 	if p.Publish != nil {
 		clone.Publish = p.Publish.clone()
 	}
@@ -152,11 +287,60 @@ func (p *Permissions) clone() *Permissions {
 	return clone
 }
 
+// inheritPermissions returns the permissions p extended with the default
+// ones: the allow and deny lists are merged, and the response permission
+// of p, if any, takes precedence. It returns a copy of the default ones
+// if p is nil.
+func inheritPermissions(def, p *Permissions) *Permissions {
+	if p == nil {
+		return def.clone()
+	}
+	merged := &Permissions{
+		Publish:          inheritSubjectPermission(def.Publish, p.Publish),
+		Subscribe:        inheritSubjectPermission(def.Subscribe, p.Subscribe),
+		Response:         p.Response,
+		MinWildcardDepth: p.MinWildcardDepth,
+	}
+	if merged.Response == nil && def.Response != nil {
+		merged.Response = def.clone().Response
+	}
+	if def.MinWildcardDepth > merged.MinWildcardDepth {
+		merged.MinWildcardDepth = def.MinWildcardDepth
+	}
+	return merged
+}
+
+func inheritSubjectPermission(def, p *SubjectPermission) *SubjectPermission {
+	if def == nil {
+		return p.clone()
+	}
+	if p == nil {
+		return def.clone()
+	}
+	merge := func(a, b []string) []string {
+		if len(a) == 0 && len(b) == 0 {
+			return nil
+		}
+		m := make([]string, 0, len(a)+len(b))
+		seen := make(map[string]struct{}, len(a)+len(b))
+		for _, l := range [][]string{a, b} {
+			for _, subj := range l {
+				if _, ok := seen[subj]; !ok {
+					seen[subj] = struct{}{}
+					m = append(m, subj)
+				}
+			}
+		}
+		return m
+	}
+	return &SubjectPermission{Allow: merge(def.Allow, p.Allow), Deny: merge(def.Deny, p.Deny)}
+}
+
 // checkAuthforWarnings will look for insecure settings and log concerns.
 // Lock is assumed held.
 func (s *Server) checkAuthforWarnings() {
 	warn := false
-	if s.opts.Password != "" && !isBcrypt(s.opts.Password) {
+	if s.opts.Password != "" && !isHashedPassword(s.opts.Password) {
 		warn = true
 	}
 	for _, u := range s.users {
@@ -165,15 +349,19 @@ func (s *Server) checkAuthforWarnings() {
 		if u.Password == "" && s.opts.TLSMap {
 			continue
 		}
+		// Skip warn if the password is verified by an external backend.
+		if u.Password == "" && u.Account.getAuthBackend() != nil {
+			continue
+		}
 
-		if !isBcrypt(u.Password) {
+		if !isHashedPassword(u.Password) {
 			warn = true
 			break
 		}
 	}
 	if warn {
 		// Warning about using plaintext passwords.
-		s.Warnf("Plaintext passwords detected, use nkeys or bcrypt.")
+		s.Warnf("Plaintext passwords detected, use nkeys, bcrypt or argon2id.")
 	}
 }
 
@@ -274,6 +462,21 @@ func (s *Server) configureAuthorization() {
 		s.users = nil
 		s.info.AuthRequired = false
 	}
+
+	// OIDC bearer tokens can be used alongside other authentication methods.
+	if opts.OIDC != nil {
+		s.oidc = newOIDCValidator(opts.OIDC)
+		s.info.AuthRequired = true
+	} else {
+		s.oidc = nil
+	}
+
+	// The decisions cached by the policy engine are dropped.
+	if opts.Policy != nil {
+		s.policy.Store(newPolicyEngine(opts.Policy))
+	} else {
+		s.policy.Store((*policyEngine)(nil))
+	}
 }
 
 // checkAuthentication will check based on client type and
@@ -305,6 +508,11 @@ func (s *Server) isClientAuthorized(c *client) bool {
 		return opts.CustomClientAuthentication.Check(c)
 	}
 
+	// Bearer tokens are validated against the OIDC issuer if configured.
+	if opts.OIDC != nil && isOIDCToken(c.opts.Authorization) {
+		return s.processOIDCAuthentication(c)
+	}
+
 	return s.processClientOrLeafAuthentication(c)
 }
 
@@ -404,7 +612,7 @@ func (s *Server) processClientOrLeafAuthentication(c *client) bool {
 			c.Debugf("Account JWT lookup error: %v", err)
 			return false
 		}
-		if !s.isTrustedIssuer(acc.Issuer) {
+		if !acc.isTemplate() && !s.isTrustedIssuer(acc.Issuer) {
 			c.Debugf("Account JWT not signed by trusted operator")
 			return false
 		}
@@ -443,6 +651,18 @@ func (s *Server) processClientOrLeafAuthentication(c *client) bool {
 			c.Debugf("User authentication revoked")
 			return false
 		}
+		var allowSrc []string
+		if juc.Src != "" {
+			allowSrc = strings.Split(juc.Src, ",")
+		}
+		if !c.checkConnectionSource(allowSrc, nil, acc) {
+			return false
+		}
+		allowed, window := validateTimes(juc.Times, time.Now())
+		if !allowed {
+			c.Debugf("User not allowed to connect at this time")
+			return false
+		}
 
 		nkey = buildInternalNkeyUser(juc, acc)
 		if err := c.RegisterNkeyUser(nkey); err != nil {
@@ -454,6 +674,10 @@ func (s *Server) processClientOrLeafAuthentication(c *client) bool {
 
 		// Check if we need to set an auth timer if the user jwt expires.
 		c.checkExpiration(juc.Claims())
+		// Or if its connection time window closes.
+		if window > 0 {
+			c.setExpirationTimer(window)
+		}
 		return true
 	}
 
@@ -480,6 +704,12 @@ func (s *Server) processClientOrLeafAuthentication(c *client) bool {
 			c.Debugf("Signature not verified")
 			return false
 		}
+		if !c.checkConnectionSource(nkey.AllowedSources, nkey.DeniedSources, nkey.Account) {
+			return false
+		}
+		if !c.checkConnectionTimes(nkey.ConnectionTimes) {
+			return false
+		}
 		if err := c.RegisterNkeyUser(nkey); err != nil {
 			return false
 		}
@@ -487,10 +717,23 @@ func (s *Server) processClientOrLeafAuthentication(c *client) bool {
 	}
 
 	if user != nil {
-		ok = comparePasswords(user.Password, c.opts.Password)
+		backend := false
+		if ab := user.Account.getAuthBackend(); ab != nil && user.Password == "" {
+			ok, backend = ab.Authenticate(user.Username, c.opts.Password), true
+		} else {
+			ok = comparePasswords(user.Password, c.opts.Password)
+		}
+		if ok {
+			ok = c.checkConnectionSource(user.AllowedSources, user.DeniedSources, user.Account) &&
+				c.checkConnectionTimes(user.ConnectionTimes)
+		}
 		// If we are authorized, register the user which will properly setup any permissions
 		// for pub/sub authorizations.
 		if ok {
+			// The password is only rehashed once the user is fully authorized.
+			if !backend {
+				s.rehashUserPassword(user, c.opts.Password)
+			}
 			c.RegisterUser(user)
 			// Generate an event if we have a system account and this is not the $G account.
 			s.accountConnectEvent(c)
@@ -576,6 +819,18 @@ func (s *Server) isRouterAuthorized(c *client) bool {
 		return s.opts.CustomRouterAuthentication.Check(c)
 	}
 
+	if opts.JoinTokens != nil && isJoinToken(c.opts.Username) {
+		return s.isRouterJoinTokenAuthorized(c)
+	}
+
+	if len(opts.Cluster.Nkeys) > 0 {
+		if err := s.verifyRouteNkey(c.opts.Nkey, c.opts.Sig, c.nonce); err != nil {
+			c.Debugf("Route nkey authentication failed: %v", err)
+			return false
+		}
+		return true
+	}
+
 	if opts.Cluster.Username == "" {
 		return true
 	}
@@ -595,6 +850,23 @@ func (s *Server) isRouterAuthorized(c *client) bool {
 	return true
 }
 
+// isRouterJoinTokenAuthorized checks the join token of a route. Once
+// accepted, the route remains authorized on configuration reload even
+// though the token may have expired or been used.
+func (s *Server) isRouterJoinTokenAuthorized(c *client) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.route.joinToken {
+		return true
+	}
+	if _, err := s.verifyJoinToken(c.opts.Username, JoinTokenRoute); err != nil {
+		c.Debugf("Route join token authentication failed: %v", err)
+		return false
+	}
+	c.route.joinToken = true
+	return true
+}
+
 // isGatewayAuthorized checks optional gateway authorization which can be nil or username/password.
 func (s *Server) isGatewayAuthorized(c *client) bool {
 	// Snapshot server options.
@@ -647,6 +919,15 @@ func (s *Server) isLeafNodeAuthorized(c *client) bool {
 		return s.registerLeafWithAccount(c, account)
 	}
 
+	if opts.JoinTokens != nil && isJoinToken(c.opts.Username) {
+		jc, err := s.verifyJoinToken(c.opts.Username, JoinTokenLeafNode)
+		if err != nil {
+			c.Debugf("Leafnode join token authentication failed: %v", err)
+			return false
+		}
+		return s.registerLeafWithAccount(c, jc.Account)
+	}
+
 	// If leafnodes config has an authorization{} stanza, this takes precedence.
 	// The user in CONNECT mutch match. We will bind to the account associated
 	// with that user (from the leafnode's authorization{} config).
@@ -683,13 +964,47 @@ func isBcrypt(password string) bool {
 }
 
 func comparePasswords(serverPassword, clientPassword string) bool {
-	// Check to see if the server password is a bcrypt hash
+	// Check to see if the server password is a bcrypt or argon2id hash
 	if isBcrypt(serverPassword) {
 		if err := bcrypt.CompareHashAndPassword([]byte(serverPassword), []byte(clientPassword)); err != nil {
 			return false
 		}
+	} else if isArgon2id(serverPassword) {
+		return compareArgon2id(serverPassword, clientPassword)
 	} else if serverPassword != clientPassword {
 		return false
 	}
 	return true
 }
+
+// Default time given to an external authentication command to complete.
+const defaultExecAuthTimeout = 2 * time.Second
+
+// execAuthBackend is an AuthBackend that delegates the verification to an
+// external command. The username and password are written, each on its own
+// line, to the standard input of the command and the credentials are
+// considered valid if the command exits with a zero status. This allows
+// reuse of existing tools to check against PAM, LDAP or other stores.
+type execAuthBackend struct {
+	cmd     string
+	args    []string
+	timeout time.Duration
+}
+
+// NewExecAuthBackend returns an AuthBackend that runs the given command
+// to verify credentials. If timeout is 0, a default of 2 seconds is used.
+func NewExecAuthBackend(cmd string, args []string, timeout time.Duration) AuthBackend {
+	if timeout <= 0 {
+		timeout = defaultExecAuthTimeout
+	}
+	return &execAuthBackend{cmd: cmd, args: args, timeout: timeout}
+}
+
+// Authenticate implements the AuthBackend interface.
+func (e *execAuthBackend) Authenticate(username, password string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, e.cmd, e.args...)
+	cmd.Stdin = bytes.NewBufferString(fmt.Sprintf("%s\n%s\n", username, password))
+	return cmd.Run() == nil
+}
@@ -0,0 +1,350 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_AUTH_BAN_MAX_FAILURES is the default number of authentication
+	// failures from a source IP allowed in a burst.
+	DEFAULT_AUTH_BAN_MAX_FAILURES = 10
+	// DEFAULT_AUTH_BAN_PERIOD is the default time for a source IP to get
+	// back all its allowed authentication failures.
+	DEFAULT_AUTH_BAN_PERIOD = time.Minute
+	// DEFAULT_AUTH_BAN is the default duration of the first ban.
+	DEFAULT_AUTH_BAN = time.Minute
+	// DEFAULT_AUTH_BAN_MAX is the default longest ban.
+	DEFAULT_AUTH_BAN_MAX = time.Hour
+)
+
+// AuthBanOpts temporarily bans the source IPs with too many authentication
+// failures on the client and leaf node listeners. Each source IP has a
+// bucket of MaxFailures tokens, refilled over Period, and a failure takes
+// a token. A source IP failing with an empty bucket is banned for Ban, and
+// each new ban of the same source IP lasts twice as long as the previous
+// one, up to MaxBan.
+type AuthBanOpts struct {
+	MaxFailures int           `json:"max_failures,omitempty"`
+	Period      time.Duration `json:"period,omitempty"`
+	Ban         time.Duration `json:"ban,omitempty"`
+	MaxBan      time.Duration `json:"max_ban,omitempty"`
+	// Allow lists the CIDR blocks, or IP addresses, that are never banned.
+	Allow []string `json:"allow,omitempty"`
+}
+
+func (o *AuthBanOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.MaxFailures < 0 {
+		return fmt.Errorf("auth_ban max_failures can not be negative")
+	}
+	if o.Period < 0 || o.Ban < 0 || o.MaxBan < 0 {
+		return fmt.Errorf("auth_ban durations can not be negative")
+	}
+	if o.MaxBan > 0 && o.MaxBan < o.ban() {
+		return fmt.Errorf("auth_ban max_ban of %v is shorter than the ban of %v", o.MaxBan, o.ban())
+	}
+	for _, src := range o.Allow {
+		if _, err := parseSourceCIDR(src); err != nil {
+			return fmt.Errorf("invalid auth_ban allow entry: %v", err)
+		}
+	}
+	return nil
+}
+
+func (o *AuthBanOpts) maxFailures() int {
+	if o.MaxFailures > 0 {
+		return o.MaxFailures
+	}
+	return DEFAULT_AUTH_BAN_MAX_FAILURES
+}
+
+func (o *AuthBanOpts) period() time.Duration {
+	if o.Period > 0 {
+		return o.Period
+	}
+	return DEFAULT_AUTH_BAN_PERIOD
+}
+
+func (o *AuthBanOpts) ban() time.Duration {
+	if o.Ban > 0 {
+		return o.Ban
+	}
+	return DEFAULT_AUTH_BAN
+}
+
+func (o *AuthBanOpts) maxBan() time.Duration {
+	if o.MaxBan > 0 {
+		return o.MaxBan
+	}
+	if ban := o.ban(); ban > DEFAULT_AUTH_BAN_MAX {
+		return ban
+	}
+	return DEFAULT_AUTH_BAN_MAX
+}
+
+// authBanSource is the state of a source IP with authentication failures.
+type authBanSource struct {
+	tokens   float64
+	last     time.Time
+	failures int64
+	bans     int
+	until    time.Time
+}
+
+// authBans tracks the source IPs with authentication failures.
+type authBans struct {
+	sync.Mutex
+	sources   map[string]*authBanSource
+	lastPrune time.Time
+}
+
+// refill adds the tokens earned since the last failure, or since the end
+// of the ban.
+func (src *authBanSource) refill(o *AuthBanOpts, now time.Time) {
+	if !now.After(src.last) {
+		return
+	}
+	max := float64(o.maxFailures())
+	src.tokens += now.Sub(src.last).Seconds() / o.period().Seconds() * max
+	if src.tokens > max {
+		src.tokens = max
+	}
+	src.last = now
+}
+
+// authFailure records an authentication failure from the given host, and
+// bans it if it has no tokens left. It returns the duration of the ban, if
+// one was started.
+func (s *Server) authFailure(host string) time.Duration {
+	o := s.getOpts().AuthBan
+	if o == nil || host == _EMPTY_ {
+		return 0
+	}
+	if ip := net.ParseIP(host); ip != nil && sourceInList(ip, o.Allow) {
+		return 0
+	}
+	now := time.Now()
+	b := &s.authBans
+	b.Lock()
+	defer b.Unlock()
+	if b.sources == nil {
+		b.sources = make(map[string]*authBanSource)
+	}
+	b.prune(o, now)
+	src := b.sources[host]
+	if src == nil {
+		src = &authBanSource{tokens: float64(o.maxFailures()), last: now}
+		b.sources[host] = src
+	}
+	src.failures++
+	src.refill(o, now)
+	if src.tokens >= 1 {
+		src.tokens--
+		return 0
+	}
+	// Ban, for twice as long as the previous time, and give back the
+	// tokens for when the ban expires.
+	ban := o.ban()
+	for i := 0; i < src.bans && ban < o.maxBan(); i++ {
+		ban *= 2
+	}
+	if ban > o.maxBan() {
+		ban = o.maxBan()
+	}
+	src.bans++
+	src.until = now.Add(ban)
+	src.tokens, src.last = float64(o.maxFailures()), src.until
+	return ban
+}
+
+// prune forgets the source IPs whose bucket is full again and whose last
+// ban, if any, expired more than the longest ban ago. It runs at most once
+// per period.
+// Lock should be held.
+func (b *authBans) prune(o *AuthBanOpts, now time.Time) {
+	if now.Sub(b.lastPrune) < o.period() {
+		return
+	}
+	b.lastPrune = now
+	for host, src := range b.sources {
+		if now.Sub(src.last) >= o.period() && now.Sub(src.until) >= o.maxBan() {
+			delete(b.sources, host)
+		}
+	}
+}
+
+// authBanned returns how long the given host is still banned for.
+func (s *Server) authBanned(host string) time.Duration {
+	if s.getOpts().AuthBan == nil || host == _EMPTY_ {
+		return 0
+	}
+	b := &s.authBans
+	b.Lock()
+	defer b.Unlock()
+	if src := b.sources[host]; src != nil {
+		if left := time.Until(src.until); left > 0 {
+			return left
+		}
+	}
+	return 0
+}
+
+// authBannedReject closes the connection if its source IP is banned, and
+// returns true if it did.
+func (c *client) authBannedReject() bool {
+	c.mu.Lock()
+	host := c.host
+	c.mu.Unlock()
+	left := c.srv.authBanned(host)
+	if left <= 0 {
+		return false
+	}
+	c.sendErr(fmt.Sprintf("Authentication Banned, Retry After %v", left.Round(time.Second)))
+	c.Debugf("Rejecting connection, source banned for %v", left)
+	c.closeConnection(AuthenticationBanned)
+	return true
+}
+
+// authFailureBan records the authentication failure of the connection,
+// and sends an advisory if its source IP is now banned.
+func (c *client) authFailureBan() {
+	s := c.srv
+	c.mu.Lock()
+	host, kind := c.host, c.kind
+	c.mu.Unlock()
+	if s == nil || (kind != CLIENT && kind != LEAF) {
+		return
+	}
+	if ban := s.authFailure(host); ban > 0 {
+		s.Warnf("Banning %s for %v after too many authentication failures", host, ban)
+		s.sendAuthBanEvent(host, ban)
+	}
+}
+
+// AuthBanEventMsg is sent when a source IP is banned after too many
+// authentication failures.
+type AuthBanEventMsg struct {
+	Server   ServerInfo    `json:"server"`
+	Host     string        `json:"host"`
+	Failures int64         `json:"failures"`
+	Bans     int           `json:"bans"`
+	Duration time.Duration `json:"duration"`
+	Until    time.Time     `json:"until"`
+}
+
+// sendAuthBanEvent sends an advisory about the ban of a source IP.
+func (s *Server) sendAuthBanEvent(host string, ban time.Duration) {
+	m := &AuthBanEventMsg{Host: host, Duration: ban}
+	b := &s.authBans
+	b.Lock()
+	if src := b.sources[host]; src != nil {
+		m.Failures, m.Bans, m.Until = src.failures, src.bans, src.until
+	}
+	b.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	subj := fmt.Sprintf(authBanEventSubj, s.info.ID)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
+
+// AuthBanz lists the source IPs banned after too many authentication
+// failures.
+type AuthBanz struct {
+	ID      string         `json:"server_id"`
+	Now     time.Time      `json:"now"`
+	Tracked int            `json:"num_tracked"`
+	Banned  int            `json:"num_banned"`
+	Sources []*AuthBanInfo `json:"sources"`
+}
+
+// AuthBanInfo is the state of a source IP with authentication failures.
+type AuthBanInfo struct {
+	Host     string     `json:"host"`
+	Failures int64      `json:"failures"`
+	Bans     int        `json:"bans"`
+	Banned   bool       `json:"banned"`
+	Until    *time.Time `json:"until,omitempty"`
+}
+
+// AuthBanzOptions are options passed to AuthBanz.
+type AuthBanzOptions struct {
+	// All includes the source IPs with failures that are not banned.
+	All bool `json:"all"`
+}
+
+// AuthBanz returns the source IPs banned, the ones banned the longest
+// first.
+func (s *Server) AuthBanz(opts *AuthBanzOptions) *AuthBanz {
+	now := time.Now()
+	bz := &AuthBanz{ID: s.ID(), Now: now, Sources: []*AuthBanInfo{}}
+	b := &s.authBans
+	b.Lock()
+	bz.Tracked = len(b.sources)
+	for host, src := range b.sources {
+		bi := &AuthBanInfo{Host: host, Failures: src.failures, Bans: src.bans}
+		if src.until.After(now) {
+			until := src.until
+			bi.Banned, bi.Until = true, &until
+			bz.Banned++
+		} else if opts == nil || !opts.All {
+			continue
+		}
+		bz.Sources = append(bz.Sources, bi)
+	}
+	b.Unlock()
+	sort.Slice(bz.Sources, func(i, j int) bool {
+		ui, uj := bz.Sources[i].Until, bz.Sources[j].Until
+		if (ui == nil) != (uj == nil) {
+			return ui != nil
+		}
+		if ui != nil && !ui.Equal(*uj) {
+			return ui.After(*uj)
+		}
+		return bz.Sources[i].Host < bz.Sources[j].Host
+	})
+	return bz
+}
+
+// HandleAuthBanz process HTTP requests for the banned source IPs.
+func (s *Server) HandleAuthBanz(w http.ResponseWriter, r *http.Request) {
+	all, err := decodeBool(w, r, "all")
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.httpReqStats[AuthBanzPath]++
+	s.mu.Unlock()
+
+	b, err := json.MarshalIndent(s.AuthBanz(&AuthBanzOptions{All: all}), "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /authbanz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
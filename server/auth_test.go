@@ -14,8 +14,27 @@
 package server
 
 import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 func TestUserCloneNilPermissions(t *testing.T) {
@@ -101,3 +120,677 @@ func TestUserCloneNil(t *testing.T) {
 		t.Fatalf("Expected nil, got: %+v", clone)
 	}
 }
+
+type testAuthBackend struct {
+	users map[string]string
+}
+
+func (b *testAuthBackend) Authenticate(username, password string) bool {
+	pwd, ok := b.users[username]
+	return ok && pwd == password
+}
+
+func TestAccountAuthBackend(t *testing.T) {
+	acc := NewAccount("A")
+	acc.SetAuthBackend(&testAuthBackend{users: map[string]string{"alice": "pwd"}})
+
+	opts := DefaultOptions()
+	opts.Accounts = []*Account{acc}
+	opts.Users = []*User{
+		{Username: "alice", Account: acc},
+		{Username: "bob", Password: "bobpwd", Account: acc},
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	for _, test := range []struct {
+		name string
+		user string
+		pass string
+		ok   bool
+	}{
+		{"backend valid", "alice", "pwd", true},
+		{"backend invalid", "alice", "bad", false},
+		{"local password", "bob", "bobpwd", true},
+		{"unknown user", "carol", "pwd", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			url := fmt.Sprintf("nats://%s:%s@%s:%d", test.user, test.pass, opts.Host, opts.Port)
+			nc, err := nats.Connect(url)
+			if test.ok {
+				if err != nil {
+					t.Fatalf("Error on connect: %v", err)
+				}
+				nc.Close()
+			} else if err == nil {
+				nc.Close()
+				t.Fatal("Expected connect to fail")
+			}
+		})
+	}
+}
+
+func TestExecAuthBackend(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Skipping test on windows")
+	}
+	dir, err := ioutil.TempDir("", "auth_backend")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "check.sh")
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nread u\nread p\n[ \"$u\" = \"alice\" ] && [ \"$p\" = \"$1\" ]\n"), 0755); err != nil {
+		t.Fatalf("Error writing script: %v", err)
+	}
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [{user: alice}]
+				auth_backend {
+					exec: "%s"
+					args: ["secret"]
+					timeout: "5s"
+				}
+			}
+		}
+	`, script)))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://alice:secret@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+
+	if nc, err := nats.Connect(fmt.Sprintf("nats://alice:bad@%s:%d", opts.Host, opts.Port)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connect to fail")
+	}
+}
+
+func TestValidateConnectionTimes(t *testing.T) {
+	now := time.Date(2020, 1, 1, 10, 0, 0, 0, time.Local)
+	for _, test := range []struct {
+		name    string
+		times   []jwt.TimeRange
+		allowed bool
+		left    time.Duration
+	}{
+		{"no times", nil, true, 0},
+		{"inside", []jwt.TimeRange{{Start: "09:00:00", End: "11:00:00"}}, true, time.Hour},
+		{"outside", []jwt.TimeRange{{Start: "11:00:00", End: "12:00:00"}}, false, 0},
+		{"spans midnight", []jwt.TimeRange{{Start: "22:00:00", End: "10:30:00"}}, true, 30 * time.Minute},
+		{"end excluded", []jwt.TimeRange{{Start: "08:00:00", End: "10:00:00"}}, false, 0},
+		{"longest wins", []jwt.TimeRange{
+			{Start: "09:00:00", End: "10:15:00"},
+			{Start: "09:30:00", End: "12:00:00"},
+		}, true, 2 * time.Hour},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			allowed, left := validateTimes(test.times, now)
+			if allowed != test.allowed || left != test.left {
+				t.Fatalf("Expected %v/%v, got %v/%v", test.allowed, test.left, allowed, left)
+			}
+		})
+	}
+}
+
+func TestUserConnectionTimes(t *testing.T) {
+	now := time.Now()
+	inside := jwt.TimeRange{
+		Start: now.Add(-time.Hour).Format("15:04:05"),
+		End:   now.Add(time.Hour).Format("15:04:05"),
+	}
+	outside := jwt.TimeRange{
+		Start: now.Add(time.Hour).Format("15:04:05"),
+		End:   now.Add(2 * time.Hour).Format("15:04:05"),
+	}
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users: [
+				{user: "in", password: "pwd", connection_times: [{start: %q, end: %q}]}
+				{user: "out", password: "pwd", connection_times: [{start: %q, end: %q}]}
+			]
+		}
+	`, inside.Start, inside.End, outside.Start, outside.End)))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://in:pwd@%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+
+	if nc, err := nats.Connect(fmt.Sprintf("nats://out:pwd@%s:%d", opts.Host, opts.Port)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connect to fail")
+	}
+
+	// Invalid time format is rejected at config time.
+	bad := createConfFile(t, []byte(`
+		authorization {
+			users: [{user: "u", password: "pwd", connection_times: [{start: "9am", end: "10:00:00"}]}]
+		}
+	`))
+	defer os.Remove(bad)
+	if _, err := ProcessConfigFile(bad); err == nil {
+		t.Fatal("Expected error for invalid time range")
+	}
+}
+
+func TestValidateSource(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		host  string
+		allow []string
+		deny  []string
+		ok    bool
+	}{
+		{"no lists", "10.0.0.1", nil, nil, true},
+		{"no lists unknown host", "", nil, nil, true},
+		{"allowed", "10.0.0.1", []string{"10.0.0.0/8"}, nil, true},
+		{"not allowed", "192.168.0.1", []string{"10.0.0.0/8"}, nil, false},
+		{"denied", "10.1.0.1", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}, false},
+		{"single ip", "10.0.0.1", []string{"10.0.0.1"}, nil, true},
+		{"ipv6", "::1", []string{"::1/128"}, nil, true},
+		{"unknown host", "", []string{"10.0.0.0/8"}, nil, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if ok := validateSource(test.host, test.allow, test.deny); ok != test.ok {
+				t.Fatalf("Expected %v, got %v", test.ok, ok)
+			}
+		})
+	}
+}
+
+func TestUserAndAccountSources(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		accounts {
+			A {
+				users: [
+					{user: "a1", password: "pwd", allow_sources: ["127.0.0.0/8"]}
+					{user: "a2", password: "pwd", deny_sources: "127.0.0.1"}
+				]
+			}
+			B {
+				users: [{user: "b", password: "pwd"}]
+				deny_sources: ["127.0.0.0/8"]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	for _, test := range []struct {
+		user string
+		ok   bool
+	}{
+		{"a1", true},
+		{"a2", false},
+		{"b", false},
+	} {
+		nc, err := nats.Connect(fmt.Sprintf("nats://%s:pwd@%s:%d", test.user, opts.Host, opts.Port))
+		if test.ok && err != nil {
+			t.Fatalf("Error on connect for %q: %v", test.user, err)
+		} else if !test.ok && err == nil {
+			nc.Close()
+			t.Fatalf("Expected connect to fail for %q", test.user)
+		}
+		if nc != nil {
+			nc.Close()
+		}
+	}
+
+	bad := createConfFile(t, []byte(`
+		authorization {
+			users: [{user: "u", password: "pwd", allow_sources: ["10.0.0.0/33"]}]
+		}
+	`))
+	defer os.Remove(bad)
+	if _, err := ProcessConfigFile(bad); err == nil {
+		t.Fatal("Expected error for invalid source")
+	}
+}
+
+func TestAccountTLSRequired(t *testing.T) {
+	for _, secure := range []bool{false, true} {
+		tlsBlock := _EMPTY_
+		if secure {
+			tlsBlock = `tls {
+				cert_file: "./configs/certs/cert.new.pem"
+				key_file:  "./configs/certs/key.new.pem"
+			}`
+		}
+		conf := createConfFile(t, []byte(fmt.Sprintf(`
+			listen: "127.0.0.1:-1"
+			%s
+			accounts {
+				A { users: [{user: "a", password: "pwd"}], tls_required: true }
+				B { users: [{user: "b", password: "pwd"}] }
+			}
+		`, tlsBlock)))
+		defer os.Remove(conf)
+
+		s, opts := RunServerWithConfig(conf)
+		defer s.Shutdown()
+
+		for _, test := range []struct {
+			user string
+			ok   bool
+		}{
+			{"a", secure},
+			{"b", true},
+		} {
+			url := fmt.Sprintf("nats://%s:pwd@%s:%d", test.user, opts.Host, opts.Port)
+			var copts []nats.Option
+			if secure {
+				copts = append(copts, nats.RootCAs("./configs/certs/cert.new.pem"))
+			}
+			nc, err := nats.Connect(url, copts...)
+			if test.ok && err != nil {
+				t.Fatalf("Error on connect for %q with TLS=%v: %v", test.user, secure, err)
+			} else if !test.ok && err == nil {
+				nc.Close()
+				t.Fatalf("Expected connect to fail for %q with TLS=%v", test.user, secure)
+			}
+			if nc != nil {
+				nc.Close()
+			}
+		}
+		s.Shutdown()
+	}
+}
+
+func TestHashAndComparePasswords(t *testing.T) {
+	for _, ph := range []*PasswordHashingOpts{
+		{Algorithm: PasswordHashBcrypt, BcryptCost: 4},
+		{Algorithm: PasswordHashArgon2id, Argon2Time: 1, Argon2Memory: 64, Argon2Threads: 1},
+	} {
+		t.Run(ph.Algorithm, func(t *testing.T) {
+			hash, err := HashPassword("pwd", ph)
+			if err != nil {
+				t.Fatalf("Error hashing: %v", err)
+			}
+			if !isHashedPassword(hash) {
+				t.Fatalf("Expected %q to be recognized as a hash", hash)
+			}
+			if !comparePasswords(hash, "pwd") {
+				t.Fatal("Expected password to match")
+			}
+			if comparePasswords(hash, "bad") {
+				t.Fatal("Expected password to not match")
+			}
+			if needsRehash(hash, ph) {
+				t.Fatal("Expected no rehash with same options")
+			}
+			if !needsRehash("pwd", ph) {
+				t.Fatal("Expected rehash of plaintext password")
+			}
+		})
+	}
+	if _, err := HashPassword("pwd", &PasswordHashingOpts{Algorithm: "md5"}); err == nil {
+		t.Fatal("Expected error for unknown algorithm")
+	}
+}
+
+func TestPasswordRehashOnLogin(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Users = []*User{
+		{Username: "alice", Password: "pwd"},
+		{Username: "bob", Password: "pwd", DeniedSources: []string{"127.0.0.1"}},
+	}
+	opts.PasswordHashing = &PasswordHashingOpts{
+		Algorithm:     PasswordHashArgon2id,
+		Argon2Time:    1,
+		Argon2Memory:  64,
+		Argon2Threads: 1,
+		Rehash:        true,
+	}
+	rehashed := make(chan string, 1)
+	opts.PasswordRehashed = func(username, hash string) {
+		rehashed <- hash
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	// A user rejected after the password check is not rehashed.
+	if nc, err := nats.Connect(fmt.Sprintf("nats://bob:pwd@%s:%d", opts.Host, opts.Port)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connect to fail from a denied source")
+	}
+	select {
+	case <-rehashed:
+		t.Fatal("Unexpected rehash of a rejected user")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	url := fmt.Sprintf("nats://alice:pwd@%s:%d", opts.Host, opts.Port)
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+
+	select {
+	case hash := <-rehashed:
+		if !isArgon2id(hash) {
+			t.Fatalf("Expected argon2id hash, got %q", hash)
+		}
+		s.mu.Lock()
+		stored := s.users["alice"].Password
+		s.mu.Unlock()
+		if stored != hash {
+			t.Fatalf("Expected stored password to be %q, got %q", hash, stored)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Password was not rehashed")
+	}
+
+	// Can still connect with the rehashed password, and no new rehash.
+	nc, err = nats.Connect(url)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+	select {
+	case <-rehashed:
+		t.Fatal("Unexpected rehash")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAuthBan(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			user: "ivan"
+			password: "pwd"
+		}
+		auth_ban {
+			max_failures: 1
+			period: "1h"
+			ban: "1m"
+			max_ban: "3m"
+			allow: ["10.0.0.0/8"]
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	bo := opts.AuthBan
+	if bo == nil || bo.MaxFailures != 1 || bo.Period != time.Hour || bo.Ban != time.Minute ||
+		bo.MaxBan != 3*time.Minute || !reflect.DeepEqual(bo.Allow, []string{"10.0.0.0/8"}) {
+		t.Fatalf("Unexpected auth_ban options: %+v", bo)
+	}
+
+	// Each new ban lasts twice as long, up to the longest ban.
+	for i, expected := range []time.Duration{0, time.Minute, 0, 2 * time.Minute, 0, 3 * time.Minute} {
+		if ban := s.authFailure("192.168.0.1"); ban != expected {
+			t.Fatalf("Expected ban of %v for failure %d, got %v", expected, i+1, ban)
+		}
+	}
+	if left := s.authBanned("192.168.0.1"); left <= 2*time.Minute {
+		t.Fatalf("Expected to be banned for about 3m, got %v", left)
+	}
+	// Allowed sources are never banned.
+	for i := 0; i < 5; i++ {
+		if ban := s.authFailure("10.1.2.3"); ban != 0 {
+			t.Fatalf("Expected allowed source not to be banned, got %v", ban)
+		}
+	}
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	for i := 0; i < 2; i++ {
+		if nc, err := nats.Connect(url, nats.UserInfo("ivan", "wrong")); err == nil {
+			nc.Close()
+			t.Fatal("Expected authentication failure")
+		}
+	}
+	// Now banned, whatever the credentials.
+	c, err := net.Dial("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(c)
+	if l, err := br.ReadString('\n'); err != nil || !strings.HasPrefix(l, "INFO ") {
+		t.Fatalf("Expected INFO, got %q, %v", l, err)
+	}
+	if l, err := br.ReadString('\n'); err != nil || !strings.HasPrefix(l, "-ERR 'Authentication Banned, Retry After ") {
+		t.Fatalf("Expected banned error, got %q, %v", l, err)
+	}
+
+	bz := s.AuthBanz(nil)
+	if bz.Tracked != 2 || bz.Banned != 2 || len(bz.Sources) != 2 {
+		t.Fatalf("Unexpected authbanz: %+v", bz)
+	}
+	if bi := bz.Sources[0]; bi.Host != "192.168.0.1" || bi.Bans != 3 || !bi.Banned {
+		t.Fatalf("Unexpected first source: %+v", bi)
+	}
+	if bi := bz.Sources[1]; bi.Host != "127.0.0.1" || bi.Failures != 2 || bi.Bans != 1 || bi.Until == nil {
+		t.Fatalf("Unexpected second source: %+v", bi)
+	}
+}
+
+func TestAuthPolicy(t *testing.T) {
+	var calls, failing int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var req struct {
+			Input policyInput `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		in := req.Input
+		var allowed bool
+		switch in.Action {
+		case PolicyConnect:
+			allowed = in.User != "mallory" && in.Account == globalAccountName
+		case PolicyPublish:
+			allowed = strings.HasPrefix(in.Subject, "allowed.")
+		case PolicySubscribe:
+			allowed = in.Subject != "secret"
+		}
+		// Either form of result.
+		if in.Action == PolicyPublish {
+			fmt.Fprintf(w, `{"result":{"allow":%v}}`, allowed)
+		} else {
+			fmt.Fprintf(w, `{"result":%v}`, allowed)
+		}
+	}))
+	defer ts.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users: [
+				{user: "alice", password: "pwd"}
+				{user: "mallory", password: "pwd"}
+			]
+		}
+		policy {
+			url: "%s"
+			timeout: "500ms"
+			cache_ttl: "1h"
+		}
+	`, ts.URL)))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if po := opts.Policy; po == nil || po.URL != ts.URL || po.Timeout != 500*time.Millisecond || po.CacheTTL != time.Hour {
+		t.Fatalf("Unexpected policy options: %+v", po)
+	}
+
+	connect := func(user string) (*bufio.Reader, net.Conn, string) {
+		t.Helper()
+		c, err := net.Dial("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		br := bufio.NewReader(c)
+		br.ReadString('\n')
+		fmt.Fprintf(c, "CONNECT {\"user\":%q,\"pass\":\"pwd\",\"verbose\":false}\r\nPING\r\n", user)
+		l, _ := br.ReadString('\n')
+		return br, c, l
+	}
+	send := func(c net.Conn, br *bufio.Reader, proto string) string {
+		t.Helper()
+		fmt.Fprintf(c, "%sPING\r\n", proto)
+		l, _ := br.ReadString('\n')
+		if strings.HasPrefix(l, "-ERR") {
+			br.ReadString('\n')
+		}
+		return l
+	}
+
+	if _, c, l := connect("mallory"); !strings.HasPrefix(l, "-ERR 'Authorization Violation'") {
+		t.Fatalf("Expected authorization violation, got %q", l)
+	} else {
+		c.Close()
+	}
+	br, c, l := connect("alice")
+	defer c.Close()
+	if l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	if l := send(c, br, "SUB secret 1\r\n"); !strings.HasPrefix(l, "-ERR 'Permissions Violation for Subscription to \"secret\"'") {
+		t.Fatalf("Expected subscription violation, got %q", l)
+	}
+	if l := send(c, br, "PUB foo 1\r\nx\r\n"); !strings.HasPrefix(l, "-ERR 'Permissions Violation for Publish to \"foo\"'") {
+		t.Fatalf("Expected publish violation, got %q", l)
+	}
+	// Decisions are cached.
+	before := atomic.LoadInt32(&calls)
+	for i := 0; i < 3; i++ {
+		if l := send(c, br, "PUB allowed.foo 1\r\nx\r\n"); l != "PONG\r\n" {
+			t.Fatalf("Expected PONG, got %q", l)
+		}
+	}
+	if n := atomic.LoadInt32(&calls) - before; n != 1 {
+		t.Fatalf("Expected 1 call to the policy engine, got %d", n)
+	}
+
+	// Fail closed by default, and open if configured.
+	atomic.StoreInt32(&failing, 1)
+	if l := send(c, br, "PUB allowed.bar 1\r\nx\r\n"); !strings.HasPrefix(l, "-ERR 'Permissions Violation") {
+		t.Fatalf("Expected publish violation, got %q", l)
+	}
+	// The failing engine is not contacted again right away.
+	before = atomic.LoadInt32(&calls)
+	if l := send(c, br, "PUB allowed.baz 1\r\nx\r\n"); !strings.HasPrefix(l, "-ERR 'Permissions Violation") {
+		t.Fatalf("Expected publish violation, got %q", l)
+	}
+	if n := atomic.LoadInt32(&calls) - before; n != 0 {
+		t.Fatalf("Expected no call to the failing policy engine, got %d", n)
+	}
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users: [
+				{user: "alice", password: "pwd"}
+				{user: "mallory", password: "pwd"}
+			]
+		}
+		policy {
+			url: "%s"
+			fail_open: true
+		}
+	`, ts.URL)))
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	if l := send(c, br, "PUB allowed.bar 1\r\nx\r\n"); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+
+	for _, po := range []*PolicyOpts{
+		{URL: "localhost:8181"},
+		{URL: ts.URL, Actions: []string{"request"}},
+	} {
+		o := DefaultOptions()
+		o.Policy = po
+		if err := validateOptions(o); err == nil {
+			t.Fatalf("Expected error for %+v", po)
+		}
+	}
+}
+
+func TestAuthPolicyUsesAuthenticatedUser(t *testing.T) {
+	users := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Input policyInput `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		users <- req.Input.User
+		fmt.Fprint(w, `{"result":true}`)
+	}))
+	defer ts.Close()
+
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		authorization {
+			users: [
+				{user: "alice", password: "pwd"}
+				{nkey: %q}
+			]
+		}
+		policy {
+			url: "%s"
+			actions: ["connect"]
+		}
+	`, pub, ts.URL)))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// The nkey user claims to be alice in the CONNECT.
+	c, err := net.Dial("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(c)
+	l, _ := br.ReadString('\n')
+	var info nonceInfo
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(l, "INFO ")), &info); err != nil {
+		t.Fatalf("Error unmarshalling INFO: %v", err)
+	}
+	sig, _ := kp.Sign([]byte(info.Nonce))
+	fmt.Fprintf(c, "CONNECT {\"user\":\"alice\",\"nkey\":%q,\"sig\":%q,\"verbose\":false}\r\nPING\r\n",
+		pub, base64.RawURLEncoding.EncodeToString(sig))
+	if l, _ := br.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	select {
+	case u := <-users:
+		if u != pub {
+			t.Fatalf("Expected the policy input user to be %q, got %q", pub, u)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Policy engine was not consulted")
+	}
+}
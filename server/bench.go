@@ -0,0 +1,402 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// Bench scenarios: publishers only, and publishers with subscribers
+// receiving all the messages.
+const (
+	BenchScenarioPub = "pub"
+	BenchScenarioSub = "sub"
+)
+
+const (
+	benchSubject = "bench"
+	benchTimeout = 2 * time.Minute
+)
+
+// BenchOpts are the options of a load test of an in-process server.
+type BenchOpts struct {
+	// Publishers and Subscribers are the number of synthetic clients, the
+	// messages being split between the publishers.
+	Publishers  int
+	Subscribers int
+	// Messages is the total number of messages published.
+	Messages int
+	// Size is the payload size of the messages.
+	Size int
+	// Compression also runs the scenarios with compressed connections.
+	Compression bool
+}
+
+// BenchResult is the result of a bench scenario, emitted as JSON.
+type BenchResult struct {
+	Scenario      string        `json:"scenario"`
+	Transport     string        `json:"transport"`
+	Compression   bool          `json:"compression"`
+	Publishers    int           `json:"publishers"`
+	Subscribers   int           `json:"subscribers"`
+	Messages      int           `json:"messages"`
+	Size          int           `json:"size"`
+	Duration      time.Duration `json:"duration_ns"`
+	PubMsgsPerSec float64       `json:"pub_msgs_per_sec"`
+	SubMsgsPerSec float64       `json:"sub_msgs_per_sec,omitempty"`
+	BytesPerSec   float64       `json:"bytes_per_sec"`
+}
+
+// RunBench starts an in-process server, runs the bench scenarios against
+// it and returns their results.
+func RunBench(bo *BenchOpts) ([]*BenchResult, error) {
+	if bo.Publishers <= 0 || bo.Messages <= 0 || bo.Size < 0 || bo.Subscribers < 0 {
+		return nil, errors.New("bench: publishers and messages must be positive, subscribers and size not negative")
+	}
+	opts := &Options{
+		Host:           "127.0.0.1",
+		Port:           RANDOM_PORT,
+		NoLog:          true,
+		NoSigs:         true,
+		MaxPayload:     MAX_PAYLOAD_SIZE,
+		MaxPending:     MAX_PENDING_SIZE,
+		WriteDeadline:  DEFAULT_FLUSH_DEADLINE,
+		MaxControlLine: MAX_CONTROL_LINE_SIZE,
+	}
+	if bo.Size > int(opts.MaxPayload) {
+		opts.MaxPayload = int32(bo.Size)
+	}
+	if bo.Compression {
+		opts.Compression = CompressionS2
+	}
+	s, err := NewServer(opts)
+	if err != nil {
+		return nil, err
+	}
+	go s.Start()
+	defer s.Shutdown()
+	if !s.ReadyForConnections(10 * time.Second) {
+		return nil, errors.New("bench: unable to start the server")
+	}
+	addr := s.Addr().String()
+
+	var results []*BenchResult
+	for _, compress := range []bool{false, true} {
+		if compress && !bo.Compression {
+			continue
+		}
+		for _, scenario := range []string{BenchScenarioPub, BenchScenarioSub} {
+			if scenario == BenchScenarioSub && bo.Subscribers == 0 {
+				continue
+			}
+			r, err := runBenchScenario(addr, scenario, compress, bo)
+			if err != nil {
+				return nil, fmt.Errorf("bench: scenario %q: %v", scenario, err)
+			}
+			results = append(results, r)
+		}
+	}
+	return results, nil
+}
+
+// runBenchScenario publishes the messages, and waits for the subscribers
+// to receive them all for the sub scenario.
+func runBenchScenario(addr, scenario string, compress bool, bo *BenchOpts) (*BenchResult, error) {
+	r := &BenchResult{
+		Scenario:    scenario,
+		Transport:   "tcp",
+		Compression: compress,
+		Publishers:  bo.Publishers,
+		Messages:    bo.Messages,
+		Size:        bo.Size,
+	}
+	var subs []*benchConn
+	defer func() {
+		for _, bc := range subs {
+			bc.Close()
+		}
+	}()
+	if scenario == BenchScenarioSub {
+		r.Subscribers = bo.Subscribers
+		for i := 0; i < bo.Subscribers; i++ {
+			bc, err := dialBench(addr, compress)
+			if err != nil {
+				return nil, err
+			}
+			subs = append(subs, bc)
+			fmt.Fprintf(bc.w, "SUB %s 1\r\n", benchSubject)
+			if err := bc.ping(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	pubs := make([]*benchConn, 0, bo.Publishers)
+	defer func() {
+		for _, bc := range pubs {
+			bc.Close()
+		}
+	}()
+	for i := 0; i < bo.Publishers; i++ {
+		bc, err := dialBench(addr, compress)
+		if err != nil {
+			return nil, err
+		}
+		pubs = append(pubs, bc)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		errsMu sync.Mutex
+		errs   []error
+	)
+	fail := func(err error) {
+		errsMu.Lock()
+		errs = append(errs, err)
+		errsMu.Unlock()
+	}
+	subsDone := make(chan struct{}, len(subs))
+	for _, bc := range subs {
+		go func(bc *benchConn) {
+			if err := bc.receive(bo.Messages); err != nil {
+				fail(err)
+			}
+			subsDone <- struct{}{}
+		}(bc)
+	}
+
+	start := time.Now()
+	for i, bc := range pubs {
+		n := bo.Messages / len(pubs)
+		if i < bo.Messages%len(pubs) {
+			n++
+		}
+		wg.Add(1)
+		go func(bc *benchConn, n int) {
+			defer wg.Done()
+			if err := bc.publish(n, bo.Size); err != nil {
+				fail(err)
+			}
+		}(bc, n)
+	}
+	wg.Wait()
+	pubElapsed := time.Since(start)
+	for range subs {
+		<-subsDone
+	}
+	r.Duration = time.Since(start)
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+
+	r.PubMsgsPerSec = float64(bo.Messages) / pubElapsed.Seconds()
+	total := bo.Messages * (1 + len(subs))
+	if len(subs) > 0 {
+		r.SubMsgsPerSec = float64(bo.Messages*len(subs)) / r.Duration.Seconds()
+	}
+	r.BytesPerSec = float64(total*bo.Size) / r.Duration.Seconds()
+	return r, nil
+}
+
+// benchConn is a synthetic client speaking the client protocol, possibly
+// compressed.
+type benchConn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+	zw *s2.Writer
+}
+
+func dialBench(addr string, compress bool) (*benchConn, error) {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	nc.SetDeadline(time.Now().Add(benchTimeout))
+	bc := &benchConn{nc: nc}
+	br := bufio.NewReader(nc)
+	if _, err := br.ReadString('\n'); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	connect := "CONNECT {\"verbose\":false,\"pedantic\":false,\"echo\":false}\r\n"
+	if compress {
+		connect = fmt.Sprintf("CONNECT {\"verbose\":false,\"pedantic\":false,\"echo\":false,\"compression\":%q}\r\n", CompressionS2)
+	}
+	if _, err := nc.Write([]byte(connect)); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if compress {
+		// Everything after the CONNECT is compressed in both directions.
+		bc.zw = s2.NewWriter(nc, s2.WriterConcurrency(1))
+		bc.w = bufio.NewWriterSize(bc.zw, 32*1024)
+		bc.r = bufio.NewReaderSize(s2.NewReader(br), 32*1024)
+	} else {
+		bc.w = bufio.NewWriterSize(nc, 32*1024)
+		bc.r = bufio.NewReaderSize(br, 32*1024)
+	}
+	if err := bc.ping(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+// flush sends the buffered protocols.
+func (bc *benchConn) flush() error {
+	if err := bc.w.Flush(); err != nil {
+		return err
+	}
+	if bc.zw != nil {
+		return bc.zw.Flush()
+	}
+	return nil
+}
+
+// ping flushes and waits for the PONG, so that the server processed all
+// that was sent before.
+func (bc *benchConn) ping() error {
+	bc.w.WriteString("PING\r\n")
+	if err := bc.flush(); err != nil {
+		return err
+	}
+	for {
+		l, err := bc.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch {
+		case l == "PONG\r\n":
+			return nil
+		case strings.HasPrefix(l, "-ERR"):
+			return fmt.Errorf("server error: %s", l[:len(l)-2])
+		}
+	}
+}
+
+// publish sends n messages of the given size, and waits for the server to
+// process them.
+func (bc *benchConn) publish(n, size int) error {
+	payload := bytes.Repeat([]byte("a"), size)
+	proto := []byte(fmt.Sprintf("PUB %s %d\r\n", benchSubject, size))
+	for i := 0; i < n; i++ {
+		bc.w.Write(proto)
+		bc.w.Write(payload)
+		if _, err := bc.w.WriteString(CR_LF); err != nil {
+			return err
+		}
+	}
+	return bc.ping()
+}
+
+// receive reads messages until n were received.
+func (bc *benchConn) receive(n int) error {
+	for received := 0; received < n; {
+		l, err := bc.r.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(l, []byte("MSG ")) {
+			if bytes.HasPrefix(l, []byte("-ERR")) {
+				return fmt.Errorf("server error: %s", l[:len(l)-2])
+			}
+			continue
+		}
+		args := bytes.Fields(l)
+		size, err := strconv.Atoi(string(args[len(args)-1]))
+		if err != nil {
+			return fmt.Errorf("invalid message: %q", l)
+		}
+		if _, err := bc.r.Discard(size + len(CR_LF)); err != nil {
+			return err
+		}
+		received++
+	}
+	return nil
+}
+
+func (bc *benchConn) Close() error {
+	return bc.nc.Close()
+}
+
+// processBenchCommand processes the arguments of the bench command, runs
+// it and writes the JSON results, exiting on success.
+func processBenchCommand(args []string) error {
+	bo, output, err := parseBenchCommand(args)
+	if err != nil {
+		return err
+	}
+	results, err := RunBench(bo)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if output == _EMPTY_ || output == "-" {
+		_, err = os.Stdout.Write(b)
+	} else {
+		err = ioutil.WriteFile(output, b, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("bench: %v", err)
+	}
+	os.Exit(0)
+	return nil
+}
+
+// parseBenchCommand parses "[--pubs <n>] [--subs <n>] [--msgs <n>]
+// [--size <n>] [--compression] [--output <file>]". It returns the bench
+// options and the file to write the results to.
+func parseBenchCommand(args []string) (*BenchOpts, string, error) {
+	bo := &BenchOpts{}
+	var output string
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.IntVar(&bo.Publishers, "pubs", 1, "Number of publishers")
+	fs.IntVar(&bo.Subscribers, "subs", 1, "Number of subscribers")
+	fs.IntVar(&bo.Messages, "msgs", 100000, "Number of messages to publish")
+	fs.IntVar(&bo.Size, "size", 128, "Size of the messages")
+	fs.BoolVar(&bo.Compression, "compression", false, "Also run with compressed connections")
+	fs.StringVar(&output, "output", "", "File to write the JSON results to, or \"-\" for stdout")
+	if err := fs.Parse(args); err != nil {
+		return nil, "", fmt.Errorf("bench: %v", err)
+	}
+	if fs.NArg() > 0 {
+		return nil, "", fmt.Errorf("bench: unexpected arguments: %v", fs.Args())
+	}
+	if bo.Publishers <= 0 || bo.Messages <= 0 {
+		return nil, "", errors.New("bench: --pubs and --msgs must be positive")
+	}
+	if bo.Subscribers < 0 || bo.Size < 0 {
+		return nil, "", errors.New("bench: --subs and --size can not be negative")
+	}
+	return bo, output, nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseBenchCommand(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		args   []string
+		bo     BenchOpts
+		output string
+		err    string
+	}{
+		{"defaults", nil, BenchOpts{Publishers: 1, Subscribers: 1, Messages: 100000, Size: 128}, "", ""},
+		{"all", []string{"--pubs", "2", "--subs", "0", "--msgs", "10", "--size", "0", "--compression", "--output", "-"},
+			BenchOpts{Publishers: 2, Messages: 10, Compression: true}, "-", ""},
+		{"no publishers", []string{"--pubs", "0"}, BenchOpts{}, "", "positive"},
+		{"negative size", []string{"--size", "-1"}, BenchOpts{}, "", "negative"},
+		{"extra args", []string{"foo"}, BenchOpts{}, "", "unexpected"},
+		{"unknown flag", []string{"--foo"}, BenchOpts{}, "", "not defined"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			bo, output, err := parseBenchCommand(test.args)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if *bo != test.bo || output != test.output {
+				t.Fatalf("Expected %+v and output %q, got %+v and %q", test.bo, test.output, *bo, output)
+			}
+		})
+	}
+}
+
+func TestRunBench(t *testing.T) {
+	results, err := RunBench(&BenchOpts{Publishers: 2, Subscribers: 2, Messages: 1001, Size: 64, Compression: true})
+	if err != nil {
+		t.Fatalf("Error running bench: %v", err)
+	}
+	if len(results) != 4 {
+		t.Fatalf("Expected 4 results, got %d", len(results))
+	}
+	for i, r := range results {
+		scenario := BenchScenarioPub
+		if i%2 == 1 {
+			scenario = BenchScenarioSub
+		}
+		if r.Scenario != scenario || r.Compression != (i >= 2) || r.Transport != "tcp" ||
+			r.Messages != 1001 || r.Duration <= 0 || r.PubMsgsPerSec <= 0 || r.BytesPerSec <= 0 {
+			t.Fatalf("Unexpected result %d: %+v", i, r)
+		}
+		if (scenario == BenchScenarioSub) != (r.Subscribers == 2 && r.SubMsgsPerSec > 0) {
+			t.Fatalf("Unexpected subscribers in result %d: %+v", i, r)
+		}
+	}
+}
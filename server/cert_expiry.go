@@ -0,0 +1,134 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Number of the soonest expiring peer certificates reported in varz.
+const varzCertExpiries = 10
+
+// CertExpiry is the expiration of the certificate presented by the peer of
+// a TLS connection. When the peer sent a chain, it is the certificate of
+// the chain that expires first.
+type CertExpiry struct {
+	Kind    string    `json:"kind"`
+	CID     uint64    `json:"cid"`
+	Host    string    `json:"host,omitempty"`
+	Subject string    `json:"subject"`
+	Issuer  string    `json:"issuer,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// certExpiries tracks the peer certificates of the TLS connections, by
+// connection ID.
+type certExpiries struct {
+	sync.Mutex
+	m map[uint64]*CertExpiry
+}
+
+// soonest returns, sorted, the certificates that expire first.
+func (ce *certExpiries) soonest(max int) []*CertExpiry {
+	ce.Lock()
+	defer ce.Unlock()
+	if len(ce.m) == 0 {
+		return nil
+	}
+	res := make([]*CertExpiry, 0, len(ce.m))
+	for _, e := range ce.m {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Expires.Before(res[j].Expires) })
+	if len(res) > max {
+		res = res[:max]
+	}
+	return res
+}
+
+// trackPeerCert records the expiration of the certificate presented by the
+// peer once the TLS handshake is complete, and schedules the advisory sent
+// ahead of it if enabled.
+// Lock is held on entry.
+func (c *client) trackPeerCert() {
+	s := c.srv
+	conn, ok := c.nc.(*tls.Conn)
+	if !ok || s == nil || c.isClosed() {
+		return
+	}
+	var cert *x509.Certificate
+	for _, pc := range conn.ConnectionState().PeerCertificates {
+		if cert == nil || pc.NotAfter.Before(cert.NotAfter) {
+			cert = pc
+		}
+	}
+	if cert == nil {
+		return
+	}
+	e := &CertExpiry{
+		Kind:    c.typeString(),
+		CID:     c.cid,
+		Host:    c.host,
+		Subject: cert.Subject.String(),
+		Issuer:  cert.Issuer.String(),
+		Expires: cert.NotAfter,
+	}
+	s.certs.Lock()
+	if s.certs.m == nil {
+		s.certs.m = make(map[uint64]*CertExpiry)
+	}
+	s.certs.m[c.cid] = e
+	s.certs.Unlock()
+
+	if opts := s.getOpts(); opts.CertExpiryWarning > 0 {
+		d := time.Until(e.Expires.Add(-opts.CertExpiryWarning))
+		if d < 0 {
+			d = 0
+		}
+		c.cetmr = time.AfterFunc(d, func() { s.certExpiringEvent(e) })
+	}
+}
+
+// untrackPeerCert stops tracking the certificate of the peer when the
+// connection is closed.
+// Lock is held on entry.
+func (c *client) untrackPeerCert() {
+	clearTimer(&c.cetmr)
+	if s := c.srv; s != nil {
+		s.certs.Lock()
+		delete(s.certs.m, c.cid)
+		s.certs.Unlock()
+	}
+}
+
+// certExpiringEvent warns about, and sends an advisory for, a peer
+// certificate about to expire.
+func (s *Server) certExpiringEvent(e *CertExpiry) {
+	s.Warnf("TLS certificate %q of %s connection %d expires at %v",
+		e.Subject, e.Kind, e.CID, e.Expires.Format(time.RFC3339))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	m := &CertExpiringEventMsg{Cert: *e}
+	subj := fmt.Sprintf(certExpiringEventSubj, s.info.ID)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
@@ -15,6 +15,8 @@ package server
 
 import (
 	"bytes"
+	"container/list"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
@@ -62,6 +64,11 @@ const (
 	okProto   = "+OK" + _CRLF_
 )
 
+// subNoEchoArg is the option following the sid in SUB protocols, as in
+// "SUB <subject> [queue] <sid> no_echo", for a subscription that does not
+// receive the messages published by its own connection.
+const subNoEchoArg = "no_echo"
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
@@ -108,6 +115,8 @@ const (
 	writeLoopStarted                         // Marks that the writeLoop has been started.
 	skipFlushOnClose                         // Marks that flushOutbound() should not be called on connection close.
 	expectConnect                            // Marks if this connection is expected to send a CONNECT
+	priorityLane                             // Marks that high priority data can be written before other pending data.
+	pendingAuth                              // Marks that the connection is counted as pending authentication.
 )
 
 // set the flag (would be equivalent to set the boolean to true)
@@ -167,6 +176,18 @@ const (
 	WrongGateway
 	MissingAccount
 	Revocation
+	MemoryPressure
+	AdminKick
+	SubjectLimitExceeded
+	MaxConnectionLifetimeExceeded
+	AcceptPaused
+	ServerOverloaded
+	FileDescriptorsExhausted
+	DuplicateConnection
+	AuthenticationBanned
+	MaxPendingAuthExceeded
+	SessionMigrated
+	AccountFrozen
 )
 
 // Some flags passed to processMsgResultsEx
@@ -188,10 +209,12 @@ type client struct {
 	mpay    int32
 	msubs   int32
 	mcl     int32
+	oks     int32
 	mu      sync.Mutex
 	kind    int
 	cid     uint64
 	opts    clientOpts
+	feats   Feature
 	start   time.Time
 	nonce   []byte
 	nc      net.Conn
@@ -200,6 +223,7 @@ type client struct {
 	srv     *Server
 	acc     *Account
 	user    *NkeyUser
+	authID  string
 	host    string
 	port    uint16
 	subs    map[string]*subscription
@@ -210,8 +234,13 @@ type client struct {
 	in      readCache
 	pcd     map[*client]struct{}
 	atmr    *time.Timer
+	ltmr    *time.Timer
+	ewtmr   *time.Timer
+	cetmr   *time.Timer
+	expires time.Time
 	ping    pinfo
 	msgb    [msgScratchSize]byte
+	msgbl   []byte
 	last    time.Time
 	parseState
 
@@ -220,6 +249,11 @@ type client struct {
 	rrTracking map[string]*remoteLatency
 	rrMax      int
 
+	// Set for clients that provided a durable ID.
+	durable *durableConnInfo
+	// Identity of the client when limited to one connection.
+	uniqueKey string
+
 	route *route
 	gw    *gateway
 	leaf  *leaf
@@ -229,6 +263,9 @@ type client struct {
 
 	flags clientFlag // Compact booleans into a single field. Size will be increased when needed.
 
+	// Levels set at runtime for this connection, see SetLogLevel.
+	logLevel int32
+
 	debug bool
 	trace bool
 	echo  bool
@@ -239,24 +276,41 @@ type pinfo struct {
 	tmr  *time.Timer
 	last time.Time
 	out  int
+	// Overrides of the account, if any.
+	interval time.Duration
+	maxOut   int
+	// When the connection was suspended, if it is.
+	suspended time.Time
 }
 
 // outbound holds pending data for a socket.
 type outbound struct {
-	p   []byte        // Primary write buffer
-	s   []byte        // Secondary for use post flush
-	nb  net.Buffers   // net.Buffers for writev IO
-	sz  int32         // limit size per []byte, uses variable BufSize constants, start, min, max.
-	sws int32         // Number of short writes, used for dynamic resizing.
-	pb  int64         // Total pending/queued bytes.
-	pm  int32         // Total pending/queued messages.
-	fsp int32         // Flush signals that are pending per producer from readLoop's pcd.
-	sch chan struct{} // To signal writeLoop that there is data to flush.
-	wdl time.Duration // Snapshot of write deadline.
-	mp  int64         // Snapshot of max pending for client.
-	lft time.Duration // Last flush time for Write.
-	stc chan struct{} // Stall chan we create to slow down producers on overrun, e.g. fan-in.
-	lwb int32         // Last byte size of Write.
+	p   []byte           // Primary write buffer
+	s   []byte           // Secondary for use post flush
+	nb  net.Buffers      // net.Buffers for writev IO
+	sz  int32            // limit size per []byte, uses variable BufSize constants, start, min, max.
+	sws int32            // Number of short writes, used for dynamic resizing.
+	pb  int64            // Total pending/queued bytes.
+	pm  int32            // Total pending/queued messages.
+	fsp int32            // Flush signals that are pending per producer from readLoop's pcd.
+	sch chan struct{}    // To signal writeLoop that there is data to flush.
+	wdl time.Duration    // Snapshot of write deadline.
+	mp  int64            // Snapshot of max pending for client.
+	lft time.Duration    // Last flush time for Write.
+	stc chan struct{}    // Stall chan we create to slow down producers on overrun, e.g. fan-in.
+	lwb int32            // Last byte size of Write.
+	hp  []byte           // High priority data, written before other pending data.
+	pbo int64            // Leading pending bytes that need to be written before high priority data.
+	wl  stallTracker     // Tracks the writeLoop for the watchdog.
+	lqt time.Time        // When the oldest sampled pending data was queued.
+	lso uint32           // Count of queued data for latency sampling.
+	lsf uint32           // Count of flushes for latency sampling.
+	crk time.Duration    // Snapshot of the time small writes are held, see corkOutbound.
+	pac *WritePacingOpts // Snapshot of the write pacing options, nil if not paced.
+	pbl []byte           // Paced messages held until a later tick.
+	pps []int32          // Size of each message held in pbl.
+	ptk int64            // Bytes that can still be written in the current pacing tick.
+	ptt time.Time        // Start of the current pacing tick.
 }
 
 type perm struct {
@@ -268,7 +322,80 @@ type permissions struct {
 	sub    perm
 	pub    perm
 	resp   *ResponsePermission
-	pcache map[string]bool
+	pcache *permCache
+	// See Permissions.MinWildcardDepth.
+	minWildcardDepth int
+}
+
+// permCache is a LRU cache of publish permission results keyed by the
+// literal subject. It has its own lock since, for routes and leafnodes,
+// it is also accessed outside the readLoop when checking imports, with
+// or without the client lock. The statistics are updated atomically so
+// they can be reported in connz without the lock.
+type permCache struct {
+	mu     sync.Mutex
+	m      map[string]*list.Element
+	ll     *list.List
+	hits   uint64
+	misses uint64
+	size   int64
+}
+
+type permCacheEntry struct {
+	subject string
+	allowed bool
+}
+
+func newPermCache() *permCache {
+	return &permCache{m: make(map[string]*list.Element), ll: list.New()}
+}
+
+// get returns the cached result for this subject, if any, and marks it
+// as most recently used.
+func (pc *permCache) get(subject string) (bool, bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	e, ok := pc.m[subject]
+	if !ok {
+		atomic.AddUint64(&pc.misses, 1)
+		return false, false
+	}
+	atomic.AddUint64(&pc.hits, 1)
+	pc.ll.MoveToFront(e)
+	return e.Value.(*permCacheEntry).allowed, true
+}
+
+// set stores the result for this subject, evicting the least recently
+// used entry if the cache is full.
+func (pc *permCache) set(subject string, allowed bool) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if e, ok := pc.m[subject]; ok {
+		e.Value.(*permCacheEntry).allowed = allowed
+		pc.ll.MoveToFront(e)
+		return
+	}
+	pc.m[subject] = pc.ll.PushFront(&permCacheEntry{subject, allowed})
+	if pc.ll.Len() > maxPermCacheSize {
+		e := pc.ll.Back()
+		pc.ll.Remove(e)
+		delete(pc.m, e.Value.(*permCacheEntry).subject)
+	}
+	atomic.StoreInt64(&pc.size, int64(pc.ll.Len()))
+}
+
+// stats returns the current statistics of the cache.
+func (pc *permCache) stats() *PermCacheStats {
+	hits, misses := atomic.LoadUint64(&pc.hits), atomic.LoadUint64(&pc.misses)
+	ps := &PermCacheStats{
+		Size:   int(atomic.LoadInt64(&pc.size)),
+		Hits:   hits,
+		Misses: misses,
+	}
+	if total := hits + misses; total > 0 {
+		ps.HitRate = float64(hits) / float64(total)
+	}
+	return ps
 }
 
 // This is used to dynamically track responses and reply subjects
@@ -307,8 +434,7 @@ const (
 // Used in readloop to cache hot subject lookups and group statistics.
 type readCache struct {
 	// These are for clients who are bound to a single account.
-	genid   uint64
-	results map[string]*SublistResult
+	results map[string]l1Result
 
 	// This is for routes and gateways to have their own L1 as well that is account aware.
 	pacache map[string]*perAccountCache
@@ -326,6 +452,13 @@ type readCache struct {
 
 	rsz int32 // Read buffer size
 	srs int32 // Short reads, used for dynamic buffer resizing.
+
+	// Set when the client enabled compression in CONNECT.
+	cconn *compressedConn
+
+	// Counts of reads and matches for latency sampling.
+	lsp uint32
+	lsm uint32
 }
 
 const (
@@ -340,6 +473,13 @@ var (
 	closedSubsCheckInterval  = defaultClosedSubsCheckInterval
 )
 
+// l1Result is a result of the L1 cache, valid as long as the generation
+// of its subject in the sublist does not change.
+type l1Result struct {
+	results *SublistResult
+	genid   uint64
+}
+
 // perAccountCache is for L1 semantics for inbound messages from a route or gateway to mimic the performance of clients.
 type perAccountCache struct {
 	acc     *Account
@@ -367,7 +507,7 @@ func (c *client) GetOpts() *clientOpts {
 // GetTLSConnectionState returns the TLS ConnectionState if TLS is enabled, nil
 // otherwise. Implements the ClientAuth interface.
 func (c *client) GetTLSConnectionState() *tls.ConnectionState {
-	tc, ok := c.nc.(*tls.Conn)
+	tc, ok := rawConn(c.nc).(*tls.Conn)
 	if !ok {
 		return nil
 	}
@@ -390,6 +530,19 @@ type subscription struct {
 	max     int64
 	qw      int32
 	closed  int32
+
+	// Set when kept out of the account sublist, see isFirehose.
+	firehose bool
+
+	// Set when the messages published by the connection itself are not
+	// delivered to this subscription.
+	noEcho bool
+
+	// For credit based queue subscriptions, the maximum and the current
+	// number of credits, see subCreditsArg. Credits are updated with
+	// atomics.
+	maxCredits int32
+	credits    int32
 }
 
 // Indicate that this subscription is closed.
@@ -421,6 +574,16 @@ type clientOpts struct {
 	Protocol      int    `json:"protocol"`
 	Account       string `json:"account,omitempty"`
 	AccountNew    bool   `json:"new_account,omitempty"`
+	Replay        bool   `json:"replay,omitempty"`
+	DurableID     string `json:"durable_id,omitempty"`
+	Compression   string `json:"compression,omitempty"`
+
+	// Metadata of the application, such as its build, locale or time zone,
+	// reported in connz and in the connect and disconnect events.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Features supported by the client.
+	Features Feature `json:"features,omitempty"`
 
 	// Routes only
 	Import *SubjectPermission `json:"import,omitempty"`
@@ -446,12 +609,20 @@ func (c *client) initClient() {
 	// Snapshots to avoid mutex access in fast paths.
 	c.out.wdl = opts.WriteDeadline
 	c.out.mp = opts.MaxPending
+	c.out.crk = opts.writeCork(c.kind)
+	if c.kind == CLIENT {
+		c.out.pac = opts.WritePacing
+	}
 
 	c.subs = make(map[string]*subscription)
 	c.echo = true
 
 	c.debug = (atomic.LoadInt32(&c.srv.logging.debug) != 0)
 	c.trace = (atomic.LoadInt32(&c.srv.logging.trace) != 0)
+	c.logLevel = atomic.LoadInt32(&c.srv.logging.kinds[c.kind])
+	if c.logLevel&logLevelTrace != 0 {
+		c.trace = true
+	}
 
 	if c.kind == SYSTEM && !c.srv.logging.traceSysAcc {
 		c.trace = false
@@ -469,7 +640,7 @@ func (c *client) initClient() {
 
 	// snapshot the string version of the connection
 	var conn string
-	if ip, ok := c.nc.(*net.TCPConn); ok {
+	if ip, ok := unwrapFaultConn(c.nc).(*net.TCPConn); ok {
 		conn = ip.RemoteAddr().String()
 		host, port, _ := net.SplitHostPort(conn)
 		iPort, _ := strconv.Atoi(port)
@@ -509,6 +680,10 @@ func (c *client) reportErrRegisterAccount(acc *Account, err error) {
 		c.maxAccountConnExceeded()
 		return
 	}
+	if err == ErrAccountFrozen {
+		c.accountFrozen()
+		return
+	}
 	c.Errorf("Problem registering with account [%s]", acc.Name)
 	c.sendErr("Failed Account Registration")
 }
@@ -526,13 +701,28 @@ func (c *client) registerWithAccount(acc *Account) error {
 		}
 	}
 
+	interval, maxOut := acc.getPingInterval()
+
 	c.mu.Lock()
 	kind := c.kind
 	srv := c.srv
 	c.acc = acc
 	c.applyAccountLimits()
+	if kind == CLIENT {
+		c.ping.interval, c.ping.maxOut = interval, maxOut
+		// Reset the timer set with the interval of the server.
+		if interval > 0 && c.ping.tmr != nil {
+			c.clearPingTimer()
+			c.setPingTimer()
+		}
+	}
 	c.mu.Unlock()
 
+	// New connections of a frozen account are rejected.
+	if (kind == CLIENT || kind == LEAF) && acc.IsFrozen() {
+		return ErrAccountFrozen
+	}
+
 	// Check if we have a max connections violation
 	if kind == CLIENT && acc.MaxTotalConnectionsReached() {
 		return ErrTooManyAccountConnections
@@ -606,6 +796,7 @@ func (c *client) RegisterUser(user *User) {
 	}
 
 	c.mu.Lock()
+	c.authID = user.Username
 
 	// Assign permissions.
 	if user.Permissions == nil {
@@ -632,6 +823,7 @@ func (c *client) RegisterNkeyUser(user *NkeyUser) error {
 
 	c.mu.Lock()
 	c.user = user
+	c.authID = user.Nkey
 	// Assign permissions.
 	if user.Permissions == nil {
 		// Reset perms to nil in case client previously had them.
@@ -662,8 +854,10 @@ func (c *client) setPermissions(perms *Permissions) {
 	if perms == nil {
 		return
 	}
+	// Replacing the permissions also invalidates the publish cache.
 	c.perms = &permissions{}
-	c.perms.pcache = make(map[string]bool)
+	c.perms.pcache = newPermCache()
+	c.perms.minWildcardDepth = perms.MinWildcardDepth
 
 	// Loop over publish permissions
 	if perms.Publish != nil {
@@ -732,8 +926,48 @@ func (c *client) checkExpiration(claims *jwt.ClaimsData) {
 	if claims.Expires < tn {
 		return
 	}
-	expiresAt := time.Duration(claims.Expires - tn)
-	c.setExpirationTimer(expiresAt * time.Second)
+	expiresAt := time.Duration(claims.Expires-tn) * time.Second
+	c.setExpirationTimer(expiresAt)
+	if w := c.srv.getOpts().JWTExpiryWarning; w > 0 {
+		c.setExpiryWarningTimer(expiresAt - w)
+	}
+}
+
+// Check that the client's address is allowed by the user's and the
+// account's source lists, and that the client uses TLS if the account
+// requires it.
+func (c *client) checkConnectionSource(allow, deny []string, acc *Account) bool {
+	c.mu.Lock()
+	host := c.host
+	c.mu.Unlock()
+	if !validateSource(host, allow, deny) {
+		c.Debugf("User not allowed to connect from %q", host)
+		return false
+	}
+	if allow, deny = acc.getSourceLists(); !validateSource(host, allow, deny) {
+		c.Debugf("Account %q not allowed to connect from %q", acc.Name, host)
+		return false
+	}
+	if acc.getTLSRequired() && c.GetTLSConnectionState() == nil {
+		c.Debugf("Account %q requires TLS", acc.Name)
+		return false
+	}
+	return true
+}
+
+// Check that the client is allowed to connect at this time given the
+// user's connection time windows, and if so, set the timer that will
+// disconnect the client when the current window closes.
+func (c *client) checkConnectionTimes(times []jwt.TimeRange) bool {
+	allowed, window := validateTimes(times, time.Now())
+	if !allowed {
+		c.Debugf("User not allowed to connect at this time")
+		return false
+	}
+	if window > 0 {
+		c.setExpirationTimer(window)
+	}
+	return true
 }
 
 // This will load up the deny structure used for filtering delivered
@@ -750,6 +984,7 @@ func (c *client) loadMsgDenyFilter() {
 // Runs in its own Go routine.
 func (c *client) writeLoop() {
 	defer c.srv.grWG.Done()
+	defer c.loopStarted()()
 	c.mu.Lock()
 	if c.isClosed() {
 		c.mu.Unlock()
@@ -761,6 +996,7 @@ func (c *client) writeLoop() {
 
 	// This will clear connection state and remove it from the server.
 	defer c.teardownConn()
+	defer c.out.wl.done()
 
 	// Used to check that we did flush from last wake up.
 	waitOk := true
@@ -769,19 +1005,35 @@ func (c *client) writeLoop() {
 	const maxWait = time.Second
 	t := time.NewTimer(maxWait)
 
+	// Used to hold small writes, stopped until then.
+	var ct *time.Timer
+	if c.out.crk > 0 {
+		ct = time.NewTimer(time.Hour)
+		ct.Stop()
+	}
+
 	var close bool
 
 	// Main loop. Will wait to be signaled and then will use
 	// buffered outbound structure for efficient writev to the underlying socket.
 	for {
+		c.out.wl.start()
 		c.mu.Lock()
 		if close = c.flags.isSet(closeConnection); !close {
+			if c.out.pac != nil {
+				c.releasePaced()
+			}
 			owtf := c.out.fsp > 0 && c.out.pb < maxBufSize && c.out.fsp < maxFlushPending
-			if waitOk && (c.out.pb == 0 || owtf) {
+			if waitOk && (c.pendingWrite() == 0 || owtf) {
+				wait := maxWait
+				if c.out.pac != nil {
+					wait = c.pacedWait(maxWait)
+				}
 				c.mu.Unlock()
+				c.out.wl.done()
 
 				// Reset our timer
-				t.Reset(maxWait)
+				t.Reset(wait)
 
 				// Wait on pending data.
 				select {
@@ -789,10 +1041,16 @@ func (c *client) writeLoop() {
 				case <-t.C:
 				}
 
+				c.out.wl.start()
 				c.mu.Lock()
-				close = c.flags.isSet(closeConnection)
+				if close = c.flags.isSet(closeConnection); !close && c.out.pac != nil {
+					c.releasePaced()
+				}
 			}
 		}
+		if !close && c.out.crk > 0 {
+			close = c.corkOutbound(ch, ct)
+		}
 		if close {
 			c.flushAndClose(false)
 			c.mu.Unlock()
@@ -804,6 +1062,37 @@ func (c *client) writeLoop() {
 	}
 }
 
+// Pending data is flushed right away when corked once it reaches this size.
+const corkMaxPending = 32 * 1024
+
+// corkOutbound holds small pending data for up to the cork time of the
+// connection, so that bursts of small messages are coalesced into fewer
+// writes. Returns true if the connection is to be closed.
+// Lock is held on entry and released while waiting.
+func (c *client) corkOutbound(ch chan struct{}, t *time.Timer) bool {
+	deadline := time.Now().Add(c.out.crk)
+	for c.out.pb < corkMaxPending && len(c.out.hp) == 0 {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			break
+		}
+		c.mu.Unlock()
+		t.Reset(wait)
+		select {
+		case <-ch:
+			if !t.Stop() {
+				<-t.C
+			}
+		case <-t.C:
+		}
+		c.mu.Lock()
+		if c.flags.isSet(closeConnection) {
+			return true
+		}
+	}
+	return false
+}
+
 // flushClients will make sure to flush any clients we may have
 // sent to during processing. We pass in a budget as a time.Duration
 // for how much time to spend in place flushing for this client. This
@@ -811,6 +1100,12 @@ func (c *client) writeLoop() {
 // message that now is being delivered.
 func (c *client) flushClients(budget time.Duration) time.Time {
 	last := time.Now()
+	// Queue the +OK owed for the PUBs that were processed.
+	if atomic.LoadInt32(&c.oks) > 0 {
+		c.mu.Lock()
+		c.flushOKs()
+		c.mu.Unlock()
+	}
 	// Check pending clients for flush.
 	for cp := range c.pcd {
 		// TODO(dlc) - Wonder if it makes more sense to create a new map?
@@ -829,7 +1124,8 @@ func (c *client) flushClients(budget time.Duration) time.Time {
 			continue
 		}
 
-		if budget > 0 && cp.flushOutbound() {
+		// Corked connections are flushed by their writeLoop.
+		if budget > 0 && cp.out.crk == 0 && cp.flushOutbound() {
 			budget -= cp.out.lft
 		} else {
 			cp.flushSignal()
@@ -848,6 +1144,7 @@ func (c *client) readLoop() {
 	c.mu.Lock()
 	s := c.srv
 	defer s.grWG.Done()
+	defer c.loopStarted()()
 	if c.isClosed() {
 		c.mu.Unlock()
 		return
@@ -860,7 +1157,7 @@ func (c *client) readLoop() {
 	c.mcl = MAX_CONTROL_LINE_SIZE
 	if s != nil {
 		if opts := s.getOpts(); opts != nil {
-			c.mcl = int32(opts.MaxControlLine)
+			c.mcl = opts.maxControlLine(c.kind)
 		}
 	}
 	// Check the per-account-cache for closed subscriptions
@@ -879,6 +1176,10 @@ func (c *client) readLoop() {
 	b := make([]byte, c.in.rsz)
 
 	for {
+		// Stop reading from clients while the server is under memory pressure.
+		if c.kind == CLIENT && s != nil && atomic.LoadInt32(&s.memPressure) == 1 {
+			c.waitForMemory(s)
+		}
 		n, err := nc.Read(b)
 		// If we have any data we will try to parse and exit at the end.
 		if n == 0 && err != nil {
@@ -887,6 +1188,9 @@ func (c *client) readLoop() {
 		}
 		start := time.Now()
 
+		// Pick up changes of the trace level.
+		c.syncTraceLevel()
+
 		// Clear inbound stats cache
 		c.in.msgs = 0
 		c.in.bytes = 0
@@ -894,7 +1198,11 @@ func (c *client) readLoop() {
 
 		// Main call into parser for inbound data. This will generate callouts
 		// to process messages, etc.
-		if err := c.parse(b[:n]); err != nil {
+		err = c.parse(b[:n])
+		if s.sampleLatency(&c.in.lsp) {
+			s.recordLatency(latencyStageParse, time.Since(start))
+		}
+		if err != nil {
 			if dur := time.Since(start); dur >= readLoopReportThreshold {
 				c.Warnf("Readloop processing time: %v", dur)
 			}
@@ -903,13 +1211,21 @@ func (c *client) readLoop() {
 			// decremented and their writeLoop signaled.
 			c.flushClients(0)
 			// handled inline
-			if err != ErrMaxPayload && err != ErrAuthentication {
+			if err == ErrScannerProbe {
+				c.closeConnection(ProtocolViolation)
+			} else if err != ErrMaxPayload && err != ErrAuthentication && err != ErrDuplicateConnection &&
+				err != ErrSessionMigrated && !isSubjectLimitErr(err) {
 				c.Error(err)
 				c.closeConnection(ProtocolViolation)
 			}
 			return
 		}
 
+		// Switch to the compressed connection if enabled in CONNECT.
+		if c.in.cconn != nil {
+			nc, c.in.cconn = c.in.cconn, nil
+		}
+
 		// Updates stats for client and server that were collected
 		// from parsing through the buffer.
 		if c.in.msgs > 0 {
@@ -917,6 +1233,9 @@ func (c *client) readLoop() {
 			atomic.AddInt64(&c.inBytes, int64(c.in.bytes))
 			atomic.AddInt64(&s.inMsgs, int64(c.in.msgs))
 			atomic.AddInt64(&s.inBytes, int64(c.in.bytes))
+			if c.acc != nil {
+				c.acc.usage.addIn(c.kind, int64(c.in.msgs), int64(c.in.bytes))
+			}
 		}
 
 		// Budget to spend in place flushing outbound data.
@@ -931,6 +1250,9 @@ func (c *client) readLoop() {
 		// Flush, or signal to writeLoop to flush to socket.
 		last := c.flushClients(budget)
 
+		// Account the processing time, pausing if over the CPU quota.
+		c.chargeCPU(time.Since(start))
+
 		// Update activity, check read buffer size.
 		c.mu.Lock()
 		closed := c.isClosed()
@@ -939,6 +1261,10 @@ func (c *client) readLoop() {
 		if c.in.msgs > 0 || c.in.subs > 0 {
 			c.last = last
 		}
+		// Anything received wakes up a suspended connection.
+		if n > 0 && !c.ping.suspended.IsZero() {
+			c.resume()
+		}
 
 		if n >= cap(b) {
 			c.in.srs = 0
@@ -1008,6 +1334,47 @@ func (c *client) handlePartialWrite(pnb net.Buffers) {
 	c.out.nb = append(pnb, nb...)
 }
 
+// insertPriorityData places the high priority data in front of the
+// pending data, but after the leading bytes that need to go out first,
+// such as what is left from a partial write. Data is always queued as
+// complete protocols, so this is a protocol boundary.
+// Lock is held on entry.
+func (c *client) insertPriorityData(nb net.Buffers) net.Buffers {
+	hp := c.out.hp
+	c.out.hp = nil
+	left := c.out.pbo
+	if left == 0 {
+		return append(net.Buffers{hp}, nb...)
+	}
+	pnb := make(net.Buffers, 0, len(nb)+2)
+	for i, b := range nb {
+		if left == 0 {
+			pnb = append(pnb, hp)
+			return append(pnb, nb[i:]...)
+		}
+		if int64(len(b)) <= left {
+			pnb = append(pnb, b)
+			left -= int64(len(b))
+			continue
+		}
+		// Limit the capacity of the first part since it could be reused
+		// as the primary buffer while the second part is still pending.
+		pnb = append(pnb, b[:left:left], hp, b[left:])
+		return append(pnb, nb[i+1:]...)
+	}
+	return append(pnb, hp)
+}
+
+// enablePriorityLane allows high priority data to be written ahead of
+// other pending data. Everything already pending will still be written
+// first, since it may contain protocols that need to be sent in order,
+// such as INFO or CONNECT.
+// Lock is held on entry.
+func (c *client) enablePriorityLane() {
+	c.flags.set(priorityLane)
+	c.out.pbo = c.out.pb
+}
+
 // flushOutbound will flush outbound buffer to a client.
 // Will return true if data was attempted to be written.
 // Lock must be held
@@ -1024,8 +1391,9 @@ func (c *client) flushOutbound() bool {
 	c.flags.set(flushOutbound)
 	defer c.flags.clear(flushOutbound)
 
-	// Check for nothing to do.
-	if c.nc == nil || c.srv == nil || c.out.pb == 0 {
+	// Check for nothing to do, paced messages that are held are written
+	// once released by the writeLoop.
+	if c.nc == nil || c.srv == nil || c.pendingWrite() == 0 {
 		return true // true because no need to queue a signal.
 	}
 
@@ -1033,6 +1401,11 @@ func (c *client) flushOutbound() bool {
 	nb := c.collapsePtoNB()
 	c.out.p, c.out.nb, c.out.s = c.out.s, nil, nil
 
+	// Insert any high priority data.
+	if len(c.out.hp) > 0 {
+		nb = c.insertPriorityData(nb)
+	}
+
 	// For selecting primary replacement.
 	cnb := nb
 	var lfs int
@@ -1042,7 +1415,7 @@ func (c *client) flushOutbound() bool {
 
 	// In case it goes away after releasing the lock.
 	nc := c.nc
-	attempted := c.out.pb
+	attempted := c.pendingWrite()
 	apm := c.out.pm
 
 	// Capture this (we change the value in some tests)
@@ -1058,6 +1431,10 @@ func (c *client) flushOutbound() bool {
 
 	// Actual write to the socket.
 	n, err := nb.WriteTo(nc)
+	// Compressed data is buffered, send it once for all the buffers.
+	if cc, ok := nc.(*compressedConn); ok && err == nil {
+		err = cc.Flush()
+	}
 	nc.SetWriteDeadline(time.Time{})
 	lft := time.Since(now)
 
@@ -1086,6 +1463,13 @@ func (c *client) flushOutbound() bool {
 	// Update flush time statistics.
 	c.out.lft = lft
 	c.out.lwb = int32(n)
+	if c.srv.sampleLatency(&c.out.lsf) {
+		c.srv.recordLatency(latencyStageFlush, lft)
+	}
+	if !c.out.lqt.IsZero() {
+		c.srv.recordLatency(latencyStageOutbound, time.Since(c.out.lqt))
+		c.out.lqt = time.Time{}
+	}
 
 	// Subtract from pending bytes and messages.
 	c.out.pb -= int64(c.out.lwb)
@@ -1095,8 +1479,13 @@ func (c *client) flushOutbound() bool {
 	// TODO(dlc) - zero write with no error will cause lost message and the writeloop to spin.
 	if int64(c.out.lwb) != attempted && n > 0 {
 		c.handlePartialWrite(nb)
-	} else if c.out.lwb >= c.out.sz {
-		c.out.sws = 0
+		// What is left needs to go out before any high priority data.
+		c.out.pbo = attempted - n
+	} else {
+		c.out.pbo = 0
+		if c.out.lwb >= c.out.sz {
+			c.out.sws = 0
+		}
 	}
 
 	// Adjust based on what we wrote plus any pending.
@@ -1130,7 +1519,7 @@ func (c *client) flushOutbound() bool {
 
 	// Check that if there is still data to send and writeLoop is in wait,
 	// then we need to signal.
-	if c.out.pb > 0 {
+	if c.pendingWrite() > 0 {
 		c.flushSignal()
 	}
 
@@ -1194,6 +1583,9 @@ func (c *client) markConnAsClosed(reason ClosedState, skipFlush bool) bool {
 	if skipFlush {
 		c.flags.set(skipFlushOnClose)
 	}
+	if c.srv != nil && isHandshakeFailure(reason) {
+		atomic.AddInt64(&c.srv.handshakeFailures, 1)
+	}
 	// Save off the connection if its a client or leafnode.
 	if c.kind == CLIENT || c.kind == LEAF {
 		if nc := c.nc; nc != nil && c.srv != nil {
@@ -1229,7 +1621,12 @@ func (c *client) traceMsg(msg []byte) {
 		return
 	}
 
-	maxTrace := c.srv.getOpts().MaxTracedMsgLen
+	opts := c.srv.getOpts()
+	if tr := opts.TraceRedaction; tr != nil && tr.Payload != _EMPTY_ {
+		c.Tracef("<<- MSG_PAYLOAD: [%s]", redactPayload(tr, msg[:len(msg)-LEN_CR_LF]))
+		return
+	}
+	maxTrace := opts.MaxTracedMsgLen
 	if maxTrace > 0 && (len(msg)-LEN_CR_LF) > maxTrace {
 		c.Tracef("<<- MSG_PAYLOAD: [\"%s...\"]", msg[:maxTrace])
 	} else {
@@ -1324,6 +1721,30 @@ func removePassFromTrace(arg []byte) []byte {
 	return buf
 }
 
+// Credentials, other than passwords, pattern matcher.
+var credsPat = regexp.MustCompile(`"(auth_token|jwt|sig)"\s*:\s*"[^"]*"`)
+
+// removeCredsFromTrace removes the auth token, JWT and signature from
+// trace messages for logging.
+func removeCredsFromTrace(arg []byte) []byte {
+	if !credsPat.Match(arg) {
+		return arg
+	}
+	return credsPat.ReplaceAll(arg, []byte(`"$1":"[REDACTED]"`))
+}
+
+// redactPayload returns the redacted form of a traced payload.
+func redactPayload(tr *TraceRedactionOpts, payload []byte) string {
+	if tr.Payload == TraceRedactHash {
+		return fmt.Sprintf("%d bytes sha256:%x", len(payload), sha256.Sum256(payload))
+	}
+	n := tr.PayloadLen
+	if n > len(payload) {
+		n = len(payload)
+	}
+	return fmt.Sprintf("%d bytes %q...", len(payload), payload[:n])
+}
+
 // Returns the RTT by computing the elapsed time since now and `start`.
 // On Windows VM where I (IK) run tests, time.Since() will return 0
 // (I suspect some time granularity issues). So return at minimum 1ns.
@@ -1337,10 +1758,26 @@ func computeRTT(start time.Time) time.Duration {
 
 func (c *client) processConnect(arg []byte) error {
 	if c.trace {
-		c.traceInOp("CONNECT", removePassFromTrace(arg))
+		targ := removePassFromTrace(arg)
+		if tr := c.srv.getOpts().TraceRedaction; tr != nil && tr.Connect {
+			targ = removeCredsFromTrace(targ)
+		}
+		c.traceInOp("CONNECT", targ)
+	}
+
+	// Features offered by the server, getOpts() does not need the lock.
+	offered := ^Feature(0)
+	if c.srv != nil {
+		offered = serverFeatures(c.srv.getOpts())
 	}
 
 	c.mu.Lock()
+	// A second CONNECT would authenticate the connection again, possibly
+	// with another identity.
+	if c.flags.isSet(connectReceived) && (c.kind == CLIENT || c.kind == LEAF) {
+		c.mu.Unlock()
+		return c.protoStateViolation(ErrDuplicateConnect)
+	}
 	// If we can't stop the timer because the callback is in progress...
 	if !c.clearAuthTimer() {
 		// wait for it to finish and handle sending the failure back to
@@ -1353,6 +1790,7 @@ func (c *client) processConnect(arg []byte) error {
 		c.mu.Unlock()
 		return nil
 	}
+	c.untrackPendingAuth()
 	c.last = time.Now()
 	// Estimate RTT to start.
 	if c.kind == CLIENT {
@@ -1378,6 +1816,11 @@ func (c *client) processConnect(arg []byte) error {
 	// Indicate that the CONNECT protocol has been received, and that the
 	// server now knows which protocol this client supports.
 	c.flags.set(connectReceived)
+	// System messages are delivered ahead of other pending data to clients.
+	if c.kind == CLIENT {
+		c.enablePriorityLane()
+	}
+	c.feats = negotiateFeatures(offered, &c.opts)
 	// Capture these under lock
 	c.echo = c.opts.Echo
 	proto := c.opts.Protocol
@@ -1386,6 +1829,11 @@ func (c *client) processConnect(arg []byte) error {
 	account := c.opts.Account
 	accountNew := c.opts.AccountNew
 	ujwt := c.opts.JWT
+	durableID := c.opts.DurableID
+	compression := c.opts.Compression
+	metadata := c.opts.Metadata
+	durable := c.hasFeature(FeatureDurable)
+	compress := c.hasFeature(FeatureCompression)
 	c.mu.Unlock()
 
 	if srv != nil {
@@ -1414,6 +1862,10 @@ func (c *client) processConnect(arg []byte) error {
 			c.authViolation()
 			return ErrAuthentication
 		}
+		if !c.policyAllows(PolicyConnect, _EMPTY_, _EMPTY_) {
+			c.authViolation()
+			return ErrAuthentication
+		}
 
 		// Check for Account designation, this section should be only used when there is not a jwt.
 		if account != "" {
@@ -1448,6 +1900,30 @@ func (c *client) processConnect(arg []byte) error {
 			c.registerWithAccount(srv.gacc)
 		}
 
+		// Track the client identity across reconnects.
+		if kind == CLIENT && durable {
+			srv.trackDurableConn(c, durableID)
+		}
+
+		// Limit the identity to a single connection if configured.
+		if kind == CLIENT {
+			if err := srv.checkUniqueConn(c); err != nil {
+				return err
+			}
+		}
+
+		// Clients whose session was migrated reconnect to the other server.
+		if kind == CLIENT && durableID != _EMPTY_ {
+			c.mu.Lock()
+			acc := c.acc
+			c.mu.Unlock()
+			if acc != nil {
+				if err := srv.checkMigratedAway(c, acc.Name, durableID); err != nil {
+					return err
+				}
+			}
+		}
+
 	}
 
 	switch kind {
@@ -1458,6 +1934,24 @@ func (c *client) processConnect(arg []byte) error {
 			c.closeConnection(BadClientProtocolVersion)
 			return ErrBadClientProtocol
 		}
+		if metadataSize(metadata) > MAX_CLIENT_METADATA_SIZE {
+			c.sendErr(ErrClientMetadataTooLarge.Error())
+			return ErrClientMetadataTooLarge
+		}
+		// Everything after the CONNECT is compressed, including the +OK.
+		if compression != "" && srv != nil {
+			if !compress {
+				c.sendErr(ErrUnsupportedCompression.Error())
+				return ErrUnsupportedCompression
+			}
+			c.mu.Lock()
+			err := c.startCompression(compression)
+			c.mu.Unlock()
+			if err != nil {
+				c.sendErr(err.Error())
+				return err
+			}
+		}
 		if verbose {
 			c.sendOK()
 		}
@@ -1474,6 +1968,15 @@ func (c *client) processConnect(arg []byte) error {
 	return nil
 }
 
+// metadataSize returns the size of the keys and values of client metadata.
+func metadataSize(md map[string]string) int {
+	n := 0
+	for k, v := range md {
+		n += len(k) + len(v)
+	}
+	return n
+}
+
 func (c *client) sendErrAndErr(err string) {
 	c.sendErr(err)
 	c.Errorf(err)
@@ -1500,6 +2003,12 @@ func (c *client) accountAuthExpired() {
 }
 
 func (c *client) authViolation() {
+	c.authViolationWithReason(CloseReasonAuthViolation)
+}
+
+// authViolationWithReason is an authViolation sending this close reason to
+// the clients that negotiated it.
+func (c *client) authViolationWithReason(r CloseReason) {
 	var s *Server
 	var hasTrustedNkeys, hasNkeys, hasUsers bool
 	if s = c.srv; s != nil {
@@ -1509,7 +2018,7 @@ func (c *client) authViolation() {
 		hasUsers = s.users != nil
 		s.mu.Unlock()
 		defer s.sendAuthErrorEvent(c)
-
+		defer c.authFailureBan()
 	}
 	if hasTrustedNkeys {
 		c.Errorf("%v", ErrAuthentication)
@@ -1524,7 +2033,7 @@ func (c *client) authViolation() {
 	} else {
 		c.Errorf(ErrAuthentication.Error())
 	}
-	c.sendErr("Authorization Violation")
+	c.sendErr(c.closeReasonText("Authorization Violation", r))
 	c.closeConnection(AuthenticationViolation)
 }
 
@@ -1548,6 +2057,55 @@ func (c *client) maxPayloadViolation(sz int, max int32) {
 	c.closeConnection(MaxPayloadExceeded)
 }
 
+// checkSubjectLimits checks the subject and reply subject against the
+// configured limits. On violation, the client is notified and closed.
+func (c *client) checkSubjectLimits(subject, reply []byte) error {
+	s := c.srv
+	if s == nil {
+		return nil
+	}
+	var err error
+	var errTxt string
+	if max := atomic.LoadInt32(&s.subjectLimits.maxLen); max > 0 && len(subject) > int(max) {
+		err, errTxt = ErrMaxSubjectLength, "Maximum Subject Length Exceeded"
+	} else if max := atomic.LoadInt32(&s.subjectLimits.maxTokens); max > 0 && bytes.Count(subject, []byte(tsep)) >= int(max) {
+		err, errTxt = ErrMaxSubjectTokens, "Maximum Subject Tokens Exceeded"
+	} else if max := atomic.LoadInt32(&s.subjectLimits.maxReply); max > 0 && len(reply) > int(max) {
+		err, errTxt = ErrMaxReplyLength, "Maximum Reply Subject Length Exceeded"
+	} else {
+		return nil
+	}
+	atomic.AddInt64(&s.subjectLimitViolations, 1)
+	c.Errorf("%s: %q", err.Error(), subject)
+	c.sendErr(errTxt)
+	c.closeConnection(SubjectLimitExceeded)
+	return err
+}
+
+// protoStateViolation reports a protocol operation received when the
+// state of the connection does not allow it, or rejected by the strict
+// protocol validation. The returned error closes the connection.
+func (c *client) protoStateViolation(err error) error {
+	if s := c.srv; s != nil {
+		atomic.AddInt64(&s.protoStateViolations, 1)
+	}
+	c.sendErr(err.Error())
+	return err
+}
+
+// isStrictProtocol returns true if the protocol of clients is strictly
+// validated, in which case invalid subjects and PUB, SUB or UNSUB before
+// CONNECT close the connection.
+func (c *client) isStrictProtocol() bool {
+	s := c.srv
+	return s != nil && atomic.LoadInt32(&s.subjectLimits.strict) == 1
+}
+
+// isSubjectLimitErr returns true for the errors of checkSubjectLimits.
+func isSubjectLimitErr(err error) bool {
+	return err == ErrMaxSubjectLength || err == ErrMaxSubjectTokens || err == ErrMaxReplyLength
+}
+
 // queueOutbound queues data for a clientconnection.
 // Return if the data is referenced or not. If referenced, the caller
 // should not reuse the `data` array.
@@ -1575,6 +2133,12 @@ func (c *client) queueOutbound(data []byte) bool {
 		return referenced
 	}
 
+	// Time until this data is written to the connection, unless older
+	// data is already being timed.
+	if c.srv.sampleLatency(&c.out.lso) && c.out.lqt.IsZero() {
+		c.out.lqt = time.Now()
+	}
+
 	if c.out.p == nil && len(data) < maxBufSize {
 		if c.out.sz == 0 {
 			c.out.sz = startBufSize
@@ -1641,6 +2205,35 @@ func (c *client) queueOutbound(data []byte) bool {
 	return referenced
 }
 
+// queuePriorityOutbound queues data that will be written before other
+// pending data, so that it is not starved by bulk data. It is used for
+// the PING, PONG and -ERR protocols of routes and leafnodes, which can be
+// reordered with other protocols, and for the $SYS messages delivered to
+// clients. Interest protocols and other messages must not use it since
+// they have to be sent in order. The data counts
+// towards the pending bytes. If the priority lane has not been enabled
+// for this connection, this is the same as queueOutbound.
+// Assume the lock is held upon entry.
+func (c *client) queuePriorityOutbound(data []byte) {
+	if !c.flags.isSet(priorityLane) {
+		c.queueOutbound(data)
+		return
+	}
+	// Do not keep going if closed
+	if c.flags.isSet(closeConnection) {
+		return
+	}
+	c.out.pb += int64(len(data))
+	if c.kind == CLIENT && c.out.pb > c.out.mp {
+		c.out.pb -= int64(len(data))
+		atomic.AddInt64(&c.srv.slowConsumers, 1)
+		c.Noticef("Slow Consumer Detected: MaxPending of %d Exceeded", c.out.mp)
+		c.markConnAsClosed(SlowConsumerPendingBytes, true)
+		return
+	}
+	c.out.hp = append(c.out.hp, data...)
+}
+
 // Assume the lock is held upon entry.
 func (c *client) enqueueProtoAndFlush(proto []byte, doFlush bool) {
 	if c.isClosed() {
@@ -1667,8 +2260,21 @@ func (c *client) enqueueProto(proto []byte) {
 
 // Assume the lock is held upon entry.
 func (c *client) sendPong() {
-	c.traceOutOp("PONG", nil)
-	c.enqueueProto([]byte(pongProto))
+	c.sendPongProto([]byte(pongProto))
+}
+
+// Assume the lock is held upon entry.
+func (c *client) sendPongProto(proto []byte) {
+	c.flushOKs()
+	c.traceOutOp("PONG", proto[4:len(proto)-LEN_CR_LF])
+	// Routes and leafnodes have no expectation on the order of PONGs and
+	// messages.
+	if c.kind == ROUTER || c.kind == LEAF {
+		c.queuePriorityOutbound(proto)
+		c.flushSignal()
+		return
+	}
+	c.enqueueProto(proto)
 }
 
 // Used to kick off a RTT measurement for latency tracking.
@@ -1701,8 +2307,14 @@ func (c *client) sendRTTPingLocked() bool {
 func (c *client) sendPing() {
 	c.rttStart = time.Now()
 	c.ping.out++
-	c.traceOutOp("PING", nil)
-	c.enqueueProto([]byte(pingProto))
+	proto := c.pingProtoAt(c.rttStart)
+	c.traceOutOp("PING", proto[4:len(proto)-LEN_CR_LF])
+	if c.kind == ROUTER || c.kind == LEAF {
+		c.queuePriorityOutbound(proto)
+		c.flushSignal()
+		return
+	}
+	c.enqueueProto(proto)
 }
 
 // Generates the INFO to be sent to the client with the client ID included.
@@ -1712,27 +2324,91 @@ func (c *client) generateClientInfoJSON(info Info) []byte {
 	info.CID = c.cid
 	info.ClientIP = c.host
 	info.MaxPayload = c.mpay
+	opts := c.srv.getOpts()
+	opts.ClientInfo.apply(&info)
+	orderConnectURLs(opts.Cluster.ConnectURLsOrder, &info)
 	// Generate the info json
 	b, _ := json.Marshal(info)
 	pcs := [][]byte{[]byte("INFO"), b, []byte(CR_LF)}
 	return bytes.Join(pcs, []byte(" "))
 }
 
+// apply hides or replaces the details of the server in the INFO.
+func (ci *ClientInfoOpts) apply(info *Info) {
+	if ci.HideVersion {
+		info.Version, info.GitCommit = _EMPTY_, _EMPTY_
+	} else if ci.Version != _EMPTY_ {
+		info.Version, info.GitCommit = ci.Version, _EMPTY_
+	}
+	if ci.HideGo {
+		info.GoVersion = _EMPTY_
+	} else if ci.Go != _EMPTY_ {
+		info.GoVersion = ci.Go
+	}
+	if ci.HideHost {
+		info.Host = _EMPTY_
+	} else if ci.Host != _EMPTY_ {
+		info.Host = ci.Host
+	}
+}
+
 func (c *client) sendErr(err string) {
 	c.mu.Lock()
+	c.flushOKs()
 	c.traceOutOp("-ERR", []byte(err))
-	c.enqueueProto([]byte(fmt.Sprintf(errProto, err)))
+	proto := []byte(fmt.Sprintf(errProto, err))
+	// Errors of routes and leafnodes are not ordered with their messages.
+	if c.kind == ROUTER || c.kind == LEAF {
+		c.queuePriorityOutbound(proto)
+		c.flushSignal()
+	} else {
+		c.enqueueProto(proto)
+	}
 	c.mu.Unlock()
 }
 
 func (c *client) sendOK() {
 	c.mu.Lock()
+	c.flushOKs()
 	c.traceOutOp("OK", nil)
 	c.enqueueProto([]byte(okProto))
 	c.pcd[c] = needFlush
 	c.mu.Unlock()
 }
 
+// Protocol of a batch of +OK, sliced to queue the ones owed at once.
+var okBatch = bytes.Repeat([]byte(okProto), 64)
+
+// queueOK owes a +OK to a verbose client for a PUB. They are queued by
+// batch once the read buffer has been processed, or before anything else
+// is sent to the client from its readLoop so that the order is kept.
+// When tracing, the +OK is sent right away so that each one is traced.
+func (c *client) queueOK() {
+	if c.trace {
+		c.sendOK()
+		return
+	}
+	atomic.AddInt32(&c.oks, 1)
+}
+
+// flushOKs queues the +OK owed to the client.
+// Lock is held on entry.
+func (c *client) flushOKs() {
+	n := int(atomic.SwapInt32(&c.oks, 0))
+	if n == 0 || c.isClosed() {
+		return
+	}
+	for n > 0 {
+		k := n
+		if max := len(okBatch) / len(okProto); k > max {
+			k = max
+		}
+		c.queueOutbound(okBatch[:k*len(okProto)])
+		n -= k
+	}
+	c.flushSignal()
+}
+
 func (c *client) processPing() {
 	c.mu.Lock()
 	c.traceInOp("PING", nil)
@@ -1757,12 +2433,19 @@ func (c *client) processPing() {
 	// If we are here, the CONNECT has been received so we know
 	// if this client supports async INFO or not.
 	var (
-		checkInfoChange bool
-		srv             = c.srv
+		checkInfoChange        bool
+		srv                    = c.srv
+		accName, name, durable string
 	)
+	// Clients send their subscriptions before the first PING when they
+	// reconnect, so the interest restored for them can be released, and
+	// the messages held for their migrated session delivered.
+	if !c.flags.isSet(firstPongSent) && c.acc != nil {
+		accName, name, durable = c.acc.Name, c.opts.Name, c.opts.DurableID
+	}
 	// For older clients, just flip the firstPongSent flag if not already
 	// set and we are done.
-	if c.opts.Protocol < ClientProtoInfo || srv == nil {
+	if !c.hasFeature(FeatureAsyncInfo) || srv == nil {
 		c.flags.setIfNotSet(firstPongSent)
 	} else {
 		// This is a client that supports async INFO protocols.
@@ -1790,10 +2473,20 @@ func (c *client) processPing() {
 		c.mu.Unlock()
 		srv.mu.Unlock()
 	}
+	if name != _EMPTY_ && srv != nil {
+		srv.releasePrimedInterest(accName, name)
+	}
+	if durable != _EMPTY_ && srv != nil {
+		srv.resumeMigratedSession(c, accName, durable)
+	}
 }
 
 func (c *client) processPong() {
 	c.traceInOp("PONG", nil)
+	c.handlePong()
+}
+
+func (c *client) handlePong() {
 	c.mu.Lock()
 	c.ping.out = 0
 	c.rtt = computeRTT(c.rttStart)
@@ -1856,8 +2549,18 @@ func (c *client) processPub(trace bool, arg []byte) error {
 		c.maxPayloadViolation(c.pa.size, maxPayload)
 		return ErrMaxPayload
 	}
+	if err := c.checkSubjectLimits(c.pa.subject, c.pa.reply); err != nil {
+		return err
+	}
 
-	if c.opts.Pedantic && !IsValidLiteralSubject(string(c.pa.subject)) {
+	if c.kind == CLIENT && c.isStrictProtocol() {
+		if !IsValidLiteralSubject(string(c.pa.subject)) {
+			return c.protoStateViolation(ErrBadPublishSubject)
+		}
+		if c.pa.reply != nil && !IsValidLiteralSubject(string(c.pa.reply)) {
+			return c.protoStateViolation(ErrBadReplySubject)
+		}
+	} else if c.opts.Pedantic && !IsValidLiteralSubject(string(c.pa.subject)) {
 		c.sendErr("Invalid Publish Subject")
 	}
 	return nil
@@ -1898,6 +2601,19 @@ func (c *client) processSub(argo []byte, noForward bool) (*subscription, error)
 	copy(arg, argo)
 	args := splitArg(arg)
 	sub := &subscription{client: c}
+	// With FeatureSubNoEcho and FeatureQueueCredits, the last arguments may
+	// be the no_echo and credits options. The features are negotiated in
+	// CONNECT, processed by this same go routine, so no need for the lock.
+	for n := len(args); n > 2 && c.kind == CLIENT; n = len(args) {
+		if c.hasFeature(FeatureSubNoEcho) && string(args[n-1]) == subNoEchoArg {
+			sub.noEcho = true
+		} else if credits, ok := parseSubCredits(args[n-1]); ok && c.hasFeature(FeatureQueueCredits) {
+			sub.maxCredits, sub.credits = credits, credits
+		} else {
+			break
+		}
+		args = args[:n-1]
+	}
 	switch len(args) {
 	case 2:
 		sub.subject = args[0]
@@ -1910,6 +2626,23 @@ func (c *client) processSub(argo []byte, noForward bool) (*subscription, error)
 	default:
 		return nil, fmt.Errorf("processSub Parse Error: '%s'", arg)
 	}
+	// Credits apply to the members of a queue group only.
+	if sub.maxCredits > 0 && sub.queue == nil {
+		return nil, fmt.Errorf("processSub Parse Error: credits without queue group: '%s'", arg)
+	}
+
+	if c.kind == CLIENT {
+		if err := c.checkSubjectLimits(sub.subject, nil); err != nil {
+			return nil, err
+		}
+		if c.isStrictProtocol() && !IsValidSubject(string(sub.subject)) {
+			return nil, c.protoStateViolation(ErrBadSubscribeSubject)
+		}
+		if !c.policyAllows(PolicySubscribe, string(sub.subject), string(sub.queue)) {
+			c.subPermissionViolation(sub)
+			return nil, nil
+		}
+	}
 
 	c.mu.Lock()
 
@@ -1946,6 +2679,12 @@ func (c *client) processSub(argo []byte, noForward bool) (*subscription, error)
 			c.subPermissionViolation(sub)
 			return nil, nil
 		}
+		// Check for wildcards broader than allowed for the user or account.
+		if !c.wildcardDepthAllowed(sub.subject) {
+			c.mu.Unlock()
+			c.subPermissionViolation(sub)
+			return nil, nil
+		}
 	}
 	// Check if we have a maximum on the number of subscriptions.
 	if c.subsAtLimit() {
@@ -1957,15 +2696,23 @@ func (c *client) processSub(argo []byte, noForward bool) (*subscription, error)
 	var updateGWs bool
 	var err error
 
+	var inserted bool
+
 	// Subscribe here.
 	if c.subs[sid] == nil {
 		c.subs[sid] = sub
-		if acc != nil && acc.sl != nil {
+		if kind == CLIENT && acc != nil && sub.queue == nil && isFirehose(srv.getOpts(), string(sub.subject)) {
+			sub.firehose = true
+			acc.addFirehoseSub(sub)
+			updateGWs = c.srv.gateway.enabled
+			inserted = true
+		} else if acc != nil && acc.sl != nil {
 			err = acc.sl.Insert(sub)
 			if err != nil {
 				delete(c.subs, sid)
 			} else {
 				updateGWs = c.srv.gateway.enabled
+				inserted = true
 			}
 		}
 	}
@@ -1988,6 +2735,19 @@ func (c *client) processSub(argo []byte, noForward bool) (*subscription, error)
 		c.Errorf(err.Error())
 	}
 
+	if inserted {
+		c.subscriptionEvent(acc, SubscriptionCreated, sub)
+	}
+
+	// Send the recent messages if asked for, and the last values retained,
+	// for this new subscription.
+	if kind == CLIENT && inserted && sub.queue == nil {
+		if c.hasFeature(FeatureReplay) {
+			c.deliverReplay(acc, sub)
+		}
+		c.deliverRetained(acc, sub)
+	}
+
 	if noForward {
 		return sub, nil
 	}
@@ -2124,6 +2884,44 @@ func (c *client) addShadowSub(sub *subscription, im *streamImport, useFrom bool)
 	return &nsub, nil
 }
 
+// wildcardDepth returns the index of the first wildcard token of the
+// subject, -1 if the subject is literal.
+func wildcardDepth(subject []byte) int {
+	depth := 0
+	for start, i := 0, 0; i <= len(subject); i++ {
+		if i < len(subject) && subject[i] != btsep {
+			continue
+		}
+		if tk := subject[start:i]; len(tk) == 1 && (tk[0] == pwc || tk[0] == fwc) {
+			return depth
+		}
+		start = i + 1
+		depth++
+	}
+	return -1
+}
+
+// wildcardDepthAllowed returns false if the subject has a wildcard in the
+// first tokens forbidden by the minimum wildcard depth of the user or of
+// the account, the highest applying.
+// Lock should be held.
+func (c *client) wildcardDepthAllowed(subject []byte) bool {
+	min := 0
+	if c.perms != nil {
+		min = c.perms.minWildcardDepth
+	}
+	if c.acc != nil {
+		if am := int(atomic.LoadInt32(&c.acc.minWildcardDepth)); am > min {
+			min = am
+		}
+	}
+	if min == 0 {
+		return true
+	}
+	d := wildcardDepth(subject)
+	return d < 0 || d >= min
+}
+
 // canSubscribe determines if the client is authorized to subscribe to the
 // given subject. Assumes caller is holding lock.
 func (c *client) canSubscribe(subject string) bool {
@@ -2235,7 +3033,9 @@ func (c *client) unsubscribe(acc *Account, sub *subscription, force, remove bool
 	// with open subscriptions.
 	if remove {
 		delete(c.subs, string(sub.sid))
-		if acc != nil {
+		if acc != nil && sub.firehose {
+			acc.removeFirehoseSubs(sub)
+		} else if acc != nil {
 			acc.sl.Remove(sub)
 		}
 	}
@@ -2250,6 +3050,10 @@ func (c *client) unsubscribe(acc *Account, sub *subscription, force, remove bool
 	sub.close()
 	c.mu.Unlock()
 
+	if remove {
+		c.subscriptionEvent(acc, SubscriptionDeleted, sub)
+	}
+
 	// Process shadow subs if we have them.
 	for _, nsub := range shadowSubs {
 		if err := nsub.im.acc.sl.Remove(nsub); err != nil {
@@ -2335,11 +3139,15 @@ func (c *client) processUnsub(arg []byte) error {
 func (c *client) checkDenySub(subject string) bool {
 	if denied, ok := c.mperms.dcache[subject]; ok {
 		return denied
-	} else if r := c.mperms.deny.Match(subject); len(r.psubs) != 0 {
-		c.mperms.dcache[subject] = true
+	}
+	denied := len(c.mperms.deny.Match(subject).psubs) != 0
+	// Replies of muxed requests are seen once, do not evict the others.
+	if isMuxReply(subject) {
+		return denied
+	}
+	c.mperms.dcache[subject] = denied
+	if denied {
 		return true
-	} else {
-		c.mperms.dcache[subject] = false
 	}
 	if len(c.mperms.dcache) > maxDenyPermCacheSize {
 		c.pruneDenyCache()
@@ -2347,7 +3155,34 @@ func (c *client) checkDenySub(subject string) bool {
 	return false
 }
 
+// msgScratch makes sure that n bytes can be appended to mh without
+// allocating. Headers that do not fit in msgb are moved to msgbl, which
+// is kept so that long subjects only grow it once. Headers larger than
+// maxBufSize would be referenced by the outbound buffers, so they are not
+// retained.
+func (c *client) msgScratch(mh []byte, n int) []byte {
+	if cap(mh)-len(mh) >= n {
+		return mh
+	}
+	need := len(mh) + n
+	if need > maxBufSize {
+		return append(make([]byte, 0, need), mh...)
+	}
+	if cap(c.msgbl) < need {
+		sz := 2 * msgScratchSize
+		for sz < need {
+			sz <<= 1
+		}
+		if sz > maxBufSize {
+			sz = maxBufSize
+		}
+		c.msgbl = make([]byte, 0, sz)
+	}
+	return append(c.msgbl[:0], mh...)
+}
+
 func (c *client) msgHeader(mh []byte, sub *subscription, reply []byte) []byte {
+	mh = c.msgScratch(mh, len(sub.sid)+len(reply)+len(c.pa.szb)+2+LEN_CR_LF)
 	if len(sub.sid) > 0 {
 		mh = append(mh, sub.sid...)
 		mh = append(mh, ' ')
@@ -2399,10 +3234,14 @@ func (c *client) deliverMsg(sub *subscription, subject, mh, msg []byte, gwrply b
 	client.mu.Lock()
 
 	// Check echo
-	if c == client && !client.echo {
+	if c == client && (!client.echo || sub.noEcho) {
 		client.mu.Unlock()
 		return false
 	}
+	// The +OK owed for the PUB go before the message.
+	if c == client {
+		client.flushOKs()
+	}
 
 	// Check if we have a subscribe deny clause. This will trigger us to check the subject
 	// for a match against the denied subjects.
@@ -2421,6 +3260,11 @@ func (c *client) deliverMsg(sub *subscription, subject, mh, msg []byte, gwrply b
 
 	srv := client.srv
 
+	if client.dropSuspended() {
+		client.mu.Unlock()
+		return false
+	}
+
 	sub.nm++
 	// Check if we should auto-unsubscribe.
 	if sub.max > 0 {
@@ -2472,6 +3316,9 @@ func (c *client) deliverMsg(sub *subscription, subject, mh, msg []byte, gwrply b
 
 	atomic.AddInt64(&srv.outMsgs, 1)
 	atomic.AddInt64(&srv.outBytes, msgSize)
+	if client.acc != nil {
+		client.acc.usage.addOut(client.kind, 1, msgSize)
+	}
 
 	// Check for internal subscription.
 	if client.kind == SYSTEM {
@@ -2523,9 +3370,16 @@ func (c *client) deliverMsg(sub *subscription, subject, mh, msg []byte, gwrply b
 		}
 	}
 
-	// Queue to outbound buffer
-	client.queueOutbound(mh)
-	client.queueOutbound(msg)
+	// Queue to outbound buffer. System messages to clients go first.
+	if client.kind == CLIENT && isSystemSubject(subject) {
+		client.queuePriorityOutbound(mh)
+		client.queuePriorityOutbound(msg)
+	} else if client.out.pac != nil && !client.out.pac.isInteractive(subject) {
+		client.queuePacedOutbound(mh, msg)
+	} else {
+		client.queueOutbound(mh)
+		client.queueOutbound(msg)
+	}
 
 	client.out.pm++
 
@@ -2617,18 +3471,6 @@ func (c *client) pruneDenyCache() {
 	}
 }
 
-// prunePubPermsCache will prune the cache via randomly
-// deleting items. Doing so pruneSize items at a time.
-func (c *client) prunePubPermsCache() {
-	r := 0
-	for subject := range c.perms.pcache {
-		delete(c.perms.pcache, subject)
-		if r++; r > pruneSize {
-			break
-		}
-	}
-}
-
 // pruneRemoteTracking will prune any remote tracking objects
 // that are too old. These are orphaned when a service is not
 // sending reponses etc.
@@ -2656,7 +3498,7 @@ func (c *client) pubAllowedFullCheck(subject string, fullCheck bool) bool {
 		return true
 	}
 	// Check if published subject is allowed if we have permissions in place.
-	allowed, ok := c.perms.pcache[subject]
+	allowed, ok := c.perms.pcache.get(subject)
 	if ok {
 		return allowed
 	}
@@ -2691,17 +3533,37 @@ func (c *client) pubAllowedFullCheck(subject string, fullCheck bool) bool {
 			}
 		}
 		c.mu.Unlock()
-	} else {
-		// Update our cache here.
-		c.perms.pcache[string(subject)] = allowed
-		// Prune if needed.
-		if len(c.perms.pcache) > maxPermCacheSize {
-			c.prunePubPermsCache()
-		}
+	} else if !isMuxReply(subject) {
+		// Update our cache here, this will evict the least recently used
+		// entry if needed.
+		c.perms.pcache.set(subject, allowed)
 	}
 	return allowed
 }
 
+// Prefix of the inboxes of the requesters.
+const muxInboxPrefix = "_INBOX."
+
+// Test whether a subject is a reply of a muxed request, that is of the form
+// _INBOX.<id>.<token>, the requester having a single _INBOX.<id>.*
+// subscription for all its requests. Such a subject is used for a single
+// response, so it is not worth caching permissions or matches for it.
+func isMuxReply(subject string) bool {
+	if len(subject) <= len(muxInboxPrefix) || subject[:len(muxInboxPrefix)] != muxInboxPrefix {
+		return false
+	}
+	sep := -1
+	for i := len(muxInboxPrefix); i < len(subject); i++ {
+		if subject[i] == btsep {
+			if sep != -1 {
+				return false
+			}
+			sep = i
+		}
+	}
+	return sep > len(muxInboxPrefix) && sep < len(subject)-1
+}
+
 // Test whether a reply subject is a service import reply.
 func isServiceReply(reply []byte) bool {
 	// This function is inlined and checking this way is actually faster
@@ -2741,6 +3603,9 @@ func (c *client) processInboundClientMsg(msg []byte) {
 	// The msg includes the CR_LF, so pull back out for accounting.
 	c.in.msgs++
 	c.in.bytes += int32(len(msg) - LEN_CR_LF)
+	if c.kind == CLIENT {
+		c.srv.recordMsgSize(len(msg) - LEN_CR_LF)
+	}
 
 	if c.trace {
 		c.traceMsg(msg)
@@ -2752,20 +3617,54 @@ func (c *client) processInboundClientMsg(msg []byte) {
 		return
 	}
 
+	// Credits granted back to the credit based queue subscriptions.
+	if c.kind == CLIENT && c.hasFeature(FeatureQueueCredits) && bytes.HasPrefix(c.pa.subject, queueCreditPrefixBytes) {
+		c.processCreditGrant(msg)
+		return
+	}
+
 	// Check pub permissions
 	if c.perms != nil && (c.perms.pub.allow != nil || c.perms.pub.deny != nil) && !c.pubAllowed(string(c.pa.subject)) {
 		c.pubPermissionViolation(c.pa.subject)
 		return
 	}
 
+	// Check with the policy engine, if any.
+	if !c.policyAllows(PolicyPublish, string(c.pa.subject), _EMPTY_) {
+		c.pubPermissionViolation(c.pa.subject)
+		return
+	}
+
+	// Check subjects reserved to other users of the account.
+	if c.kind == CLIENT && c.acc != nil && !c.acc.reservedPubAllowed(string(c.pa.subject), c.authID) {
+		c.pubPermissionViolation(c.pa.subject)
+		return
+	}
+
 	// Now check for reserved replies. These are used for service imports.
 	if len(c.pa.reply) > 0 && isReservedReply(c.pa.reply) {
 		c.replySubjectViolation(c.pa.reply)
 		return
 	}
 
+	// The checks that can reply with an -ERR are done before the +OK.
+	if c.kind == CLIENT && c.srv != nil && c.acc != nil {
+		// Check if the subject is over the account's subject quota.
+		if atomic.LoadInt32(&c.acc.quotaOn) == 1 && !c.checkSubjectQuota() {
+			return
+		}
+		// Drop the messages of frozen accounts.
+		if !c.checkFrozen() {
+			return
+		}
+		// Check that the payload is enveloped if required on the subject.
+		if atomic.LoadInt32(&c.acc.encryptionOn) == 1 && !c.checkEncryption(msg) {
+			return
+		}
+	}
+
 	if c.opts.Verbose {
-		c.sendOK()
+		c.queueOK()
 	}
 
 	// Mostly under testing scenarios.
@@ -2773,6 +3672,31 @@ func (c *client) processInboundClientMsg(msg []byte) {
 		return
 	}
 
+	// Check if the subject is over its rate limit.
+	if c.kind == CLIENT && atomic.LoadInt32(&c.srv.rateGuards.enabled) == 1 && c.checkSubjectRate() {
+		return
+	}
+
+	// Pass the message to the interceptors of the embedding application.
+	if c.kind == CLIENT && len(c.srv.interceptors) > 0 {
+		var ok bool
+		if msg, ok = c.interceptMsg(msg); !ok {
+			return
+		}
+	}
+
+	// Check the payload against the schema of the subject.
+	if c.kind == CLIENT && atomic.LoadInt32(&c.srv.schemas.enabled) == 1 && !c.checkSchema(msg) {
+		return
+	}
+
+	c.acc.storeMsg(c.pa.subject, c.pa.reply, msg)
+
+	// Tee the message to the archive subject of the account.
+	if c.kind == CLIENT {
+		c.archiveMsg(c.acc, msg)
+	}
+
 	// Check if this client's gateway replies map is not empty
 	if atomic.LoadInt32(&c.cgwrt) > 0 && c.handleGWReplyMap(msg) {
 		return
@@ -2810,31 +3734,12 @@ func (c *client) processInboundClientMsg(msg []byte) {
 	// Match the subscriptions. We will use our own L1 map if
 	// it's still valid, avoiding contention on the shared sublist.
 	var r *SublistResult
-	var ok bool
-
-	genid := atomic.LoadUint64(&c.acc.sl.genid)
-	if genid == c.in.genid && c.in.results != nil {
-		r, ok = c.in.results[string(c.pa.subject)]
+	if c.srv.sampleLatency(&c.in.lsm) {
+		start := time.Now()
+		r = c.matchL1()
+		c.srv.recordLatency(latencyStageMatch, time.Since(start))
 	} else {
-		// Reset our L1 completely.
-		c.in.results = make(map[string]*SublistResult)
-		c.in.genid = genid
-	}
-
-	// Go back to the sublist data structure.
-	if !ok {
-		r = c.acc.sl.Match(string(c.pa.subject))
-		c.in.results[string(c.pa.subject)] = r
-		// Prune the results cache. Keeps us from unbounded growth. Random delete.
-		if len(c.in.results) > maxResultCacheSize {
-			n := 0
-			for subject := range c.in.results {
-				delete(c.in.results, subject)
-				if n++; n > pruneSize {
-					break
-				}
-			}
-		}
+		r = c.matchL1()
 	}
 
 	var qnames [][]byte
@@ -2914,6 +3819,42 @@ func (c *client) handleGWReplyMap(msg []byte) bool {
 	return true
 }
 
+// Audits, if enabled, a message crossing from account `from` to account `to`.
+// Messages sent by the server itself are not audited since audit advisories
+// could otherwise be audited in turn.
+func (c *client) auditAccountCrossing(kind string, from, to *Account, subject, mapped []byte) {
+	if c.kind == SYSTEM || c.srv == nil {
+		return
+	}
+	aa := c.srv.getOpts().AccountAudit
+	if aa == nil || from == nil || to == nil || from == to {
+		return
+	}
+	c.srv.accountCrossingEvent(aa, &AccountCrossingEventMsg{
+		Type:          kind,
+		FromAccount:   from.Name,
+		ToAccount:     to.Name,
+		Subject:       string(subject),
+		MappedSubject: string(mapped),
+		ClientID:      c.cid,
+	})
+}
+
+// Audits, if enabled, a message delivered to a stream import's shadow subscription.
+func (c *client) auditStreamImport(sub *subscription, subject []byte) {
+	if c.kind == SYSTEM || c.srv == nil || c.srv.getOpts().AccountAudit == nil {
+		return
+	}
+	sub.client.mu.Lock()
+	to := sub.client.acc
+	sub.client.mu.Unlock()
+	mapped := subject
+	if sub.im.prefix != "" {
+		mapped = append([]byte(sub.im.prefix), subject...)
+	}
+	c.auditAccountCrossing("stream", sub.im.acc, to, subject, mapped)
+}
+
 // This checks and process import services by doing the mapping and sending the
 // message onward if applicable.
 func (c *client) checkForImportServices(acc *Account, msg []byte) {
@@ -2949,7 +3890,9 @@ func (c *client) checkForImportServices(acc *Account, msg []byte) {
 			}
 		}
 		// FIXME(dlc) - Do L1 cache trick from above.
-		rr := si.acc.sl.Match(si.to)
+		rr := si.acc.withFirehose(si.to, si.acc.sl.Match(si.to))
+
+		c.auditAccountCrossing("service", acc, si.acc, c.pa.subject, []byte(si.to))
 
 		// Check to see if we have no results and this is an internal serviceImport. If so we
 		// need to clean that up.
@@ -3026,7 +3969,7 @@ func (c *client) addSubToRouteTargets(sub *subscription) {
 func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject, reply []byte, flags int) [][]byte {
 	var queues [][]byte
 	// msg header for clients.
-	msgh := c.msgb[1:msgHeadProtoLen]
+	msgh := c.msgScratch(c.msgb[1:msgHeadProtoLen], len(subject)+1)
 	msgh = append(msgh, subject...)
 	msgh = append(msgh, ' ')
 	si := len(msgh)
@@ -3072,9 +4015,12 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 			continue
 		}
 		// Check for stream import mapped subs. These apply to local subs only.
+		if sub.im != nil {
+			c.auditStreamImport(sub, subject)
+		}
 		if sub.im != nil && sub.im.prefix != "" {
 			// Redo the subject here on the fly.
-			msgh = c.msgb[1:msgHeadProtoLen]
+			msgh = c.msgScratch(c.msgb[1:msgHeadProtoLen], len(sub.im.prefix)+len(subject)+1)
 			msgh = append(msgh, sub.im.prefix...)
 			msgh = append(msgh, subject...)
 			msgh = append(msgh, ' ')
@@ -3177,10 +4123,18 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 				break
 			}
 
+			// Skip the credit based members that have no credits left.
+			if !sub.takeCredit() {
+				continue
+			}
+
 			// Check for mapped subs
+			if sub.im != nil {
+				c.auditStreamImport(sub, subject)
+			}
 			if sub.im != nil && sub.im.prefix != "" {
 				// Redo the subject here on the fly.
-				msgh = c.msgb[1:msgHeadProtoLen]
+				msgh = c.msgScratch(c.msgb[1:msgHeadProtoLen], len(sub.im.prefix)+len(subject)+1)
 				msgh = append(msgh, sub.im.prefix...)
 				msgh = append(msgh, subject...)
 				msgh = append(msgh, ' ')
@@ -3202,6 +4156,8 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, subject,
 				}
 				break
 			}
+			// The credit was not used.
+			sub.grantCredits(1)
 		}
 
 		if rsub != nil {
@@ -3221,21 +4177,42 @@ sendToRoutesOrLeafs:
 		return queues
 	}
 
+	// The cluster of the leaf node this message comes from, if any.
+	origin := c.msgOrigin()
+
 	// We address by index to avoid struct copy.
 	// We have inline structs for memory layout and cache coherency.
 	for i := range c.in.rts {
 		rt := &c.in.rts[i]
 		kind := rt.sub.client.kind
-		mh := c.msgb[:msgHeadProtoLen]
+		n := len(origin) + len(acc.Name) + len(subject) + len(reply) + len(rt.qs) + len(c.pa.szb) + 6 + LEN_CR_LF
+		if rt.sub.im != nil {
+			n += len(rt.sub.im.prefix)
+		}
+		mh := c.msgScratch(c.msgb[:msgHeadProtoLen], n)
 		if kind == ROUTER {
 			// Router (and Gateway) nodes are RMSG. Set here since leafnodes may rewrite.
-			mh[0] = 'R'
+			// Messages from a leaf node are LMSG with their origin, if supported.
+			if origin != _EMPTY_ && rt.sub.client.supportsOrigin() {
+				mh[0] = 'L'
+				mh = append(mh, origin...)
+				mh = append(mh, ' ')
+			} else {
+				mh[0] = 'R'
+			}
 			mh = append(mh, acc.Name...)
 			mh = append(mh, ' ')
 		} else {
+			// Do not send back to the cluster of the originating leaf node.
+			if c.isLeafLoop(rt.sub.client, origin) {
+				continue
+			}
 			// Leaf nodes are LMSG
 			mh[0] = 'L'
 			// Remap subject if its a shadow subscription, treat like a normal client.
+			if rt.sub.im != nil {
+				c.auditStreamImport(rt.sub, subject)
+			}
 			if rt.sub.im != nil && rt.sub.im.prefix != "" {
 				mh = append(mh, rt.sub.im.prefix...)
 			}
@@ -3302,7 +4279,7 @@ func (c *client) processPingTimer() {
 	// If we have had activity within the PingInterval then
 	// there is no need to send a ping. This can be client data
 	// or if we received a ping from the other side.
-	pingInterval := c.srv.getOpts().PingInterval
+	pingInterval := c.pingInterval()
 	now := time.Now()
 	needRTT := c.rtt == 0 || now.Sub(c.rttStart) > DEFAULT_RTT_MEASUREMENT_INTERVAL
 
@@ -3312,7 +4289,10 @@ func (c *client) processPingTimer() {
 		c.Debugf("Delaying PING due to remote ping %v ago", delta.Round(time.Second))
 	} else {
 		// Check for violation
-		if c.ping.out+1 > c.srv.getOpts().MaxPingsOut {
+		if c.ping.out+1 > c.maxPingsOut() && c.suspendStale(now) {
+			// Keep sending PINGs, the PONG will resume the connection.
+			c.sendPing()
+		} else if c.ping.out+1 > c.maxPingsOut() {
 			c.Debugf("Stale Client Connection - Closing")
 			c.enqueueProto([]byte(fmt.Sprintf(errProto, "Stale Connection")))
 			c.mu.Unlock()
@@ -3333,10 +4313,30 @@ func (c *client) setPingTimer() {
 	if c.srv == nil {
 		return
 	}
-	d := c.srv.getOpts().PingInterval
+	d := c.pingInterval()
 	c.ping.tmr = time.AfterFunc(d, c.processPingTimer)
 }
 
+// Returns the ping interval of the account of the client, if set,
+// otherwise the one of the server.
+// Lock should be held
+func (c *client) pingInterval() time.Duration {
+	if c.ping.interval > 0 {
+		return c.ping.interval
+	}
+	return c.srv.getOpts().PingInterval
+}
+
+// Returns the maximum number of outstanding pings of the account of the
+// client, if set, otherwise the one of the server.
+// Lock should be held
+func (c *client) maxPingsOut() int {
+	if c.ping.maxOut > 0 {
+		return c.ping.maxOut
+	}
+	return c.srv.getOpts().MaxPingsOut
+}
+
 // Lock should be held
 func (c *client) clearPingTimer() {
 	if c.ping.tmr == nil {
@@ -3346,6 +4346,61 @@ func (c *client) clearPingTimer() {
 	c.ping.tmr = nil
 }
 
+// How long a client asked to reconnect at the end of its lifetime has to
+// do so before the connection is closed.
+var connLifetimeGrace = 10 * time.Second
+
+// Lock should be held
+func (c *client) setLifetimeTimer(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	// Spread the expirations of connections created together, for
+	// instance after a restart, over an additional tenth of the lifetime.
+	d += time.Duration(rand.Int63n(int64(d)/10 + 1))
+	c.ltmr = time.AfterFunc(d, c.lifetimeExpired)
+}
+
+// Lock should be held
+func (c *client) clearLifetimeTimer() {
+	if c.ltmr == nil {
+		return
+	}
+	c.ltmr.Stop()
+	c.ltmr = nil
+}
+
+// lifetimeExpired asks the client to reconnect, with an INFO protocol in
+// lame duck mode, and closes the connection after connLifetimeGrace.
+// Clients that do not support asynchronous INFO protocols are closed
+// right away.
+func (c *client) lifetimeExpired() {
+	srv := c.srv
+	srv.mu.Lock()
+	info := srv.copyInfo()
+	srv.mu.Unlock()
+	info.LameDuckMode = true
+
+	c.mu.Lock()
+	if c.isClosed() {
+		c.mu.Unlock()
+		return
+	}
+	asked := c.hasFeature(FeatureLameDuckMode) && c.flags.isSet(firstPongSent)
+	if asked {
+		c.enqueueProto(c.generateClientInfoJSON(info))
+		c.ltmr = time.AfterFunc(connLifetimeGrace, func() {
+			c.closeConnection(MaxConnectionLifetimeExceeded)
+		})
+	}
+	c.mu.Unlock()
+
+	c.Debugf("Maximum connection lifetime reached")
+	if !asked {
+		c.closeConnection(MaxConnectionLifetimeExceeded)
+	}
+}
+
 // Lock should be held
 func (c *client) setAuthTimer(d time.Duration) {
 	c.atmr = time.AfterFunc(d, c.authTimeout)
@@ -3368,14 +4423,53 @@ func (c *client) awaitingAuth() bool {
 	return !c.flags.isSet(connectReceived) && c.atmr != nil
 }
 
-// This will set the atmr for the JWT expiration time.
+// This will set the atmr for the JWT expiration time or the end of the
+// user's connection time window. If a timer is already set to fire
+// before the given duration, it is kept.
 // We will lock on entry.
 func (c *client) setExpirationTimer(d time.Duration) {
 	c.mu.Lock()
+	exp := time.Now().Add(d)
+	if c.atmr != nil && !c.expires.IsZero() {
+		if c.expires.Before(exp) {
+			c.mu.Unlock()
+			return
+		}
+		c.atmr.Stop()
+	}
+	c.expires = exp
 	c.atmr = time.AfterFunc(d, c.authExpired)
 	c.mu.Unlock()
 }
 
+// This will set the timer that sends the advisory letting the client know
+// that its user JWT is about to expire. If the warning window is already
+// open, the advisory is sent right away.
+// We will lock on entry.
+func (c *client) setExpiryWarningTimer(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	c.mu.Lock()
+	if c.ewtmr != nil {
+		c.ewtmr.Stop()
+	}
+	c.ewtmr = time.AfterFunc(d, c.authExpiring)
+	c.mu.Unlock()
+}
+
+// authExpiring sends the advisory for the upcoming expiration of the user
+// JWT. The connection is still closed with AuthenticationExpired if the
+// client has not reconnected with a renewed JWT when it expires.
+func (c *client) authExpiring() {
+	c.mu.Lock()
+	c.ewtmr = nil
+	srv := c.srv
+	c.mu.Unlock()
+	c.Debugf("User Authentication Expiring")
+	srv.userExpiringEvent(c)
+}
+
 // Possibly flush the connection and then close the low level connection.
 // The boolean `minimalFlush` indicates if the flush operation should have a
 // minimal write deadline.
@@ -3521,7 +4615,11 @@ func (c *client) teardownConn() {
 	}
 
 	c.clearAuthTimer()
+	c.untrackPendingAuth()
 	c.clearPingTimer()
+	c.clearLifetimeTimer()
+	clearTimer(&c.ewtmr)
+	c.untrackPeerCert()
 	// Unblock anyone who is potentially stalled waiting on us.
 	if c.out.stc != nil {
 		close(c.out.stc)
@@ -3544,7 +4642,7 @@ func (c *client) teardownConn() {
 	// Snapshot for use if we are a client connection.
 	// FIXME(dlc) - we can just stub in a new one for client
 	// and reference existing one.
-	var subs []*subscription
+	var subs, fsubs []*subscription
 	if kind == CLIENT || kind == LEAF {
 		var _subs [32]*subscription
 		subs = _subs[:0]
@@ -3552,7 +4650,11 @@ func (c *client) teardownConn() {
 			// Auto-unsubscribe subscriptions must be unsubscribed forcibly.
 			sub.max = 0
 			sub.close()
-			subs = append(subs, sub)
+			if sub.firehose {
+				fsubs = append(fsubs, sub)
+			} else {
+				subs = append(subs, sub)
+			}
 		}
 	}
 
@@ -3573,6 +4675,11 @@ func (c *client) teardownConn() {
 	// Remove client's or leaf node subscriptions.
 	if (kind == CLIENT || kind == LEAF) && acc != nil {
 		acc.sl.RemoveBatch(subs)
+		if len(fsubs) > 0 {
+			acc.removeFirehoseSubs(fsubs...)
+		}
+		c.subscriptionEvent(acc, SubscriptionDeleted, subs...)
+		c.subscriptionEvent(acc, SubscriptionDeleted, fsubs...)
 	} else if kind == ROUTER {
 		go c.removeRemoteSubs()
 	}
@@ -3696,6 +4803,38 @@ func (c *client) getRTTValue() time.Duration {
 	return rtt
 }
 
+// matchL1 returns the subscriptions matching the subject of the message
+// being processed in the client's account, from our L1 cache if the result
+// there is still valid.
+func (c *client) matchL1() *SublistResult {
+	subject := string(c.pa.subject)
+	genid := c.acc.sl.genidFor(subject)
+	if c.in.results == nil {
+		c.in.results = make(map[string]l1Result)
+	} else if cr, ok := c.in.results[subject]; ok && cr.genid == genid {
+		return c.acc.withFirehose(subject, cr.results)
+	}
+
+	// Go back to the sublist data structure.
+	r := c.acc.sl.Match(subject)
+	// Replies of muxed requests are seen once, do not evict the others.
+	if isMuxReply(subject) {
+		return c.acc.withFirehose(subject, r)
+	}
+	c.in.results[subject] = l1Result{r, genid}
+	// Prune the results cache. Keeps us from unbounded growth. Random delete.
+	if len(c.in.results) > maxResultCacheSize {
+		n := 0
+		for subject := range c.in.results {
+			delete(c.in.results, subject)
+			if n++; n > pruneSize {
+				break
+			}
+		}
+	}
+	return c.acc.withFirehose(subject, r)
+}
+
 // This function is used by ROUTER and GATEWAY connections to
 // look for a subject on a given account (since these type of
 // connections are not bound to a specific account).
@@ -3712,7 +4851,7 @@ func (c *client) getAccAndResultFromCache() (*Account, *SublistResult) {
 	// Check our cache.
 	if pac, ok = c.in.pacache[string(c.pa.pacache)]; ok {
 		// Check the genid to see if it's still valid.
-		if genid := atomic.LoadUint64(&pac.acc.sl.genid); genid != pac.genid {
+		if genid := pac.acc.sl.genidFor(string(c.pa.subject)); genid != pac.genid {
 			ok = false
 			delete(c.in.pacache, string(c.pa.pacache))
 		} else {
@@ -3728,17 +4867,21 @@ func (c *client) getAccAndResultFromCache() (*Account, *SublistResult) {
 		}
 
 		// Match against the account sublist.
-		r = acc.sl.Match(string(c.pa.subject))
+		subject := string(c.pa.subject)
+		genid := acc.sl.genidFor(subject)
+		r = acc.sl.Match(subject)
 
-		// Store in our cache
-		c.in.pacache[string(c.pa.pacache)] = &perAccountCache{acc, r, atomic.LoadUint64(&acc.sl.genid)}
+		// Store in our cache, unless a reply of a muxed request.
+		if !isMuxReply(subject) {
+			c.in.pacache[string(c.pa.pacache)] = &perAccountCache{acc, r, genid}
 
-		// Check if we need to prune.
-		if len(c.in.pacache) > maxPerAccountCacheSize {
-			c.prunePerAccountCache()
+			// Check if we need to prune.
+			if len(c.in.pacache) > maxPerAccountCacheSize {
+				c.prunePerAccountCache()
+			}
 		}
 	}
-	return acc, r
+	return acc, acc.withFirehose(string(c.pa.subject), r)
 }
 
 // Account will return the associated account for this client.
@@ -3814,6 +4957,12 @@ func (c *client) Errorf(format string, v ...interface{}) {
 
 func (c *client) Debugf(format string, v ...interface{}) {
 	format = fmt.Sprintf("%s - %s", c, format)
+	if atomic.LoadInt32(&c.logLevel)&logLevelDebug != 0 {
+		c.srv.executeLogCall(func(logger Logger, format string, v ...interface{}) {
+			logger.Debugf(format, v...)
+		}, format, v...)
+		return
+	}
 	c.srv.Debugf(format, v...)
 }
 
@@ -3824,6 +4973,12 @@ func (c *client) Noticef(format string, v ...interface{}) {
 
 func (c *client) Tracef(format string, v ...interface{}) {
 	format = fmt.Sprintf("%s - %s", c, format)
+	if atomic.LoadInt32(&c.logLevel)&logLevelTrace != 0 {
+		c.srv.executeLogCall(func(logger Logger, format string, v ...interface{}) {
+			logger.Tracef(format, v...)
+		}, format, v...)
+		return
+	}
 	c.srv.Tracef(format, v...)
 }
 
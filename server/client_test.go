@@ -19,10 +19,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"math"
 	"net"
+	"os"
 	"reflect"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -30,8 +34,10 @@ import (
 	"time"
 
 	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 
+	"github.com/klauspost/compress/s2"
 	"github.com/nats-io/nats.go"
 )
 
@@ -219,6 +225,7 @@ func TestClientConnect(t *testing.T) {
 	// Test that we can capture user/pass
 	connectOp = []byte("CONNECT {\"user\":\"derek\",\"pass\":\"foo\"}\r\n")
 	c.opts = defaultOpts
+	c.flags.clear(connectReceived)
 	err = c.parse(connectOp)
 	if err != nil {
 		t.Fatalf("Received error: %v\n", err)
@@ -233,6 +240,7 @@ func TestClientConnect(t *testing.T) {
 	// Test that we can capture client name
 	connectOp = []byte("CONNECT {\"user\":\"derek\",\"pass\":\"foo\",\"name\":\"router\"}\r\n")
 	c.opts = defaultOpts
+	c.flags.clear(connectReceived)
 	err = c.parse(connectOp)
 	if err != nil {
 		t.Fatalf("Received error: %v\n", err)
@@ -248,6 +256,7 @@ func TestClientConnect(t *testing.T) {
 	// Test that we correctly capture auth tokens
 	connectOp = []byte("CONNECT {\"auth_token\":\"YZZ222\",\"name\":\"router\"}\r\n")
 	c.opts = defaultOpts
+	c.flags.clear(connectReceived)
 	err = c.parse(connectOp)
 	if err != nil {
 		t.Fatalf("Received error: %v\n", err)
@@ -280,6 +289,7 @@ func TestClientConnectProto(t *testing.T) {
 
 	// ProtoInfo
 	connectOp = []byte(fmt.Sprintf("CONNECT {\"verbose\":true,\"pedantic\":true,\"tls_required\":false,\"protocol\":%d}\r\n", ClientProtoInfo))
+	c.flags.clear(connectReceived)
 	err = c.parse(connectOp)
 	if err != nil {
 		t.Fatalf("Received error: %v\n", err)
@@ -309,6 +319,7 @@ func TestClientConnectProto(t *testing.T) {
 			}
 		}
 	}()
+	c.flags.clear(connectReceived)
 	err = c.parse(connectOp)
 	if err == nil {
 		t.Fatalf("Expected to receive an error\n")
@@ -1562,6 +1573,64 @@ func TestTraceMsg(t *testing.T) {
 	}
 }
 
+func TestTraceMsgRedaction(t *testing.T) {
+	c := &client{}
+	c.trace = true
+
+	payload := []byte("secret payload")
+	msg := append(append([]byte(nil), payload...), CR_LF...)
+	cases := []struct {
+		Desc   string
+		Opts   *TraceRedactionOpts
+		Wanted string
+	}{
+		{
+			Desc:   "hash",
+			Opts:   &TraceRedactionOpts{Payload: TraceRedactHash},
+			Wanted: fmt.Sprintf(" - <<- MSG_PAYLOAD: [14 bytes sha256:%x]", sha256.Sum256(payload)),
+		},
+		{
+			Desc:   "truncate",
+			Opts:   &TraceRedactionOpts{Payload: TraceRedactTruncate, PayloadLen: 6},
+			Wanted: " - <<- MSG_PAYLOAD: [14 bytes \"secret\"...]",
+		},
+		{
+			Desc:   "truncate to size only",
+			Opts:   &TraceRedactionOpts{Payload: TraceRedactTruncate},
+			Wanted: " - <<- MSG_PAYLOAD: [14 bytes \"\"...]",
+		},
+		{
+			Desc:   "truncate longer than payload",
+			Opts:   &TraceRedactionOpts{Payload: TraceRedactTruncate, PayloadLen: 100},
+			Wanted: " - <<- MSG_PAYLOAD: [14 bytes \"secret payload\"...]",
+		},
+		{
+			Desc:   "connect only",
+			Opts:   &TraceRedactionOpts{Connect: true},
+			Wanted: " - <<- MSG_PAYLOAD: [\"secret payload\"]",
+		},
+	}
+	for _, ut := range cases {
+		c.srv = &Server{
+			opts: &Options{TraceRedaction: ut.Opts},
+		}
+		c.srv.SetLogger(&DummyLogger{}, true, true)
+
+		c.traceMsg(msg)
+
+		got := c.srv.logging.logger.(*DummyLogger).msg
+		if got != ut.Wanted {
+			t.Errorf("Desc: %s. Traced msg want: %s, got: %s", ut.Desc, ut.Wanted, got)
+		}
+	}
+
+	connect := `CONNECT {"verbose":false,"auth_token":"t0k3n","jwt" : "eyJ0","sig":"c2ln","nkey":"UABC"}`
+	expected := `CONNECT {"verbose":false,"auth_token":"[REDACTED]","jwt":"[REDACTED]","sig":"[REDACTED]","nkey":"UABC"}`
+	if got := string(removeCredsFromTrace([]byte(connect))); got != expected {
+		t.Fatalf("\nExpected %q\n    got: %q", expected, got)
+	}
+}
+
 func TestClientMaxPending(t *testing.T) {
 	opts := DefaultOptions()
 	opts.MaxPending = math.MaxInt32 + 1
@@ -1990,3 +2059,1469 @@ func TestFlushOutboundNoSliceReuseIfPartial(t *testing.T) {
 		t.Fatalf("Expected\n%q\ngot\n%q", expected.String(), fakeConn.buf.String())
 	}
 }
+
+func TestClientPubPermsCacheLRU(t *testing.T) {
+	c := &client{}
+	c.setPermissions(&Permissions{Publish: &SubjectPermission{Allow: []string{"foo.*"}, Deny: []string{"foo.bar"}}})
+
+	if !c.pubAllowed("foo.0") || c.pubAllowed("foo.bar") || c.pubAllowed("baz") {
+		t.Fatal("Unexpected publish permission results")
+	}
+	// Again, should now come from the cache.
+	if !c.pubAllowed("foo.0") || c.pubAllowed("foo.bar") || c.pubAllowed("baz") {
+		t.Fatal("Unexpected cached publish permission results")
+	}
+	if ps := c.perms.pcache.stats(); ps.Hits != 3 || ps.Misses != 3 || ps.Size != 3 || ps.HitRate != 0.5 {
+		t.Fatalf("Unexpected stats: %+v", ps)
+	}
+
+	// Fill the cache, touching "foo.0" so that it is kept while "foo.bar",
+	// the least recently used, is evicted.
+	for i := 1; i < maxPermCacheSize; i++ {
+		c.pubAllowed(fmt.Sprintf("foo.%d", i))
+		c.pubAllowed("foo.0")
+	}
+	pc := c.perms.pcache
+	if pc.ll.Len() != maxPermCacheSize || len(pc.m) != maxPermCacheSize {
+		t.Fatalf("Expected cache size to be %d, got %d/%d", maxPermCacheSize, pc.ll.Len(), len(pc.m))
+	}
+	if _, ok := pc.m["foo.0"]; !ok {
+		t.Fatal("Expected recently used subject to be in the cache")
+	}
+	if _, ok := pc.m["foo.bar"]; ok {
+		t.Fatal("Expected least recently used subject to be evicted")
+	}
+
+	// For routes and leafnodes, the cache is also used outside the
+	// readLoop, so concurrent lookups must be safe.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				c.pubAllowed(fmt.Sprintf("foo.%d", (i*1000+j)%(2*maxPermCacheSize)))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Updating permissions invalidates the cache.
+	c.setPermissions(&Permissions{Publish: &SubjectPermission{Allow: []string{"foo.bar"}}})
+	if !c.pubAllowed("foo.bar") || c.pubAllowed("foo.0") {
+		t.Fatal("Unexpected publish permission results after update")
+	}
+}
+
+func TestClientMuxReplyPermsNotCached(t *testing.T) {
+	for _, test := range []struct {
+		subject string
+		mux     bool
+	}{
+		{"_INBOX.abc.def", true},
+		{"_INBOX.abc", false},
+		{"_INBOX.abc.def.ghi", false},
+		{"_INBOX..def", false},
+		{"_INBOX.abc.", false},
+		{"foo.abc.def", false},
+	} {
+		if mux := isMuxReply(test.subject); mux != test.mux {
+			t.Fatalf("Expected %q mux reply to be %v, got %v", test.subject, test.mux, mux)
+		}
+	}
+
+	c := &client{}
+	c.setPermissions(&Permissions{
+		Publish:   &SubjectPermission{Allow: []string{"_INBOX.>"}, Deny: []string{"_INBOX.abc.bad"}},
+		Subscribe: &SubjectPermission{Deny: []string{"_INBOX.abc.bad"}},
+	})
+	if !c.pubAllowed("_INBOX.abc.def") || c.pubAllowed("_INBOX.abc.bad") || !c.pubAllowed("_INBOX.abc") {
+		t.Fatal("Unexpected publish permission results")
+	}
+	if _, ok := c.perms.pcache.m["_INBOX.abc.def"]; ok || len(c.perms.pcache.m) != 1 {
+		t.Fatalf("Expected only the non muxed reply to be cached, got %v", c.perms.pcache.m)
+	}
+	// Loaded when subscribing to a wildcard that includes denied subjects.
+	c.loadMsgDenyFilter()
+	if c.checkDenySub("_INBOX.abc.def") || !c.checkDenySub("_INBOX.abc.bad") || c.checkDenySub("_INBOX.abc") {
+		t.Fatal("Unexpected deny results")
+	}
+	if len(c.mperms.dcache) != 1 {
+		t.Fatalf("Expected only the non muxed reply to be cached, got %v", c.mperms.dcache)
+	}
+}
+
+func TestClientMuxReplyResultsNotCached(t *testing.T) {
+	s := New(DefaultOptions())
+	defer s.Shutdown()
+
+	c := &client{srv: s, kind: CLIENT, acc: s.globalAccount()}
+	route := &client{srv: s, kind: ROUTER}
+	route.in.pacache = make(map[string]*perAccountCache)
+	match := func(subject string) {
+		c.pa.subject = []byte(subject)
+		c.matchL1()
+		route.pa.account, route.pa.subject = []byte(globalAccountName), []byte(subject)
+		route.pa.pacache = []byte(globalAccountName + " " + subject)
+		if acc, _ := route.getAccAndResultFromCache(); acc == nil {
+			t.Fatalf("Expected account for %q", subject)
+		}
+	}
+	for i := 0; i < 2*maxPerAccountCacheSize; i++ {
+		match(fmt.Sprintf("_INBOX.abc.%d", i))
+	}
+	match("foo")
+	if _, ok := c.in.results["foo"]; !ok || len(c.in.results) != 1 {
+		t.Fatalf("Expected only the non muxed reply in the L1 cache, got %v entries", len(c.in.results))
+	}
+	if _, ok := route.in.pacache[globalAccountName+" foo"]; !ok || len(route.in.pacache) != 1 {
+		t.Fatalf("Expected only the non muxed reply in the account cache, got %v entries", len(route.in.pacache))
+	}
+}
+
+func TestFlushOutboundPriorityLane(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxPending = 1024
+	s := &Server{opts: opts}
+
+	fakeConn := &testConnWritePartial{}
+	c := &client{srv: s, nc: fakeConn}
+	c.initClient()
+
+	flush := func() {
+		for done := false; !done; {
+			c.mu.Lock()
+			if c.out.pb > 0 {
+				c.flushOutbound()
+			} else {
+				done = true
+			}
+			c.mu.Unlock()
+		}
+	}
+
+	c.mu.Lock()
+	// Without the lane enabled, order is preserved.
+	c.queuePriorityOutbound([]byte("INFO\r\n"))
+	c.queueOutbound([]byte("CONNECT\r\n"))
+	// What is pending when the lane is enabled goes out first.
+	c.enablePriorityLane()
+	c.queuePriorityOutbound([]byte("PING\r\n"))
+	c.mu.Unlock()
+	flush()
+	if got := fakeConn.buf.String(); got != "INFO\r\nCONNECT\r\nPING\r\n" {
+		t.Fatalf("Unexpected output: %q", got)
+	}
+	fakeConn.buf.Reset()
+
+	// What is left from a partial write goes out before priority data.
+	c.mu.Lock()
+	c.queueOutbound([]byte("MSG ABCDEFGHIJKLMNOPQRSTUVWXYZ\r\n"))
+	fakeConn.partial = true
+	c.flushOutbound()
+	fakeConn.partial = false
+	c.queueOutbound([]byte("MSG 0123456789\r\n"))
+	c.queuePriorityOutbound([]byte("PONG\r\n"))
+	c.queuePriorityOutbound([]byte("-ERR 'error'\r\n"))
+	c.mu.Unlock()
+	flush()
+	expected := "MSG ABCDEFGHIJKLMNOPQRSTUVWXYZ\r\nPONG\r\n-ERR 'error'\r\nMSG 0123456789\r\n"
+	if got := fakeConn.buf.String(); got != expected {
+		t.Fatalf("Expected\n%q\ngot\n%q", expected, got)
+	}
+	fakeConn.buf.Reset()
+
+	// Interest protocols of routes are not reordered with messages.
+	c.mu.Lock()
+	c.kind = ROUTER
+	c.queueOutbound([]byte("RMSG $G foo 2\r\nok\r\n"))
+	c.sendRouteUnSubProtos([]*subscription{{client: c, subject: []byte("foo")}}, false, nil)
+	c.sendPong()
+	c.mu.Unlock()
+	flush()
+	expected = "PONG\r\nRMSG $G foo 2\r\nok\r\nRS- $G foo\r\n"
+	if got := fakeConn.buf.String(); got != expected {
+		t.Fatalf("Expected\n%q\ngot\n%q", expected, got)
+	}
+}
+
+func TestClientSystemMessagesPriority(t *testing.T) {
+	// The lane is enabled for clients once connected.
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	cid, _ := nc.GetClientID()
+	c := s.getClient(cid)
+	c.mu.Lock()
+	enabled := c.flags.isSet(priorityLane)
+	c.mu.Unlock()
+	if !enabled {
+		t.Fatal("Expected the priority lane to be enabled")
+	}
+
+	opts := DefaultOptions()
+	opts.MaxPending = 1024
+	ss := &Server{opts: opts}
+	fakeConn := &testConnWritePartial{}
+	sc := &client{srv: ss, nc: fakeConn, kind: CLIENT}
+	sc.initClient()
+	sc.mu.Lock()
+	sc.enablePriorityLane()
+	sc.mu.Unlock()
+	pc := &client{srv: ss, kind: CLIENT}
+	pc.initClient()
+
+	deliver := func(subject string) {
+		t.Helper()
+		sub := &subscription{client: sc, subject: []byte(subject), sid: []byte("1")}
+		mh := []byte(fmt.Sprintf("MSG %s 1 2\r\n", subject))
+		if !pc.deliverMsg(sub, []byte(subject), mh, []byte("ok\r\n"), false) {
+			t.Fatalf("Message on %q not delivered", subject)
+		}
+	}
+	deliver("foo")
+	deliver("$SYS.test")
+	sc.mu.Lock()
+	sc.flushOutbound()
+	sc.mu.Unlock()
+	expected := "MSG $SYS.test 1 2\r\nok\r\nMSG foo 1 2\r\nok\r\n"
+	if got := fakeConn.buf.String(); got != expected {
+		t.Fatalf("Expected\n%q\ngot\n%q", expected, got)
+	}
+}
+
+func TestClientSubjectLimits(t *testing.T) {
+	opts := defaultServerOptions
+	opts.MaxSubjectLength = 12
+	opts.MaxSubjectTokens = 3
+	opts.MaxReplyLength = 8
+
+	for _, test := range []struct {
+		name  string
+		proto string
+		err   error
+		resp  string
+	}{
+		{"pub ok", "PUB a.b.c reply 2\r\nok\r\n", nil, ""},
+		{"sub ok", "SUB a.b.* 1\r\n", nil, ""},
+		{"pub subject length", "PUB abcdef.ghijkl 2\r\nok\r\n", ErrMaxSubjectLength, "Maximum Subject Length Exceeded"},
+		{"pub subject tokens", "PUB a.b.c.d 2\r\nok\r\n", ErrMaxSubjectTokens, "Maximum Subject Tokens Exceeded"},
+		{"pub reply length", "PUB a.b.c reply.abc 2\r\nok\r\n", ErrMaxReplyLength, "Maximum Reply Subject Length Exceeded"},
+		{"sub subject length", "SUB abcdef.ghijkl 1\r\n", ErrMaxSubjectLength, "Maximum Subject Length Exceeded"},
+		{"sub subject tokens", "SUB a.b.c.> 1\r\n", ErrMaxSubjectTokens, "Maximum Subject Tokens Exceeded"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			s, c, cr, _ := rawSetup(opts)
+			defer c.close()
+
+			go func() {
+				c.parse([]byte("CONNECT {\"verbose\":false}\r\n" + test.proto + "PING\r\n"))
+			}()
+			l, err := cr.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading response: %v", err)
+			}
+			if test.err == nil {
+				if l != "PONG\r\n" {
+					t.Fatalf("Expected PONG, got %q", l)
+				}
+				return
+			}
+			if expected := fmt.Sprintf("-ERR '%s'\r\n", test.resp); l != expected {
+				t.Fatalf("Expected %q, got %q", expected, l)
+			}
+			checkFor(t, time.Second, 15*time.Millisecond, func() error {
+				c.mu.Lock()
+				closed := c.isClosed()
+				c.mu.Unlock()
+				if !closed {
+					return fmt.Errorf("client not closed")
+				}
+				return nil
+			})
+			if n := atomic.LoadInt64(&s.subjectLimitViolations); n != 1 {
+				t.Fatalf("Expected 1 violation, got %v", n)
+			}
+		})
+	}
+}
+
+func TestClientCompression(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Compression = CompressionS2
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		br := bufio.NewReader(c)
+		l, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		info := Info{}
+		if err := json.Unmarshal([]byte(l[len("INFO "):]), &info); err != nil {
+			t.Fatalf("Error unmarshalling INFO: %v", err)
+		}
+		if info.Compression != CompressionS2 {
+			t.Fatalf("Expected compression to be advertised, got %q", info.Compression)
+		}
+		return c, br
+	}
+
+	c, br := dial()
+	defer c.Close()
+
+	// Send the compressed protocols along with the CONNECT.
+	var buf bytes.Buffer
+	buf.WriteString("CONNECT {\"verbose\":true,\"compression\":\"s2\"}\r\n")
+	w := s2.NewWriter(&buf)
+	w.Write([]byte("SUB foo 1\r\nPUB foo 5\r\nhello\r\nPING\r\n"))
+	w.Flush()
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	cr := bufio.NewReader(s2.NewReader(br))
+	for _, expected := range []string{"+OK", "+OK", "+OK", "MSG foo 1 5", "hello", "PONG"} {
+		l, err := cr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		if l != expected+"\r\n" {
+			t.Fatalf("Expected %q, got %q", expected, l)
+		}
+	}
+
+	connz, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error on connz: %v", err)
+	}
+	if connz.NumConns != 1 || connz.Conns[0].Compression != CompressionS2 {
+		t.Fatalf("Expected compression in connz, got %+v", connz.Conns)
+	}
+	cs := connz.Conns[0].CompressionStats
+	if cs == nil || cs.InBytes != int64(len("SUB foo 1\r\nPUB foo 5\r\nhello\r\nPING\r\n")) ||
+		cs.InWireBytes == 0 || cs.OutBytes == 0 || cs.OutWireBytes == 0 || cs.Ratio == 0 {
+		t.Fatalf("Unexpected compression stats: %+v", cs)
+	}
+	varz, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error on varz: %v", err)
+	}
+	if vcs := varz.CompressionStats; vcs == nil || *vcs != *cs {
+		t.Fatalf("Expected compression stats in varz to be %+v, got %+v", cs, vcs)
+	}
+
+	// Unsupported compressions are rejected.
+	c2, br2 := dial()
+	defer c2.Close()
+	if _, err := c2.Write([]byte("CONNECT {\"compression\":\"deflate\"}\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if l, err := br2.ReadString('\n'); err != nil || !strings.Contains(l, ErrUnsupportedCompression.Error()) {
+		t.Fatalf("Expected unsupported compression error, got %q, %v", l, err)
+	}
+}
+
+func TestClientCompressionAdaptive(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Compression = CompressionS2
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	if _, err := c.Write([]byte("CONNECT {\"verbose\":false,\"compression\":\"s2\"}\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	w := s2.NewWriter(c)
+	cr := bufio.NewReader(s2.NewReader(br))
+	fmt.Fprintf(w, "SUB foo 1\r\n")
+
+	// Publishes the payloads to itself and checks that they are received.
+	send := func(payload func() []byte, count int) {
+		t.Helper()
+		for i := 0; i < count; i++ {
+			p := payload()
+			fmt.Fprintf(w, "PUB foo %d\r\n%s\r\nPING\r\n", len(p), p)
+			w.Flush()
+			c.SetReadDeadline(time.Now().Add(2 * time.Second))
+			if l, err := cr.ReadString('\n'); err != nil || l != fmt.Sprintf("MSG foo 1 %d\r\n", len(p)) {
+				t.Fatalf("Expected MSG, got %q, %v", l, err)
+			}
+			got := make([]byte, len(p)+2)
+			if _, err := io.ReadFull(cr, got); err != nil || !bytes.Equal(got[:len(p)], p) {
+				t.Fatalf("Unexpected payload: %v", err)
+			}
+			if l, err := cr.ReadString('\n'); err != nil || l != "PONG\r\n" {
+				t.Fatalf("Expected PONG, got %q, %v", l, err)
+			}
+		}
+	}
+	// The switch happens right after the write, so wait for it.
+	checkStoring := func(expected bool) {
+		t.Helper()
+		checkFor(t, time.Second, 15*time.Millisecond, func() error {
+			connz, err := s.Connz(nil)
+			if err != nil || connz.NumConns != 1 || connz.Conns[0].CompressionStats == nil {
+				t.Fatalf("Unexpected connz: %+v, %v", connz, err)
+			}
+			if storing := connz.Conns[0].CompressionStats.Storing; storing != expected {
+				return fmt.Errorf("Expected storing to be %v", expected)
+			}
+			return nil
+		})
+	}
+
+	// Random bytes do not compress.
+	incompressible := func() []byte {
+		p := make([]byte, 4096)
+		rand.Read(p)
+		return p
+	}
+	send(incompressible, 32)
+	checkStoring(true)
+	// Compression is tried again after a while.
+	compressible := func() []byte { return bytes.Repeat([]byte("a"), 64*1024) }
+	send(compressible, 20)
+	checkStoring(false)
+}
+
+func TestClientCompressionFlushOutbound(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxPending = 1024
+	s := &Server{opts: opts}
+
+	fakeConn := &testConnWritePartial{}
+	c := &client{srv: s, nc: newCompressedConn(fakeConn, &compressionCounters{})}
+	c.initClient()
+
+	c.mu.Lock()
+	c.out.sz = 10
+	for _, buf := range []string{"ABCDEFGH", "IJKLMNOP", "QRSTUVWX", "YZ012345", "6789"} {
+		c.queueOutbound([]byte(buf))
+	}
+	nb := len(c.out.nb)
+	c.flushOutbound()
+	c.mu.Unlock()
+	if nb < 2 {
+		t.Fatalf("Expected several outbound buffers, got %v", nb)
+	}
+
+	// All the buffers are sent in a single block, after the stream identifier.
+	blocks := 0
+	for b := fakeConn.buf.Bytes(); len(b) >= 4; {
+		if b[0] != 0xff {
+			blocks++
+		}
+		b = b[4+(int(b[1])|int(b[2])<<8|int(b[3])<<16):]
+	}
+	if blocks != 1 {
+		t.Fatalf("Expected 1 block, got %v", blocks)
+	}
+	got, err := ioutil.ReadAll(s2.NewReader(bytes.NewReader(fakeConn.buf.Bytes())))
+	if err != nil || string(got) != "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789" {
+		t.Fatalf("Unexpected data: %q, %v", got, err)
+	}
+}
+
+func TestClientFeatures(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	offered := FeatureAsyncInfo | FeatureLameDuckMode | FeatureReplay | FeatureDurable | FeatureSubNoEcho | FeatureQueueCredits | FeatureCloseReasons
+	if f := serverFeatures(opts); f != offered {
+		t.Fatalf("Expected server features %q, got %q", offered, f)
+	}
+	if f := serverFeatures(&Options{Compression: CompressionS2}); f&FeatureCompression == 0 {
+		t.Fatalf("Expected compression to be offered, got %q", f)
+	}
+
+	for _, test := range []struct {
+		name     string
+		co       clientOpts
+		expected Feature
+	}{
+		{"legacy", clientOpts{Protocol: ClientProtoInfo}, FeatureAsyncInfo | FeatureLameDuckMode},
+		{"legacy original", clientOpts{Protocol: ClientProtoZero}, 0},
+		{"legacy fields", clientOpts{Replay: true, DurableID: "id"}, FeatureReplay | FeatureDurable},
+		{"explicit", clientOpts{Features: FeatureAsyncInfo | FeatureReplay}, FeatureAsyncInfo | FeatureReplay},
+		{"not offered", clientOpts{Features: FeatureCompression | FeatureAsyncInfo}, FeatureAsyncInfo},
+		{"unknown", clientOpts{Features: 1 << 63}, 0},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if f := negotiateFeatures(offered, &test.co); f != test.expected {
+				t.Fatalf("Expected features %q, got %q", test.expected, f)
+			}
+		})
+	}
+
+	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(c)
+	l, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	info := Info{}
+	if err := json.Unmarshal([]byte(l[len("INFO "):]), &info); err != nil {
+		t.Fatalf("Error unmarshalling INFO: %v", err)
+	}
+	if info.Features != offered {
+		t.Fatalf("Expected features %q in INFO, got %q", offered, info.Features)
+	}
+	connect := fmt.Sprintf("CONNECT {\"verbose\":false,\"features\":%d}\r\nPING\r\n", FeatureAsyncInfo|FeatureCompression)
+	if _, err := c.Write([]byte(connect)); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if l, err := br.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+	connz, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error on connz: %v", err)
+	}
+	if connz.NumConns != 1 || !reflect.DeepEqual(connz.Conns[0].Features, []string{"async_info"}) {
+		t.Fatalf("Expected negotiated features in connz, got %+v", connz.Conns)
+	}
+}
+
+func TestClientCloseReasons(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		authorization { users: [{user: a, password: pwd}, {user: b, password: pwd}] }
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	connect := func(user string, features Feature) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		br := bufio.NewReader(c)
+		if _, err := br.ReadString('\n'); err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		connect := fmt.Sprintf("CONNECT {\"verbose\":false,\"user\":%q,\"pass\":\"pwd\",\"features\":%d}\r\nPING\r\n", user, features)
+		if _, err := c.Write([]byte(connect)); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		if l, err := br.ReadString('\n'); err != nil || l != "PONG\r\n" {
+			t.Fatalf("Expected PONG, got %q, %v", l, err)
+		}
+		return c, br
+	}
+	expectClose := func(br *bufio.Reader, expected string) {
+		t.Helper()
+		if expected != _EMPTY_ {
+			if l, err := br.ReadString('\n'); err != nil || l != expected {
+				t.Fatalf("Expected %q, got %q, %v", expected, l, err)
+			}
+		}
+		if l, err := br.ReadString('\n'); err != io.EOF {
+			t.Fatalf("Expected connection to be closed, got %q, %v", l, err)
+		}
+	}
+
+	// Clients that did not negotiate close reasons get no error, as before.
+	c, br := connect("a", 0)
+	defer c.Close()
+	if n, err := s.KickClients(&ClientKick{User: "a"}); err != nil || n != 1 {
+		t.Fatalf("Unexpected kick result: %v, %v", n, err)
+	}
+	expectClose(br, _EMPTY_)
+
+	c, br = connect("a", FeatureCloseReasons)
+	defer c.Close()
+	if n, err := s.KickClients(&ClientKick{User: "a"}); err != nil || n != 1 {
+		t.Fatalf("Unexpected kick result: %v, %v", n, err)
+	}
+	expectClose(br, "-ERR 'Kicked by Admin (reason=admin_kick, action=reconnect)'\r\n")
+
+	c, br = connect("b", FeatureCloseReasons)
+	defer c.Close()
+	reloadUpdateConfig(t, s, conf, `
+		listen: "127.0.0.1:-1"
+		authorization { users: [{user: a, password: pwd}] }
+	`)
+	expectClose(br, "-ERR 'Client Closed (reason=auth_revoked, action=stop)'\r\n")
+
+	c, br = connect("a", FeatureCloseReasons)
+	defer c.Close()
+	s.Shutdown()
+	expectClose(br, "-ERR 'Server Shutdown (reason=shutdown, action=reconnect)'\r\n")
+}
+
+func TestClientSubNoEcho(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(c)
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	connect := fmt.Sprintf("CONNECT {\"verbose\":false,\"features\":%d}\r\n", FeatureSubNoEcho)
+	cmds := connect + "SUB foo 1 no_echo\r\nSUB foo bar 2 no_echo\r\nSUB foo 3\r\nPUB foo 2\r\nok\r\nPING\r\n"
+	if _, err := c.Write([]byte(cmds)); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if l, err := br.ReadString('\n'); err != nil || l != "MSG foo 3 2\r\n" {
+		t.Fatalf("Expected message for sid 3 only, got %q, %v", l, err)
+	}
+	if l, err := br.ReadString('\n'); err != nil || l != "ok\r\n" {
+		t.Fatalf("Expected payload, got %q, %v", l, err)
+	}
+	if l, err := br.ReadString('\n'); err != nil || l != pongProto {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+
+	// Messages from other connections are delivered.
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	natsPub(t, nc, "foo", []byte("ok"))
+	natsFlush(t, nc)
+	sids := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		if _, err := br.ReadString('\n'); err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		sids[l] = true
+	}
+	if !sids["MSG foo 1 2\r\n"] || !sids["MSG foo 2 2\r\n"] || !sids["MSG foo 3 2\r\n"] {
+		t.Fatalf("Expected message for all sids, got %v", sids)
+	}
+
+	sz, err := s.Subsz(&SubszOptions{Subscriptions: true, Test: "foo"})
+	if err != nil {
+		t.Fatalf("Error on subsz: %v", err)
+	}
+	noEcho := map[string]bool{}
+	for _, sd := range sz.Subs {
+		noEcho[sd.Sid] = sd.NoEcho
+	}
+	if !noEcho["1"] || !noEcho["2"] || noEcho["3"] {
+		t.Fatalf("Unexpected subscription details: %+v", sz.Subs)
+	}
+}
+
+func TestClientQueueCredits(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	connect := fmt.Sprintf("CONNECT {\"verbose\":false,\"features\":%d}\r\n", FeatureQueueCredits)
+	if _, err := c.Write([]byte(connect + "SUB foo bar 1 credits=2\r\nPING\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if l, err := br.ReadString('\n'); err != nil || l != pongProto {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+
+	// Another member of the queue group gets the messages once the credit
+	// based one has no credits left.
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	other := natsQueueSubSync(t, nc, "foo", "bar")
+	natsFlush(t, nc)
+	publish := func() {
+		t.Helper()
+		for i := 0; i < 20; i++ {
+			natsPub(t, nc, "foo", []byte("ok"))
+		}
+		natsFlush(t, nc)
+	}
+	received := func() int {
+		t.Helper()
+		if _, err := c.Write([]byte(pingProto)); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		n := 0
+		for {
+			l, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading: %v", err)
+			}
+			if l == pongProto {
+				return n
+			}
+			if l != "MSG foo 1 2\r\n" {
+				t.Fatalf("Unexpected protocol %q", l)
+			}
+			br.ReadString('\n')
+			n++
+		}
+	}
+	publish()
+	if n := received(); n != 2 {
+		t.Fatalf("Expected 2 messages, got %d", n)
+	}
+	if n, _, _ := other.Pending(); n != 18 {
+		t.Fatalf("Expected 18 messages for the other member, got %d", n)
+	}
+
+	// Granted credits are capped to the maximum.
+	if _, err := c.Write([]byte("PUB $QCREDIT.1 1\r\n5\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if n := received(); n != 0 {
+		t.Fatalf("Expected no message, got %d", n)
+	}
+	sz, _ := s.Subsz(&SubszOptions{Subscriptions: true, Test: "foo"})
+	for _, sd := range sz.Subs {
+		if sd.Cid == 1 && (sd.MaxCredits != 2 || sd.Credits != 2) {
+			t.Fatalf("Unexpected credits: %+v", sd)
+		}
+	}
+	publish()
+	if n := received(); n != 2 {
+		t.Fatalf("Expected 2 messages, got %d", n)
+	}
+
+	// Credits require a queue group, this is a parse error.
+	if _, err := c.Write([]byte("SUB baz 2 credits=2\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	if l, err := br.ReadString('\n'); err == nil {
+		t.Fatalf("Expected connection to be closed, got %q", l)
+	}
+}
+
+func TestClientInfoHiddenFields(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		client_info {
+			hide_version: true
+			go: "go0.0"
+			hide_host: true
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	getInfo := func() map[string]interface{} {
+		t.Helper()
+		c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		defer c.Close()
+		l, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		info := make(map[string]interface{})
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(l, "INFO ")), &info); err != nil {
+			t.Fatalf("Error unmarshalling INFO: %v", err)
+		}
+		return info
+	}
+	info := getInfo()
+	for _, f := range []string{"version", "git_commit", "host"} {
+		if v, ok := info[f]; ok {
+			t.Fatalf("Expected %q to be omitted, got %v", f, v)
+		}
+	}
+	if g := info["go"]; g != "go0.0" {
+		t.Fatalf("Expected go to be replaced, got %v", g)
+	}
+	if p := info["port"]; p != float64(opts.Port) {
+		t.Fatalf("Expected port %v, got %v", opts.Port, p)
+	}
+
+	reloadUpdateConfig(t, s, conf, `
+		listen: "127.0.0.1:-1"
+		client_info {
+			version: "1.0.0"
+		}
+	`)
+	info = getInfo()
+	if v := info["version"]; v != "1.0.0" {
+		t.Fatalf("Expected version to be replaced, got %v", v)
+	}
+	if g := info["go"]; g != runtime.Version() {
+		t.Fatalf("Expected go version %q, got %v", runtime.Version(), g)
+	}
+	if h := info["host"]; h != "127.0.0.1" {
+		t.Fatalf("Expected host, got %v", h)
+	}
+}
+
+func TestClientL1CacheKeptForUnrelatedSubjects(t *testing.T) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "foo.bar")
+	natsPub(t, nc, "foo.bar", []byte("hello"))
+	natsFlush(t, nc)
+	natsNexMsg(t, sub, time.Second)
+
+	sl := s.globalAccount().sl
+	matches := atomic.LoadUint64(&sl.matches)
+	pubAndCheck := func(expected uint64) {
+		t.Helper()
+		natsPub(t, nc, "foo.bar", []byte("hello"))
+		natsFlush(t, nc)
+		natsNexMsg(t, sub, time.Second)
+		if n := atomic.LoadUint64(&sl.matches) - matches; n != expected {
+			t.Fatalf("Expected %v new matches, got %v", expected, n)
+		}
+		matches = atomic.LoadUint64(&sl.matches)
+	}
+	// Subscriptions on unrelated subjects keep the L1 result valid.
+	nc2 := natsConnect(t, s.ClientURL())
+	defer nc2.Close()
+	natsSubSync(t, nc2, "bar.>")
+	natsFlush(t, nc2)
+	pubAndCheck(0)
+
+	// But not those that may match the subject.
+	natsSubSync(t, nc2, "foo.*")
+	natsFlush(t, nc2)
+	pubAndCheck(1)
+	natsSubSync(t, nc2, "*.baz")
+	natsFlush(t, nc2)
+	pubAndCheck(1)
+	pubAndCheck(0)
+}
+
+func TestClientDuplicateConnect(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(c)
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	if _, err := c.Write([]byte("CONNECT {\"verbose\":false}\r\nPING\r\nCONNECT {\"verbose\":false}\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	for _, expected := range []string{"PONG", "-ERR 'duplicate CONNECT'"} {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		if l != expected+"\r\n" {
+			t.Fatalf("Expected %q, got %q", expected, l)
+		}
+	}
+	if _, err := br.ReadString('\n'); err == nil {
+		t.Fatal("Expected connection to be closed")
+	}
+
+	v, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error on varz: %v", err)
+	}
+	if v.ProtoViolations != 1 {
+		t.Fatalf("Expected 1 protocol state violation, got %v", v.ProtoViolations)
+	}
+}
+
+func TestClientStrictProtocol(t *testing.T) {
+	opts := DefaultOptions()
+	opts.StrictProtocol = true
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	for i, test := range []struct {
+		name  string
+		proto string
+		err   error
+	}{
+		{"ok", "PUB foo reply 2\r\nok\r\nSUB foo.* 1\r\n", nil},
+		{"pub wildcard subject", "PUB foo.* 2\r\nok\r\n", ErrBadPublishSubject},
+		{"pub empty token", "PUB foo..bar 2\r\nok\r\n", ErrBadPublishSubject},
+		{"pub wildcard reply", "PUB foo reply.> 2\r\nok\r\n", ErrBadReplySubject},
+		{"sub empty token", "SUB foo..bar 1\r\n", ErrBadSubscribeSubject},
+		{"sub bad wildcard", "SUB foo.>.bar 1\r\n", ErrBadSubscribeSubject},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+			if err != nil {
+				t.Fatalf("Error connecting: %v", err)
+			}
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(2 * time.Second))
+			br := bufio.NewReader(c)
+			if _, err := br.ReadString('\n'); err != nil {
+				t.Fatalf("Error reading INFO: %v", err)
+			}
+			if _, err := c.Write([]byte("CONNECT {\"verbose\":false}\r\n" + test.proto + "PING\r\n")); err != nil {
+				t.Fatalf("Error writing: %v", err)
+			}
+			l, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading: %v", err)
+			}
+			if test.err == nil {
+				if l != "PONG\r\n" {
+					t.Fatalf("Expected PONG, got %q", l)
+				}
+				return
+			}
+			if expected := fmt.Sprintf("-ERR '%s'\r\n", test.err); l != expected {
+				t.Fatalf("Expected %q, got %q", expected, l)
+			}
+			if _, err := br.ReadString('\n'); err == nil {
+				t.Fatal("Expected connection to be closed")
+			}
+			v, err := s.Varz(nil)
+			if err != nil {
+				t.Fatalf("Error on varz: %v", err)
+			}
+			if v.ProtoViolations != int64(i) {
+				t.Fatalf("Expected %d protocol violations, got %v", i, v.ProtoViolations)
+			}
+		})
+	}
+}
+
+func TestClientStrictProtocolBeforeConnect(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		strict bool
+		proto  string
+		err    error
+	}{
+		{"not strict", false, "SUB foo 1\r\nPUB foo 2\r\nok\r\n", nil},
+		{"pub", true, "PUB foo 2\r\nok\r\n", ErrProtoBeforeConnect},
+		{"sub", true, "SUB foo 1\r\n", ErrProtoBeforeConnect},
+		{"unsub", true, "UNSUB 1\r\n", ErrProtoBeforeConnect},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.StrictProtocol = test.strict
+			s := RunServer(opts)
+			defer s.Shutdown()
+
+			c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+			if err != nil {
+				t.Fatalf("Error connecting: %v", err)
+			}
+			defer c.Close()
+			c.SetReadDeadline(time.Now().Add(2 * time.Second))
+			br := bufio.NewReader(c)
+			if _, err := br.ReadString('\n'); err != nil {
+				t.Fatalf("Error reading INFO: %v", err)
+			}
+			if _, err := c.Write([]byte(test.proto + "PING\r\n")); err != nil {
+				t.Fatalf("Error writing: %v", err)
+			}
+			l, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading: %v", err)
+			}
+			if test.err == nil {
+				// Verbose is on until the CONNECT.
+				for l == "+OK\r\n" {
+					l, _ = br.ReadString('\n')
+				}
+				if !strings.HasPrefix(l, "MSG foo 1 2") {
+					t.Fatalf("Expected MSG, got %q", l)
+				}
+				return
+			}
+			if expected := fmt.Sprintf("-ERR '%s'\r\n", test.err); l != expected {
+				t.Fatalf("Expected %q, got %q", expected, l)
+			}
+			if _, err := br.ReadString('\n'); err == nil {
+				t.Fatal("Expected connection to be closed")
+			}
+			v, err := s.Varz(nil)
+			if err != nil {
+				t.Fatalf("Error on varz: %v", err)
+			}
+			if v.ProtoViolations != 1 {
+				t.Fatalf("Expected 1 protocol violation, got %v", v.ProtoViolations)
+			}
+		})
+	}
+}
+
+type captureDebugLogger struct {
+	DummyLogger
+	dbgCh chan string
+}
+
+func (l *captureDebugLogger) Debugf(format string, v ...interface{}) {
+	select {
+	case l.dbgCh <- fmt.Sprintf(format, v...):
+	default:
+	}
+}
+
+func TestClientProtoErrorDump(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ProtoErrorDump = 4
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	l := &captureDebugLogger{dbgCh: make(chan string, 100)}
+	s.SetLogger(l, true, false)
+
+	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("CONNECT {\"user\":\"ivan\",\"name\":\"broken\"}\r\nXYZ\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case dbg := <-l.dbgCh:
+			if !strings.Contains(dbg, "Protocol error") {
+				continue
+			}
+			if !strings.Contains(dbg, `User "ivan"`) || !strings.Contains(dbg, `name "broken"`) ||
+				!strings.HasSuffix(dbg, "4 bytes=58595a0d") {
+				t.Fatalf("Unexpected debug statement: %q", dbg)
+			}
+			return
+		case <-timeout:
+			t.Fatal("Did not get the protocol error debug statement")
+		}
+	}
+}
+
+func TestClientScannerProbe(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxScannerResponses = 1
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	probe := func(data string) string {
+		t.Helper()
+		c, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		defer c.Close()
+		br := bufio.NewReader(c)
+		if _, err := br.ReadString('\n'); err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		c.Write([]byte(data))
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		resp, err := ioutil.ReadAll(br)
+		if err != nil {
+			t.Fatalf("Expected connection to be closed, got %v", err)
+		}
+		return string(resp)
+	}
+	// A TLS client hello, then an HTTP request over the limit.
+	if resp := probe("\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03"); resp != "-ERR 'Unknown Protocol Operation'\r\n" {
+		t.Fatalf("Unexpected response: %q", resp)
+	}
+	if resp := probe("GET / HTTP/1.1\r\n\r\n"); resp != "" {
+		t.Fatalf("Expected no response over the limit, got %q", resp)
+	}
+	if n := atomic.LoadInt64(&s.scannerProbes); n != 2 {
+		t.Fatalf("Expected 2 scanner probes, got %v", n)
+	}
+
+	// Protocol operations, even invalid or split, are not probes.
+	c, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(c)
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	c.Write([]byte("PI"))
+	time.Sleep(50 * time.Millisecond)
+	c.Write([]byte("NG\r\n"))
+	if l, err := br.ReadString('\n'); err != nil || l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+	if n := atomic.LoadInt64(&s.scannerProbes); n != 2 {
+		t.Fatalf("Expected 2 scanner probes, got %v", n)
+	}
+}
+
+func TestClientMaxConnectionLifetime(t *testing.T) {
+	graceBefore := connLifetimeGrace
+	connLifetimeGrace = 200 * time.Millisecond
+	defer func() { connLifetimeGrace = graceBefore }()
+
+	opts := DefaultOptions()
+	opts.MaxConnectionLifetime = 100 * time.Millisecond
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	connect := func(protocol int) (net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		br := bufio.NewReader(c)
+		if _, err := br.ReadString('\n'); err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		c.Write([]byte(fmt.Sprintf("CONNECT {\"verbose\":false,\"protocol\":%d}\r\nPING\r\n", protocol)))
+		if l, err := br.ReadString('\n'); err != nil || l != "PONG\r\n" {
+			t.Fatalf("Expected PONG, got %q, %v", l, err)
+		}
+		return c, br
+	}
+
+	// Clients supporting async INFO are asked to reconnect, then closed
+	// after the grace period.
+	c, br := connect(ClientProtoInfo)
+	defer c.Close()
+	start := time.Now()
+	l, err := br.ReadString('\n')
+	if err != nil || !strings.HasPrefix(l, "INFO ") || !strings.Contains(l, `"ldm":true`) {
+		t.Fatalf("Expected INFO in lame duck mode, got %q, %v", l, err)
+	}
+	if _, err := br.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected connection to be closed, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < connLifetimeGrace-50*time.Millisecond {
+		t.Fatalf("Expected connection to be closed after the grace period, got %v", elapsed)
+	}
+
+	// Others are closed right away.
+	c, br = connect(ClientProtoZero)
+	defer c.Close()
+	if l, err := br.ReadString('\n'); err != io.EOF {
+		t.Fatalf("Expected connection to be closed, got %q, %v", l, err)
+	}
+
+	checkClosedConns(t, s, 2, 2*time.Second)
+	for _, cc := range s.closedClients() {
+		if cc.Reason != MaxConnectionLifetimeExceeded.String() {
+			t.Fatalf("Unexpected close reason: %q", cc.Reason)
+		}
+	}
+}
+
+func TestClientFirehoseSubscriptions(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		firehose_subjects: ["events.>"]
+		cluster {
+			listen: "127.0.0.1:-1"
+		}
+	`))
+	defer os.Remove(conf)
+	optsA, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	optsA.NoLog, optsA.NoSigs = true, true
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Cluster.Host = "127.0.0.1"
+	optsB.Cluster.Port = -1
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", optsA.Cluster.Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+
+	nc := natsConnect(t, sa.ClientURL())
+	defer nc.Close()
+	all := natsSubSync(t, nc, ">")
+	events := natsSubSync(t, nc, "events.>")
+	narrow := natsSubSync(t, nc, "events.a.>")
+	qsub := natsQueueSubSync(t, nc, ">", "queue")
+	natsFlush(t, nc)
+
+	// Only the narrow and queue subscriptions are in the sublist.
+	acc := sa.globalAccount()
+	if n := acc.sl.Count(); n != 2 {
+		t.Fatalf("Expected 2 subscriptions in the sublist, got %d", n)
+	}
+	if n := len(acc.firehoseSubs()); n != 2 {
+		t.Fatalf("Expected 2 firehose subscriptions, got %d", n)
+	}
+	// But they are all counted.
+	if n := sa.NumSubscriptions(); n != 4 {
+		t.Fatalf("Expected 4 subscriptions, got %d", n)
+	}
+	if sz, _ := sa.Subsz(&SubszOptions{Subscriptions: true}); sz.NumSubs != 4 || sz.Total != 4 {
+		t.Fatalf("Expected 4 subscriptions in subsz, got %d/%d", sz.NumSubs, sz.Total)
+	}
+
+	// Messages from local clients and from routes are delivered.
+	ncb := natsConnect(t, sb.ClientURL())
+	defer ncb.Close()
+	checkExpectedSubs(t, 4, sb)
+	for _, nc := range []*nats.Conn{nc, ncb} {
+		natsPub(t, nc, "events.a.b", []byte("hello"))
+		natsPub(t, nc, "other", []byte("hello"))
+		natsFlush(t, nc)
+		for _, sub := range []*nats.Subscription{all, events, narrow, qsub, all, qsub} {
+			natsNexMsg(t, sub, time.Second)
+		}
+	}
+	for _, sub := range []*nats.Subscription{all, events, narrow, qsub} {
+		if msg, err := sub.NextMsg(50 * time.Millisecond); err == nil {
+			t.Fatalf("Unexpected message on %q: %q", sub.Subject, msg.Subject)
+		}
+	}
+
+	// Unsubscribing and closing the connection removes them.
+	natsUnsub(t, all)
+	natsFlush(t, nc)
+	if n := len(acc.firehoseSubs()); n != 1 {
+		t.Fatalf("Expected 1 firehose subscription, got %d", n)
+	}
+	nc.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := len(acc.firehoseSubs()); n != 0 {
+			return fmt.Errorf("Expected no firehose subscription, got %d", n)
+		}
+		return nil
+	})
+}
+
+func TestClientVerboseBatchedOKs(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+
+	// The +OK of the PUBs are batched, but must keep their place relative
+	// to what else is sent to the client.
+	if _, err := c.Write([]byte("CONNECT {\"verbose\":true}\r\nSUB foo 1\r\n" +
+		"PUB bar 1\r\na\r\nPUB bar 1\r\na\r\nPUB foo 2\r\nhi\r\nPUB bar 0\r\n\r\nUNSUB 2\r\nPING\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	for _, expected := range []string{"+OK", "+OK", "+OK", "+OK", "+OK", "MSG foo 1 2", "hi", "+OK", "+OK", "PONG"} {
+		l, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		if l != expected+"\r\n" {
+			t.Fatalf("Expected %q, got %q", expected, l)
+		}
+	}
+}
+
+type testUpperInterceptor struct{}
+
+func (testUpperInterceptor) OnPublish(account, subject string, payload []byte) (bool, []byte) {
+	switch subject {
+	case "deny":
+		return false, nil
+	case "upper":
+		return true, bytes.ToUpper(payload)
+	}
+	return true, nil
+}
+
+func TestClientMessageInterceptors(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MessageInterceptors = []MessageInterceptor{testUpperInterceptor{}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	sub := natsSubSync(t, nc, ">")
+	natsFlush(t, nc)
+
+	natsPub(t, nc, "deny", []byte("dropped"))
+	natsPub(t, nc, "upper", []byte("hello"))
+	natsPub(t, nc, "foo", []byte("unchanged"))
+	for _, expected := range []string{"upper:HELLO", "foo:unchanged"} {
+		m := natsNexMsg(t, sub, time.Second)
+		if got := m.Subject + ":" + string(m.Data); got != expected {
+			t.Fatalf("Expected %q, got %q", expected, got)
+		}
+	}
+
+	v, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error on varz: %v", err)
+	}
+	if len(v.Interceptors) != 1 {
+		t.Fatalf("Expected interceptor stats, got %+v", v.Interceptors)
+	}
+	is := v.Interceptors[0]
+	if is.Name != "server.testUpperInterceptor" || is.Calls != 3 || is.Rejected != 1 || is.Mutated != 1 {
+		t.Fatalf("Unexpected interceptor stats: %+v", is)
+	}
+}
+
+func TestClientWritePacing(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		write_pacing {
+			rate: 2KB
+			interval: "50ms"
+			interactive: ["rpc.>"]
+		}
+	`))
+	defer os.Remove(conf)
+	s, o := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if wp := o.WritePacing; wp == nil || wp.Rate != 2048 || wp.Interval != 50*time.Millisecond ||
+		!reflect.DeepEqual(wp.Interactive, []string{"rpc.>"}) {
+		t.Fatalf("Unexpected write pacing options: %+v", wp)
+	}
+
+	url := fmt.Sprintf("nats://%s:%d", o.Host, o.Port)
+	sub := natsConnect(t, url)
+	defer sub.Close()
+	ch := make(chan *nats.Msg, 100)
+	if _, err := sub.ChanSubscribe(">", ch); err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	natsFlush(t, sub)
+
+	nc := natsConnect(t, url)
+	defer nc.Close()
+	payload := make([]byte, 1000)
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		natsPub(t, nc, "bulk", payload)
+	}
+	natsPub(t, nc, "rpc.x", []byte("ping"))
+	natsFlush(t, nc)
+
+	var rpc, bulk int
+	for bulk < 20 {
+		select {
+		case m := <-ch:
+			if m.Subject == "rpc.x" {
+				// It is not held behind the bulk messages.
+				if bulk > 4 {
+					t.Fatalf("Interactive message received after %d bulk messages", bulk)
+				}
+				rpc++
+			} else {
+				bulk++
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timeout waiting for messages, got %d", bulk)
+		}
+	}
+	// About 2 messages per tick.
+	if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+		t.Fatalf("Expected messages to be paced, got them in %v", elapsed)
+	}
+	if rpc != 1 {
+		t.Fatalf("Expected the interactive message, got %d", rpc)
+	}
+
+	o.WritePacing = &WritePacingOpts{Rate: 1024, Interactive: []string{"rpc.*."}}
+	if err := validateOptions(o); err == nil {
+		t.Fatal("Expected error for invalid interactive subject")
+	}
+}
+
+func TestClientMsgHeaderNoAlloc(t *testing.T) {
+	s := New(&defaultServerOptions)
+	defer s.Shutdown()
+	acc := s.globalAccount()
+
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	sc := &client{srv: s, kind: CLIENT, acc: acc, echo: true, nc: srv}
+	sc.initClient()
+	sc.out.mp = 64 * 1024 * 1024
+	// Big enough for all the queued messages to stay in the primary buffer.
+	sc.out.sz = maxBufSize
+	sc.out.p = make([]byte, 0, maxBufSize)
+	pc := &client{srv: s, kind: CLIENT, acc: acc}
+	pc.initClient()
+	pc.pa.szb = []byte("5")
+
+	// Long enough to not fit in the msgb scratch buffer.
+	subj := strings.Repeat("foo.", 300) + "bar"
+	r := &SublistResult{psubs: []*subscription{
+		{client: sc, subject: []byte(subj), sid: []byte("1")},
+		{client: sc, subject: []byte(subj), sid: []byte("22")},
+	}}
+	msg := []byte("hello\r\n")
+	subject := []byte(subj)
+	reply := []byte("_INBOX.a")
+
+	deliver := func() []byte {
+		pc.processMsgResults(acc, r, msg, subject, reply, pmrNoFlag)
+		out := sc.out.p
+		sc.out.p, sc.out.pb = sc.out.p[:0], 0
+		return out
+	}
+	expected := fmt.Sprintf("MSG %s 1 _INBOX.a 5\r\nhello\r\nMSG %s 22 _INBOX.a 5\r\nhello\r\n", subj, subj)
+	if out := string(deliver()); out != expected {
+		t.Fatalf("Expected %q, got %q", expected, out)
+	}
+	if n := testing.AllocsPerRun(100, func() { deliver() }); n != 0 {
+		t.Fatalf("Expected no allocation for the message headers, got %v", n)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+// DEFAULT_CLOCK_SKEW_THRESHOLD is the default clock skew with a route or
+// gateway above which a warning is logged.
+const DEFAULT_CLOCK_SKEW_THRESHOLD = time.Second
+
+// Routes and gateways whose INFO has PingTS set accept a timestamp in the
+// PING protocol, "PING <t1>", and answer with "PONG <t1> <t2>", t2 being
+// their own time when answering. With t3 the time the PONG is received,
+// the clock of the remote is ahead by t2 - (t1 + t3) / 2, the error being
+// within half the round trip time. Servers that predate this ignore the
+// arguments of PING and PONG.
+
+// clockSkew is the estimated clock skew with a route or gateway.
+type clockSkew struct {
+	// Set when the remote accepts timestamps in PING.
+	enabled bool
+	known   bool
+	// Smoothed offset of the remote clock.
+	offset time.Duration
+	warned bool
+}
+
+// clockSkew returns the clock skew state of a route or gateway connection,
+// nil for other kinds.
+// Lock should be held.
+func (c *client) clockSkew() *clockSkew {
+	switch c.kind {
+	case ROUTER:
+		if c.route != nil {
+			return &c.route.skew
+		}
+	case GATEWAY:
+		if c.gw != nil {
+			return &c.gw.skew
+		}
+	}
+	return nil
+}
+
+// pingProtoAt returns the PING protocol to send at the given time.
+// Lock should be held.
+func (c *client) pingProtoAt(now time.Time) []byte {
+	if cs := c.clockSkew(); cs != nil && cs.enabled {
+		return []byte(fmt.Sprintf("PING %d\r\n", now.UnixNano()))
+	}
+	return []byte(pingProto)
+}
+
+// processTimedPing answers a PING carrying the time of the remote with our
+// own time.
+func (c *client) processTimedPing(arg []byte) {
+	t1 := parseInt64(bytes.TrimSpace(arg))
+	c.mu.Lock()
+	c.traceInOp("PING", arg)
+	if c.isClosed() {
+		c.mu.Unlock()
+		return
+	}
+	if t1 < 0 {
+		c.sendPong()
+	} else {
+		c.sendPongProto([]byte(fmt.Sprintf("PONG %d %d\r\n", t1, time.Now().UnixNano())))
+	}
+	c.ping.last = time.Now()
+	c.mu.Unlock()
+}
+
+// processTimedPong updates the clock skew estimate from a PONG answering
+// a timed PING.
+func (c *client) processTimedPong(arg []byte) {
+	t3 := time.Now().UnixNano()
+	c.traceInOp("PONG", arg)
+	fields := bytes.Fields(arg)
+	var t1, t2 int64 = -1, -1
+	if len(fields) == 2 {
+		t1, t2 = parseInt64(fields[0]), parseInt64(fields[1])
+	}
+	c.mu.Lock()
+	cs := c.clockSkew()
+	if cs != nil && t1 > 0 && t2 > 0 && t1 <= t3 {
+		c.updateClockSkew(cs, time.Duration(t2-t1/2-t3/2))
+	}
+	c.mu.Unlock()
+	c.handlePong()
+}
+
+// updateClockSkew smooths the offset measured and warns when the skew
+// crosses the threshold.
+// Lock should be held.
+func (c *client) updateClockSkew(cs *clockSkew, offset time.Duration) {
+	if cs.known {
+		cs.offset += (offset - cs.offset) / 4
+	} else {
+		cs.offset, cs.known = offset, true
+	}
+	threshold := DEFAULT_CLOCK_SKEW_THRESHOLD
+	if c.srv != nil {
+		if t := c.srv.getOpts().ClockSkewThreshold; t > 0 {
+			threshold = t
+		} else if t < 0 {
+			return
+		}
+	}
+	skew := cs.offset
+	if skew < 0 {
+		skew = -skew
+	}
+	if !cs.warned && skew > threshold {
+		cs.warned = true
+		c.Warnf("Clock skew of %v with the remote server, above %v", cs.offset, threshold)
+	} else if cs.warned && skew <= threshold/2 {
+		cs.warned = false
+		c.Noticef("Clock skew of %v with the remote server, back within %v", cs.offset, threshold)
+	}
+}
+
+// clockSkewString returns the estimated skew of the remote clock, empty
+// if not known.
+// Lock should be held.
+func (c *client) clockSkewString() string {
+	if cs := c.clockSkew(); cs != nil && cs.known {
+		return cs.offset.String()
+	}
+	return _EMPTY_
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "fmt"
+
+// CloseReason is a machine readable reason for the server closing a
+// client connection. It is sent, to the clients that negotiated
+// FeatureCloseReasons, at the end of the -ERR preceding the close, as in
+// "-ERR 'Server Shutdown (reason=lame_duck, action=reconnect)'", so that
+// client libraries can decide whether to reconnect or to stop.
+type CloseReason string
+
+const (
+	// CloseReasonShutdown is the shutdown of the server.
+	CloseReasonShutdown CloseReason = "shutdown"
+	// CloseReasonLameDuck is the close of the clients by a server in
+	// lame duck mode.
+	CloseReasonLameDuck CloseReason = "lame_duck"
+	// CloseReasonAuthViolation is a failed authentication or
+	// authorization.
+	CloseReasonAuthViolation CloseReason = "auth_violation"
+	// CloseReasonAuthRevoked is the loss of the client authorization on
+	// a configuration reload.
+	CloseReasonAuthRevoked CloseReason = "auth_revoked"
+	// CloseReasonAccountChanged is the move of the client user to another
+	// account on a configuration reload.
+	CloseReasonAccountChanged CloseReason = "account_changed"
+	// CloseReasonAdminKick is the close of the client by an administrator.
+	CloseReasonAdminKick CloseReason = "admin_kick"
+)
+
+// Actions a client is expected to take after a close.
+const (
+	closeActionReconnect = "reconnect"
+	closeActionStop      = "stop"
+)
+
+// action returns whether the client should reconnect, possibly to another
+// server, or stop.
+func (r CloseReason) action() string {
+	switch r {
+	case CloseReasonAuthViolation, CloseReasonAuthRevoked:
+		return closeActionStop
+	default:
+		return closeActionReconnect
+	}
+}
+
+// closeReasonText returns the error text to send before closing the
+// connection, with the close reason if the client negotiated it.
+func (c *client) closeReasonText(text string, r CloseReason) string {
+	c.mu.Lock()
+	negotiated := c.hasFeature(FeatureCloseReasons)
+	c.mu.Unlock()
+	if !negotiated {
+		return text
+	}
+	return fmt.Sprintf("%s (reason=%s, action=%s)", text, r, r.action())
+}
+
+// closeWithReason closes the connection, sending the close reason first
+// to the clients that negotiated it. Others are closed without an error,
+// as before close reasons, since they may otherwise not reconnect.
+func (c *client) closeWithReason(state ClosedState, r CloseReason) {
+	c.mu.Lock()
+	send := c.kind == CLIENT && c.hasFeature(FeatureCloseReasons)
+	c.mu.Unlock()
+	if send {
+		c.sendErr(c.closeReasonText(state.String(), r))
+	}
+	c.closeConnection(state)
+}
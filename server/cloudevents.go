@@ -0,0 +1,110 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	cloudEventsVersion     = "1.0"
+	cloudEventsContentType = "application/cloudevents+json"
+	cloudEventsBatchType   = "application/cloudevents-batch+json"
+	cloudEventsHeaderPfx   = "Ce-"
+)
+
+// Messages have no headers, so a CloudEvent is always published in the
+// structured JSON format, which carries its attributes along with the data.
+
+// isCloudEvent returns true if the request is a CloudEvent, in either the
+// structured or the binary content mode.
+func isCloudEvent(r *http.Request) bool {
+	if r.Header.Get(cloudEventsHeaderPfx+"Specversion") != _EMPTY_ {
+		return true
+	}
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return strings.HasPrefix(ct, "application/cloudevents")
+}
+
+// cloudEventPublish returns the subject and the payload to publish for the
+// CloudEvent of the request. A binary mode event, with its attributes in
+// Ce- headers, is converted to the structured JSON format. The subject is
+// the one of the path or, if empty, the type of the event.
+func cloudEventPublish(r *http.Request, subject string, body []byte) (string, []byte, error) {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	event := make(map[string]json.RawMessage)
+	switch ct {
+	case cloudEventsBatchType:
+		return _EMPTY_, nil, fmt.Errorf("batched CloudEvents are not supported")
+	case cloudEventsContentType:
+		if err := json.Unmarshal(body, &event); err != nil {
+			return _EMPTY_, nil, fmt.Errorf("invalid CloudEvent: %v", err)
+		}
+	default:
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, cloudEventsHeaderPfx) && len(v) > 0 {
+				b, _ := json.Marshal(v[0])
+				event[strings.ToLower(k[len(cloudEventsHeaderPfx):])] = b
+			}
+		}
+		if ct := r.Header.Get("Content-Type"); ct != _EMPTY_ {
+			b, _ := json.Marshal(ct)
+			event["datacontenttype"] = b
+		}
+		if len(body) > 0 {
+			if isJSONContentType(ct) && json.Valid(body) {
+				event["data"] = body
+			} else {
+				// Marshaled as base64.
+				b, _ := json.Marshal(body)
+				event["data_base64"] = b
+			}
+		}
+	}
+
+	var attrs struct {
+		SpecVersion string `json:"specversion"`
+		ID          string `json:"id"`
+		Source      string `json:"source"`
+		Type        string `json:"type"`
+	}
+	for name, v := range map[string]*string{
+		"specversion": &attrs.SpecVersion,
+		"id":          &attrs.ID,
+		"source":      &attrs.Source,
+		"type":        &attrs.Type,
+	} {
+		if raw, ok := event[name]; !ok || json.Unmarshal(raw, v) != nil || *v == _EMPTY_ {
+			return _EMPTY_, nil, fmt.Errorf("invalid CloudEvent: missing %s", name)
+		}
+	}
+	if attrs.SpecVersion != cloudEventsVersion {
+		return _EMPTY_, nil, fmt.Errorf("unsupported CloudEvents version %q", attrs.SpecVersion)
+	}
+	if subject == _EMPTY_ {
+		subject = attrs.Type
+	}
+	if ct != cloudEventsContentType {
+		body, _ = json.Marshal(event)
+	}
+	return subject, body, nil
+}
+
+func isJSONContentType(ct string) bool {
+	return ct == _EMPTY_ || ct == "application/json" || ct == "text/json" || strings.HasSuffix(ct, "+json")
+}
@@ -0,0 +1,277 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// CompressionS2 is the compression of the client protocol using the s2
+// stream format, an extension of the snappy one. It is the only one
+// currently supported.
+const CompressionS2 = "s2"
+
+// compressionBlockSize is the size of the blocks the outbound data is
+// compressed in, which is also the most buffered per connection.
+const compressionBlockSize = 64 * 1024
+
+// validateCompression checks the compression algorithm in the options.
+func validateCompression(o *Options) error {
+	switch o.Compression {
+	case _EMPTY_, CompressionS2:
+		return nil
+	}
+	return fmt.Errorf("unsupported compression %q, expected %q", o.Compression, CompressionS2)
+}
+
+// compressionCounters count the bytes before and after compression, in
+// both directions. Used atomically.
+type compressionCounters struct {
+	inRaw   int64
+	inWire  int64
+	outRaw  int64
+	outWire int64
+}
+
+// CompressionStats has the bytes of compressed connections before (raw)
+// and after (wire) compression, and the ratio of raw to wire bytes.
+type CompressionStats struct {
+	InBytes      int64   `json:"in_bytes"`
+	InWireBytes  int64   `json:"in_wire_bytes"`
+	OutBytes     int64   `json:"out_bytes"`
+	OutWireBytes int64   `json:"out_wire_bytes"`
+	Ratio        float64 `json:"ratio"`
+	// Storing is set for a connection whose outbound data currently does
+	// not compress well enough and is sent uncompressed.
+	Storing bool `json:"storing,omitempty"`
+}
+
+func (cc *compressionCounters) stats() *CompressionStats {
+	cs := &CompressionStats{
+		InBytes:      atomic.LoadInt64(&cc.inRaw),
+		InWireBytes:  atomic.LoadInt64(&cc.inWire),
+		OutBytes:     atomic.LoadInt64(&cc.outRaw),
+		OutWireBytes: atomic.LoadInt64(&cc.outWire),
+	}
+	if wire := cs.InWireBytes + cs.OutWireBytes; wire > 0 {
+		cs.Ratio = float64(cs.InBytes+cs.OutBytes) / float64(wire)
+	}
+	return cs
+}
+
+// countingConn counts the bytes read from and written to the connection
+// under the compression, in the counters of the connection and of the
+// server.
+type countingConn struct {
+	net.Conn
+	cc, sc *compressionCounters
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.cc.inWire, int64(n))
+	atomic.AddInt64(&c.sc.inWire, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.cc.outWire, int64(n))
+	atomic.AddInt64(&c.sc.outWire, int64(n))
+	return n, err
+}
+
+// compressedConn compresses the data written to and decompresses the data
+// read from a client connection. Clients enable compression in CONNECT,
+// after which everything sent in both directions is compressed.
+type compressedConn struct {
+	net.Conn
+
+	// Right after the embedded connection for the alignment of the
+	// 64-bit atomics.
+	counters compressionCounters
+	// The counters of the server.
+	scounters *compressionCounters
+
+	// Only accessed from the readLoop.
+	pending []byte
+	r       *s2.Reader
+
+	wmu sync.Mutex
+	w   *s2.Writer
+	// The writer to compress and the one to store, and what was sent
+	// since the last switch between them.
+	zw, sw    *s2.Writer
+	probeRaw  int64
+	probeWire int64
+	// The raw bytes written since the last flush and the wire bytes
+	// counted at that flush.
+	unflushed   int
+	flushedWire int64
+	storing     int32
+	wireCounted net.Conn
+}
+
+func newCompressedConn(nc net.Conn, sc *compressionCounters) *compressedConn {
+	cc := &compressedConn{Conn: nc, scounters: sc}
+	cc.wireCounted = cc.wire()
+	cc.zw = newS2Writer(cc.wireCounted)
+	cc.w = cc.zw
+	return cc
+}
+
+// wire returns the connection under the compression, counting the bytes
+// that go through it.
+func (cc *compressedConn) wire() net.Conn {
+	return &countingConn{Conn: cc.Conn, cc: &cc.counters, sc: cc.scounters}
+}
+
+func (cc *compressedConn) countRaw(in, out int) {
+	if in > 0 {
+		atomic.AddInt64(&cc.counters.inRaw, int64(in))
+		atomic.AddInt64(&cc.scounters.inRaw, int64(in))
+	}
+	if out > 0 {
+		atomic.AddInt64(&cc.counters.outRaw, int64(out))
+		atomic.AddInt64(&cc.scounters.outRaw, int64(out))
+	}
+}
+
+// Read decompresses the data read from the connection, starting with the
+// data that was received along with the CONNECT.
+func (cc *compressedConn) Read(b []byte) (int, error) {
+	if cc.r == nil {
+		var src io.Reader = cc.wireCounted
+		if len(cc.pending) > 0 {
+			atomic.AddInt64(&cc.counters.inWire, int64(len(cc.pending)))
+			atomic.AddInt64(&cc.scounters.inWire, int64(len(cc.pending)))
+			src = io.MultiReader(bytes.NewReader(cc.pending), src)
+			cc.pending = nil
+		}
+		cc.r = s2.NewReader(src)
+	}
+	n, err := cc.r.Read(b)
+	cc.countRaw(n, 0)
+	return n, err
+}
+
+// Write compresses the data, which is only sent once a block is full or
+// on Flush.
+func (cc *compressedConn) Write(b []byte) (int, error) {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	n, err := cc.w.Write(b)
+	cc.unflushed += n
+	cc.countRaw(0, n)
+	return n, err
+}
+
+// Flush sends the data written so far, so that it can be decompressed by
+// the client without waiting for more. It is called once per flush of
+// the outbound buffers, not for each of them.
+func (cc *compressedConn) Flush() error {
+	cc.wmu.Lock()
+	defer cc.wmu.Unlock()
+	if cc.unflushed == 0 {
+		return nil
+	}
+	if err := cc.w.Flush(); err != nil {
+		return err
+	}
+	wire := atomic.LoadInt64(&cc.counters.outWire)
+	cc.adapt(cc.unflushed, wire-cc.flushedWire)
+	cc.unflushed, cc.flushedWire = 0, wire
+	return nil
+}
+
+// newS2Writer returns a writer compressing synchronously, so that no
+// goroutine is started per connection, in blocks of compressionBlockSize.
+func newS2Writer(w io.Writer, opts ...s2.WriterOption) *s2.Writer {
+	opts = append(opts, s2.WriterConcurrency(1), s2.WriterBlockSize(compressionBlockSize))
+	return s2.NewWriter(w, opts...)
+}
+
+const (
+	// Outbound data is sent in uncompressed s2 blocks, instead of being
+	// compressed, when it shrinks by less than this ratio of raw to wire
+	// bytes, measured every compressionProbeSize raw bytes.
+	compressionMinRatio  = 1.1
+	compressionProbeSize = 64 * 1024
+	// Compression is tried again after this many raw bytes were stored.
+	compressionReprobeSize = 1024 * 1024
+)
+
+// adapt switches between compressing and storing the outbound data based
+// on the ratio achieved. Data that does not compress well, like encrypted
+// payloads, costs CPU for nothing. The client does not need to know: the
+// writers are switched after a flush, and each starts with a stream
+// identifier that s2 readers accept in the middle of a stream.
+// Write lock is held on entry.
+func (cc *compressedConn) adapt(raw int, wire int64) {
+	cc.probeRaw += int64(raw)
+	cc.probeWire += wire
+	if cc.w == cc.zw {
+		if cc.probeRaw < compressionProbeSize {
+			return
+		}
+		if float64(cc.probeRaw) < float64(cc.probeWire)*compressionMinRatio {
+			if cc.sw == nil {
+				cc.sw = newS2Writer(cc.wireCounted, s2.WriterUncompressed())
+			} else {
+				cc.sw.Reset(cc.wireCounted)
+			}
+			cc.w = cc.sw
+			atomic.StoreInt32(&cc.storing, 1)
+		}
+	} else {
+		if cc.probeRaw < compressionReprobeSize {
+			return
+		}
+		cc.zw.Reset(cc.wireCounted)
+		cc.w = cc.zw
+		atomic.StoreInt32(&cc.storing, 0)
+	}
+	cc.probeRaw, cc.probeWire = 0, 0
+}
+
+// rawConn returns the connection under the compression, if any.
+func rawConn(nc net.Conn) net.Conn {
+	if cc, ok := nc.(*compressedConn); ok {
+		return cc.Conn
+	}
+	return nc
+}
+
+// startCompression checks the compression requested by the client in
+// CONNECT and, if supported, switches the connection to compressed data.
+// Lock is held on entry.
+func (c *client) startCompression(compression string) error {
+	opts := c.srv.getOpts()
+	if !strings.EqualFold(compression, opts.Compression) {
+		return ErrUnsupportedCompression
+	}
+	cc := newCompressedConn(c.nc, &c.srv.compression)
+	c.nc = cc
+	// The parser hands over to the readLoop what follows the CONNECT.
+	c.in.cconn = cc
+	return nil
+}
@@ -16,9 +16,14 @@ package server
 import (
 	"errors"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
+	"sync/atomic"
 	"testing"
+
+	"github.com/nats-io/nkeys"
 )
 
 func TestConfigCheck(t *testing.T) {
@@ -1083,9 +1088,9 @@ func TestConfigCheck(t *testing.T) {
 		  }
 		}
 		`,
-			err:       nil,
-			errorLine: 0,
-			errorPos:  0,
+			err:       errors.New(`cluster tls requires 'cert_file' and 'key_file' since routes present their certificate to each other`),
+			errorLine: 3,
+			errorPos:  5,
 		},
 		{
 			name: "invalid lame_duck_duration type",
@@ -1382,3 +1387,158 @@ func TestConfigCheckMultipleErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateConfig(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{"valid", `
+			listen: "127.0.0.1:-1"
+			accounts { A { users: [{user: a, password: pwd}] } }
+			`, ""},
+		{"warnings only", `
+			listen: "127.0.0.1:-1"
+			authorization { user: a, password: pwd }
+			`, ""},
+		{"syntax error", `
+			listen: "127.0.0.1:-1"
+			monitoring_port: 8222
+			`, `unknown field "monitoring_port"`},
+		{"tls files", `
+			tls {
+				cert_file: "../test/configs/certs/server-cert.pem"
+				key_file: "../test/configs/certs/client-key.pem"
+			}
+			`, "private key does not match public key"},
+		{"startup validation", `
+			leafnodes {
+				remotes [{url: "nats://127.0.0.1:1234", account: "foo"}]
+			}
+			`, `no local account "foo"`},
+		{"leafnode account", `
+			leafnodes {
+				authorization { user: a, password: pwd, account: "foo" }
+			}
+			`, `cannot find account "foo"`},
+		{"system account", `
+			accounts { A { users: [{user: a, password: pwd}] } }
+			system_account: "SYS"
+			`, "error resolving system account"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(test.conf))
+			defer os.Remove(conf)
+			err := ValidateConfig(conf)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestValidateConfigDoesNotFetchFromResolver(t *testing.T) {
+	var fetches int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+	}))
+	defer ts.Close()
+
+	kp, _ := nkeys.CreateOperator()
+	opub, _ := kp.PublicKey()
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		trusted: %q
+		resolver: URL("%s/ngs/v1/accounts/jwt/")
+	`, opub, ts.URL)))
+	defer os.Remove(conf)
+
+	if err := ValidateConfig(conf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := atomic.LoadInt32(&fetches); n != 0 {
+		t.Fatalf("Expected no request to the resolver, got %v", n)
+	}
+}
+
+func TestConfigStrictness(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		write_deadline: 10
+		cluster {
+			listen: "127.0.0.1:-1"
+			lsiten: "127.0.0.1:4248"
+		}
+	`))
+	defer os.Remove(conf)
+
+	// By default, unknown fields are errors.
+	opts := &Options{}
+	err := opts.ProcessConfigFile(conf)
+	cerr, ok := err.(*processConfigErr)
+	if !ok || len(cerr.Errors()) != 1 || len(cerr.Warnings()) != 1 {
+		t.Fatalf("Expected 1 error and 1 warning, got %v", err)
+	}
+
+	conf = createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		config_strictness: warn
+		write_deadline: 10
+		cluster {
+			listen: "127.0.0.1:-1"
+			lsiten: "127.0.0.1:4248"
+		}
+	`))
+	defer os.Remove(conf)
+
+	opts, err = ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if opts.ConfigStrictness != ConfigStrictnessWarn {
+		t.Fatalf("Unexpected config strictness: %q", opts.ConfigStrictness)
+	}
+	check := func(warnings []*ConfigWarning) {
+		t.Helper()
+		if len(warnings) != 2 {
+			t.Fatalf("Expected 2 config warnings, got %v", len(warnings))
+		}
+		for _, w := range warnings {
+			switch w.Kind {
+			case ConfigWarningDeprecated:
+				if w.Field != "write_deadline" || !strings.HasSuffix(w.Source, ":4:3") || w.Reason == _EMPTY_ {
+					t.Fatalf("Unexpected deprecation: %+v", w)
+				}
+			case ConfigWarningUnknown:
+				if w.Field != "lsiten" || !strings.HasSuffix(w.Source, ":7:4") {
+					t.Fatalf("Unexpected unknown field: %+v", w)
+				}
+			default:
+				t.Fatalf("Unexpected config warning: %+v", w)
+			}
+		}
+	}
+	check(opts.configWarnings)
+
+	opts.NoLog, opts.NoSigs = true, true
+	s := RunServer(opts)
+	defer s.Shutdown()
+	v, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error on varz: %v", err)
+	}
+	check(v.ConfigWarnings)
+
+	opts = DefaultOptions()
+	opts.ConfigStrictness = "loose"
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "config_strictness") {
+		t.Fatalf("Expected error on invalid config strictness, got %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+)
+
+const (
+	// ConfigStrictnessError reports unknown configuration fields as errors,
+	// which is the default.
+	ConfigStrictnessError = "error"
+	// ConfigStrictnessWarn reports unknown configuration fields as
+	// warnings, so that the server still starts.
+	ConfigStrictnessWarn = "warn"
+)
+
+const (
+	// ConfigWarningDeprecated is the kind of a deprecated field in use.
+	ConfigWarningDeprecated = "deprecated"
+	// ConfigWarningUnknown is the kind of an unknown field, reported as a
+	// warning with the warn config strictness.
+	ConfigWarningUnknown = "unknown"
+)
+
+// ConfigWarning is an entry of the report on the configuration file,
+// reported at startup and in varz.
+type ConfigWarning struct {
+	Kind   string `json:"kind"`
+	Field  string `json:"field"`
+	Source string `json:"source"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// validateConfigStrictness checks the config strictness of the options.
+func validateConfigStrictness(o *Options) error {
+	switch o.ConfigStrictness {
+	case _EMPTY_, ConfigStrictnessError, ConfigStrictnessWarn:
+		return nil
+	}
+	return fmt.Errorf("invalid config_strictness %q, expected %q or %q",
+		o.ConfigStrictness, ConfigStrictnessError, ConfigStrictnessWarn)
+}
+
+// applyConfigStrictness moves the unknown fields from the errors to the
+// warnings with the warn strictness, and returns the report of the
+// deprecated and unknown fields among the warnings.
+func applyConfigStrictness(strictness string, errors, warnings *[]error) []*ConfigWarning {
+	if strictness == ConfigStrictnessWarn {
+		errs := (*errors)[:0]
+		for _, err := range *errors {
+			if _, ok := err.(*unknownConfigFieldErr); ok {
+				*warnings = append(*warnings, err)
+			} else {
+				errs = append(errs, err)
+			}
+		}
+		*errors = errs
+	}
+	var report []*ConfigWarning
+	for _, err := range *warnings {
+		switch e := err.(type) {
+		case *configDeprecationErr:
+			report = append(report, &ConfigWarning{
+				Kind:   ConfigWarningDeprecated,
+				Field:  e.field,
+				Source: e.Source(),
+				Reason: e.reason,
+			})
+		case *unknownConfigFieldErr:
+			report = append(report, &ConfigWarning{
+				Kind:   ConfigWarningUnknown,
+				Field:  e.field,
+				Source: e.Source(),
+			})
+		}
+	}
+	return report
+}
+
+// logConfigWarnings logs the report on the configuration file.
+func (s *Server) logConfigWarnings() {
+	for _, w := range s.getOpts().configWarnings {
+		if w.Kind == ConfigWarningDeprecated {
+			s.Warnf("Configuration field %q at %s is deprecated: %s", w.Field, w.Source, w.Reason)
+		} else {
+			s.Warnf("Unknown configuration field %q at %s", w.Field, w.Source)
+		}
+	}
+}
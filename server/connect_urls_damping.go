@@ -0,0 +1,106 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "time"
+
+// While the cluster membership churns, for instance during a rolling
+// restart, the connect URLs of the routes change many times in a row and
+// each change would be sent as an INFO to all clients. With damping, the
+// changes are batched: the INFO is sent once the connect URLs have not
+// changed for the damping period, or at most connectURLsMaxDampingFactor
+// periods after the first change. Members that leave and come back within
+// a batch are not seen as changed at all, and if the connect URLs are the
+// same as when the batch started no INFO is sent.
+
+const connectURLsMaxDampingFactor = 4
+
+// connectURLsDamping is the batch of connect URLs updates pending.
+type connectURLsDamping struct {
+	timer    *time.Timer
+	first    time.Time
+	deadline time.Time
+	// Connect URLs of the routes when the batch started.
+	sent map[string]struct{}
+}
+
+// dampConnectURLs starts a batch of connect URLs updates if none is
+// pending, and returns false if updates are not damped.
+// Server lock should be held.
+func (s *Server) dampConnectURLs() bool {
+	damping := s.getOpts().Cluster.ConnectURLsDamping
+	if damping <= 0 {
+		return false
+	}
+	d := &s.curlsDamping
+	if d.timer == nil {
+		d.sent = make(map[string]struct{}, len(s.clientConnectURLsMap))
+		for url := range s.clientConnectURLsMap {
+			d.sent[url] = struct{}{}
+		}
+	}
+	return true
+}
+
+// scheduleConnectURLsUpdate pushes back the sending of the INFO to clients
+// for the batch of connect URLs updates pending.
+// Server lock should be held.
+func (s *Server) scheduleConnectURLsUpdate() {
+	damping := s.getOpts().Cluster.ConnectURLsDamping
+	d := &s.curlsDamping
+	now := time.Now()
+	if d.timer == nil {
+		d.first = now
+		d.deadline = now.Add(damping)
+		d.timer = time.AfterFunc(damping, s.flushConnectURLsUpdate)
+		return
+	}
+	d.deadline = now.Add(damping)
+	if max := d.first.Add(connectURLsMaxDampingFactor * damping); d.deadline.After(max) {
+		d.deadline = max
+	}
+}
+
+// flushConnectURLsUpdate sends the INFO to clients once the batch of
+// connect URLs updates is due, unless the connect URLs ended up the same.
+func (s *Server) flushConnectURLsUpdate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := &s.curlsDamping
+	if d.timer == nil {
+		return
+	}
+	if wait := time.Until(d.deadline); wait > 0 {
+		d.timer = time.AfterFunc(wait, s.flushConnectURLsUpdate)
+		return
+	}
+	sent := d.sent
+	d.timer, d.sent = nil, nil
+	if sameConnectURLs(sent, s.clientConnectURLsMap) {
+		return
+	}
+	s.sendAsyncInfoToClients()
+}
+
+func sameConnectURLs(a, b map[string]struct{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for url := range a {
+		if _, ok := b[url]; !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -26,6 +26,9 @@ const (
 	CommandQuit   = Command("quit")
 	CommandReopen = Command("reopen")
 	CommandReload = Command("reload")
+	// CommandUpgrade starts a new server process that takes over the
+	// listeners, and then drains this one.
+	CommandUpgrade = Command("upgrade")
 
 	// private for now
 	commandLDMode = Command("ldm")
@@ -67,6 +70,10 @@ const (
 	// something different if > 1MB payloads are needed.
 	MAX_PAYLOAD_SIZE = (1024 * 1024)
 
+	// MAX_CLIENT_METADATA_SIZE is the maximum size of the keys and values of
+	// the metadata a client can give in its CONNECT.
+	MAX_CLIENT_METADATA_SIZE = 1024
+
 	// MAX_PENDING_SIZE is the maximum outbound pending bytes per client.
 	MAX_PENDING_SIZE = (64 * 1024 * 1024)
 
@@ -179,4 +186,12 @@ const (
 	// DEFAULT_SERVICE_LATENCY_SAMPLING is the default sampling rate for service
 	// latency metrics
 	DEFAULT_SERVICE_LATENCY_SAMPLING = 100
+
+	// DEFAULT_INTEREST_SNAPSHOT_TTL is how long the interest restored from
+	// a snapshot is kept waiting for clients to reconnect after a restart.
+	DEFAULT_INTEREST_SNAPSHOT_TTL = 30 * time.Second
+
+	// DEFAULT_MAX_SCANNER_RESPONSES is the maximum number of errors sent
+	// per second to connections that do not speak the NATS protocol.
+	DEFAULT_MAX_SCANNER_RESPONSES = 10
 )
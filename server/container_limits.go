@@ -0,0 +1,178 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Root of the cgroup file system the limits are read from.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// With a memory limit, the default maximum pending bytes of a connection is
+// the limit divided by this, but not above MAX_PENDING_SIZE.
+const containerMaxPendingDivisor = 64
+
+// Memory limits at or above this are cgroup v1 for no limit.
+const cgroupNoMemoryLimit = 1 << 62
+
+// ContainerLimits are the CPU and memory limits of the cgroup the server
+// runs in, as detected at startup.
+type ContainerLimits struct {
+	Source     string  `json:"source"`
+	CPUs       float64 `json:"cpus,omitempty"`
+	Memory     int64   `json:"memory,omitempty"`
+	GOMAXPROCS int     `json:"gomaxprocs,omitempty"`
+}
+
+var (
+	containerLimitsOnce sync.Once
+	containerLimits     *ContainerLimits
+)
+
+// detectedContainerLimits returns the container limits, detected once, nil
+// if there are none.
+func detectedContainerLimits() *ContainerLimits {
+	containerLimitsOnce.Do(func() {
+		containerLimits = readContainerLimits(cgroupRoot)
+	})
+	return containerLimits
+}
+
+// readContainerLimits reads the limits of cgroup v2, or of cgroup v1 if
+// the former are not found, under the given root.
+func readContainerLimits(root string) *ContainerLimits {
+	cl := &ContainerLimits{}
+	if quota, period, ok := readCgroupPair(filepath.Join(root, "cpu.max")); ok {
+		cl.Source = "cgroup2"
+		if quota > 0 && period > 0 {
+			cl.CPUs = float64(quota) / float64(period)
+		}
+		if mem, ok := readCgroupValue(filepath.Join(root, "memory.max")); ok {
+			cl.Memory = mem
+		}
+	} else {
+		quota, qok := readCgroupValue(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+		period, pok := readCgroupValue(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+		mem, mok := readCgroupValue(filepath.Join(root, "memory", "memory.limit_in_bytes"))
+		if !qok && !mok {
+			return nil
+		}
+		cl.Source = "cgroup1"
+		if qok && pok && quota > 0 && period > 0 {
+			cl.CPUs = float64(quota) / float64(period)
+		}
+		if mok && mem < cgroupNoMemoryLimit {
+			cl.Memory = mem
+		}
+	}
+	if cl.CPUs == 0 && cl.Memory == 0 {
+		return nil
+	}
+	if cl.CPUs > 0 {
+		cl.GOMAXPROCS = int(math.Ceil(cl.CPUs))
+		if n := runtime.NumCPU(); cl.GOMAXPROCS > n {
+			cl.GOMAXPROCS = n
+		}
+	}
+	return cl
+}
+
+// readCgroupValue reads a file with a single number, "max" or -1 for no
+// limit, which returns 0.
+func readCgroupValue(path string) (int64, bool) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	s := strings.TrimSpace(string(b))
+	if s == "max" {
+		return 0, true
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if v < 0 {
+		v = 0
+	}
+	return v, true
+}
+
+// readCgroupPair reads the quota and period of cgroup v2 cpu.max, the
+// quota being 0 for no limit.
+func readCgroupPair(path string) (int64, int64, bool) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, 0, false
+	}
+	f := strings.Fields(string(b))
+	if len(f) != 2 {
+		return 0, 0, false
+	}
+	period, err := strconv.ParseInt(f[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	if f[0] == "max" {
+		return 0, period, true
+	}
+	quota, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return quota, period, true
+}
+
+// maxPending returns the default maximum pending bytes of a connection
+// given the memory limit.
+func (cl *ContainerLimits) maxPending() int64 {
+	if cl == nil || cl.Memory <= 0 {
+		return MAX_PENDING_SIZE
+	}
+	if mp := cl.Memory / containerMaxPendingDivisor; mp < MAX_PENDING_SIZE {
+		return mp
+	}
+	return MAX_PENDING_SIZE
+}
+
+// cpus returns the number of CPUs available to the server.
+func (cl *ContainerLimits) cpus() float64 {
+	if cl == nil || cl.CPUs <= 0 {
+		return float64(runtime.NumCPU())
+	}
+	return cl.CPUs
+}
+
+// applyContainerLimits logs the container limits and sets GOMAXPROCS from
+// the CPU limit, unless set in the environment, then logs the values in
+// use.
+func (s *Server) applyContainerLimits() {
+	cl := s.containerLimits
+	if cl == nil {
+		return
+	}
+	s.Noticef("Detected %s limits: cpus=%v memory=%v", cl.Source, cl.CPUs, cl.Memory)
+	if cl.GOMAXPROCS > 0 && os.Getenv("GOMAXPROCS") == _EMPTY_ && runtime.GOMAXPROCS(0) != cl.GOMAXPROCS {
+		runtime.GOMAXPROCS(cl.GOMAXPROCS)
+	}
+	s.Noticef("Using GOMAXPROCS=%d max_pending=%d", runtime.GOMAXPROCS(0), s.getOpts().MaxPending)
+}
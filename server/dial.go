@@ -0,0 +1,329 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// IP families that outbound connections can prefer.
+const (
+	DialPreferIPv4 = "ipv4"
+	DialPreferIPv6 = "ipv6"
+)
+
+const (
+	// DEFAULT_DIAL_FALLBACK_DELAY is the default delay before dialing the
+	// next address when happy eyeballs is enabled.
+	DEFAULT_DIAL_FALLBACK_DELAY = 300 * time.Millisecond
+
+	// Backoff of endpoints that failed to be dialed.
+	dialBackoffMin = time.Second
+	dialBackoffMax = 30 * time.Second
+
+	// Maximum number of endpoints whose dial state is tracked.
+	maxDialEndpoints = 1024
+)
+
+// OutboundDialOpts are options for how routes, gateways and leafnodes
+// resolve and dial the remote servers they connect to.
+type OutboundDialOpts struct {
+	// ResolveTimeout limits the time to resolve a host name, no limit if 0.
+	ResolveTimeout time.Duration `json:"resolve_timeout,omitempty"`
+	// Prefer the addresses of this IP family, DialPreferIPv4 or
+	// DialPreferIPv6, the resolved addresses are used in random order
+	// if empty.
+	Prefer string `json:"prefer,omitempty"`
+	// HappyEyeballs dials the resolved addresses in turn, alternating IP
+	// families, without waiting for the previous ones to fail for more
+	// than FallbackDelay. The first successful connection is used.
+	HappyEyeballs bool          `json:"happy_eyeballs,omitempty"`
+	FallbackDelay time.Duration `json:"fallback_delay,omitempty"`
+}
+
+func (o *OutboundDialOpts) validate() error {
+	switch o.Prefer {
+	case _EMPTY_, DialPreferIPv4, DialPreferIPv6:
+	default:
+		return fmt.Errorf("invalid outbound dial preference %q, expected %q or %q",
+			o.Prefer, DialPreferIPv4, DialPreferIPv6)
+	}
+	if o.ResolveTimeout < 0 || o.FallbackDelay < 0 {
+		return fmt.Errorf("outbound dial timeouts can't be negative")
+	}
+	return nil
+}
+
+// OutboundEndpoint is the dial state of an address that a route, gateway
+// or leafnode connection was attempted to.
+type OutboundEndpoint struct {
+	Kind        string     `json:"kind"`
+	Address     string     `json:"address"`
+	Failures    int        `json:"failures"`
+	LastAttempt time.Time  `json:"last_attempt"`
+	LastError   string     `json:"last_error,omitempty"`
+	Backoff     *time.Time `json:"backoff_until,omitempty"`
+}
+
+// dialEndpoints tracks the dial state of outbound endpoints, keyed by
+// address.
+type dialEndpoints struct {
+	sync.Mutex
+	endpoints map[string]*OutboundEndpoint
+}
+
+// outboundDialOpts returns the current outbound dial options.
+func (s *Server) outboundDialOpts() OutboundDialOpts {
+	if opts := s.getOpts(); opts != nil {
+		return opts.OutboundDial
+	}
+	return OutboundDialOpts{}
+}
+
+func isIPv4(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() != nil
+}
+
+// resolveOutbound resolves the host of hostPort and returns the addresses
+// to dial, in order: by IP family preference, random otherwise, and with
+// the endpoints in backoff last.
+func (s *Server) resolveOutbound(resolver netResolver, hostPort string) ([]string, error) {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return nil, err
+	}
+	// If already an IP, skip.
+	if net.ParseIP(host) != nil {
+		return []string{hostPort}, nil
+	}
+	dopts := s.outboundDialOpts()
+	ctx := context.Background()
+	if dopts.ResolveTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dopts.ResolveTimeout)
+		defer cancel()
+	}
+	ips, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("lookup for host %q: %v", host, err)
+	}
+	if len(ips) == 0 {
+		s.Warnf("Unable to get IP for %s, will try with %s: %v", host, hostPort, err)
+		return []string{hostPort}, nil
+	}
+	addrs := make([]string, len(ips))
+	for i, j := range rand.Perm(len(ips)) {
+		addrs[i] = net.JoinHostPort(ips[j], port)
+	}
+	if dopts.Prefer != _EMPTY_ {
+		v4 := dopts.Prefer == DialPreferIPv4
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return isIPv4(addrs[i]) == v4 && isIPv4(addrs[j]) != v4
+		})
+	}
+	if len(addrs) > 1 {
+		now := time.Now()
+		s.dialState.Lock()
+		inBackoff := func(addr string) bool {
+			ep := s.dialState.endpoints[addr]
+			return ep != nil && ep.Backoff != nil && now.Before(*ep.Backoff)
+		}
+		sort.SliceStable(addrs, func(i, j int) bool {
+			return !inBackoff(addrs[i]) && inBackoff(addrs[j])
+		})
+		s.dialState.Unlock()
+	}
+	return addrs, nil
+}
+
+// interleaveFamilies reorders the addresses so that IP families alternate,
+// starting with the family of the first address.
+func interleaveFamilies(addrs []string) []string {
+	var first, other []string
+	v4 := isIPv4(addrs[0])
+	for _, addr := range addrs {
+		if isIPv4(addr) == v4 {
+			first = append(first, addr)
+		} else {
+			other = append(other, addr)
+		}
+	}
+	res := make([]string, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(other); i++ {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+		if i < len(other) {
+			res = append(res, other[i])
+		}
+	}
+	return res
+}
+
+// dialOutbound connects to the first address, or races the addresses if
+// happy eyeballs is enabled, and records the result of each dial.
+func (s *Server) dialOutbound(kind string, addrs []string, timeout time.Duration) (net.Conn, error) {
+	dopts := s.outboundDialOpts()
+	if !dopts.HappyEyeballs || len(addrs) == 1 {
+		conn, err := net.DialTimeout("tcp", addrs[0], timeout)
+		s.recordDial(kind, addrs[0], err)
+		return conn, err
+	}
+	addrs = interleaveFamilies(addrs)
+	delay := dopts.FallbackDelay
+	if delay <= 0 {
+		delay = DEFAULT_DIAL_FALLBACK_DELAY
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		addr string
+		err  error
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan dialResult, len(addrs))
+	dialer := &net.Dialer{Timeout: timeout}
+	next, pending := 0, 0
+	var fallback <-chan time.Time
+	dialNext := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			results <- dialResult{conn, addr, err}
+		}()
+		if next < len(addrs) {
+			fallback = time.After(delay)
+		} else {
+			fallback = nil
+		}
+	}
+	// Close the connections of the dials still in progress.
+	drain := func(n int) {
+		go func() {
+			for i := 0; i < n; i++ {
+				if r := <-results; r.conn != nil {
+					r.conn.Close()
+				}
+			}
+		}()
+	}
+
+	var firstErr error
+	dialNext()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			s.recordDial(kind, r.addr, r.err)
+			if r.err == nil {
+				drain(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				dialNext()
+			}
+		case <-fallback:
+			dialNext()
+		case <-s.quitCh:
+			drain(pending)
+			return nil, ErrServerNotRunning
+		}
+	}
+	return nil, firstErr
+}
+
+// recordDial updates the dial state of the endpoint. Endpoints that fail
+// are put in an exponential backoff during which they are dialed last.
+func (s *Server) recordDial(kind, addr string, err error) {
+	now := time.Now()
+	ds := &s.dialState
+	ds.Lock()
+	defer ds.Unlock()
+	if ds.endpoints == nil {
+		ds.endpoints = make(map[string]*OutboundEndpoint)
+	}
+	ep := ds.endpoints[addr]
+	if ep == nil {
+		if len(ds.endpoints) >= maxDialEndpoints {
+			// Forget the endpoint attempted the longest time ago.
+			var oldest *OutboundEndpoint
+			for _, e := range ds.endpoints {
+				if oldest == nil || e.LastAttempt.Before(oldest.LastAttempt) {
+					oldest = e
+				}
+			}
+			delete(ds.endpoints, oldest.Address)
+		}
+		ep = &OutboundEndpoint{Address: addr}
+		ds.endpoints[addr] = ep
+	}
+	ep.Kind = kind
+	ep.LastAttempt = now
+	if err == nil {
+		ep.Failures = 0
+		ep.LastError = _EMPTY_
+		ep.Backoff = nil
+		return
+	}
+	ep.Failures++
+	ep.LastError = err.Error()
+	backoff := dialBackoffMin
+	for i := 1; i < ep.Failures && backoff < dialBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > dialBackoffMax {
+		backoff = dialBackoffMax
+	}
+	until := now.Add(backoff)
+	ep.Backoff = &until
+}
+
+// outboundEndpoints returns the dial state of the outbound endpoints,
+// sorted by address.
+func (s *Server) outboundEndpoints() []*OutboundEndpoint {
+	ds := &s.dialState
+	ds.Lock()
+	defer ds.Unlock()
+	if len(ds.endpoints) == 0 {
+		return nil
+	}
+	eps := make([]*OutboundEndpoint, 0, len(ds.endpoints))
+	for _, ep := range ds.endpoints {
+		cep := *ep
+		if ep.Backoff != nil {
+			until := *ep.Backoff
+			cep.Backoff = &until
+		}
+		eps = append(eps, &cep)
+	}
+	sort.Slice(eps, func(i, j int) bool { return eps[i].Address < eps[j].Address })
+	return eps
+}
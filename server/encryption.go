@@ -0,0 +1,152 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sync/atomic"
+)
+
+// Messages on the subjects of an account's encryption policy must be
+// sealed in an envelope, whose first line, since messages have no
+// headers, is:
+//
+//	NATS-ENC/1 <key id> <nonce>\r\n
+//
+// followed by the sealed payload. The nonce is base64 encoded, and of 12
+// or 24 bytes, for AES-GCM or XChaCha20-Poly1305. The server can not open
+// the payload, it only checks that it is enveloped.
+const (
+	envelopePrefix = "NATS-ENC/1 "
+	// The sealed payload has at least the authentication tag of the AEAD.
+	envelopeMinSealed = 16
+)
+
+// encryptionPolicy is the subjects on which the clients of an account
+// must publish enveloped payloads, and the allowed key IDs, any if empty.
+type encryptionPolicy struct {
+	subjects []string
+	keyIDs   map[string]struct{}
+}
+
+func newEncryptionPolicy(subjects, keyIDs []string) (*encryptionPolicy, error) {
+	if len(subjects) == 0 {
+		return nil, fmt.Errorf("encryption requires subjects")
+	}
+	for _, subject := range subjects {
+		if !IsValidSubject(subject) {
+			return nil, fmt.Errorf("invalid encryption subject %q", subject)
+		}
+	}
+	ep := &encryptionPolicy{subjects: subjects}
+	if len(keyIDs) > 0 {
+		ep.keyIDs = make(map[string]struct{}, len(keyIDs))
+		for _, kid := range keyIDs {
+			ep.keyIDs[kid] = struct{}{}
+		}
+	}
+	return ep, nil
+}
+
+// applies returns true if messages on the subject must be enveloped.
+func (ep *encryptionPolicy) applies(subject string) bool {
+	for _, filter := range ep.subjects {
+		if matchLiteral(subject, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns an error if the payload, without the trailing CR_LF, is
+// not enveloped or its key ID is not allowed.
+func (ep *encryptionPolicy) check(payload []byte) error {
+	if !bytes.HasPrefix(payload, []byte(envelopePrefix)) {
+		return fmt.Errorf("plaintext payload")
+	}
+	eol := bytes.Index(payload, []byte(_CRLF_))
+	if eol < 0 {
+		return fmt.Errorf("missing envelope line")
+	}
+	fields := bytes.Fields(payload[len(envelopePrefix):eol])
+	if len(fields) != 2 {
+		return fmt.Errorf("expected key id and nonce in envelope")
+	}
+	if ep.keyIDs != nil {
+		if _, ok := ep.keyIDs[string(fields[0])]; !ok {
+			return fmt.Errorf("key id %q not allowed", fields[0])
+		}
+	}
+	nonce, err := base64.StdEncoding.DecodeString(string(fields[1]))
+	if err != nil {
+		nonce, err = base64.RawURLEncoding.DecodeString(string(fields[1]))
+	}
+	if err != nil || (len(nonce) != 12 && len(nonce) != 24) {
+		return fmt.Errorf("invalid nonce")
+	}
+	if len(payload)-eol-LEN_CR_LF < envelopeMinSealed {
+		return fmt.Errorf("sealed payload too short")
+	}
+	return nil
+}
+
+// SetEncryptionPolicy requires the messages published by this account's
+// clients on the given subjects to be sealed in an encryption envelope,
+// with one of the given key IDs if any. No subjects removes the policy.
+func (a *Account) SetEncryptionPolicy(subjects, keyIDs []string) error {
+	var ep *encryptionPolicy
+	if len(subjects) > 0 {
+		var err error
+		if ep, err = newEncryptionPolicy(subjects, keyIDs); err != nil {
+			return err
+		}
+	}
+	a.mu.Lock()
+	a.setEncryptionPolicy(ep)
+	a.mu.Unlock()
+	return nil
+}
+
+// Account lock is held on entry if the account is registered.
+func (a *Account) setEncryptionPolicy(ep *encryptionPolicy) {
+	a.encryption = ep
+	if ep != nil {
+		atomic.StoreInt32(&a.encryptionOn, 1)
+	} else {
+		atomic.StoreInt32(&a.encryptionOn, 0)
+	}
+}
+
+// checkEncryption returns false if the message being processed has to be
+// rejected because it is not enveloped as required on its subject.
+func (c *client) checkEncryption(msg []byte) bool {
+	acc := c.acc
+	acc.mu.RLock()
+	ep := acc.encryption
+	acc.mu.RUnlock()
+	if ep == nil || !ep.applies(string(c.pa.subject)) {
+		return true
+	}
+	err := ep.check(msg[:len(msg)-LEN_CR_LF])
+	if err == nil {
+		return true
+	}
+	c.Debugf("Rejecting message on %q: %v", c.pa.subject, err)
+	// Reported as a permissions violation so that clients don't treat it
+	// as a protocol error and reconnect.
+	c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q, Encryption Envelope Required", c.pa.subject))
+	return false
+}
@@ -37,12 +37,57 @@ var (
 	// ErrMaxControlLine represents an error condition when the control line is too big.
 	ErrMaxControlLine = errors.New("maximum control line exceeded")
 
+	// ErrMaxSubjectLength represents an error condition when a subject is too long.
+	ErrMaxSubjectLength = errors.New("maximum subject length exceeded")
+
+	// ErrMaxSubjectTokens represents an error condition when a subject has too many tokens.
+	ErrMaxSubjectTokens = errors.New("maximum subject tokens exceeded")
+
+	// ErrMaxReplyLength represents an error condition when a reply subject is too long.
+	ErrMaxReplyLength = errors.New("maximum reply subject length exceeded")
+
+	// ErrUnsupportedCompression represents an error condition when a client requests
+	// a compression that the server does not support or has not enabled.
+	ErrUnsupportedCompression = errors.New("unsupported compression")
+
+	// ErrClientMetadataTooLarge represents an error condition when the metadata
+	// of a client CONNECT exceeds MAX_CLIENT_METADATA_SIZE.
+	ErrClientMetadataTooLarge = errors.New("client metadata too large")
+
 	// ErrReservedPublishSubject represents an error condition when sending to a reserved subject, e.g. _SYS.>
 	ErrReservedPublishSubject = errors.New("reserved internal subject")
 
 	// ErrBadPublishSubject represents an error condition for an invalid publish subject.
 	ErrBadPublishSubject = errors.New("invalid publish subject")
 
+	// ErrBadReplySubject represents an error condition for an invalid reply subject.
+	ErrBadReplySubject = errors.New("invalid reply subject")
+
+	// ErrBadSubscribeSubject represents an error condition for an invalid subscribe subject.
+	ErrBadSubscribeSubject = errors.New("invalid subscribe subject")
+
+	// ErrDuplicateConnect signals a client or leafnode sent a second CONNECT.
+	ErrDuplicateConnect = errors.New("duplicate CONNECT")
+
+	// ErrProtoBeforeConnect signals a client sent PUB, SUB or UNSUB before CONNECT.
+	ErrProtoBeforeConnect = errors.New("protocol operation before CONNECT")
+
+	// ErrDuplicateConnection signals a client connected with the identity
+	// of a client already connected, when limited to one connection.
+	ErrDuplicateConnection = errors.New("duplicate connection")
+
+	// ErrSessionMigrated signals a client that its session was migrated to
+	// another server, that it needs to reconnect to.
+	ErrSessionMigrated = errors.New("session migrated")
+
+	// ErrAccountFrozen is returned to the connections of an account frozen
+	// by an administrator.
+	ErrAccountFrozen = errors.New("account frozen")
+
+	// ErrScannerProbe signals a client sent data that is not the NATS
+	// protocol before any CONNECT.
+	ErrScannerProbe = errors.New("non-protocol data")
+
 	// ErrBadClientProtocol signals a client requested an invalid client protocol.
 	ErrBadClientProtocol = errors.New("invalid client protocol")
 
@@ -50,6 +95,10 @@ var (
 	// server has been reached.
 	ErrTooManyConnections = errors.New("maximum connections exceeded")
 
+	// ErrTooManyPendingAuth signals a connection that too many connections
+	// accepted on the same listener have not authenticated yet.
+	ErrTooManyPendingAuth = errors.New("maximum pending authentications exceeded")
+
 	// ErrTooManyAccountConnections signals that an account has reached its maximum number of active
 	// connections.
 	ErrTooManyAccountConnections = errors.New("maximum account active connections exceeded")
@@ -180,6 +229,11 @@ func (e *configWarningErr) Error() string {
 	return fmt.Sprintf("%s: invalid use of field %q: %s", e.Source(), e.field, e.reason)
 }
 
+// configDeprecationErr is a warning for the use of a deprecated field.
+type configDeprecationErr struct {
+	configWarningErr
+}
+
 // processConfigErr is the result of processing the configuration from the server.
 type processConfigErr struct {
 	errors   []error
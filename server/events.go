@@ -38,10 +38,33 @@ const (
 	accConnsEventSubj        = "$SYS.SERVER.ACCOUNT.%s.CONNS"
 	shutdownEventSubj        = "$SYS.SERVER.%s.SHUTDOWN"
 	authErrorEventSubj       = "$SYS.SERVER.%s.CLIENT.AUTH.ERR"
+	authBanEventSubj         = "$SYS.SERVER.%s.CLIENT.AUTH.BAN"
 	serverStatsSubj          = "$SYS.SERVER.%s.STATSZ"
 	serverStatsReqSubj       = "$SYS.REQ.SERVER.%s.STATSZ"
 	serverStatsPingReqSubj   = "$SYS.REQ.SERVER.PING"
+	serverPingReqSubj        = "$SYS.REQ.SERVER.PING.%s"
+	clientRedirectReqSubj    = "$SYS.REQ.SERVER.%s.REDIRECT"
+	clientKickReqSubj        = "$SYS.REQ.SERVER.%s.KICK"
+	logLevelReqSubj          = "$SYS.REQ.SERVER.%s.LOGLEVEL"
+	acceptReqSubj            = "$SYS.REQ.SERVER.%s.ACCEPT"
+	joinTokenReqSubj         = "$SYS.REQ.SERVER.%s.JOIN_TOKEN"
+	stateSnapshotReqSubj     = "$SYS.REQ.SERVER.%s.SNAPSHOT"
+	clientMigrateReqSubj     = "$SYS.REQ.SERVER.%s.MIGRATE"
+	sessionsImportSubj       = "$SYS.REQ.SERVER.%s.SESSIONS"
+	serverStallEventSubj     = "$SYS.SERVER.%s.STALL"
+	serverFDExhaustEventSubj = "$SYS.SERVER.%s.FD_EXHAUSTED"
+	serverWatermarkEventSubj = "$SYS.SERVER.%s.WATERMARK.%s"
+	certExpiringEventSubj    = "$SYS.SERVER.%s.CERT.EXPIRING"
 	leafNodeConnectEventSubj = "$SYS.ACCOUNT.%s.LEAFNODE.CONNECT"
+	accCrossingEventSubj     = "$SYS.ACCOUNT.%s.AUDIT.CROSSING"
+	subjectRateEventSubj     = "$SYS.ACCOUNT.%s.SUBJECT.RATE"
+	subjectQuotaEventSubj    = "$SYS.ACCOUNT.%s.SUBJECT.QUOTA"
+	schemaViolationEventSubj = "$SYS.ACCOUNT.%s.SCHEMA.INVALID"
+	subscriptionEventSubj    = "$SYS.ACCOUNT.%s.SUBSCRIPTION.%s"
+	accUsageEventSubj        = "$SYS.ACCOUNT.%s.USAGE"
+	accFreezeReqSubj         = "$SYS.REQ.ACCOUNT.%s.FREEZE"
+	accFrozenEventSubj       = "$SYS.ACCOUNT.%s.FROZEN"
+	userExpiringEventSubj    = "$SYS.ACCOUNT.%s.USER.%s.EXPIRING"
 	remoteLatencyEventSubj   = "$SYS.LATENCY.M2.%s"
 	inboxRespSubj            = "$SYS._INBOX.%s.%s"
 
@@ -49,6 +72,9 @@ const (
 	// we can then shard as needed.
 	accNumSubsReqSubj = "$SYS.REQ.ACCOUNT.NSUBS"
 
+	// This is exported to accounts, for their own subject space.
+	accSubszReqSubj = "$SYS.REQ.ACCOUNT.%s.SUBSZ"
+
 	// These are for exported debug services. These are local to this server only.
 	accSubsSubj = "$SYS.DEBUG.SUBSCRIBERS"
 
@@ -103,6 +129,148 @@ type DisconnectEventMsg struct {
 	Reason   string     `json:"reason"`
 }
 
+// UserExpiringEventMsg is sent, in the user's own account, ahead of the
+// expiration of the user JWT a client connected with, so that the client
+// can reconnect with a renewed JWT before being disconnected.
+type UserExpiringEventMsg struct {
+	Server  ServerInfo `json:"server"`
+	Client  ClientInfo `json:"client"`
+	Expires time.Time  `json:"expires"`
+}
+
+// Test whether a subject is a system subject.
+func isSystemSubject(subject []byte) bool {
+	return len(subject) > 5 && string(subject[:5]) == "$SYS."
+}
+
+// AccountCrossingEventMsg is sent, when account auditing is enabled, for
+// each message that crosses from one account to another through an import.
+type AccountCrossingEventMsg struct {
+	Server        ServerInfo `json:"server"`
+	Type          string     `json:"type"`
+	FromAccount   string     `json:"from_account"`
+	ToAccount     string     `json:"to_account"`
+	Subject       string     `json:"subject"`
+	MappedSubject string     `json:"mapped_subject,omitempty"`
+	ClientID      uint64     `json:"client_id,omitempty"`
+}
+
+// AccountUsageEventMsg is sent periodically with the usage of an account
+// on a server between Start and End, for billing. Connections is the
+// number of connections open at the end of the period.
+type AccountUsageEventMsg struct {
+	Server   ServerInfo     `json:"server"`
+	Account  string         `json:"account"`
+	Start    time.Time      `json:"start"`
+	End      time.Time      `json:"end"`
+	Client   TransportUsage `json:"client"`
+	Leafnode TransportUsage `json:"leafnode"`
+}
+
+// SubjectRateEventMsg is sent when a subject of an account exceeds the
+// maximum message rate of the matching subject rate limit, at most once
+// per second for each subject.
+type SubjectRateEventMsg struct {
+	Server   ServerInfo `json:"server"`
+	Account  string     `json:"account"`
+	Subject  string     `json:"subject"`
+	Filter   string     `json:"filter"`
+	MaxRate  int64      `json:"max_rate"`
+	Action   string     `json:"action"`
+	ClientID uint64     `json:"client_id,omitempty"`
+}
+
+// SchemaViolationEventMsg is sent, when schema validation is enabled, for
+// a message whose payload does not match the schema of its subject. It is
+// sent at most once per second for a subject of an account.
+type SchemaViolationEventMsg struct {
+	Server   ServerInfo `json:"server"`
+	Account  string     `json:"account"`
+	Subject  string     `json:"subject"`
+	Schema   string     `json:"schema"`
+	Error    string     `json:"error"`
+	Policy   string     `json:"policy"`
+	ClientID uint64     `json:"client_id,omitempty"`
+}
+
+// AccountFrozenEventMsg is sent when an account is frozen or unfrozen, and
+// at most once per second for an account when a message of a frozen
+// account is dropped, with the subject and client of the message.
+type AccountFrozenEventMsg struct {
+	Server   ServerInfo `json:"server"`
+	Account  string     `json:"account"`
+	Frozen   bool       `json:"frozen"`
+	Reason   string     `json:"reason,omitempty"`
+	Subject  string     `json:"subject,omitempty"`
+	ClientID uint64     `json:"client_id,omitempty"`
+}
+
+// SubscriptionEventMsg is sent, when subscription events are enabled, for
+// the creation and deletion of the subscriptions of clients. Dropped is
+// the number of advisories of the account not sent because of the rate
+// limit since the previous one.
+type SubscriptionEventMsg struct {
+	Server     ServerInfo `json:"server"`
+	Type       string     `json:"type"`
+	Account    string     `json:"account"`
+	Subject    string     `json:"subject"`
+	Queue      string     `json:"queue,omitempty"`
+	ClientID   uint64     `json:"client_id"`
+	ClientName string     `json:"client_name,omitempty"`
+	User       string     `json:"user,omitempty"`
+	Dropped    int64      `json:"dropped,omitempty"`
+}
+
+// SubjectQuotaEventMsg is sent when the clients of an account publish to
+// more distinct subjects than allowed by the account's subject quota, at
+// most once per quota window.
+type SubjectQuotaEventMsg struct {
+	Server      ServerInfo    `json:"server"`
+	Account     string        `json:"account"`
+	Subject     string        `json:"subject"`
+	MaxSubjects int           `json:"max_subjects"`
+	Window      time.Duration `json:"window"`
+	ClientID    uint64        `json:"client_id,omitempty"`
+}
+
+// ServerStallEventMsg is sent when the watchdog detects that a part of the
+// server has been stuck for longer than the configured threshold.
+type ServerStallEventMsg struct {
+	Server      ServerInfo    `json:"server"`
+	Kind        string        `json:"kind"`
+	Description string        `json:"description"`
+	Duration    time.Duration `json:"duration"`
+	ClientID    uint64        `json:"client_id,omitempty"`
+}
+
+// ServerFDExhaustedEventMsg is sent when a listener of the server can not
+// accept connections because the process ran out of file descriptors.
+type ServerFDExhaustedEventMsg struct {
+	Server   ServerInfo `json:"server"`
+	Listener string     `json:"listener"`
+	Error    string     `json:"error"`
+	Closed   int        `json:"closed_idle,omitempty"`
+}
+
+// CertExpiringEventMsg is sent, when cert_expiry_warning is set, ahead of
+// the expiration of the certificate presented by the peer of a TLS
+// connection, so that it is rotated before the connection fails.
+type CertExpiringEventMsg struct {
+	Server ServerInfo `json:"server"`
+	Cert   CertExpiry `json:"cert"`
+}
+
+// ServerWatermarkEventMsg is sent when a server wide metric reaches its
+// high watermark, and when it goes back to its low watermark.
+type ServerWatermarkEventMsg struct {
+	Server ServerInfo `json:"server"`
+	Metric string     `json:"metric"`
+	State  string     `json:"state"`
+	Value  int64      `json:"value"`
+	High   int64      `json:"high"`
+	Low    int64      `json:"low"`
+}
+
 // AccountNumConns is an event that will be sent from a server that is tracking
 // a given account when the number of connections changes. It will also HB
 // updates in the absence of any changes.
@@ -144,6 +312,9 @@ type ClientInfo struct {
 	Version string     `json:"ver,omitempty"`
 	RTT     string     `json:"rtt,omitempty"`
 	Stop    *time.Time `json:"stop,omitempty"`
+
+	// Metadata given by the client in its CONNECT.
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 // ServerStats hold various statistics that we will periodically send out.
@@ -161,6 +332,7 @@ type ServerStats struct {
 	SlowConsumers    int64          `json:"slow_consumers"`
 	Routes           []*RouteStat   `json:"routes,omitempty"`
 	Gateways         []*GatewayStat `json:"gateways,omitempty"`
+	Rates            *Rates         `json:"rates,omitempty"`
 }
 
 // RouteStat holds route statistics.
@@ -447,6 +619,7 @@ func (s *Server) sendStatsz(subj string) {
 	m.Stats.Sent.Bytes = atomic.LoadInt64(&s.outBytes)
 	m.Stats.SlowConsumers = atomic.LoadInt64(&s.slowConsumers)
 	m.Stats.NumSubs = s.numSubscriptions()
+	m.Stats.Rates = s.rollingRates()
 
 	for _, r := range s.routes {
 		m.Stats.Routes = append(m.Stats.Routes, routeStat(r))
@@ -540,6 +713,11 @@ func (s *Server) initEventTracking() {
 	if _, err := s.sysSubscribe(subject, s.connsRequest); err != nil {
 		s.Errorf("Error setting up internal tracking: %v", err)
 	}
+	// Listen for requests to freeze an account.
+	subject = fmt.Sprintf(accFreezeReqSubj, "*")
+	if _, err := s.sysSubscribe(subject, s.accountFreezeReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
 	// Listen for broad requests to respond with number of subscriptions for a given subject.
 	if _, err := s.sysSubscribe(accNumSubsReqSubj, s.nsubsRequest); err != nil {
 		s.Errorf("Error setting up internal tracking: %v", err)
@@ -563,6 +741,52 @@ func (s *Server) initEventTracking() {
 	if _, err := s.sysSubscribe(serverStatsPingReqSubj, s.statszReq); err != nil {
 		s.Errorf("Error setting up internal tracking: %v", err)
 	}
+	// Listen for ping messages that will be sent to all servers for one of
+	// the monitoring endpoints.
+	subject = fmt.Sprintf(serverPingReqSubj, "*")
+	if _, err := s.sysSubscribe(subject, s.serverPingReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to redirect our clients to other servers.
+	subject = fmt.Sprintf(clientRedirectReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.redirectClientsReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to disconnect some of our clients.
+	subject = fmt.Sprintf(clientKickReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.kickClientsReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to change the log levels.
+	subject = fmt.Sprintf(logLevelReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.logLevelReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to pause or resume accepting clients.
+	subject = fmt.Sprintf(acceptReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.acceptReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to issue join tokens.
+	subject = fmt.Sprintf(joinTokenReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.joinTokenReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to snapshot the state of the server.
+	subject = fmt.Sprintf(stateSnapshotReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.stateSnapshotReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	// Listen for requests to migrate some of our clients to another server,
+	// and for the sessions migrated to us.
+	subject = fmt.Sprintf(clientMigrateReqSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.migrateClientsReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
+	subject = fmt.Sprintf(sessionsImportSubj, s.info.ID)
+	if _, err := s.sysSubscribe(subject, s.sessionsImport); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
 	// Listen for updates when leaf nodes connect for a given account. This will
 	// force any gateway connections to move to `modeInterestOnly`
 	subject = fmt.Sprintf(leafNodeConnectEventSubj, "*")
@@ -585,6 +809,15 @@ func (s *Server) initEventTracking() {
 	if err := sacc.AddServiceExport(accSubsSubj, nil); err != nil {
 		s.Errorf("Error adding system service export for %q: %v", accSubsSubj, err)
 	}
+
+	// This is for the subjects with interest in an account.
+	subject = fmt.Sprintf(accSubszReqSubj, "*")
+	if _, err := s.sysSubscribeInternal(subject, s.accountSubszReq); err != nil {
+		s.Errorf("Error setting up internal service for account subsz: %v", err)
+	}
+	if err := sacc.AddServiceExport(subject, nil); err != nil {
+		s.Errorf("Error adding system service export for %q: %v", subject, err)
+	}
 }
 
 // accountClaimUpdate will receive claim updates for accounts.
@@ -737,6 +970,137 @@ func (s *Server) statszReq(sub *subscription, _ *client, subject, reply string,
 	s.sendStatsz(reply)
 }
 
+// ServerAPIResponse is the response of a server to a ping for one of its
+// monitoring endpoints, $SYS.REQ.SERVER.PING.<kind>, the kind being one
+// of VARZ, CONNZ, SUBSZ, ROUTEZ, GATEWAYZ, LEAFZ or ACCOUNTZ. The payload
+// of the ping holds the options of the endpoint as JSON, for instance
+// {"auth":true,"acc":"A"} to list the connections of account A from all
+// servers in one request.
+type ServerAPIResponse struct {
+	Server ServerInfo  `json:"server"`
+	Data   interface{} `json:"data,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// serverPingReq is a request, sent to all servers, for one of our
+// monitoring endpoints.
+func (s *Server) serverPingReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() || reply == _EMPTY_ {
+		return
+	}
+	kind := subject[strings.LastIndexByte(subject, btsep)+1:]
+	unmarshal := func(v interface{}) error {
+		if len(msg) == 0 {
+			return nil
+		}
+		return json.Unmarshal(msg, v)
+	}
+	var (
+		data interface{}
+		err  error
+	)
+	switch kind {
+	case "VARZ":
+		opts := &VarzOptions{}
+		if err = unmarshal(opts); err == nil {
+			data, err = s.Varz(opts)
+		}
+	case "CONNZ":
+		opts := &ConnzOptions{}
+		if err = unmarshal(opts); err == nil {
+			data, err = s.Connz(opts)
+		}
+	case "SUBSZ":
+		opts := &SubszOptions{}
+		if err = unmarshal(opts); err == nil {
+			data, err = s.Subsz(opts)
+		}
+	case "ROUTEZ":
+		opts := &RoutezOptions{}
+		if err = unmarshal(opts); err == nil {
+			data, err = s.Routez(opts)
+		}
+	case "GATEWAYZ":
+		opts := &GatewayzOptions{}
+		if err = unmarshal(opts); err == nil {
+			data, err = s.Gatewayz(opts)
+		}
+	case "LEAFZ":
+		opts := &LeafzOptions{}
+		if err = unmarshal(opts); err == nil {
+			data, err = s.Leafz(opts)
+		}
+	case "ACCOUNTZ":
+		opts := &AccountzOptions{}
+		if err = unmarshal(opts); err == nil {
+			data, err = s.Accountz(opts)
+		}
+	default:
+		err = fmt.Errorf("unknown ping kind %q", kind)
+	}
+	resp := &ServerAPIResponse{}
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Data = data
+	}
+	s.sendInternalMsgLocked(reply, _EMPTY_, &resp.Server, resp)
+}
+
+// ClientRedirectResponse is the response to a client redirect request.
+type ClientRedirectResponse struct {
+	Server     string `json:"server_id"`
+	Redirected int    `json:"redirected"`
+	Error      string `json:"error,omitempty"`
+}
+
+// redirectClientsReq is a request to redirect some of our clients.
+func (s *Server) redirectClientsReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	resp := &ClientRedirectResponse{Server: s.ID()}
+	r := &ClientRedirect{}
+	if err := json.Unmarshal(msg, r); err != nil {
+		resp.Error = fmt.Sprintf("Error unmarshalling client redirect request: %v", err)
+	} else if n, err := s.RedirectClients(r); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Redirected = n
+		s.Noticef("Redirected %d client(s)", n)
+	}
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, nil, resp)
+	}
+}
+
+// ClientKickResponse is the response to a client kick request.
+type ClientKickResponse struct {
+	Server string `json:"server_id"`
+	Kicked int    `json:"kicked"`
+	Error  string `json:"error,omitempty"`
+}
+
+// kickClientsReq is a request to disconnect some of our clients.
+func (s *Server) kickClientsReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	resp := &ClientKickResponse{Server: s.ID()}
+	k := &ClientKick{}
+	if err := json.Unmarshal(msg, k); err != nil {
+		resp.Error = fmt.Sprintf("Error unmarshalling client kick request: %v", err)
+	} else if n, err := s.KickClients(k); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Kicked = n
+		s.Noticef("Kicked %d client(s)", n)
+	}
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, nil, resp)
+	}
+}
+
 // remoteConnsUpdate gets called when we receive a remote update from another server.
 func (s *Server) remoteConnsUpdate(sub *subscription, _ *client, subject, reply string, msg []byte) {
 	if !s.eventsRunning() {
@@ -877,14 +1241,15 @@ func (s *Server) accountConnectEvent(c *client) {
 
 	m := ConnectEventMsg{
 		Client: ClientInfo{
-			Start:   c.start,
-			Host:    c.host,
-			ID:      c.cid,
-			Account: accForClient(c),
-			User:    nameForClient(c),
-			Name:    c.opts.Name,
-			Lang:    c.opts.Lang,
-			Version: c.opts.Version,
+			Start:    c.start,
+			Host:     c.host,
+			ID:       c.cid,
+			Account:  accForClient(c),
+			User:     nameForClient(c),
+			Name:     c.opts.Name,
+			Lang:     c.opts.Lang,
+			Version:  c.opts.Version,
+			Metadata: c.opts.Metadata,
 		},
 	}
 	c.mu.Unlock()
@@ -893,6 +1258,56 @@ func (s *Server) accountConnectEvent(c *client) {
 	s.sendInternalMsgLocked(subj, _EMPTY_, &m.Server, &m)
 }
 
+// userExpiringEvent sends an advisory into the client's account to let it
+// know that its user JWT is about to expire.
+func (s *Server) userExpiringEvent(c *client) {
+	s.mu.Lock()
+	if !s.eventsEnabled() || s.sys.sendq == nil {
+		s.mu.Unlock()
+		return
+	}
+	sendq := s.sys.sendq
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	acc := c.acc
+	if acc == nil || c.isClosed() {
+		c.mu.Unlock()
+		return
+	}
+	m := &UserExpiringEventMsg{
+		Client: ClientInfo{
+			Start:    c.start,
+			Host:     c.host,
+			ID:       c.cid,
+			Account:  accForClient(c),
+			User:     nameForClient(c),
+			Name:     c.opts.Name,
+			Lang:     c.opts.Lang,
+			Version:  c.opts.Version,
+			Metadata: c.opts.Metadata,
+		},
+		Expires: c.expires,
+	}
+	c.mu.Unlock()
+
+	subj := fmt.Sprintf(userExpiringEventSubj, acc.Name, m.Client.User)
+	sendq <- &pubMsg{acc, subj, _EMPTY_, &m.Server, m, false}
+}
+
+// accountCrossingEvent will log and/or send an advisory for a message crossing
+// accounts, depending on the account audit options.
+func (s *Server) accountCrossingEvent(aa *AccountAuditOpts, m *AccountCrossingEventMsg) {
+	if aa.Log {
+		s.Noticef("Account audit: %s message on %q from account %q to account %q as %q",
+			m.Type, m.Subject, m.FromAccount, m.ToAccount, m.MappedSubject)
+	}
+	if aa.Advisory {
+		subj := fmt.Sprintf(accCrossingEventSubj, m.FromAccount)
+		s.sendInternalMsgLocked(subj, _EMPTY_, &m.Server, m)
+	}
+}
+
 // accountDisconnectEvent will send an account client disconnect event if there is interest.
 // This is a billing event.
 func (s *Server) accountDisconnectEvent(c *client, now time.Time, reason string) {
@@ -914,16 +1329,17 @@ func (s *Server) accountDisconnectEvent(c *client, now time.Time, reason string)
 
 	m := DisconnectEventMsg{
 		Client: ClientInfo{
-			Start:   c.start,
-			Stop:    &now,
-			Host:    c.host,
-			ID:      c.cid,
-			Account: accForClient(c),
-			User:    nameForClient(c),
-			Name:    c.opts.Name,
-			Lang:    c.opts.Lang,
-			Version: c.opts.Version,
-			RTT:     c.getRTT(),
+			Start:    c.start,
+			Stop:     &now,
+			Host:     c.host,
+			ID:       c.cid,
+			Account:  accForClient(c),
+			User:     nameForClient(c),
+			Name:     c.opts.Name,
+			Lang:     c.opts.Lang,
+			Version:  c.opts.Version,
+			Metadata: c.opts.Metadata,
+			RTT:      c.getRTT(),
 		},
 		Sent: DataStats{
 			Msgs:  atomic.LoadInt64(&c.inMsgs),
@@ -952,16 +1368,17 @@ func (s *Server) sendAuthErrorEvent(c *client) {
 	c.mu.Lock()
 	m := DisconnectEventMsg{
 		Client: ClientInfo{
-			Start:   c.start,
-			Stop:    &now,
-			Host:    c.host,
-			ID:      c.cid,
-			Account: accForClient(c),
-			User:    nameForClient(c),
-			Name:    c.opts.Name,
-			Lang:    c.opts.Lang,
-			Version: c.opts.Version,
-			RTT:     c.getRTT(),
+			Start:    c.start,
+			Stop:     &now,
+			Host:     c.host,
+			ID:       c.cid,
+			Account:  accForClient(c),
+			User:     nameForClient(c),
+			Name:     c.opts.Name,
+			Lang:     c.opts.Lang,
+			Version:  c.opts.Version,
+			Metadata: c.opts.Metadata,
+			RTT:      c.getRTT(),
 		},
 		Sent: DataStats{
 			Msgs:  c.inMsgs,
@@ -1208,13 +1625,14 @@ func (s *Server) debugSubscribers(sub *subscription, c *client, subject, reply s
 
 	if subjectIsLiteral(tsubj) {
 		// We will look up subscribers locally first then determine if we need to solicit other servers.
-		rr := c.acc.sl.Match(tsubj)
+		rr := c.acc.withFirehose(tsubj, c.acc.sl.Match(tsubj))
 		nsubs = totalSubs(rr, qgroup)
 	} else {
 		// We have a wildcard, so this is a bit slower path.
 		var _subs [32]*subscription
 		subs := _subs[:0]
 		c.acc.sl.All(&subs)
+		subs = append(subs, c.acc.firehoseSubs()...)
 		for _, sub := range subs {
 			if subjectIsSubsetMatch(string(sub.subject), tsubj) {
 				if qgroup != nil && !bytes.Equal(qgroup, sub.queue) {
@@ -1299,13 +1717,14 @@ func (s *Server) nsubsRequest(sub *subscription, _ *client, subject, reply strin
 	// We will look up subscribers locally first then determine if we need to solicit other servers.
 	var nsubs int32
 	if subjectIsLiteral(m.Subject) {
-		rr := acc.sl.Match(m.Subject)
+		rr := acc.withFirehose(m.Subject, acc.sl.Match(m.Subject))
 		nsubs = totalSubs(rr, m.Queue)
 	} else {
 		// We have a wildcard, so this is a bit slower path.
 		var _subs [32]*subscription
 		subs := _subs[:0]
 		acc.sl.All(&subs)
+		subs = append(subs, acc.firehoseSubs()...)
 		for _, sub := range subs {
 			if (sub.client.kind == CLIENT || sub.client.isUnsolicitedLeafNode()) && subjectIsSubsetMatch(string(sub.subject), m.Subject) {
 				if m.Queue != nil && !bytes.Equal(m.Queue, sub.queue) {
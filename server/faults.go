@@ -0,0 +1,51 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "net"
+
+// netFaults injects network faults in the connections of the servers, for
+// tests of failure handling. It is only set in builds with the "faults"
+// tag, see faults_enabled.go, and nil otherwise.
+var netFaults interface {
+	// wrapConn returns the connection of the given kind, possibly wrapped
+	// to delay or split its writes.
+	wrapConn(s *Server, kind int, conn net.Conn) net.Conn
+	// routeBlocked returns true if the server is partitioned away from
+	// the server with the given ID.
+	routeBlocked(s *Server, id string) bool
+}
+
+// faultConn returns the connection, wrapped if faults are injected.
+func (s *Server) faultConn(kind int, conn net.Conn) net.Conn {
+	if netFaults == nil {
+		return conn
+	}
+	return netFaults.wrapConn(s, kind, conn)
+}
+
+// unwrapFaultConn returns the connection that faults are injected in, or
+// the given one if none.
+func unwrapFaultConn(nc net.Conn) net.Conn {
+	if fc, ok := nc.(interface{ netConn() net.Conn }); ok {
+		return fc.netConn()
+	}
+	return nc
+}
+
+// routeBlocked returns true if routes to the server with the given ID
+// are refused because of an injected partition.
+func (s *Server) routeBlocked(id string) bool {
+	return netFaults != nil && netFaults.routeBlocked(s, id)
+}
@@ -0,0 +1,189 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build faults
+
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// The fault injection API, only available in builds with the "faults"
+// tag, e.g.:
+//
+//	go test -tags faults ./...
+//
+// Faults apply to the connections created after they are set, while route
+// partitions also close the existing routes.
+
+// NetFaults are the faults injected in the connections of a server.
+type NetFaults struct {
+	// Kinds of the connections affected, CLIENT, ROUTER, GATEWAY or LEAF,
+	// all if empty.
+	Kinds []int
+	// Latency added before each write.
+	Latency time.Duration
+	// MaxWrite, if positive, splits writes in writes of at most this many
+	// bytes, so that peers receive partial protocols.
+	MaxWrite int
+}
+
+type serverFaults struct {
+	faults      *NetFaults
+	partitioned map[string]struct{}
+}
+
+type faultRegistry struct {
+	mu      sync.RWMutex
+	servers map[*Server]*serverFaults
+}
+
+func init() {
+	netFaults = &faultRegistry{servers: make(map[*Server]*serverFaults)}
+}
+
+func registry() *faultRegistry {
+	return netFaults.(*faultRegistry)
+}
+
+// SetNetFaults sets the faults injected in the connections of the server
+// created from now on. Nil removes them.
+func (s *Server) SetNetFaults(f *NetFaults) {
+	r := registry()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sf := r.servers[s]
+	if sf == nil {
+		sf = &serverFaults{partitioned: make(map[string]struct{})}
+		r.servers[s] = sf
+	}
+	sf.faults = f
+	if f == nil && len(sf.partitioned) == 0 {
+		delete(r.servers, s)
+	}
+}
+
+// PartitionRoutes partitions the server away from the servers with the
+// given IDs: their routes are closed and refused until healed.
+func (s *Server) PartitionRoutes(ids ...string) {
+	r := registry()
+	r.mu.Lock()
+	sf := r.servers[s]
+	if sf == nil {
+		sf = &serverFaults{partitioned: make(map[string]struct{})}
+		r.servers[s] = sf
+	}
+	for _, id := range ids {
+		sf.partitioned[id] = struct{}{}
+	}
+	r.mu.Unlock()
+
+	var routes []*client
+	s.mu.Lock()
+	for _, id := range ids {
+		if c := s.remotes[id]; c != nil {
+			routes = append(routes, c)
+		}
+	}
+	s.mu.Unlock()
+	for _, c := range routes {
+		c.closeConnection(RouteRemoved)
+	}
+}
+
+// HealRoutes removes the route partitions of the server, which reconnects
+// to the servers of its explicit routes.
+func (s *Server) HealRoutes() {
+	r := registry()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sf := r.servers[s]; sf != nil {
+		sf.partitioned = make(map[string]struct{})
+		if sf.faults == nil {
+			delete(r.servers, s)
+		}
+	}
+}
+
+func (r *faultRegistry) wrapConn(s *Server, kind int, conn net.Conn) net.Conn {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sf := r.servers[s]
+	if sf == nil || sf.faults == nil {
+		return conn
+	}
+	f := sf.faults
+	if len(f.Kinds) > 0 {
+		found := false
+		for _, k := range f.Kinds {
+			if k == kind {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return conn
+		}
+	}
+	return &faultyConn{Conn: conn, latency: f.Latency, maxWrite: f.MaxWrite}
+}
+
+func (r *faultRegistry) routeBlocked(s *Server, id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if sf := r.servers[s]; sf != nil {
+		_, ok := sf.partitioned[id]
+		return ok
+	}
+	return false
+}
+
+// faultyConn delays and splits the writes of a connection.
+type faultyConn struct {
+	net.Conn
+	latency  time.Duration
+	maxWrite int
+}
+
+func (fc *faultyConn) netConn() net.Conn {
+	return fc.Conn
+}
+
+func (fc *faultyConn) Write(b []byte) (int, error) {
+	if fc.maxWrite <= 0 {
+		if fc.latency > 0 {
+			time.Sleep(fc.latency)
+		}
+		return fc.Conn.Write(b)
+	}
+	var written int
+	for len(b) > 0 {
+		if fc.latency > 0 {
+			time.Sleep(fc.latency)
+		}
+		chunk := b
+		if len(chunk) > fc.maxWrite {
+			chunk = chunk[:fc.maxWrite]
+		}
+		n, err := fc.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
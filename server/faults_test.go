@@ -0,0 +1,58 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build faults
+
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestNetFaults(t *testing.T) {
+	o1 := DefaultOptions()
+	o1.Cluster.Host = "127.0.0.1"
+	o1.Cluster.Port = -1
+	s1 := RunServer(o1)
+	defer s1.Shutdown()
+
+	o2 := nextServerOpts(o1)
+	o2.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", s1.ClusterAddr().Port))
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+	checkClusterFormed(t, s1, s2)
+
+	// Protocols split in writes of a few bytes are reassembled by clients.
+	s1.SetNetFaults(&NetFaults{Kinds: []int{CLIENT}, MaxWrite: 3, Latency: time.Millisecond})
+	nc := natsConnect(t, s1.ClientURL())
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "foo")
+	natsPub(t, nc, "foo", []byte("hello world"))
+	if msg := natsNexMsg(t, sub, 2*time.Second); string(msg.Data) != "hello world" {
+		t.Fatalf("Unexpected message: %q", msg.Data)
+	}
+	s1.SetNetFaults(nil)
+
+	// Partitioned servers stay apart until healed.
+	s1.PartitionRoutes(s2.ID())
+	checkNumRoutes(t, s1, 0)
+	checkNumRoutes(t, s2, 0)
+	time.Sleep(2 * DEFAULT_ROUTE_RECONNECT)
+	if n := s1.NumRoutes(); n != 0 {
+		t.Fatalf("Expected no route while partitioned, got %d", n)
+	}
+	s1.HealRoutes()
+	checkClusterFormed(t, s1, s2)
+}
@@ -0,0 +1,149 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "strings"
+
+// Feature is an optional protocol feature. The server sends the features
+// it offers as a bitmask in the INFO protocol, clients send the ones they
+// support in the CONNECT protocol, and a connection uses the features in
+// both.
+type Feature uint64
+
+const (
+	// FeatureAsyncInfo is the support of INFO protocols after the first one.
+	FeatureAsyncInfo Feature = 1 << iota
+	// FeatureLameDuckMode is the support of INFO protocols in lame duck
+	// mode, asking the client to reconnect to another server.
+	FeatureLameDuckMode
+	// FeatureCompression is the compression of the connection.
+	FeatureCompression
+	// FeatureReplay is the delivery of recent messages to new
+	// subscriptions.
+	FeatureReplay
+	// FeatureDurable is the tracking of a client identity across
+	// reconnects.
+	FeatureDurable
+	// FeatureSubNoEcho is the suppression of the connection own messages
+	// for the subscriptions with the no_echo option, see subNoEchoArg.
+	FeatureSubNoEcho
+	// FeatureQueueCredits is the credit based delivery to the queue
+	// subscriptions with the credits option, see subCreditsArg.
+	FeatureQueueCredits
+	// FeatureCloseReasons is the machine readable reason sent with the
+	// -ERR preceding the close of the connection by the server, see
+	// CloseReason.
+	FeatureCloseReasons
+)
+
+// featureDef registers a protocol feature. New features only need to be
+// added to featureRegistry and checked with client.hasFeature.
+type featureDef struct {
+	feature Feature
+	name    string
+	// offered returns true if the server offers the feature with these
+	// options, it is always offered if nil.
+	offered func(o *Options) bool
+	// implied returns true if a client uses the feature based on the
+	// CONNECT fields that predate feature negotiation, so that clients
+	// not sending features keep working as before.
+	implied func(co *clientOpts) bool
+}
+
+var featureRegistry = []featureDef{
+	{
+		feature: FeatureAsyncInfo,
+		name:    "async_info",
+		implied: func(co *clientOpts) bool { return co.Protocol >= ClientProtoInfo },
+	},
+	{
+		feature: FeatureLameDuckMode,
+		name:    "ldm",
+		implied: func(co *clientOpts) bool { return co.Protocol >= ClientProtoInfo },
+	},
+	{
+		feature: FeatureCompression,
+		name:    "compression",
+		offered: func(o *Options) bool { return o.Compression != _EMPTY_ },
+		implied: func(co *clientOpts) bool { return co.Compression != _EMPTY_ },
+	},
+	{
+		feature: FeatureReplay,
+		name:    "replay",
+		implied: func(co *clientOpts) bool { return co.Replay },
+	},
+	{
+		feature: FeatureDurable,
+		name:    "durable",
+		implied: func(co *clientOpts) bool { return co.DurableID != _EMPTY_ },
+	},
+	{
+		feature: FeatureSubNoEcho,
+		name:    "sub_no_echo",
+	},
+	{
+		feature: FeatureQueueCredits,
+		name:    "queue_credits",
+	},
+	{
+		feature: FeatureCloseReasons,
+		name:    "close_reasons",
+	},
+}
+
+// String returns the names of the features, separated by commas.
+func (f Feature) String() string {
+	return strings.Join(f.names(), ",")
+}
+
+func (f Feature) names() []string {
+	var names []string
+	for _, fd := range featureRegistry {
+		if f&fd.feature != 0 {
+			names = append(names, fd.name)
+		}
+	}
+	return names
+}
+
+// serverFeatures returns the features offered by a server with these
+// options.
+func serverFeatures(o *Options) Feature {
+	var f Feature
+	for _, fd := range featureRegistry {
+		if fd.offered == nil || fd.offered(o) {
+			f |= fd.feature
+		}
+	}
+	return f
+}
+
+// negotiateFeatures returns the features offered by the server that the
+// client sent in CONNECT, or that are implied by its other CONNECT fields.
+func negotiateFeatures(offered Feature, co *clientOpts) Feature {
+	f := co.Features
+	for _, fd := range featureRegistry {
+		if fd.implied != nil && fd.implied(co) {
+			f |= fd.feature
+		}
+	}
+	return f & offered
+}
+
+// hasFeature returns true if the feature was negotiated for this
+// connection.
+// Lock should be held.
+func (c *client) hasFeature(f Feature) bool {
+	return c.feats&f != 0
+}
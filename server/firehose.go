@@ -0,0 +1,113 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+)
+
+// Subscriptions of clients to very broad wildcards, like ">", match about
+// every message and end up in every cached result of the account sublist.
+// Those that cover one of the firehose subjects of the options are kept
+// out of the sublist, in a separate list of the account that is matched
+// for each message.
+
+// validateFirehoseSubjects checks that the firehose subjects are valid
+// wildcard subjects.
+func validateFirehoseSubjects(o *Options) error {
+	for _, subj := range o.FirehoseSubjects {
+		if !IsValidSubject(subj) || !subjectHasWildcard(subj) {
+			return fmt.Errorf("invalid firehose subject %q, expected a wildcard subject", subj)
+		}
+	}
+	return nil
+}
+
+// isFirehose returns true if a plain subscription of a client to this
+// subject is to be kept out of the account sublist, that is if it matches
+// at least everything one of the firehose subjects matches.
+func isFirehose(opts *Options, subject string) bool {
+	if opts == nil || len(opts.FirehoseSubjects) == 0 || !subjectHasWildcard(subject) {
+		return false
+	}
+	for _, fs := range opts.FirehoseSubjects {
+		if subjectIsSubsetMatch(fs, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// firehoseSubs returns the firehose subscriptions of the account. The
+// slice is replaced, never modified.
+func (a *Account) firehoseSubs() []*subscription {
+	subs, _ := a.firehose.Load().([]*subscription)
+	return subs
+}
+
+// addFirehoseSub adds a firehose subscription to the account.
+func (a *Account) addFirehoseSub(sub *subscription) {
+	a.mu.Lock()
+	old := a.firehoseSubs()
+	subs := make([]*subscription, 0, len(old)+1)
+	subs = append(subs, old...)
+	a.firehose.Store(append(subs, sub))
+	a.mu.Unlock()
+}
+
+// removeFirehoseSubs removes firehose subscriptions from the account.
+func (a *Account) removeFirehoseSubs(rsubs ...*subscription) {
+	a.mu.Lock()
+	old := a.firehoseSubs()
+	subs := make([]*subscription, 0, len(old))
+	for _, sub := range old {
+		removed := false
+		for _, rsub := range rsubs {
+			if sub == rsub {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			subs = append(subs, sub)
+		}
+	}
+	a.firehose.Store(subs)
+	a.mu.Unlock()
+}
+
+// withFirehose returns the result of the sublist match for the subject
+// with the matching firehose subscriptions of the account added. The
+// result of the sublist is returned as is when there are none, otherwise
+// a new result is created since the one of the sublist may be cached.
+func (a *Account) withFirehose(subject string, r *SublistResult) *SublistResult {
+	fsubs := a.firehoseSubs()
+	if len(fsubs) == 0 {
+		return r
+	}
+	var psubs []*subscription
+	for _, sub := range fsubs {
+		if matchLiteral(subject, string(sub.subject)) {
+			if psubs == nil {
+				psubs = make([]*subscription, 0, len(r.psubs)+len(fsubs))
+				psubs = append(psubs, r.psubs...)
+			}
+			psubs = append(psubs, sub)
+		}
+	}
+	if psubs == nil {
+		return r
+	}
+	return &SublistResult{psubs: psubs, qsubs: r.qsubs}
+}
@@ -0,0 +1,61 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+)
+
+var (
+	fuzzServerOnce sync.Once
+	fuzzServer     *Server
+)
+
+// fuzzParse feeds data to the protocol parser of a new connection of the
+// given kind, as the fuzz targets and their corpus test do. Following the
+// go-fuzz convention, it returns 1 if the data parsed, 0 otherwise.
+func fuzzParse(kind int, data []byte) int {
+	fuzzServerOnce.Do(func() {
+		fuzzServer = New(&Options{Host: "127.0.0.1", NoLog: true, NoSigs: true})
+	})
+	s := fuzzServer
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go io.Copy(ioutil.Discard, cli)
+
+	c := &client{srv: s, nc: srv, kind: kind, msubs: -1, mpay: -1, mcl: MAX_CONTROL_LINE_SIZE}
+	switch kind {
+	case ROUTER:
+		c.route = &route{}
+	case LEAF:
+		c.leaf = &leaf{smap: map[string]int32{}}
+	}
+	c.mu.Lock()
+	c.initClient()
+	if kind == ROUTER {
+		c.in.pacache = make(map[string]*perAccountCache)
+	}
+	c.mu.Unlock()
+	c.registerWithAccount(s.globalAccount())
+
+	err := c.parse(data)
+	c.closeConnection(ClientClosed)
+	if err != nil {
+		return 0
+	}
+	return 1
+}
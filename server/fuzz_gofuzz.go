@@ -0,0 +1,38 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build gofuzz
+
+package server
+
+// The fuzz targets of the protocol parser, for go-fuzz, e.g.:
+//
+//	go-fuzz-build -func FuzzClientParser github.com/nats-io/nats-server/v2/server
+//	go-fuzz -bin server-fuzz.zip -workdir testdata/fuzz/client
+//
+// The corpus seeds are in testdata/fuzz/<kind>/corpus.
+
+// FuzzClientParser parses data received from a client connection.
+func FuzzClientParser(data []byte) int {
+	return fuzzParse(CLIENT, data)
+}
+
+// FuzzRouteParser parses data received from a route connection.
+func FuzzRouteParser(data []byte) int {
+	return fuzzParse(ROUTER, data)
+}
+
+// FuzzLeafParser parses data received from a leafnode connection.
+func FuzzLeafParser(data []byte) int {
+	return fuzzParse(LEAF, data)
+}
@@ -153,6 +153,9 @@ type srvGateway struct {
 	// This is to track recent subscriptions for a given connection
 	rsubs sync.Map
 
+	// Per account egress caps, nil if none.
+	egress *gatewayEgress
+
 	resolver  netResolver   // Used to resolve host name before calling net.Dial()
 	sqbsz     int           // Max buffer size to send queue subs protocol. Used for testing.
 	recSubExp time.Duration // For how long do we check if there is a subscription match for a message with reply
@@ -191,6 +194,10 @@ type gateway struct {
 	connected bool
 	// Set to true if outbound is to a server that only knows about $GR, not $GNR
 	useOldPrefix bool
+	// Set if outbound is to a server that accepts messages tagged with their origin.
+	lnoc bool
+	// Estimated clock skew with the remote, outbound only.
+	skew clockSkew
 }
 
 // Outbound subject interest entry.
@@ -237,8 +244,13 @@ func (r *RemoteGatewayOpts) clone() *RemoteGatewayOpts {
 		return nil
 	}
 	clone := &RemoteGatewayOpts{
-		Name: r.Name,
-		URLs: deepCopyURLs(r.URLs),
+		Name:          r.Name,
+		URLs:          deepCopyURLs(r.URLs),
+		TLSIdentities: copyStrings(r.TLSIdentities),
+	}
+	if r.Proxy != nil {
+		proxy := *r.Proxy
+		clone.Proxy = &proxy
 	}
 	if r.TLSConfig != nil {
 		clone.TLSConfig = r.TLSConfig.Clone()
@@ -265,6 +277,9 @@ func validateGatewayOptions(o *Options) error {
 		if len(g.URLs) == 0 {
 			return fmt.Errorf("gateway %q has no URL", g.Name)
 		}
+		if len(g.TLSIdentities) > 0 && o.Gateway.TLSConfig == nil {
+			return fmt.Errorf("gateway %q has TLS identities but TLS is not configured", g.Name)
+		}
 	}
 	return nil
 }
@@ -325,6 +340,10 @@ func (s *Server) newGateway(opts *Options) error {
 
 	gateway.pasi.m = make(map[string]map[string]*sitally)
 
+	if eo := opts.Gateway.AccountEgress; eo != nil {
+		gateway.egress = newGatewayEgress(eo)
+	}
+
 	if gateway.resolver == nil {
 		gateway.resolver = netResolver(net.DefaultResolver)
 	}
@@ -429,6 +448,7 @@ func (s *Server) startGateways() {
 // a loop (until the server is shutdown) accepting incoming
 // gateway connections.
 func (s *Server) gatewayAcceptLoop(ch chan struct{}) {
+	defer s.acceptLoopStarted()()
 	defer func() {
 		if ch != nil {
 			close(ch)
@@ -444,13 +464,13 @@ func (s *Server) gatewayAcceptLoop(ch chan struct{}) {
 	}
 
 	hp := net.JoinHostPort(opts.Gateway.Host, strconv.Itoa(port))
-	l, e := net.Listen("tcp", hp)
+	l, e := s.listenOrInherit(GatewayListener, hp)
 	if e != nil {
 		s.Fatalf("Error listening on gateway port: %d - %v", opts.Gateway.Port, e)
 		return
 	}
-	s.Noticef("Gateway name is %s", s.getGatewayName())
-	s.Noticef("Listening for gateways connections on %s",
+	s.bannerf("Gateway name is %s", s.getGatewayName())
+	s.bannerf("Listening for gateways connections on %s",
 		net.JoinHostPort(opts.Gateway.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
 
 	s.mu.Lock()
@@ -465,6 +485,8 @@ func (s *Server) gatewayAcceptLoop(ch chan struct{}) {
 		MaxPayload:   s.info.MaxPayload,
 		Gateway:      opts.Gateway.Name,
 		GatewayNRP:   true,
+		LNOC:         true,
+		PingTS:       true,
 	}
 	// If we have selected a random port...
 	if port == 0 {
@@ -502,10 +524,15 @@ func (s *Server) gatewayAcceptLoop(ch chan struct{}) {
 	close(ch)
 	ch = nil
 
+	s.checkListenersReady()
+
 	tmpDelay := ACCEPT_MIN_SLEEP
 
+	defer s.acceptLoops.gateway.done()
 	for s.isRunning() {
+		s.acceptLoops.gateway.done()
 		conn, err := l.Accept()
+		s.acceptLoops.gateway.start()
 		if err != nil {
 			tmpDelay = s.acceptError("Gateway", err, tmpDelay)
 			continue
@@ -641,6 +668,9 @@ func (s *Server) solicitGateway(cfg *gatewayCfg, firstConnect bool) {
 	const connFmt = "Connecting to %s gateway %q (%s) at %s (attempt %v)"
 	const connErrFmt = "Error connecting to %s gateway %q (%s) at %s (attempt %v): %v"
 
+	defer s.connectRetryDone("gateway", cfg.Name)
+
+	var lastErr error
 	for s.isRunning() {
 		urls := cfg.getURLs()
 		if len(urls) == 0 {
@@ -650,22 +680,40 @@ func (s *Server) solicitGateway(cfg *gatewayCfg, firstConnect bool) {
 		report := s.shouldReportConnectErr(firstConnect, attempts)
 		// Iteration is random
 		for _, u := range urls {
-			address, err := s.getRandomIP(s.gateway.resolver, u.Host)
-			if err != nil {
-				s.Errorf("Error getting IP for %s gateway %q (%s): %v", typeStr, cfg.Name, u.Host, err)
-				continue
+			var (
+				addrs   []string
+				address string
+				conn    net.Conn
+				err     error
+			)
+			if cfg.Proxy != nil {
+				// The host is resolved by the proxy.
+				address = "proxy " + cfg.Proxy.Host
+			} else {
+				addrs, err = s.resolveOutbound(s.gateway.resolver, u.Host)
+				if err != nil {
+					lastErr = err
+					s.Errorf("Error getting IP for %s gateway %q (%s): %v", typeStr, cfg.Name, u.Host, err)
+					continue
+				}
+				address = addrs[0]
 			}
 			if report {
 				s.Noticef(connFmt, typeStr, cfg.Name, u.Host, address, attempts)
 			} else {
 				s.Debugf(connFmt, typeStr, cfg.Name, u.Host, address, attempts)
 			}
-			conn, err := net.DialTimeout("tcp", address, DEFAULT_ROUTE_DIAL)
+			if cfg.Proxy != nil {
+				conn, err = s.dialProxy("gateway", cfg.Proxy, u.Host, DEFAULT_ROUTE_DIAL)
+			} else {
+				conn, err = s.dialOutbound("gateway", addrs, DEFAULT_ROUTE_DIAL)
+			}
 			if err == nil {
 				// We could connect, create the gateway connection and return.
 				s.createGateway(cfg, u, conn)
 				return
 			}
+			lastErr = err
 			if report {
 				s.Errorf(connErrFmt, typeStr, cfg.Name, u.Host, address, attempts, err)
 			} else {
@@ -684,10 +732,16 @@ func (s *Server) solicitGateway(cfg *gatewayCfg, firstConnect bool) {
 				return
 			}
 		}
+		if opts.Gateway.Retry.exhausted(attempts) {
+			s.Errorf("Giving up connecting to %s gateway %q after %d attempts", typeStr, cfg.Name, attempts)
+			return
+		}
+		delay := opts.Gateway.Retry.delay(gatewayConnectDelay, attempts)
+		s.connectRetry("gateway", cfg.Name, attempts, lastErr, delay)
 		select {
 		case <-s.quitCh:
 			return
-		case <-time.After(gatewayConnectDelay):
+		case <-time.After(delay):
 			continue
 		}
 	}
@@ -699,6 +753,9 @@ func (s *Server) solicitGateway(cfg *gatewayCfg, firstConnect bool) {
 func (s *Server) createGateway(cfg *gatewayCfg, url *url.URL, conn net.Conn) {
 	// Snapshot server options.
 	opts := s.getOpts()
+	// Tune the socket, whether accepted or dialed.
+	s.applySocketOpts(conn, opts.Gateway.Socket)
+	conn = s.faultConn(GATEWAY, conn)
 
 	now := time.Now()
 	c := &client{srv: s, nc: conn, start: now, last: now, kind: GATEWAY}
@@ -805,6 +862,7 @@ func (s *Server) createGateway(cfg *gatewayCfg, url *url.URL, conn net.Conn) {
 
 		// To be consistent with client, set this flag to indicate that handshake is done
 		c.flags.set(handshakeComplete)
+		c.trackPeerCert()
 
 		// Verify that the connection did not go away while we released the lock.
 		if c.isClosed() {
@@ -906,12 +964,30 @@ func (c *client) processGatewayConnect(arg []byte) error {
 
 	// If we reject unknown gateways, make sure we have it configured,
 	// otherwise return an error.
-	if s.gateway.rejectUnknown() && s.getRemoteGateway(connect.Gateway) == nil {
+	cfg := s.getRemoteGateway(connect.Gateway)
+	if s.gateway.rejectUnknown() && cfg == nil {
 		c.Errorf("Rejecting connection from gateway %q", connect.Gateway)
 		c.sendErr(fmt.Sprintf("Connection to gateway %q rejected", s.getGatewayName()))
 		c.closeConnection(WrongGateway)
 		return ErrWrongGateway
 	}
+	// If identities are configured for this gateway, the TLS certificate
+	// presented by the remote must match one of them.
+	if ids := cfg.getTLSIdentities(); len(ids) > 0 {
+		if !checkClientTLSCertSubject(c, func(id string) bool {
+			for _, tid := range ids {
+				if id == tid {
+					return true
+				}
+			}
+			return false
+		}) {
+			c.Errorf("Rejecting connection from gateway %q, TLS identity not allowed", connect.Gateway)
+			c.sendErr(fmt.Sprintf("Connection to gateway %q rejected", s.getGatewayName()))
+			c.closeConnection(WrongGateway)
+			return ErrWrongGateway
+		}
+	}
 
 	// For a gateway connection, c.gw is guaranteed not to be nil here
 	// (created in createGateway() and never set to nil).
@@ -1018,6 +1094,8 @@ func (c *client) processGatewayInfo(info *Info) {
 			c.enqueueProto(c.gw.infoJSON)
 			c.gw.infoJSON = nil
 			c.gw.useOldPrefix = !info.GatewayNRP
+			c.gw.lnoc = info.LNOC
+			c.gw.skew.enabled = info.PingTS
 			c.mu.Unlock()
 
 			// Register as an outbound gateway.. if we had a protocol to ack our connect,
@@ -1359,6 +1437,18 @@ func (s *Server) getRemoteGateway(name string) *gatewayCfg {
 	return cfg
 }
 
+// Returns the TLS identities allowed for inbound connections
+// from this gateway, if any.
+func (g *gatewayCfg) getTLSIdentities() []string {
+	if g == nil {
+		return nil
+	}
+	g.RLock()
+	ids := g.TLSIdentities
+	g.RUnlock()
+	return ids
+}
+
 // Used in tests
 func (g *gatewayCfg) bumpConnAttempts() {
 	g.Lock()
@@ -2323,6 +2413,7 @@ func (c *client) sendMsgToGateways(acc *Account, msg, subject, reply []byte, qgr
 	}
 	thisClusterReplyPrefix := gw.replyPfx
 	thisClusterOldReplyPrefix := gw.oldReplyPfx
+	egress := gw.egress
 	gw.RUnlock()
 	if len(gws) == 0 {
 		return
@@ -2336,6 +2427,8 @@ func (c *client) sendMsgToGateways(acc *Account, msg, subject, reply []byte, qgr
 		mreply     []byte
 		dstHash    []byte
 		checkReply = len(reply) > 0
+		sent       int64
+		origin     = c.msgOrigin()
 	)
 
 	// Get a subscription from the pool
@@ -2420,7 +2513,15 @@ func (c *client) sendMsgToGateways(acc *Account, msg, subject, reply []byte, qgr
 				mreply = append(mreply, reply...)
 			}
 		}
-		mh := c.msgb[:msgHeadProtoLen]
+		mh := c.msgScratch(c.msgb[:msgHeadProtoLen], len(origin)+len(accName)+len(subject)+len(mreply)+len(queues)+len(c.pa.szb)+7)
+		// Messages from a leaf node are LMSG with their origin, if supported.
+		if origin != _EMPTY_ && gwc.supportsOrigin() {
+			mh[0] = 'L'
+			mh = append(mh, origin...)
+			mh = append(mh, ' ')
+		} else {
+			mh[0] = 'R'
+		}
 		mh = append(mh, accName...)
 		mh = append(mh, ' ')
 		mh = append(mh, subject...)
@@ -2446,11 +2547,17 @@ func (c *client) sendMsgToGateways(acc *Account, msg, subject, reply []byte, qgr
 		sub.nm, sub.max = 0, 0
 		sub.client = gwc
 		sub.subject = subject
-		c.deliverMsg(sub, subject, mh, msg, false)
+		if c.deliverMsg(sub, subject, mh, msg, false) {
+			sent += int64(len(mh) + len(msg))
+		}
 	}
 	// Done with subscription, put back to pool. We don't need
 	// to reset content since we explicitly set when using it.
 	subPool.Put(sub)
+
+	if egress != nil && sent > 0 {
+		c.checkGatewayEgress(egress, acc, sent)
+	}
 }
 
 // Possibly sends an A- to the remote gateway `c`.
@@ -2510,7 +2617,7 @@ func (s *Server) gatewayHandleSubjectNoInterest(c *client, acc *Account, accName
 	// If there is no subscription for this account, we would normally
 	// send an A-, however, if this account has the internal subscription
 	// for service reply, send a specific RS- for the subject instead.
-	hasSubs := acc.sl.Count() > 0
+	hasSubs := acc.sl.Count() > 0 || len(acc.firehoseSubs()) > 0
 	if !hasSubs {
 		acc.mu.RLock()
 		hasSubs = acc.siReply != nil
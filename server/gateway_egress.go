@@ -0,0 +1,126 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Longest pause of a publisher whose account is over its gateway egress
+// cap, so that a single large message doesn't stall it for too long.
+const maxGatewayEgressDelay = time.Second
+
+// GatewayEgressOpts caps the rate, in bytes per second, at which the
+// messages of each account are sent to the remote gateways. When an
+// account goes over its cap, its publishers are paused until the account
+// is back under it, so that one account can't saturate the links shared
+// by all accounts.
+type GatewayEgressOpts struct {
+	// Cap of the accounts not listed in Accounts, no cap if 0.
+	Default int64 `json:"default,omitempty"`
+	// Per account caps. A cap of 0 exempts the account.
+	Accounts map[string]int64 `json:"accounts,omitempty"`
+}
+
+func (o *GatewayEgressOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Default < 0 {
+		return fmt.Errorf("gateway account_egress default can't be negative")
+	}
+	for acc, rate := range o.Accounts {
+		if rate < 0 {
+			return fmt.Errorf("gateway account_egress for account %q can't be negative", acc)
+		}
+	}
+	return nil
+}
+
+// rate returns the cap of the given account, 0 if not capped.
+func (o *GatewayEgressOpts) rate(account string) int64 {
+	if rate, ok := o.Accounts[account]; ok {
+		return rate
+	}
+	return o.Default
+}
+
+// gatewayEgress tracks the bytes sent to gateways by each capped account
+// with a token bucket that holds up to one second worth of bytes.
+type gatewayEgress struct {
+	sync.Mutex
+	opts    *GatewayEgressOpts
+	buckets map[string]*egressBucket
+}
+
+type egressBucket struct {
+	rate   int64
+	tokens int64
+	last   time.Time
+}
+
+func newGatewayEgress(opts *GatewayEgressOpts) *gatewayEgress {
+	return &gatewayEgress{opts: opts, buckets: make(map[string]*egressBucket)}
+}
+
+// take accounts for n bytes of the account sent to the gateways, and
+// returns for how long the publisher should be paused for the account to
+// be back under its cap.
+func (g *gatewayEgress) take(account string, n int64) time.Duration {
+	now := time.Now()
+	g.Lock()
+	defer g.Unlock()
+	b := g.buckets[account]
+	if b == nil {
+		b = &egressBucket{rate: g.opts.rate(account), last: now}
+		b.tokens = b.rate
+		g.buckets[account] = b
+	}
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens += int64(now.Sub(b.last)) * b.rate / int64(time.Second)
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	delay := time.Duration(-b.tokens * int64(time.Second) / b.rate)
+	if delay > maxGatewayEgressDelay {
+		delay = maxGatewayEgressDelay
+	}
+	return delay
+}
+
+// checkGatewayEgress accounts for the bytes of the account sent to the
+// gateways by this connection, and pauses it if the account is over its
+// cap. Only clients and leaf nodes are paused, routes and gateways carry
+// the messages of all accounts.
+func (c *client) checkGatewayEgress(ge *gatewayEgress, acc *Account, n int64) {
+	delay := ge.take(acc.Name, n)
+	if delay <= 0 || (c.kind != CLIENT && c.kind != LEAF) {
+		return
+	}
+	// Deliver what has been processed so far before pausing.
+	c.flushClients(0)
+	select {
+	case <-time.After(delay):
+	case <-c.srv.quitCh:
+	}
+}
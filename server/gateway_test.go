@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"os"
 	"runtime"
 	"strings"
 	"sync"
@@ -315,6 +316,27 @@ func testGatewayOptionsFromToWithTLS(t *testing.T, org, dst string, urls []strin
 	return o
 }
 
+func TestGatewayProxy(t *testing.T) {
+	o2 := testDefaultOptionsForGateway("B")
+	s2 := runGatewayServer(o2)
+	defer s2.Shutdown()
+
+	p, pu := runTestProxy(t, ProxySchemeHTTP, "user", "pwd")
+	defer p.l.Close()
+
+	o1 := testGatewayOptionsFromToWithServers(t, "A", "B", s2)
+	o1.Gateway.Gateways[0].Proxy = pu
+	s1 := runGatewayServer(o1)
+	defer s1.Shutdown()
+
+	waitForOutboundGateways(t, s1, 1, time.Second)
+	waitForInboundGateways(t, s2, 1, time.Second)
+	waitForOutboundGateways(t, s2, 1, time.Second)
+	if n := atomic.LoadInt32(&p.tunnel); n != 1 {
+		t.Fatalf("Expected connection through the proxy, got %v", n)
+	}
+}
+
 func TestGatewayBasic(t *testing.T) {
 	o2 := testDefaultOptionsForGateway("B")
 	o2.Gateway.ConnectRetries = 0
@@ -1283,6 +1305,33 @@ func TestGatewayRejectUnknown(t *testing.T) {
 	}
 }
 
+func TestGatewayRejectTLSIdentity(t *testing.T) {
+	o2 := testGatewayOptionsFromToWithURLs(t, "B", "A", []string{"nats://127.0.0.1:1234"})
+	o2.Gateway.RejectUnknown = true
+	s2 := runGatewayServer(o2)
+	defer s2.Shutdown()
+
+	// Require a TLS identity from A. Since A does not use TLS,
+	// its connection must be rejected.
+	cfg := s2.getRemoteGateway("A")
+	cfg.Lock()
+	cfg.TLSIdentities = []string{"CN=gw-a"}
+	cfg.Unlock()
+
+	o1 := testGatewayOptionsFromToWithServers(t, "A", "B", s2)
+	s1 := runGatewayServer(o1)
+	defer s1.Shutdown()
+
+	time.Sleep(100 * time.Millisecond)
+	waitForInboundGateways(t, s2, 0, time.Second)
+
+	// TLS identities require TLS.
+	o2.Gateway.Gateways[0].TLSIdentities = []string{"CN=gw-a"}
+	if err := validateGatewayOptions(o2); err == nil {
+		t.Fatal("Expected error for TLS identities without TLS")
+	}
+}
+
 func TestGatewayNoReconnectOnClose(t *testing.T) {
 	o2 := testDefaultOptionsForGateway("B")
 	s2 := runGatewayServer(o2)
@@ -2019,6 +2068,89 @@ func TestGatewayQueueSub(t *testing.T) {
 	check(t, &count3, total)
 }
 
+func TestGatewayQueueSubPrefersLocalCluster(t *testing.T) {
+	ob := testDefaultOptionsForGateway("B")
+	sb := runGatewayServer(ob)
+	defer sb.Shutdown()
+
+	oa1 := testGatewayOptionsFromToWithServers(t, "A", "B", sb)
+	sa1 := runGatewayServer(oa1)
+	defer sa1.Shutdown()
+
+	oa2 := testGatewayOptionsFromToWithServers(t, "A", "B", sb)
+	oa2.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", sa1.ClusterAddr().Port))
+	sa2 := runGatewayServer(oa2)
+	defer sa2.Shutdown()
+
+	checkClusterFormed(t, sa1, sa2)
+	waitForOutboundGateways(t, sa1, 1, time.Second)
+	waitForOutboundGateways(t, sa2, 1, time.Second)
+	waitForOutboundGateways(t, sb, 1, time.Second)
+
+	count := func(n *int32) nats.MsgHandler {
+		return func(_ *nats.Msg) { atomic.AddInt32(n, 1) }
+	}
+	var countA, countB int32
+
+	ncB := natsConnect(t, sb.ClientURL())
+	defer ncB.Close()
+	natsQueueSub(t, ncB, "foo", "bar", count(&countB))
+	natsFlush(t, ncB)
+
+	// The only member of the group in cluster A is on the server that
+	// does not receive the messages.
+	ncA2 := natsConnect(t, sa2.ClientURL())
+	defer ncA2.Close()
+	qsubA := natsQueueSub(t, ncA2, "foo", "bar", count(&countA))
+	natsFlush(t, ncA2)
+
+	checkForRegisteredQSubInterest(t, sa1, "B", globalAccountName, "foo", 1, time.Second)
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if r := sa1.globalAccount().sl.Match("foo"); len(r.qsubs) != 1 {
+			return fmt.Errorf("Expected queue interest from the route")
+		}
+		return nil
+	})
+
+	ncA1 := natsConnect(t, sa1.ClientURL())
+	defer ncA1.Close()
+	total := 100
+	send := func() {
+		t.Helper()
+		for i := 0; i < total; i++ {
+			natsPub(t, ncA1, "foo", []byte("msg"))
+		}
+		natsFlush(t, ncA1)
+	}
+	check := func(n *int32, expected int) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			if c := int(atomic.LoadInt32(n)); c != expected {
+				return fmt.Errorf("Expected to get %v messages, got %v", expected, c)
+			}
+			return nil
+		})
+	}
+
+	// All messages stay in cluster A.
+	send()
+	check(&countA, total)
+	check(&countB, 0)
+
+	// Once the local member is gone, messages go to cluster B.
+	natsUnsub(t, qsubA)
+	natsFlush(t, ncA2)
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if r := sa1.globalAccount().sl.Match("foo"); len(r.qsubs) != 0 {
+			return fmt.Errorf("Expected no local queue interest")
+		}
+		return nil
+	})
+	send()
+	check(&countA, total)
+	check(&countB, total)
+}
+
 func TestGatewayTotalQSubs(t *testing.T) {
 	ob1 := testDefaultOptionsForGateway("B")
 	sb1 := runGatewayServer(ob1)
@@ -5850,3 +5982,59 @@ func TestGatewayNoCrashOnInvalidSubject(t *testing.T) {
 		t.Fatalf("Error getting message: %v", err)
 	}
 }
+
+func TestGatewayAccountEgress(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		gateway {
+			name: "A"
+			listen: "127.0.0.1:-1"
+			account_egress {
+				default: 20KB
+				accounts { SYS: 0, BIG: 1MB }
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	eo := opts.Gateway.AccountEgress
+	if eo == nil || eo.Default != 20*1024 || eo.rate("SYS") != 0 || eo.rate("BIG") != 1024*1024 || eo.rate("OTHER") != 20*1024 {
+		t.Fatalf("Unexpected account egress: %+v", eo)
+	}
+
+	o2 := testDefaultOptionsForGateway("B")
+	s2 := runGatewayServer(o2)
+	defer s2.Shutdown()
+
+	o1 := testGatewayOptionsFromToWithServers(t, "A", "B", s2)
+	o1.Gateway.AccountEgress = &GatewayEgressOpts{Default: 20000}
+	s1 := runGatewayServer(o1)
+	defer s1.Shutdown()
+
+	waitForOutboundGateways(t, s1, 1, time.Second)
+	waitForOutboundGateways(t, s2, 1, time.Second)
+
+	nc2 := natsConnect(t, s2.ClientURL())
+	defer nc2.Close()
+	sub := natsSubSync(t, nc2, "foo")
+	natsFlush(t, nc2)
+
+	nc1 := natsConnect(t, s1.ClientURL())
+	defer nc1.Close()
+	msg := make([]byte, 1000)
+	start := time.Now()
+	// The bucket starts with one second worth of bytes, so sending two
+	// seconds worth of bytes takes about a second.
+	for i := 0; i < 40; i++ {
+		natsPub(t, nc1, "foo", msg)
+	}
+	natsFlush(t, nc1)
+	for i := 0; i < 40; i++ {
+		natsNexMsg(t, sub, 2*time.Second)
+	}
+	if elapsed := time.Since(start); elapsed < 800*time.Millisecond || elapsed > 3*time.Second {
+		t.Fatalf("Expected messages to be capped to about a second, took %v", elapsed)
+	}
+}
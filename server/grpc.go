@@ -0,0 +1,572 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// The gRPC gateway serves the following service, on its own port, to
+// clients that can not use the NATS protocol:
+//
+//	service Gateway {
+//	  rpc Publish(Msg) returns (Empty);
+//	  rpc Subscribe(SubscribeRequest) returns (stream Msg);
+//	  rpc Request(Msg) returns (Msg);
+//	}
+//	message Msg { string subject = 1; string reply = 2; bytes data = 3; }
+//	message SubscribeRequest { string subject = 1; string queue = 2; }
+//	message Empty {}
+//
+// in the "nats" package. Each call uses its own in-process client
+// connection, authenticated with the "authorization" metadata of the call:
+// "Bearer <token>" for a token, or "Basic <base64 of user:password>" for a
+// user, which binds the call to the account of that user. HTTP/2 is only
+// served over TLS, so a tls block is required.
+
+const (
+	// DEFAULT_GRPC_REQUEST_TIMEOUT is how long a Request call waits for the
+	// reply if the call has no deadline.
+	DEFAULT_GRPC_REQUEST_TIMEOUT = 5 * time.Second
+
+	grpcService = "/nats.Gateway/"
+)
+
+// gRPC status codes.
+const (
+	grpcOK               = 0
+	grpcInvalidArgument  = 3
+	grpcDeadlineExceeded = 4
+	grpcPermissionDenied = 7
+	grpcUnimplemented    = 12
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcUnauthenticated  = 16
+)
+
+// GRPCOpts are options for the gRPC gateway.
+type GRPCOpts struct {
+	Host      string      `json:"addr,omitempty"`
+	Port      int         `json:"port,omitempty"`
+	TLSConfig *tls.Config `json:"-"`
+}
+
+func (o *GRPCOpts) validate() error {
+	if o == nil || o.Port == 0 {
+		return nil
+	}
+	if o.TLSConfig == nil {
+		return fmt.Errorf("grpc requires a tls configuration")
+	}
+	return nil
+}
+
+// grpcStatus is the status a call ends with.
+type grpcStatus struct {
+	code int
+	msg  string
+}
+
+func (e *grpcStatus) Error() string {
+	return e.msg
+}
+
+// startGRPC starts the gRPC gateway.
+func (s *Server) startGRPC() error {
+	opts := s.getOpts()
+	port := opts.GRPC.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(opts.GRPC.Host, strconv.Itoa(port))
+	l, err := s.listen(hp)
+	if err != nil {
+		return fmt.Errorf("can't listen to the grpc port: %v", err)
+	}
+	s.bannerf("Listening for gRPC calls on %s",
+		net.JoinHostPort(opts.GRPC.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+
+	config := opts.GRPC.TLSConfig.Clone()
+	config.NextProtos = []string{"h2"}
+	srv := &http.Server{
+		Addr:           hp,
+		Handler:        http.HandlerFunc(s.handleGRPC),
+		MaxHeaderBytes: 1 << 20,
+	}
+	s.mu.Lock()
+	if port == 0 {
+		opts.GRPC.Port = l.Addr().(*net.TCPAddr).Port
+	}
+	s.grpcListener = l
+	s.mu.Unlock()
+
+	srv.TLSConfig = config
+	go func() {
+		if err := srv.ServeTLS(l, _EMPTY_, _EMPTY_); err != nil && s.isRunning() {
+			s.Fatalf("Error starting grpc on %q: %v", hp, err)
+		}
+		srv.Close()
+		s.done <- true
+	}()
+	return nil
+}
+
+// GRPCAddr returns the net.Addr object for the gRPC listener.
+func (s *Server) GRPCAddr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.grpcListener == nil {
+		return nil
+	}
+	return s.grpcListener.Addr().(*net.TCPAddr)
+}
+
+// handleGRPC serves the calls of the gRPC gateway.
+func (s *Server) handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 ||
+		!strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC calls only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+
+	var err error
+	switch strings.TrimPrefix(r.URL.Path, grpcService) {
+	case "Publish":
+		err = s.grpcPublish(w, r)
+	case "Subscribe":
+		err = s.grpcSubscribe(w, r)
+	case "Request":
+		err = s.grpcRequest(w, r)
+	default:
+		err = &grpcStatus{grpcUnimplemented, fmt.Sprintf("unknown method %s", r.URL.Path)}
+	}
+	code, msg := grpcOK, _EMPTY_
+	if err != nil {
+		code, msg = grpcInternal, err.Error()
+		if st, ok := err.(*grpcStatus); ok {
+			code = st.code
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if msg != _EMPTY_ {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+// grpcPublish publishes the message of the call.
+func (s *Server) grpcPublish(w http.ResponseWriter, r *http.Request) error {
+	m, err := s.grpcReadMsg(r)
+	if err != nil {
+		return err
+	}
+	c, err := s.httpClientConnect(r, "grpc")
+	if err != nil {
+		return err
+	}
+	defer c.nc.Close()
+	if err := c.publish(m.subject, m.reply, m.data); err != nil {
+		return err
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	return grpcWriteMsg(w, nil)
+}
+
+// grpcSubscribe streams the messages of a subscription until the call is
+// canceled.
+func (s *Server) grpcSubscribe(w http.ResponseWriter, r *http.Request) error {
+	b, err := s.grpcReadRequest(r)
+	if err != nil {
+		return err
+	}
+	var subject, queue string
+	err = pbFields(b, func(field int, v []byte) {
+		switch field {
+		case 1:
+			subject = string(v)
+		case 2:
+			queue = string(v)
+		}
+	})
+	if err != nil || !IsValidSubject(subject) || strings.ContainsAny(queue, " \t\r\n") {
+		return &grpcStatus{grpcInvalidArgument, "invalid subscription"}
+	}
+	c, err := s.httpClientConnect(r, "grpc")
+	if err != nil {
+		return err
+	}
+	defer c.nc.Close()
+	proto := "SUB " + subject
+	if queue != _EMPTY_ {
+		proto += " " + queue
+	}
+	if err := c.send(proto + " 1\r\n"); err != nil {
+		return err
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	// The client connection is closed when the call is canceled.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			c.nc.Close()
+		case <-done:
+		}
+	}()
+	w.(http.Flusher).Flush()
+	for {
+		m, err := c.next()
+		if err != nil {
+			if r.Context().Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if m == nil {
+			continue
+		}
+		if err := grpcWriteMsg(w, m.encode()); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+	}
+}
+
+// grpcRequest publishes the message of the call and returns the first
+// reply, waiting until the deadline of the call.
+func (s *Server) grpcRequest(w http.ResponseWriter, r *http.Request) error {
+	m, err := s.grpcReadMsg(r)
+	if err != nil {
+		return err
+	}
+	timeout := DEFAULT_GRPC_REQUEST_TIMEOUT
+	if gt := r.Header.Get("Grpc-Timeout"); gt != _EMPTY_ {
+		if timeout, err = parseGRPCTimeout(gt); err != nil {
+			return &grpcStatus{grpcInvalidArgument, err.Error()}
+		}
+	}
+	c, err := s.httpClientConnect(r, "grpc")
+	if err != nil {
+		return err
+	}
+	defer c.nc.Close()
+	m.reply = "_INBOX." + nuid.Next()
+	if err := c.send(fmt.Sprintf("SUB %s 1\r\nUNSUB 1 1\r\n", m.reply)); err != nil {
+		return err
+	}
+	if err := c.publish(m.subject, m.reply, m.data); err != nil {
+		return err
+	}
+	c.nc.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		reply, err := c.next()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return &grpcStatus{grpcDeadlineExceeded, "request timeout"}
+			}
+			return err
+		}
+		if reply != nil {
+			return grpcWriteMsg(w, reply.encode())
+		}
+	}
+}
+
+// grpcReadRequest reads the request message of the call.
+func (s *Server) grpcReadRequest(r *http.Request) ([]byte, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r.Body, hdr[:]); err != nil {
+		return nil, &grpcStatus{grpcInvalidArgument, "missing request message"}
+	}
+	if hdr[0] != 0 {
+		return nil, &grpcStatus{grpcUnimplemented, "compression is not supported"}
+	}
+	size := binary.BigEndian.Uint32(hdr[1:])
+	if max := uint32(s.getOpts().MaxPayload) + MAX_CONTROL_LINE_SIZE; size > max {
+		return nil, &grpcStatus{grpcInvalidArgument, ErrMaxPayload.Error()}
+	}
+	b := make([]byte, size)
+	if _, err := io.ReadFull(r.Body, b); err != nil {
+		return nil, &grpcStatus{grpcInvalidArgument, "incomplete request message"}
+	}
+	return b, nil
+}
+
+// grpcReadMsg reads the Msg request message of the call.
+func (s *Server) grpcReadMsg(r *http.Request) (*grpcMsg, error) {
+	b, err := s.grpcReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &grpcMsg{}
+	if err := m.decode(b); err != nil || !IsValidLiteralSubject(m.subject) ||
+		(m.reply != _EMPTY_ && !IsValidLiteralSubject(m.reply)) {
+		return nil, &grpcStatus{grpcInvalidArgument, "invalid message"}
+	}
+	return m, nil
+}
+
+// grpcWriteMsg writes a response message.
+func grpcWriteMsg(w io.Writer, b []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(b)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(b)
+	return err
+}
+
+// parseGRPCTimeout parses the value of the grpc-timeout header.
+func parseGRPCTimeout(v string) (time.Duration, error) {
+	if len(v) < 2 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", v)
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", v)
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour,
+		'M': time.Minute,
+		'S': time.Second,
+		'm': time.Millisecond,
+		'u': time.Microsecond,
+		'n': time.Nanosecond,
+	}
+	unit, ok := units[v[len(v)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid grpc-timeout %q", v)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// httpClientConn is the in-process client connection of an HTTP request.
+type httpClientConn struct {
+	nc net.Conn
+	br *bufio.Reader
+}
+
+// httpClientConnect opens the client connection of the request, which is
+// authenticated with its Authorization header.
+func (s *Server) httpClientConnect(r *http.Request, lang string) (*httpClientConn, error) {
+	co := &clientOpts{
+		Echo:     true,
+		Name:     lang + ":" + r.RemoteAddr,
+		Lang:     lang,
+		Version:  VERSION,
+		Protocol: ClientProtoInfo,
+	}
+	auth := r.Header.Get("Authorization")
+	switch {
+	case strings.HasPrefix(auth, "Bearer "):
+		co.Authorization = strings.TrimPrefix(auth, "Bearer ")
+	case strings.HasPrefix(auth, "Basic "):
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+		if err != nil {
+			return nil, &grpcStatus{grpcUnauthenticated, "invalid authorization"}
+		}
+		up := strings.SplitN(string(b), ":", 2)
+		co.Username = up[0]
+		if len(up) == 2 {
+			co.Password = up[1]
+		}
+	case auth != _EMPTY_:
+		return nil, &grpcStatus{grpcUnauthenticated, "invalid authorization"}
+	}
+
+	nc, err := s.InProcessConn()
+	if err != nil {
+		return nil, &grpcStatus{grpcUnavailable, err.Error()}
+	}
+	c := &httpClientConn{nc: nc, br: bufio.NewReaderSize(nc, MAX_CONTROL_LINE_SIZE)}
+	if line, err := readProtoLine(c.br); err != nil || !strings.HasPrefix(line, "INFO ") {
+		nc.Close()
+		return nil, &grpcStatus{grpcUnavailable, "server not ready"}
+	}
+	b, _ := json.Marshal(co)
+	// Send the PING along, since the connection is closed right away if
+	// the authentication fails.
+	if err = c.send(fmt.Sprintf("CONNECT %s\r\nPING\r\n", b)); err == nil {
+		_, err = c.next()
+	}
+	if err != nil {
+		nc.Close()
+		if st, ok := err.(*grpcStatus); ok && st.msg == "Authorization Violation" {
+			st.code = grpcUnauthenticated
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// send writes the protocols.
+func (c *httpClientConn) send(protos string) error {
+	if _, err := io.WriteString(c.nc, protos); err != nil {
+		return &grpcStatus{grpcUnavailable, err.Error()}
+	}
+	return nil
+}
+
+// publish sends the PUB protocol for the message.
+func (c *httpClientConn) publish(subject, reply string, data []byte) error {
+	proto := "PUB " + subject
+	if reply != _EMPTY_ {
+		proto += " " + reply
+	}
+	return c.send(fmt.Sprintf("%s %d\r\n%s\r\n", proto, len(data), data))
+}
+
+// flush sends a PING and waits for the PONG, which fails if the server
+// rejected any of the protocols sent before.
+func (c *httpClientConn) flush() error {
+	if err := c.send("PING\r\n"); err != nil {
+		return err
+	}
+	for {
+		if m, err := c.next(); m == nil || err != nil {
+			return err
+		}
+	}
+}
+
+// next returns the next message received, or nil for a PONG.
+func (c *httpClientConn) next() (*grpcMsg, error) {
+	for {
+		line, err := readProtoLine(c.br)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			subject, _, reply, payload, err := readMsgProto(c.br, line)
+			if err != nil {
+				return nil, err
+			}
+			return &grpcMsg{subject: subject, reply: reply, data: payload}, nil
+		case line == "PONG":
+			return nil, nil
+		case line == "PING":
+			if err := c.send("PONG\r\n"); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, "-ERR "):
+			msg := protoErrText(line)
+			code := grpcUnavailable
+			if strings.HasPrefix(msg, "Permissions Violation") {
+				code = grpcPermissionDenied
+			}
+			return nil, &grpcStatus{code, msg}
+		}
+	}
+}
+
+// grpcMsg is the Msg message.
+type grpcMsg struct {
+	subject string
+	reply   string
+	data    []byte
+}
+
+func (m *grpcMsg) encode() []byte {
+	var b []byte
+	b = pbAppendBytes(b, 1, []byte(m.subject))
+	b = pbAppendBytes(b, 2, []byte(m.reply))
+	b = pbAppendBytes(b, 3, m.data)
+	return b
+}
+
+func (m *grpcMsg) decode(b []byte) error {
+	return pbFields(b, func(field int, v []byte) {
+		switch field {
+		case 1:
+			m.subject = string(v)
+		case 2:
+			m.reply = string(v)
+		case 3:
+			m.data = v
+		}
+	})
+}
+
+// pbAppendBytes appends a length-delimited protobuf field, unless empty.
+func pbAppendBytes(b []byte, field int, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(field)<<3|2)
+	b = append(b, tmp[:n]...)
+	n = binary.PutUvarint(tmp[:], uint64(len(v)))
+	b = append(b, tmp[:n]...)
+	return append(b, v...)
+}
+
+// pbFields calls fn for each length-delimited field of the protobuf
+// message, skipping the other fields.
+func pbFields(b []byte, fn func(field int, v []byte)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return fmt.Errorf("invalid varint")
+			}
+			b = b[n:]
+		case 1, 5:
+			size := 8
+			if key&7 == 5 {
+				size = 4
+			}
+			if len(b) < size {
+				return fmt.Errorf("invalid fixed field")
+			}
+			b = b[size:]
+		case 2:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return fmt.Errorf("invalid length")
+			}
+			fn(int(key>>3), b[n:n+int(size)])
+			b = b[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+	}
+	return nil
+}
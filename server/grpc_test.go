@@ -0,0 +1,234 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestGRPCParseConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		grpc {
+			listen: "127.0.0.1:50051"
+			tls {
+				cert_file: "../test/configs/certs/server-cert.pem"
+				key_file: "../test/configs/certs/server-key.pem"
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if gro := opts.GRPC; gro == nil || gro.Host != "127.0.0.1" || gro.Port != 50051 || gro.TLSConfig == nil {
+		t.Fatalf("Unexpected grpc options: %+v", gro)
+	}
+
+	conf = createConfFile(t, []byte(`grpc { port: 50051 }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil {
+		t.Fatal("Expected error for missing tls")
+	}
+}
+
+type grpcTestClient struct {
+	t   *testing.T
+	hc  *http.Client
+	url string
+}
+
+func newGRPCTestClient(t *testing.T, s *Server) *grpcTestClient {
+	t.Helper()
+	// The test CA is signed with SHA1, which is not trusted anymore.
+	tr := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}
+	return &grpcTestClient{
+		t:   t,
+		hc:  &http.Client{Transport: tr},
+		url: fmt.Sprintf("https://%s/nats.Gateway/", s.GRPCAddr()),
+	}
+}
+
+// call sends the request message, returns the response, and leaves the
+// response messages to be read from its body.
+func (c *grpcTestClient) call(ctx context.Context, method, auth string, msg []byte, hdrs ...string) *http.Response {
+	c.t.Helper()
+	var b bytes.Buffer
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	b.Write(hdr[:])
+	b.Write(msg)
+	req, _ := http.NewRequest("POST", c.url+method, &b)
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	for i := 0; i < len(hdrs); i += 2 {
+		req.Header.Set(hdrs[i], hdrs[i+1])
+	}
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		c.t.Fatalf("Error calling %s: %v", method, err)
+	}
+	if resp.ProtoMajor != 2 || resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("Unexpected response: %v %v", resp.Proto, resp.Status)
+	}
+	return resp
+}
+
+func grpcTestReadMsg(t *testing.T, r io.Reader) *grpcMsg {
+	t.Helper()
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		t.Fatalf("Error reading message: %v", err)
+	}
+	b := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		t.Fatalf("Error reading message: %v", err)
+	}
+	m := &grpcMsg{}
+	if err := m.decode(b); err != nil {
+		t.Fatalf("Error decoding message: %v", err)
+	}
+	return m
+}
+
+// status reads the rest of the response and returns its status.
+func grpcTestStatus(t *testing.T, resp *http.Response) (string, string) {
+	t.Helper()
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+}
+
+func TestGRPCGateway(t *testing.T) {
+	tc, err := GenTLSConfig(&TLSConfigOpts{
+		CertFile: "../test/configs/certs/server-cert.pem",
+		KeyFile:  "../test/configs/certs/server-key.pem",
+	})
+	if err != nil {
+		t.Fatalf("Error generating tls config: %v", err)
+	}
+	o := DefaultOptions()
+	o.Users = []*User{
+		{Username: "alice", Password: "pwd"},
+		{Username: "bob", Password: "pwd", Permissions: &Permissions{
+			Publish: &SubjectPermission{Allow: []string{"allowed"}},
+		}},
+	}
+	o.GRPC = &GRPCOpts{Host: "127.0.0.1", Port: -1, TLSConfig: tc}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	c := newGRPCTestClient(t, s)
+	alice := "Basic YWxpY2U6cHdk" // alice:pwd
+	bob := "Basic Ym9iOnB3ZA=="   // bob:pwd
+
+	nc := natsConnect(t, fmt.Sprintf("nats://alice:pwd@%s:%d", o.Host, o.Port))
+	defer nc.Close()
+
+	// Subscribe, and publish from a NATS client.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sresp := c.call(ctx, "Subscribe", alice, pbAppendBytes(nil, 1, []byte("foo.>")))
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.NumSubscriptions(); n != 1 {
+			return fmt.Errorf("expected 1 subscription, got %d", n)
+		}
+		return nil
+	})
+	natsPubReq(t, nc, "foo.bar", "reply", []byte("hello"))
+	if m := grpcTestReadMsg(t, sresp.Body); m.subject != "foo.bar" || m.reply != "reply" || string(m.data) != "hello" {
+		t.Fatalf("Unexpected message: %+v", m)
+	}
+
+	// Publish, which the subscription gets.
+	m := &grpcMsg{subject: "foo.baz", data: []byte("from grpc")}
+	if st, msg := grpcTestStatus(t, c.call(ctx, "Publish", alice, m.encode())); st != "0" {
+		t.Fatalf("Unexpected status %s: %s", st, msg)
+	}
+	if m := grpcTestReadMsg(t, sresp.Body); m.subject != "foo.baz" || string(m.data) != "from grpc" {
+		t.Fatalf("Unexpected message: %+v", m)
+	}
+	cancel()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.NumSubscriptions(); n != 0 {
+			return fmt.Errorf("expected no subscription, got %d", n)
+		}
+		return nil
+	})
+
+	// Request, with a responder.
+	sub, err := nc.Subscribe("service", func(m *nats.Msg) {
+		m.Respond(append([]byte("re: "), m.Data...))
+	})
+	if err != nil {
+		t.Fatalf("Error subscribing: %v", err)
+	}
+	natsFlush(t, nc)
+	m = &grpcMsg{subject: "service", data: []byte("help")}
+	resp := c.call(context.Background(), "Request", alice, m.encode())
+	if m := grpcTestReadMsg(t, resp.Body); string(m.data) != "re: help" {
+		t.Fatalf("Unexpected reply: %+v", m)
+	}
+	if st, msg := grpcTestStatus(t, resp); st != "0" {
+		t.Fatalf("Unexpected status %s: %s", st, msg)
+	}
+	sub.Unsubscribe()
+	natsFlush(t, nc)
+	resp = c.call(context.Background(), "Request", alice, m.encode(), "Grpc-Timeout", "100m")
+	if st, _ := grpcTestStatus(t, resp); st != "4" {
+		t.Fatalf("Expected deadline exceeded, got %s", st)
+	}
+
+	// Errors.
+	for _, test := range []struct {
+		name   string
+		method string
+		auth   string
+		msg    *grpcMsg
+		status string
+	}{
+		{"no auth", "Publish", "", &grpcMsg{subject: "foo"}, "16"},
+		{"bad auth", "Publish", "Basic Ym9iOmJhZA==", &grpcMsg{subject: "foo"}, "16"},
+		{"not allowed", "Publish", bob, &grpcMsg{subject: "foo"}, "7"},
+		{"allowed", "Publish", bob, &grpcMsg{subject: "allowed"}, "0"},
+		{"invalid subject", "Publish", alice, &grpcMsg{subject: "foo.*"}, "3"},
+		{"unknown method", "Unknown", alice, &grpcMsg{subject: "foo"}, "12"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resp := c.call(context.Background(), test.method, test.auth, test.msg.encode())
+			if st, msg := grpcTestStatus(t, resp); st != test.status {
+				t.Fatalf("Expected status %s, got %s: %s", test.status, st, msg)
+			}
+		})
+	}
+}
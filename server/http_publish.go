@@ -0,0 +1,87 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// HandlePublish publishes the body of a POST request to the subject in its
+// path, for clients that can not keep a connection, such as webhooks. The
+// optional "reply" query parameter is the reply subject. The request is
+// authenticated, and subject to the permissions of the user, like with the
+// gRPC gateway: the Authorization header is "Bearer <token>" or "Basic"
+// with the user and password. It is only served with http_publish set.
+// With cloudevents set, the body can also be a CloudEvent, see
+// cloudEventPublish.
+func (s *Server) HandlePublish(w http.ResponseWriter, r *http.Request) {
+	opts := s.getOpts()
+	if !opts.HTTPPublish {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	s.httpReqStats[PublishPath]++
+	s.mu.Unlock()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(opts.MaxPayload)))
+	if err != nil {
+		http.Error(w, ErrMaxPayload.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	subject := strings.TrimPrefix(r.URL.Path, PublishPath)
+	if opts.CloudEvents && isCloudEvent(r) {
+		if subject, data, err = cloudEventPublish(r, subject, data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	reply := r.URL.Query().Get("reply")
+	if !IsValidLiteralSubject(subject) || (reply != _EMPTY_ && !IsValidLiteralSubject(reply)) {
+		http.Error(w, "Invalid Subject", http.StatusBadRequest)
+		return
+	}
+
+	c, err := s.httpClientConnect(r, "http")
+	if err == nil {
+		defer c.nc.Close()
+		if err = c.publish(subject, reply, data); err == nil {
+			err = c.flush()
+		}
+	}
+	if err != nil {
+		code := http.StatusInternalServerError
+		if st, ok := err.(*grpcStatus); ok {
+			switch st.code {
+			case grpcUnauthenticated:
+				code = http.StatusUnauthorized
+			case grpcPermissionDenied:
+				code = http.StatusForbidden
+			case grpcUnavailable:
+				code = http.StatusServiceUnavailable
+			}
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
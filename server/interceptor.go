@@ -0,0 +1,122 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// MessageInterceptor can be set in the options by applications embedding
+// the server to validate, or transform, the messages published by clients,
+// for instance for schema validation or encryption at the edge.
+//
+// OnPublish is invoked for every message published by a client, from the
+// readLoop of that client and before the message is delivered to anyone.
+// It returns false to drop the message, and a non nil payload to replace
+// the one published. The given payload must not be retained nor modified.
+//
+// This is in the hot path: the time spent in OnPublish adds to the
+// latency of every message, and slows down the publisher.
+type MessageInterceptor interface {
+	OnPublish(account, subject string, payload []byte) (allow bool, mutated []byte)
+}
+
+// InterceptorStats are the metrics of a message interceptor.
+type InterceptorStats struct {
+	Name     string        `json:"name"`
+	Calls    uint64        `json:"calls"`
+	Rejected uint64        `json:"rejected"`
+	Mutated  uint64        `json:"mutated"`
+	AvgTime  time.Duration `json:"avg_time"`
+}
+
+// messageInterceptor is a message interceptor with its metrics.
+type messageInterceptor struct {
+	// Kept first for the alignment of the 64-bit atomics.
+	calls    uint64
+	rejected uint64
+	mutated  uint64
+	nanos    uint64
+	mi       MessageInterceptor
+	name     string
+}
+
+// newMessageInterceptors returns the interceptors of the options, named
+// after their type.
+func newMessageInterceptors(opts *Options) []*messageInterceptor {
+	if len(opts.MessageInterceptors) == 0 {
+		return nil
+	}
+	mis := make([]*messageInterceptor, 0, len(opts.MessageInterceptors))
+	for _, mi := range opts.MessageInterceptors {
+		mis = append(mis, &messageInterceptor{mi: mi, name: fmt.Sprintf("%T", mi)})
+	}
+	return mis
+}
+
+// logMessageInterceptors warns about the cost of the interceptors.
+func (s *Server) logMessageInterceptors() {
+	for _, mi := range s.interceptors {
+		s.Warnf("Message interceptor %s invoked for every message published by clients", mi.name)
+	}
+}
+
+// interceptMsg passes the message being processed to the interceptors. It
+// returns the message to deliver, which has the CR_LF like the one given,
+// or false if it has been dropped.
+func (c *client) interceptMsg(msg []byte) ([]byte, bool) {
+	acc, subj := c.acc.Name, string(c.pa.subject)
+	for _, mi := range c.srv.interceptors {
+		start := time.Now()
+		allow, mutated := mi.mi.OnPublish(acc, subj, msg[:len(msg)-LEN_CR_LF])
+		atomic.AddUint64(&mi.nanos, uint64(time.Since(start)))
+		atomic.AddUint64(&mi.calls, 1)
+		if !allow {
+			atomic.AddUint64(&mi.rejected, 1)
+			return nil, false
+		}
+		if mutated != nil {
+			atomic.AddUint64(&mi.mutated, 1)
+			msg = make([]byte, 0, len(mutated)+LEN_CR_LF)
+			msg = append(append(msg, mutated...), CR_LF...)
+			c.pa.size = len(mutated)
+			c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+		}
+	}
+	return msg, true
+}
+
+// interceptorStats returns the metrics of the interceptors.
+func (s *Server) interceptorStats() []*InterceptorStats {
+	if len(s.interceptors) == 0 {
+		return nil
+	}
+	stats := make([]*InterceptorStats, 0, len(s.interceptors))
+	for _, mi := range s.interceptors {
+		is := &InterceptorStats{
+			Name:     mi.name,
+			Calls:    atomic.LoadUint64(&mi.calls),
+			Rejected: atomic.LoadUint64(&mi.rejected),
+			Mutated:  atomic.LoadUint64(&mi.mutated),
+		}
+		if is.Calls > 0 {
+			is.AvgTime = time.Duration(atomic.LoadUint64(&mi.nanos) / is.Calls)
+		}
+		stats = append(stats, is)
+	}
+	return stats
+}
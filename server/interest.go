@@ -0,0 +1,280 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often the interest snapshot is saved, so that it is available
+// even if the server was not shutdown properly.
+const interestSnapshotInterval = 30 * time.Second
+
+// interestSnapshot is the interest of named clients, persisted so that
+// routes and gateways can be primed with it after a restart, before the
+// clients reconnect.
+type interestSnapshot struct {
+	Server  string            `json:"server_id"`
+	Time    time.Time         `json:"time"`
+	Clients []*clientInterest `json:"clients"`
+}
+
+// clientInterest is the interest of a client, identified by its account
+// and the name it provided in the CONNECT protocol.
+type clientInterest struct {
+	Account string        `json:"account"`
+	Name    string        `json:"name"`
+	Subs    []subInterest `json:"subs"`
+}
+
+type subInterest struct {
+	Subject string `json:"subject"`
+	Queue   string `json:"queue,omitempty"`
+}
+
+// primedInterest holds the interest restored from a snapshot until the
+// clients reconnect or it expires.
+type primedInterest struct {
+	sync.Mutex
+	clients map[string]*primedClient
+	tmr     *time.Timer
+}
+
+// primedClient holds the restored subscriptions of a client. They are
+// owned by an internal client so that they are sent to new routes, but are
+// not added to the account's sublist so they never receive messages.
+type primedClient struct {
+	c    *client
+	acc  *Account
+	subs []*subscription
+}
+
+func primedInterestKey(account, name string) string {
+	return account + " " + name
+}
+
+// startInterestSnapshot restores the interest from the snapshot file, if
+// any, and starts saving it periodically. This needs to be invoked before
+// routes and gateways are started.
+func (s *Server) startInterestSnapshot() {
+	opts := s.getOpts()
+	if opts.InterestSnapshot == _EMPTY_ {
+		return
+	}
+	s.primeInterest(opts.InterestSnapshot, opts.InterestSnapshotTTL)
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		t := time.NewTicker(interestSnapshotInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.mu.Lock()
+				var snap *interestSnapshot
+				// Clients are being closed in lame duck mode, the
+				// snapshot has been saved when entering it.
+				if !s.shutdown && !s.ldm {
+					snap = s.interestSnapshot()
+				}
+				s.mu.Unlock()
+				s.saveInterestSnapshot(opts.InterestSnapshot, snap)
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// primeInterest loads the snapshot and propagates its interest as if the
+// clients were connected. The interest of a client is released when it
+// reconnects, and whatever is left is released after ttl.
+func (s *Server) primeInterest(path string, ttl time.Duration) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			s.Warnf("Unable to read interest snapshot: %v", err)
+		}
+		return
+	}
+	snap := &interestSnapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		s.Warnf("Unable to parse interest snapshot %q: %v", path, err)
+		return
+	}
+
+	p := &primedInterest{clients: make(map[string]*primedClient, len(snap.Clients))}
+	now := time.Now()
+	nsubs := 0
+	for _, ci := range snap.Clients {
+		acc, err := s.lookupAccount(ci.Account)
+		if err != nil {
+			s.Warnf("Unable to restore interest of account %q: %v", ci.Account, err)
+			continue
+		}
+		c := &client{srv: s, acc: acc, kind: SYSTEM, opts: internalOpts, msubs: -1, mpay: -1, start: now, last: now}
+		pc := &primedClient{c: c, acc: acc}
+		acc.addClient(c)
+		for _, si := range ci.Subs {
+			if !IsValidSubject(si.Subject) {
+				continue
+			}
+			sub := &subscription{client: c, subject: []byte(si.Subject)}
+			if si.Queue != _EMPTY_ {
+				sub.queue = []byte(si.Queue)
+			}
+			pc.subs = append(pc.subs, sub)
+			s.updateRouteSubscriptionMap(acc, sub, 1)
+			if s.gateway.enabled {
+				s.gatewayUpdateSubInterest(acc.Name, sub, 1)
+			}
+		}
+		nsubs += len(pc.subs)
+		p.clients[primedInterestKey(ci.Account, ci.Name)] = pc
+	}
+	p.tmr = time.AfterFunc(ttl, s.releaseAllPrimedInterest)
+
+	s.mu.Lock()
+	s.primed = p
+	s.mu.Unlock()
+
+	s.Noticef("Restored %d subscription(s) of %d client(s) from interest snapshot taken at %v",
+		nsubs, len(p.clients), snap.Time)
+}
+
+// releasePrimedInterest releases the restored interest of the client with
+// the given account and name once it has reconnected.
+func (s *Server) releasePrimedInterest(account, name string) {
+	s.mu.Lock()
+	p := s.primed
+	s.mu.Unlock()
+	if p == nil {
+		return
+	}
+	key := primedInterestKey(account, name)
+	p.Lock()
+	pc := p.clients[key]
+	delete(p.clients, key)
+	p.Unlock()
+	if pc != nil {
+		s.unprimeClient(pc)
+	}
+}
+
+// releaseAllPrimedInterest releases the restored interest of the clients
+// that did not reconnect in time.
+func (s *Server) releaseAllPrimedInterest() {
+	s.mu.Lock()
+	p := s.primed
+	s.mu.Unlock()
+	if p == nil {
+		return
+	}
+	p.Lock()
+	clients := p.clients
+	p.clients = make(map[string]*primedClient)
+	p.Unlock()
+	if len(clients) == 0 {
+		return
+	}
+	for _, pc := range clients {
+		s.unprimeClient(pc)
+	}
+	s.Noticef("Released restored interest of %d client(s) that did not reconnect", len(clients))
+}
+
+// unprimeClient removes the restored interest of a client.
+func (s *Server) unprimeClient(pc *primedClient) {
+	for _, sub := range pc.subs {
+		s.updateRouteSubscriptionMap(pc.acc, sub, -1)
+		if s.gateway.enabled {
+			s.gatewayUpdateSubInterest(pc.acc.Name, sub, -1)
+		}
+	}
+	pc.acc.removeClient(pc.c)
+}
+
+// interestSnapshot returns the interest of the named clients, including
+// the restored interest of clients that have not reconnected yet.
+// Server lock is held on entry.
+func (s *Server) interestSnapshot() *interestSnapshot {
+	snap := &interestSnapshot{Server: s.info.ID, Time: time.Now()}
+	clients := make(map[string]*clientInterest)
+	seen := make(map[string]map[subInterest]struct{})
+	add := func(account, name string, si subInterest) {
+		key := primedInterestKey(account, name)
+		ci := clients[key]
+		if ci == nil {
+			ci = &clientInterest{Account: account, Name: name}
+			clients[key] = ci
+			seen[key] = make(map[subInterest]struct{})
+			snap.Clients = append(snap.Clients, ci)
+		}
+		if _, ok := seen[key][si]; !ok {
+			seen[key][si] = struct{}{}
+			ci.Subs = append(ci.Subs, si)
+		}
+	}
+
+	for _, c := range s.clients {
+		c.mu.Lock()
+		if c.kind == CLIENT && c.opts.Name != _EMPTY_ && c.acc != nil {
+			for _, sub := range c.subs {
+				add(c.acc.Name, c.opts.Name, subInterest{string(sub.subject), string(sub.queue)})
+			}
+		}
+		c.mu.Unlock()
+	}
+	if p := s.primed; p != nil {
+		p.Lock()
+		for key, pc := range p.clients {
+			name := key[len(pc.acc.Name)+1:]
+			for _, sub := range pc.subs {
+				add(pc.acc.Name, name, subInterest{string(sub.subject), string(sub.queue)})
+			}
+		}
+		p.Unlock()
+	}
+	return snap
+}
+
+// saveInterestSnapshot writes the snapshot to the given file, unless a
+// more recent snapshot has already been saved.
+func (s *Server) saveInterestSnapshot(path string, snap *interestSnapshot) {
+	if snap == nil {
+		return
+	}
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+	if snap.Time.Before(s.snapTime) {
+		return
+	}
+	data, err := json.Marshal(snap)
+	if err == nil {
+		tmp := path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		s.Warnf("Unable to save interest snapshot: %v", err)
+		return
+	}
+	s.snapTime = snap.Time
+}
@@ -0,0 +1,254 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of connections a join token can be issued for.
+const (
+	JoinTokenRoute    = "route"
+	JoinTokenLeafNode = "leafnode"
+)
+
+const (
+	// Prefix of join tokens, to tell them apart from user names.
+	joinTokenPrefix = "NJT."
+	// Default validity of an issued join token.
+	defaultJoinTokenTTL = 15 * time.Minute
+	// Default maximum validity of an issued join token.
+	defaultJoinTokenMaxTTL = 24 * time.Hour
+	// Minimum length of the secret signing join tokens.
+	joinTokenMinSecretLen = 16
+)
+
+// JoinTokenOpts enables short-lived tokens that new routes and leafnodes
+// present as user name to join, instead of long-lived credentials. The
+// tokens are signed with a secret shared by the servers of the cluster,
+// so that any of them can issue and verify them.
+type JoinTokenOpts struct {
+	Secret string
+	// MaxTTL is the maximum validity of an issued token.
+	MaxTTL time.Duration
+}
+
+func (o *JoinTokenOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	if len(o.Secret) < joinTokenMinSecretLen {
+		return fmt.Errorf("join tokens secret must be at least %d characters long", joinTokenMinSecretLen)
+	}
+	if o.MaxTTL < 0 {
+		return fmt.Errorf("join tokens max_ttl can not be negative")
+	}
+	return nil
+}
+
+func (o *JoinTokenOpts) maxTTL() time.Duration {
+	if o.MaxTTL == 0 {
+		return defaultJoinTokenMaxTTL
+	}
+	return o.MaxTTL
+}
+
+// JoinTokenRequest describes the join token to issue.
+type JoinTokenRequest struct {
+	// Kind is either JoinTokenRoute or JoinTokenLeafNode.
+	Kind string `json:"kind"`
+	// TTL is the validity of the token, 15 minutes if 0.
+	TTL time.Duration `json:"ttl,omitempty"`
+	// OneTime tokens can be used by a single connection to each server.
+	OneTime bool `json:"one_time,omitempty"`
+	// Account leafnodes joining with the token are bound to, the
+	// global account if empty.
+	Account string `json:"account,omitempty"`
+}
+
+// JoinTokenResponse is the response to a join token request.
+type JoinTokenResponse struct {
+	Server  string    `json:"server_id"`
+	Token   string    `json:"token,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// joinTokenClaims are the signed content of a join token.
+type joinTokenClaims struct {
+	Kind    string `json:"kind"`
+	Account string `json:"acc,omitempty"`
+	Expires int64  `json:"exp"`
+	Nonce   string `json:"nonce"`
+	OneTime bool   `json:"once,omitempty"`
+}
+
+// joinTokenTracker keeps the one-time tokens used until they expire.
+type joinTokenTracker struct {
+	sync.Mutex
+	used map[string]time.Time
+}
+
+// use records the use of a one-time token, returning false if it has
+// already been used.
+func (t *joinTokenTracker) use(nonce string, expires time.Time) bool {
+	t.Lock()
+	defer t.Unlock()
+	now := time.Now()
+	for n, exp := range t.used {
+		if now.After(exp) {
+			delete(t.used, n)
+		}
+	}
+	if _, ok := t.used[nonce]; ok {
+		return false
+	}
+	if t.used == nil {
+		t.used = make(map[string]time.Time)
+	}
+	t.used[nonce] = expires
+	return true
+}
+
+// isJoinToken returns true if the user name looks like a join token.
+func isJoinToken(user string) bool {
+	return strings.HasPrefix(user, joinTokenPrefix)
+}
+
+func signJoinToken(secret string, payload string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// IssueJoinToken returns a join token signed with the secret of the
+// options, along with its expiration.
+func IssueJoinToken(opts *JoinTokenOpts, req *JoinTokenRequest) (string, time.Time, error) {
+	if opts == nil {
+		return _EMPTY_, time.Time{}, errors.New("join tokens are not enabled")
+	}
+	if err := opts.validate(); err != nil {
+		return _EMPTY_, time.Time{}, err
+	}
+	switch req.Kind {
+	case JoinTokenRoute:
+		if req.Account != _EMPTY_ {
+			return _EMPTY_, time.Time{}, errors.New("account can only be set for leafnode join tokens")
+		}
+	case JoinTokenLeafNode:
+	default:
+		return _EMPTY_, time.Time{}, fmt.Errorf("invalid join token kind %q, expected %q or %q",
+			req.Kind, JoinTokenRoute, JoinTokenLeafNode)
+	}
+	ttl := req.TTL
+	if ttl == 0 {
+		ttl = defaultJoinTokenTTL
+	}
+	if ttl < 0 || ttl > opts.maxTTL() {
+		return _EMPTY_, time.Time{}, fmt.Errorf("join token ttl must be positive and at most %v", opts.maxTTL())
+	}
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return _EMPTY_, time.Time{}, err
+	}
+	expires := time.Now().Add(ttl)
+	claims, err := json.Marshal(&joinTokenClaims{
+		Kind:    req.Kind,
+		Account: req.Account,
+		Expires: expires.Unix(),
+		Nonce:   base64.RawURLEncoding.EncodeToString(nonce[:]),
+		OneTime: req.OneTime,
+	})
+	if err != nil {
+		return _EMPTY_, time.Time{}, err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	return joinTokenPrefix + payload + "." + signJoinToken(opts.Secret, payload), expires, nil
+}
+
+// IssueJoinToken returns a join token accepted by the servers of the
+// cluster, along with its expiration.
+func (s *Server) IssueJoinToken(req *JoinTokenRequest) (string, time.Time, error) {
+	if req.Kind == JoinTokenLeafNode && req.Account != _EMPTY_ {
+		if _, err := s.lookupAccount(req.Account); err != nil {
+			return _EMPTY_, time.Time{}, fmt.Errorf("unable to lookup account %q: %v", req.Account, err)
+		}
+	}
+	token, expires, err := IssueJoinToken(s.getOpts().JoinTokens, req)
+	if err == nil {
+		s.Noticef("Issued %s join token expiring at %v", req.Kind, expires.Format(time.RFC3339))
+	}
+	return token, expires, err
+}
+
+// verifyJoinToken checks that the token was issued for this kind of
+// connection and has not expired or, for one-time tokens, been used.
+func (s *Server) verifyJoinToken(token, kind string) (*joinTokenClaims, error) {
+	opts := s.getOpts().JoinTokens
+	if opts == nil {
+		return nil, errors.New("join tokens are not enabled")
+	}
+	parts := strings.Split(strings.TrimPrefix(token, joinTokenPrefix), ".")
+	if len(parts) != 2 {
+		return nil, errors.New("malformed token")
+	}
+	if !hmac.Equal([]byte(signJoinToken(opts.Secret, parts[0])), []byte(parts[1])) {
+		return nil, errors.New("invalid signature")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token: %v", err)
+	}
+	claims := &joinTokenClaims{}
+	if err := json.Unmarshal(b, claims); err != nil {
+		return nil, fmt.Errorf("malformed token: %v", err)
+	}
+	if claims.Kind != kind {
+		return nil, fmt.Errorf("token issued for a %s", claims.Kind)
+	}
+	expires := time.Unix(claims.Expires, 0)
+	if time.Now().After(expires) {
+		return nil, errors.New("token expired")
+	}
+	if claims.OneTime && !s.joinTokens.use(claims.Nonce, expires) {
+		return nil, errors.New("token already used")
+	}
+	return claims, nil
+}
+
+// joinTokenReq is a request to issue a join token.
+func (s *Server) joinTokenReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() || reply == _EMPTY_ {
+		return
+	}
+	resp := &JoinTokenResponse{Server: s.ID()}
+	req := &JoinTokenRequest{}
+	if err := json.Unmarshal(msg, req); err != nil {
+		resp.Error = fmt.Sprintf("Error unmarshalling join token request: %v", err)
+	} else if token, expires, err := s.IssueJoinToken(req); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Token, resp.Expires = token, expires
+	}
+	s.sendInternalMsgLocked(reply, _EMPTY_, nil, resp)
+}
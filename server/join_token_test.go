@@ -0,0 +1,200 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinTokenVerify(t *testing.T) {
+	jt := &JoinTokenOpts{Secret: "0123456789abcdef"}
+	s := &Server{opts: &Options{JoinTokens: jt}}
+
+	issue := func(req *JoinTokenRequest) string {
+		t.Helper()
+		token, expires, err := IssueJoinToken(jt, req)
+		if err != nil {
+			t.Fatalf("Error issuing token: %v", err)
+		}
+		if !isJoinToken(token) || time.Until(expires) <= 0 {
+			t.Fatalf("Unexpected token %q expiring at %v", token, expires)
+		}
+		return token
+	}
+
+	token := issue(&JoinTokenRequest{Kind: JoinTokenLeafNode, Account: "A"})
+	for i := 0; i < 2; i++ {
+		if jc, err := s.verifyJoinToken(token, JoinTokenLeafNode); err != nil || jc.Account != "A" {
+			t.Fatalf("Unexpected result: %+v, %v", jc, err)
+		}
+	}
+	if _, err := s.verifyJoinToken(token, JoinTokenRoute); err == nil {
+		t.Fatal("Expected error for a token of another kind")
+	}
+
+	token = issue(&JoinTokenRequest{Kind: JoinTokenRoute, OneTime: true})
+	if _, err := s.verifyJoinToken(token, JoinTokenRoute); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := s.verifyJoinToken(token, JoinTokenRoute); err == nil || !strings.Contains(err.Error(), "used") {
+		t.Fatalf("Expected error for a token already used, got %v", err)
+	}
+
+	// A token signed with another secret is rejected.
+	token, _, _ = IssueJoinToken(&JoinTokenOpts{Secret: "fedcba9876543210"}, &JoinTokenRequest{Kind: JoinTokenRoute})
+	if _, err := s.verifyJoinToken(token, JoinTokenRoute); err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("Expected signature error, got %v", err)
+	}
+
+	// Expired tokens are rejected.
+	claims, _ := json.Marshal(&joinTokenClaims{Kind: JoinTokenRoute, Expires: time.Now().Add(-time.Second).Unix()})
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+	token = joinTokenPrefix + payload + "." + signJoinToken(jt.Secret, payload)
+	if _, err := s.verifyJoinToken(token, JoinTokenRoute); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Fatalf("Expected expired error, got %v", err)
+	}
+
+	for _, req := range []*JoinTokenRequest{
+		{Kind: "gateway"},
+		{Kind: JoinTokenRoute, Account: "A"},
+		{Kind: JoinTokenRoute, TTL: 48 * time.Hour},
+	} {
+		if _, _, err := IssueJoinToken(jt, req); err == nil {
+			t.Fatalf("Expected error issuing %+v", req)
+		}
+	}
+}
+
+func TestJoinTokenRoute(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		cluster {
+			listen: "127.0.0.1:-1"
+			authorization { user: ruser, password: pwd }
+		}
+		join_tokens { secret: "0123456789abcdef", max_ttl: "1h" }
+	`))
+	defer os.Remove(conf)
+	s1, o1 := RunServerWithConfig(conf)
+	defer s1.Shutdown()
+
+	token, _, err := IssueJoinToken(o1.JoinTokens, &JoinTokenRequest{Kind: JoinTokenRoute, OneTime: true})
+	if err != nil {
+		t.Fatalf("Error issuing token: %v", err)
+	}
+	o2 := DefaultOptions()
+	o2.Cluster.Host = "127.0.0.1"
+	o2.Cluster.Port = -1
+	o2.Routes = RoutesFromStr(fmt.Sprintf("nats://%s@127.0.0.1:%d", token, o1.Cluster.Port))
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+	checkClusterFormed(t, s1, s2)
+
+	// The route is kept on reload, although the token has been used.
+	reloadUpdateConfig(t, s1, conf, `
+		listen: "127.0.0.1:-1"
+		cluster {
+			listen: "127.0.0.1:-1"
+			authorization { user: ruser, password: pwd }
+		}
+		join_tokens { secret: "0123456789abcdef", max_ttl: "2h" }
+	`)
+	time.Sleep(100 * time.Millisecond)
+	checkClusterFormed(t, s1, s2)
+	s2.Shutdown()
+
+	// The one-time token can not be used again.
+	o3 := DefaultOptions()
+	o3.Cluster.Host = "127.0.0.1"
+	o3.Cluster.Port = -1
+	o3.Routes = o2.Routes
+	s3 := RunServer(o3)
+	defer s3.Shutdown()
+	time.Sleep(250 * time.Millisecond)
+	if n := s1.NumRoutes(); n != 0 {
+		t.Fatalf("Expected no route, got %v", n)
+	}
+}
+
+func TestJoinTokenLeafNodeFromSystemRequest(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		accounts {
+			SYS { users: [{user: sys, password: pwd}] }
+			A { users: [{user: a, password: pwd}] }
+		}
+		leafnodes {
+			listen: "127.0.0.1:-1"
+			authorization { user: luser, password: pwd }
+		}
+		join_tokens { secret: "0123456789abcdef" }
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port))
+	defer nc.Close()
+	request := func(req *JoinTokenRequest) JoinTokenResponse {
+		t.Helper()
+		b, _ := json.Marshal(req)
+		msg, err := nc.Request(fmt.Sprintf(joinTokenReqSubj, s.ID()), b, time.Second)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		resp := JoinTokenResponse{}
+		if err := json.Unmarshal(msg.Data, &resp); err != nil {
+			t.Fatalf("Error unmarshalling response: %v", err)
+		}
+		return resp
+	}
+	if resp := request(&JoinTokenRequest{Kind: JoinTokenLeafNode, Account: "B"}); resp.Token != "" || !strings.Contains(resp.Error, "account") {
+		t.Fatalf("Expected error for unknown account, got %+v", resp)
+	}
+	resp := request(&JoinTokenRequest{Kind: JoinTokenLeafNode, Account: "A", TTL: time.Minute})
+	if resp.Error != "" || resp.Server != s.ID() || time.Until(resp.Expires) > time.Minute {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	lo := DefaultOptions()
+	u, _ := url.Parse(fmt.Sprintf("nats://%s@127.0.0.1:%d", resp.Token, opts.LeafNode.Port))
+	lo.LeafNode.Remotes = []*RemoteLeafOpts{{URLs: []*url.URL{u}}}
+	ln := RunServer(lo)
+	defer ln.Shutdown()
+	checkLeafNodeConnected(t, s)
+
+	// The leafnode is bound to the account of the token.
+	nca := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s:%d", opts.Host, opts.Port))
+	defer nca.Close()
+	sub := natsSubSync(t, nca, "foo")
+	natsFlush(t, nca)
+	ncl := natsConnect(t, fmt.Sprintf("nats://%s:%d", lo.Host, lo.Port))
+	defer ncl.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := ln.globalAccount().sl.Count(); n == 0 {
+			return fmt.Errorf("Expected interest to be propagated")
+		}
+		return nil
+	})
+	natsPub(t, ncl, "foo", []byte("hello"))
+	natsNexMsg(t, sub, time.Second)
+}
@@ -18,9 +18,11 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -28,6 +30,7 @@ import (
 	"time"
 
 	"github.com/nats-io/jwt"
+	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nkeys"
 )
 
@@ -1688,6 +1691,110 @@ func TestAccountURLResolverNoFetchOnReload(t *testing.T) {
 	}
 }
 
+func TestAccountURLResolverCache(t *testing.T) {
+	kp, _ := nkeys.FromSeed(oSeed)
+	pub, _ := kp.PublicKey()
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	ukp, _ := nkeys.CreateUser()
+	upub, _ := ukp.PublicKey()
+	nac := jwt.NewAccountClaims(apub)
+	ajwt, err := nac.Encode(kp)
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+
+	var mu sync.Mutex
+	down := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if down {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(ajwt))
+	}))
+	defer ts.Close()
+	setDown := func(d bool) {
+		mu.Lock()
+		down = d
+		mu.Unlock()
+	}
+
+	dir, err := ioutil.TempDir("", "resolver_cache")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: -1
+		trusted: %q
+		resolver: URL("%s/ngs/v1/accounts/jwt/")
+		resolver_cache { dir: %q, ttl: "1h" }
+	`, pub, ts.URL, dir)))
+	defer os.Remove(conf)
+
+	s, _ := RunServerWithConfig(conf)
+	if acc, _ := s.LookupAccount(apub); acc == nil {
+		t.Fatalf("Expected to receive an account")
+	}
+	s.Shutdown()
+	if _, err := os.Stat(filepath.Join(dir, apub+".jwt")); err != nil {
+		t.Fatalf("Expected account JWT to be cached: %v", err)
+	}
+
+	// The server starts and serves the account while the resolver is down.
+	setDown(true)
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+	acc, _ := s.LookupAccount(apub)
+	if acc == nil {
+		t.Fatalf("Expected to receive the cached account")
+	}
+	cr := s.AccountResolver().(*cachingAccResolver)
+	cr.mu.Lock()
+	_, stale := cr.stale[apub]
+	cr.mu.Unlock()
+	if !stale {
+		t.Fatalf("Expected account to be reconciled later")
+	}
+
+	// Users revoked while the resolver was down are once reconciled.
+	nac.Revoke(upub)
+	mu.Lock()
+	ajwt, err = nac.Encode(kp)
+	mu.Unlock()
+	if err != nil {
+		t.Fatalf("Error generating account JWT: %v", err)
+	}
+	s.reconcileResolverCache()
+	if acc.checkUserRevoked(upub) {
+		t.Fatalf("Expected user not to be revoked while the resolver is down")
+	}
+	setDown(false)
+	s.reconcileResolverCache()
+	if !acc.checkUserRevoked(upub) {
+		t.Fatalf("Expected user to be revoked once reconciled")
+	}
+
+	// Expired JWTs are not served.
+	setDown(true)
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, apub+".jwt"), old, old); err != nil {
+		t.Fatalf("Error changing times: %v", err)
+	}
+	if _, err := cr.Fetch(apub); err == nil {
+		t.Fatal("Expected expired account JWT not to be served")
+	}
+
+	// The cache requires a URL resolver.
+	opts := &Options{AccountResolver: &MemAccResolver{}, ResolverCache: &ResolverCacheOpts{Dir: dir}}
+	if err := validateOptions(opts); err == nil || !strings.Contains(err.Error(), "URL resolver") {
+		t.Fatalf("Expected error about the resolver, got %v", err)
+	}
+}
+
 func TestJWTUserSigningKey(t *testing.T) {
 	s := opTrustBasicSetup()
 	defer s.Shutdown()
@@ -2449,3 +2556,70 @@ func TestJWTAccountLimitsMaxConnsAfterExpired(t *testing.T) {
 		return nil
 	})
 }
+
+func TestJWTAccountTemplate(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		account_template {
+			max_connections: 1
+			max_payload: 512
+			exports: [{stream: "public.>"}, {service: "help", response: stream}]
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config file: %v", err)
+	}
+	at := opts.AccountTemplate
+	if at == nil || at.Limits.Conn != 1 || at.Limits.Payload != 512 || at.Limits.Subs != jwt.NoLimit || len(at.Exports) != 2 {
+		t.Fatalf("Unexpected template: %+v", at)
+	}
+	if _, err := NewServer(opts); err == nil || !strings.Contains(err.Error(), "resolver") {
+		t.Fatalf("Expected error without an account resolver, got %v", err)
+	}
+
+	kp, _ := nkeys.FromSeed(oSeed)
+	pub, _ := kp.PublicKey()
+	opts = DefaultOptions()
+	opts.TrustedKeys = []string{pub}
+	opts.AccountResolver = &MemAccResolver{}
+	opts.AccountTemplate = at
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	akp, _ := nkeys.CreateAccount()
+	apub, _ := akp.PublicKey()
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	nc, err := nats.Connect(url, createUserCreds(t, s, akp))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	acc, _ := s.LookupAccount(apub)
+	if acc == nil || !acc.isTemplate() || acc.MaxActiveConnections() != 1 {
+		t.Fatalf("Expected account from the template, got %+v", acc)
+	}
+	acc.mu.RLock()
+	mpay := acc.mpay
+	acc.mu.RUnlock()
+	if mpay != 512 {
+		t.Fatalf("Expected max payload of 512, got %v", mpay)
+	}
+	if !acc.IsExportService("help") || !acc.checkStreamExportApproved(s.globalAccount(), "public.foo", nil) {
+		t.Fatal("Expected exports of the template")
+	}
+	if nc2, err := nats.Connect(url, createUserCreds(t, s, akp)); err == nil {
+		nc2.Close()
+		t.Fatal("Expected connection limit of the template")
+	}
+
+	// The account JWT, once pushed, replaces the template.
+	nac := jwt.NewAccountClaims(apub)
+	ajwt, _ := nac.Encode(kp)
+	if err := s.updateAccountWithClaimJWT(acc, ajwt); err != nil {
+		t.Fatalf("Error updating account: %v", err)
+	}
+	if acc.isTemplate() || acc.Issuer != pub || acc.MaxActiveConnections() != -1 {
+		t.Fatalf("Expected account from the JWT, got %+v", acc)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stages of the read and write loops whose latency is sampled.
+const (
+	// Parsing and processing of a buffer read from a connection.
+	latencyStageParse = iota
+	// Match of the subject of a message published by a client.
+	latencyStageMatch
+	// Time between data being queued for a connection and written to it.
+	latencyStageOutbound
+	// Write of pending data to a connection.
+	latencyStageFlush
+	numLatencyStages
+)
+
+var latencyStageNames = [numLatencyStages]string{
+	latencyStageParse:    "parse",
+	latencyStageMatch:    "match",
+	latencyStageOutbound: "queue_outbound",
+	latencyStageFlush:    "flush",
+}
+
+// Bucket i of a latency histogram counts the durations under 1us << i,
+// the last one counts all the others.
+const latencyBuckets = 24
+
+// latencyHistogram is a histogram of durations updated atomically.
+type latencyHistogram struct {
+	buckets [latencyBuckets]uint64
+	sum     int64
+	max     int64
+}
+
+func (h *latencyHistogram) record(d time.Duration) {
+	i := 0
+	for bound := time.Microsecond; d >= bound && i < latencyBuckets-1; bound <<= 1 {
+		i++
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if int64(d) <= max || atomic.CompareAndSwapInt64(&h.max, max, int64(d)) {
+			break
+		}
+	}
+}
+
+// LatencyHistogram summarizes the sampled latencies of a stage. The
+// percentiles are the upper bound of the histogram bucket they fall in.
+type LatencyHistogram struct {
+	Count uint64        `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+func (h *latencyHistogram) snapshot() *LatencyHistogram {
+	var buckets [latencyBuckets]uint64
+	var count uint64
+	for i := range buckets {
+		buckets[i] = atomic.LoadUint64(&h.buckets[i])
+		count += buckets[i]
+	}
+	if count == 0 {
+		return nil
+	}
+	max := time.Duration(atomic.LoadInt64(&h.max))
+	lh := &LatencyHistogram{
+		Count: count,
+		Mean:  time.Duration(atomic.LoadInt64(&h.sum) / int64(count)),
+		Max:   max,
+	}
+	percentile := func(p uint64) time.Duration {
+		var n uint64
+		for i, c := range buckets {
+			if n += c; n*100 >= count*p {
+				if bound := time.Microsecond << uint(i); i < latencyBuckets-1 && bound < max {
+					return bound
+				}
+				return max
+			}
+		}
+		return max
+	}
+	lh.P50, lh.P90, lh.P99 = percentile(50), percentile(90), percentile(99)
+	return lh
+}
+
+// latencyStats are the latency histograms of the stages of the read and
+// write loops, in which one of every `every` events is timed.
+type latencyStats struct {
+	// Kept first for the alignment of the 64-bit atomics.
+	stages [numLatencyStages]latencyHistogram
+	every  uint32
+}
+
+// setLatencySampling sets the sampling of the stage latencies, 0 disables
+// it.
+func (s *Server) setLatencySampling(every int) {
+	if every < 0 {
+		every = 0
+	}
+	atomic.StoreUint32(&s.latency.every, uint32(every))
+}
+
+// sampleLatency returns true if the event counted by n has to be timed.
+// The counter is owned by the caller.
+func (s *Server) sampleLatency(n *uint32) bool {
+	if s == nil {
+		return false
+	}
+	every := atomic.LoadUint32(&s.latency.every)
+	if every == 0 {
+		return false
+	}
+	if *n++; *n < every {
+		return false
+	}
+	*n = 0
+	return true
+}
+
+func (s *Server) recordLatency(stage int, d time.Duration) {
+	s.latency.stages[stage].record(d)
+}
+
+// stageLatencies returns the summary of each stage with samples, nil if
+// there are none.
+func (s *Server) stageLatencies() map[string]*LatencyHistogram {
+	var m map[string]*LatencyHistogram
+	for i := range s.latency.stages {
+		if lh := s.latency.stages[i].snapshot(); lh != nil {
+			if m == nil {
+				m = make(map[string]*LatencyHistogram, numLatencyStages)
+			}
+			m[latencyStageNames[i]] = lh
+		}
+	}
+	return m
+}
@@ -54,6 +54,8 @@ type leaf struct {
 	smap map[string]int32
 	// We have any auth stuff here for solicited connections.
 	remote *leafNodeCfg
+	// Name of the cluster of the remote server, if any.
+	remoteCluster string
 }
 
 // Used for remote (solicited) leafnodes.
@@ -247,17 +249,26 @@ func (s *Server) connectToRemoteLeafNode(remote *leafNodeCfg, firstConnect bool)
 
 	const connErrFmt = "Error trying to connect as leafnode to remote server %q (attempt %v): %v"
 
+	retryName := remote.URLs[0].Host
+	defer s.connectRetryDone("leafnode", retryName)
+
 	attempts := 0
 	for s.isRunning() && s.remoteLeafNodeStillValid(remote) {
 		rURL := remote.pickNextURL()
-		url, err := s.getRandomIP(resolver, rURL.Host)
-		if err == nil {
-			var ipStr string
-			if url != rURL.Host {
-				ipStr = fmt.Sprintf(" (%s)", url)
+		var err error
+		if remote.Proxy != nil {
+			s.Debugf("Trying to connect as leafnode to remote server on %q through proxy %q", rURL.Host, remote.Proxy.Host)
+			conn, err = s.dialProxy("leafnode", remote.Proxy, rURL.Host, dialTimeout)
+		} else {
+			var addrs []string
+			if addrs, err = s.resolveOutbound(resolver, rURL.Host); err == nil {
+				var ipStr string
+				if addrs[0] != rURL.Host {
+					ipStr = fmt.Sprintf(" (%s)", addrs[0])
+				}
+				s.Debugf("Trying to connect as leafnode to remote server on %q%s", rURL.Host, ipStr)
+				conn, err = s.dialOutbound("leafnode", addrs, dialTimeout)
 			}
-			s.Debugf("Trying to connect as leafnode to remote server on %q%s", rURL.Host, ipStr)
-			conn, err = net.DialTimeout("tcp", url, dialTimeout)
 		}
 		if err != nil {
 			attempts++
@@ -266,10 +277,16 @@ func (s *Server) connectToRemoteLeafNode(remote *leafNodeCfg, firstConnect bool)
 			} else {
 				s.Debugf(connErrFmt, rURL.Host, attempts, err)
 			}
+			if remote.Retry.exhausted(attempts) {
+				s.Errorf("Giving up connecting as leafnode to remote server %q after %d attempts", retryName, attempts)
+				return
+			}
+			delay := remote.Retry.delay(reconnectDelay, attempts)
+			s.connectRetry("leafnode", retryName, attempts, err, delay)
 			select {
 			case <-s.quitCh:
 				return
-			case <-time.After(reconnectDelay):
+			case <-time.After(delay):
 				continue
 			}
 		}
@@ -315,6 +332,7 @@ func (cfg *leafNodeCfg) saveUserPassword(u *url.URL) {
 // a loop (until the server is shutdown) accepting incoming
 // leaf node connections from remote servers.
 func (s *Server) leafNodeAcceptLoop(ch chan struct{}) {
+	defer s.acceptLoopStarted()()
 	defer func() {
 		if ch != nil {
 			close(ch)
@@ -330,13 +348,13 @@ func (s *Server) leafNodeAcceptLoop(ch chan struct{}) {
 	}
 
 	hp := net.JoinHostPort(opts.LeafNode.Host, strconv.Itoa(port))
-	l, e := net.Listen("tcp", hp)
+	l, e := s.listenOrInherit(LeafNodeListener, hp)
 	if e != nil {
 		s.Fatalf("Error listening on leafnode port: %d - %v", opts.LeafNode.Port, e)
 		return
 	}
 
-	s.Noticef("Listening for leafnode connections on %s",
+	s.bannerf("Listening for leafnode connections on %s",
 		net.JoinHostPort(opts.LeafNode.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
 
 	s.mu.Lock()
@@ -352,6 +370,7 @@ func (s *Server) leafNodeAcceptLoop(ch chan struct{}) {
 		TLSVerify:    tlsVerify,
 		MaxPayload:   s.info.MaxPayload, // TODO(dlc) - Allow override?
 		Proto:        1,                 // Fixed for now.
+		Cluster:      clusterName(opts),
 	}
 	// If we have selected a random port...
 	if port == 0 {
@@ -398,10 +417,15 @@ func (s *Server) leafNodeAcceptLoop(ch chan struct{}) {
 	close(ch)
 	ch = nil
 
+	s.checkListenersReady()
+
 	tmpDelay := ACCEPT_MIN_SLEEP
 
+	defer s.acceptLoops.leafnode.done()
 	for s.isRunning() {
+		s.acceptLoops.leafnode.done()
 		conn, err := l.Accept()
+		s.acceptLoops.leafnode.start()
 		if err != nil {
 			tmpDelay = s.acceptError("LeafNode", err, tmpDelay)
 			continue
@@ -423,8 +447,9 @@ var credsRe = regexp.MustCompile(`\s*(?:(?:[-]{3,}[^\n]*[-]{3,}\n)(.+)(?:\n\s*[-
 func (c *client) sendLeafConnect(tlsRequired bool) {
 	// We support basic user/pass and operator based user JWT with signatures.
 	cinfo := leafConnectInfo{
-		TLS:  tlsRequired,
-		Name: c.srv.info.ID,
+		TLS:     tlsRequired,
+		Name:    c.srv.info.ID,
+		Cluster: clusterName(c.srv.getOpts()),
 	}
 
 	// Check for credentials first, that will take precedence..
@@ -555,6 +580,9 @@ func (s *Server) sendAsyncLeafNodeInfo() {
 func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 	// Snapshot server options.
 	opts := s.getOpts()
+	// Tune the socket, whether accepted or dialed.
+	s.applySocketOpts(conn, opts.LeafNode.Socket)
+	conn = s.faultConn(LEAF, conn)
 
 	maxPay := int32(opts.MaxPayload)
 	maxSubs := int32(opts.MaxSubs)
@@ -592,11 +620,20 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 		}
 		c.mu.Lock()
 		c.acc = acc
+		if remote.Permissions != nil {
+			c.setRoutePermissions(remote.Permissions)
+		}
 	} else {
 		c.flags.set(expectConnect)
 	}
 	c.mu.Unlock()
 
+	// Reject leaf nodes from source IPs banned after too many
+	// authentication failures.
+	if !solicited && c.authBannedReject() {
+		return nil
+	}
+
 	var nonce [nonceLen]byte
 
 	// Grab server variables
@@ -707,6 +744,7 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 
 			// Re-Grab lock
 			c.mu.Lock()
+			c.trackPeerCert()
 		}
 
 		c.sendLeafConnect(tlsRequired)
@@ -727,6 +765,13 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 		// this before it can initiate the TLS handshake..
 		c.sendProtoNow(bytes.Join(pcs, []byte(" ")))
 
+		// Reject leafnodes while too many have not authenticated yet.
+		if !c.trackPendingAuth(opts.LeafNode.MaxPendingAuth) {
+			c.mu.Unlock()
+			c.maxPendingAuthExceeded()
+			return nil
+		}
+
 		// Check to see if we need to spin up TLS.
 		if info.TLSRequired {
 			c.Debugf("Starting TLS leafnode server handshake")
@@ -753,6 +798,7 @@ func (s *Server) createLeafNode(conn net.Conn, remote *leafNodeCfg) *client {
 
 			// Indicate that handshake is complete (used in monitoring)
 			c.flags.set(handshakeComplete)
+			c.trackPeerCert()
 		}
 
 		// Leaf nodes will always require a CONNECT to let us know
@@ -825,6 +871,7 @@ func (c *client) processLeafnodeInfo(info *Info) error {
 		}
 		// Capture a nonce here.
 		c.nonce = []byte(info.Nonce)
+		c.leaf.remoteCluster = info.Cluster
 		if info.TLSRequired && c.leaf.remote != nil {
 			c.leaf.remote.TLS = true
 		}
@@ -915,10 +962,17 @@ func (s *Server) setLeafNodeInfoHostPortAndIP() error {
 func (s *Server) addLeafNodeConnection(c *client) {
 	c.mu.Lock()
 	cid := c.cid
+	c.enablePriorityLane()
 	c.mu.Unlock()
 	s.mu.Lock()
 	s.leafs[cid] = c
 	s.mu.Unlock()
+
+	// Reconcile the accounts served from the resolver cache while the hub
+	// could not be reached.
+	if c.isSolicitedLeafNode() {
+		go s.reconcileResolverCache()
+	}
 }
 
 func (s *Server) removeLeafNodeConnection(c *client) {
@@ -939,6 +993,9 @@ type leafConnectInfo struct {
 	Comp bool   `json:"compression,omitempty"`
 	Name string `json:"name,omitempty"`
 
+	// Name of the cluster of the soliciting server, if any.
+	Cluster string `json:"cluster,omitempty"`
+
 	// Just used to detect wrong connection attempts.
 	Gateway string `json:"gateway,omitempty"`
 }
@@ -971,11 +1028,25 @@ func (c *client) processLeafNodeConnect(s *Server, arg []byte, lang string) erro
 		return ErrWrongGateway
 	}
 
+	c.mu.Lock()
+	c.leaf.remoteCluster = proto.Cluster
+	c.mu.Unlock()
+
 	// Leaf Nodes do not do echo or verbose or pedantic.
 	c.opts.Verbose = false
 	c.opts.Echo = false
 	c.opts.Pedantic = false
 
+	// Permissions of the user, if any, take precedence over the ones
+	// defined for all accepted leaf node connections.
+	if perms := s.getOpts().LeafNode.Permissions; perms != nil {
+		c.mu.Lock()
+		if c.perms == nil {
+			c.setRoutePermissions(perms)
+		}
+		c.mu.Unlock()
+	}
+
 	// Create and initialize the smap since we know our bound account now.
 	lm := s.initLeafNodeSmap(c)
 	// We are good to go, send over all the bound account subscriptions.
@@ -1018,6 +1089,7 @@ func (s *Server) initLeafNodeSmap(c *client) int {
 	} else {
 		acc.sl.All(&subs)
 	}
+	subs = append(subs, acc.firehoseSubs()...)
 	// Since leaf nodes only send on interest, if the bound
 	// account has import services we need to send those over.
 	for isubj := range acc.imports.services {
@@ -1059,14 +1131,16 @@ func (s *Server) initLeafNodeSmap(c *client) int {
 	// Now walk the results and add them to our smap
 	c.mu.Lock()
 	for _, sub := range subs {
-		// We ignore ourselves here.
-		if c != sub.client {
+		// We ignore ourselves here, and the interest we can't import.
+		if c != sub.client && c.canImport(string(sub.subject)) {
 			c.leaf.smap[keyFromSub(sub)]++
 		}
 	}
 	// FIXME(dlc) - We need to update appropriately on an account claims update.
 	for _, isubj := range ims {
-		c.leaf.smap[isubj]++
+		if c.canImport(isubj) {
+			c.leaf.smap[isubj]++
+		}
 	}
 	// If we have gateways enabled we need to make sure the other side sends us responses
 	// that have been augmented from the original subscription.
@@ -1132,6 +1206,11 @@ func (c *client) updateSmap(sub *subscription, delta int32) {
 		c.mu.Unlock()
 		return
 	}
+	// Don't send interest for subjects we can't import.
+	if !c.canImport(string(sub.subject)) {
+		c.mu.Unlock()
+		return
+	}
 
 	n := c.leaf.smap[key]
 	// We will update if its a queue, if count is zero (or negative), or we were 0 and are N > 0.
@@ -1474,9 +1553,11 @@ func (c *client) processInboundLeafMsg(msg []byte) {
 		c.traceMsg(msg)
 	}
 
-	// Check pub permissions
+	// Check pub permissions. Interest sent to the remote may be wider than
+	// what we import, so drop the message instead of sending an error that
+	// would close the connection.
 	if c.perms != nil && (c.perms.pub.allow != nil || c.perms.pub.deny != nil) && !c.pubAllowed(string(c.pa.subject)) {
-		c.pubPermissionViolation(c.pa.subject)
+		c.Debugf("Not permitted to import %q, dropping message", c.pa.subject)
 		return
 	}
 
@@ -1488,6 +1569,8 @@ func (c *client) processInboundLeafMsg(msg []byte) {
 		return
 	}
 
+	acc.storeMsg(c.pa.subject, c.pa.reply, msg)
+
 	// Check to see if we need to map/route to another account.
 	if acc.imports.services != nil {
 		c.checkForImportServices(acc, msg)
@@ -1495,33 +1578,7 @@ func (c *client) processInboundLeafMsg(msg []byte) {
 
 	// Match the subscriptions. We will use our own L1 map if
 	// it's still valid, avoiding contention on the shared sublist.
-	var r *SublistResult
-	var ok bool
-
-	genid := atomic.LoadUint64(&c.acc.sl.genid)
-	if genid == c.in.genid && c.in.results != nil {
-		r, ok = c.in.results[string(c.pa.subject)]
-	} else {
-		// Reset our L1 completely.
-		c.in.results = make(map[string]*SublistResult)
-		c.in.genid = genid
-	}
-
-	// Go back to the sublist data structure.
-	if !ok {
-		r = c.acc.sl.Match(string(c.pa.subject))
-		c.in.results[string(c.pa.subject)] = r
-		// Prune the results cache. Keeps us from unbounded growth. Random delete.
-		if len(c.in.results) > maxResultCacheSize {
-			n := 0
-			for subject := range c.in.results {
-				delete(c.in.results, subject)
-				if n++; n > pruneSize {
-					break
-				}
-			}
-		}
-	}
+	r := c.matchL1()
 
 	// Collect queue names if needed.
 	var qnames [][]byte
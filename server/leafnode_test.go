@@ -17,8 +17,11 @@ import (
 	"bufio"
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
@@ -53,6 +56,184 @@ func (c *captureLeafNodeRandomIPLogger) Debugf(format string, v ...interface{})
 	}
 }
 
+// testProxy is a minimal HTTP CONNECT and SOCKS5 proxy.
+type testProxy struct {
+	t      *testing.T
+	l      net.Listener
+	user   string
+	pass   string
+	tunnel int32
+}
+
+func runTestProxy(t *testing.T, scheme, user, pass string) (*testProxy, *url.URL) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	p := &testProxy{t: t, l: l, user: user, pass: pass}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if scheme == ProxySchemeHTTP {
+				go p.handleHTTP(c)
+			} else {
+				go p.handleSOCKS5(c)
+			}
+		}
+	}()
+	u := &url.URL{Scheme: scheme, Host: l.Addr().String()}
+	if user != _EMPTY_ {
+		u.User = url.UserPassword(user, pass)
+	}
+	return p, u
+}
+
+func (p *testProxy) pipe(c net.Conn, r io.Reader, target string) {
+	tc, err := net.Dial("tcp", target)
+	if err != nil {
+		c.Close()
+		return
+	}
+	atomic.AddInt32(&p.tunnel, 1)
+	go func() {
+		io.Copy(tc, r)
+		tc.Close()
+	}()
+	io.Copy(c, tc)
+	c.Close()
+}
+
+func (p *testProxy) handleHTTP(c net.Conn) {
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect {
+		c.Close()
+		return
+	}
+	if p.user != _EMPTY_ {
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.user+":"+p.pass))
+		if req.Header.Get("Proxy-Authorization") != auth {
+			c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			c.Close()
+			return
+		}
+	}
+	c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	p.pipe(c, br, req.Host)
+}
+
+func (p *testProxy) handleSOCKS5(c net.Conn) {
+	buf := make([]byte, 256)
+	fail := func() { c.Close() }
+	if _, err := io.ReadFull(c, buf[:2]); err != nil {
+		fail()
+		return
+	}
+	if _, err := io.ReadFull(c, buf[:buf[1]]); err != nil {
+		fail()
+		return
+	}
+	if p.user == _EMPTY_ {
+		c.Write([]byte{5, 0})
+	} else {
+		c.Write([]byte{5, 2})
+		if _, err := io.ReadFull(c, buf[:2]); err != nil {
+			fail()
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(c, user)
+		io.ReadFull(c, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(c, pass)
+		if string(user) != p.user || string(pass) != p.pass {
+			c.Write([]byte{1, 1})
+			fail()
+			return
+		}
+		c.Write([]byte{1, 0})
+	}
+	if _, err := io.ReadFull(c, buf[:4]); err != nil || buf[3] != 3 {
+		fail()
+		return
+	}
+	io.ReadFull(c, buf[:1])
+	host := make([]byte, buf[0])
+	io.ReadFull(c, host)
+	io.ReadFull(c, buf[:2])
+	port := int(buf[0])<<8 | int(buf[1])
+	c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	p.pipe(c, c, net.JoinHostPort(string(host), fmt.Sprintf("%d", port)))
+}
+
+func TestLeafNodeRemoteProxy(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		leafnodes {
+			remotes [{url: "nats://127.0.0.1:7422", proxy: "ftp://127.0.0.1:21"}]
+		}
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "invalid proxy scheme") {
+		t.Fatalf("Expected error about proxy scheme, got %v", err)
+	}
+
+	ob := DefaultOptions()
+	ob.LeafNode.Host = "127.0.0.1"
+	ob.LeafNode.Port = -1
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+
+	for _, test := range []struct {
+		name   string
+		scheme string
+		user   string
+		pass   string
+	}{
+		{"http", ProxySchemeHTTP, _EMPTY_, _EMPTY_},
+		{"http auth", ProxySchemeHTTP, "user", "pwd"},
+		{"socks5", ProxySchemeSOCKS5, _EMPTY_, _EMPTY_},
+		{"socks5 auth", ProxySchemeSOCKS5, "user", "pwd"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p, pu := runTestProxy(t, test.scheme, test.user, test.pass)
+			defer p.l.Close()
+
+			u, _ := url.Parse(fmt.Sprintf("nats://localhost:%d", ob.LeafNode.Port))
+			oa := DefaultOptions()
+			oa.LeafNode.ReconnectInterval = 50 * time.Millisecond
+			oa.LeafNode.Remotes = []*RemoteLeafOpts{{URLs: []*url.URL{u}, Proxy: pu}}
+			sa := RunServer(oa)
+			defer sa.Shutdown()
+
+			checkLeafNodeConnected(t, sa)
+			checkLeafNodeConnected(t, sb)
+			if n := atomic.LoadInt32(&p.tunnel); n != 1 {
+				t.Fatalf("Expected connection through the proxy, got %v", n)
+			}
+
+			// Wrong credentials are rejected by the proxy.
+			if test.user != _EMPTY_ {
+				bad := *pu
+				bad.User = url.UserPassword("user", "bad")
+				if _, err := sa.dialProxy("leafnode", &bad, u.Host, time.Second); err == nil {
+					t.Fatal("Expected dial to fail")
+				}
+			}
+			sa.Shutdown()
+			checkFor(t, time.Second, 15*time.Millisecond, func() error {
+				if n := sb.NumLeafNodes(); n != 0 {
+					return fmt.Errorf("Expected no leafnode, got %v", n)
+				}
+				return nil
+			})
+		})
+	}
+}
+
 func TestLeafNodeRandomIP(t *testing.T) {
 	u, err := url.Parse("nats://hostname_to_resolve:1234")
 	if err != nil {
@@ -949,3 +1130,199 @@ func TestLeafNodeRemoteWrongPort(t *testing.T) {
 		})
 	}
 }
+
+func TestLeafNodePermissions(t *testing.T) {
+	conf1 := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		leafnodes {
+			listen: "127.0.0.1:-1"
+			permissions {
+				import: "up.>"
+				export: "down.>"
+			}
+		}
+	`))
+	defer os.Remove(conf1)
+	s1, o1 := RunServerWithConfig(conf1)
+	defer s1.Shutdown()
+
+	if p := o1.LeafNode.Permissions; p == nil || p.Import == nil || p.Export == nil ||
+		p.Import.Allow[0] != "up.>" || p.Export.Allow[0] != "down.>" {
+		t.Fatalf("Unexpected leafnode permissions: %+v", p)
+	}
+
+	conf2 := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		leafnodes {
+			remotes = [{
+				url: "nats-leaf://127.0.0.1:%d"
+				permissions { export: { deny: "up.bar" } }
+			}]
+		}
+	`, o1.LeafNode.Port)))
+	defer os.Remove(conf2)
+	s2, o2 := RunServerWithConfig(conf2)
+	defer s2.Shutdown()
+
+	if p := o2.LeafNode.Remotes[0].Permissions; p == nil || p.Export == nil || p.Export.Deny[0] != "up.bar" {
+		t.Fatalf("Unexpected remote leafnode permissions: %+v", p)
+	}
+
+	checkLeafNodeConnected(t, s1)
+	checkLeafNodeConnected(t, s2)
+
+	hub := natsConnect(t, s1.ClientURL())
+	defer hub.Close()
+	edge := natsConnect(t, s2.ClientURL())
+	defer edge.Close()
+
+	hubSub := natsSubSync(t, hub, ">")
+	natsFlush(t, hub)
+	for _, subj := range []string{"up.foo", "up.bar", "other.foo"} {
+		natsSubSync(t, hub, subj)
+	}
+	natsFlush(t, hub)
+	edgeSub := natsSubSync(t, edge, ">")
+	natsFlush(t, edge)
+	for _, subj := range []string{"down.foo", "secret.foo"} {
+		natsSubSync(t, edge, subj)
+	}
+	natsFlush(t, edge)
+
+	// Wait for the interest that is allowed to cross the leafnode.
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if r := s2.globalAccount().sl.Match("up.foo"); len(r.psubs) != 2 {
+			return fmt.Errorf("Expected interest on up.foo in the leaf server")
+		}
+		if r := s1.globalAccount().sl.Match("down.foo"); len(r.psubs) != 2 {
+			return fmt.Errorf("Expected interest on down.foo in the hub server")
+		}
+		return nil
+	})
+	// Interest on the hub that the hub doesn't import, or that the remote
+	// doesn't export, is not sent to the leaf server.
+	for _, subj := range []string{"other.foo", "up.bar"} {
+		if r := s2.globalAccount().sl.Match(subj); len(r.psubs) != 1 {
+			t.Fatalf("Expected no hub interest on %q in the leaf server, got %d subs", subj, len(r.psubs))
+		}
+	}
+
+	// Only the permitted messages flow in each direction.
+	for _, subj := range []string{"other.foo", "up.bar", "up.foo"} {
+		natsPub(t, edge, subj, []byte("hello"))
+	}
+	natsFlush(t, edge)
+	if msg := natsNexMsg(t, hubSub, time.Second); msg.Subject != "up.foo" {
+		t.Fatalf("Expected message on up.foo, got %q", msg.Subject)
+	}
+	for _, subj := range []string{"secret.foo", "down.foo"} {
+		natsPub(t, hub, subj, []byte("hello"))
+	}
+	natsFlush(t, hub)
+	for i := 0; i < 3; i++ {
+		// The edge client gets its own messages first.
+		natsNexMsg(t, edgeSub, time.Second)
+	}
+	if msg := natsNexMsg(t, edgeSub, time.Second); msg.Subject != "down.foo" {
+		t.Fatalf("Expected message on down.foo, got %q", msg.Subject)
+	}
+	for i := 0; i < 2; i++ {
+		// The hub client gets its own messages.
+		natsNexMsg(t, hubSub, time.Second)
+	}
+	if msg, err := hubSub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected no more messages on the hub, got %v, %v", msg, err)
+	}
+	if msg, err := edgeSub.NextMsg(100 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected no more messages on the leaf, got %v, %v", msg, err)
+	}
+	if s1.NumLeafNodes() != 1 {
+		t.Fatalf("Expected leafnode connection to still be up")
+	}
+}
+
+func TestLeafNodeSplitHorizon(t *testing.T) {
+	// Hub cluster of two servers.
+	oa := DefaultOptions()
+	oa.Cluster.Name = "HUB"
+	oa.Cluster.Host = "127.0.0.1"
+	oa.Cluster.Port = -1
+	oa.LeafNode.Host = "127.0.0.1"
+	oa.LeafNode.Port = -1
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+
+	ob := DefaultOptions()
+	ob.Cluster.Name = "HUB"
+	ob.Cluster.Host = "127.0.0.1"
+	ob.Cluster.Port = -1
+	ob.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", oa.Cluster.Port))
+	ob.LeafNode.Host = "127.0.0.1"
+	ob.LeafNode.Port = -1
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+
+	// Spoke cluster of two servers, each with a leafnode connection to a
+	// different server of the hub.
+	spokeOpts := func(leafPort int) *Options {
+		o := DefaultOptions()
+		o.Cluster.Name = "SPOKE"
+		o.Cluster.Host = "127.0.0.1"
+		o.Cluster.Port = -1
+		u, _ := url.Parse(fmt.Sprintf("nats://127.0.0.1:%d", leafPort))
+		o.LeafNode.ReconnectInterval = 10 * time.Millisecond
+		o.LeafNode.Remotes = []*RemoteLeafOpts{{URLs: []*url.URL{u}}}
+		return o
+	}
+	o1 := spokeOpts(oa.LeafNode.Port)
+	s1 := RunServer(o1)
+	defer s1.Shutdown()
+	o2 := spokeOpts(ob.LeafNode.Port)
+	o2.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", o1.Cluster.Port))
+	s2 := RunServer(o2)
+	defer s2.Shutdown()
+
+	checkClusterFormed(t, s1, s2)
+	checkLeafNodeConnected(t, sa)
+	checkLeafNodeConnected(t, sb)
+
+	nc2 := natsConnect(t, s2.ClientURL())
+	defer nc2.Close()
+	sub := natsSubSync(t, nc2, "foo")
+	natsFlush(t, nc2)
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		for _, s := range []*Server{sa, sb, s1} {
+			if r := s.globalAccount().sl.Match("foo"); len(r.psubs) == 0 {
+				return fmt.Errorf("No interest on foo in %s", s.ID())
+			}
+		}
+		return nil
+	})
+
+	nc1 := natsConnect(t, s1.ClientURL())
+	defer nc1.Close()
+	natsPub(t, nc1, "foo", []byte("hello"))
+	natsFlush(t, nc1)
+
+	// The message goes from S1 to S2 over the spoke route, and from S1 to
+	// A over the leafnode connection. B gets it from A over the hub route
+	// but does not send it back to the spoke over its leafnode connection.
+	natsNexMsg(t, sub, time.Second)
+	if msg, err := sub.NextMsg(250 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected a single message, got %v, %v", msg, err)
+	}
+	if n := atomic.LoadInt64(&sb.suppressedLoops); n == 0 {
+		t.Fatalf("Expected suppressed loops to be counted")
+	}
+}
+
+func TestLeafNodeClusterNameWithSpaces(t *testing.T) {
+	o := DefaultOptions()
+	o.Cluster.Name = "MY CLUSTER"
+	if _, err := NewServer(o); err == nil || !strings.Contains(err.Error(), "can not contain spaces") {
+		t.Fatalf("Expected error about cluster name, got %v", err)
+	}
+}
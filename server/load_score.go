@@ -0,0 +1,213 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server/pse"
+)
+
+// DEFAULT_LOAD_REPORT_INTERVAL is the default interval at which servers
+// report their load score to the routes when the connect URLs are ordered
+// by load.
+const DEFAULT_LOAD_REPORT_INTERVAL = 5 * time.Second
+
+const (
+	// ConnectURLsShuffle shuffles the connect URLs sent to each client.
+	ConnectURLsShuffle = "shuffle"
+	// ConnectURLsLoad orders the connect URLs sent to each client randomly,
+	// with the less loaded servers more likely to come first.
+	ConnectURLsLoad = "load"
+)
+
+// The load scores sent to clients are updated only when one of them
+// changes by at least that much, to not flood clients with INFO protocols.
+const loadScoreMinChange = 10
+
+// The weight of the connect URLs of servers whose load is not known.
+const loadScoreUnknown = 50
+
+// validateConnectURLsOrder checks the order of the connect URLs in the
+// cluster options.
+func validateConnectURLsOrder(o *Options) error {
+	switch o.Cluster.ConnectURLsOrder {
+	case _EMPTY_, ConnectURLsShuffle, ConnectURLsLoad:
+		return nil
+	}
+	return fmt.Errorf("invalid cluster connect_urls_order %q, expected %q or %q",
+		o.Cluster.ConnectURLsOrder, ConnectURLsShuffle, ConnectURLsLoad)
+}
+
+// loadReportInterval returns the interval at which the load score is
+// reported to the routes, 0 if it is not.
+func (c *ClusterOpts) loadReportInterval() time.Duration {
+	if c.LoadReportInterval > 0 {
+		return c.LoadReportInterval
+	}
+	if c.ConnectURLsOrder == ConnectURLsLoad {
+		return DEFAULT_LOAD_REPORT_INTERVAL
+	}
+	return 0
+}
+
+// startLoadReports starts the routine that reports the load score of
+// this server to the routes, if enabled.
+func (s *Server) startLoadReports() {
+	interval := s.getOpts().Cluster.loadReportInterval()
+	if interval <= 0 {
+		return
+	}
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		s.reportLoad()
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.reportLoad()
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// loadScore returns the load of this server from 0 to 100, the highest of
+// the CPU usage over all the cores available to it and of the number of clients over the
+// maximum number of connections.
+func (s *Server) loadScore() int {
+	var pcpu float64
+	var rss, vss int64
+	pse.ProcUsage(&pcpu, &rss, &vss)
+
+	score := pcpu / s.containerLimits.cpus()
+	if max := s.getOpts().MaxConn; max > 0 {
+		if conns := float64(s.NumClients()) * 100 / float64(max); conns > score {
+			score = conns
+		}
+	}
+	return int(math.Max(0, math.Min(100, score)))
+}
+
+// reportLoad sends the load score of this server to the routes in an
+// INFO protocol. Servers that do not know about the load score simply
+// process it as an update of the route INFO that changes nothing.
+func (s *Server) reportLoad() {
+	score := s.loadScore()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return
+	}
+	s.loadScoreLast = score
+	info := s.routeInfo
+	info.LoadScore = &score
+	b, _ := json.Marshal(&info)
+	proto := []byte(fmt.Sprintf(InfoProto, b))
+	for _, r := range s.routes {
+		r.mu.Lock()
+		r.enqueueProto(proto)
+		r.mu.Unlock()
+	}
+	s.updateConnectLoads()
+}
+
+// processRouteLoadScore stores the load score reported by a route.
+func (c *client) processRouteLoadScore(score int) {
+	c.route.loadScore = score
+	c.route.hasLoadScore = true
+	c.mu.Unlock()
+
+	s := c.srv
+	s.mu.Lock()
+	s.updateConnectLoads()
+	s.mu.Unlock()
+}
+
+// updateConnectLoads maps the connect URLs to the load score of their
+// server and sends it to the clients if it changed significantly.
+// Server lock is held on entry.
+func (s *Server) updateConnectLoads() {
+	loads := make(map[string]int)
+	if s.loadScoreLast >= 0 {
+		for _, url := range s.clientConnectURLs {
+			loads[url] = s.loadScoreLast
+		}
+	}
+	for _, r := range s.routes {
+		r.mu.Lock()
+		if r.route.hasLoadScore {
+			for _, url := range r.route.connectURLs {
+				loads[url] = r.route.loadScore
+			}
+		}
+		r.mu.Unlock()
+	}
+	if !connectLoadsChanged(s.info.ConnectLoads, loads) {
+		return
+	}
+	// The map is replaced, never modified, so copies of the INFO can
+	// share it.
+	s.info.ConnectLoads = loads
+	s.sendAsyncInfoToClients()
+}
+
+func connectLoadsChanged(old, new map[string]int) bool {
+	if len(old) != len(new) {
+		return true
+	}
+	for url, score := range new {
+		prev, ok := old[url]
+		if !ok || prev-score >= loadScoreMinChange || score-prev >= loadScoreMinChange {
+			return true
+		}
+	}
+	return false
+}
+
+// orderConnectURLs orders the connect URLs of the INFO sent to a client,
+// so that clients that try them in order spread over the cluster.
+func orderConnectURLs(order string, info *Info) {
+	urls := info.ClientConnectURLs
+	switch order {
+	case ConnectURLsShuffle:
+		rand.Shuffle(len(urls), func(i, j int) {
+			urls[i], urls[j] = urls[j], urls[i]
+		})
+	case ConnectURLsLoad:
+		// Weighted random order, where the weight of a URL grows as the
+		// load of its server drops, so that clients do not all rush to
+		// the least loaded server.
+		keys := make(map[string]float64, len(urls))
+		for _, url := range urls {
+			score, ok := info.ConnectLoads[url]
+			if !ok {
+				score = loadScoreUnknown
+			}
+			keys[url] = math.Pow(rand.Float64(), 1/float64(101-score))
+		}
+		sort.SliceStable(urls, func(i, j int) bool {
+			return keys[urls[i]] > keys[urls[j]]
+		})
+	}
+}
@@ -63,17 +63,19 @@ func (s *Server) ConfigureLogger() {
 		syslog = true
 	}
 
+	// The debug and trace levels are enforced by the server, so that they
+	// can be changed at runtime, see SetLogLevel.
 	if opts.LogFile != "" {
-		log = srvlog.NewFileLogger(opts.LogFile, opts.Logtime, opts.Debug, opts.Trace, true)
+		log = srvlog.NewFileLogger(opts.LogFile, opts.Logtime, true, true, true)
 		if opts.LogSizeLimit > 0 {
 			if l, ok := log.(*srvlog.Logger); ok {
 				l.SetSizeLimit(opts.LogSizeLimit)
 			}
 		}
 	} else if opts.RemoteSyslog != "" {
-		log = srvlog.NewRemoteSysLogger(opts.RemoteSyslog, opts.Debug, opts.Trace)
+		log = srvlog.NewRemoteSysLogger(opts.RemoteSyslog, true, true)
 	} else if syslog {
-		log = srvlog.NewSysLogger(opts.Debug, opts.Trace)
+		log = srvlog.NewSysLogger(true, true)
 	} else {
 		colors := true
 		// Check to see if stderr is being redirected and if so turn off color
@@ -82,7 +84,7 @@ func (s *Server) ConfigureLogger() {
 		if err != nil || (stat.Mode()&os.ModeCharDevice) == 0 {
 			colors = false
 		}
-		log = srvlog.NewStdLogger(opts.Logtime, opts.Debug, opts.Trace, colors, true)
+		log = srvlog.NewStdLogger(opts.Logtime, true, true, colors, true)
 	}
 
 	s.SetLogger(log, opts.Debug, opts.Trace)
@@ -137,9 +139,10 @@ func (s *Server) ReOpenLogFile() {
 	if opts.LogFile == "" {
 		s.Noticef("File log re-open ignored, not a file logger")
 	} else {
-		fileLog := srvlog.NewFileLogger(opts.LogFile,
-			opts.Logtime, opts.Debug, opts.Trace, true)
-		s.SetLogger(fileLog, opts.Debug, opts.Trace)
+		fileLog := srvlog.NewFileLogger(opts.LogFile, opts.Logtime, true, true, true)
+		// Keep the levels that may have been changed at runtime.
+		levels := s.logLevels()
+		s.SetLogger(fileLog, levels&logLevelDebug != 0, levels&logLevelTrace != 0)
 		s.Noticef("File log re-opened")
 	}
 }
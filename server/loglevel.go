@@ -0,0 +1,251 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Bits of the log levels changed at runtime.
+const (
+	logLevelDebug int32 = 1 << iota
+	logLevelTrace
+)
+
+// LogLevelRequest changes the debug and trace logging at runtime, for the
+// whole server or only for some connections.
+type LogLevelRequest struct {
+	// Debug, if set, enables or disables the debug logging.
+	Debug *bool `json:"debug,omitempty"`
+	// Trace, if set, enables or disables the trace logging.
+	Trace *bool `json:"trace,omitempty"`
+	// Kind restricts the change to the connections of this kind, that is
+	// "client", "route", "gateway" or "leafnode", including the ones
+	// created afterwards.
+	Kind string `json:"kind,omitempty"`
+	// CID restricts the change to this connection.
+	CID uint64 `json:"cid,omitempty"`
+	// Timeout after which the levels in place before the change are
+	// restored, the change is kept if 0.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// LogLevelResponse is the response to a log level request, with the
+// levels now in place for the selected scope.
+type LogLevelResponse struct {
+	Server  string     `json:"server_id"`
+	Debug   bool       `json:"debug"`
+	Trace   bool       `json:"trace"`
+	Kind    string     `json:"kind,omitempty"`
+	CID     uint64     `json:"cid,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// Connection kinds that log levels can be restricted to.
+var logLevelKinds = map[string]int{
+	"client":   CLIENT,
+	"route":    ROUTER,
+	"gateway":  GATEWAY,
+	"leafnode": LEAF,
+}
+
+// apply returns the levels after the change of the request.
+func (r *LogLevelRequest) apply(levels int32) int32 {
+	set := func(bit int32, v *bool) {
+		if v == nil {
+			return
+		}
+		if *v {
+			levels |= bit
+		} else {
+			levels &^= bit
+		}
+	}
+	set(logLevelDebug, r.Debug)
+	set(logLevelTrace, r.Trace)
+	return levels
+}
+
+// SetLogLevel applies the log level change of the request. Changes
+// restricted to connections only enable debug or trace logging on top of
+// the server levels. The server levels are reset to the configured ones
+// on a logging configuration reload.
+func (s *Server) SetLogLevel(req *LogLevelRequest) (*LogLevelResponse, error) {
+	if req.Debug == nil && req.Trace == nil {
+		return nil, errors.New("debug or trace is required")
+	}
+	if req.Kind != _EMPTY_ && req.CID != 0 {
+		return nil, errors.New("kind and cid can not be both set")
+	}
+	if req.Timeout < 0 {
+		return nil, errors.New("timeout can not be negative")
+	}
+	resp := &LogLevelResponse{Server: s.ID(), Kind: req.Kind, CID: req.CID}
+	var levels int32
+	var restore func()
+	switch {
+	case req.Kind != _EMPTY_:
+		kind, ok := logLevelKinds[strings.ToLower(req.Kind)]
+		if !ok {
+			return nil, fmt.Errorf("invalid kind %q", req.Kind)
+		}
+		prev := atomic.LoadInt32(&s.logging.kinds[kind])
+		levels = req.apply(prev)
+		s.setKindLogLevel(kind, levels)
+		restore = func() { s.setKindLogLevel(kind, prev) }
+	case req.CID != 0:
+		c := s.logLevelConn(req.CID)
+		if c == nil {
+			return nil, fmt.Errorf("no connection with cid %d", req.CID)
+		}
+		prev := atomic.LoadInt32(&c.logLevel)
+		levels = req.apply(prev)
+		atomic.StoreInt32(&c.logLevel, levels)
+		restore = func() { atomic.StoreInt32(&c.logLevel, prev) }
+	default:
+		prev := s.logLevels()
+		levels = req.apply(prev)
+		s.setLogLevels(levels)
+		restore = func() { s.setLogLevels(prev) }
+	}
+	resp.Debug = levels&logLevelDebug != 0
+	resp.Trace = levels&logLevelTrace != 0
+	if req.Timeout > 0 {
+		expires := time.Now().Add(req.Timeout)
+		resp.Expires = &expires
+		time.AfterFunc(req.Timeout, func() {
+			restore()
+			s.Noticef("Log levels restored after %v", req.Timeout)
+		})
+	}
+	s.Noticef("Log levels changed: debug=%v trace=%v kind=%q cid=%d timeout=%v",
+		resp.Debug, resp.Trace, req.Kind, req.CID, req.Timeout)
+	return resp, nil
+}
+
+// logLevels returns the server log levels.
+func (s *Server) logLevels() int32 {
+	var levels int32
+	if atomic.LoadInt32(&s.logging.debug) != 0 {
+		levels |= logLevelDebug
+	}
+	if atomic.LoadInt32(&s.logging.trace) != 0 {
+		levels |= logLevelTrace
+	}
+	return levels
+}
+
+// setLogLevels sets the server log levels.
+func (s *Server) setLogLevels(levels int32) {
+	var debug, trace int32
+	if levels&logLevelDebug != 0 {
+		debug = 1
+	}
+	if levels&logLevelTrace != 0 {
+		trace = 1
+	}
+	atomic.StoreInt32(&s.logging.debug, debug)
+	atomic.StoreInt32(&s.logging.trace, trace)
+}
+
+// setKindLogLevel sets the levels of the connections of this kind.
+func (s *Server) setKindLogLevel(kind int, levels int32) {
+	atomic.StoreInt32(&s.logging.kinds[kind], levels)
+	var conns []*client
+	s.mu.Lock()
+	switch kind {
+	case CLIENT:
+		for _, c := range s.clients {
+			conns = append(conns, c)
+		}
+	case ROUTER:
+		for _, c := range s.routes {
+			conns = append(conns, c)
+		}
+	case LEAF:
+		for _, c := range s.leafs {
+			conns = append(conns, c)
+		}
+	}
+	s.mu.Unlock()
+	if kind == GATEWAY {
+		s.getOutboundGatewayConnections(&conns)
+		s.getInboundGatewayConnections(&conns)
+	}
+	for _, c := range conns {
+		atomic.StoreInt32(&c.logLevel, levels)
+	}
+}
+
+// logLevelConn returns the connection of any kind with this cid.
+func (s *Server) logLevelConn(cid uint64) *client {
+	s.mu.Lock()
+	c := s.clients[cid]
+	if c == nil {
+		c = s.routes[cid]
+	}
+	if c == nil {
+		c = s.leafs[cid]
+	}
+	s.mu.Unlock()
+	if c != nil {
+		return c
+	}
+	var gws []*client
+	s.getOutboundGatewayConnections(&gws)
+	s.getInboundGatewayConnections(&gws)
+	for _, gw := range gws {
+		if gw.cid == cid {
+			return gw
+		}
+	}
+	return nil
+}
+
+// syncTraceLevel updates the trace flag of the connection after a change
+// of the trace level.
+// This is invoked from the readLoop only.
+func (c *client) syncTraceLevel() {
+	trace := atomic.LoadInt32(&c.srv.logging.trace) != 0 || atomic.LoadInt32(&c.logLevel)&logLevelTrace != 0
+	if trace != c.trace {
+		c.mu.Lock()
+		c.trace = trace
+		c.mu.Unlock()
+	}
+}
+
+// logLevelReq is a request to change the log levels.
+func (s *Server) logLevelReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	resp := &LogLevelResponse{Server: s.ID()}
+	req := &LogLevelRequest{}
+	if err := json.Unmarshal(msg, req); err != nil {
+		resp.Error = fmt.Sprintf("Error unmarshalling log level request: %v", err)
+	} else if r, err := s.SetLogLevel(req); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp = r
+	}
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, nil, resp)
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often the memory used by connections is checked when
+	// a memory limit is configured.
+	memoryCheckInterval = 250 * time.Millisecond
+
+	// Reads from clients are paused when the memory used by connections
+	// is above this percentage of the limit, and resumed when below.
+	memoryPausePercent = 90
+
+	// How long a paused readLoop waits before checking again.
+	memoryPauseWait = 10 * time.Millisecond
+
+	// Number of consecutive checks under memory pressure after which
+	// clients are closed even if the usage is not above the limit, since
+	// pausing reads did not help.
+	memoryShedChecks = 4
+)
+
+// memoryUsage is the memory used by a connection.
+type memoryUsage struct {
+	c    *client
+	used int64
+}
+
+// startMemoryMonitor starts the routine that tracks the memory used by
+// connections, that is, pending outbound data and read buffers, and sheds
+// load when it goes over the configured limit. It does nothing if already
+// started.
+func (s *Server) startMemoryMonitor() {
+	s.mu.Lock()
+	if s.memMonStarted || s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+	s.memMonStarted = true
+	s.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		t := time.NewTicker(memoryCheckInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.checkMemoryPressure(s.getOpts().MaxMemory)
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// checkMemoryPressure computes the memory used by all connections. Reads
+// from clients are paused when above memoryPausePercent of the limit. When
+// above the limit, or if pausing reads did not help after memoryShedChecks
+// checks, clients with the most pending data are closed until the usage
+// goes back below memoryPausePercent of the limit.
+// This is invoked from the memory monitor routine only.
+func (s *Server) checkMemoryPressure(limit int64) {
+	var conns []*client
+	s.mu.Lock()
+	for _, c := range s.clients {
+		conns = append(conns, c)
+	}
+	for _, c := range s.routes {
+		conns = append(conns, c)
+	}
+	for _, c := range s.leafs {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	s.gateway.RLock()
+	for _, c := range s.gateway.in {
+		conns = append(conns, c)
+	}
+	for _, c := range s.gateway.outo {
+		conns = append(conns, c)
+	}
+	s.gateway.RUnlock()
+
+	var total int64
+	var clients []memoryUsage
+	for _, c := range conns {
+		c.mu.Lock()
+		used := c.out.pb + int64(c.in.rsz)
+		kind := c.kind
+		c.mu.Unlock()
+		total += used
+		if kind == CLIENT {
+			clients = append(clients, memoryUsage{c, used})
+		}
+	}
+	atomic.StoreInt64(&s.memUsed, total)
+
+	if limit <= 0 {
+		s.setMemoryPressure(false, total, limit)
+		return
+	}
+	threshold := limit / 100 * memoryPausePercent
+	if total > threshold {
+		s.memPressureChecks++
+	} else {
+		s.memPressureChecks = 0
+	}
+
+	// Shed the worst offenders if needed.
+	if total > limit || s.memPressureChecks > memoryShedChecks {
+		s.memPressureChecks = 0
+		sort.Slice(clients, func(i, j int) bool { return clients[i].used > clients[j].used })
+		for _, mu := range clients {
+			if total <= threshold {
+				break
+			}
+			mu.c.Warnf("Closing connection using %d bytes: memory usage of %d bytes is too close to the limit of %d bytes",
+				mu.used, total, limit)
+			mu.c.closeConnection(MemoryPressure)
+			total -= mu.used
+		}
+	}
+	s.setMemoryPressure(total > threshold, total, limit)
+}
+
+// setMemoryPressure sets or clears the memory pressure state, which pauses
+// reads from clients.
+func (s *Server) setMemoryPressure(on bool, used, limit int64) {
+	if on {
+		if atomic.CompareAndSwapInt32(&s.memPressure, 0, 1) {
+			s.Warnf("Memory usage of %d bytes is close to the limit of %d bytes, pausing reads from clients", used, limit)
+		}
+	} else if atomic.CompareAndSwapInt32(&s.memPressure, 1, 0) {
+		s.Noticef("Memory usage of %d bytes is back under control, resuming reads from clients", used)
+	}
+}
+
+// waitForMemory blocks the readLoop of a client while the server is
+// under memory pressure, unless the client is closed or the server
+// is shutdown.
+func (c *client) waitForMemory(s *Server) {
+	for atomic.LoadInt32(&s.memPressure) == 1 {
+		select {
+		case <-time.After(memoryPauseWait):
+		case <-s.quitCh:
+			return
+		}
+		c.mu.Lock()
+		closed := c.isClosed()
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+)
+
+// Memory profiles, selecting how the server sizes its memory at startup
+// for the number of connections it is expected to handle.
+const (
+	MemoryProfileSmall  = "small"
+	MemoryProfileMedium = "medium"
+	MemoryProfileLarge  = "large"
+)
+
+// memoryProfile is the startup memory tuning of a profile.
+type memoryProfile struct {
+	// Connections the client map is pre-sized for.
+	conns int
+	// GC percent, 0 to keep the runtime's.
+	gcPercent int
+	// Size of the memory ballast, which raises the heap size the GC
+	// percent applies to without using physical memory.
+	ballast int64
+}
+
+var memoryProfiles = map[string]memoryProfile{
+	MemoryProfileSmall:  {conns: 1024},
+	MemoryProfileMedium: {conns: 16 * 1024, gcPercent: 150, ballast: 256 * 1024 * 1024},
+	MemoryProfileLarge:  {conns: 128 * 1024, gcPercent: 200, ballast: 1024 * 1024 * 1024},
+}
+
+func validateMemoryProfile(o *Options) error {
+	if o.MemoryProfile != _EMPTY_ {
+		if _, ok := memoryProfiles[o.MemoryProfile]; !ok {
+			return fmt.Errorf("unknown memory profile %q, expected %q, %q or %q", o.MemoryProfile,
+				MemoryProfileSmall, MemoryProfileMedium, MemoryProfileLarge)
+		}
+	}
+	if o.GCPercent < -1 {
+		return fmt.Errorf("gc_percent can't be less than -1")
+	}
+	if o.MemoryBallast < 0 {
+		return fmt.Errorf("memory_ballast can't be negative")
+	}
+	return nil
+}
+
+// memoryProfile returns the memory tuning of the options, that is of the
+// selected profile with the GC percent and ballast overridden if set.
+func (o *Options) memoryProfile() memoryProfile {
+	mp := memoryProfiles[o.MemoryProfile]
+	if o.GCPercent != 0 {
+		mp.gcPercent = o.GCPercent
+	}
+	if o.MemoryBallast != 0 {
+		mp.ballast = o.MemoryBallast
+	}
+	if mp.conns > o.MaxConn && o.MaxConn > 0 {
+		mp.conns = o.MaxConn
+	}
+	return mp
+}
+
+// applyMemoryProfile sets the GC percent, unless GOGC is set in the
+// environment, and allocates the memory ballast.
+func (s *Server) applyMemoryProfile() {
+	mp := s.getOpts().memoryProfile()
+	if mp.gcPercent != 0 && os.Getenv("GOGC") == _EMPTY_ {
+		s.mu.Lock()
+		s.prevGCPercent = debug.SetGCPercent(mp.gcPercent)
+		s.gcPercentSet = true
+		s.mu.Unlock()
+		s.Noticef("Set GC percent to %d", mp.gcPercent)
+	}
+	if mp.ballast > 0 {
+		s.mu.Lock()
+		s.ballast = make([]byte, mp.ballast)
+		s.mu.Unlock()
+		s.Noticef("Allocated a memory ballast of %d bytes", mp.ballast)
+	}
+}
+
+// releaseMemoryProfile restores the GC percent and releases the ballast.
+// Server lock held on entry.
+func (s *Server) releaseMemoryProfile() {
+	if s.gcPercentSet {
+		debug.SetGCPercent(s.prevGCPercent)
+		s.gcPercentSet = false
+	}
+	s.ballast = nil
+}
@@ -0,0 +1,340 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long a session migrated to another server is held there until its
+// client reconnects, during which the client is rejected by the server
+// it migrated from.
+var migratedSessionTTL = 30 * time.Second
+
+// MIGRATED_SESSION_MAX_MSGS is the maximum number of messages held for a
+// migrated session until its client reconnects.
+const MIGRATED_SESSION_MAX_MSGS = 1024
+
+// ClientMigration selects the clients whose session is migrated to
+// another server of the cluster. Only clients with a durable ID are
+// migrated, since that is how they are recognized when they reconnect.
+type ClientMigration struct {
+	// CIDs of the clients to migrate. All clients if empty.
+	CIDs []uint64 `json:"cids,omitempty"`
+	// Account, if set, restricts the migration to the clients of this
+	// account.
+	Account string `json:"account,omitempty"`
+	// Server is the ID of the server the sessions are migrated to.
+	Server string `json:"server_id"`
+	// ConnectURL, as host:port, is the client URL of that server.
+	ConnectURL string `json:"connect_url"`
+}
+
+// ClientMigrationResponse is the response to a client migration request.
+type ClientMigrationResponse struct {
+	Server   string `json:"server_id"`
+	Migrated int    `json:"migrated"`
+	Error    string `json:"error,omitempty"`
+}
+
+// migratedSession is the session of a client sent to the server it
+// migrates to.
+type migratedSession struct {
+	Account   string        `json:"account"`
+	DurableID string        `json:"durable_id"`
+	Subs      []migratedSub `json:"subs"`
+}
+
+type migratedSub struct {
+	Subject string `json:"subject"`
+	Queue   string `json:"queue,omitempty"`
+	Sid     string `json:"sid"`
+}
+
+// heldSession holds the subscriptions of a session migrated to this
+// server, and the messages they receive, until its client reconnects.
+// The subscriptions are owned by an internal client and receive their
+// messages through system callbacks.
+type heldSession struct {
+	sync.Mutex
+	c    *client
+	acc  *Account
+	subs map[string]*heldSub // keyed by internal sid
+	nmsg int
+	tmr  *time.Timer
+}
+
+type heldSub struct {
+	migratedSub
+	msgs []*retainedMsg
+}
+
+// MigrateClients migrates the sessions of the selected clients to another
+// server: their subscriptions are sent to it, which holds the messages
+// published on them until the clients reconnect there, and the clients
+// are sent the URL of that server and disconnected. Until the session
+// expires there, the clients are rejected by this server so that they
+// reconnect to the other one. This is experimental.
+func (s *Server) MigrateClients(m *ClientMigration) (int, error) {
+	if m.Server == _EMPTY_ || m.ConnectURL == _EMPTY_ {
+		return 0, errors.New("server ID and connect URL required")
+	}
+	if !s.eventsEnabled() {
+		return 0, ErrNoSysAccount
+	}
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return 0, ErrServerNotRunning
+	}
+	if m.Server == s.info.ID {
+		s.mu.Unlock()
+		return 0, errors.New("can not migrate clients to this server")
+	}
+	info := s.copyInfo()
+	info.ClientConnectURLs = []string{m.ConnectURL}
+
+	clients := s.clients
+	if len(m.CIDs) > 0 {
+		clients = make(map[uint64]*client, len(m.CIDs))
+		for _, cid := range m.CIDs {
+			if c := s.clients[cid]; c != nil {
+				clients[cid] = c
+			}
+		}
+	}
+	now := time.Now()
+	if s.migratedAway == nil {
+		s.migratedAway = make(map[string]time.Time)
+	}
+	for key, expires := range s.migratedAway {
+		if now.After(expires) {
+			delete(s.migratedAway, key)
+		}
+	}
+	var sessions []*migratedSession
+	var migrated []*client
+	for _, c := range clients {
+		c.mu.Lock()
+		if c.kind == CLIENT && c.opts.DurableID != _EMPTY_ && c.acc != nil &&
+			c.hasFeature(FeatureAsyncInfo) && c.flags.isSet(firstPongSent) &&
+			(m.Account == _EMPTY_ || c.acc.Name == m.Account) {
+			ms := &migratedSession{Account: c.acc.Name, DurableID: c.opts.DurableID}
+			for _, sub := range c.subs {
+				ms.Subs = append(ms.Subs, migratedSub{string(sub.subject), string(sub.queue), string(sub.sid)})
+			}
+			sessions = append(sessions, ms)
+			migrated = append(migrated, c)
+			s.migratedAway[primedInterestKey(ms.Account, ms.DurableID)] = now.Add(migratedSessionTTL)
+			c.enqueueProto(c.generateClientInfoJSON(info))
+		}
+		c.mu.Unlock()
+	}
+	if len(sessions) > 0 {
+		s.sendInternalMsg(fmt.Sprintf(sessionsImportSubj, m.Server), _EMPTY_, nil, sessions)
+	}
+	s.mu.Unlock()
+
+	for _, c := range migrated {
+		c.closeConnection(SessionMigrated)
+	}
+	return len(migrated), nil
+}
+
+// checkMigratedAway rejects a client whose session was migrated to another
+// server, so that it reconnects there. It returns an error if the client
+// is rejected, after closing it.
+func (s *Server) checkMigratedAway(c *client, account, durableID string) error {
+	key := primedInterestKey(account, durableID)
+	s.mu.Lock()
+	expires, ok := s.migratedAway[key]
+	if ok && time.Now().After(expires) {
+		delete(s.migratedAway, key)
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	c.sendErrAndDebug(ErrSessionMigrated.Error())
+	c.closeConnection(SessionMigrated)
+	return ErrSessionMigrated
+}
+
+// migrateClientsReq is a request to migrate some of our clients.
+func (s *Server) migrateClientsReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	resp := &ClientMigrationResponse{Server: s.ID()}
+	m := &ClientMigration{}
+	if err := json.Unmarshal(msg, m); err != nil {
+		resp.Error = fmt.Sprintf("Error unmarshalling client migration request: %v", err)
+	} else if n, err := s.MigrateClients(m); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Migrated = n
+		s.Noticef("Migrated %d client(s) to %q", n, m.Server)
+	}
+	if reply != _EMPTY_ {
+		s.sendInternalMsgLocked(reply, _EMPTY_, nil, resp)
+	}
+}
+
+// sessionsImport holds the sessions migrated to this server.
+func (s *Server) sessionsImport(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() {
+		return
+	}
+	var sessions []*migratedSession
+	if err := json.Unmarshal(msg, &sessions); err != nil {
+		s.Warnf("Error unmarshalling migrated sessions: %v", err)
+		return
+	}
+	for _, ms := range sessions {
+		s.holdSession(ms)
+	}
+}
+
+// holdSession subscribes on behalf of the migrated session until its
+// client reconnects or the session expires.
+func (s *Server) holdSession(ms *migratedSession) {
+	acc, err := s.lookupAccount(ms.Account)
+	if err != nil {
+		s.Warnf("Unable to hold migrated session of account %q: %v", ms.Account, err)
+		return
+	}
+	now := time.Now()
+	c := &client{srv: s, kind: SYSTEM, opts: internalOpts, msubs: -1, mpay: -1, start: now, last: now}
+	c.initClient()
+	c.echo = false
+	c.registerWithAccount(acc)
+	hs := &heldSession{c: c, acc: acc, subs: make(map[string]*heldSub, len(ms.Subs))}
+
+	key := primedInterestKey(ms.Account, ms.DurableID)
+	s.mu.Lock()
+	if s.migrated == nil {
+		s.migrated = make(map[string]*heldSession)
+	}
+	old := s.migrated[key]
+	s.migrated[key] = hs
+	var isids []string
+	for _, msub := range ms.Subs {
+		isid := strconv.FormatInt(int64(s.sys.sid), 10)
+		s.sys.sid++
+		hsub := &heldSub{migratedSub: msub}
+		hs.subs[isid] = hsub
+		s.sys.subs[isid] = func(_ *subscription, _ *client, subject, reply string, msg []byte) {
+			hs.hold(hsub, subject, reply, msg)
+		}
+		isids = append(isids, isid)
+	}
+	s.mu.Unlock()
+	if old != nil {
+		s.releaseHeldSession(old)
+	}
+
+	for _, isid := range isids {
+		msub := hs.subs[isid].migratedSub
+		arg := msub.Subject + " " + isid
+		if msub.Queue != _EMPTY_ {
+			arg = msub.Subject + " " + msub.Queue + " " + isid
+		}
+		if _, err := c.processSub([]byte(arg), false); err != nil {
+			s.Warnf("Unable to hold subscription %q of migrated session: %v", msub.Subject, err)
+		}
+	}
+	hs.Lock()
+	hs.tmr = time.AfterFunc(migratedSessionTTL, func() {
+		s.mu.Lock()
+		expired := s.migrated[key] == hs
+		if expired {
+			delete(s.migrated, key)
+		}
+		s.mu.Unlock()
+		if expired {
+			s.releaseHeldSession(hs)
+			s.Debugf("Migrated session %q expired", key)
+		}
+	})
+	hs.Unlock()
+}
+
+// hold keeps a message received by a subscription of the session.
+func (hs *heldSession) hold(hsub *heldSub, subject, reply string, msg []byte) {
+	hs.Lock()
+	defer hs.Unlock()
+	if hs.nmsg >= MIGRATED_SESSION_MAX_MSGS {
+		return
+	}
+	hs.nmsg++
+	rm := &retainedMsg{subject: subject, msg: append(append([]byte(nil), msg...), _CRLF_...)}
+	if reply != _EMPTY_ {
+		rm.reply = []byte(reply)
+	}
+	hsub.msgs = append(hsub.msgs, rm)
+}
+
+// releaseHeldSession removes the subscriptions of the session.
+func (s *Server) releaseHeldSession(hs *heldSession) {
+	hs.Lock()
+	if hs.tmr != nil {
+		hs.tmr.Stop()
+	}
+	hs.Unlock()
+	s.mu.Lock()
+	for isid := range hs.subs {
+		delete(s.sys.subs, isid)
+	}
+	s.mu.Unlock()
+	for isid := range hs.subs {
+		hs.c.processUnsub([]byte(isid))
+	}
+	hs.acc.removeClient(hs.c)
+}
+
+// resumeMigratedSession delivers to the client that just reconnected the
+// messages held since its session was migrated to this server, to its
+// subscriptions with the same sids.
+func (s *Server) resumeMigratedSession(c *client, account, durableID string) {
+	key := primedInterestKey(account, durableID)
+	s.mu.Lock()
+	hs := s.migrated[key]
+	delete(s.migrated, key)
+	s.mu.Unlock()
+	if hs == nil {
+		return
+	}
+	s.releaseHeldSession(hs)
+
+	hs.Lock()
+	defer hs.Unlock()
+	for _, hsub := range hs.subs {
+		if len(hsub.msgs) == 0 {
+			continue
+		}
+		c.mu.Lock()
+		sub := c.subs[hsub.Sid]
+		c.mu.Unlock()
+		if sub != nil && string(sub.subject) == hsub.Subject {
+			c.deliverStoredMsgs(sub, hsub.msgs)
+		}
+	}
+	c.Debugf("Resumed migrated session with %d message(s)", hs.nmsg)
+}
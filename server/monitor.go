@@ -80,6 +80,9 @@ type ConnzOptions struct {
 
 	// Filter by account.
 	Account string `json:"acc"`
+
+	// Filter by the durable ID provided by clients.
+	DurableID string `json:"durable_id"`
 }
 
 // ConnState is for filtering states of connections. We will only have two, open and closed.
@@ -120,6 +123,27 @@ type ConnInfo struct {
 	AuthorizedUser string     `json:"authorized_user,omitempty"`
 	Account        string     `json:"account,omitempty"`
 	Subs           []string   `json:"subscriptions_list,omitempty"`
+	DurableID      string     `json:"durable_id,omitempty"`
+	Reconnects     int        `json:"reconnects,omitempty"`
+	LastSeen       *time.Time `json:"last_seen,omitempty"`
+	Suspended      *time.Time `json:"suspended,omitempty"`
+	Compression    string     `json:"compression,omitempty"`
+	Features       []string   `json:"features,omitempty"`
+	// Metadata given by the client in its CONNECT.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// PermCache is set for connections with publish permissions.
+	PermCache *PermCacheStats `json:"publish_permissions_cache,omitempty"`
+	// CompressionStats is set for compressed connections.
+	CompressionStats *CompressionStats `json:"compression_stats,omitempty"`
+}
+
+// PermCacheStats has statistics about the cache of publish permission
+// checks of a connection.
+type PermCacheStats struct {
+	Size    int     `json:"size"`
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
 }
 
 // DefaultConnListSize is the default size of the connection list.
@@ -142,6 +166,7 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 		state   = ConnOpen
 		user    string
 		acc     string
+		durable string
 	)
 
 	if opts != nil {
@@ -162,6 +187,7 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 		}
 		user = opts.User
 		acc = opts.Account
+		durable = opts.DurableID
 
 		subs = opts.Subscriptions
 		offset = opts.Offset
@@ -274,6 +300,9 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 				if user != "" && client.opts.Username != user {
 					continue
 				}
+				if durable != "" && client.opts.DurableID != durable {
+					continue
+				}
 				openClients = append(openClients, client)
 			}
 		}
@@ -327,6 +356,9 @@ func (s *Server) Connz(opts *ConnzOptions) (*Connz, error) {
 		if user != "" && cc.user != user {
 			continue
 		}
+		if durable != "" && cc.DurableID != durable {
+			continue
+		}
 
 		// Copy if needed for any changes to the ConnInfo
 		if needCopy {
@@ -422,16 +454,39 @@ func (ci *ConnInfo) fill(client *client, nc net.Conn, now time.Time) {
 	ci.Name = client.opts.Name
 	ci.Lang = client.opts.Lang
 	ci.Version = client.opts.Version
+	if cc, ok := nc.(*compressedConn); ok {
+		ci.Compression = client.opts.Compression
+		ci.CompressionStats = cc.counters.stats()
+		ci.CompressionStats.Storing = atomic.LoadInt32(&cc.storing) == 1
+	}
+	ci.Features = client.feats.names()
+	ci.Metadata = client.opts.Metadata
+	if !client.ping.suspended.IsZero() {
+		suspended := client.ping.suspended
+		ci.Suspended = &suspended
+	}
+	if d := client.durable; d != nil {
+		ci.DurableID = client.opts.DurableID
+		ci.Reconnects = d.reconnects
+		if !d.lastSeen.IsZero() {
+			lastSeen := d.lastSeen
+			ci.LastSeen = &lastSeen
+		}
+	}
 	// inMsgs and inBytes are updated outside of the client's lock, so
 	// we need to use atomic here.
 	ci.InMsgs = atomic.LoadInt64(&client.inMsgs)
 	ci.InBytes = atomic.LoadInt64(&client.inBytes)
 
+	if p := client.perms; p != nil && p.pcache != nil && (p.pub.allow != nil || p.pub.deny != nil) {
+		ci.PermCache = p.pcache.stats()
+	}
+
 	// If the connection is gone, too bad, we won't set TLSVersion and TLSCipher.
 	// Exclude clients that are still doing handshake so we don't block in
 	// ConnectionState().
 	if client.flags.isSet(handshakeComplete) && nc != nil {
-		conn := nc.(*tls.Conn)
+		conn := rawConn(nc).(*tls.Conn)
 		cs := conn.ConnectionState()
 		ci.TLSVersion = tlsVersion(cs.Version)
 		ci.TLSCipher = tlsCipher(cs.CipherSuite)
@@ -551,9 +606,14 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	format, err := decodeFormat(w, r)
+	if err != nil {
+		return
+	}
 
 	user := r.URL.Query().Get("user")
 	acc := r.URL.Query().Get("acc")
+	durable := r.URL.Query().Get("durable_id")
 
 	connzOpts := &ConnzOptions{
 		Sort:          sortOpt,
@@ -565,6 +625,7 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 		State:         state,
 		User:          user,
 		Account:       acc,
+		DurableID:     durable,
 	}
 
 	s.mu.Lock()
@@ -577,6 +638,18 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(err.Error()))
 		return
 	}
+	switch format {
+	case MonitorFormatCSV:
+		if err := CSVResponseHandler(w, c.Conns); err != nil {
+			s.Errorf("Error encoding response to /connz request: %v", err)
+		}
+		return
+	case MonitorFormatMsgpack:
+		if err := MsgpackResponseHandler(w, c); err != nil {
+			s.Errorf("Error encoding response to /connz request: %v", err)
+		}
+		return
+	}
 	b, err := json.MarshalIndent(c, "", "  ")
 	if err != nil {
 		s.Errorf("Error marshaling response to /connz request: %v", err)
@@ -586,6 +659,131 @@ func (s *Server) HandleConnz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, b)
 }
 
+// HandleKick process HTTP POST requests to close client connections,
+// selected by the `cid` or `user` parameters, optionally restricted to
+// the `acc` account, with the close `reason` reported in connz.
+func (s *Server) HandleKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	cid, err := decodeUint64(w, r, "cid")
+	if err != nil {
+		return
+	}
+	k := &ClientKick{
+		User:    r.URL.Query().Get("user"),
+		Account: r.URL.Query().Get("acc"),
+		Reason:  r.URL.Query().Get("reason"),
+	}
+	if cid > 0 {
+		k.CIDs = []uint64{cid}
+	}
+
+	s.mu.Lock()
+	s.httpReqStats[KickPath]++
+	s.mu.Unlock()
+
+	n, err := s.KickClients(k)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	s.Noticef("Kicked %d client(s) on request from %s", n, r.RemoteAddr)
+	b, err := json.MarshalIndent(&ClientKickResponse{Server: s.ID(), Kicked: n}, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to %s request: %v", KickPath, err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// HandleLogLevel process HTTP POST requests to enable or disable the
+// `debug` and `trace` logging, optionally restricted to the connections of
+// a `kind` or to a `cid`, and reverted after a `timeout` duration.
+func (s *Server) HandleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	req := &LogLevelRequest{Kind: r.URL.Query().Get("kind")}
+	for _, p := range []struct {
+		name string
+		v    **bool
+	}{{"debug", &req.Debug}, {"trace", &req.Trace}} {
+		if r.URL.Query().Get(p.name) == _EMPTY_ {
+			continue
+		}
+		v, err := decodeBool(w, r, p.name)
+		if err != nil {
+			return
+		}
+		*p.v = &v
+	}
+	cid, err := decodeUint64(w, r, "cid")
+	if err != nil {
+		return
+	}
+	req.CID = cid
+	if t := r.URL.Query().Get("timeout"); t != _EMPTY_ {
+		if req.Timeout, err = time.ParseDuration(t); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Error decoding duration for 'timeout': %v", err)))
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.httpReqStats[LogLevelPath]++
+	s.mu.Unlock()
+
+	resp, err := s.SetLogLevel(req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to %s request: %v", LogLevelPath, err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// HandleAccept process HTTP POST requests to pause, with `pause=true`, or
+// resume accepting new client connections. The optional `error` parameter
+// is the error sent to the clients rejected while paused.
+func (s *Server) HandleAccept(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	pause, err := decodeBool(w, r, "pause")
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.httpReqStats[AcceptPath]++
+	s.mu.Unlock()
+
+	resp := s.SetAccept(&AcceptRequest{Pause: pause, Error: r.URL.Query().Get("error")})
+	b, err := json.MarshalIndent(resp, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to %s request: %v", AcceptPath, err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
 // Routez represents detailed information on current client connections.
 type Routez struct {
 	ID        string             `json:"server_id"`
@@ -614,6 +812,7 @@ type RouteInfo struct {
 	Export       *SubjectPermission `json:"export,omitempty"`
 	Pending      int                `json:"pending_size"`
 	RTT          string             `json:"rtt,omitempty"`
+	ClockSkew    string             `json:"clock_skew,omitempty"`
 	InMsgs       int64              `json:"in_msgs"`
 	OutMsgs      int64              `json:"out_msgs"`
 	InBytes      int64              `json:"in_bytes"`
@@ -657,6 +856,7 @@ func (s *Server) Routez(routezOpts *RoutezOptions) (*Routez, error) {
 			Import:       r.opts.Import,
 			Export:       r.opts.Export,
 			RTT:          r.getRTT(),
+			ClockSkew:    r.clockSkewString(),
 		}
 
 		if subs && len(r.subs) > 0 {
@@ -684,6 +884,10 @@ func (s *Server) HandleRoutez(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	format, err := decodeFormat(w, r)
+	if err != nil {
+		return
+	}
 	var opts *RoutezOptions
 	if subs {
 		opts = &RoutezOptions{Subscriptions: true}
@@ -695,6 +899,18 @@ func (s *Server) HandleRoutez(w http.ResponseWriter, r *http.Request) {
 
 	// As of now, no error is ever returned.
 	rs, _ := s.Routez(opts)
+	switch format {
+	case MonitorFormatCSV:
+		if err := CSVResponseHandler(w, rs.Routes); err != nil {
+			s.Errorf("Error encoding response to /routez request: %v", err)
+		}
+		return
+	case MonitorFormatMsgpack:
+		if err := MsgpackResponseHandler(w, rs); err != nil {
+			s.Errorf("Error encoding response to /routez request: %v", err)
+		}
+		return
+	}
 	b, err := json.MarshalIndent(rs, "", "  ")
 	if err != nil {
 		s.Errorf("Error marshaling response to /routez request: %v", err)
@@ -733,12 +949,15 @@ type SubszOptions struct {
 
 // SubDetail is for verbose information for subscriptions.
 type SubDetail struct {
-	Subject string `json:"subject"`
-	Queue   string `json:"qgroup,omitempty"`
-	Sid     string `json:"sid"`
-	Msgs    int64  `json:"msgs"`
-	Max     int64  `json:"max,omitempty"`
-	Cid     uint64 `json:"cid"`
+	Subject    string `json:"subject"`
+	Queue      string `json:"qgroup,omitempty"`
+	Sid        string `json:"sid"`
+	Msgs       int64  `json:"msgs"`
+	Max        int64  `json:"max,omitempty"`
+	Cid        uint64 `json:"cid"`
+	NoEcho     bool   `json:"no_echo,omitempty"`
+	MaxCredits int32  `json:"max_credits,omitempty"`
+	Credits    int32  `json:"credits,omitempty"`
 }
 
 // Subsz returns a Subsz struct containing subjects statistics
@@ -772,6 +991,9 @@ func (s *Server) Subsz(opts *SubszOptions) (*Subsz, error) {
 
 	// FIXME(dlc) - Make account aware.
 	sz := &Subsz{s.gacc.sl.Stats(), 0, offset, limit, nil}
+	// Firehose subscriptions are not in the sublist.
+	fsubs := s.gacc.firehoseSubs()
+	sz.NumSubs += uint32(len(fsubs))
 
 	if subdetail {
 		// Now add in subscription's details
@@ -779,6 +1001,7 @@ func (s *Server) Subsz(opts *SubszOptions) (*Subsz, error) {
 		subs := raw[:0]
 
 		s.gacc.sl.localSubs(&subs)
+		subs = append(subs, fsubs...)
 		details := make([]SubDetail, len(subs))
 		i := 0
 		// TODO(dlc) - may be inefficient and could just do normal match when total subs is large and filtering.
@@ -792,12 +1015,15 @@ func (s *Server) Subsz(opts *SubszOptions) (*Subsz, error) {
 			}
 			sub.client.mu.Lock()
 			details[i] = SubDetail{
-				Subject: string(sub.subject),
-				Queue:   string(sub.queue),
-				Sid:     string(sub.sid),
-				Msgs:    sub.nm,
-				Max:     sub.max,
-				Cid:     sub.client.cid,
+				Subject:    string(sub.subject),
+				Queue:      string(sub.queue),
+				Sid:        string(sub.sid),
+				Msgs:       sub.nm,
+				Max:        sub.max,
+				Cid:        sub.client.cid,
+				NoEcho:     sub.noEcho,
+				MaxCredits: sub.maxCredits,
+				Credits:    atomic.LoadInt32(&sub.credits),
 			}
 			sub.client.mu.Unlock()
 			i++
@@ -890,56 +1116,116 @@ func (s *Server) HandleStacksz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, buf[:n])
 }
 
+// Readyz reports whether the server is ready, that is, whether all its
+// configured listeners are bound and accepting connections.
+type Readyz struct {
+	Ready        bool                          `json:"ready"`
+	Listeners    map[string]*ListenerReadiness `json:"listeners"`
+	AcceptPaused bool                          `json:"accept_paused,omitempty"`
+}
+
+// HandleReadyz process HTTP requests for the server readiness. It responds
+// with a 503 status code if the server is not ready.
+func (s *Server) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[ReadyzPath]++
+	readiness := s.readiness()
+	paused := !s.acceptPaused.IsZero()
+	s.mu.Unlock()
+
+	rz := &Readyz{Ready: allListenersReady(readiness) && !paused, Listeners: readiness, AcceptPaused: paused}
+	b, err := json.MarshalIndent(rz, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /readyz request: %v", err)
+	}
+	if !rz.Ready {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
 // Varz will output server information on the monitoring port at /varz.
 type Varz struct {
-	ID                string            `json:"server_id"`
-	Name              string            `json:"server_name"`
-	Version           string            `json:"version"`
-	Proto             int               `json:"proto"`
-	GitCommit         string            `json:"git_commit,omitempty"`
-	GoVersion         string            `json:"go"`
-	Host              string            `json:"host"`
-	Port              int               `json:"port"`
-	AuthRequired      bool              `json:"auth_required,omitempty"`
-	TLSRequired       bool              `json:"tls_required,omitempty"`
-	TLSVerify         bool              `json:"tls_verify,omitempty"`
-	IP                string            `json:"ip,omitempty"`
-	ClientConnectURLs []string          `json:"connect_urls,omitempty"`
-	MaxConn           int               `json:"max_connections"`
-	MaxSubs           int               `json:"max_subscriptions,omitempty"`
-	PingInterval      time.Duration     `json:"ping_interval"`
-	MaxPingsOut       int               `json:"ping_max"`
-	HTTPHost          string            `json:"http_host"`
-	HTTPPort          int               `json:"http_port"`
-	HTTPSPort         int               `json:"https_port"`
-	AuthTimeout       float64           `json:"auth_timeout"`
-	MaxControlLine    int32             `json:"max_control_line"`
-	MaxPayload        int               `json:"max_payload"`
-	MaxPending        int64             `json:"max_pending"`
-	Cluster           ClusterOptsVarz   `json:"cluster,omitempty"`
-	Gateway           GatewayOptsVarz   `json:"gateway,omitempty"`
-	LeafNode          LeafNodeOptsVarz  `json:"leaf,omitempty"`
-	TLSTimeout        float64           `json:"tls_timeout"`
-	WriteDeadline     time.Duration     `json:"write_deadline"`
-	Start             time.Time         `json:"start"`
-	Now               time.Time         `json:"now"`
-	Uptime            string            `json:"uptime"`
-	Mem               int64             `json:"mem"`
-	Cores             int               `json:"cores"`
-	CPU               float64           `json:"cpu"`
-	Connections       int               `json:"connections"`
-	TotalConnections  uint64            `json:"total_connections"`
-	Routes            int               `json:"routes"`
-	Remotes           int               `json:"remotes"`
-	Leafs             int               `json:"leafnodes"`
-	InMsgs            int64             `json:"in_msgs"`
-	OutMsgs           int64             `json:"out_msgs"`
-	InBytes           int64             `json:"in_bytes"`
-	OutBytes          int64             `json:"out_bytes"`
-	SlowConsumers     int64             `json:"slow_consumers"`
-	Subscriptions     uint32            `json:"subscriptions"`
-	HTTPReqStats      map[string]uint64 `json:"http_req_stats"`
-	ConfigLoadTime    time.Time         `json:"config_load_time"`
+	ID                string              `json:"server_id"`
+	Name              string              `json:"server_name"`
+	Version           string              `json:"version"`
+	Proto             int                 `json:"proto"`
+	GitCommit         string              `json:"git_commit,omitempty"`
+	GoVersion         string              `json:"go"`
+	Host              string              `json:"host"`
+	Port              int                 `json:"port"`
+	AuthRequired      bool                `json:"auth_required,omitempty"`
+	TLSRequired       bool                `json:"tls_required,omitempty"`
+	TLSVerify         bool                `json:"tls_verify,omitempty"`
+	IP                string              `json:"ip,omitempty"`
+	ClientConnectURLs []string            `json:"connect_urls,omitempty"`
+	MaxConn           int                 `json:"max_connections"`
+	MaxSubs           int                 `json:"max_subscriptions,omitempty"`
+	PingInterval      time.Duration       `json:"ping_interval"`
+	MaxPingsOut       int                 `json:"ping_max"`
+	HTTPHost          string              `json:"http_host"`
+	HTTPPort          int                 `json:"http_port"`
+	HTTPSPort         int                 `json:"https_port"`
+	AuthTimeout       float64             `json:"auth_timeout"`
+	MaxControlLine    int32               `json:"max_control_line"`
+	MaxPayload        int                 `json:"max_payload"`
+	MaxPending        int64               `json:"max_pending"`
+	Cluster           ClusterOptsVarz     `json:"cluster,omitempty"`
+	Gateway           GatewayOptsVarz     `json:"gateway,omitempty"`
+	LeafNode          LeafNodeOptsVarz    `json:"leaf,omitempty"`
+	TLSTimeout        float64             `json:"tls_timeout"`
+	WriteDeadline     time.Duration       `json:"write_deadline"`
+	Start             time.Time           `json:"start"`
+	Now               time.Time           `json:"now"`
+	Uptime            string              `json:"uptime"`
+	Mem               int64               `json:"mem"`
+	Cores             int                 `json:"cores"`
+	CPU               float64             `json:"cpu"`
+	Connections       int                 `json:"connections"`
+	TotalConnections  uint64              `json:"total_connections"`
+	Routes            int                 `json:"routes"`
+	Remotes           int                 `json:"remotes"`
+	Leafs             int                 `json:"leafnodes"`
+	InMsgs            int64               `json:"in_msgs"`
+	OutMsgs           int64               `json:"out_msgs"`
+	InBytes           int64               `json:"in_bytes"`
+	OutBytes          int64               `json:"out_bytes"`
+	SlowConsumers     int64               `json:"slow_consumers"`
+	SubjectViolations int64               `json:"subject_limit_violations,omitempty"`
+	ProtoViolations   int64               `json:"protocol_state_violations,omitempty"`
+	ScannerProbes     int64               `json:"scanner_probes,omitempty"`
+	AcceptPaused      bool                `json:"accept_paused,omitempty"`
+	Overloaded        bool                `json:"overloaded,omitempty"`
+	AdmissionRejected int64               `json:"admission_rejected,omitempty"`
+	SuppressedLoops   int64               `json:"suppressed_loops,omitempty"`
+	SuspendDropped    int64               `json:"suspend_dropped,omitempty"`
+	FDExhausted       int64               `json:"fd_exhausted,omitempty"`
+	HandshakeFailures int64               `json:"handshake_failures,omitempty"`
+	MaxMemory         int64               `json:"max_memory,omitempty"`
+	MemoryUsed        int64               `json:"memory_used,omitempty"`
+	Subscriptions     uint32              `json:"subscriptions"`
+	HTTPReqStats      map[string]uint64   `json:"http_req_stats"`
+	ConfigLoadTime    time.Time           `json:"config_load_time"`
+	OutboundEndpoints []*OutboundEndpoint `json:"outbound_endpoints,omitempty"`
+	CertExpiries      []*CertExpiry       `json:"cert_expiries,omitempty"`
+	ConfigWarnings    []*ConfigWarning    `json:"config_warnings,omitempty"`
+	ContainerLimits   *ContainerLimits    `json:"container_limits,omitempty"`
+	TrafficStats      *TrafficStats       `json:"traffic_stats,omitempty"`
+	Interceptors      []*InterceptorStats `json:"interceptors,omitempty"`
+	SchemaViolations  int64               `json:"schema_violations,omitempty"`
+	ConnectRetries    []*ConnectRetry     `json:"connect_retries,omitempty"`
+	Rates             *Rates              `json:"rates,omitempty"`
+	Runtime           *RuntimeStats       `json:"runtime,omitempty"`
+
+	// StageLatency has the sampled latencies of the read and write loop
+	// stages, if enabled with latency_sampling.
+	StageLatency map[string]*LatencyHistogram `json:"stage_latency,omitempty"`
+
+	// CompressionStats has the bytes of all the compressed client
+	// connections, if any.
+	CompressionStats *CompressionStats `json:"compression_stats,omitempty"`
 }
 
 // ClusterOptsVarz contains monitoring cluster information
@@ -1040,6 +1326,11 @@ func (s *Server) HandleRoot(w http.ResponseWriter, r *http.Request) {
 	<a href=/gatewayz>gatewayz</a><br/>
 	<a href=/leafz>leafz</a><br/>
 	<a href=/subsz>subsz</a><br/>
+	<a href=/readyz>readyz</a><br/>
+	<a href=/accountz>accountz</a><br/>
+	<a href=/ipqueuesz>ipqueuesz</a><br/>
+	<a href=/authbanz>authbanz</a><br/>
+	<a href=/metrics>metrics</a><br/>
     <br/>
     <a href=https://docs.nats.io/nats-server/configuration/monitoring.html>help</a>
   </body>
@@ -1108,8 +1399,9 @@ func (s *Server) createVarz(pcpu float64, rss int64) *Varz {
 			TLSTimeout:  ln.TLSTimeout,
 			Remotes:     []RemoteLeafOptsVarz{},
 		},
-		Start:   s.start,
-		MaxSubs: opts.MaxSubs,
+		Start:           s.start,
+		MaxSubs:         opts.MaxSubs,
+		ContainerLimits: s.containerLimits,
 	}
 	if len(opts.Routes) > 0 {
 		varz.Cluster.URLs = urlsToStrings(opts.Routes)
@@ -1170,9 +1462,11 @@ func (s *Server) updateVarzConfigReloadableFields(v *Varz) {
 	v.MaxControlLine = opts.MaxControlLine
 	v.MaxPayload = int(opts.MaxPayload)
 	v.MaxPending = opts.MaxPending
+	v.MaxMemory = opts.MaxMemory
 	v.TLSTimeout = opts.TLSTimeout
 	v.WriteDeadline = opts.WriteDeadline
 	v.ConfigLoadTime = s.configTime
+	v.ConfigWarnings = opts.configWarnings
 	// Update route URLs if applicable
 	if s.varzUpdateRouteURLs {
 		v.Cluster.URLs = urlsToStrings(opts.Routes)
@@ -1204,12 +1498,35 @@ func (s *Server) updateVarzRuntimeFields(v *Varz, forceUpdate bool, pcpu float64
 	v.OutMsgs = atomic.LoadInt64(&s.outMsgs)
 	v.OutBytes = atomic.LoadInt64(&s.outBytes)
 	v.SlowConsumers = atomic.LoadInt64(&s.slowConsumers)
+	v.SubjectViolations = atomic.LoadInt64(&s.subjectLimitViolations)
+	v.ProtoViolations = atomic.LoadInt64(&s.protoStateViolations)
+	v.ScannerProbes = atomic.LoadInt64(&s.scannerProbes)
+	v.AcceptPaused = !s.acceptPaused.IsZero()
+	v.Overloaded = atomic.LoadInt32(&s.overloaded) == 1
+	v.AdmissionRejected = atomic.LoadInt64(&s.admissionRejected)
+	v.SuppressedLoops = atomic.LoadInt64(&s.suppressedLoops)
+	v.SuspendDropped = atomic.LoadInt64(&s.suspendDropped)
+	v.FDExhausted = atomic.LoadInt64(&s.fdExhaustedErrs)
+	v.HandshakeFailures = atomic.LoadInt64(&s.handshakeFailures)
+	v.StageLatency = s.stageLatencies()
+	if cs := s.compression.stats(); cs.InWireBytes+cs.OutWireBytes > 0 {
+		v.CompressionStats = cs
+	}
+	v.MemoryUsed = atomic.LoadInt64(&s.memUsed)
 	// FIXME(dlc) - make this multi-account aware.
-	v.Subscriptions = s.gacc.sl.Count()
+	v.Subscriptions = uint32(s.gacc.TotalSubs())
 	v.HTTPReqStats = make(map[string]uint64, len(s.httpReqStats))
 	for key, val := range s.httpReqStats {
 		v.HTTPReqStats[key] = val
 	}
+	v.OutboundEndpoints = s.outboundEndpoints()
+	v.CertExpiries = s.certs.soonest(varzCertExpiries)
+	v.TrafficStats = s.trafficStats()
+	v.Interceptors = s.interceptorStats()
+	v.SchemaViolations = atomic.LoadInt64(&s.schemas.violations)
+	v.ConnectRetries = s.connectRetries()
+	v.Rates = s.rollingRates()
+	v.Runtime = s.runtimeStats()
 
 	// Update Gateway remote urls if applicable
 	gw := s.gateway
@@ -1697,6 +2014,216 @@ func (s *Server) HandleLeafz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, b)
 }
 
+// Accountz represents the cumulative usage of accounts on this server.
+type Accountz struct {
+	ID       string          `json:"server_id"`
+	Now      time.Time       `json:"now"`
+	Accounts []*AccountUsage `json:"accounts"`
+}
+
+// AccountzOptions are options passed to Accountz.
+type AccountzOptions struct {
+	// Account filters the result to this account.
+	Account string `json:"account"`
+}
+
+// Accountz returns an Accountz structure containing the usage of the
+// accounts registered on this server, sorted by name.
+func (s *Server) Accountz(opts *AccountzOptions) (*Accountz, error) {
+	var filter string
+	if opts != nil {
+		filter = opts.Account
+	}
+	az := &Accountz{ID: s.ID(), Now: time.Now(), Accounts: []*AccountUsage{}}
+	if filter != "" {
+		v, ok := s.accounts.Load(filter)
+		if !ok {
+			return nil, fmt.Errorf("account %q not found", filter)
+		}
+		az.Accounts = append(az.Accounts, v.(*Account).Usage())
+		return az, nil
+	}
+	s.accounts.Range(func(k, v interface{}) bool {
+		az.Accounts = append(az.Accounts, v.(*Account).Usage())
+		return true
+	})
+	sort.Slice(az.Accounts, func(i, j int) bool { return az.Accounts[i].Account < az.Accounts[j].Account })
+	return az, nil
+}
+
+// HandleAccountz process HTTP requests for account usage information.
+func (s *Server) HandleAccountz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[AccountzPath]++
+	s.mu.Unlock()
+
+	az, err := s.Accountz(&AccountzOptions{Account: r.URL.Query().Get("acc")})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b, err := json.MarshalIndent(az, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /accountz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
+// DefaultIpqueueThreshold is the default fill percentage above which a
+// queue is flagged in Ipqueuesz.
+const DefaultIpqueueThreshold = 75
+
+// Ipqueuesz represents the depths of the internal queues of the server: the
+// outbound queues of the client, route, gateway and leaf node connections,
+// and the send queue of the system events.
+type Ipqueuesz struct {
+	ID        string         `json:"server_id"`
+	Now       time.Time      `json:"now"`
+	Threshold int            `json:"threshold"`
+	Flagged   int            `json:"num_flagged"`
+	Queues    []*IpqueueInfo `json:"queues"`
+}
+
+// IpqueueInfo has the depth of an internal queue. Pending and Limit are
+// in bytes for the outbound queues of connections, and in messages for
+// the system send queue.
+type IpqueueInfo struct {
+	Name    string  `json:"name"`
+	Kind    string  `json:"kind"`
+	Cid     uint64  `json:"cid,omitempty"`
+	Pending int64   `json:"pending"`
+	Limit   int64   `json:"limit"`
+	Percent float64 `json:"percent"`
+	Flagged bool    `json:"flagged,omitempty"`
+}
+
+// IpqueueszOptions are options passed to Ipqueuesz.
+type IpqueueszOptions struct {
+	// Threshold is the fill percentage above which queues are flagged,
+	// DefaultIpqueueThreshold if 0.
+	Threshold int `json:"threshold"`
+	// All includes the empty queues.
+	All bool `json:"all"`
+}
+
+// Ipqueuesz returns the depths of the internal queues, the fullest first,
+// so that backpressure can be noticed before slow consumers are closed.
+func (s *Server) Ipqueuesz(opts *IpqueueszOptions) (*Ipqueuesz, error) {
+	threshold, all := DefaultIpqueueThreshold, false
+	if opts != nil {
+		if opts.Threshold < 0 || opts.Threshold > 100 {
+			return nil, fmt.Errorf("invalid threshold %d, expected a percentage", opts.Threshold)
+		}
+		if opts.Threshold > 0 {
+			threshold = opts.Threshold
+		}
+		all = opts.All
+	}
+	qz := &Ipqueuesz{ID: s.ID(), Now: time.Now(), Threshold: threshold, Queues: []*IpqueueInfo{}}
+	add := func(qi *IpqueueInfo) {
+		if qi.Pending == 0 && !all {
+			return
+		}
+		if qi.Limit > 0 {
+			qi.Percent = float64(qi.Pending) * 100 / float64(qi.Limit)
+		}
+		if qi.Flagged = qi.Percent >= float64(threshold); qi.Flagged {
+			qz.Flagged++
+		}
+		qz.Queues = append(qz.Queues, qi)
+	}
+
+	s.mu.Lock()
+	conns := make([]*client, 0, len(s.clients)+len(s.routes)+len(s.leafs))
+	for _, m := range []map[uint64]*client{s.clients, s.routes, s.leafs} {
+		for _, c := range m {
+			conns = append(conns, c)
+		}
+	}
+	if s.sys != nil && s.sys.sendq != nil {
+		add(&IpqueueInfo{
+			Name:    "system_send",
+			Kind:    "System",
+			Pending: int64(len(s.sys.sendq)),
+			Limit:   int64(cap(s.sys.sendq)),
+		})
+	}
+	s.mu.Unlock()
+
+	s.gateway.RLock()
+	for _, c := range s.gateway.out {
+		conns = append(conns, c)
+	}
+	for _, c := range s.gateway.in {
+		conns = append(conns, c)
+	}
+	s.gateway.RUnlock()
+
+	for _, c := range conns {
+		c.mu.Lock()
+		qi := &IpqueueInfo{
+			Kind:    c.typeString(),
+			Cid:     c.cid,
+			Pending: c.out.pb,
+			Limit:   c.out.mp,
+		}
+		switch c.kind {
+		case ROUTER:
+			if c.route != nil {
+				qi.Name = c.route.remoteID
+			}
+		case GATEWAY:
+			if c.gw != nil {
+				qi.Name = c.gw.name
+			}
+		default:
+			qi.Name = c.opts.Name
+		}
+		c.mu.Unlock()
+		add(qi)
+	}
+	sort.SliceStable(qz.Queues, func(i, j int) bool {
+		if qz.Queues[i].Percent != qz.Queues[j].Percent {
+			return qz.Queues[i].Percent > qz.Queues[j].Percent
+		}
+		return qz.Queues[i].Cid < qz.Queues[j].Cid
+	})
+	return qz, nil
+}
+
+// HandleIpqueuesz process HTTP requests for the depths of internal queues.
+func (s *Server) HandleIpqueuesz(w http.ResponseWriter, r *http.Request) {
+	threshold, err := decodeInt(w, r, "threshold")
+	if err != nil {
+		return
+	}
+	all, err := decodeBool(w, r, "all")
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.httpReqStats[IpqueueszPath]++
+	s.mu.Unlock()
+
+	qz, err := s.Ipqueuesz(&IpqueueszOptions{Threshold: threshold, All: all})
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b, err := json.MarshalIndent(qz, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /ipqueuesz request: %v", err)
+	}
+
+	// Handle response
+	ResponseHandler(w, r, b)
+}
+
 // ResponseHandler handles responses for monitoring routes
 func ResponseHandler(w http.ResponseWriter, r *http.Request, data []byte) {
 	// Get callback from request
@@ -1765,6 +2292,41 @@ func (reason ClosedState) String() string {
 		return "Missing Account"
 	case Revocation:
 		return "Credentials Revoked"
+	case MemoryPressure:
+		return "Memory Pressure"
+	case AdminKick:
+		return "Kicked by Admin"
+	case SubjectLimitExceeded:
+		return "Subject Limit Exceeded"
+	case MaxConnectionLifetimeExceeded:
+		return "Maximum Connection Lifetime Exceeded"
+	case AcceptPaused:
+		return "Server Not Accepting Connections"
+	case ServerOverloaded:
+		return "Server Overloaded"
+	case FileDescriptorsExhausted:
+		return "File Descriptors Exhausted"
+	case DuplicateConnection:
+		return "Duplicate Connection"
+	case AuthenticationBanned:
+		return "Authentication Banned"
+	case MaxPendingAuthExceeded:
+		return "Maximum Pending Authentications Exceeded"
+	case SessionMigrated:
+		return "Session Migrated"
+	case AccountFrozen:
+		return "Account Frozen"
 	}
 	return "Unknown State"
 }
+
+// closedStateFromString returns the closed state whose description,
+// as returned by String(), matches name, ignoring case.
+func closedStateFromString(name string) (ClosedState, error) {
+	for reason := ClientClosed; reason.String() != "Unknown State"; reason++ {
+		if strings.EqualFold(reason.String(), name) {
+			return reason, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown close reason %q", name)
+}
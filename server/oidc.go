@@ -0,0 +1,447 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default time JWKS keys are cached before being fetched again.
+	defaultOIDCJWKSCacheTTL = time.Hour
+	// Minimum interval between two fetches triggered by an unknown key id.
+	oidcJWKSMinRefresh = 10 * time.Second
+	// Timeout for HTTP requests to the issuer.
+	oidcFetchTimeout = 5 * time.Second
+	// Clock skew tolerated when checking exp/nbf claims.
+	oidcClockSkew = 30 * time.Second
+	// Default claim used to identify the user.
+	defaultOIDCUserClaim = "sub"
+)
+
+// OIDCOpts are options for validating OIDC/OAuth2 bearer tokens
+// presented by clients in the CONNECT's auth_token field.
+type OIDCOpts struct {
+	// Issuer is the expected `iss` claim. If JWKSURL is not set, the
+	// keys location is discovered from the issuer's openid-configuration.
+	Issuer string
+	// JWKSURL is the location of the issuer's JSON Web Key Set.
+	JWKSURL string
+	// Audience, if set, must be present in the `aud` claim.
+	Audience string
+	// UserClaim is the claim holding the user name, `sub` by default.
+	// If the name matches a configured user, that user's account and
+	// permissions are used.
+	UserClaim string
+	// AccountClaim is the claim holding the account name to bind to
+	// when the user is not otherwise configured. Without it, only the
+	// configured users are accepted. The system account can not be
+	// designated this way.
+	AccountClaim string
+	// PermissionsClaim is the claim holding the permissions, in the
+	// same JSON form as the user permissions, of the users bound with
+	// AccountClaim. Without it, or when the token does not have this
+	// claim, those users can not publish nor subscribe.
+	PermissionsClaim string
+	// JWKSCacheTTL is how long fetched keys are kept.
+	JWKSCacheTTL time.Duration
+}
+
+// oidcValidator verifies bearer tokens against the keys of an OIDC issuer.
+type oidcValidator struct {
+	mu      sync.Mutex
+	opts    OIDCOpts
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+	hc      *http.Client
+	// Closed when the key set fetch in progress, if any, completes, with
+	// its error in fetchErr.
+	fetching chan struct{}
+	fetchErr error
+}
+
+// oidcClaims holds the claims extracted from a verified token.
+type oidcClaims map[string]interface{}
+
+func newOIDCValidator(o *OIDCOpts) *oidcValidator {
+	opts := *o
+	if opts.UserClaim == "" {
+		opts.UserClaim = defaultOIDCUserClaim
+	}
+	if opts.JWKSCacheTTL <= 0 {
+		opts.JWKSCacheTTL = defaultOIDCJWKSCacheTTL
+	}
+	return &oidcValidator{opts: opts, hc: &http.Client{Timeout: oidcFetchTimeout}}
+}
+
+// Returns true if the given token looks like a compact JWS, that is
+// three dot separated segments, the first one being a JSON header with
+// an algorithm. Other tokens go through the regular token authentication.
+func isOIDCToken(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+	}
+	return oidcDecodeSegment(parts[0], &hdr) == nil && hdr.Alg != ""
+}
+
+// validate checks the signature and standard claims of the given token
+// and returns its claims.
+func (v *oidcValidator) validate(token string) (oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var hdr struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := oidcDecodeSegment(parts[0], &hdr); err != nil {
+		return nil, fmt.Errorf("invalid token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid token signature encoding: %v", err)
+	}
+	key, err := v.getKey(hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := oidcVerify(hdr.Alg, key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+	claims := oidcClaims{}
+	if err := oidcDecodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid token claims: %v", err)
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims verifies issuer, audience and validity period.
+func (v *oidcValidator) checkClaims(claims oidcClaims, now time.Time) error {
+	if iss, _ := claims["iss"].(string); iss != v.opts.Issuer {
+		return fmt.Errorf("unexpected issuer %q", iss)
+	}
+	if v.opts.Audience != "" {
+		found := false
+		switch aud := claims["aud"].(type) {
+		case string:
+			found = aud == v.opts.Audience
+		case []interface{}:
+			for _, a := range aud {
+				if as, _ := a.(string); as == v.opts.Audience {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("audience %q not found in token", v.opts.Audience)
+		}
+	}
+	if exp, ok := claims["exp"].(float64); !ok {
+		return errors.New("token has no expiration")
+	} else if now.Add(-oidcClockSkew).After(time.Unix(int64(exp), 0)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token not yet valid")
+	}
+	return nil
+}
+
+// Returns the value of the given claim as a string, if present.
+func (c oidcClaims) str(name string) string {
+	s, _ := c[name].(string)
+	return s
+}
+
+// getKey returns the public key for the given key id, fetching
+// the key set if not cached, expired or the key id is unknown.
+// The key set is fetched without the lock, one fetch at a time, so
+// that the authentications using cached keys do not wait for it.
+func (v *oidcValidator) getKey(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	now := time.Now()
+	key, ok := v.lookupKey(kid)
+	expired := now.Sub(v.fetched) > v.opts.JWKSCacheTTL
+	if ok && !expired {
+		v.mu.Unlock()
+		return key, nil
+	}
+	if !expired && now.Sub(v.fetched) <= oidcJWKSMinRefresh {
+		v.mu.Unlock()
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	// Wait for the fetch in progress, or start one.
+	ch := v.fetching
+	if ch == nil {
+		ch = make(chan struct{})
+		v.fetching = ch
+		v.mu.Unlock()
+		keys, err := v.fetchKeys()
+		v.mu.Lock()
+		if err == nil {
+			v.keys, v.fetched = keys, now
+		}
+		v.fetching, v.fetchErr = nil, err
+		close(ch)
+	} else {
+		v.mu.Unlock()
+		<-ch
+		v.mu.Lock()
+	}
+	err := v.fetchErr
+	newKey, found := v.lookupKey(kid)
+	v.mu.Unlock()
+
+	if found {
+		return newKey, nil
+	}
+	// Keep using what we had if the issuer is unreachable.
+	if ok {
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+// Lock held on entry.
+func (v *oidcValidator) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(v.keys) == 1 {
+		for _, k := range v.keys {
+			return k, true
+		}
+	}
+	k, ok := v.keys[kid]
+	return k, ok
+}
+
+// fetchKeys downloads and parses the issuer's key set.
+func (v *oidcValidator) fetchKeys() (map[string]crypto.PublicKey, error) {
+	jwksURL := v.opts.JWKSURL
+	if jwksURL == "" {
+		var disc struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		u := strings.TrimSuffix(v.opts.Issuer, "/") + "/.well-known/openid-configuration"
+		if err := v.getJSON(u, &disc); err != nil {
+			return nil, err
+		}
+		if disc.JWKSURI == "" {
+			return nil, fmt.Errorf("no jwks_uri in openid configuration of %q", v.opts.Issuer)
+		}
+		jwksURL = disc.JWKSURI
+	}
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := v.getJSON(jwksURL, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			if k.Crv != "P-256" {
+				continue
+			}
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no usable keys found at %q", jwksURL)
+	}
+	return keys, nil
+}
+
+func (v *oidcValidator) getJSON(url string, dst interface{}) error {
+	resp, err := v.hc.Get(url)
+	if err != nil {
+		return fmt.Errorf("error fetching %q: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error fetching %q: %v", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+func oidcDecodeSegment(seg string, dst interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, dst)
+}
+
+// oidcVerify checks the signature for the supported algorithms.
+func oidcVerify(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	h := sha256.Sum256(signed)
+	switch alg {
+	case "RS256":
+		pk, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key type mismatch for RS256")
+		}
+		if err := rsa.VerifyPKCS1v15(pk, crypto.SHA256, h[:], sig); err != nil {
+			return errors.New("invalid token signature")
+		}
+	case "ES256":
+		pk, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return errors.New("key type mismatch for ES256")
+		}
+		r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pk, h[:], r, s) {
+			return errors.New("invalid token signature")
+		}
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+	return nil
+}
+
+// processOIDCAuthentication authenticates the client with the bearer token
+// provided in the CONNECT's auth_token, and binds it to the user or account
+// designated by the token's claims.
+func (s *Server) processOIDCAuthentication(c *client) bool {
+	s.mu.Lock()
+	v := s.oidc
+	s.mu.Unlock()
+	if v == nil {
+		return false
+	}
+	claims, err := v.validate(c.opts.Authorization)
+	if err != nil {
+		c.Debugf("OIDC token not valid: %v", err)
+		return false
+	}
+	username := claims.str(v.opts.UserClaim)
+	if username == "" {
+		c.Debugf("OIDC token has no %q claim", v.opts.UserClaim)
+		return false
+	}
+	s.mu.Lock()
+	user := s.users[username]
+	s.mu.Unlock()
+
+	// The user is known, so use its account and permissions.
+	if user != nil {
+		if !c.checkConnectionSource(user.AllowedSources, user.DeniedSources, user.Account) ||
+			!c.checkConnectionTimes(user.ConnectionTimes) {
+			return false
+		}
+		c.opts.Username = username
+		c.RegisterUser(user)
+		s.accountConnectEvent(c)
+		return true
+	}
+	// Otherwise the token has to designate the account, so that unknown
+	// users are not given access to the global account.
+	if v.opts.AccountClaim == "" {
+		c.Debugf("OIDC user %q is not configured", username)
+		return false
+	}
+	accName := claims.str(v.opts.AccountClaim)
+	if accName == "" {
+		c.Debugf("OIDC token has no %q claim", v.opts.AccountClaim)
+		return false
+	}
+	acc, err := s.LookupAccount(accName)
+	if err != nil {
+		c.Debugf("OIDC account %q lookup error: %v", accName, err)
+		return false
+	}
+	if acc == s.SystemAccount() {
+		c.Debugf("OIDC user %q can not be bound to the system account", username)
+		return false
+	}
+	perms, err := oidcPermissions(claims, v.opts.PermissionsClaim)
+	if err != nil {
+		c.Debugf("OIDC token has invalid %q claim: %v", v.opts.PermissionsClaim, err)
+		return false
+	}
+	c.opts.Username = username
+	c.RegisterUser(&User{Username: username, Account: acc, Permissions: perms})
+	s.accountConnectEvent(c)
+	return true
+}
+
+// oidcPermissions returns the permissions held by the given claim, or
+// permissions denying everything if there is no such claim.
+func oidcPermissions(claims oidcClaims, name string) (*Permissions, error) {
+	pc, ok := claims[name]
+	if name == "" || !ok {
+		return &Permissions{
+			Publish:   &SubjectPermission{Deny: []string{">"}},
+			Subscribe: &SubjectPermission{Deny: []string{">"}},
+		}, nil
+	}
+	b, err := json.Marshal(pc)
+	if err != nil {
+		return nil, err
+	}
+	perms := &Permissions{}
+	if err := json.Unmarshal(b, perms); err != nil {
+		return nil, err
+	}
+	validateResponsePermissions(perms)
+	return perms, nil
+}
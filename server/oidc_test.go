@@ -0,0 +1,304 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+type testOIDCIssuer struct {
+	srv     *httptest.Server
+	key     *rsa.PrivateKey
+	fetches int32
+	// Delay of the key set responses, used atomically.
+	delay int64
+}
+
+func newTestOIDCIssuer(t *testing.T) *testOIDCIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	ti := &testOIDCIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"issuer":%q,"jwks_uri":%q}`, ti.srv.URL, ti.srv.URL+"/keys")
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&ti.fetches, 1)
+		time.Sleep(time.Duration(atomic.LoadInt64(&ti.delay)))
+		e := big.NewInt(int64(key.E)).Bytes()
+		fmt.Fprintf(w, `{"keys":[{"kty":"RSA","kid":"k1","use":"sig","n":%q,"e":%q}]}`,
+			base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			base64.RawURLEncoding.EncodeToString(e))
+	})
+	ti.srv = httptest.NewServer(mux)
+	return ti
+}
+
+func (ti *testOIDCIssuer) token(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	hdr, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1", "typ": "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(body)
+	h := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ti.key, crypto.SHA256, h[:])
+	if err != nil {
+		t.Fatalf("Error signing: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCAuthentication(t *testing.T) {
+	ti := newTestOIDCIssuer(t)
+	defer ti.srv.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		oidc {
+			issuer: %q
+			audience: "nats"
+			account_claim: "nats_account"
+		}
+		accounts {
+			A {}
+			B { users: [{user: "svc", password: "pwd"}] }
+		}
+	`, ti.srv.URL)))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	exp := time.Now().Add(time.Hour).Unix()
+
+	for _, test := range []struct {
+		name   string
+		claims map[string]interface{}
+		acc    string
+	}{
+		{"account from claim", map[string]interface{}{"iss": ti.srv.URL, "aud": "nats", "sub": "alice", "exp": exp, "nats_account": "A"}, "A"},
+		{"configured user", map[string]interface{}{"iss": ti.srv.URL, "aud": []string{"other", "nats"}, "sub": "svc", "exp": exp}, "B"},
+		{"bad issuer", map[string]interface{}{"iss": "https://evil", "aud": "nats", "sub": "alice", "exp": exp, "nats_account": "A"}, ""},
+		{"bad audience", map[string]interface{}{"iss": ti.srv.URL, "aud": "other", "sub": "alice", "exp": exp, "nats_account": "A"}, ""},
+		{"expired", map[string]interface{}{"iss": ti.srv.URL, "aud": "nats", "sub": "alice", "exp": time.Now().Add(-time.Hour).Unix(), "nats_account": "A"}, ""},
+		{"unknown account", map[string]interface{}{"iss": ti.srv.URL, "aud": "nats", "sub": "alice", "exp": exp, "nats_account": "C"}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			nc, err := nats.Connect(url, nats.Token(ti.token(t, test.claims)))
+			if test.acc == "" {
+				if err == nil {
+					nc.Close()
+					t.Fatal("Expected connect to fail")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error on connect: %v", err)
+			}
+			defer nc.Close()
+			acc, _ := s.LookupAccount(test.acc)
+			checkAccClientsCount(t, acc, 1)
+		})
+	}
+
+	// Tampered signature must be rejected.
+	tok := ti.token(t, map[string]interface{}{"iss": ti.srv.URL, "aud": "nats", "sub": "alice", "exp": exp, "nats_account": "A"})
+	if nc, err := nats.Connect(url, nats.Token(tok[:len(tok)-4]+"AAAA")); err == nil {
+		nc.Close()
+		t.Fatal("Expected connect to fail with tampered token")
+	}
+	// Keys should have been cached.
+	if n := atomic.LoadInt32(&ti.fetches); n != 1 {
+		t.Fatalf("Expected keys to be fetched once, got %v", n)
+	}
+}
+
+func TestOIDCUnknownUserWithoutAccountClaim(t *testing.T) {
+	ti := newTestOIDCIssuer(t)
+	defer ti.srv.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		oidc { issuer: %q }
+		accounts {
+			B { users: [{user: "svc", password: "pwd"}] }
+		}
+	`, ti.srv.URL)))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	exp := time.Now().Add(time.Hour).Unix()
+
+	// Without an account claim, unknown users are not bound to the global
+	// account.
+	tok := ti.token(t, map[string]interface{}{"iss": ti.srv.URL, "sub": "alice", "exp": exp})
+	if nc, err := nats.Connect(url, nats.Token(tok)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connect to fail for an unknown user")
+	}
+	tok = ti.token(t, map[string]interface{}{"iss": ti.srv.URL, "sub": "svc", "exp": exp})
+	nc, err := nats.Connect(url, nats.Token(tok))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	acc, _ := s.LookupAccount("B")
+	checkAccClientsCount(t, acc, 1)
+}
+
+func TestOIDCConcurrentKeyFetch(t *testing.T) {
+	ti := newTestOIDCIssuer(t)
+	defer ti.srv.Close()
+	atomic.StoreInt64(&ti.delay, int64(250*time.Millisecond))
+
+	v := newOIDCValidator(&OIDCOpts{Issuer: ti.srv.URL, JWKSURL: ti.srv.URL + "/keys"})
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := v.getKey("k1")
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Error getting key: %v", err)
+		}
+	}
+	// The concurrent lookups share a single fetch.
+	if n := atomic.LoadInt32(&ti.fetches); n != 1 {
+		t.Fatalf("Expected keys to be fetched once, got %v", n)
+	}
+
+	// Cached keys are returned while a fetch is in progress.
+	v.mu.Lock()
+	v.fetched = time.Now().Add(-time.Minute)
+	v.mu.Unlock()
+	go v.getKey("unknown")
+	checkFor(t, time.Second, 5*time.Millisecond, func() error {
+		if atomic.LoadInt32(&ti.fetches) != 2 {
+			return fmt.Errorf("fetch not started")
+		}
+		return nil
+	})
+	start := time.Now()
+	if _, err := v.getKey("k1"); err != nil {
+		t.Fatalf("Error getting key: %v", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Fatalf("Cached key lookup waited for the fetch: %v", d)
+	}
+}
+
+func TestOIDCAccountClaimPermissions(t *testing.T) {
+	ti := newTestOIDCIssuer(t)
+	defer ti.srv.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		oidc {
+			issuer: %q
+			account_claim: "nats_account"
+			permissions_claim: "nats_permissions"
+		}
+		accounts {
+			A {}
+			SYS { users: [{user: "sys", password: "pwd"}] }
+		}
+		system_account: "SYS"
+		authorization { token: "not.a.jwt" }
+	`, ti.srv.URL)))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	exp := time.Now().Add(time.Hour).Unix()
+
+	// The system account can not be designated by the token.
+	tok := ti.token(t, map[string]interface{}{"iss": ti.srv.URL, "sub": "alice", "exp": exp, "nats_account": "SYS"})
+	if nc, err := nats.Connect(url, nats.Token(tok)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connect to fail for the system account")
+	}
+
+	checkPerms := func(nc *nats.Conn, errCh chan error, subj string, allowed bool) {
+		t.Helper()
+		sub := natsSubSync(t, nc, subj)
+		natsFlush(t, nc)
+		select {
+		case err := <-errCh:
+			if allowed {
+				t.Fatalf("Unexpected error on %q: %v", subj, err)
+			}
+		case <-time.After(250 * time.Millisecond):
+			if !allowed {
+				t.Fatalf("Expected permissions violation on %q", subj)
+			}
+		}
+		sub.Unsubscribe()
+	}
+	connect := func(claims map[string]interface{}) (*nats.Conn, chan error) {
+		t.Helper()
+		errCh := make(chan error, 10)
+		nc, err := nats.Connect(url, nats.Token(ti.token(t, claims)),
+			nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) {
+				errCh <- err
+			}))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		return nc, errCh
+	}
+
+	// Without the permissions claim, everything is denied.
+	nc, errCh := connect(map[string]interface{}{"iss": ti.srv.URL, "sub": "alice", "exp": exp, "nats_account": "A"})
+	checkPerms(nc, errCh, "foo", false)
+	nc.Close()
+
+	// Otherwise the claim's permissions apply.
+	nc, errCh = connect(map[string]interface{}{"iss": ti.srv.URL, "sub": "bob", "exp": exp, "nats_account": "A",
+		"nats_permissions": map[string]interface{}{"subscribe": map[string]interface{}{"allow": []string{"foo"}}}})
+	checkPerms(nc, errCh, "foo", true)
+	checkPerms(nc, errCh, "bar", false)
+	nc.Close()
+
+	// A token with dots that is not a JWT uses the regular token authentication.
+	nc, err := nats.Connect(url, nats.Token("not.a.jwt"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+}
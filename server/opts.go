@@ -27,6 +27,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync/atomic"
@@ -55,11 +56,13 @@ func NoErrOnUnknownFields(noError bool) {
 // NOTE: This structure is no longer used for monitoring endpoints
 // and json tags are deprecated and may be removed in the future.
 type ClusterOpts struct {
+	Name           string            `json:"name,omitempty"`
 	Host           string            `json:"addr,omitempty"`
 	Port           int               `json:"cluster_port,omitempty"`
 	Username       string            `json:"-"`
 	Password       string            `json:"-"`
 	AuthTimeout    float64           `json:"auth_timeout,omitempty"`
+	MaxPendingAuth int               `json:"-"`
 	Permissions    *RoutePermissions `json:"-"`
 	TLSTimeout     float64           `json:"-"`
 	TLSConfig      *tls.Config       `json:"-"`
@@ -68,6 +71,44 @@ type ClusterOpts struct {
 	Advertise      string            `json:"-"`
 	NoAdvertise    bool              `json:"-"`
 	ConnectRetries int               `json:"-"`
+	NkeySeed       string            `json:"-"`
+	Nkeys          []string          `json:"-"`
+	// InterestBatchWindow, if positive, is the time during which interest
+	// updates are accumulated before being sent to the routes. Updates that
+	// cancel each other during that window are not sent at all.
+	InterestBatchWindow time.Duration `json:"-"`
+	// MaxControlLine, if positive, overrides the server max_control_line
+	// for route connections.
+	MaxControlLine int32 `json:"max_control_line,omitempty"`
+	// Socket tunes the route connections.
+	Socket *SocketOpts `json:"-"`
+	// LoadReportInterval, if positive, is the interval at which the server
+	// reports its load score to the routes. The scores are sent to clients
+	// along with the connect URLs.
+	LoadReportInterval time.Duration `json:"-"`
+	// ConnectURLsOrder, if set, orders the connect URLs sent to each client,
+	// see ConnectURLsShuffle and ConnectURLsLoad.
+	ConnectURLsOrder string `json:"-"`
+	// WriteCork, if positive, is the time during which small writes to the
+	// routes are held to be coalesced with the ones that follow.
+	WriteCork time.Duration `json:"-"`
+	// Retry, if set, is the backoff between the attempts to connect to
+	// the routes.
+	Retry *RetryPolicy `json:"-"`
+	// ConnectURLsDamping, if positive, is the time during which changes
+	// to the connect URLs of the routes are batched before an INFO is
+	// sent to clients.
+	ConnectURLsDamping time.Duration `json:"-"`
+}
+
+// AccountAuditOpts are options for auditing messages that cross accounts
+// through stream or service imports.
+type AccountAuditOpts struct {
+	// Log each crossing.
+	Log bool `json:"log,omitempty"`
+	// Send an advisory to $SYS.ACCOUNT.<from account>.AUDIT.CROSSING
+	// for each crossing.
+	Advisory bool `json:"advisory,omitempty"`
 }
 
 // GatewayOpts are options for gateways.
@@ -87,6 +128,15 @@ type GatewayOpts struct {
 	ConnectRetries int                  `json:"connect_retries,omitempty"`
 	Gateways       []*RemoteGatewayOpts `json:"gateways,omitempty"`
 	RejectUnknown  bool                 `json:"reject_unknown,omitempty"`
+	MaxControlLine int32                `json:"max_control_line,omitempty"`
+	Socket         *SocketOpts          `json:"-"`
+	AccountEgress  *GatewayEgressOpts   `json:"account_egress,omitempty"`
+	// WriteCork, if positive, is the time during which small writes to the
+	// gateways are held to be coalesced with the ones that follow.
+	WriteCork time.Duration `json:"-"`
+	// Retry, if set, is the backoff between the attempts to connect to
+	// the gateways.
+	Retry *RetryPolicy `json:"-"`
 
 	// Not exported, for tests.
 	resolver         netResolver
@@ -101,6 +151,45 @@ type RemoteGatewayOpts struct {
 	TLSConfig  *tls.Config `json:"-"`
 	TLSTimeout float64     `json:"tls_timeout,omitempty"`
 	URLs       []*url.URL  `json:"urls,omitempty"`
+	// If set, connections to this gateway are dialed through this HTTP
+	// CONNECT or SOCKS5 proxy.
+	Proxy *url.URL `json:"-"`
+	// If set, inbound connections from this gateway must present a TLS
+	// certificate whose email, DNS name or subject is in this list.
+	TLSIdentities []string `json:"-"`
+}
+
+// Payload redactions of the trace logs.
+const (
+	// TraceRedactHash traces the size and the SHA-256 hash of payloads.
+	TraceRedactHash = "hash"
+	// TraceRedactTruncate traces the size and the first bytes of payloads.
+	TraceRedactTruncate = "truncate"
+)
+
+// TraceRedactionOpts are options for redacting the protocols traced, so
+// that tracing can be enabled where payloads and credentials must not be
+// logged. Passwords are always redacted.
+type TraceRedactionOpts struct {
+	// Payload is either TraceRedactHash or TraceRedactTruncate.
+	Payload string `json:"payload,omitempty"`
+	// PayloadLen is the number of bytes of payloads kept by
+	// TraceRedactTruncate.
+	PayloadLen int `json:"payload_len,omitempty"`
+	// Connect masks the auth token, JWT and signature of CONNECT protocols.
+	Connect bool `json:"connect,omitempty"`
+}
+
+// ClientInfoOpts hide or replace details about the server in the INFO
+// sent to clients, which they receive before authenticating. Hiding a
+// field takes precedence over replacing it.
+type ClientInfoOpts struct {
+	HideVersion bool   `json:"hide_version,omitempty"`
+	Version     string `json:"version,omitempty"`
+	HideGo      bool   `json:"hide_go,omitempty"`
+	Go          string `json:"go,omitempty"`
+	HideHost    bool   `json:"hide_host,omitempty"`
+	Host        string `json:"host,omitempty"`
 }
 
 // LeafNodeOpts are options for a given server to accept leaf node connections and/or connect to a remote cluster.
@@ -112,12 +201,19 @@ type LeafNodeOpts struct {
 	Account           string        `json:"-"`
 	Users             []*User       `json:"-"`
 	AuthTimeout       float64       `json:"auth_timeout,omitempty"`
+	MaxPendingAuth    int           `json:"-"`
 	TLSConfig         *tls.Config   `json:"-"`
 	TLSTimeout        float64       `json:"tls_timeout,omitempty"`
 	TLSMap            bool          `json:"-"`
 	Advertise         string        `json:"-"`
 	NoAdvertise       bool          `json:"-"`
 	ReconnectInterval time.Duration `json:"-"`
+	MaxControlLine    int32         `json:"max_control_line,omitempty"`
+	Socket            *SocketOpts   `json:"-"`
+
+	// Limits the interest and messages exchanged with accepted leaf node
+	// connections whose user has no permissions.
+	Permissions *RoutePermissions `json:"-"`
 
 	// For solicited connections to other clusters/superclusters.
 	Remotes []*RemoteLeafOpts `json:"remotes,omitempty"`
@@ -136,83 +232,206 @@ type RemoteLeafOpts struct {
 	TLS          bool        `json:"-"`
 	TLSConfig    *tls.Config `json:"-"`
 	TLSTimeout   float64     `json:"tls_timeout,omitempty"`
+	// If set, connections to the remote are dialed through this HTTP
+	// CONNECT or SOCKS5 proxy.
+	Proxy *url.URL `json:"-"`
+	// Limits the interest and messages exchanged with the remote.
+	Permissions *RoutePermissions `json:"-"`
+	// Retry, if set, is the backoff between the attempts to connect to
+	// the remote.
+	Retry *RetryPolicy `json:"-"`
 }
 
 // Options block for nats-server.
 // NOTE: This structure is no longer used for monitoring endpoints
 // and json tags are deprecated and may be removed in the future.
 type Options struct {
-	ConfigFile            string        `json:"-"`
-	ServerName            string        `json:"server_name"`
-	Host                  string        `json:"addr"`
-	Port                  int           `json:"port"`
-	ClientAdvertise       string        `json:"-"`
-	Trace                 bool          `json:"-"`
-	Debug                 bool          `json:"-"`
-	TraceVerbose          bool          `json:"-"`
-	NoLog                 bool          `json:"-"`
-	NoSigs                bool          `json:"-"`
-	NoSublistCache        bool          `json:"-"`
-	DisableShortFirstPing bool          `json:"-"`
-	Logtime               bool          `json:"-"`
-	MaxConn               int           `json:"max_connections"`
-	MaxSubs               int           `json:"max_subscriptions,omitempty"`
-	Nkeys                 []*NkeyUser   `json:"-"`
-	Users                 []*User       `json:"-"`
-	Accounts              []*Account    `json:"-"`
-	SystemAccount         string        `json:"-"`
-	AllowNewAccounts      bool          `json:"-"`
-	Username              string        `json:"-"`
-	Password              string        `json:"-"`
-	Authorization         string        `json:"-"`
-	PingInterval          time.Duration `json:"ping_interval"`
-	MaxPingsOut           int           `json:"ping_max"`
-	HTTPHost              string        `json:"http_host"`
-	HTTPPort              int           `json:"http_port"`
-	HTTPSPort             int           `json:"https_port"`
-	AuthTimeout           float64       `json:"auth_timeout"`
-	MaxControlLine        int32         `json:"max_control_line"`
-	MaxPayload            int32         `json:"max_payload"`
-	MaxPending            int64         `json:"max_pending"`
-	Cluster               ClusterOpts   `json:"cluster,omitempty"`
-	Gateway               GatewayOpts   `json:"gateway,omitempty"`
-	LeafNode              LeafNodeOpts  `json:"leaf,omitempty"`
-	ProfPort              int           `json:"-"`
-	PidFile               string        `json:"-"`
-	PortsFileDir          string        `json:"-"`
-	LogFile               string        `json:"-"`
-	LogSizeLimit          int64         `json:"-"`
-	Syslog                bool          `json:"-"`
-	RemoteSyslog          string        `json:"-"`
-	Routes                []*url.URL    `json:"-"`
-	RoutesStr             string        `json:"-"`
-	TLSTimeout            float64       `json:"tls_timeout"`
-	TLS                   bool          `json:"-"`
-	TLSVerify             bool          `json:"-"`
-	TLSMap                bool          `json:"-"`
-	TLSCert               string        `json:"-"`
-	TLSKey                string        `json:"-"`
-	TLSCaCert             string        `json:"-"`
-	TLSConfig             *tls.Config   `json:"-"`
-	WriteDeadline         time.Duration `json:"-"`
-	MaxClosedClients      int           `json:"-"`
-	LameDuckDuration      time.Duration `json:"-"`
+	ConfigFile            string           `json:"-"`
+	ServerName            string           `json:"server_name"`
+	Host                  string           `json:"addr"`
+	Port                  int              `json:"port"`
+	ClientAdvertise       string           `json:"-"`
+	Trace                 bool             `json:"-"`
+	Debug                 bool             `json:"-"`
+	TraceVerbose          bool             `json:"-"`
+	NoLog                 bool             `json:"-"`
+	NoSigs                bool             `json:"-"`
+	NoSublistCache        bool             `json:"-"`
+	DisableShortFirstPing bool             `json:"-"`
+	Logtime               bool             `json:"-"`
+	MaxConn               int              `json:"max_connections"`
+	MaxPendingAuth        int              `json:"max_pending_auth,omitempty"`
+	MaxSubs               int              `json:"max_subscriptions,omitempty"`
+	Nkeys                 []*NkeyUser      `json:"-"`
+	Users                 []*User          `json:"-"`
+	Accounts              []*Account       `json:"-"`
+	SystemAccount         string           `json:"-"`
+	AllowNewAccounts      bool             `json:"-"`
+	Username              string           `json:"-"`
+	Password              string           `json:"-"`
+	Authorization         string           `json:"-"`
+	PingInterval          time.Duration    `json:"ping_interval"`
+	MaxPingsOut           int              `json:"ping_max"`
+	HTTPHost              string           `json:"http_host"`
+	HTTPPort              int              `json:"http_port"`
+	HTTPSPort             int              `json:"https_port"`
+	AuthTimeout           float64          `json:"auth_timeout"`
+	MaxControlLine        int32            `json:"max_control_line"`
+	MaxSubjectLength      int32            `json:"max_subject_len,omitempty"`
+	MaxSubjectTokens      int32            `json:"max_subject_tokens,omitempty"`
+	MaxReplyLength        int32            `json:"max_reply_len,omitempty"`
+	StrictProtocol        bool             `json:"strict_protocol,omitempty"`
+	MaxPayload            int32            `json:"max_payload"`
+	MaxPending            int64            `json:"max_pending"`
+	MaxMemory             int64            `json:"max_memory,omitempty"`
+	ProtoErrorDump        int              `json:"proto_error_dump,omitempty"`
+	MaxScannerResponses   int              `json:"max_scanner_responses,omitempty"`
+	MaxConnectionLifetime time.Duration    `json:"max_connection_lifetime,omitempty"`
+	JWTExpiryWarning      time.Duration    `json:"jwt_expiry_warning,omitempty"`
+	CertExpiryWarning     time.Duration    `json:"cert_expiry_warning,omitempty"`
+	SecretsRefresh        time.Duration    `json:"secrets_refresh,omitempty"`
+	InterestSnapshot      string           `json:"-"`
+	InterestSnapshotTTL   time.Duration    `json:"-"`
+	Watchdog              time.Duration    `json:"watchdog,omitempty"`
+	LatencySampling       int              `json:"latency_sampling,omitempty"`
+	Watermarks            *WatermarkOpts   `json:"watermarks,omitempty"`
+	Admission             *AdmissionOpts   `json:"admission,omitempty"`
+	Suspend               *SuspendOpts     `json:"suspend,omitempty"`
+	AcceptErrors          *AcceptErrorOpts `json:"accept_errors,omitempty"`
+	AuthBan               *AuthBanOpts     `json:"auth_ban,omitempty"`
+	ListenRetry           time.Duration    `json:"listen_retry,omitempty"`
+	Compression           string           `json:"compression,omitempty"`
+	OutboundDial          OutboundDialOpts `json:"-"`
+	Socket                *SocketOpts      `json:"-"`
+	// ClientAcceptors, if greater than 1, is the number of SO_REUSEPORT
+	// listeners, each with its own accept loop, opened on the client port.
+	ClientAcceptors  int            `json:"-"`
+	ClientInfo       ClientInfoOpts `json:"-"`
+	Cluster          ClusterOpts    `json:"cluster,omitempty"`
+	Gateway          GatewayOpts    `json:"gateway,omitempty"`
+	LeafNode         LeafNodeOpts   `json:"leaf,omitempty"`
+	Stomp            *StompOpts     `json:"stomp,omitempty"`
+	GRPC             *GRPCOpts      `json:"grpc,omitempty"`
+	ProfPort         int            `json:"-"`
+	PidFile          string         `json:"-"`
+	PortsFileDir     string         `json:"-"`
+	StartupReport    string         `json:"-"`
+	StateSnapshotDir string         `json:"-"`
+	Quiet            bool           `json:"-"`
+	LogFile          string         `json:"-"`
+	LogSizeLimit     int64          `json:"-"`
+	Syslog           bool           `json:"-"`
+	RemoteSyslog     string         `json:"-"`
+	Routes           []*url.URL     `json:"-"`
+	RoutesStr        string         `json:"-"`
+	TLSTimeout       float64        `json:"tls_timeout"`
+	TLS              bool           `json:"-"`
+	TLSVerify        bool           `json:"-"`
+	TLSMap           bool           `json:"-"`
+	TLSCert          string         `json:"-"`
+	TLSKey           string         `json:"-"`
+	TLSCaCert        string         `json:"-"`
+	TLSConfig        *tls.Config    `json:"-"`
+	WriteDeadline    time.Duration  `json:"-"`
+	MaxClosedClients int            `json:"-"`
+	LameDuckDuration time.Duration  `json:"-"`
 	// MaxTracedMsgLen is the maximum printable length for traced messages.
 	MaxTracedMsgLen int `json:"-"`
+	// TraceRedaction redacts payloads and credentials of traced protocols.
+	TraceRedaction *TraceRedactionOpts `json:"-"`
 
 	// Operating a trusted NATS server
 	TrustedKeys              []string              `json:"-"`
 	TrustedOperators         []*jwt.OperatorClaims `json:"-"`
 	AccountResolver          AccountResolver       `json:"-"`
 	AccountResolverTLSConfig *tls.Config           `json:"-"`
+	AccountTemplate          *AccountTemplate      `json:"-"`
+	ResolverCache            *ResolverCacheOpts    `json:"-"`
 	resolverPreloads         map[string]string
 
 	CustomClientAuthentication Authentication `json:"-"`
 	CustomRouterAuthentication Authentication `json:"-"`
 
+	// OIDC enables validation of bearer tokens presented by clients.
+	OIDC *OIDCOpts `json:"-"`
+
+	// Policy delegates the authorization decisions of clients to an
+	// external policy engine.
+	Policy *PolicyOpts `json:"-"`
+
+	// JoinTokens enables routes and leafnodes to join with short-lived
+	// tokens.
+	JoinTokens *JoinTokenOpts `json:"-"`
+
+	// AccountAudit enables the auditing of messages crossing accounts.
+	AccountAudit *AccountAuditOpts `json:"-"`
+
+	// AccountUsage enables the publishing of account usage records.
+	AccountUsage *AccountUsageOpts `json:"-"`
+
+	// TrafficStats enables the message size and top talkers stats in varz.
+	TrafficStats *TrafficStatsOpts `json:"-"`
+
+	// ClockSkewThreshold is the clock skew with a route or gateway above
+	// which a warning is logged, DEFAULT_CLOCK_SKEW_THRESHOLD if 0, never
+	// if negative.
+	ClockSkewThreshold time.Duration `json:"-"`
+
+	// AdvertiseResolveInterval, if positive, is the interval at which the
+	// client_advertise host name is resolved. The server then advertises
+	// the addresses instead of the name.
+	AdvertiseResolveInterval time.Duration `json:"-"`
+
+	// HTTPPublish enables the POST /v1/publish/<subject> endpoint of the
+	// monitoring port.
+	HTTPPublish bool `json:"-"`
+
+	// CloudEvents enables the CloudEvents 1.0 envelopes on the publish
+	// endpoint of the monitoring port.
+	CloudEvents bool `json:"-"`
+
+	// WritePacing limits the rate at which messages are written to each
+	// client connection.
+	WritePacing *WritePacingOpts `json:"-"`
+
+	// UniqueConnections limits clients to one connection per identity.
+	UniqueConnections *UniqueConnOpts `json:"-"`
+
+	// SchemaValidation enables the validation of published payloads
+	// against the schemas of their subjects.
+	SchemaValidation *SchemaValidationOpts `json:"-"`
+
+	// PasswordHashing configures the rehashing of user passwords on login.
+	PasswordHashing *PasswordHashingOpts `json:"-"`
+
+	// SubjectRateLimits protects subjects from publishers exceeding
+	// a maximum message rate.
+	SubjectRateLimits []*SubjectRateLimit `json:"-"`
+
+	// SubscriptionEvents enables advisories on the creation and deletion
+	// of client subscriptions.
+	SubscriptionEvents *SubscriptionEventOpts `json:"-"`
+
+	// FirehoseSubjects are wildcard subjects. Plain client subscriptions
+	// that match at least everything one of them matches are delivered
+	// through a separate path instead of being added to the sublist.
+	FirehoseSubjects []string `json:"-"`
+
+	// PasswordRehashed, if set, is invoked with the new hash when a user
+	// password has been rehashed, so that it can be persisted.
+	PasswordRehashed func(username, hash string) `json:"-"`
+
+	// MessageInterceptors, if set, are passed in order the messages
+	// published by clients. See MessageInterceptor.
+	MessageInterceptors []MessageInterceptor `json:"-"`
+
 	// CheckConfig configuration file syntax test was successful and exit.
 	CheckConfig bool `json:"-"`
 
+	// IssueJoinToken, set from the command line, is the join token to
+	// print before exiting.
+	IssueJoinToken *JoinTokenRequest `json:"-"`
+
 	// ConnectErrorReports specifies the number of failed attempts
 	// at which point server should report the failure of an initial
 	// connection to a route, gateway or leaf node.
@@ -223,11 +442,34 @@ type Options struct {
 	// that this applies to reconnect events.
 	ReconnectErrorReports int
 
+	// ConfigStrictness is how unknown fields of the configuration file are
+	// reported, ConfigStrictnessError if not set.
+	ConfigStrictness string `json:"config_strictness,omitempty"`
+
+	// ContainerLimits enables the detection of the cgroup CPU and memory
+	// limits used to size GOMAXPROCS and the default MaxPending. Off by
+	// default since GOMAXPROCS is process wide.
+	ContainerLimits bool `json:"-"`
+
+	// MemoryProfile pre-sizes the server and tunes the GC for the number
+	// of connections expected: MemoryProfileSmall, MemoryProfileMedium or
+	// MemoryProfileLarge. GCPercent and MemoryBallast, if set, override
+	// the ones of the profile. None of these can be reloaded.
+	MemoryProfile string `json:"memory_profile,omitempty"`
+	GCPercent     int    `json:"gc_percent,omitempty"`
+	MemoryBallast int64  `json:"memory_ballast,omitempty"`
+
 	// private fields, used to know if bool options are explicitly
 	// defined in config and/or command line params.
 	inConfig  map[string]bool
 	inCmdLine map[string]bool
 
+	// secret references found in the configuration file.
+	secretRefs []string
+
+	// deprecated and unknown fields found in the configuration file.
+	configWarnings []*ConfigWarning
+
 	// private fields, used for testing
 	gatewaysSolicitDelay time.Duration
 	routeProto           int
@@ -312,6 +554,8 @@ type authorization struct {
 type TLSConfigOpts struct {
 	CertFile         string
 	KeyFile          string
+	CertSecret       string
+	KeySecret        string
 	CaFile           string
 	Verify           bool
 	Insecure         bool
@@ -439,6 +683,36 @@ func configureSystemAccount(o *Options, m map[string]interface{}) (retErr error)
 	return nil
 }
 
+// maxControlLine returns the maximum control line for connections of the
+// given kind, which can be overridden for routes, gateways and leafnodes.
+func (o *Options) maxControlLine(kind int) int32 {
+	var mcl int32
+	switch kind {
+	case ROUTER:
+		mcl = o.Cluster.MaxControlLine
+	case GATEWAY:
+		mcl = o.Gateway.MaxControlLine
+	case LEAF:
+		mcl = o.LeafNode.MaxControlLine
+	}
+	if mcl <= 0 {
+		mcl = o.MaxControlLine
+	}
+	return mcl
+}
+
+// writeCork returns the time small writes are held for connections of
+// the given kind, 0 if they are written right away.
+func (o *Options) writeCork(kind int) time.Duration {
+	switch kind {
+	case ROUTER:
+		return o.Cluster.WriteCork
+	case GATEWAY:
+		return o.Gateway.WriteCork
+	}
+	return 0
+}
+
 // ProcessConfigFile updates the Options structure with options
 // present in the given configuration file.
 // This version is convenient if one wants to set some default
@@ -475,6 +749,8 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 	for k, v := range m {
 		o.processConfigFileLine(k, v, &errors, &warnings)
 	}
+	o.secretRefs = collectSecretRefs(m, nil)
+	o.configWarnings = applyConfigStrictness(o.ConfigStrictness, &errors, &warnings)
 
 	if len(errors) > 0 || len(warnings) > 0 {
 		return &processConfigErr{
@@ -530,6 +806,13 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			*errors = append(*errors, err)
 			return
 		}
+	case "account_template":
+		at, err := parseAccountTemplate(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.AccountTemplate = at
 	case "authorization":
 		auth, err := parseAuthorization(tk, o, errors, warnings)
 		if err != nil {
@@ -567,6 +850,120 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			// NKeys may have been added from Accounts parsing, so do an append here
 			o.Nkeys = append(o.Nkeys, auth.nkeys...)
 		}
+	case "oidc":
+		oo, err := parseOIDC(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.OIDC = oo
+	case "policy":
+		po, err := parsePolicy(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.Policy = po
+	case "join_tokens":
+		jt, err := parseJoinTokens(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.JoinTokens = jt
+	case "outbound_dial":
+		od, err := parseOutboundDial(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.OutboundDial = od
+	case "account_usage":
+		au, err := parseAccountUsage(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.AccountUsage = au
+	case "unique_connections":
+		uo, err := parseUniqueConnections(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.UniqueConnections = uo
+	case "schema_validation":
+		sv, err := parseSchemaValidation(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.SchemaValidation = sv
+	case "traffic_stats":
+		ts, err := parseTrafficStats(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.TrafficStats = ts
+	case "clock_skew_threshold":
+		o.ClockSkewThreshold = parseDuration("clock_skew_threshold", tk, v, errors, warnings)
+	case "advertise_resolve_interval":
+		o.AdvertiseResolveInterval = parseDuration("advertise_resolve_interval", tk, v, errors, warnings)
+	case "http_publish":
+		o.HTTPPublish = v.(bool)
+	case "cloudevents", "cloud_events":
+		o.CloudEvents = v.(bool)
+	case "write_pacing":
+		wp, err := parseWritePacing(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.WritePacing = wp
+	case "account_audit":
+		aa, err := parseAccountAudit(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.AccountAudit = aa
+	case "password_hashing":
+		ph, err := parsePasswordHashing(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.PasswordHashing = ph
+	case "subscription_events":
+		se, err := parseSubscriptionEvents(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.SubscriptionEvents = se
+	case "firehose_subjects":
+		switch fv := v.(type) {
+		case string:
+			o.FirehoseSubjects = []string{fv}
+		case []interface{}:
+			o.FirehoseSubjects = nil
+			for _, s := range fv {
+				_, s = unwrapValue(s, &lt)
+				o.FirehoseSubjects = append(o.FirehoseSubjects, s.(string))
+			}
+		default:
+			err := &configErr{tk, fmt.Sprintf("Expected firehose_subjects to be a string or an array, got %T", v)}
+			*errors = append(*errors, err)
+			return
+		}
+	case "subject_rate_limits":
+		limits, err := parseSubjectRateLimits(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.SubjectRateLimits = limits
 	case "http":
 		hp, err := parseListen(v)
 		if err != nil {
@@ -606,6 +1003,20 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			*errors = append(*errors, err)
 			return
 		}
+	case "stomp":
+		so, err := parseStomp(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.Stomp = so
+	case "grpc":
+		gro, err := parseGRPC(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.GRPC = gro
 	case "logfile", "log_file":
 		o.LogFile = v.(string)
 	case "logfile_size_limit", "log_size_limit":
@@ -619,8 +1030,29 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		o.PidFile = v.(string)
 	case "ports_file_dir":
 		o.PortsFileDir = v.(string)
+	case "startup_report":
+		o.StartupReport = v.(string)
+	case "state_snapshot_dir":
+		o.StateSnapshotDir = v.(string)
+	case "container_limits":
+		o.ContainerLimits = v.(bool)
+	case "memory_profile":
+		o.MemoryProfile = strings.ToLower(v.(string))
+	case "gc_percent":
+		o.GCPercent = int(v.(int64))
+	case "memory_ballast":
+		o.MemoryBallast = v.(int64)
 	case "prof_port":
 		o.ProfPort = int(v.(int64))
+	case "socket":
+		so, err := parseSocketOpts(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.Socket = so
+	case "client_acceptors":
+		o.ClientAcceptors = int(v.(int64))
 	case "max_control_line":
 		if v.(int64) > 1<<31-1 {
 			err := &configErr{tk, fmt.Sprintf("%s value is too big", k)}
@@ -637,10 +1069,107 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		o.MaxPayload = int32(v.(int64))
 	case "max_pending":
 		o.MaxPending = v.(int64)
+	case "max_subject_len", "max_subject_length":
+		o.MaxSubjectLength = int32(v.(int64))
+	case "max_subject_tokens":
+		o.MaxSubjectTokens = int32(v.(int64))
+	case "max_reply_len", "max_reply_length":
+		o.MaxReplyLength = int32(v.(int64))
+	case "strict_protocol":
+		o.StrictProtocol = v.(bool)
+	case "max_memory":
+		o.MaxMemory = v.(int64)
+	case "proto_error_dump":
+		o.ProtoErrorDump = int(v.(int64))
+	case "max_scanner_responses":
+		o.MaxScannerResponses = int(v.(int64))
+	case "max_connection_lifetime", "max_conn_lifetime":
+		o.MaxConnectionLifetime = parseDuration("max_connection_lifetime", tk, v, errors, warnings)
+	case "jwt_expiry_warning":
+		o.JWTExpiryWarning = parseDuration("jwt_expiry_warning", tk, v, errors, warnings)
+	case "cert_expiry_warning":
+		o.CertExpiryWarning = parseDuration("cert_expiry_warning", tk, v, errors, warnings)
+	case "secrets_refresh":
+		o.SecretsRefresh = parseDuration("secrets_refresh", tk, v, errors, warnings)
+	case "interest_snapshot":
+		o.InterestSnapshot = v.(string)
+	case "interest_snapshot_ttl":
+		o.InterestSnapshotTTL = parseDuration("interest_snapshot_ttl", tk, v, errors, warnings)
+	case "watchdog":
+		o.Watchdog = parseDuration("watchdog", tk, v, errors, warnings)
+	case "latency_sampling":
+		o.LatencySampling = int(v.(int64))
+	case "watermarks":
+		wo, err := parseWatermarks(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.Watermarks = wo
+	case "admission", "admission_control":
+		ao, err := parseAdmission(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.Admission = ao
+	case "auth_ban":
+		bo, err := parseAuthBan(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.AuthBan = bo
+	case "suspend":
+		so, err := parseSuspend(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.Suspend = so
+	case "accept_errors":
+		ao, err := parseAcceptErrors(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.AcceptErrors = ao
+	case "listen_retry":
+		o.ListenRetry = parseDuration("listen_retry", tk, v, errors, warnings)
+	case "client_info":
+		ci, err := parseClientInfo(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.ClientInfo = ci
+	case "compression":
+		switch vv := v.(type) {
+		case bool:
+			if vv {
+				o.Compression = CompressionS2
+			} else {
+				o.Compression = _EMPTY_
+			}
+		case string:
+			o.Compression = strings.ToLower(vv)
+		default:
+			err := &configErr{tk, fmt.Sprintf("Expected compression to be a boolean or a string, got %T", v)}
+			*errors = append(*errors, err)
+		}
 	case "max_connections", "max_conn":
 		o.MaxConn = int(v.(int64))
+	case "max_pending_auth":
+		o.MaxPendingAuth = int(v.(int64))
 	case "max_traced_msg_len":
 		o.MaxTracedMsgLen = int(v.(int64))
+	case "trace_redaction":
+		tr, err := parseTraceRedaction(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.TraceRedaction = tr
 	case "max_subscriptions", "max_subs":
 		o.MaxSubs = int(v.(int64))
 	case "ping_interval":
@@ -730,6 +1259,13 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			err := &configErr{tk, "error parsing account resolver, should be MEM or URL(\"url\")"}
 			*errors = append(*errors, err)
 		}
+	case "resolver_cache":
+		rc, err := parseResolverCache(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.ResolverCache = rc
 	case "resolver_tls":
 		tc, err := parseTLS(tk)
 		if err != nil {
@@ -800,6 +1336,8 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 				*errors = append(*errors, err)
 			}
 		}
+	case "config_strictness":
+		o.ConfigStrictness = strings.ToLower(v.(string))
 	case "connect_error_reports":
 		o.ConnectErrorReports = int(v.(int64))
 	case "reconnect_error_reports":
@@ -829,13 +1367,13 @@ func parseDuration(field string, tk token, v interface{}, errors *[]error, warni
 	} else {
 		// Backward compatible with old type, assume this is the
 		// number of seconds.
-		err := &configWarningErr{
+		err := &configDeprecationErr{configWarningErr{
 			field: field,
 			configErr: configErr{
 				token:  tk,
 				reason: field + " should be converted to a duration",
 			},
-		}
+		}}
 		*warnings = append(*warnings, err)
 		return time.Duration(v.(int64)) * time.Second
 	}
@@ -901,8 +1439,12 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			}
 			opts.Cluster.Host = hp.host
 			opts.Cluster.Port = hp.port
+		case "name":
+			opts.Cluster.Name = mv.(string)
 		case "port":
 			opts.Cluster.Port = int(mv.(int64))
+		case "max_pending_auth":
+			opts.Cluster.MaxPendingAuth = int(mv.(int64))
 		case "host", "net":
 			opts.Cluster.Host = mv.(string)
 		case "authorization":
@@ -921,13 +1463,13 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			opts.Cluster.AuthTimeout = auth.timeout
 
 			if auth.defaultPermissions != nil {
-				err := &configWarningErr{
+				err := &configDeprecationErr{configWarningErr{
 					field: mk,
 					configErr: configErr{
 						token:  tk,
 						reason: `setting "permissions" within cluster authorization block is deprecated`,
 					},
-				}
+				}}
 				*warnings = append(*warnings, err)
 
 				// Do not set permissions if they were specified in top-level cluster block.
@@ -944,7 +1486,7 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			}
 			opts.Routes = routes
 		case "tls":
-			config, tlsopts, err := getTLSConfig(tk)
+			config, tlsopts, err := getClusterTLSConfig(tk, warnings)
 			if err != nil {
 				*errors = append(*errors, err)
 				continue
@@ -959,6 +1501,59 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			trackExplicitVal(opts, &opts.inConfig, "Cluster.NoAdvertise", opts.Cluster.NoAdvertise)
 		case "connect_retries":
 			opts.Cluster.ConnectRetries = int(mv.(int64))
+		case "interest_batch_window":
+			opts.Cluster.InterestBatchWindow = parseDuration("interest_batch_window", tk, mv, errors, warnings)
+		case "max_control_line":
+			opts.Cluster.MaxControlLine = int32(mv.(int64))
+		case "load_report_interval":
+			opts.Cluster.LoadReportInterval = parseDuration("load_report_interval", tk, mv, errors, warnings)
+		case "connect_urls_order":
+			opts.Cluster.ConnectURLsOrder = mv.(string)
+		case "write_cork":
+			opts.Cluster.WriteCork = parseDuration("write_cork", tk, mv, errors, warnings)
+		case "connect_urls_damping":
+			opts.Cluster.ConnectURLsDamping = parseDuration("connect_urls_damping", tk, mv, errors, warnings)
+		case "socket":
+			so, err := parseSocketOpts(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.Socket = so
+		case "retry":
+			rp, err := parseRetryPolicy(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.Cluster.Retry = rp
+		case "nkey_seed", "seed":
+			seed := mv.(string)
+			kp, err := nkeys.FromSeed([]byte(seed))
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Invalid cluster nkey seed: %v", err)})
+				continue
+			}
+			if pub, _ := kp.PublicKey(); !nkeys.IsValidPublicServerKey(pub) {
+				*errors = append(*errors, &configErr{tk, "Cluster nkey seed should be a server seed"})
+				continue
+			}
+			opts.Cluster.NkeySeed = seed
+		case "nkeys":
+			keys, ok := mv.([]interface{})
+			if !ok {
+				*errors = append(*errors, &configErr{tk, "Cluster nkeys should be an array of server public keys"})
+				continue
+			}
+			for _, k := range keys {
+				_, k = unwrapValue(k, &lt)
+				key := k.(string)
+				if !nkeys.IsValidPublicServerKey(key) {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("Not a valid public server nkey: %q", key)})
+					continue
+				}
+				opts.Cluster.Nkeys = append(opts.Cluster.Nkeys, key)
+			}
 		case "permissions":
 			perms, err := parseUserPermissions(mv, errors, warnings)
 			if err != nil {
@@ -986,6 +1581,10 @@ func parseCluster(v interface{}, opts *Options, errors *[]error, warnings *[]err
 			}
 		}
 	}
+	// The certificate subject is matched against the cluster user.
+	if opts.Cluster.TLSMap && opts.Cluster.Username == "" {
+		return &configErr{tk, "cluster tls 'verify_and_map' requires a user in the cluster authorization block"}
+	}
 	return nil
 }
 
@@ -1017,6 +1616,17 @@ func parseURL(u string, typ string) (*url.URL, error) {
 	return url, nil
 }
 
+func parseProxyURL(u string) (*url.URL, error) {
+	proxy, err := parseURL(u, "proxy")
+	if err != nil {
+		return nil, err
+	}
+	if err := validateProxyURL(proxy); err != nil {
+		return nil, err
+	}
+	return proxy, nil
+}
+
 func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
 	var lt token
 	defer convertPanicToErrorList(&lt, errors)
@@ -1079,6 +1689,31 @@ func parseGateway(v interface{}, o *Options, errors *[]error, warnings *[]error)
 			o.Gateway.Gateways = gateways
 		case "reject_unknown":
 			o.Gateway.RejectUnknown = mv.(bool)
+		case "max_control_line":
+			o.Gateway.MaxControlLine = int32(mv.(int64))
+		case "write_cork":
+			o.Gateway.WriteCork = parseDuration("write_cork", tk, mv, errors, warnings)
+		case "socket":
+			so, err := parseSocketOpts(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			o.Gateway.Socket = so
+		case "retry":
+			rp, err := parseRetryPolicy(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			o.Gateway.Retry = rp
+		case "account_egress":
+			eo, err := parseGatewayEgress(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			o.Gateway.AccountEgress = eo
 		default:
 			if !tk.IsUsedVariable() {
 				err := &unknownConfigFieldErr{
@@ -1121,6 +1756,8 @@ func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]e
 			opts.LeafNode.Port = hp.port
 		case "port":
 			opts.LeafNode.Port = int(mv.(int64))
+		case "max_pending_auth":
+			opts.LeafNode.MaxPendingAuth = int(mv.(int64))
 		case "host", "net":
 			opts.LeafNode.Host = mv.(string)
 		case "authorization":
@@ -1148,6 +1785,15 @@ func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]e
 			opts.LeafNode.Remotes = remotes
 		case "reconnect", "reconnect_delay", "reconnect_interval":
 			opts.LeafNode.ReconnectInterval = time.Duration(int(mv.(int64))) * time.Second
+		case "max_control_line":
+			opts.LeafNode.MaxControlLine = int32(mv.(int64))
+		case "socket":
+			so, err := parseSocketOpts(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.Socket = so
 		case "tls":
 			tc, err := parseTLS(tk)
 			if err != nil {
@@ -1165,6 +1811,13 @@ func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]e
 		case "no_advertise":
 			opts.LeafNode.NoAdvertise = mv.(bool)
 			trackExplicitVal(opts, &opts.inConfig, "LeafNode.NoAdvertise", opts.LeafNode.NoAdvertise)
+		case "permissions":
+			perms, err := parseLeafPermissions(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.Permissions = perms
 		default:
 			if !tk.IsUsedVariable() {
 				err := &unknownConfigFieldErr{
@@ -1200,7 +1853,12 @@ func parseLeafAuthorization(v interface{}, errors *[]error, warnings *[]error) (
 		case "user", "username":
 			auth.user = mv.(string)
 		case "pass", "password":
-			auth.pass = mv.(string)
+			pass, err := secretValue(mv)
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			auth.pass = pass
 		case "timeout":
 			at := float64(1)
 			switch mv := mv.(type) {
@@ -1268,7 +1926,12 @@ func parseLeafUsers(mv interface{}, errors *[]error, warnings *[]error) ([]*User
 			case "user", "username":
 				user.Username = v.(string)
 			case "pass", "password":
-				user.Password = v.(string)
+				pass, err := secretValue(v)
+				if err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				user.Password = pass
 			case "account":
 				// We really want to save just the account name here, but
 				// the User object is *Account. So we create an account object
@@ -1343,6 +2006,27 @@ func parseRemoteLeafNodes(v interface{}, errors *[]error, warnings *[]error) ([]
 					continue
 				}
 				remote.Credentials = p
+			case "proxy":
+				proxy, err := parseProxyURL(v.(string))
+				if err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				remote.Proxy = proxy
+			case "retry":
+				rp, err := parseRetryPolicy(tk, errors, warnings)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				remote.Retry = rp
+			case "permissions":
+				perms, err := parseLeafPermissions(tk, errors, warnings)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				remote.Permissions = perms
 			case "tls":
 				tc, err := parseTLS(tk)
 				if err != nil {
@@ -1400,6 +2084,57 @@ func getTLSConfig(tk token) (*tls.Config, *TLSConfigOpts, error) {
 	return config, tc, nil
 }
 
+// getClusterTLSConfig returns the TLS configuration of routes, which is
+// independent of the one of clients. Routes present their certificate to
+// each other and verify it by default. With `verify: false`, a route still
+// has to present a certificate but it is not verified, and `insecure`
+// disables all verifications.
+func getClusterTLSConfig(tk token, warnings *[]error) (*tls.Config, *TLSConfigOpts, error) {
+	tc, err := parseTLS(tk)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tc.CertFile == "" && tc.CertSecret == "" {
+		return nil, nil, &configErr{tk, "cluster tls requires 'cert_file' and 'key_file' since routes present their certificate to each other"}
+	}
+	if tc.Map && tc.Insecure {
+		return nil, nil, &configErr{tk, "cluster tls 'verify_and_map' can't be used with 'insecure'"}
+	}
+	config, err := GenTLSConfig(tc)
+	if err != nil {
+		return nil, nil, &configErr{tk, err.Error()}
+	}
+	// Routes always verify each other's certificate, unless insecure.
+	// An explicit `verify: false` does not change that, warn about it.
+	var lt token
+	_, v := unwrapValue(tk, &lt)
+	if tlsm, ok := v.(map[string]interface{}); ok {
+		if _, ok := tlsm["verify"]; ok && !tc.Verify && !tc.Insecure {
+			*warnings = append(*warnings, &configWarningErr{
+				field: "verify",
+				configErr: configErr{
+					token:  tk,
+					reason: clusterTLSVerifyWarning,
+				},
+			})
+		}
+	}
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	if tc.Insecure {
+		config.ClientAuth = tls.RequireAnyClientCert
+		*warnings = append(*warnings, &configWarningErr{
+			field: "insecure",
+			configErr: configErr{
+				token:  tk,
+				reason: clusterTLSInsecureWarning,
+			},
+		})
+	}
+	// We act as both client and server, so we mirror the CA pool.
+	config.RootCAs = config.ClientCAs
+	return config, tc, nil
+}
+
 func parseGateways(v interface{}, errors *[]error, warnings *[]error) ([]*RemoteGatewayOpts, error) {
 	var lt token
 	defer convertPanicToErrorList(&lt, errors)
@@ -1447,14 +2182,34 @@ func parseGateways(v interface{}, errors *[]error, warnings *[]error) ([]*Remote
 					continue
 				}
 				gateway.URLs = urls
-			default:
-				if !tk.IsUsedVariable() {
-					err := &unknownConfigFieldErr{
-						field: k,
-						configErr: configErr{
-							token: tk,
-						},
-					}
+			case "proxy":
+				proxy, err := parseProxyURL(v.(string))
+				if err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				gateway.Proxy = proxy
+			case "tls_identity", "tls_identities":
+				switch iv := v.(type) {
+				case string:
+					gateway.TLSIdentities = []string{iv}
+				case []interface{}:
+					for _, i := range iv {
+						_, i = unwrapValue(i, &lt)
+						gateway.TLSIdentities = append(gateway.TLSIdentities, i.(string))
+					}
+				default:
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected tls_identities to be a string or an array, got %T", v)})
+					continue
+				}
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
 					*errors = append(*errors, err)
 					continue
 				}
@@ -1479,6 +2234,25 @@ func setClusterPermissions(opts *ClusterOpts, perms *Permissions) {
 	}
 }
 
+// parseLeafPermissions will parse the import and export permissions of
+// leaf node connections. They have the same meaning as for routes.
+func parseLeafPermissions(v interface{}, errors, warnings *[]error) (*RoutePermissions, error) {
+	perms, err := parseUserPermissions(v, errors, warnings)
+	if err != nil {
+		return nil, err
+	}
+	// Dynamic response permissions do not make sense here.
+	if perms.Response != nil {
+		var lt token
+		tk, _ := unwrapValue(v, &lt)
+		return nil, &configErr{tk, "Leafnode permissions do not support dynamic responses"}
+	}
+	return &RoutePermissions{
+		Import: perms.Publish,
+		Export: perms.Subscribe,
+	}, nil
+}
+
 // Temp structures to hold account import and export defintions since they need
 // to be processed after being parsed.
 type export struct {
@@ -1487,6 +2261,7 @@ type export struct {
 	accs []string
 	rt   ServiceRespType
 	lat  *serviceLatency
+	deny []string
 }
 
 type importStream struct {
@@ -1569,6 +2344,11 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 			acc := NewAccount(aname)
 			opts.Accounts = append(opts.Accounts, acc)
 
+			var (
+				accUsers     []*User
+				accNkeys     []*NkeyUser
+				defaultPerms *Permissions
+			)
 			for k, v := range mv {
 				tk, mv := unwrapValue(v, &lt)
 				switch strings.ToLower(k) {
@@ -1612,6 +2392,7 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 						u.Account = acc
 					}
 					opts.Users = append(opts.Users, users...)
+					accUsers = append(accUsers, users...)
 
 					for _, u := range nkeys {
 						if _, ok := uorn[u.Nkey]; ok {
@@ -1623,6 +2404,112 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 						u.Account = acc
 					}
 					opts.Nkeys = append(opts.Nkeys, nkeys...)
+					accNkeys = append(accNkeys, nkeys...)
+				case "default_permission", "default_permissions":
+					perms, err := parseUserPermissions(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					defaultPerms = perms
+				case "auth_backend", "authentication_backend":
+					ab, err := parseAuthBackend(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.authBackend = ab
+				case "allow_sources", "allowed_sources":
+					list, err := parseSourceList(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.allowSources = list
+				case "deny_sources", "denied_sources":
+					list, err := parseSourceList(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.denySources = list
+				case "reserved_subjects":
+					reserved, err := parseReservedSubjects(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.reserved = reserved
+					acc.nreserved = int32(len(reserved))
+				case "retain", "retained":
+					r, err := parseRetained(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.setRetained(r)
+				case "archive":
+					t, err := parseArchive(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.setArchive(t)
+				case "replay":
+					b, err := parseReplay(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.setReplay(b)
+				case "encryption":
+					ep, err := parseEncryptionPolicy(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.setEncryptionPolicy(ep)
+				case "subject_quota":
+					q, err := parseSubjectQuota(tk, errors, warnings)
+					if err != nil {
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.setSubjectQuota(q)
+				case "tls_required":
+					acc.tlsRequired = mv.(bool)
+				case "min_wildcard_depth":
+					depth, ok := mv.(int64)
+					if !ok || depth < 0 {
+						err := &configErr{tk, fmt.Sprintf("Expected min_wildcard_depth to be a positive integer, got %v", mv)}
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.minWildcardDepth = int32(depth)
+				case "cpu_quota":
+					cpus, err := parseCPUQuota(mv)
+					if err != nil {
+						*errors = append(*errors, &configErr{tk, err.Error()})
+						continue
+					}
+					acc.SetCPUQuota(cpus)
+				case "schema_policy":
+					policy := strings.ToLower(mv.(string))
+					if err := validateSchemaPolicy(policy); err != nil {
+						*errors = append(*errors, &configErr{tk, err.Error()})
+						continue
+					}
+					acc.schemaPolicy = policy
+				case "ping_interval":
+					acc.pingInterval = parseDuration("ping_interval", tk, mv, errors, warnings)
+				case "ping_max":
+					max, ok := mv.(int64)
+					if !ok || max <= 0 {
+						err := &configErr{tk, fmt.Sprintf("Expected ping_max to be a positive integer, got %v", mv)}
+						*errors = append(*errors, err)
+						continue
+					}
+					acc.maxPingsOut = int(max)
 				default:
 					if !tk.IsUsedVariable() {
 						err := &unknownConfigFieldErr{
@@ -1635,6 +2522,16 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 					}
 				}
 			}
+			// Users of the account inherit its default permissions, in
+			// addition to their own.
+			if defaultPerms != nil {
+				for _, u := range accUsers {
+					u.Permissions = inheritPermissions(defaultPerms, u.Permissions)
+				}
+				for _, u := range accNkeys {
+					u.Permissions = inheritPermissions(defaultPerms, u.Permissions)
+				}
+			}
 		}
 	}
 	lt = tk
@@ -1670,6 +2567,13 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 			*errors = append(*errors, &configErr{tk, msg})
 			continue
 		}
+		if len(stream.deny) > 0 {
+			if err := stream.acc.SetExportDeny(stream.sub, stream.deny); err != nil {
+				msg := fmt.Sprintf("Error adding stream export %q: %v", stream.sub, err)
+				*errors = append(*errors, &configErr{tk, msg})
+				continue
+			}
+		}
 	}
 	for _, service := range exportServices {
 		// Make array of accounts if applicable.
@@ -1688,6 +2592,13 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 			*errors = append(*errors, &configErr{tk, msg})
 			continue
 		}
+		if len(service.deny) > 0 {
+			if err := service.acc.SetExportDeny(service.sub, service.deny); err != nil {
+				msg := fmt.Sprintf("Error adding service export %q: %v", service.sub, err)
+				*errors = append(*errors, &configErr{tk, msg})
+				continue
+			}
+		}
 
 		if service.lat != nil {
 			if opts.SystemAccount == "" {
@@ -1736,38 +2647,1382 @@ func parseAccounts(v interface{}, opts *Options, errors *[]error, warnings *[]er
 	return nil
 }
 
-// Parse the account exports
-func parseAccountExports(v interface{}, acc *Account, errors, warnings *[]error) ([]*export, []*export, error) {
+// parseOIDC will parse the OIDC bearer token validation block.
+func parseOIDC(v interface{}, errors, warnings *[]error) (*OIDCOpts, error) {
 	var lt token
 	defer convertPanicToErrorList(&lt, errors)
 
-	// This should be an array of objects/maps.
 	tk, v := unwrapValue(v, &lt)
-	ims, ok := v.([]interface{})
+	mv, ok := v.(map[string]interface{})
 	if !ok {
-		return nil, nil, &configErr{tk, fmt.Sprintf("Exports should be an array, got %T", v)}
+		return nil, &configErr{tk, fmt.Sprintf("Expected oidc to be a map, got %T", v)}
+	}
+	oo := &OIDCOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "issuer":
+			oo.Issuer = mv.(string)
+		case "jwks_url", "jwks_uri":
+			oo.JWKSURL = mv.(string)
+		case "audience", "aud":
+			oo.Audience = mv.(string)
+		case "user_claim":
+			oo.UserClaim = mv.(string)
+		case "account_claim":
+			oo.AccountClaim = mv.(string)
+		case "permissions_claim":
+			oo.PermissionsClaim = mv.(string)
+		case "jwks_cache_ttl", "cache_ttl":
+			oo.JWKSCacheTTL = parseDuration(k, tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if oo.Issuer == "" {
+		return nil, &configErr{tk, "oidc requires an issuer"}
 	}
+	return oo, nil
+}
 
-	var services []*export
-	var streams []*export
+// parsePolicy will parse the policy engine block.
+func parsePolicy(v interface{}, errors, warnings *[]error) (*PolicyOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
 
-	for _, v := range ims {
-		// Should have stream or service
-		stream, service, err := parseExportStreamOrService(v, errors, warnings)
-		if err != nil {
-			*errors = append(*errors, err)
-			continue
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected policy to be a map, got %T", v)}
+	}
+	po := &PolicyOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "url":
+			po.URL = mv.(string)
+		case "timeout":
+			po.Timeout = parseDuration(k, tk, mv, errors, warnings)
+		case "cache_ttl":
+			po.CacheTTL = parseDuration(k, tk, mv, errors, warnings)
+		case "cache_size":
+			po.CacheSize = int(mv.(int64))
+		case "fail_open":
+			po.FailOpen = mv.(bool)
+		case "actions":
+			switch vv := mv.(type) {
+			case string:
+				po.Actions = []string{strings.ToLower(vv)}
+			case []interface{}:
+				for _, a := range vv {
+					_, a = unwrapValue(a, &lt)
+					po.Actions = append(po.Actions, strings.ToLower(a.(string)))
+				}
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected actions to be a string or an array, got %T", mv)})
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
 		}
-		if service != nil {
-			service.acc = acc
-			services = append(services, service)
+	}
+	if err := po.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return po, nil
+}
+
+// parseWritePacing will parse the write pacing block.
+func parseWritePacing(v interface{}, errors, warnings *[]error) (*WritePacingOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected write_pacing to be a map, got %T", v)}
+	}
+	wp := &WritePacingOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "rate":
+			wp.Rate = mv.(int64)
+		case "interval":
+			wp.Interval = parseDuration(k, tk, mv, errors, warnings)
+		case "interactive":
+			switch vv := mv.(type) {
+			case string:
+				wp.Interactive = []string{vv}
+			case []interface{}:
+				for _, s := range vv {
+					_, s = unwrapValue(s, &lt)
+					wp.Interactive = append(wp.Interactive, s.(string))
+				}
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected interactive to be a string or an array, got %T", mv)})
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
 		}
-		if stream != nil {
-			stream.acc = acc
-			streams = append(streams, stream)
+	}
+	if err := wp.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return wp, nil
+}
+
+// parseJoinTokens will parse the join tokens block.
+func parseJoinTokens(v interface{}, errors, warnings *[]error) (*JoinTokenOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected join_tokens to be a map, got %T", v)}
+	}
+	jt := &JoinTokenOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "secret":
+			secret, err := secretValue(mv)
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			jt.Secret = secret
+		case "max_ttl":
+			jt.MaxTTL = parseDuration(k, tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := jt.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return jt, nil
+}
+
+// parseAccountAudit will parse the account audit setting, which is either
+// a boolean to enable logging, or a map.
+func parseAccountAudit(v interface{}, errors, warnings *[]error) (*AccountAuditOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	switch vv := v.(type) {
+	case bool:
+		if !vv {
+			return nil, nil
+		}
+		return &AccountAuditOpts{Log: true}, nil
+	case map[string]interface{}:
+		aa := &AccountAuditOpts{}
+		for k, v := range vv {
+			tk, mv := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "log":
+				aa.Log = mv.(bool)
+			case "advisory", "advisories":
+				aa.Advisory = mv.(bool)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		if !aa.Log && !aa.Advisory {
+			return nil, nil
+		}
+		return aa, nil
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected account_audit to be a boolean or a map, got %T", v)}
+	}
+}
+
+// parseSubscriptionEvents will parse the subscription events setting, which
+// is either a boolean or a map.
+func parseSubscriptionEvents(v interface{}, errors, warnings *[]error) (*SubscriptionEventOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	switch vv := v.(type) {
+	case bool:
+		if !vv {
+			return nil, nil
+		}
+		return &SubscriptionEventOpts{}, nil
+	case map[string]interface{}:
+		se := &SubscriptionEventOpts{}
+		for k, v := range vv {
+			tk, mv := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "accounts":
+				switch av := mv.(type) {
+				case string:
+					se.Accounts = append(se.Accounts, av)
+				case []interface{}:
+					for _, a := range av {
+						_, a = unwrapValue(a, &lt)
+						se.Accounts = append(se.Accounts, a.(string))
+					}
+				default:
+					*errors = append(*errors, &configErr{tk, "subscription_events accounts should be an array of account names"})
+				}
+			case "max_rate", "rate":
+				se.MaxRate = mv.(int64)
+			case "sample":
+				se.Sample = int(mv.(int64))
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		return se, nil
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected subscription_events to be a boolean or a map, got %T", v)}
+	}
+}
+
+// parseTraceRedaction will parse how payloads and credentials are redacted
+// in the trace logs.
+func parseTraceRedaction(v interface{}, errors, warnings *[]error) (*TraceRedactionOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected trace_redaction to be a map, got %T", v)}
+	}
+	tr := &TraceRedactionOpts{}
+	for k, v := range m {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "payload":
+			switch p := strings.ToLower(mv.(string)); p {
+			case TraceRedactHash, TraceRedactTruncate:
+				tr.Payload = p
+			default:
+				err := &configErr{tk, fmt.Sprintf("Expected payload to be %q or %q, got %q",
+					TraceRedactHash, TraceRedactTruncate, mv)}
+				*errors = append(*errors, err)
+			}
+		case "payload_len":
+			tr.PayloadLen = int(mv.(int64))
+			if tr.PayloadLen < 0 {
+				err := &configErr{tk, "payload_len can not be negative"}
+				*errors = append(*errors, err)
+			}
+		case "connect":
+			tr.Connect = mv.(bool)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if tr.Payload == _EMPTY_ && !tr.Connect {
+		return nil, nil
+	}
+	return tr, nil
+}
+
+// parseSocketOpts will parse the tuning of the TCP connections of a
+// listener.
+func parseSocketOpts(v interface{}, errors, warnings *[]error) (*SocketOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected socket to be a map, got %T", v)}
+	}
+	so := &SocketOpts{}
+	for k, v := range m {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "no_delay", "nodelay":
+			so.DisableNoDelay = !mv.(bool)
+		case "keep_alive", "keepalive":
+			if b, ok := mv.(bool); ok {
+				if !b {
+					so.KeepAlive = -1
+				}
+			} else {
+				so.KeepAlive = parseDuration(k, tk, mv, errors, warnings)
+			}
+		case "recv_buffer", "rcvbuf":
+			so.RecvBuffer = int(mv.(int64))
+		case "send_buffer", "sndbuf":
+			so.SendBuffer = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := so.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return so, nil
+}
+
+// parseRetryPolicy will parse the backoff between the attempts to connect
+// to routes, gateways or leafnode remotes.
+func parseRetryPolicy(v interface{}, errors, warnings *[]error) (*RetryPolicy, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected retry to be a map, got %T", v)}
+	}
+	rp := &RetryPolicy{}
+	for k, v := range m {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "initial", "initial_delay":
+			rp.Initial = parseDuration(k, tk, mv, errors, warnings)
+		case "max", "max_delay":
+			rp.Max = parseDuration(k, tk, mv, errors, warnings)
+		case "jitter":
+			switch j := mv.(type) {
+			case float64:
+				rp.Jitter = j
+			case int64:
+				rp.Jitter = float64(j)
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected jitter to be a number, got %T", mv)})
+			}
+		case "max_attempts":
+			rp.MaxAttempts = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := rp.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return rp, nil
+}
+
+// parseGatewayEgress will parse the per account egress caps of gateways,
+// either as a single default cap or as a map with default and accounts.
+func parseGatewayEgress(v interface{}, errors, warnings *[]error) (*GatewayEgressOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	eo := &GatewayEgressOpts{}
+	switch vv := v.(type) {
+	case int64:
+		eo.Default = vv
+	case map[string]interface{}:
+		for k, v := range vv {
+			tk, mv := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "default":
+				eo.Default = mv.(int64)
+			case "accounts":
+				am, ok := mv.(map[string]interface{})
+				if !ok {
+					return nil, &configErr{tk, fmt.Sprintf("Expected accounts to be a map, got %T", mv)}
+				}
+				eo.Accounts = make(map[string]int64, len(am))
+				for acc, v := range am {
+					_, v = unwrapValue(v, &lt)
+					eo.Accounts[acc] = v.(int64)
+				}
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected account_egress to be a size or a map, got %T", v)}
+	}
+	if err := eo.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return eo, nil
+}
+
+// parseClientInfo will parse the details of the server hidden or replaced
+// in the INFO sent to clients.
+func parseClientInfo(v interface{}, errors, warnings *[]error) (ClientInfoOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	var ci ClientInfoOpts
+	tk, v := unwrapValue(v, &lt)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return ci, &configErr{tk, fmt.Sprintf("Expected client_info to be a map, got %T", v)}
+	}
+	for k, v := range m {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "hide_version":
+			ci.HideVersion = mv.(bool)
+		case "version":
+			ci.Version = mv.(string)
+		case "hide_go":
+			ci.HideGo = mv.(bool)
+		case "go":
+			ci.Go = mv.(string)
+		case "hide_host":
+			ci.HideHost = mv.(bool)
+		case "host":
+			ci.Host = mv.(string)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return ci, nil
+}
+
+// parseOutboundDial will parse how routes, gateways and leafnodes resolve
+// and dial remote servers.
+func parseOutboundDial(v interface{}, errors, warnings *[]error) (OutboundDialOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	var od OutboundDialOpts
+	tk, v := unwrapValue(v, &lt)
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return od, &configErr{tk, fmt.Sprintf("Expected outbound_dial to be a map, got %T", v)}
+	}
+	for k, v := range m {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "resolve_timeout":
+			od.ResolveTimeout = parseDuration("resolve_timeout", tk, mv, errors, warnings)
+		case "prefer":
+			od.Prefer = strings.ToLower(mv.(string))
+		case "happy_eyeballs":
+			od.HappyEyeballs = mv.(bool)
+		case "fallback_delay":
+			od.FallbackDelay = parseDuration("fallback_delay", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := od.validate(); err != nil {
+		return od, &configErr{tk, err.Error()}
+	}
+	return od, nil
+}
+
+// parseAccountUsage will parse the account usage setting, which is either
+// a boolean to enable it with the defaults, or a map.
+func parseResolverCache(v interface{}, errors, warnings *[]error) (*ResolverCacheOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	switch vv := v.(type) {
+	case string:
+		return &ResolverCacheOpts{Dir: vv}, nil
+	case map[string]interface{}:
+		rc := &ResolverCacheOpts{}
+		for k, v := range vv {
+			tk, mv := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "dir":
+				rc.Dir = mv.(string)
+			case "ttl":
+				rc.TTL = parseDuration("ttl", tk, mv, errors, warnings)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		return rc, nil
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected resolver_cache to be a dir or a map, got %T", v)}
+	}
+}
+
+func parseAccountUsage(v interface{}, errors, warnings *[]error) (*AccountUsageOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	switch vv := v.(type) {
+	case bool:
+		if !vv {
+			return nil, nil
+		}
+		return &AccountUsageOpts{}, nil
+	case map[string]interface{}:
+		au := &AccountUsageOpts{}
+		for k, v := range vv {
+			tk, mv := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "interval":
+				au.Interval = parseDuration("interval", tk, mv, errors, warnings)
+			case "subject":
+				au.Subject = mv.(string)
+				if !IsValidPublishSubject(strings.Replace(au.Subject, "%s", "acc", -1)) {
+					return nil, &configErr{tk, fmt.Sprintf("invalid account usage subject %q", au.Subject)}
+				}
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		return au, nil
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected account_usage to be a boolean or a map, got %T", v)}
+	}
+}
+
+// parseTrafficStats will parse the traffic stats setting, which is either
+// a boolean to enable it with the defaults, or a map.
+func parseTrafficStats(v interface{}, errors, warnings *[]error) (*TrafficStatsOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	switch vv := v.(type) {
+	case bool:
+		if !vv {
+			return nil, nil
+		}
+		return &TrafficStatsOpts{}, nil
+	case map[string]interface{}:
+		ts := &TrafficStatsOpts{}
+		for k, v := range vv {
+			tk, mv := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "window":
+				ts.Window = parseDuration("window", tk, mv, errors, warnings)
+			case "top":
+				ts.Top = int(mv.(int64))
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		return ts, nil
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected traffic_stats to be a boolean or a map, got %T", v)}
+	}
+}
+
+// parseWatermarks will parse the watermarks block.
+func parseWatermarks(v interface{}, errors, warnings *[]error) (*WatermarkOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected watermarks to be a map, got %T", v)}
+	}
+	wo := &WatermarkOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "interval":
+			wo.Interval = parseDuration("interval", tk, mv, errors, warnings)
+		case "connections", "max_connections":
+			wo.Connections = parseWatermark(k, tk, mv, errors)
+		case "subscriptions", "max_subscriptions":
+			wo.Subscriptions = parseWatermark(k, tk, mv, errors)
+		case "memory", "max_memory":
+			wo.Memory = parseWatermark(k, tk, mv, errors)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := wo.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return wo, nil
+}
+
+// parseAdmission will parse the admission control block.
+func parseAdmission(v interface{}, errors, warnings *[]error) (*AdmissionOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected admission to be a map, got %T", v)}
+	}
+	ao := &AdmissionOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "max_cpu":
+			switch cpu := mv.(type) {
+			case int64:
+				ao.MaxCPU = float64(cpu)
+			case float64:
+				ao.MaxCPU = cpu
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected max_cpu to be a number, got %T", mv)})
+			}
+		case "max_rss", "max_memory":
+			ao.MaxRSS = mv.(int64)
+		case "retry_after":
+			ao.RetryAfter = parseDuration("retry_after", tk, mv, errors, warnings)
+		case "defer":
+			ao.Defer = parseDuration("defer", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := ao.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return ao, nil
+}
+
+// parseAuthBan will parse the auth_ban block.
+func parseAuthBan(v interface{}, errors, warnings *[]error) (*AuthBanOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected auth_ban to be a map, got %T", v)}
+	}
+	bo := &AuthBanOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "max_failures":
+			bo.MaxFailures = int(mv.(int64))
+		case "period":
+			bo.Period = parseDuration("period", tk, mv, errors, warnings)
+		case "ban":
+			bo.Ban = parseDuration("ban", tk, mv, errors, warnings)
+		case "max_ban":
+			bo.MaxBan = parseDuration("max_ban", tk, mv, errors, warnings)
+		case "allow":
+			list, err := parseSourceList(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			bo.Allow = list
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := bo.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return bo, nil
+}
+
+// parseStomp will parse the stomp block.
+func parseStomp(v interface{}, errors, warnings *[]error) (*StompOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected stomp to be a map, got %T", v)}
+	}
+	so := &StompOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			so.Host, so.Port = hp.host, hp.port
+		case "port":
+			so.Port = int(mv.(int64))
+		case "host", "net":
+			so.Host = mv.(string)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	return so, nil
+}
+
+// parseGRPC will parse the grpc block.
+func parseGRPC(v interface{}, errors, warnings *[]error) (*GRPCOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected grpc to be a map, got %T", v)}
+	}
+	gro := &GRPCOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "listen":
+			hp, err := parseListen(mv)
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			gro.Host, gro.Port = hp.host, hp.port
+		case "port":
+			gro.Port = int(mv.(int64))
+		case "host", "net":
+			gro.Host = mv.(string)
+		case "tls":
+			tc, err := parseTLS(tk)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			if gro.TLSConfig, err = GenTLSConfig(tc); err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := gro.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return gro, nil
+}
+
+// parseAcceptErrors will parse the accept_errors block.
+func parseAcceptErrors(v interface{}, errors, warnings *[]error) (*AcceptErrorOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected accept_errors to be a map, got %T", v)}
+	}
+	ao := &AcceptErrorOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "min_sleep":
+			ao.MinSleep = parseDuration("min_sleep", tk, mv, errors, warnings)
+		case "max_sleep":
+			ao.MaxSleep = parseDuration("max_sleep", tk, mv, errors, warnings)
+		case "close_idle":
+			ao.CloseIdle = int(mv.(int64))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := ao.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return ao, nil
+}
+
+// parseSuspend will parse the suspend block, or a boolean to enable the
+// suspension of stale clients with the default settings.
+func parseSuspend(v interface{}, errors, warnings *[]error) (*SuspendOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	switch vv := v.(type) {
+	case bool:
+		if vv {
+			return &SuspendOpts{}, nil
+		}
+		return nil, nil
+	case map[string]interface{}:
+		so := &SuspendOpts{}
+		for k, v := range vv {
+			tk, mv := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "max", "max_duration":
+				so.MaxDuration = parseDuration("max_duration", tk, mv, errors, warnings)
+			case "buffer":
+				so.Buffer = mv.(bool)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		if err := so.validate(); err != nil {
+			return nil, &configErr{tk, err.Error()}
+		}
+		return so, nil
+	}
+	return nil, &configErr{tk, fmt.Sprintf("Expected suspend to be a boolean or a map, got %T", v)}
+}
+
+// parseWatermark parses a watermark given as its high value, or as a map
+// with the high and low values.
+func parseWatermark(field string, tk token, v interface{}, errors *[]error) Watermark {
+	var lt token
+	switch vv := v.(type) {
+	case int64:
+		return Watermark{High: vv}
+	case map[string]interface{}:
+		var w Watermark
+		for k, v := range vv {
+			tk, mv := unwrapValue(v, &lt)
+			n, ok := mv.(int64)
+			if !ok {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected %s %s to be a number, got %T", field, k, mv)})
+				continue
+			}
+			switch strings.ToLower(k) {
+			case "high":
+				w.High = n
+			case "low":
+				w.Low = n
+			default:
+				*errors = append(*errors, &unknownConfigFieldErr{field: k, configErr: configErr{token: tk}})
+			}
+		}
+		return w
+	default:
+		*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected %s to be a number or a map, got %T", field, v)})
+		return Watermark{}
+	}
+}
+
+// parsePasswordHashing will parse the password hashing block.
+func parsePasswordHashing(v interface{}, errors, warnings *[]error) (*PasswordHashingOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected password_hashing to be a map, got %T", v)}
+	}
+	ph := &PasswordHashingOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "algorithm", "algo":
+			ph.Algorithm = strings.ToLower(mv.(string))
+		case "bcrypt_cost", "cost":
+			ph.BcryptCost = int(mv.(int64))
+		case "argon2_time", "time":
+			ph.Argon2Time = uint32(mv.(int64))
+		case "argon2_memory", "memory":
+			ph.Argon2Memory = uint32(mv.(int64))
+		case "argon2_threads", "threads":
+			ph.Argon2Threads = uint8(mv.(int64))
+		case "rehash":
+			ph.Rehash = mv.(bool)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := ph.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return ph, nil
+}
+
+// parseSubjectRateLimits will parse the list of subject rate limits.
+func parseSubjectRateLimits(v interface{}, errors, warnings *[]error) ([]*SubjectRateLimit, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected subject_rate_limits to be an array, got %T", v)}
+	}
+	var limits []*SubjectRateLimit
+	for _, v := range arr {
+		tk, v := unwrapValue(v, &lt)
+		mv, ok := v.(map[string]interface{})
+		if !ok {
+			*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected subject rate limit to be a map, got %T", v)})
+			continue
+		}
+		l := &SubjectRateLimit{Action: SubjectRateAdvisory}
+		for k, v := range mv {
+			tk, mv := unwrapValue(v, &lt)
+			switch strings.ToLower(k) {
+			case "subject":
+				l.Subject = mv.(string)
+			case "max_rate", "rate":
+				l.MaxRate = mv.(int64)
+			case "action":
+				l.Action = strings.ToLower(mv.(string))
+			case "sample":
+				l.Sample = int(mv.(int64))
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+		if err := l.validate(); err != nil {
+			*errors = append(*errors, &configErr{tk, err.Error()})
+			continue
+		}
+		limits = append(limits, l)
+	}
+	return limits, nil
+}
+
+// parseUniqueConnections will parse the unique_connections block.
+func parseUniqueConnections(v interface{}, errors, warnings *[]error) (*UniqueConnOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected unique_connections to be a map, got %T", v)}
+	}
+	uo := &UniqueConnOpts{By: UniqueConnByUser, Policy: UniqueConnReject}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "by":
+			uo.By = strings.ToLower(mv.(string))
+		case "policy":
+			uo.Policy = strings.ToLower(mv.(string))
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := uo.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return uo, nil
+}
+
+// parseSchemaValidation will parse the schema_validation block.
+func parseSchemaValidation(v interface{}, errors, warnings *[]error) (*SchemaValidationOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected schema_validation to be a map, got %T", v)}
+	}
+	sv := &SchemaValidationOpts{}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "registry", "url":
+			sv.Registry = mv.(string)
+		case "refresh":
+			sv.Refresh = parseDuration("refresh", tk, mv, errors, warnings)
+		case "policy":
+			sv.Policy = strings.ToLower(mv.(string))
+		case "subjects":
+			arr, ok := mv.([]interface{})
+			if !ok {
+				return nil, &configErr{tk, fmt.Sprintf("Expected schema subjects to be an array, got %T", mv)}
+			}
+			for _, v := range arr {
+				tk, v := unwrapValue(v, &lt)
+				m, ok := v.(map[string]interface{})
+				if !ok {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected schema subject to be a map, got %T", v)})
+					continue
+				}
+				ss := &SubjectSchema{}
+				for k, v := range m {
+					tk, mv := unwrapValue(v, &lt)
+					switch strings.ToLower(k) {
+					case "subject":
+						ss.Subject = mv.(string)
+					case "schema":
+						ss.Schema = mv.(string)
+					default:
+						if !tk.IsUsedVariable() {
+							err := &unknownConfigFieldErr{
+								field: k,
+								configErr: configErr{
+									token: tk,
+								},
+							}
+							*errors = append(*errors, err)
+						}
+					}
+				}
+				sv.Subjects = append(sv.Subjects, ss)
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if err := sv.validate(); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return sv, nil
+}
+
+// parseAuthBackend will parse the external authentication backend of an account.
+func parseAuthBackend(v interface{}, errors, warnings *[]error) (AuthBackend, error) {
+	var (
+		cmd     string
+		args    []string
+		timeout time.Duration
+		lt      token
+	)
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected auth_backend to be a map, got %T", v)}
+	}
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "exec", "command":
+			cmd = mv.(string)
+		case "args", "arguments":
+			av, ok := mv.([]interface{})
+			if !ok {
+				*errors = append(*errors, &configErr{tk, "auth_backend args should be an array of strings"})
+				continue
+			}
+			for _, a := range av {
+				_, a = unwrapValue(a, &lt)
+				args = append(args, a.(string))
+			}
+		case "timeout":
+			timeout = parseDuration("timeout", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
+		}
+	}
+	if cmd == "" {
+		return nil, &configErr{tk, "auth_backend requires an exec command"}
+	}
+	return NewExecAuthBackend(cmd, args, timeout), nil
+}
+
+// Parse the account exports
+func parseAccountExports(v interface{}, acc *Account, errors, warnings *[]error) ([]*export, []*export, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	// This should be an array of objects/maps.
+	tk, v := unwrapValue(v, &lt)
+	ims, ok := v.([]interface{})
+	if !ok {
+		return nil, nil, &configErr{tk, fmt.Sprintf("Exports should be an array, got %T", v)}
+	}
+
+	var services []*export
+	var streams []*export
+
+	for _, v := range ims {
+		// Should have stream or service
+		stream, service, err := parseExportStreamOrService(v, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			continue
+		}
+		if service != nil {
+			service.acc = acc
+			services = append(services, service)
+		}
+		if stream != nil {
+			stream.acc = acc
+			streams = append(streams, stream)
+		}
+	}
+	return streams, services, nil
+}
+
+// parseAccountTemplate will parse the template of accounts unknown to the
+// account resolver.
+func parseAccountTemplate(v interface{}, errors, warnings *[]error) (*AccountTemplate, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected account_template to be a map, got %T", v)}
+	}
+	at := NewAccountTemplate()
+	for k, v := range mv {
+		tk, mv := unwrapValue(v, &lt)
+		switch strings.ToLower(k) {
+		case "max_connections", "max_conn":
+			at.Limits.Conn = mv.(int64)
+		case "max_subscriptions", "max_subs":
+			at.Limits.Subs = mv.(int64)
+		case "max_leafnodes":
+			at.Limits.LeafNodeConn = mv.(int64)
+		case "max_payload":
+			at.Limits.Payload = mv.(int64)
+		case "max_data":
+			at.Limits.Data = mv.(int64)
+		case "max_imports":
+			at.Limits.Imports = mv.(int64)
+		case "max_exports":
+			at.Limits.Exports = mv.(int64)
+		case "exports":
+			streams, services, err := parseAccountExports(tk, nil, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			add := func(e *export, typ jwt.ExportType) {
+				if len(e.accs) > 0 {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("Export %q of account_template can't be restricted to accounts", e.sub)})
+					return
+				}
+				if len(e.deny) > 0 {
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("Export %q of account_template can't have deny subjects", e.sub)})
+					return
+				}
+				je := &jwt.Export{Subject: jwt.Subject(e.sub), Type: typ}
+				if typ == jwt.Service {
+					je.ResponseType = jwt.ResponseType(e.rt.String())
+				}
+				if e.lat != nil {
+					je.Latency = &jwt.ServiceLatency{Sampling: int(e.lat.sampling), Results: jwt.Subject(e.lat.subject)}
+				}
+				at.Exports = append(at.Exports, je)
+			}
+			for _, e := range streams {
+				add(e, jwt.Stream)
+			}
+			for _, e := range services {
+				add(e, jwt.Service)
+			}
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: k,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+			}
 		}
 	}
-	return streams, services, nil
+	return at, nil
 }
 
 // Parse the account imports
@@ -1844,15 +4099,17 @@ func parseAccount(v map[string]interface{}, errors, warnings *[]error) (string,
 
 // Parse an export stream or service.
 // e.g.
-//   {stream: "public.>"} # No accounts means public.
-//   {stream: "synadia.private.>", accounts: [cncf, natsio]}
-//   {service: "pub.request"} # No accounts means public.
-//   {service: "pub.special.request", accounts: [nats.io]}
+//
+//	{stream: "public.>"} # No accounts means public.
+//	{stream: "synadia.private.>", accounts: [cncf, natsio]}
+//	{service: "pub.request"} # No accounts means public.
+//	{service: "pub.special.request", accounts: [nats.io]}
 func parseExportStreamOrService(v interface{}, errors, warnings *[]error) (*export, *export, error) {
 	var (
 		curStream  *export
 		curService *export
 		accounts   []string
+		deny       []string
 		rt         ServiceRespType
 		rtSeen     bool
 		rtToken    token
@@ -1892,7 +4149,7 @@ func parseExportStreamOrService(v interface{}, errors, warnings *[]error) (*expo
 				*errors = append(*errors, err)
 				continue
 			}
-			curStream = &export{sub: mvs}
+			curStream = &export{sub: mvs, deny: deny}
 			if accounts != nil {
 				curStream.accs = accounts
 			}
@@ -1936,7 +4193,7 @@ func parseExportStreamOrService(v interface{}, errors, warnings *[]error) (*expo
 				*errors = append(*errors, err)
 				continue
 			}
-			curService = &export{sub: mvs}
+			curService = &export{sub: mvs, deny: deny}
 			if accounts != nil {
 				curService.accs = accounts
 			}
@@ -1956,6 +4213,25 @@ func parseExportStreamOrService(v interface{}, errors, warnings *[]error) (*expo
 			} else if curService != nil {
 				curService.accs = accounts
 			}
+		case "except", "deny":
+			switch dv := mv.(type) {
+			case string:
+				deny = append(deny, dv)
+			case []interface{}:
+				for _, iv := range dv {
+					_, mv := unwrapValue(iv, &lt)
+					deny = append(deny, mv.(string))
+				}
+			default:
+				err := &configErr{tk, fmt.Sprintf("Expected %s to be a subject or an array of subjects, got %T", mk, mv)}
+				*errors = append(*errors, err)
+				continue
+			}
+			if curStream != nil {
+				curStream.deny = deny
+			} else if curService != nil {
+				curService.deny = deny
+			}
 		case "latency":
 			latToken = tk
 			var err error
@@ -2059,9 +4335,10 @@ func parseServiceLatency(root token, v interface{}) (l *serviceLatency, retErr e
 
 // Parse an import stream or service.
 // e.g.
-//   {stream: {account: "synadia", subject:"public.synadia"}, prefix: "imports.synadia"}
-//   {stream: {account: "synadia", subject:"synadia.private.*"}}
-//   {service: {account: "synadia", subject: "pub.special.request"}, to: "synadia.request"}
+//
+//	{stream: {account: "synadia", subject:"public.synadia"}, prefix: "imports.synadia"}
+//	{stream: {account: "synadia", subject:"synadia.private.*"}}
+//	{service: {account: "synadia", subject: "pub.special.request"}, to: "synadia.request"}
 func parseImportStreamOrService(v interface{}, errors, warnings *[]error) (*importStream, *importService, error) {
 	var (
 		curStream  *importStream
@@ -2177,7 +4454,12 @@ func parseAuthorization(v interface{}, opts *Options, errors *[]error, warnings
 		case "user", "username":
 			auth.user = mv.(string)
 		case "pass", "password":
-			auth.pass = mv.(string)
+			pass, err := secretValue(mv)
+			if err != nil {
+				*errors = append(*errors, &configErr{tk, err.Error()})
+				continue
+			}
+			auth.pass = pass
 		case "token":
 			auth.token = mv.(string)
 		case "timeout":
@@ -2212,74 +4494,513 @@ func parseAuthorization(v interface{}, opts *Options, errors *[]error, warnings
 						token: tk,
 					},
 				}
-				*errors = append(*errors, err)
+				*errors = append(*errors, err)
+			}
+			continue
+		}
+
+		// Now check for permission defaults with multiple users, etc.
+		if auth.users != nil && auth.defaultPermissions != nil {
+			for _, user := range auth.users {
+				if user.Permissions == nil {
+					user.Permissions = auth.defaultPermissions
+				}
+			}
+		}
+
+	}
+	return auth, nil
+}
+
+// Helper function to parse multiple users array with optional permissions.
+func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]error) ([]*NkeyUser, []*User, error) {
+	var (
+		tk    token
+		lt    token
+		keys  []*NkeyUser
+		users = []*User{}
+	)
+	defer convertPanicToErrorList(&lt, errors)
+	tk, mv = unwrapValue(mv, &lt)
+
+	// Make sure we have an array
+	uv, ok := mv.([]interface{})
+	if !ok {
+		return nil, nil, &configErr{tk, fmt.Sprintf("Expected users field to be an array, got %v", mv)}
+	}
+	for _, u := range uv {
+		tk, u = unwrapValue(u, &lt)
+
+		// Check its a map/struct
+		um, ok := u.(map[string]interface{})
+		if !ok {
+			err := &configErr{tk, fmt.Sprintf("Expected user entry to be a map/struct, got %v", u)}
+			*errors = append(*errors, err)
+			continue
+		}
+
+		var (
+			user  = &User{}
+			nkey  = &NkeyUser{}
+			perms *Permissions
+			times []jwt.TimeRange
+			allow []string
+			deny  []string
+			err   error
+		)
+		for k, v := range um {
+			// Also needs to unwrap first
+			tk, v = unwrapValue(v, &lt)
+
+			switch strings.ToLower(k) {
+			case "nkey":
+				nkey.Nkey = v.(string)
+			case "user", "username":
+				user.Username = v.(string)
+			case "pass", "password":
+				pass, err := secretValue(v)
+				if err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				user.Password = pass
+			case "permission", "permissions", "authorization":
+				perms, err = parseUserPermissions(tk, errors, warnings)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+			case "connection_times", "times":
+				times, err = parseTimeRanges(tk, errors, warnings)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+			case "allow_sources", "allowed_sources":
+				allow, err = parseSourceList(tk, errors, warnings)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+			case "deny_sources", "denied_sources":
+				deny, err = parseSourceList(tk, errors, warnings)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: k,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+					continue
+				}
+			}
+		}
+		// Place perms if we have them.
+		if perms != nil {
+			// nkey takes precedent.
+			if nkey.Nkey != "" {
+				nkey.Permissions = perms
+			} else {
+				user.Permissions = perms
+			}
+		}
+		nkey.ConnectionTimes, nkey.AllowedSources, nkey.DeniedSources = times, allow, deny
+		user.ConnectionTimes, user.AllowedSources, user.DeniedSources = times, allow, deny
+
+		// Check to make sure we have at least an nkey or username <password> defined.
+		if nkey.Nkey == "" && user.Username == "" {
+			return nil, nil, &configErr{tk, "User entry requires a user"}
+		} else if nkey.Nkey != "" {
+			// Make sure the nkey a proper public nkey for a user..
+			if !nkeys.IsValidPublicUserKey(nkey.Nkey) {
+				return nil, nil, &configErr{tk, "Not a valid public nkey for a user"}
+			}
+			// If we have user or password defined here that is an error.
+			if user.Username != "" || user.Password != "" {
+				return nil, nil, &configErr{tk, "Nkey users do not take usernames or passwords"}
+			}
+			keys = append(keys, nkey)
+		} else {
+			users = append(users, user)
+		}
+	}
+	return keys, users, nil
+}
+
+// parseSourceList will parse a single CIDR block or IP address, or an array of them.
+func parseSourceList(v interface{}, errors, warnings *[]error) ([]string, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	var list []string
+	switch vv := v.(type) {
+	case string:
+		list = []string{vv}
+	case []interface{}:
+		for _, i := range vv {
+			_, i = unwrapValue(i, &lt)
+			list = append(list, i.(string))
+		}
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected sources to be a string or an array, got %T", v)}
+	}
+	for _, src := range list {
+		if _, err := parseSourceCIDR(src); err != nil {
+			return nil, &configErr{tk, fmt.Sprintf("invalid source: %v", err)}
+		}
+	}
+	return list, nil
+}
+
+// parseReservedSubjects will parse the map of subjects reserved to some
+// users of an account, each subject mapping to a user or a list of users.
+func parseReservedSubjects(v interface{}, errors, warnings *[]error) ([]*ReservedSubject, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	mv, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected reserved_subjects to be a map, got %T", v)}
+	}
+	var reserved []*ReservedSubject
+	for subject, v := range mv {
+		tk, v := unwrapValue(v, &lt)
+		if !IsValidSubject(subject) {
+			return nil, &configErr{tk, fmt.Sprintf("invalid reserved subject %q", subject)}
+		}
+		r := &ReservedSubject{Subject: subject}
+		switch vv := v.(type) {
+		case string:
+			r.Users = []string{vv}
+		case []interface{}:
+			for _, i := range vv {
+				_, i = unwrapValue(i, &lt)
+				r.Users = append(r.Users, i.(string))
+			}
+		default:
+			return nil, &configErr{tk, fmt.Sprintf("Expected users of reserved subject %q to be a string or an array, got %T", subject, v)}
+		}
+		reserved = append(reserved, r)
+	}
+	// Keep a stable order so that reloads don't see a difference.
+	sort.Slice(reserved, func(i, j int) bool { return reserved[i].Subject < reserved[j].Subject })
+	return reserved, nil
+}
+
+// parseStoredSubjects will parse a string or an array of subjects.
+func parseStoredSubjects(v interface{}, lt *token, what string) ([]string, error) {
+	tk, v := unwrapValue(v, lt)
+	var subjects []string
+	switch vv := v.(type) {
+	case string:
+		subjects = append(subjects, vv)
+	case []interface{}:
+		for _, i := range vv {
+			_, i = unwrapValue(i, lt)
+			subjects = append(subjects, i.(string))
+		}
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected %s subjects to be a string or an array, got %T", what, v)}
+	}
+	for _, subject := range subjects {
+		if !IsValidSubject(subject) {
+			return nil, &configErr{tk, fmt.Sprintf("invalid %s subject %q", what, subject)}
+		}
+	}
+	return subjects, nil
+}
+
+// parseRetained will parse the subjects of an account's last value cache,
+// either as a list of subjects or as a map with subjects and max_msgs.
+func parseRetained(v interface{}, errors, warnings *[]error) (*retainedMsgs, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	var (
+		subjects []string
+		max      int
+		err      error
+	)
+	tk, v := unwrapValue(v, &lt)
+	if mv, ok := v.(map[string]interface{}); ok {
+		for mk, mv := range mv {
+			tk, mv := unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "subjects":
+				if subjects, err = parseStoredSubjects(tk, &lt, "retained"); err != nil {
+					return nil, err
+				}
+			case "max_msgs", "max":
+				max = int(mv.(int64))
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+	} else if subjects, err = parseStoredSubjects(tk, &lt, "retained"); err != nil {
+		return nil, err
+	}
+	if len(subjects) == 0 {
+		return nil, &configErr{tk, "Expected at least one retained subject"}
+	}
+	if max < 0 {
+		return nil, &configErr{tk, "Retained max_msgs can't be negative"}
+	}
+	return newRetainedMsgs(subjects, max), nil
+}
+
+// parseSubjectQuota will parse the subject quota of an account, either as
+// the maximum number of subjects or as a map with max_subjects and window.
+// parseEncryptionPolicy parses the encryption policy of an account, either
+// as a list of subjects or as a map with subjects and key_ids.
+func parseEncryptionPolicy(v interface{}, errors, warnings *[]error) (*encryptionPolicy, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	var (
+		subjects, keyIDs []string
+		err              error
+	)
+	tk, v := unwrapValue(v, &lt)
+	if mv, ok := v.(map[string]interface{}); ok {
+		for mk, mv := range mv {
+			tk, mv := unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "subjects":
+				if subjects, err = parseStoredSubjects(tk, &lt, "encryption"); err != nil {
+					return nil, err
+				}
+			case "key_ids":
+				switch vv := mv.(type) {
+				case string:
+					keyIDs = append(keyIDs, vv)
+				case []interface{}:
+					for _, i := range vv {
+						_, i = unwrapValue(i, &lt)
+						keyIDs = append(keyIDs, i.(string))
+					}
+				default:
+					return nil, &configErr{tk, fmt.Sprintf("Expected encryption key_ids to be a string or an array, got %T", mv)}
+				}
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+	} else if subjects, err = parseStoredSubjects(tk, &lt, "encryption"); err != nil {
+		return nil, err
+	}
+	ep, err := newEncryptionPolicy(subjects, keyIDs)
+	if err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return ep, nil
+}
+
+func parseSubjectQuota(v interface{}, errors, warnings *[]error) (*subjectQuota, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	var (
+		max    int
+		window time.Duration
+	)
+	tk, v := unwrapValue(v, &lt)
+	switch vv := v.(type) {
+	case int64:
+		max = int(vv)
+	case map[string]interface{}:
+		for mk, mv := range vv {
+			tk, mv := unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "max_subjects", "max":
+				max = int(mv.(int64))
+			case "window":
+				window = parseDuration("window", tk, mv, errors, warnings)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
 			}
-			continue
 		}
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected subject_quota to be a number or a map, got %T", v)}
+	}
+	if max <= 0 {
+		return nil, &configErr{tk, "Subject quota max_subjects must be positive"}
+	}
+	if window < 0 {
+		return nil, &configErr{tk, "Subject quota window can't be negative"}
+	}
+	return newSubjectQuota(max, window), nil
+}
 
-		// Now check for permission defaults with multiple users, etc.
-		if auth.users != nil && auth.defaultPermissions != nil {
-			for _, user := range auth.users {
-				if user.Permissions == nil {
-					user.Permissions = auth.defaultPermissions
+// parseReplay will parse the replay buffers of an account, either as a
+// list of subjects or as a map with subjects, max_msgs and max_age.
+func parseReplay(v interface{}, errors, warnings *[]error) (*replayBuffers, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	var (
+		subjects []string
+		max      int
+		maxAge   time.Duration
+		err      error
+	)
+	tk, v := unwrapValue(v, &lt)
+	if mv, ok := v.(map[string]interface{}); ok {
+		for mk, mv := range mv {
+			tk, mv := unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "subjects":
+				if subjects, err = parseStoredSubjects(tk, &lt, "replay"); err != nil {
+					return nil, err
+				}
+			case "max_msgs", "max":
+				max = int(mv.(int64))
+			case "max_age":
+				maxAge = parseDuration("max_age", tk, mv, errors, warnings)
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
 				}
 			}
 		}
-
+	} else if subjects, err = parseStoredSubjects(tk, &lt, "replay"); err != nil {
+		return nil, err
 	}
-	return auth, nil
+	if len(subjects) == 0 {
+		return nil, &configErr{tk, "Expected at least one replay subject"}
+	}
+	if max < 0 {
+		return nil, &configErr{tk, "Replay max_msgs can't be negative"}
+	}
+	if maxAge < 0 {
+		return nil, &configErr{tk, "Replay max_age can't be negative"}
+	}
+	return newReplayBuffers(subjects, max, maxAge), nil
 }
 
-// Helper function to parse multiple users array with optional permissions.
-func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]error) ([]*NkeyUser, []*User, error) {
+// parseArchive parses the archive tap of an account, either the archive
+// subject prefix or a map with the prefix, the subjects filters and the
+// sampling rate.
+func parseArchive(v interface{}, errors, warnings *[]error) (*archiveTap, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
 	var (
-		tk    token
-		lt    token
-		keys  []*NkeyUser
-		users = []*User{}
+		prefix   string
+		subjects []string
+		sample   float64
+		err      error
 	)
+	tk, v := unwrapValue(v, &lt)
+	switch vv := v.(type) {
+	case string:
+		prefix = vv
+	case map[string]interface{}:
+		for mk, mv := range vv {
+			tk, mv := unwrapValue(mv, &lt)
+			switch strings.ToLower(mk) {
+			case "subject", "prefix":
+				prefix = mv.(string)
+			case "subjects", "filter", "filters":
+				if subjects, err = parseStoredSubjects(tk, &lt, "archive"); err != nil {
+					return nil, err
+				}
+			case "sample":
+				switch n := mv.(type) {
+				case float64:
+					sample = n
+				case int64:
+					sample = float64(n)
+				default:
+					return nil, &configErr{tk, fmt.Sprintf("Expected archive sample to be a number, got %T", mv)}
+				}
+			default:
+				if !tk.IsUsedVariable() {
+					err := &unknownConfigFieldErr{
+						field: mk,
+						configErr: configErr{
+							token: tk,
+						},
+					}
+					*errors = append(*errors, err)
+				}
+			}
+		}
+	default:
+		return nil, &configErr{tk, fmt.Sprintf("Expected archive to be a subject or a map, got %T", v)}
+	}
+	if prefix == _EMPTY_ {
+		return nil, &configErr{tk, "Expected an archive subject"}
+	}
+	if err := validateArchiveTap(prefix, subjects, sample); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return newArchiveTap(prefix, subjects, sample), nil
+}
+
+// parseTimeRanges will parse an array of connection time windows,
+// each with a start and end in the "15:04:05" format.
+func parseTimeRanges(v interface{}, errors, warnings *[]error) ([]jwt.TimeRange, error) {
+	var lt token
 	defer convertPanicToErrorList(&lt, errors)
-	tk, mv = unwrapValue(mv, &lt)
 
-	// Make sure we have an array
-	uv, ok := mv.([]interface{})
+	tk, v := unwrapValue(v, &lt)
+	av, ok := v.([]interface{})
 	if !ok {
-		return nil, nil, &configErr{tk, fmt.Sprintf("Expected users field to be an array, got %v", mv)}
+		return nil, &configErr{tk, fmt.Sprintf("Expected connection times to be an array, got %T", v)}
 	}
-	for _, u := range uv {
-		tk, u = unwrapValue(u, &lt)
-
-		// Check its a map/struct
-		um, ok := u.(map[string]interface{})
+	times := make([]jwt.TimeRange, 0, len(av))
+	for _, mv := range av {
+		tk, mv := unwrapValue(mv, &lt)
+		tm, ok := mv.(map[string]interface{})
 		if !ok {
-			err := &configErr{tk, fmt.Sprintf("Expected user entry to be a map/struct, got %v", u)}
-			*errors = append(*errors, err)
-			continue
+			return nil, &configErr{tk, fmt.Sprintf("Expected time range to be a map, got %T", mv)}
 		}
-
-		var (
-			user  = &User{}
-			nkey  = &NkeyUser{}
-			perms *Permissions
-			err   error
-		)
-		for k, v := range um {
-			// Also needs to unwrap first
-			tk, v = unwrapValue(v, &lt)
-
+		var tr jwt.TimeRange
+		for k, v := range tm {
+			tk, v := unwrapValue(v, &lt)
 			switch strings.ToLower(k) {
-			case "nkey":
-				nkey.Nkey = v.(string)
-			case "user", "username":
-				user.Username = v.(string)
-			case "pass", "password":
-				user.Password = v.(string)
-			case "permission", "permissions", "authorization":
-				perms, err = parseUserPermissions(tk, errors, warnings)
-				if err != nil {
-					*errors = append(*errors, err)
-					continue
-				}
+			case "start":
+				tr.Start = v.(string)
+			case "end":
+				tr.End = v.(string)
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -2289,38 +5010,17 @@ func parseUsers(mv interface{}, opts *Options, errors *[]error, warnings *[]erro
 						},
 					}
 					*errors = append(*errors, err)
-					continue
 				}
 			}
 		}
-		// Place perms if we have them.
-		if perms != nil {
-			// nkey takes precedent.
-			if nkey.Nkey != "" {
-				nkey.Permissions = perms
-			} else {
-				user.Permissions = perms
-			}
-		}
-
-		// Check to make sure we have at least an nkey or username <password> defined.
-		if nkey.Nkey == "" && user.Username == "" {
-			return nil, nil, &configErr{tk, "User entry requires a user"}
-		} else if nkey.Nkey != "" {
-			// Make sure the nkey a proper public nkey for a user..
-			if !nkeys.IsValidPublicUserKey(nkey.Nkey) {
-				return nil, nil, &configErr{tk, "Not a valid public nkey for a user"}
-			}
-			// If we have user or password defined here that is an error.
-			if user.Username != "" || user.Password != "" {
-				return nil, nil, &configErr{tk, "Nkey users do not take usernames or passwords"}
-			}
-			keys = append(keys, nkey)
-		} else {
-			users = append(users, user)
+		vr := jwt.CreateValidationResults()
+		tr.Validate(vr)
+		if !vr.IsEmpty() {
+			return nil, &configErr{tk, fmt.Sprintf("invalid time range: %v", vr.Issues[0].Description)}
 		}
+		times = append(times, tr)
 	}
-	return keys, users, nil
+	return times, nil
 }
 
 // Helper function to parse user/account permissions
@@ -2381,6 +5081,14 @@ func parseUserPermissions(mv interface{}, errors, warnings *[]error) (*Permissio
 					p.Publish.Allow = []string{}
 				}
 			}
+		case "min_wildcard_depth":
+			depth, ok := mv.(int64)
+			if !ok || depth < 0 {
+				err := &configErr{tk, fmt.Sprintf("Expected min_wildcard_depth to be a positive integer, got %v", mv)}
+				*errors = append(*errors, err)
+				continue
+			}
+			p.MinWildcardDepth = int(depth)
 		default:
 			if !tk.IsUsedVariable() {
 				err := &configErr{tk, fmt.Sprintf("Unknown field %q parsing permissions", k)}
@@ -2579,6 +5287,84 @@ func parseCurvePreferences(curveName string) (tls.CurveID, error) {
 	return curve, nil
 }
 
+// secretValue returns the string value of a setting that is either given
+// directly or as a `{ secret: "<scheme>://<ref>" }` map, in which case the
+// value is fetched from the secret source, without trailing newlines.
+func secretValue(v interface{}) (string, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return v.(string), nil
+	}
+	ref, err := secretRef(m)
+	if err != nil {
+		return "", err
+	}
+	secret, err := resolveSecret(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
+
+// secretRef returns the reference of a `{ secret: "<scheme>://<ref>" }` map.
+func secretRef(m map[string]interface{}) (string, error) {
+	var lt token
+	v, ok := m["secret"]
+	if !ok || len(m) != 1 {
+		return "", fmt.Errorf("expected a value or a map with a single 'secret' reference")
+	}
+	_, v = unwrapValue(v, &lt)
+	ref, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("expected secret reference to be a string, got %T", v)
+	}
+	return ref, nil
+}
+
+// collectSecretRefs appends to refs the secret references found in
+// the parsed configuration.
+func collectSecretRefs(v interface{}, refs []string) []string {
+	var lt token
+	_, v = unwrapValue(v, &lt)
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if ref, err := secretRef(v); err == nil {
+			return append(refs, ref)
+		}
+		for _, mv := range v {
+			refs = collectSecretRefs(mv, refs)
+		}
+	case []interface{}:
+		for _, av := range v {
+			refs = collectSecretRefs(av, refs)
+		}
+	}
+	return refs
+}
+
+// loadX509KeyPair loads the certificate and private key from their
+// files or secret sources.
+func loadX509KeyPair(tc *TLSConfigOpts) (tls.Certificate, error) {
+	if tc.CertSecret == "" && tc.KeySecret == "" {
+		return tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	}
+	load := func(file, ref string) ([]byte, error) {
+		if ref != "" {
+			return resolveSecret(ref)
+		}
+		return ioutil.ReadFile(file)
+	}
+	certPEM, err := load(tc.CertFile, tc.CertSecret)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := load(tc.KeyFile, tc.KeySecret)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
+
 // Helper function to parse TLS configs.
 func parseTLS(v interface{}) (t *TLSConfigOpts, retErr error) {
 	var (
@@ -2594,12 +5380,28 @@ func parseTLS(v interface{}) (t *TLSConfigOpts, retErr error) {
 		tk, mv := unwrapValue(mv, &lt)
 		switch strings.ToLower(mk) {
 		case "cert_file":
+			if sm, ok := mv.(map[string]interface{}); ok {
+				ref, err := secretRef(sm)
+				if err != nil {
+					return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, 'cert_file': %v", err)}
+				}
+				tc.CertSecret = ref
+				continue
+			}
 			certFile, ok := mv.(string)
 			if !ok {
 				return nil, &configErr{tk, "error parsing tls config, expected 'cert_file' to be filename"}
 			}
 			tc.CertFile = certFile
 		case "key_file":
+			if sm, ok := mv.(map[string]interface{}); ok {
+				ref, err := secretRef(sm)
+				if err != nil {
+					return nil, &configErr{tk, fmt.Sprintf("error parsing tls config, 'key_file': %v", err)}
+				}
+				tc.KeySecret = ref
+				continue
+			}
 			keyFile, ok := mv.(string)
 			if !ok {
 				return nil, &configErr{tk, "error parsing tls config, expected 'key_file' to be filename"}
@@ -2698,14 +5500,16 @@ func GenTLSConfig(tc *TLSConfigOpts) (*tls.Config, error) {
 		InsecureSkipVerify:       tc.Insecure,
 	}
 
+	hasCert := tc.CertFile != "" || tc.CertSecret != ""
+	hasKey := tc.KeyFile != "" || tc.KeySecret != ""
 	switch {
-	case tc.CertFile != "" && tc.KeyFile == "":
+	case hasCert && !hasKey:
 		return nil, fmt.Errorf("missing 'key_file' in TLS configuration")
-	case tc.CertFile == "" && tc.KeyFile != "":
+	case !hasCert && hasKey:
 		return nil, fmt.Errorf("missing 'cert_file' in TLS configuration")
-	case tc.CertFile != "" && tc.KeyFile != "":
+	case hasCert && hasKey:
 		// Now load in cert and private key
-		cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+		cert, err := loadX509KeyPair(tc)
 		if err != nil {
 			return nil, fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
 		}
@@ -2788,6 +5592,12 @@ func MergeOptions(fileOpts, flagOpts *Options) *Options {
 	if flagOpts.PortsFileDir != "" {
 		opts.PortsFileDir = flagOpts.PortsFileDir
 	}
+	if flagOpts.StartupReport != "" {
+		opts.StartupReport = flagOpts.StartupReport
+	}
+	if flagOpts.Quiet {
+		opts.Quiet = true
+	}
 	if flagOpts.ProfPort != 0 {
 		opts.ProfPort = flagOpts.ProfPort
 	}
@@ -2989,7 +5799,11 @@ func setBaselineOptions(opts *Options) {
 		opts.MaxPayload = MAX_PAYLOAD_SIZE
 	}
 	if opts.MaxPending == 0 {
-		opts.MaxPending = MAX_PENDING_SIZE
+		if opts.ContainerLimits {
+			opts.MaxPending = detectedContainerLimits().maxPending()
+		} else {
+			opts.MaxPending = MAX_PENDING_SIZE
+		}
 	}
 	if opts.WriteDeadline == time.Duration(0) {
 		opts.WriteDeadline = DEFAULT_FLUSH_DEADLINE
@@ -3000,6 +5814,9 @@ func setBaselineOptions(opts *Options) {
 	if opts.LameDuckDuration == 0 {
 		opts.LameDuckDuration = DEFAULT_LAME_DUCK_DURATION
 	}
+	if opts.InterestSnapshot != "" && opts.InterestSnapshotTTL == 0 {
+		opts.InterestSnapshotTTL = DEFAULT_INTEREST_SNAPSHOT_TTL
+	}
 	if opts.Gateway.Port != 0 {
 		if opts.Gateway.Host == "" {
 			opts.Gateway.Host = DEFAULT_HOST
@@ -3019,6 +5836,62 @@ func setBaselineOptions(opts *Options) {
 	}
 }
 
+// ValidateConfig processes the given configuration file and validates the
+// resulting options as the server would on startup, without starting it.
+// This includes checking that the TLS certificates and keys can be loaded
+// and match. Errors from the configuration file processing are returned as
+// a single error listing each of them with their location in the file.
+// Warnings alone do not cause an error to be returned.
+func ValidateConfig(configFile string) error {
+	opts := &Options{}
+	if err := opts.ProcessConfigFile(configFile); err != nil {
+		if cerr, ok := err.(*processConfigErr); !ok || len(cerr.Errors()) != 0 {
+			return err
+		}
+	}
+	return validateConfiguredOptions(opts)
+}
+
+// validateConfiguredOptions performs the validations done when creating a
+// server, on a copy of the options. It does not create a server, so no
+// signal handler is installed and the account resolver is not contacted.
+func validateConfiguredOptions(opts *Options) error {
+	if err := validateServerOptions(opts.Clone()); err != nil {
+		return fmt.Errorf("%s: %v", opts.ConfigFile, err)
+	}
+	return nil
+}
+
+// validateServerOptions checks the options as NewServer would. Accounts
+// that can only be found through the account resolver are not checked.
+func validateServerOptions(opts *Options) error {
+	setBaselineOptions(opts)
+	if err := validateOptions(opts); err != nil {
+		return err
+	}
+	if !validTrustedKeys(opts) {
+		return fmt.Errorf("Error processing trusted operator keys")
+	}
+	if err := validateResolverPreloads(opts); err != nil {
+		return err
+	}
+	accountExists := func(accName string) bool {
+		if accName == globalAccountName {
+			return true
+		}
+		for _, acc := range opts.Accounts {
+			if acc.Name == accName {
+				return true
+			}
+		}
+		return false
+	}
+	if opts.SystemAccount != _EMPTY_ && opts.AccountResolver == nil && !accountExists(opts.SystemAccount) {
+		return fmt.Errorf("error resolving system account: %v", ErrMissingAccount)
+	}
+	return validateLeafNodeAccounts(opts, accountExists)
+}
+
 // ConfigureOptions accepts a flag set and augment it with NATS Server
 // specific flags. On success, an options structure is returned configured
 // based on the selected flags and/or configuration file.
@@ -3034,6 +5907,10 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 		dbgAndTrace            bool
 		trcAndVerboseTrc       bool
 		dbgAndTrcAndVerboseTrc bool
+		issueJoinToken         string
+		joinTokenTTL           time.Duration
+		joinTokenOnce          bool
+		joinTokenAccount       string
 		err                    error
 	)
 
@@ -3064,11 +5941,15 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 	fs.StringVar(&configFile, "c", "", "Configuration file.")
 	fs.StringVar(&configFile, "config", "", "Configuration file.")
 	fs.BoolVar(&opts.CheckConfig, "t", false, "Check configuration and exit.")
+	fs.BoolVar(&opts.CheckConfig, "config-check", false, "Check configuration and exit.")
 	fs.StringVar(&signal, "sl", "", "Send signal to nats-server process (stop, quit, reopen, reload)")
 	fs.StringVar(&signal, "signal", "", "Send signal to nats-server process (stop, quit, reopen, reload)")
 	fs.StringVar(&opts.PidFile, "P", "", "File to store process pid.")
 	fs.StringVar(&opts.PidFile, "pid", "", "File to store process pid.")
 	fs.StringVar(&opts.PortsFileDir, "ports_file_dir", "", "Creates a ports file in the specified directory (<executable_name>_<pid>.ports)")
+	fs.StringVar(&opts.StartupReport, "startup_report", "", "Writes a JSON startup report to the file, or to stdout with '-', once the server is ready.")
+	fs.BoolVar(&opts.Quiet, "q", false, "Do not log the startup banner.")
+	fs.BoolVar(&opts.Quiet, "quiet", false, "Do not log the startup banner.")
 	fs.StringVar(&opts.LogFile, "l", "", "File to store logging output.")
 	fs.StringVar(&opts.LogFile, "log", "", "File to store logging output.")
 	fs.Int64Var(&opts.LogSizeLimit, "log_size_limit", 0, "Logfile size limit being auto-rotated")
@@ -3085,6 +5966,10 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 	fs.StringVar(&opts.Cluster.Advertise, "cluster_advertise", "", "Cluster URL to advertise to other servers.")
 	fs.BoolVar(&opts.Cluster.NoAdvertise, "no_advertise", false, "Advertise known cluster IPs to clients.")
 	fs.IntVar(&opts.Cluster.ConnectRetries, "connect_retries", 0, "For implicit routes, number of connect retries")
+	fs.StringVar(&issueJoinToken, "issue_join_token", "", "Print a join token for a route or leafnode and exit.")
+	fs.DurationVar(&joinTokenTTL, "join_token_ttl", 0, "Validity of the issued join token.")
+	fs.BoolVar(&joinTokenOnce, "join_token_once", false, "Issued join token can be used only once.")
+	fs.StringVar(&joinTokenAccount, "join_token_account", "", "Account leafnodes joining with the issued token bind to.")
 	fs.BoolVar(&showTLSHelp, "help_tls", false, "TLS help.")
 	fs.BoolVar(&opts.TLS, "tls", false, "Enable TLS.")
 	fs.BoolVar(&opts.TLSVerify, "tlsverify", false, "Enable TLS with client verification.")
@@ -3120,6 +6005,20 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 		return nil, nil
 	}
 
+	// The signal command sends a signal to a running server and exits.
+	if fs.Arg(0) == "signal" {
+		if err := processSignalCommand(fs.Args()[1:]); err != nil {
+			return nil, err
+		}
+	}
+
+	// The bench command runs a load test of an in-process server and exits.
+	if fs.Arg(0) == "bench" {
+		if err := processBenchCommand(fs.Args()[1:]); err != nil {
+			return nil, err
+		}
+	}
+
 	// Process args looking for non-flag options,
 	// 'version' and 'help' only for now
 	showVersion, showHelp, err = ProcessCommandLineArgs(fs)
@@ -3191,7 +6090,11 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 			// If we get here we only have warnings and can still continue
 			fmt.Fprint(os.Stderr, err)
 		} else if opts.CheckConfig {
-			// Report configuration file syntax test was successful and exit.
+			// Report configuration file test was successful and exit, once
+			// the options have been validated as they would be on startup.
+			if err := validateConfiguredOptions(opts); err != nil {
+				return nil, err
+			}
 			return opts, nil
 		}
 
@@ -3204,6 +6107,19 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 		return nil, fmt.Errorf("must specify [-c, --config] option to check configuration file syntax")
 	}
 
+	// Issuing a join token requires the secret from the configuration file.
+	if issueJoinToken != "" {
+		if configFile == "" {
+			return nil, fmt.Errorf("must specify [-c, --config] option to issue a join token")
+		}
+		opts.IssueJoinToken = &JoinTokenRequest{
+			Kind:    issueJoinToken,
+			TTL:     joinTokenTTL,
+			OneTime: joinTokenOnce,
+			Account: joinTokenAccount,
+		}
+	}
+
 	// Special handling of some flags
 	var (
 		flagErr     error
@@ -3365,6 +6281,60 @@ func processSignal(signal string) error {
 	return nil
 }
 
+// processSignalCommand processes the arguments of the signal command and
+// sends the signal, exiting on success.
+func processSignalCommand(args []string) error {
+	command, pid, err := parseSignalCommand(args)
+	if err != nil {
+		return err
+	}
+	if err := ProcessSignal(command, pid); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
+
+// parseSignalCommand parses "<command> [--pid <pid>|--pidfile <file>]",
+// the flags being accepted before the command as well. It returns the
+// command and the PID, or Windows service name, to signal.
+func parseSignalCommand(args []string) (Command, string, error) {
+	var pid, pidFile string
+	fs := flag.NewFlagSet("signal", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.StringVar(&pid, "pid", "", "PID, or Windows service name, of the server to signal")
+	fs.StringVar(&pidFile, "pidfile", "", "File containing the PID of the server to signal")
+	if err := fs.Parse(args); err != nil {
+		return "", "", fmt.Errorf("signal: %v", err)
+	}
+	if fs.NArg() == 0 {
+		return "", "", errors.New("signal: missing command (ldm, reload, reopen, stop, quit, upgrade)")
+	}
+	command := Command(strings.ToLower(fs.Arg(0)))
+	if err := fs.Parse(fs.Args()[1:]); err != nil {
+		return "", "", fmt.Errorf("signal: %v", err)
+	}
+	if fs.NArg() > 0 {
+		return "", "", fmt.Errorf("signal: unexpected arguments: %v", fs.Args())
+	}
+	switch command {
+	case CommandStop, CommandQuit, CommandReopen, CommandReload, CommandUpgrade, commandLDMode:
+	default:
+		return "", "", fmt.Errorf("signal: unknown command %q (ldm, reload, reopen, stop, quit, upgrade)", command)
+	}
+	if pid != "" && pidFile != "" {
+		return "", "", errors.New("signal: --pid and --pidfile are mutually exclusive")
+	}
+	if pidFile != "" {
+		b, err := ioutil.ReadFile(pidFile)
+		if err != nil {
+			return "", "", fmt.Errorf("signal: %v", err)
+		}
+		pid = strings.TrimSpace(string(b))
+	}
+	return command, pid, nil
+}
+
 // maybeReadPidFile returns a PID or Windows service name obtained via the following method:
 // 1. Try to open a file with path "pidStr" (absolute or relative).
 // 2. If such a file exists and can be read, return its contents.
@@ -1305,6 +1305,9 @@ func TestConfigureOptions(t *testing.T) {
 	// Should fail because of too many args for signal command
 	expectToFail([]string{"-sl", "quit=pid=foo"}, "signal")
 
+	// Should fail because of unknown signal command
+	expectToFail([]string{"signal", "foo"}, "signal")
+
 	// Should fail because of invalid pid
 	// On windows, if not running with admin privileges, you would get access denied.
 	expectToFail([]string{"-sl", "quit=pid"}, "pid", "denied")
@@ -1405,6 +1408,46 @@ func TestConfigureOptions(t *testing.T) {
 	}
 }
 
+func TestParseSignalCommand(t *testing.T) {
+	pidFile := createConfFile(t, []byte("123\n"))
+	defer os.Remove(pidFile)
+
+	for _, test := range []struct {
+		name    string
+		args    []string
+		command Command
+		pid     string
+		err     string
+	}{
+		{"ldm", []string{"ldm"}, commandLDMode, "", ""},
+		{"pid after", []string{"reload", "--pid", "42"}, CommandReload, "42", ""},
+		{"pid before", []string{"-pid", "42", "Stop"}, CommandStop, "42", ""},
+		{"pidfile", []string{"reopen", "--pidfile", pidFile}, CommandReopen, "123", ""},
+		{"missing command", []string{"--pid", "42"}, "", "", "missing command"},
+		{"unknown command", []string{"foo"}, "", "", "unknown command"},
+		{"extra args", []string{"stop", "42"}, "", "", "unexpected"},
+		{"unknown flag", []string{"stop", "--foo"}, "", "", "not defined"},
+		{"pid and pidfile", []string{"stop", "--pid", "42", "--pidfile", pidFile}, "", "", "exclusive"},
+		{"missing pidfile", []string{"stop", "--pidfile", "does_not_exist.pid"}, "", "", "does_not_exist"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			command, pid, err := parseSignalCommand(test.args)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if command != test.command || pid != test.pid {
+				t.Fatalf("Expected command %q and pid %q, got %q and %q", test.command, test.pid, command, pid)
+			}
+		})
+	}
+}
+
 func TestClusterPermissionsConfig(t *testing.T) {
 	template := `
 		cluster {
@@ -2460,3 +2503,68 @@ func TestExpandPath(t *testing.T) {
 		})
 	}
 }
+
+func TestClusterTLSConfig(t *testing.T) {
+	template := `
+		cluster {
+			listen: "127.0.0.1:-1"
+			tls {
+				cert_file: "../test/configs/certs/server-cert.pem"
+				key_file: "../test/configs/certs/server-key.pem"
+				ca_file: "../test/configs/certs/ca.pem"
+				%s
+			}
+			%s
+		}
+	`
+	for _, test := range []struct {
+		name       string
+		tls        string
+		extra      string
+		clientAuth tls.ClientAuthType
+		insecure   bool
+		warn       string
+		err        string
+	}{
+		{"verify by default", "", "", tls.RequireAndVerifyClientCert, false, "", ""},
+		{"verify disabled", "verify: false", "", tls.RequireAndVerifyClientCert, false, clusterTLSVerifyWarning, ""},
+		{"insecure", "insecure: true", "", tls.RequireAnyClientCert, true, clusterTLSInsecureWarning, ""},
+		{"map", "verify_and_map: true", "authorization { user: \"CN=localhost\" }", tls.RequireAndVerifyClientCert, false, "", ""},
+		{"map without user", "verify_and_map: true", "", 0, false, "", "requires a user"},
+		{"map with insecure", "verify_and_map: true, insecure: true", "authorization { user: \"CN=localhost\" }", 0, false, "", "can't be used with 'insecure'"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(template, test.tls, test.extra)))
+			defer os.Remove(conf)
+			opts := &Options{}
+			err := opts.ProcessConfigFile(conf)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error about %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				cerr, ok := err.(*processConfigErr)
+				if !ok || len(cerr.Errors()) > 0 {
+					t.Fatalf("Error processing config file: %v", err)
+				}
+				if test.warn == "" || !strings.Contains(err.Error(), test.warn) {
+					t.Fatalf("Unexpected warning: %v", err)
+				}
+			} else if test.warn != "" {
+				t.Fatalf("Expected warning %q", test.warn)
+			}
+			tc := opts.Cluster.TLSConfig
+			if tc.ClientAuth != test.clientAuth {
+				t.Fatalf("Expected client auth %v, got %v", test.clientAuth, tc.ClientAuth)
+			}
+			if tc.InsecureSkipVerify != test.insecure {
+				t.Fatalf("Expected insecure to be %v", test.insecure)
+			}
+			if tc.RootCAs == nil || tc.RootCAs != tc.ClientCAs {
+				t.Fatal("Expected the CA pool to be used for both sides")
+			}
+		})
+	}
+}
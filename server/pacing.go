@@ -0,0 +1,187 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_WRITE_PACING_INTERVAL is the default pacing tick.
+const DEFAULT_WRITE_PACING_INTERVAL = 10 * time.Millisecond
+
+// WritePacingOpts limit the rate at which messages are written to each
+// client connection, so that a publish fanning out to a large number of
+// subscribers does not result in a burst of writes. Up to Rate bytes of
+// messages are written per Interval, the rest is held by the server, and
+// still counts against the max pending limit of the connection.
+// Messages on the Interactive subjects are not paced and are written
+// ahead of the held messages, so that bulk traffic does not delay them.
+// Messages are kept in order for each class, but an interactive message
+// can be delivered before a bulk message that was published earlier.
+type WritePacingOpts struct {
+	Rate        int64         `json:"rate"`
+	Interval    time.Duration `json:"interval,omitempty"`
+	Interactive []string      `json:"interactive,omitempty"`
+}
+
+func (o *WritePacingOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.Rate <= 0 {
+		return fmt.Errorf("write pacing rate must be positive")
+	}
+	if o.Interval < 0 {
+		return fmt.Errorf("write pacing interval can not be negative")
+	}
+	for _, subj := range o.Interactive {
+		if !IsValidSubject(subj) {
+			return fmt.Errorf("invalid write pacing interactive subject %q", subj)
+		}
+	}
+	return nil
+}
+
+func (o *WritePacingOpts) interval() time.Duration {
+	if o.Interval == 0 {
+		return DEFAULT_WRITE_PACING_INTERVAL
+	}
+	return o.Interval
+}
+
+// isInteractive returns true if messages on the subject are not paced.
+func (o *WritePacingOpts) isInteractive(subject []byte) bool {
+	if len(o.Interactive) == 0 {
+		return false
+	}
+	subj := string(subject)
+	for _, s := range o.Interactive {
+		if matchLiteral(subj, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// pacingAllows returns true, and consumes the budget of the current tick,
+// if size bytes can be written now. A protocol larger than the budget of
+// a whole tick is allowed when the budget is full, so that it is not held
+// forever.
+// Lock is held on entry.
+func (c *client) pacingAllows(size int64, now time.Time) bool {
+	pac := c.out.pac
+	if now.Sub(c.out.ptt) >= pac.interval() {
+		c.out.ptk = pac.Rate
+		c.out.ptt = now
+	}
+	if size > c.out.ptk && c.out.ptk < pac.Rate {
+		return false
+	}
+	if c.out.ptk -= size; c.out.ptk < 0 {
+		c.out.ptk = 0
+	}
+	return true
+}
+
+// queuePacedOutbound queues a message that is subject to pacing. It is
+// queued for writing if the budget of the current tick allows it and no
+// message is held already, otherwise it is held until a later tick.
+// Lock is held on entry.
+func (c *client) queuePacedOutbound(mh, msg []byte) {
+	size := int64(len(mh) + len(msg))
+	if len(c.out.pps) == 0 && c.pacingAllows(size, time.Now()) {
+		c.queueOutbound(mh)
+		c.queueOutbound(msg)
+		return
+	}
+	// Do not keep going if closed
+	if c.flags.isSet(closeConnection) {
+		return
+	}
+	c.out.pb += size
+	if c.out.pb > c.out.mp {
+		c.out.pb -= size
+		atomic.AddInt64(&c.srv.slowConsumers, 1)
+		c.Noticef("Slow Consumer Detected: MaxPending of %d Exceeded", c.out.mp)
+		c.markConnAsClosed(SlowConsumerPendingBytes, true)
+		return
+	}
+	c.out.pbl = append(c.out.pbl, mh...)
+	c.out.pbl = append(c.out.pbl, msg...)
+	c.out.pps = append(c.out.pps, int32(size))
+	// Wake up the writeLoop so that it waits for the next tick.
+	if len(c.out.pps) == 1 {
+		c.flushSignal()
+	}
+}
+
+// releasePaced queues for writing the held messages that the budget of
+// the current tick allows.
+// Lock is held on entry.
+func (c *client) releasePaced() {
+	if len(c.out.pps) == 0 {
+		return
+	}
+	now := time.Now()
+	var size int64
+	k := 0
+	for ; k < len(c.out.pps); k++ {
+		sz := int64(c.out.pps[k])
+		if !c.pacingAllows(sz, now) {
+			break
+		}
+		size += sz
+	}
+	if k == 0 {
+		return
+	}
+	// The held bytes are already accounted for in pending bytes.
+	c.out.pb -= size
+	referenced := c.queueOutbound(c.out.pbl[:size])
+	if k == len(c.out.pps) {
+		c.out.pps = c.out.pps[:0]
+		if referenced {
+			c.out.pbl = nil
+		} else {
+			c.out.pbl = c.out.pbl[:0]
+		}
+	} else {
+		c.out.pps = c.out.pps[k:]
+		c.out.pbl = c.out.pbl[size:]
+	}
+}
+
+// pacedWait returns how long the writeLoop can wait, which is until the
+// next tick if messages are held.
+// Lock is held on entry.
+func (c *client) pacedWait(max time.Duration) time.Duration {
+	if len(c.out.pps) == 0 {
+		return max
+	}
+	if wait := time.Until(c.out.ptt.Add(c.out.pac.interval())); wait < max {
+		if wait < 0 {
+			return 0
+		}
+		return wait
+	}
+	return max
+}
+
+// pendingWrite returns the pending bytes that can be written now.
+// Lock is held on entry.
+func (c *client) pendingWrite() int64 {
+	return c.out.pb - int64(len(c.out.pbl))
+}
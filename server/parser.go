@@ -14,7 +14,9 @@
 package server
 
 import (
+	"encoding/hex"
 	"fmt"
+	"sync/atomic"
 )
 
 type pubArg struct {
@@ -26,11 +28,13 @@ type pubArg struct {
 	szb     []byte
 	queues  [][]byte
 	size    int
+	origin  []byte
 }
 
 type parserState int
 type parseState struct {
 	state   parserState
+	op      byte
 	as      int
 	drop    int
 	pa      pubArg
@@ -106,6 +110,8 @@ const (
 	OP_INF
 	OP_INFO
 	INFO_ARG
+	PING_ARG
+	PONG_ARG
 )
 
 func (c *client) parse(buf []byte) error {
@@ -119,8 +125,17 @@ func (c *client) parse(buf []byte) error {
 	authSet := c.awaitingAuth()
 	// Snapshot max control line as well.
 	mcl := c.mcl
+	probe := c.kind == CLIENT && c.srv != nil && !c.flags.isSet(connectReceived)
+	// With a strict protocol, clients must send CONNECT before PUB, SUB
+	// and UNSUB even when no authentication is required.
+	preConnect := probe && c.isStrictProtocol()
 	c.mu.Unlock()
 
+	// Before any CONNECT, detect data that is not the protocol at all.
+	if probe && c.state == OP_START && len(buf) > 0 && !isProtoStart(buf) {
+		return c.scannerProbe(buf)
+	}
+
 	// Move to loop instead of range syntax to allow jumping of i
 	for i = 0; i < len(buf); i++ {
 		b = buf[i]
@@ -139,6 +154,7 @@ func (c *client) parse(buf []byte) error {
 					goto authErr
 				}
 			}
+			c.op = b
 			switch b {
 			case 'P', 'p':
 				c.state = OP_P
@@ -153,7 +169,7 @@ func (c *client) parse(buf []byte) error {
 					c.state = OP_R
 				}
 			case 'L', 'l':
-				if c.kind != LEAF {
+				if c.kind != LEAF && c.kind != ROUTER && c.kind != GATEWAY {
 					goto parseErr
 				} else {
 					c.state = OP_L
@@ -220,6 +236,9 @@ func (c *client) parse(buf []byte) error {
 				} else {
 					arg = buf[c.as : i-c.drop]
 				}
+				if preConnect {
+					return c.protoStateViolation(ErrProtoBeforeConnect)
+				}
 				if err := c.processPub(c.trace, arg); err != nil {
 					return err
 				}
@@ -407,6 +426,9 @@ func (c *client) parse(buf []byte) error {
 
 				switch c.kind {
 				case CLIENT:
+					if preConnect {
+						return c.protoStateViolation(ErrProtoBeforeConnect)
+					}
 					_, err = c.processSub(arg, false)
 				case ROUTER:
 					err = c.processRemoteSub(arg)
@@ -427,6 +449,10 @@ func (c *client) parse(buf []byte) error {
 		case OP_L:
 			switch b {
 			case 'S', 's':
+				// Routes and gateways only receive LMSG.
+				if c.kind != LEAF {
+					goto parseErr
+				}
 				c.state = OP_LS
 			case 'M', 'm':
 				c.state = OP_M
@@ -519,6 +545,9 @@ func (c *client) parse(buf []byte) error {
 
 				switch c.kind {
 				case CLIENT:
+					if preConnect {
+						return c.protoStateViolation(ErrProtoBeforeConnect)
+					}
 					err = c.processUnsub(arg)
 				case ROUTER:
 					err = c.processRemoteUnsub(arg)
@@ -555,6 +584,31 @@ func (c *client) parse(buf []byte) error {
 			case '\n':
 				c.processPing()
 				c.drop, c.state = 0, OP_START
+			case ' ', '\t':
+				// Only routes and gateways send a timestamp, the arguments
+				// of other connections are ignored.
+				if c.kind == ROUTER || c.kind == GATEWAY {
+					c.state, c.as = PING_ARG, i+1
+				}
+			}
+		case PING_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				var arg []byte
+				if c.argBuf != nil {
+					arg = c.argBuf
+					c.argBuf = nil
+				} else {
+					arg = buf[c.as : i-c.drop]
+				}
+				c.processTimedPing(arg)
+				c.drop, c.as, c.state = 0, i+1, OP_START
+			default:
+				if c.argBuf != nil {
+					c.argBuf = append(c.argBuf, b)
+				}
 			}
 		case OP_PO:
 			switch b {
@@ -575,6 +629,29 @@ func (c *client) parse(buf []byte) error {
 			case '\n':
 				c.processPong()
 				c.drop, c.state = 0, OP_START
+			case ' ', '\t':
+				if c.kind == ROUTER || c.kind == GATEWAY {
+					c.state, c.as = PONG_ARG, i+1
+				}
+			}
+		case PONG_ARG:
+			switch b {
+			case '\r':
+				c.drop = 1
+			case '\n':
+				var arg []byte
+				if c.argBuf != nil {
+					arg = c.argBuf
+					c.argBuf = nil
+				} else {
+					arg = buf[c.as : i-c.drop]
+				}
+				c.processTimedPong(arg)
+				c.drop, c.as, c.state = 0, i+1, OP_START
+			default:
+				if c.argBuf != nil {
+					c.argBuf = append(c.argBuf, b)
+				}
 			}
 		case OP_C:
 			switch b {
@@ -642,10 +719,17 @@ func (c *client) parse(buf []byte) error {
 					return err
 				}
 				c.drop, c.state = 0, OP_START
+				// What follows is compressed and read by the readLoop
+				// through the compressed connection.
+				if cc := c.in.cconn; cc != nil {
+					cc.pending = append([]byte(nil), buf[i+1:]...)
+					return nil
+				}
 				// Reset notion on authSet
 				c.mu.Lock()
 				authSet = c.awaitingAuth()
 				c.mu.Unlock()
+				preConnect = false
 			default:
 				if c.argBuf != nil {
 					c.argBuf = append(c.argBuf, b)
@@ -694,7 +778,11 @@ func (c *client) parse(buf []byte) error {
 				}
 				var err error
 				if c.kind == ROUTER || c.kind == GATEWAY {
-					err = c.processRoutedMsgArgs(c.trace, arg)
+					if c.op == 'L' || c.op == 'l' {
+						err = c.processRoutedOriginMsgArgs(c.trace, arg)
+					} else {
+						err = c.processRoutedMsgArgs(c.trace, arg)
+					}
 				} else if c.kind == LEAF {
 					err = c.processLeafMsgArgs(c.trace, arg)
 				}
@@ -845,7 +933,8 @@ func (c *client) parse(buf []byte) error {
 	if c.state == SUB_ARG || c.state == UNSUB_ARG || c.state == PUB_ARG ||
 		c.state == ASUB_ARG || c.state == AUSUB_ARG ||
 		c.state == MSG_ARG || c.state == MINUS_ERR_ARG ||
-		c.state == CONNECT_ARG || c.state == INFO_ARG {
+		c.state == CONNECT_ARG || c.state == INFO_ARG ||
+		c.state == PING_ARG || c.state == PONG_ARG {
 		// Setup a holder buffer to deal with split buffer scenario.
 		if c.argBuf == nil {
 			c.argBuf = c.scratch[:0]
@@ -896,11 +985,16 @@ func (c *client) parse(buf []byte) error {
 	return nil
 
 authErr:
+	// A protocol operation was received before the CONNECT.
+	if c.srv != nil {
+		atomic.AddInt64(&c.srv.protoStateViolations, 1)
+	}
 	c.authViolation()
 	return ErrAuthentication
 
 parseErr:
 	c.sendErr("Unknown Protocol Operation")
+	c.dumpProtoError(i, buf)
 	snip := protoSnippet(i, buf)
 	err := fmt.Errorf("%s parser ERROR, state=%d, i=%d: proto='%s...'",
 		c.typeString(), c.state, i, snip)
@@ -919,6 +1013,26 @@ func protoSnippet(start int, buf []byte) string {
 	return fmt.Sprintf("%q", buf[start:stop])
 }
 
+// dumpProtoError logs, at debug level, the first bytes of the protocol
+// that could not be parsed, hex-encoded, along with the identity of the
+// connection. The number of bytes is set by the proto_error_dump option,
+// nothing is logged if 0. This helps diagnosing broken client libraries.
+func (c *client) dumpProtoError(start int, buf []byte) {
+	if c.srv == nil || start >= len(buf) {
+		return
+	}
+	n := c.srv.getOpts().ProtoErrorDump
+	if n <= 0 {
+		return
+	}
+	stop := start + n
+	if stop > len(buf) {
+		stop = len(buf)
+	}
+	c.Debugf("Protocol error from %s (name %q, lang %q, version %q): %d bytes=%s",
+		c.getAuthUser(), c.opts.Name, c.opts.Lang, c.opts.Version, stop-start, hex.EncodeToString(buf[start:stop]))
+}
+
 // clonePubArg is used when the split buffer scenario has the pubArg in the existing read buffer, but
 // we need to hold onto it into the next read.
 func (c *client) clonePubArg() error {
@@ -928,6 +1042,9 @@ func (c *client) clonePubArg() error {
 
 	switch c.kind {
 	case ROUTER, GATEWAY:
+		if c.op == 'L' || c.op == 'l' {
+			return c.processRoutedOriginMsgArgs(false, c.argBuf)
+		}
 		return c.processRoutedMsgArgs(false, c.argBuf)
 	case LEAF:
 		return c.processLeafMsgArgs(false, c.argBuf)
@@ -15,6 +15,8 @@ package server
 
 import (
 	"bytes"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 )
 
@@ -586,3 +588,21 @@ func TestMaxControlLine(t *testing.T) {
 		t.Fatalf("Expected an error parsing longer than expected control line")
 	}
 }
+
+func TestParserFuzzCorpus(t *testing.T) {
+	for kind, dir := range map[int]string{CLIENT: "client", ROUTER: "route", LEAF: "leaf"} {
+		files, err := filepath.Glob(filepath.Join("testdata", "fuzz", dir, "corpus", "*"))
+		if err != nil || len(files) == 0 {
+			t.Fatalf("Expected %s corpus seeds, got %v, %v", dir, files, err)
+		}
+		for _, f := range files {
+			data, err := ioutil.ReadFile(f)
+			if err != nil {
+				t.Fatalf("Error reading %s: %v", f, err)
+			}
+			if fuzzParse(kind, data) != 1 {
+				t.Fatalf("Expected seed %s to parse", f)
+			}
+		}
+	}
+}
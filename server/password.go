@@ -0,0 +1,239 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Password hashing algorithms.
+	PasswordHashBcrypt   = "bcrypt"
+	PasswordHashArgon2id = "argon2id"
+
+	// Support for argon2id stored passwords, in the PHC string format:
+	// $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+	argon2idPrefix = "$argon2id$"
+
+	// Default argon2id parameters, from RFC 9106 second recommended option.
+	DefaultArgon2Time    = 3
+	DefaultArgon2Memory  = 64 * 1024
+	DefaultArgon2Threads = 4
+	argon2SaltLen        = 16
+	argon2KeyLen         = 32
+
+	// Default bcrypt cost, same as the mkpasswd tool.
+	DefaultBcryptCost = 11
+)
+
+// PasswordHashingOpts configures how passwords are hashed when they are
+// rehashed by the server after a successful login.
+type PasswordHashingOpts struct {
+	// Algorithm is either "bcrypt" or "argon2id".
+	Algorithm string `json:"algorithm"`
+	// BcryptCost is the bcrypt cost used when Algorithm is bcrypt.
+	BcryptCost int `json:"bcrypt_cost,omitempty"`
+	// Argon2Time, Argon2Memory (in KiB) and Argon2Threads are the
+	// argon2id parameters used when Algorithm is argon2id.
+	Argon2Time    uint32 `json:"argon2_time,omitempty"`
+	Argon2Memory  uint32 `json:"argon2_memory,omitempty"`
+	Argon2Threads uint8  `json:"argon2_threads,omitempty"`
+	// Rehash, if true, causes passwords that are in plaintext, or hashed
+	// with a different algorithm or parameters, to be rehashed when a
+	// user successfully authenticates.
+	Rehash bool `json:"rehash,omitempty"`
+}
+
+// Returns a copy with defaults set for unset parameters.
+func (o *PasswordHashingOpts) withDefaults() PasswordHashingOpts {
+	po := *o
+	if po.Algorithm == "" {
+		po.Algorithm = PasswordHashBcrypt
+	}
+	if po.BcryptCost == 0 {
+		po.BcryptCost = DefaultBcryptCost
+	}
+	if po.Argon2Time == 0 {
+		po.Argon2Time = DefaultArgon2Time
+	}
+	if po.Argon2Memory == 0 {
+		po.Argon2Memory = DefaultArgon2Memory
+	}
+	if po.Argon2Threads == 0 {
+		po.Argon2Threads = DefaultArgon2Threads
+	}
+	return po
+}
+
+// validate checks the algorithm and parameters.
+func (o *PasswordHashingOpts) validate() error {
+	po := o.withDefaults()
+	switch po.Algorithm {
+	case PasswordHashBcrypt:
+		if po.BcryptCost < bcrypt.MinCost || po.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost should be in the range %d-%d, got %d",
+				bcrypt.MinCost, bcrypt.MaxCost, po.BcryptCost)
+		}
+	case PasswordHashArgon2id:
+		if po.Argon2Memory < 8*uint32(po.Argon2Threads) {
+			return fmt.Errorf("argon2 memory should be at least %d KiB", 8*uint32(po.Argon2Threads))
+		}
+	default:
+		return fmt.Errorf("unknown password hashing algorithm %q", po.Algorithm)
+	}
+	return nil
+}
+
+// HashPassword hashes the given password with the algorithm and
+// parameters from the options. If `o` is nil, bcrypt with the default
+// cost is used. This can be used to migrate stored credentials.
+func HashPassword(password string, o *PasswordHashingOpts) (string, error) {
+	if o == nil {
+		o = &PasswordHashingOpts{}
+	}
+	if err := o.validate(); err != nil {
+		return _EMPTY_, err
+	}
+	po := o.withDefaults()
+	if po.Algorithm == PasswordHashArgon2id {
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return _EMPTY_, err
+		}
+		key := argon2.IDKey([]byte(password), salt, po.Argon2Time, po.Argon2Memory, po.Argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+			po.Argon2Memory, po.Argon2Time, po.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), po.BcryptCost)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	return string(h), nil
+}
+
+// isArgon2id checks whether the given password is an argon2id hash.
+func isArgon2id(password string) bool {
+	return strings.HasPrefix(password, argon2idPrefix)
+}
+
+// isHashedPassword checks whether the given password or token is
+// stored in one of the supported hashed formats.
+func isHashedPassword(password string) bool {
+	return isBcrypt(password) || isArgon2id(password)
+}
+
+// argon2idHash holds the decoded parts of an argon2id PHC string.
+type argon2idHash struct {
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+func parseArgon2id(hash string) (*argon2idHash, error) {
+	parts := strings.Split(hash, "$")
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("invalid argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+	h := &argon2idHash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters: %v", err)
+	}
+	if h.time == 0 || h.threads == 0 {
+		return nil, fmt.Errorf("invalid argon2id parameters")
+	}
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt: %v", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(h.key) == 0 {
+		return nil, fmt.Errorf("invalid argon2id key")
+	}
+	return h, nil
+}
+
+func compareArgon2id(hash, password string) bool {
+	h, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+	return subtle.ConstantTimeCompare(key, h.key) == 1
+}
+
+// needsRehash returns true if the stored password does not match the
+// algorithm and parameters of the given options.
+func needsRehash(stored string, o *PasswordHashingOpts) bool {
+	po := o.withDefaults()
+	switch {
+	case isBcrypt(stored):
+		if po.Algorithm != PasswordHashBcrypt {
+			return true
+		}
+		cost, err := bcrypt.Cost([]byte(stored))
+		return err != nil || cost != po.BcryptCost
+	case isArgon2id(stored):
+		if po.Algorithm != PasswordHashArgon2id {
+			return true
+		}
+		h, err := parseArgon2id(stored)
+		return err != nil || h.time != po.Argon2Time || h.memory != po.Argon2Memory || h.threads != po.Argon2Threads
+	}
+	// Plaintext
+	return true
+}
+
+// rehashUserPassword replaces, if needed, the stored password of a user that
+// just authenticated with a hash produced according to the password hashing
+// options. The new hash is passed to the PasswordRehashed callback, if set,
+// so that it can be persisted.
+func (s *Server) rehashUserPassword(user *User, password string) {
+	opts := s.getOpts()
+	ph := opts.PasswordHashing
+	if ph == nil || !ph.Rehash || user.Password == _EMPTY_ || !needsRehash(user.Password, ph) {
+		return
+	}
+	hash, err := HashPassword(password, ph)
+	if err != nil {
+		s.Errorf("Error rehashing password for user %q: %v", user.Username, err)
+		return
+	}
+	s.mu.Lock()
+	// Replace with a copy since the current one may be in use.
+	if cur := s.users[user.Username]; cur != nil && cur.Password == user.Password {
+		nu := cur.clone()
+		nu.Password = hash
+		s.users[user.Username] = nu
+	}
+	s.mu.Unlock()
+	s.Noticef("Rehashed password for user %q", user.Username)
+	if cb := opts.PasswordRehashed; cb != nil {
+		cb(user.Username, hash)
+	}
+}
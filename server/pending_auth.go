@@ -0,0 +1,55 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "sync/atomic"
+
+// pendingAuth returns the number of connections accepted on the listener
+// of this kind of connection and not yet authenticated.
+func (s *Server) pendingAuth(kind int) int64 {
+	return atomic.LoadInt64(&s.pendingAuths[kind])
+}
+
+// trackPendingAuth counts the connection as pending authentication on its
+// listener, unless max connections already are, in which case it returns
+// false. A max of 0 means no limit, the connection is then not counted.
+// Lock held on entry.
+func (c *client) trackPendingAuth(max int) bool {
+	if max <= 0 {
+		return true
+	}
+	n := &c.srv.pendingAuths[c.kind]
+	if atomic.AddInt64(n, 1) > int64(max) {
+		atomic.AddInt64(n, -1)
+		return false
+	}
+	c.flags.set(pendingAuth)
+	return true
+}
+
+// untrackPendingAuth is invoked once the connection has sent its CONNECT
+// or is closed.
+// Lock held on entry.
+func (c *client) untrackPendingAuth() {
+	if !c.flags.isSet(pendingAuth) {
+		return
+	}
+	c.flags.clear(pendingAuth)
+	atomic.AddInt64(&c.srv.pendingAuths[c.kind], -1)
+}
+
+func (c *client) maxPendingAuthExceeded() {
+	c.sendErrAndDebug(ErrTooManyPendingAuth.Error())
+	c.closeConnection(MaxPendingAuthExceeded)
+}
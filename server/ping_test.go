@@ -14,7 +14,12 @@
 package server
 
 import (
+	"bufio"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -42,3 +47,148 @@ func TestPing(t *testing.T) {
 	defer nc.Close()
 	time.Sleep(10 * time.Millisecond)
 }
+
+func TestPingAccountOverride(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		ping_interval: "10s"
+		accounts {
+			WEB {
+				users = [{user: web, password: pwd}]
+				ping_interval: "50ms"
+				ping_max: 1
+			}
+			APP {
+				users = [{user: app, password: pwd}]
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// Connects without ever answering the server PINGs.
+	connect := func(user string) net.Conn {
+		t.Helper()
+		c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+		if err != nil {
+			t.Fatalf("Error connecting: %v", err)
+		}
+		if _, err := fmt.Fprintf(c, "CONNECT {\"verbose\":false,\"user\":%q,\"pass\":\"pwd\"}\r\nPING\r\n", user); err != nil {
+			t.Fatalf("Error writing: %v", err)
+		}
+		return c
+	}
+	web := connect("web")
+	defer web.Close()
+	app := connect("app")
+	defer app.Close()
+
+	// The web client is declared stale based on the account settings.
+	web.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf, err := ioutil.ReadAll(web)
+	if err != nil || !strings.Contains(string(buf), "Stale Connection") {
+		t.Fatalf("Expected stale connection error, got %q, %v", buf, err)
+	}
+	// The other one is not.
+	if n := s.NumClients(); n != 1 {
+		t.Fatalf("Expected 1 client, got %d", n)
+	}
+	conns := s.closedClients()
+	if len(conns) != 1 || conns[0].acc != "WEB" || conns[0].Reason != StaleConnection.String() {
+		t.Fatalf("Unexpected closed connections: %+v", conns)
+	}
+}
+
+func TestPingSuspendStaleClient(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		http: "127.0.0.1:-1"
+		ping_interval: "50ms"
+		ping_max: 1
+		suspend { max: "10s" }
+	`))
+	defer os.Remove(conf)
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	if _, err := c.Write([]byte("CONNECT {\"verbose\":false}\r\nSUB foo 1\r\nPING\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	// Returns the next line that is not a PING, answering them if asked.
+	readLine := func(answer bool) string {
+		t.Helper()
+		for {
+			c.SetReadDeadline(time.Now().Add(2 * time.Second))
+			l, err := br.ReadString('\n')
+			if err != nil {
+				t.Fatalf("Error reading: %v", err)
+			}
+			if l != "PING\r\n" {
+				return l
+			}
+			if answer {
+				c.Write([]byte("PONG\r\n"))
+			}
+		}
+	}
+	readLine(false) // INFO
+	if l := readLine(false); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	suspended := func() bool {
+		t.Helper()
+		connz, err := s.Connz(&ConnzOptions{CID: 1})
+		if err != nil || len(connz.Conns) != 1 {
+			t.Fatalf("Unexpected connz: %+v, %v", connz, err)
+		}
+		return connz.Conns[0].Suspended != nil
+	}
+
+	// The client does not answer the PINGs, it is suspended instead of
+	// being closed.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if !suspended() {
+			return fmt.Errorf("Connection not suspended")
+		}
+		return nil
+	})
+	time.Sleep(250 * time.Millisecond)
+	if n := s.NumClients(); n != 1 {
+		t.Fatalf("Expected suspended client to stay connected")
+	}
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	natsPub(t, nc, "foo", []byte("dropped"))
+	natsFlush(t, nc)
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		v, _ := s.Varz(nil)
+		if v.SuspendDropped != 1 {
+			return fmt.Errorf("Expected 1 dropped message, got %v", v.SuspendDropped)
+		}
+		return nil
+	})
+
+	// Anything received from the client resumes the connection.
+	if _, err := c.Write([]byte("PONG\r\n")); err != nil {
+		t.Fatalf("Error writing: %v", err)
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if suspended() {
+			return fmt.Errorf("Connection still suspended")
+		}
+		return nil
+	})
+	natsPub(t, nc, "foo", []byte("hello"))
+	natsFlush(t, nc)
+	if l := readLine(true); l != "MSG foo 1 5\r\n" {
+		t.Fatalf("Expected MSG, got %q", l)
+	}
+}
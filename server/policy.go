@@ -0,0 +1,248 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_POLICY_TIMEOUT is the default timeout of a request to the
+	// policy engine.
+	DEFAULT_POLICY_TIMEOUT = 2 * time.Second
+	// DEFAULT_POLICY_CACHE_TTL is how long decisions are cached by default.
+	DEFAULT_POLICY_CACHE_TTL = time.Minute
+	// DEFAULT_POLICY_CACHE_SIZE is the default maximum number of cached
+	// decisions.
+	DEFAULT_POLICY_CACHE_SIZE = 10000
+	// Time during which the policy engine is not contacted after a failed
+	// request, the actions not in the cache being allowed or denied
+	// according to FailOpen.
+	policyRetryInterval = 5 * time.Second
+)
+
+// errPolicyEngineUnavailable is returned for the actions decided while the
+// policy engine is not contacted after a failure, which was already reported.
+var errPolicyEngineUnavailable = errors.New("policy engine unavailable")
+
+// Actions for which the policy engine can be consulted.
+const (
+	PolicyConnect   = "connect"
+	PolicyPublish   = "publish"
+	PolicySubscribe = "subscribe"
+)
+
+// PolicyOpts delegate the authorization decisions of clients to an external
+// policy engine, after the usual authentication and permissions checks. The
+// engine is sent a POST request with a JSON body such as:
+//
+//	{"input": {"action": "publish", "account": "A", "user": "bob",
+//	           "host": "10.0.0.1", "subject": "orders.new"}}
+//
+// which is what the Open Policy Agent data API expects, and the response
+// must be {"result": true} or {"result": {"allow": true}} to allow the
+// action. Anything else denies it. Decisions are cached, and when the
+// engine can not be reached, the action is denied unless FailOpen is set,
+// and the engine is not contacted again for a few seconds.
+// The request is made from the connection's read loop, so the Actions can
+// be limited to the ones that need it, publish being the most frequent.
+type PolicyOpts struct {
+	URL       string        `json:"url"`
+	Timeout   time.Duration `json:"timeout,omitempty"`
+	CacheTTL  time.Duration `json:"cache_ttl,omitempty"`
+	CacheSize int           `json:"cache_size,omitempty"`
+	FailOpen  bool          `json:"fail_open,omitempty"`
+	// Actions lists the actions to check, all of them if empty.
+	Actions []string `json:"actions,omitempty"`
+}
+
+func (o *PolicyOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	u, err := url.Parse(o.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == _EMPTY_ {
+		return fmt.Errorf("policy url %q is not a valid http(s) url", o.URL)
+	}
+	if o.Timeout < 0 || o.CacheTTL < 0 || o.CacheSize < 0 {
+		return fmt.Errorf("policy timeout, cache_ttl and cache_size can not be negative")
+	}
+	for _, a := range o.Actions {
+		switch a {
+		case PolicyConnect, PolicyPublish, PolicySubscribe:
+		default:
+			return fmt.Errorf("unknown policy action %q", a)
+		}
+	}
+	return nil
+}
+
+// policyInput is the input of a decision.
+type policyInput struct {
+	Action  string `json:"action"`
+	Account string `json:"account,omitempty"`
+	User    string `json:"user,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	Queue   string `json:"queue,omitempty"`
+}
+
+type policyDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+// policyEngine requests and caches the decisions of the policy engine.
+type policyEngine struct {
+	opts    PolicyOpts
+	actions map[string]bool
+	hc      *http.Client
+
+	mu    sync.Mutex
+	cache map[policyInput]policyDecision
+	// Time until which the engine is not contacted after a failure.
+	retry time.Time
+}
+
+func newPolicyEngine(o *PolicyOpts) *policyEngine {
+	opts := *o
+	if opts.Timeout == 0 {
+		opts.Timeout = DEFAULT_POLICY_TIMEOUT
+	}
+	if opts.CacheTTL == 0 {
+		opts.CacheTTL = DEFAULT_POLICY_CACHE_TTL
+	}
+	if opts.CacheSize == 0 {
+		opts.CacheSize = DEFAULT_POLICY_CACHE_SIZE
+	}
+	actions := make(map[string]bool)
+	for _, a := range opts.Actions {
+		actions[a] = true
+	}
+	if len(actions) == 0 {
+		actions = map[string]bool{PolicyConnect: true, PolicyPublish: true, PolicySubscribe: true}
+	}
+	return &policyEngine{
+		opts:    opts,
+		actions: actions,
+		hc:      &http.Client{Timeout: opts.Timeout},
+		cache:   make(map[policyInput]policyDecision),
+	}
+}
+
+// allowed returns the decision for the input, from the cache if possible.
+func (p *policyEngine) allowed(in policyInput) (bool, error) {
+	now := time.Now()
+	p.mu.Lock()
+	d, ok := p.cache[in]
+	retry := p.retry
+	p.mu.Unlock()
+	if ok && now.Before(d.expires) {
+		return d.allowed, nil
+	}
+	if now.Before(retry) {
+		return p.opts.FailOpen, errPolicyEngineUnavailable
+	}
+
+	allowed, err := p.request(in)
+	if err != nil {
+		p.mu.Lock()
+		p.retry = time.Now().Add(policyRetryInterval)
+		p.mu.Unlock()
+		return p.opts.FailOpen, err
+	}
+	p.mu.Lock()
+	if len(p.cache) >= p.opts.CacheSize {
+		for k, d := range p.cache {
+			if !now.Before(d.expires) {
+				delete(p.cache, k)
+			}
+		}
+		// Still full, start over.
+		if len(p.cache) >= p.opts.CacheSize {
+			p.cache = make(map[policyInput]policyDecision)
+		}
+	}
+	p.cache[in] = policyDecision{allowed: allowed, expires: now.Add(p.opts.CacheTTL)}
+	p.mu.Unlock()
+	return allowed, nil
+}
+
+// request asks the policy engine for a decision.
+func (p *policyEngine) request(in policyInput) (bool, error) {
+	body, _ := json.Marshal(map[string]interface{}{"input": in})
+	resp, err := p.hc.Post(p.opts.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("policy engine returned %v", resp.Status)
+	}
+	var out struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return false, fmt.Errorf("invalid policy engine response: %v", err)
+	}
+	var allowed bool
+	if json.Unmarshal(out.Result, &allowed) == nil {
+		return allowed, nil
+	}
+	var result struct {
+		Allow bool `json:"allow"`
+	}
+	json.Unmarshal(out.Result, &result)
+	return result.Allow, nil
+}
+
+// policyAllows returns false if the policy engine denies the action of the
+// client. It is called from the read loop, where the authenticated identity
+// and account of the client can be accessed without the lock.
+func (c *client) policyAllows(action, subject, queue string) bool {
+	if c.srv == nil || c.kind != CLIENT {
+		return true
+	}
+	p, _ := c.srv.policy.Load().(*policyEngine)
+	if p == nil || !p.actions[action] {
+		return true
+	}
+	in := policyInput{Action: action, Host: c.host, Subject: subject, Queue: queue}
+	in.User = c.authID
+	if c.acc != nil {
+		in.Account = c.acc.Name
+	}
+	allowed, err := p.allowed(in)
+	if err == errPolicyEngineUnavailable {
+		// The failure was reported when the engine was last contacted.
+		c.Debugf("Policy engine unavailable for %s, allowed: %v", action, allowed)
+	} else if err != nil {
+		if allowed {
+			c.Warnf("Policy engine error, allowing %s: %v", action, err)
+		} else {
+			c.Warnf("Policy engine error, denying %s: %v", action, err)
+		}
+	} else if !allowed {
+		c.Debugf("Policy engine denied %s %s", action, strings.TrimSpace(subject+" "+queue))
+	}
+	return allowed
+}
@@ -0,0 +1,247 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Schemes of the proxies that outbound connections can be dialed through.
+const (
+	ProxySchemeHTTP   = "http"
+	ProxySchemeSOCKS5 = "socks5"
+)
+
+// Maximum size of the response of an HTTP proxy to a CONNECT request.
+const maxProxyResponseSize = 8 * 1024
+
+func validateProxyURL(u *url.URL) error {
+	if u == nil {
+		return nil
+	}
+	switch u.Scheme {
+	case ProxySchemeHTTP, ProxySchemeSOCKS5:
+	default:
+		return fmt.Errorf("invalid proxy scheme %q in %q, expected %q or %q",
+			u.Scheme, u.Host, ProxySchemeHTTP, ProxySchemeSOCKS5)
+	}
+	if u.Port() == _EMPTY_ {
+		return fmt.Errorf("proxy %q has no port", u.Host)
+	}
+	return nil
+}
+
+// validateProxies checks the proxies of the leafnode and gateway remotes.
+func validateProxies(o *Options) error {
+	for _, r := range o.LeafNode.Remotes {
+		if err := validateProxyURL(r.Proxy); err != nil {
+			return err
+		}
+	}
+	for _, g := range o.Gateway.Gateways {
+		if err := validateProxyURL(g.Proxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialProxy connects to hostPort through the proxy. The host name is
+// resolved by the proxy.
+func (s *Server) dialProxy(kind string, proxy *url.URL, hostPort string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxy.Host, timeout)
+	s.recordDial(kind, proxy.Host, err)
+	if err != nil {
+		return nil, fmt.Errorf("proxy %q: %v", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	switch proxy.Scheme {
+	case ProxySchemeHTTP:
+		err = proxyConnectHTTP(conn, proxy, hostPort)
+	case ProxySchemeSOCKS5:
+		err = proxyConnectSOCKS5(conn, proxy, hostPort)
+	default:
+		err = fmt.Errorf("unsupported scheme %q", proxy.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %q: %v", proxy.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// proxyConnectHTTP establishes a tunnel with an HTTP CONNECT request.
+func proxyConnectHTTP(conn net.Conn, proxy *url.URL, hostPort string) error {
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n", hostPort, hostPort)
+	if u := proxy.User; u != nil {
+		pwd, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pwd))
+		fmt.Fprintf(&req, "Proxy-Authorization: Basic %s\r\n", auth)
+	}
+	req.WriteString(CR_LF)
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return err
+	}
+	// The remote server may send its INFO right after the response, so
+	// read the response up to its end only.
+	var resp []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(resp, []byte(CR_LF+CR_LF)) {
+		if len(resp) >= maxProxyResponseSize {
+			return fmt.Errorf("response too large")
+		}
+		if _, err := conn.Read(b); err != nil {
+			return err
+		}
+		resp = append(resp, b[0])
+	}
+	r, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(resp)), nil)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("CONNECT to %s failed: %s", hostPort, r.Status)
+	}
+	return nil
+}
+
+// SOCKS5 protocol values, see RFC 1928 and RFC 1929.
+const (
+	socks5Version        = 5
+	socks5AuthNone       = 0
+	socks5AuthPassword   = 2
+	socks5AuthNoAccept   = 0xff
+	socks5CmdConnect     = 1
+	socks5AddrIPv4       = 1
+	socks5AddrDomain     = 3
+	socks5AddrIPv6       = 4
+	socks5PasswordVer    = 1
+	socks5ReplySucceeded = 0
+)
+
+// proxyConnectSOCKS5 establishes a tunnel with a SOCKS5 CONNECT command.
+func proxyConnectSOCKS5(conn net.Conn, proxy *url.URL, hostPort string) error {
+	host, portStr, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid port %q", portStr)
+	}
+
+	// Negotiate the authentication method.
+	methods := []byte{socks5AuthNone}
+	if proxy.User != nil {
+		methods = append(methods, socks5AuthPassword)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", reply[0])
+	}
+	switch reply[1] {
+	case socks5AuthNone:
+	case socks5AuthPassword:
+		if proxy.User == nil {
+			return fmt.Errorf("unexpected authentication method")
+		}
+		user := proxy.User.Username()
+		pwd, _ := proxy.User.Password()
+		if len(user) > 255 || len(pwd) > 255 {
+			return fmt.Errorf("username or password too long")
+		}
+		req := []byte{socks5PasswordVer, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pwd)))
+		req = append(req, pwd...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != socks5ReplySucceeded {
+			return fmt.Errorf("authentication failed")
+		}
+	case socks5AuthNoAccept:
+		return fmt.Errorf("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unexpected authentication method %d", reply[1])
+	}
+
+	// Request the connection.
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long")
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socks5AddrIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socks5AddrIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unexpected SOCKS version %d", resp[0])
+	}
+	if resp[1] != socks5ReplySucceeded {
+		return fmt.Errorf("CONNECT to %s failed with code %d", hostPort, resp[1])
+	}
+	// Skip the bound address and port.
+	var n int
+	switch resp[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, resp[:1]); err != nil {
+			return err
+		}
+		n = int(resp[0])
+	default:
+		return fmt.Errorf("unexpected address type %d", resp[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, n+2))
+	return err
+}
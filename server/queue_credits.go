@@ -0,0 +1,105 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"sync/atomic"
+)
+
+// subCreditsArg is the option following the sid in queue SUB protocols,
+// as in "SUB <subject> <queue> <sid> credits=<n>", for a member that is
+// delivered at most n messages it has not granted credits back for.
+const subCreditsArg = "credits="
+
+// queueCreditPrefix is the subject a client publishes on to grant credits
+// back to one of its credit based queue subscriptions, as in
+// "PUB $QCREDIT.<sid> <size>" with the number of credits as payload, 1 if
+// empty. The message is not delivered to anyone.
+const queueCreditPrefix = "$QCREDIT."
+
+var queueCreditPrefixBytes = []byte(queueCreditPrefix)
+
+// parseSubCredits returns the number of credits of the credits option, or
+// false if this is not a valid credits option.
+func parseSubCredits(arg []byte) (int32, bool) {
+	if !bytes.HasPrefix(arg, []byte(subCreditsArg)) {
+		return 0, false
+	}
+	n := parseSize(arg[len(subCreditsArg):])
+	if n <= 0 || n > 1<<30 {
+		return 0, false
+	}
+	return int32(n), true
+}
+
+// takeCredit uses one of the credits of the subscription, if credit based.
+// It returns false if there are none left, the message is then to be
+// delivered to another member of the queue group.
+func (s *subscription) takeCredit() bool {
+	if s.maxCredits == 0 {
+		return true
+	}
+	for {
+		n := atomic.LoadInt32(&s.credits)
+		if n <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.credits, n, n-1) {
+			return true
+		}
+	}
+}
+
+// grantCredits gives credits back to the subscription, up to its maximum.
+func (s *subscription) grantCredits(n int32) {
+	if s.maxCredits == 0 {
+		return
+	}
+	for {
+		c := atomic.LoadInt32(&s.credits)
+		nc := c + n
+		if nc > s.maxCredits || nc < c {
+			nc = s.maxCredits
+		}
+		if atomic.CompareAndSwapInt32(&s.credits, c, nc) {
+			return
+		}
+	}
+}
+
+// processCreditGrant processes a message published on queueCreditPrefix.
+// Grants for unknown subscriptions are ignored, the subscription may
+// have just been removed.
+func (c *client) processCreditGrant(msg []byte) {
+	n := int32(1)
+	if payload := msg[:len(msg)-LEN_CR_LF]; len(payload) > 0 {
+		v := parseSize(payload)
+		if v <= 0 || v > 1<<30 {
+			c.sendErr("Invalid Credits")
+			return
+		}
+		n = int32(v)
+	}
+	sid := string(c.pa.subject[len(queueCreditPrefix):])
+	c.mu.Lock()
+	sub := c.subs[sid]
+	c.mu.Unlock()
+	if sub != nil {
+		sub.grantCredits(n)
+	}
+	if c.opts.Verbose {
+		c.queueOK()
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The counters are sampled at this interval, and enough samples are kept
+// to cover the longest rolling window.
+var rateSampleInterval = 5 * time.Second
+
+const rateLongestWindow = 15 * time.Minute
+
+// Rates are the per second rates of the server counters over the last
+// 1, 5 and 15 minutes, or since the start for a server started more
+// recently.
+type Rates struct {
+	OneMinute      *RateStats `json:"1m"`
+	FiveMinutes    *RateStats `json:"5m"`
+	FifteenMinutes *RateStats `json:"15m"`
+}
+
+// RateStats are per second rates over a window.
+type RateStats struct {
+	InMsgs            float64 `json:"in_msgs"`
+	OutMsgs           float64 `json:"out_msgs"`
+	InBytes           float64 `json:"in_bytes"`
+	OutBytes          float64 `json:"out_bytes"`
+	Connections       float64 `json:"connections"`
+	HandshakeFailures float64 `json:"handshake_failures"`
+}
+
+// rateSample is a snapshot of the counters.
+type rateSample struct {
+	time              time.Time
+	inMsgs            int64
+	outMsgs           int64
+	inBytes           int64
+	outBytes          int64
+	connections       uint64
+	handshakeFailures int64
+}
+
+// rollingRates keeps the samples of the counters in a ring, the oldest
+// being overwritten.
+type rollingRates struct {
+	sync.Mutex
+	samples []rateSample
+	next    int
+	full    bool
+}
+
+// sampleRates takes a sample of the counters.
+func (s *Server) sampleRates() {
+	rs := rateSample{
+		time:              time.Now(),
+		inMsgs:            atomic.LoadInt64(&s.inMsgs),
+		outMsgs:           atomic.LoadInt64(&s.outMsgs),
+		inBytes:           atomic.LoadInt64(&s.inBytes),
+		outBytes:          atomic.LoadInt64(&s.outBytes),
+		handshakeFailures: atomic.LoadInt64(&s.handshakeFailures),
+	}
+	s.mu.Lock()
+	rs.connections = s.totalClients
+	s.mu.Unlock()
+
+	r := &s.rates
+	r.Lock()
+	if r.samples == nil {
+		r.samples = make([]rateSample, int(rateLongestWindow/rateSampleInterval)+1)
+	}
+	r.samples[r.next] = rs
+	if r.next++; r.next == len(r.samples) {
+		r.next, r.full = 0, true
+	}
+	r.Unlock()
+}
+
+// startRollingRates samples the counters until shutdown.
+func (s *Server) startRollingRates() {
+	s.sampleRates()
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		t := time.NewTicker(rateSampleInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				s.sampleRates()
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// rollingRates returns the rates over the rolling windows, nil if not
+// enough samples have been taken yet.
+func (s *Server) rollingRates() *Rates {
+	r := &s.rates
+	r.Lock()
+	defer r.Unlock()
+	n := r.next
+	if r.full {
+		n = len(r.samples)
+	}
+	if n < 2 {
+		return nil
+	}
+	// Samples from the most recent to the oldest.
+	at := func(i int) *rateSample {
+		return &r.samples[(r.next-1-i+len(r.samples))%len(r.samples)]
+	}
+	last := at(0)
+	over := func(window time.Duration) *RateStats {
+		// The oldest sample within the window, or the oldest one.
+		first := at(n - 1)
+		for i := 1; i < n; i++ {
+			if last.time.Sub(at(i).time) >= window {
+				first = at(i)
+				break
+			}
+		}
+		secs := last.time.Sub(first.time).Seconds()
+		if secs <= 0 {
+			return &RateStats{}
+		}
+		return &RateStats{
+			InMsgs:            float64(last.inMsgs-first.inMsgs) / secs,
+			OutMsgs:           float64(last.outMsgs-first.outMsgs) / secs,
+			InBytes:           float64(last.inBytes-first.inBytes) / secs,
+			OutBytes:          float64(last.outBytes-first.outBytes) / secs,
+			Connections:       float64(last.connections-first.connections) / secs,
+			HandshakeFailures: float64(last.handshakeFailures-first.handshakeFailures) / secs,
+		}
+	}
+	return &Rates{
+		OneMinute:      over(time.Minute),
+		FiveMinutes:    over(5 * time.Minute),
+		FifteenMinutes: over(rateLongestWindow),
+	}
+}
+
+// isHandshakeFailure returns whether a connection closed for that reason
+// failed to complete its TLS or authentication handshake.
+func isHandshakeFailure(reason ClosedState) bool {
+	switch reason {
+	case TLSHandshakeError, AuthenticationTimeout, AuthenticationViolation:
+		return true
+	}
+	return false
+}
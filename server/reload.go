@@ -216,6 +216,18 @@ func (a *authorizationOption) Apply(server *Server) {
 	server.Noticef("Reloaded: authorization token")
 }
 
+// policyOption implements the option interface for the `policy` setting.
+type policyOption struct {
+	authOption
+	newValue *PolicyOpts
+}
+
+// Apply is a no-op because authorization will be reloaded after options are
+// applied.
+func (p *policyOption) Apply(server *Server) {
+	server.Noticef("Reloaded: policy = %+v", p.newValue)
+}
+
 // authTimeoutOption implements the option interface for the authorization
 // `timeout` setting.
 type authTimeoutOption struct {
@@ -263,7 +275,7 @@ func (c *clusterOption) Apply(server *Server) {
 	tlsRequired := c.newValue.TLSConfig != nil
 	server.routeInfo.TLSRequired = tlsRequired
 	server.routeInfo.TLSVerify = tlsRequired
-	server.routeInfo.AuthRequired = c.newValue.Username != ""
+	server.routeInfo.AuthRequired = c.newValue.Username != "" || len(c.newValue.Nkeys) > 0
 	if c.newValue.NoAdvertise {
 		server.routeInfo.ClientConnectURLs = nil
 	} else {
@@ -329,6 +341,18 @@ func (r *routesOption) Apply(server *Server) {
 	server.Noticef("Reloaded: cluster routes")
 }
 
+// maxPendingAuthOption implements the option interface for the
+// `max_pending_auth` setting.
+type maxPendingAuthOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply is a no-op, the limit is checked when connections are accepted.
+func (m *maxPendingAuthOption) Apply(server *Server) {
+	server.Noticef("Reloaded: max_pending_auth = %d", m.newValue)
+}
+
 // maxConnOption implements the option interface for the `max_connections`
 // setting.
 type maxConnOption struct {
@@ -386,6 +410,42 @@ func (p *pidFileOption) Apply(server *Server) {
 	server.Noticef("Reloaded: pid_file = %v", p.newValue)
 }
 
+// startupReportOption implements the option interface for the
+// `startup_report` setting.
+type startupReportOption struct {
+	noopOption
+	newValue string
+}
+
+// Apply is a no-op, the startup report is written only once.
+func (r *startupReportOption) Apply(server *Server) {
+	server.Noticef("Reloaded: startup_report = %s", r.newValue)
+}
+
+// stateSnapshotDirOption implements the option interface for the
+// `state_snapshot_dir` setting.
+type stateSnapshotDirOption struct {
+	noopOption
+	newValue string
+}
+
+// Apply is a no-op, the directory is read when a snapshot is written.
+func (d *stateSnapshotDirOption) Apply(server *Server) {
+	server.Noticef("Reloaded: state_snapshot_dir = %s", d.newValue)
+}
+
+// containerLimitsOption implements the option interface for the
+// `container_limits` setting.
+type containerLimitsOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op, the container limits are detected on startup.
+func (c *containerLimitsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: container_limits = %v", c.newValue)
+}
+
 // portsFileDirOption implements the option interface for the `portFileDir` setting.
 type portsFileDirOption struct {
 	noopOption
@@ -435,6 +495,33 @@ func (m *maxPayloadOption) Apply(server *Server) {
 	server.Noticef("Reloaded: max_payload = %d", m.newValue)
 }
 
+// subjectLimitsOption implements the option interface for the
+// `max_subject_len`, `max_subject_tokens` and `max_reply_len` settings.
+type subjectLimitsOption struct {
+	noopOption
+	name     string
+	newValue int32
+}
+
+// Apply the new limits to subjects used from now on.
+func (l *subjectLimitsOption) Apply(server *Server) {
+	server.setSubjectLimits(server.getOpts())
+	server.Noticef("Reloaded: %s = %d", l.name, l.newValue)
+}
+
+// strictProtocolOption implements the option interface for the
+// `strict_protocol` setting.
+type strictProtocolOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply the strict validation to the protocols received from now on.
+func (p *strictProtocolOption) Apply(server *Server) {
+	server.setSubjectLimits(server.getOpts())
+	server.Noticef("Reloaded: strict_protocol = %v", p.newValue)
+}
+
 // pingIntervalOption implements the option interface for the `ping_interval`
 // setting.
 type pingIntervalOption struct {
@@ -448,6 +535,71 @@ func (p *pingIntervalOption) Apply(server *Server) {
 	server.Noticef("Reloaded: ping_interval = %s", p.newValue)
 }
 
+// accountAuditOption implements the option interface for the
+// `account_audit` setting.
+type accountAuditOption struct {
+	noopOption
+	newValue *AccountAuditOpts
+}
+
+// Apply is a no-op because the options are read when messages cross accounts.
+func (a *accountAuditOption) Apply(server *Server) {
+	server.Noticef("Reloaded: account_audit = %v", a.newValue != nil)
+}
+
+// subjectRateLimitsOption implements the option interface for the
+// `subject_rate_limits` setting.
+type subjectRateLimitsOption struct {
+	noopOption
+	newValue []*SubjectRateLimit
+}
+
+// Apply the new limits, the rates are tracked from scratch.
+func (r *subjectRateLimitsOption) Apply(server *Server) {
+	server.rateGuards.setLimits(r.newValue)
+	server.Noticef("Reloaded: subject_rate_limits = %d limit(s)", len(r.newValue))
+}
+
+// subscriptionEventsOption implements the option interface for the
+// `subscription_events` setting.
+type subscriptionEventsOption struct {
+	noopOption
+	newValue *SubscriptionEventOpts
+}
+
+// Apply is a no-op because the options are read for each subscription.
+func (s *subscriptionEventsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: subscription_events = %v", s.newValue != nil)
+}
+
+// firehoseSubjectsOption implements the option interface for the
+// `firehose_subjects` setting.
+type firehoseSubjectsOption struct {
+	noopOption
+	newValue []string
+}
+
+// Apply is a no-op, the subjects are checked for new subscriptions.
+func (f *firehoseSubjectsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: firehose_subjects = %v", f.newValue)
+}
+
+// passwordHashingOption implements the option interface for the
+// `password_hashing` setting.
+type passwordHashingOption struct {
+	noopOption
+	newValue *PasswordHashingOpts
+}
+
+// Apply is a no-op because the options are read when a user authenticates.
+func (p *passwordHashingOption) Apply(server *Server) {
+	algo := "disabled"
+	if p.newValue != nil && p.newValue.Rehash {
+		algo = p.newValue.withDefaults().Algorithm
+	}
+	server.Noticef("Reloaded: password_hashing rehash = %s", algo)
+}
+
 // maxPingsOutOption implements the option interface for the `ping_max`
 // setting.
 type maxPingsOutOption struct {
@@ -461,6 +613,204 @@ func (m *maxPingsOutOption) Apply(server *Server) {
 	server.Noticef("Reloaded: ping_max = %d", m.newValue)
 }
 
+// listenRetryOption implements the option interface for the `listen_retry`
+// setting.
+type listenRetryOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op, the new value will be used when a listener is
+// started.
+func (l *listenRetryOption) Apply(server *Server) {
+	server.Noticef("Reloaded: listen_retry = %v", l.newValue)
+}
+
+// accountUsageOption implements the option interface for the
+// `account_usage` setting.
+type accountUsageOption struct {
+	noopOption
+	newValue *AccountUsageOpts
+}
+
+// Apply the setting by starting the account usage routine if needed.
+func (a *accountUsageOption) Apply(server *Server) {
+	if a.newValue != nil {
+		server.startAccountUsage()
+	}
+	server.Noticef("Reloaded: account_usage = %v", a.newValue != nil)
+}
+
+// uniqueConnectionsOption implements the option interface for the
+// `unique_connections` setting.
+type uniqueConnectionsOption struct {
+	noopOption
+	newValue *UniqueConnOpts
+}
+
+// Apply is a no-op, the setting applies to clients that connect afterwards.
+func (u *uniqueConnectionsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: unique_connections = %v", u.newValue != nil)
+}
+
+// trafficStatsOption implements the option interface for the
+// `traffic_stats` setting.
+type trafficStatsOption struct {
+	noopOption
+	newValue *TrafficStatsOpts
+}
+
+// Apply the setting by starting, or stopping, the traffic stats.
+func (t *trafficStatsOption) Apply(server *Server) {
+	server.startTrafficStats()
+	server.Noticef("Reloaded: traffic_stats = %v", t.newValue != nil)
+}
+
+// clockSkewThresholdOption implements the option interface for the
+// `clock_skew_threshold` setting.
+type clockSkewThresholdOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the threshold is checked with each new skew
+// estimate.
+func (c *clockSkewThresholdOption) Apply(server *Server) {
+	server.Noticef("Reloaded: clock_skew_threshold = %v", c.newValue)
+}
+
+// advertiseResolveIntervalOption implements the option interface for the
+// `advertise_resolve_interval` setting.
+type advertiseResolveIntervalOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply the setting by starting the resolution routine if needed, a
+// running one picks up the new interval after its current wait.
+func (a *advertiseResolveIntervalOption) Apply(server *Server) {
+	server.startAdvertiseResolve()
+	server.Noticef("Reloaded: advertise_resolve_interval = %v", a.newValue)
+}
+
+// httpPublishOption implements the option interface for the `http_publish`
+// setting.
+type httpPublishOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the setting is checked on each request.
+func (h *httpPublishOption) Apply(server *Server) {
+	server.Noticef("Reloaded: http_publish = %v", h.newValue)
+}
+
+// cloudEventsOption implements the option interface for the `cloudevents`
+// setting.
+type cloudEventsOption struct {
+	noopOption
+	newValue bool
+}
+
+// Apply is a no-op because the setting is checked on each request.
+func (c *cloudEventsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: cloudevents = %v", c.newValue)
+}
+
+// writePacingOption implements the option interface for the
+// `write_pacing` setting.
+type writePacingOption struct {
+	noopOption
+	newValue *WritePacingOpts
+}
+
+// Apply is a no-op, the setting applies to clients that connect afterwards.
+func (w *writePacingOption) Apply(server *Server) {
+	server.Noticef("Reloaded: write_pacing = %v", w.newValue != nil)
+}
+
+// outboundDialOption implements the option interface for the
+// `outbound_dial` setting.
+type outboundDialOption struct {
+	noopOption
+	newValue OutboundDialOpts
+}
+
+// Apply is a no-op, the new value will be used for the next dials.
+func (o *outboundDialOption) Apply(server *Server) {
+	server.Noticef("Reloaded: outbound_dial = %+v", o.newValue)
+}
+
+// joinTokensOption implements the option interface for the
+// `join_tokens` setting.
+type joinTokensOption struct {
+	authOption
+	newValue *JoinTokenOpts
+}
+
+// Apply is a no-op, tokens are verified with the new value, and routes
+// that joined with a token are checked again by the authorization reload.
+func (j *joinTokensOption) Apply(server *Server) {
+	server.Noticef("Reloaded: join_tokens enabled = %v", j.newValue != nil)
+}
+
+// traceRedactionOption implements the option interface for the
+// `trace_redaction` setting.
+type traceRedactionOption struct {
+	noopOption
+	newValue *TraceRedactionOpts
+}
+
+// Apply is a no-op, the new value is used for the next traced protocol.
+func (t *traceRedactionOption) Apply(server *Server) {
+	server.Noticef("Reloaded: trace_redaction = %+v", t.newValue)
+}
+
+// socketOption implements the option interface for the `socket` setting.
+type socketOption struct {
+	noopOption
+	newValue *SocketOpts
+}
+
+// Apply is a no-op, the new value is used for the next accepted
+// connections.
+func (so *socketOption) Apply(server *Server) {
+	server.Noticef("Reloaded: socket = %+v", so.newValue)
+}
+
+// clientInfoOption implements the option interface for the `client_info`
+// setting.
+type clientInfoOption struct {
+	noopOption
+	newValue ClientInfoOpts
+}
+
+// Apply is a no-op, the new value is used for the next INFO sent to
+// clients.
+func (c *clientInfoOption) Apply(server *Server) {
+	server.Noticef("Reloaded: client_info = %+v", c.newValue)
+}
+
+// compressionOption implements the option interface for the `compression`
+// setting.
+type compressionOption struct {
+	noopOption
+	newValue string
+}
+
+// Apply the compression change, which only applies to new clients.
+func (c *compressionOption) Apply(server *Server) {
+	server.mu.Lock()
+	server.info.Compression = c.newValue
+	if c.newValue != _EMPTY_ {
+		server.info.Features |= FeatureCompression
+	} else {
+		server.info.Features &^= FeatureCompression
+	}
+	server.mu.Unlock()
+	server.Noticef("Reloaded: compression = %q", c.newValue)
+}
+
 // writeDeadlineOption implements the option interface for the `write_deadline`
 // setting.
 type writeDeadlineOption struct {
@@ -474,6 +824,221 @@ func (w *writeDeadlineOption) Apply(server *Server) {
 	server.Noticef("Reloaded: write_deadline = %s", w.newValue)
 }
 
+// maxMemoryOption implements the option interface for the `max_memory`
+// setting.
+type maxMemoryOption struct {
+	noopOption
+	newValue int64
+}
+
+// Apply starts the memory monitor if needed, the new limit will be used
+// on its next check.
+func (m *maxMemoryOption) Apply(server *Server) {
+	if m.newValue > 0 {
+		server.startMemoryMonitor()
+	}
+	server.Noticef("Reloaded: max_memory = %d", m.newValue)
+}
+
+// protoErrorDumpOption implements the option interface for the
+// `proto_error_dump` setting.
+type protoErrorDumpOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply is a no-op, the new size is used on the next protocol error.
+func (p *protoErrorDumpOption) Apply(server *Server) {
+	server.Noticef("Reloaded: proto_error_dump = %d", p.newValue)
+}
+
+// maxScannerResponsesOption implements the option interface for the
+// `max_scanner_responses` setting.
+type maxScannerResponsesOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply is a no-op, the new limit is used on the next scanner probe.
+func (m *maxScannerResponsesOption) Apply(server *Server) {
+	server.Noticef("Reloaded: max_scanner_responses = %d", m.newValue)
+}
+
+// maxConnectionLifetimeOption implements the option interface for the
+// `max_connection_lifetime` setting.
+type maxConnectionLifetimeOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op, the new lifetime applies to the new connections.
+func (m *maxConnectionLifetimeOption) Apply(server *Server) {
+	server.Noticef("Reloaded: max_connection_lifetime = %v", m.newValue)
+}
+
+// jwtExpiryWarningOption implements the option interface for the
+// `jwt_expiry_warning` setting.
+type jwtExpiryWarningOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op, the new warning window applies to the new connections.
+func (j *jwtExpiryWarningOption) Apply(server *Server) {
+	server.Noticef("Reloaded: jwt_expiry_warning = %v", j.newValue)
+}
+
+// certExpiryWarningOption implements the option interface for the
+// `cert_expiry_warning` setting.
+type certExpiryWarningOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op, the new warning window applies to the new connections.
+func (c *certExpiryWarningOption) Apply(server *Server) {
+	server.Noticef("Reloaded: cert_expiry_warning = %v", c.newValue)
+}
+
+// configStrictnessOption implements the option interface for the
+// `config_strictness` setting.
+type configStrictnessOption struct {
+	noopOption
+	newValue string
+}
+
+// Apply is a no-op, the strictness applies to the configuration file
+// processed on reload.
+func (c *configStrictnessOption) Apply(server *Server) {
+	server.Noticef("Reloaded: config_strictness = %s", c.newValue)
+}
+
+// watchdogOption implements the option interface for the `watchdog`
+// setting.
+type watchdogOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply the setting by starting the watchdog if needed.
+func (w *watchdogOption) Apply(server *Server) {
+	if w.newValue > 0 {
+		server.startWatchdog()
+	}
+	server.Noticef("Reloaded: watchdog = %v", w.newValue)
+}
+
+// latencySamplingOption implements the option interface for the
+// `latency_sampling` setting.
+type latencySamplingOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply the new sampling of the stage latencies.
+func (l *latencySamplingOption) Apply(server *Server) {
+	server.setLatencySampling(l.newValue)
+	server.Noticef("Reloaded: latency_sampling = %d", l.newValue)
+}
+
+// accountTemplateOption implements the option interface for the
+// `account_template` setting.
+type accountTemplateOption struct {
+	noopOption
+	newValue *AccountTemplate
+}
+
+// Apply is a no-op, the new template is used for the accounts created
+// from now on.
+func (a *accountTemplateOption) Apply(server *Server) {
+	server.Noticef("Reloaded: account_template enabled = %v", a.newValue != nil)
+}
+
+// watermarksOption implements the option interface for the `watermarks`
+// setting.
+type watermarksOption struct {
+	noopOption
+	newValue *WatermarkOpts
+}
+
+// Apply the setting by starting the watermarks routine if needed.
+func (w *watermarksOption) Apply(server *Server) {
+	if w.newValue != nil {
+		server.startWatermarks()
+	}
+	server.Noticef("Reloaded: watermarks = %+v", w.newValue)
+}
+
+// admissionOption implements the option interface for the `admission`
+// setting.
+type admissionOption struct {
+	noopOption
+	newValue *AdmissionOpts
+}
+
+// Apply the setting by starting the admission control routine if needed,
+// the new thresholds will be used on its next check.
+func (a *admissionOption) Apply(server *Server) {
+	if a.newValue != nil {
+		server.startAdmissionControl()
+	}
+	server.Noticef("Reloaded: admission = %+v", a.newValue)
+}
+
+// authBanOption implements the option interface for the `auth_ban`
+// setting.
+type authBanOption struct {
+	noopOption
+	newValue *AuthBanOpts
+}
+
+// Apply is a no-op, the new setting is used on the next authentication
+// failure. Current bans are kept until they expire.
+func (a *authBanOption) Apply(server *Server) {
+	server.Noticef("Reloaded: auth_ban = %+v", a.newValue)
+}
+
+// suspendOption implements the option interface for the `suspend`
+// setting.
+type suspendOption struct {
+	noopOption
+	newValue *SuspendOpts
+}
+
+// Apply is a no-op because the setting is read when a connection becomes
+// stale. Connections already suspended are closed on their next PING if
+// the suspension is disabled.
+func (s *suspendOption) Apply(server *Server) {
+	server.Noticef("Reloaded: suspend = %+v", s.newValue)
+}
+
+// acceptErrorsOption implements the option interface for the
+// `accept_errors` setting.
+type acceptErrorsOption struct {
+	noopOption
+	newValue *AcceptErrorOpts
+}
+
+// Apply is a no-op because the setting is read by the accept loops on
+// each error.
+func (a *acceptErrorsOption) Apply(server *Server) {
+	server.Noticef("Reloaded: accept_errors = %+v", a.newValue)
+}
+
+// secretsRefreshOption implements the option interface for the
+// `secrets_refresh` setting.
+type secretsRefreshOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply the setting by starting the refresh of secrets if needed. A running
+// refresh picks up the new interval after its current wait.
+func (r *secretsRefreshOption) Apply(server *Server) {
+	server.startSecretsRefresh()
+	server.Noticef("Reloaded: secrets_refresh = %v", r.newValue)
+}
+
 // clientAdvertiseOption implements the option interface for the `client_advertise` setting.
 type clientAdvertiseOption struct {
 	noopOption
@@ -638,6 +1203,8 @@ func (s *Server) reloadOptions(curOpts, newOpts *Options) error {
 	// applications starting NATS Server programmatically).
 	newOpts.CustomClientAuthentication = curOpts.CustomClientAuthentication
 	newOpts.CustomRouterAuthentication = curOpts.CustomRouterAuthentication
+	newOpts.PasswordRehashed = curOpts.PasswordRehashed
+	newOpts.MessageInterceptors = curOpts.MessageInterceptors
 
 	changed, err := s.diffOptions(newOpts)
 	if err != nil {
@@ -717,18 +1284,106 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			diffOpts = append(diffOpts, &routesOption{add: add, remove: remove})
 		case "maxconn":
 			diffOpts = append(diffOpts, &maxConnOption{newValue: newValue.(int)})
+		case "maxpendingauth":
+			diffOpts = append(diffOpts, &maxPendingAuthOption{newValue: newValue.(int)})
 		case "pidfile":
 			diffOpts = append(diffOpts, &pidFileOption{newValue: newValue.(string)})
 		case "portsfiledir":
 			diffOpts = append(diffOpts, &portsFileDirOption{newValue: newValue.(string), oldValue: oldValue.(string)})
+		case "containerlimits":
+			diffOpts = append(diffOpts, &containerLimitsOption{newValue: newValue.(bool)})
+		case "startupreport":
+			diffOpts = append(diffOpts, &startupReportOption{newValue: newValue.(string)})
+		case "statesnapshotdir":
+			diffOpts = append(diffOpts, &stateSnapshotDirOption{newValue: newValue.(string)})
 		case "maxcontrolline":
 			diffOpts = append(diffOpts, &maxControlLineOption{newValue: newValue.(int32)})
 		case "maxpayload":
 			diffOpts = append(diffOpts, &maxPayloadOption{newValue: newValue.(int32)})
+		case "socket":
+			diffOpts = append(diffOpts, &socketOption{newValue: newValue.(*SocketOpts)})
+		case "traceredaction":
+			diffOpts = append(diffOpts, &traceRedactionOption{newValue: newValue.(*TraceRedactionOpts)})
+		case "accountaudit":
+			diffOpts = append(diffOpts, &accountAuditOption{newValue: newValue.(*AccountAuditOpts)})
+		case "subscriptionevents":
+			diffOpts = append(diffOpts, &subscriptionEventsOption{newValue: newValue.(*SubscriptionEventOpts)})
+		case "firehosesubjects":
+			diffOpts = append(diffOpts, &firehoseSubjectsOption{newValue: newValue.([]string)})
+		case "subjectratelimits":
+			diffOpts = append(diffOpts, &subjectRateLimitsOption{newValue: newValue.([]*SubjectRateLimit)})
+		case "passwordhashing":
+			diffOpts = append(diffOpts, &passwordHashingOption{newValue: newValue.(*PasswordHashingOpts)})
 		case "pinginterval":
 			diffOpts = append(diffOpts, &pingIntervalOption{newValue: newValue.(time.Duration)})
 		case "maxpingsout":
 			diffOpts = append(diffOpts, &maxPingsOutOption{newValue: newValue.(int)})
+		case "maxsubjectlength":
+			diffOpts = append(diffOpts, &subjectLimitsOption{name: "max_subject_len", newValue: newValue.(int32)})
+		case "maxsubjecttokens":
+			diffOpts = append(diffOpts, &subjectLimitsOption{name: "max_subject_tokens", newValue: newValue.(int32)})
+		case "maxreplylength":
+			diffOpts = append(diffOpts, &subjectLimitsOption{name: "max_reply_len", newValue: newValue.(int32)})
+		case "strictprotocol":
+			diffOpts = append(diffOpts, &strictProtocolOption{newValue: newValue.(bool)})
+		case "maxmemory":
+			diffOpts = append(diffOpts, &maxMemoryOption{newValue: newValue.(int64)})
+		case "secretsrefresh":
+			diffOpts = append(diffOpts, &secretsRefreshOption{newValue: newValue.(time.Duration)})
+		case "protoerrordump":
+			diffOpts = append(diffOpts, &protoErrorDumpOption{newValue: newValue.(int)})
+		case "maxconnectionlifetime":
+			diffOpts = append(diffOpts, &maxConnectionLifetimeOption{newValue: newValue.(time.Duration)})
+		case "jwtexpirywarning":
+			diffOpts = append(diffOpts, &jwtExpiryWarningOption{newValue: newValue.(time.Duration)})
+		case "configstrictness":
+			diffOpts = append(diffOpts, &configStrictnessOption{newValue: newValue.(string)})
+		case "certexpirywarning":
+			diffOpts = append(diffOpts, &certExpiryWarningOption{newValue: newValue.(time.Duration)})
+		case "maxscannerresponses":
+			diffOpts = append(diffOpts, &maxScannerResponsesOption{newValue: newValue.(int)})
+		case "watchdog":
+			diffOpts = append(diffOpts, &watchdogOption{newValue: newValue.(time.Duration)})
+		case "latencysampling":
+			diffOpts = append(diffOpts, &latencySamplingOption{newValue: newValue.(int)})
+		case "watermarks":
+			diffOpts = append(diffOpts, &watermarksOption{newValue: newValue.(*WatermarkOpts)})
+		case "admission":
+			diffOpts = append(diffOpts, &admissionOption{newValue: newValue.(*AdmissionOpts)})
+		case "authban":
+			diffOpts = append(diffOpts, &authBanOption{newValue: newValue.(*AuthBanOpts)})
+		case "accepterrors":
+			diffOpts = append(diffOpts, &acceptErrorsOption{newValue: newValue.(*AcceptErrorOpts)})
+		case "suspend":
+			diffOpts = append(diffOpts, &suspendOption{newValue: newValue.(*SuspendOpts)})
+		case "listenretry":
+			diffOpts = append(diffOpts, &listenRetryOption{newValue: newValue.(time.Duration)})
+		case "accountusage":
+			diffOpts = append(diffOpts, &accountUsageOption{newValue: newValue.(*AccountUsageOpts)})
+		case "uniqueconnections":
+			diffOpts = append(diffOpts, &uniqueConnectionsOption{newValue: newValue.(*UniqueConnOpts)})
+		case "policy":
+			diffOpts = append(diffOpts, &policyOption{newValue: newValue.(*PolicyOpts)})
+		case "httppublish":
+			diffOpts = append(diffOpts, &httpPublishOption{newValue: newValue.(bool)})
+		case "cloudevents":
+			diffOpts = append(diffOpts, &cloudEventsOption{newValue: newValue.(bool)})
+		case "writepacing":
+			diffOpts = append(diffOpts, &writePacingOption{newValue: newValue.(*WritePacingOpts)})
+		case "advertiseresolveinterval":
+			diffOpts = append(diffOpts, &advertiseResolveIntervalOption{newValue: newValue.(time.Duration)})
+		case "clockskewthreshold":
+			diffOpts = append(diffOpts, &clockSkewThresholdOption{newValue: newValue.(time.Duration)})
+		case "trafficstats":
+			diffOpts = append(diffOpts, &trafficStatsOption{newValue: newValue.(*TrafficStatsOpts)})
+		case "outbounddial":
+			diffOpts = append(diffOpts, &outboundDialOption{newValue: newValue.(OutboundDialOpts)})
+		case "jointokens":
+			diffOpts = append(diffOpts, &joinTokensOption{newValue: newValue.(*JoinTokenOpts)})
+		case "clientinfo":
+			diffOpts = append(diffOpts, &clientInfoOption{newValue: newValue.(ClientInfoOpts)})
+		case "compression":
+			diffOpts = append(diffOpts, &compressionOption{newValue: newValue.(string)})
 		case "writedeadline":
 			diffOpts = append(diffOpts, &writeDeadlineOption{newValue: newValue.(time.Duration)})
 		case "clientadvertise":
@@ -749,7 +1404,9 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 				return nil, fmt.Errorf("config reload does not support moving to or from an account resolver")
 			}
 			diffOpts = append(diffOpts, &accountsOption{})
-		case "accountresolvertlsconfig":
+		case "accounttemplate":
+			diffOpts = append(diffOpts, &accountTemplateOption{newValue: newValue.(*AccountTemplate)})
+		case "accountresolvertlsconfig", "resolvercache":
 			diffOpts = append(diffOpts, &accountsOption{})
 		case "gateway":
 			// Not supported for now, but report warning if configuration of gateway
@@ -779,6 +1436,19 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
 					field.Name, oldValue, newValue)
 			}
+		case "grpc":
+			// Same for the gRPC gateway.
+			tmpOld, _ := oldValue.(*GRPCOpts)
+			tmpNew, _ := newValue.(*GRPCOpts)
+			if tmpOld != nil && tmpNew != nil {
+				o, n := *tmpOld, *tmpNew
+				o.TLSConfig, n.TLSConfig = nil, nil
+				tmpOld, tmpNew = &o, &n
+			}
+			if !reflect.DeepEqual(tmpOld, tmpNew) {
+				return nil, fmt.Errorf("config reload not supported for %s: old=%v, new=%v",
+					field.Name, oldValue, newValue)
+			}
 		case "connecterrorreports":
 			diffOpts = append(diffOpts, &connectErrorReports{newValue: newValue.(int)})
 		case "reconnecterrorreports":
@@ -890,6 +1560,17 @@ func (s *Server) reloadAuthorization() {
 				newAcc.sl = acc.sl
 				newAcc.rm = acc.rm
 				newAcc.respMap = acc.respMap
+				if newAcc.retained != nil && acc.retained != nil {
+					newAcc.retained.transfer(acc.retained)
+				}
+				if newAcc.replay != nil && acc.replay != nil {
+					newAcc.replay.transfer(acc.replay)
+				}
+				newAcc.usage.transfer(&acc.usage)
+				if acc.IsFrozen() {
+					newAcc.freeze.reason = acc.freeze.reason
+					atomic.StoreInt32(&newAcc.freeze.frozen, 1)
+				}
 				acc.mu.RUnlock()
 
 				// Check if current and new config of this account are same
@@ -938,17 +1619,21 @@ func (s *Server) reloadAuthorization() {
 	}
 
 	// Gather clients that changed accounts. We will close them and they
-	// will reconnect, doing the right thing.
+	// will reconnect, doing the right thing. Clients whose user no longer
+	// exists are asked not to reconnect.
 	var (
 		cclientsa [64]*client
 		cclients  = cclientsa[:0]
+		rclients  []*client
 		clientsa  [64]*client
 		clients   = clientsa[:0]
 		routesa   [64]*client
 		routes    = routesa[:0]
 	)
 	for _, client := range s.clients {
-		if s.clientHasMovedToDifferentAccount(client) {
+		if moved, removed := s.clientHasMovedToDifferentAccount(client); removed {
+			rclients = append(rclients, client)
+		} else if moved {
 			cclients = append(cclients, client)
 		} else {
 			clients = append(clients, client)
@@ -961,13 +1646,16 @@ func (s *Server) reloadAuthorization() {
 
 	// Close clients that have moved accounts
 	for _, client := range cclients {
-		client.closeConnection(ClientClosed)
+		client.closeWithReason(ClientClosed, CloseReasonAccountChanged)
+	}
+	for _, client := range rclients {
+		client.closeWithReason(ClientClosed, CloseReasonAuthRevoked)
 	}
 
 	for _, client := range clients {
 		// Disconnect any unauthorized clients.
 		if !s.isClientAuthorized(client) {
-			client.authViolation()
+			client.authViolationWithReason(CloseReasonAuthRevoked)
 			continue
 		}
 		// Remove any unauthorized subscriptions and check for account imports.
@@ -988,9 +1676,9 @@ func (s *Server) reloadAuthorization() {
 
 // Returns true if given client current account has changed (or user
 // no longer exist) in the new config, false if the user did not
-// change account.
+// change account. Removed is true if the user no longer exists.
 // Server lock is held on entry.
-func (s *Server) clientHasMovedToDifferentAccount(c *client) bool {
+func (s *Server) clientHasMovedToDifferentAccount(c *client) (moved, removed bool) {
 	var (
 		nu *NkeyUser
 		u  *User
@@ -1004,7 +1692,7 @@ func (s *Server) clientHasMovedToDifferentAccount(c *client) bool {
 			u = s.users[c.opts.Username]
 		}
 	} else {
-		return false
+		return false, false
 	}
 	// Get the current account name
 	c.mu.Lock()
@@ -1014,12 +1702,12 @@ func (s *Server) clientHasMovedToDifferentAccount(c *client) bool {
 	}
 	c.mu.Unlock()
 	if nu != nil && nu.Account != nil {
-		return curAccName != nu.Account.Name
+		return curAccName != nu.Account.Name, false
 	} else if u != nil && u.Account != nil {
-		return curAccName != u.Account.Name
+		return curAccName != u.Account.Name, false
 	}
 	// user/nkey no longer exists.
-	return true
+	return true, nu == nil && u == nil
 }
 
 // reloadClusterPermissions reconfigures the cluster's permssions
@@ -1149,6 +1837,26 @@ func validateClusterOpts(old, new ClusterOpts) error {
 		return fmt.Errorf("config reload not supported for cluster port: old=%d, new=%d",
 			old.Port, new.Port)
 	}
+	if old.InterestBatchWindow != new.InterestBatchWindow {
+		return fmt.Errorf("config reload not supported for cluster interest batch window: old=%v, new=%v",
+			old.InterestBatchWindow, new.InterestBatchWindow)
+	}
+	if old.MaxControlLine != new.MaxControlLine {
+		return fmt.Errorf("config reload not supported for cluster max control line: old=%v, new=%v",
+			old.MaxControlLine, new.MaxControlLine)
+	}
+	if old.WriteCork != new.WriteCork {
+		return fmt.Errorf("config reload not supported for cluster write cork: old=%v, new=%v",
+			old.WriteCork, new.WriteCork)
+	}
+	if old.ConnectURLsDamping != new.ConnectURLsDamping {
+		return fmt.Errorf("config reload not supported for cluster connect urls damping: old=%v, new=%v",
+			old.ConnectURLsDamping, new.ConnectURLsDamping)
+	}
+	if old.loadReportInterval() != new.loadReportInterval() {
+		return fmt.Errorf("config reload not supported for cluster load report interval: old=%v, new=%v",
+			old.loadReportInterval(), new.loadReportInterval())
+	}
 	// Validate Cluster.Advertise syntax
 	if new.Advertise != "" {
 		if _, _, err := parseHostPort(new.Advertise, 0); err != nil {
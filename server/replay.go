@@ -0,0 +1,254 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_REPLAY_MAX_MSGS is the default maximum number of messages kept
+// for each subject of a replay buffer.
+const DEFAULT_REPLAY_MAX_MSGS = 100
+
+// replayBuffers keeps the recent messages published on each subject
+// matching one of the replay subjects of an account, in memory only.
+// Messages are bounded per subject by count and, optionally, by age.
+type replayBuffers struct {
+	sync.Mutex
+	subjects []string
+	maxMsgs  int
+	maxAge   time.Duration
+	seq      uint64
+	swept    int64
+	rings    map[string]*replayRing
+}
+
+// replayRing is a fixed size ring of messages for a single subject.
+type replayRing struct {
+	msgs  []*replayMsg
+	start int
+	n     int
+}
+
+type replayMsg struct {
+	seq uint64
+	ts  int64
+	rm  *retainedMsg
+}
+
+func newReplayBuffers(subjects []string, maxMsgs int, maxAge time.Duration) *replayBuffers {
+	if maxMsgs <= 0 {
+		maxMsgs = DEFAULT_REPLAY_MAX_MSGS
+	}
+	return &replayBuffers{
+		subjects: subjects,
+		maxMsgs:  maxMsgs,
+		maxAge:   maxAge,
+		rings:    make(map[string]*replayRing),
+	}
+}
+
+func (b *replayBuffers) replays(subject string) bool {
+	for _, filter := range b.subjects {
+		if subjectIsSubsetMatch(subject, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *replayRing) add(m *replayMsg) {
+	if r.n < len(r.msgs) {
+		r.msgs[(r.start+r.n)%len(r.msgs)] = m
+		r.n++
+		return
+	}
+	// Full, overwrite the oldest message.
+	r.msgs[r.start] = m
+	r.start = (r.start + 1) % len(r.msgs)
+}
+
+func (r *replayRing) newest() *replayMsg {
+	if r.n == 0 {
+		return nil
+	}
+	return r.msgs[(r.start+r.n-1)%len(r.msgs)]
+}
+
+// store records the message if its subject matches a replay subject.
+func (b *replayBuffers) store(subject string, reply, msg []byte) {
+	if !b.replays(subject) {
+		return
+	}
+	now := time.Now().UnixNano()
+	rm := &retainedMsg{subject: subject, msg: append([]byte(nil), msg...)}
+	if len(reply) > 0 {
+		rm.reply = append([]byte(nil), reply...)
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	// Drop the rings of subjects that have not been used for longer
+	// than the maximum age, since all their messages are expired.
+	if b.maxAge > 0 && now-b.swept > int64(b.maxAge) {
+		for s, r := range b.rings {
+			if m := r.newest(); m == nil || now-m.ts > int64(b.maxAge) {
+				delete(b.rings, s)
+			}
+		}
+		b.swept = now
+	}
+
+	r := b.rings[subject]
+	if r == nil {
+		r = &replayRing{msgs: make([]*replayMsg, b.maxMsgs)}
+		b.rings[subject] = r
+	}
+	b.seq++
+	r.add(&replayMsg{seq: b.seq, ts: now, rm: rm})
+}
+
+// match returns the messages, still within the maximum age, whose subject
+// matches filter, in the order they were stored.
+func (b *replayBuffers) match(filter string) []*retainedMsg {
+	var oldest int64
+	if b.maxAge > 0 {
+		oldest = time.Now().UnixNano() - int64(b.maxAge)
+	}
+
+	b.Lock()
+	var msgs []*replayMsg
+	for subject, r := range b.rings {
+		if !subjectIsSubsetMatch(subject, filter) {
+			continue
+		}
+		for i := 0; i < r.n; i++ {
+			if m := r.msgs[(r.start+i)%len(r.msgs)]; m.ts >= oldest {
+				msgs = append(msgs, m)
+			}
+		}
+	}
+	b.Unlock()
+
+	if len(msgs) == 0 {
+		return nil
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].seq < msgs[j].seq })
+	rms := make([]*retainedMsg, len(msgs))
+	for i, m := range msgs {
+		rms[i] = m.rm
+	}
+	return rms
+}
+
+// transfer copies the messages of other buffers that are still replayed.
+func (b *replayBuffers) transfer(old *replayBuffers) {
+	old.Lock()
+	defer old.Unlock()
+	var msgs []*replayMsg
+	for subject, r := range old.rings {
+		if !b.replays(subject) {
+			continue
+		}
+		for i := 0; i < r.n; i++ {
+			msgs = append(msgs, r.msgs[(r.start+i)%len(r.msgs)])
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].seq < msgs[j].seq })
+	for _, m := range msgs {
+		r := b.rings[m.rm.subject]
+		if r == nil {
+			r = &replayRing{msgs: make([]*replayMsg, b.maxMsgs)}
+			b.rings[m.rm.subject] = r
+		}
+		b.seq++
+		r.add(&replayMsg{seq: b.seq, ts: m.ts, rm: m.rm})
+	}
+}
+
+// SetReplaySubjects enables the replay buffers of this account for the
+// given subjects: the last maxMsgs messages published on each subject
+// matching one of them, and no older than maxAge if not 0, are delivered
+// to new subscriptions of clients that asked for replay when connecting.
+// An empty list of subjects disables the buffers.
+func (a *Account) SetReplaySubjects(subjects []string, maxMsgs int, maxAge time.Duration) error {
+	for _, subject := range subjects {
+		if !IsValidSubject(subject) {
+			return fmt.Errorf("invalid replay subject %q", subject)
+		}
+	}
+	if maxAge < 0 {
+		return fmt.Errorf("replay max age can't be negative")
+	}
+	var b *replayBuffers
+	if len(subjects) > 0 {
+		b = newReplayBuffers(copyStrings(subjects), maxMsgs, maxAge)
+	}
+	a.mu.Lock()
+	if a.replay != nil && b != nil {
+		b.transfer(a.replay)
+	}
+	a.setReplay(b)
+	a.mu.Unlock()
+	return nil
+}
+
+// Account lock is held on entry if the account is registered.
+func (a *Account) setReplay(b *replayBuffers) {
+	a.replay = b
+	if b != nil {
+		atomic.StoreInt32(&a.replaying, 1)
+	} else {
+		atomic.StoreInt32(&a.replaying, 0)
+	}
+}
+
+// recordReplay stores the message in the replay buffers, if enabled.
+func (a *Account) recordReplay(subject []byte, reply, msg []byte) {
+	if atomic.LoadInt32(&a.replaying) == 0 {
+		return
+	}
+	a.mu.RLock()
+	b := a.replay
+	a.mu.RUnlock()
+	if b != nil {
+		b.store(string(subject), reply, msg)
+	}
+}
+
+// replayMsgs returns the recent messages matching the subject of a
+// subscription.
+func (a *Account) replayMsgs(filter string) []*retainedMsg {
+	if atomic.LoadInt32(&a.replaying) == 0 {
+		return nil
+	}
+	a.mu.RLock()
+	b := a.replay
+	a.mu.RUnlock()
+	if b == nil {
+		return nil
+	}
+	return b.match(filter)
+}
+
+// deliverReplay sends the recent messages matching a new subscription to
+// this client.
+func (c *client) deliverReplay(acc *Account, sub *subscription) {
+	c.deliverStoredMsgs(sub, acc.replayMsgs(string(sub.subject)))
+}
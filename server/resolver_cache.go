@@ -0,0 +1,194 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/jwt"
+	"github.com/nats-io/nkeys"
+)
+
+// DEFAULT_RESOLVER_CACHE_TTL is how long account JWTs are served from the
+// resolver cache when the resolver can not be reached.
+const DEFAULT_RESOLVER_CACHE_TTL = 24 * time.Hour
+
+// errResolverCacheExpired is returned for a cached account JWT older than
+// the TTL of the cache.
+var errResolverCacheExpired = errors.New("cached account JWT expired")
+
+// ResolverCacheOpts configures a cache, on disk, of the account JWTs
+// fetched by a URL resolver. Account JWTs carry the authorization of the
+// users of an account, so that an edge server, for instance connected as
+// a leafnode to the hub serving its resolver, keeps accepting the users it
+// knows while the hub can not be reached.
+type ResolverCacheOpts struct {
+	// Dir the account JWTs are stored in.
+	Dir string `json:"dir"`
+	// TTL of the cached account JWTs, DEFAULT_RESOLVER_CACHE_TTL if 0.
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+func (o *ResolverCacheOpts) validate(opts *Options) error {
+	if o == nil {
+		return nil
+	}
+	if o.Dir == _EMPTY_ {
+		return fmt.Errorf("resolver_cache requires a dir")
+	}
+	if o.TTL < 0 {
+		return fmt.Errorf("resolver_cache ttl can't be negative")
+	}
+	if _, ok := opts.AccountResolver.(*URLAccResolver); !ok {
+		return fmt.Errorf("resolver_cache requires a URL resolver")
+	}
+	return nil
+}
+
+// cachingAccResolver stores the account JWTs fetched by its resolver, and
+// serves them when the resolver fails, for at most the TTL. Since they are
+// signed by the operator, cached JWTs are verified as fetched ones are.
+type cachingAccResolver struct {
+	AccountResolver
+	dir string
+	ttl time.Duration
+
+	mu sync.Mutex
+	// Accounts served from the cache, reconciled with the resolver once
+	// it can be reached again.
+	stale map[string]struct{}
+}
+
+func newCachingAccResolver(ar AccountResolver, o *ResolverCacheOpts) (*cachingAccResolver, error) {
+	if err := os.MkdirAll(o.Dir, 0750); err != nil {
+		return nil, fmt.Errorf("could not create resolver cache dir: %v", err)
+	}
+	ttl := o.TTL
+	if ttl == 0 {
+		ttl = DEFAULT_RESOLVER_CACHE_TTL
+	}
+	return &cachingAccResolver{AccountResolver: ar, dir: o.Dir, ttl: ttl, stale: make(map[string]struct{})}, nil
+}
+
+// Fetch fetches the account JWT from the resolver and caches it, or
+// returns the cached one if the resolver fails. An account the resolver
+// does not know anymore is removed from the cache.
+func (cr *cachingAccResolver) Fetch(name string) (string, error) {
+	theJWT, err := cr.AccountResolver.Fetch(name)
+	// Names are only used as file names if they are account public keys.
+	if !nkeys.IsValidPublicAccountKey(name) {
+		return theJWT, err
+	}
+	path := filepath.Join(cr.dir, name+".jwt")
+	switch err {
+	case nil:
+		cr.store(path, theJWT)
+		return theJWT, nil
+	case ErrMissingAccount:
+		os.Remove(path)
+		return _EMPTY_, err
+	}
+	cached, cerr := cr.load(path, name)
+	if cerr != nil {
+		return _EMPTY_, err
+	}
+	cr.mu.Lock()
+	cr.stale[name] = struct{}{}
+	cr.mu.Unlock()
+	return cached, nil
+}
+
+func (cr *cachingAccResolver) store(path, theJWT string) {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(theJWT), 0640); err != nil {
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+	}
+}
+
+// load returns the cached account JWT if not expired and still issued
+// for that account.
+func (cr *cachingAccResolver) load(path, name string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	if time.Since(fi.ModTime()) > cr.ttl {
+		os.Remove(path)
+		return _EMPTY_, errResolverCacheExpired
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	ac, err := jwt.DecodeAccountClaims(string(b))
+	if err != nil {
+		return _EMPTY_, err
+	}
+	if ac.Subject != name {
+		return _EMPTY_, fmt.Errorf("cached account JWT is for %q", ac.Subject)
+	}
+	return string(b), nil
+}
+
+// takeStale returns, sorted, the accounts served from the cache since the
+// last call.
+func (cr *cachingAccResolver) takeStale() []string {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	names := make([]string, 0, len(cr.stale))
+	for name := range cr.stale {
+		names = append(names, name)
+	}
+	cr.stale = make(map[string]struct{})
+	sort.Strings(names)
+	return names
+}
+
+// reconcileResolverCache updates the accounts served from the resolver
+// cache with the claims of the resolver, so that users revoked while it
+// could not be reached are disconnected. Called when a leafnode connection
+// to the hub is established, which is when the resolver is expected to be
+// reachable again.
+func (s *Server) reconcileResolverCache() {
+	cr, ok := s.AccountResolver().(*cachingAccResolver)
+	if !ok {
+		return
+	}
+	for _, name := range cr.takeStale() {
+		v, ok := s.accounts.Load(name)
+		if !ok {
+			continue
+		}
+		claimJWT, err := s.fetchRawAccountClaims(name)
+		if err != nil {
+			continue
+		}
+		err = s.updateAccountWithClaimJWT(v.(*Account), claimJWT)
+		if err != nil && err != ErrAccountResolverSameClaims {
+			s.Warnf("Error reconciling cached account %q: %v", name, err)
+		} else {
+			s.Debugf("Reconciled cached account %q", name)
+		}
+	}
+}
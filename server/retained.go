@@ -0,0 +1,227 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// DEFAULT_RETAINED_MAX_MSGS is the default maximum number of messages
+// retained by an account.
+const DEFAULT_RETAINED_MAX_MSGS = 10000
+
+// retainedMsgs is the last value cache of an account: the last message
+// published on each subject matching one of the retained subjects.
+type retainedMsgs struct {
+	sync.Mutex
+	subjects []string
+	max      int
+	msgs     map[string]*retainedMsg
+}
+
+type retainedMsg struct {
+	subject string
+	reply   []byte
+	// Payload, including the trailing CR_LF.
+	msg []byte
+}
+
+func newRetainedMsgs(subjects []string, max int) *retainedMsgs {
+	if max <= 0 {
+		max = DEFAULT_RETAINED_MAX_MSGS
+	}
+	return &retainedMsgs{subjects: subjects, max: max, msgs: make(map[string]*retainedMsg)}
+}
+
+func (r *retainedMsgs) retains(subject string) bool {
+	for _, filter := range r.subjects {
+		if subjectIsSubsetMatch(subject, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// store retains the message if its subject matches a retained subject.
+// An empty message clears the retained message of the subject. When the
+// cache is full, a random message is evicted.
+func (r *retainedMsgs) store(subject string, reply, msg []byte) {
+	if !r.retains(subject) {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if len(msg) <= LEN_CR_LF {
+		delete(r.msgs, subject)
+		return
+	}
+	if _, ok := r.msgs[subject]; !ok && len(r.msgs) >= r.max {
+		for s := range r.msgs {
+			delete(r.msgs, s)
+			break
+		}
+	}
+	rm := &retainedMsg{subject: subject, msg: append([]byte(nil), msg...)}
+	if len(reply) > 0 {
+		rm.reply = append([]byte(nil), reply...)
+	}
+	r.msgs[subject] = rm
+}
+
+// match returns the retained messages whose subject matches filter.
+func (r *retainedMsgs) match(filter string) []*retainedMsg {
+	r.Lock()
+	defer r.Unlock()
+	var msgs []*retainedMsg
+	for subject, rm := range r.msgs {
+		if subjectIsSubsetMatch(subject, filter) {
+			msgs = append(msgs, rm)
+		}
+	}
+	return msgs
+}
+
+// SetRetainedSubjects enables the last value cache of this account for the
+// given subjects: the last message published on each subject matching one
+// of them is delivered to new subscriptions. At most maxMsgs messages are
+// retained, DEFAULT_RETAINED_MAX_MSGS if 0. An empty list of subjects
+// disables the cache.
+func (a *Account) SetRetainedSubjects(subjects []string, maxMsgs int) error {
+	for _, subject := range subjects {
+		if !IsValidSubject(subject) {
+			return fmt.Errorf("invalid retained subject %q", subject)
+		}
+	}
+	var r *retainedMsgs
+	if len(subjects) > 0 {
+		r = newRetainedMsgs(copyStrings(subjects), maxMsgs)
+	}
+	a.mu.Lock()
+	if a.retained != nil && r != nil {
+		r.transfer(a.retained)
+	}
+	a.setRetained(r)
+	a.mu.Unlock()
+	return nil
+}
+
+// Account lock is held on entry if the account is registered.
+func (a *Account) setRetained(r *retainedMsgs) {
+	a.retained = r
+	if r != nil {
+		atomic.StoreInt32(&a.retaining, 1)
+	} else {
+		atomic.StoreInt32(&a.retaining, 0)
+	}
+}
+
+// transfer copies the messages of another cache that are still retained.
+func (r *retainedMsgs) transfer(old *retainedMsgs) {
+	old.Lock()
+	defer old.Unlock()
+	for subject, rm := range old.msgs {
+		if len(r.msgs) >= r.max {
+			break
+		}
+		if r.retains(subject) {
+			r.msgs[subject] = rm
+		}
+	}
+}
+
+// storeMsg keeps the message in the last value cache and the replay
+// buffers of the account, if enabled.
+func (a *Account) storeMsg(subject []byte, reply, msg []byte) {
+	a.retainMsg(subject, reply, msg)
+	a.recordReplay(subject, reply, msg)
+}
+
+// retainMsg stores the message in the last value cache, if enabled.
+func (a *Account) retainMsg(subject []byte, reply, msg []byte) {
+	if atomic.LoadInt32(&a.retaining) == 0 {
+		return
+	}
+	a.mu.RLock()
+	r := a.retained
+	a.mu.RUnlock()
+	if r != nil {
+		r.store(string(subject), reply, msg)
+	}
+}
+
+// retainedMsgs returns the retained messages matching the subject of a
+// subscription.
+func (a *Account) retainedMsgs(filter string) []*retainedMsg {
+	if atomic.LoadInt32(&a.retaining) == 0 {
+		return nil
+	}
+	a.mu.RLock()
+	r := a.retained
+	a.mu.RUnlock()
+	if r == nil {
+		return nil
+	}
+	return r.match(filter)
+}
+
+// deliverRetained sends the retained messages matching a new subscription
+// to this client.
+func (c *client) deliverRetained(acc *Account, sub *subscription) {
+	c.deliverStoredMsgs(sub, acc.retainedMsgs(string(sub.subject)))
+}
+
+// deliverStoredMsgs sends messages kept by the server, in order, to a
+// subscription of this client.
+func (c *client) deliverStoredMsgs(sub *subscription, msgs []*retainedMsg) {
+	if len(msgs) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rm := range msgs {
+		if sub.closed == 1 || c.isClosed() {
+			return
+		}
+		if c.mperms != nil && c.checkDenySub(rm.subject) {
+			continue
+		}
+		size := len(rm.msg) - LEN_CR_LF
+		mh := make([]byte, 0, msgHeadProtoLen+len(rm.subject)+len(sub.sid)+len(rm.reply)+16)
+		mh = append(mh, msgHeadProto[1:]...)
+		mh = append(mh, rm.subject...)
+		mh = append(mh, ' ')
+		mh = append(mh, sub.sid...)
+		mh = append(mh, ' ')
+		if len(rm.reply) > 0 {
+			mh = append(mh, rm.reply...)
+			mh = append(mh, ' ')
+		}
+		mh = strconv.AppendInt(mh, int64(size), 10)
+		mh = append(mh, _CRLF_...)
+		c.outMsgs++
+		c.outBytes += int64(size)
+		atomic.AddInt64(&c.srv.outMsgs, 1)
+		atomic.AddInt64(&c.srv.outBytes, int64(size))
+		if c.acc != nil {
+			c.acc.usage.addOut(c.kind, 1, int64(size))
+		}
+		if c.trace {
+			c.traceOutOp(string(mh[:len(mh)-LEN_CR_LF]), nil)
+		}
+		c.enqueueProto(append(mh, rm.msg...))
+	}
+}
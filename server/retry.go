@@ -0,0 +1,163 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DEFAULT_RETRY_MAX is the default maximum delay between the attempts to
+// connect to a remote when a retry policy is set.
+const DEFAULT_RETRY_MAX = 30 * time.Second
+
+// RetryPolicy replaces the fixed delay between the attempts to connect to
+// routes, gateways or leafnode remotes with an exponential backoff.
+type RetryPolicy struct {
+	// Initial is the delay after the first failed attempt, the fixed
+	// delay of the connection kind if not set. It doubles after each
+	// failed attempt.
+	Initial time.Duration `json:"initial,omitempty"`
+	// Max caps the delay, DEFAULT_RETRY_MAX if not set.
+	Max time.Duration `json:"max,omitempty"`
+	// Jitter randomizes each delay by up to this fraction of it, so that
+	// servers restarted together do not retry in lockstep.
+	Jitter float64 `json:"jitter,omitempty"`
+	// MaxAttempts, if positive, is the number of failed attempts after
+	// which the server stops trying to connect.
+	MaxAttempts int `json:"max_attempts,omitempty"`
+}
+
+func (p *RetryPolicy) validate() error {
+	if p == nil {
+		return nil
+	}
+	if p.Initial < 0 || p.Max < 0 {
+		return fmt.Errorf("retry delays can't be negative")
+	}
+	if p.Initial > 0 && p.Max > 0 && p.Max < p.Initial {
+		return fmt.Errorf("retry max delay %v can't be less than the initial delay %v", p.Max, p.Initial)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("retry jitter %v must be between 0 and 1", p.Jitter)
+	}
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("retry max attempts can't be negative")
+	}
+	return nil
+}
+
+// delay returns the delay before the next attempt, after the given number
+// of failed ones, def being the fixed delay used without a policy.
+func (p *RetryPolicy) delay(def time.Duration, attempts int) time.Duration {
+	if p == nil {
+		return def
+	}
+	d := p.Initial
+	if d <= 0 {
+		d = def
+	}
+	max := p.Max
+	if max <= 0 {
+		max = DEFAULT_RETRY_MAX
+	}
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((2*rand.Float64() - 1) * p.Jitter * float64(d))
+	}
+	return d
+}
+
+// exhausted returns whether the server should stop trying to connect
+// after the given number of failed attempts.
+func (p *RetryPolicy) exhausted(attempts int) bool {
+	return p != nil && p.MaxAttempts > 0 && attempts >= p.MaxAttempts
+}
+
+// ConnectRetry is the state of the attempts to connect to a route, gateway
+// or leafnode remote that the server is not connected to.
+type ConnectRetry struct {
+	Kind        string        `json:"kind"`
+	Remote      string        `json:"remote"`
+	Attempts    int           `json:"attempts"`
+	LastError   string        `json:"last_error,omitempty"`
+	Delay       time.Duration `json:"delay"`
+	NextAttempt time.Time     `json:"next_attempt"`
+}
+
+// connectRetries tracks the remotes being retried, keyed by kind and
+// remote.
+type connectRetries struct {
+	sync.Mutex
+	m map[string]*ConnectRetry
+}
+
+// connectRetry records a failed attempt to connect to a remote, retried
+// after the delay.
+func (s *Server) connectRetry(kind, remote string, attempts int, err error, delay time.Duration) {
+	cr := &ConnectRetry{
+		Kind:        kind,
+		Remote:      remote,
+		Attempts:    attempts,
+		Delay:       delay,
+		NextAttempt: time.Now().Add(delay),
+	}
+	if err != nil {
+		cr.LastError = err.Error()
+	}
+	s.retries.Lock()
+	if s.retries.m == nil {
+		s.retries.m = make(map[string]*ConnectRetry)
+	}
+	s.retries.m[kind+" "+remote] = cr
+	s.retries.Unlock()
+}
+
+// connectRetryDone forgets about a remote that is connected to, or given
+// up on.
+func (s *Server) connectRetryDone(kind, remote string) {
+	s.retries.Lock()
+	delete(s.retries.m, kind+" "+remote)
+	s.retries.Unlock()
+}
+
+// connectRetries returns the remotes being retried, by kind and remote.
+func (s *Server) connectRetries() []*ConnectRetry {
+	s.retries.Lock()
+	if len(s.retries.m) == 0 {
+		s.retries.Unlock()
+		return nil
+	}
+	crs := make([]*ConnectRetry, 0, len(s.retries.m))
+	for _, cr := range s.retries.m {
+		c := *cr
+		crs = append(crs, &c)
+	}
+	s.retries.Unlock()
+	sort.Slice(crs, func(i, j int) bool {
+		if crs[i].Kind != crs[j].Kind {
+			return crs[i].Kind < crs[j].Kind
+		}
+		return crs[i].Remote < crs[j].Remote
+	})
+	return crs
+}
@@ -16,6 +16,7 @@ package server
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"math/rand"
@@ -26,6 +27,8 @@ import (
 	"strings"
 	"sync/atomic"
 	"time"
+
+	"github.com/nats-io/nkeys"
 )
 
 // RouteType designates the router type
@@ -77,6 +80,19 @@ type route struct {
 	gatewayURL   string
 	leafnodeURL  string
 	hash         string
+	// Used for nkey authentication of solicited routes.
+	pendingInfo  []byte
+	connectSent  bool
+	nkeyVerified bool
+	// Set when the route was accepted with a join token.
+	joinToken bool
+	// Set when the remote accepts messages tagged with their origin.
+	lnoc bool
+	// Last load score reported by the remote.
+	loadScore    int
+	hasLoadScore bool
+	// Estimated clock skew with the remote.
+	skew clockSkew
 }
 
 type connectInfo struct {
@@ -88,6 +104,8 @@ type connectInfo struct {
 	TLS      bool   `json:"tls_required"`
 	Name     string `json:"name"`
 	Gateway  string `json:"gateway,omitempty"`
+	Nkey     string `json:"nkey,omitempty"`
+	Sig      string `json:"sig,omitempty"`
 }
 
 // Route protocol constants
@@ -103,6 +121,9 @@ const (
 
 	// Warning when user configures cluster TLS insecure
 	clusterTLSInsecureWarning = "TLS certificate chain and hostname of solicited routes will not be verified. DO NOT USE IN PRODUCTION!"
+
+	// Warning when user tries to disable the verification of routes
+	clusterTLSVerifyWarning = "cluster tls 'verify: false' is ignored, route certificates are verified unless 'insecure' is set"
 )
 
 // Can be changed for tests
@@ -183,6 +204,7 @@ func (c *client) processRoutedMsgArgs(trace bool, arg []byte) error {
 	}
 
 	c.pa.arg = arg
+	c.pa.origin = nil
 	switch len(args) {
 	case 0, 1, 2:
 		return fmt.Errorf("processRoutedMsgArgs Parse Error: '%s'", args)
@@ -263,6 +285,8 @@ func (c *client) processInboundRoutedMsg(msg []byte) {
 		return
 	}
 
+	acc.storeMsg(c.pa.subject, c.pa.reply, msg)
+
 	// Check to see if we need to map/route to another account.
 	if acc.imports.services != nil {
 		c.checkForImportServices(acc, msg)
@@ -276,7 +300,8 @@ func (c *client) processInboundRoutedMsg(msg []byte) {
 }
 
 // Lock should be held entering here.
-func (c *client) sendRouteConnect(tlsRequired bool) {
+// If `nonce` is not empty, it is signed with the cluster nkey.
+func (c *client) sendRouteConnect(tlsRequired bool, nonce string) {
 	var user, pass string
 	if userInfo := c.route.url.User; userInfo != nil {
 		user = userInfo.Username()
@@ -291,6 +316,14 @@ func (c *client) sendRouteConnect(tlsRequired bool) {
 		TLS:      tlsRequired,
 		Name:     c.srv.info.ID,
 	}
+	if nonce != "" {
+		nkey, sig, err := signRouteNonce(c.srv.getOpts().Cluster.NkeySeed, nonce)
+		if err != nil {
+			c.Errorf("Error signing route nonce: %v", err)
+		} else {
+			cinfo.Nkey, cinfo.Sig = nkey, sig
+		}
+	}
 
 	b, err := json.Marshal(cinfo)
 	if err != nil {
@@ -338,6 +371,43 @@ func (c *client) processRouteInfo(info *Info) {
 		return
 	}
 
+	// With nkey authentication, a solicited route is not used until the
+	// accepting side has proven its identity.
+	if (c.route.didSolicit && c.route.pendingInfo != nil) || (c.route.connectSent && !c.route.nkeyVerified) {
+		if !c.route.connectSent {
+			c.route.connectSent = true
+			c.sendRouteConnect(s.getOpts().Cluster.TLSConfig != nil, info.Nonce)
+			c.Debugf("Route connect msg sent")
+			c.enqueueProto(c.route.pendingInfo)
+			c.route.pendingInfo = nil
+			c.mu.Unlock()
+			return
+		}
+		// Only the signed INFO is the proof, other INFOs, such as the
+		// ones for cluster updates, may be received before it.
+		if info.Sig == _EMPTY_ {
+			c.mu.Unlock()
+			c.Debugf("Ignoring route INFO received before nkey verification")
+			return
+		}
+		if err := s.verifyRouteNkey(info.Nkey, info.Sig, c.nonce); err != nil {
+			c.mu.Unlock()
+			c.Errorf("Route nkey authentication failed: %v", err)
+			c.closeConnection(AuthenticationViolation)
+			return
+		}
+		c.route.nkeyVerified = true
+		c.Debugf("Route nkey %q verified", info.Nkey)
+	} else if !c.route.didSolicit && len(s.getOpts().Cluster.Nkeys) > 0 && !c.flags.isSet(infoReceived) &&
+		(remoteID == "" || remoteID == info.ID) {
+		// Prove our identity to the soliciting side by signing its nonce.
+		if b, err := s.signedRouteInfoJSON(info.Nonce); err != nil {
+			c.Errorf("Error signing route nonce: %v", err)
+		} else {
+			c.enqueueProto(b)
+		}
+	}
+
 	// We receive an INFO from a server that informs us about another server,
 	// so the info.ID in the INFO protocol does not match the ID of this route.
 	if remoteID != "" && remoteID != info.ID {
@@ -375,6 +445,18 @@ func (c *client) processRouteInfo(info *Info) {
 	// Compute the hash of this route based on remoteID
 	c.route.hash = string(getHash(info.ID))
 
+	// Periodic report of the load of the remote server.
+	if info.LoadScore != nil && c.flags.isSet(infoReceived) {
+		c.processRouteLoadScore(*info.LoadScore)
+		return
+	}
+
+	// The connect URLs of the remote server changed.
+	if info.ConnectURLsUpdate && c.flags.isSet(infoReceived) {
+		c.processRouteConnectURLsUpdate(info.ClientConnectURLs)
+		return
+	}
+
 	// If this is an update due to config reload on the remote server,
 	// need to possibly send local subs to the remote server.
 	if c.flags.isSet(infoReceived) {
@@ -386,6 +468,8 @@ func (c *client) processRouteInfo(info *Info) {
 	// Copy over permissions as well.
 	c.opts.Import = info.Import
 	c.opts.Export = info.Export
+	c.route.lnoc = info.LNOC
+	c.route.skew.enabled = info.PingTS
 
 	// If we do not know this route's URL, construct one on the fly
 	// from the information provided.
@@ -410,6 +494,13 @@ func (c *client) processRouteInfo(info *Info) {
 	// This can happen when both servers have routes to each other.
 	c.mu.Unlock()
 
+	// Refuse routes to servers partitioned away by fault injection.
+	if s.routeBlocked(info.ID) {
+		c.Debugf("Refusing route to partitioned server %q", info.ID)
+		c.closeConnection(RouteRemoved)
+		return
+	}
+
 	if added, sendInfo := s.addRoute(c, info); added {
 		c.Debugf("Registering remote route %q", info.ID)
 
@@ -503,7 +594,7 @@ func (s *Server) sendAsyncInfoToClients() {
 		// registered (server has received CONNECT and first PING). For
 		// clients that are not at this stage, this will happen in the
 		// processing of the first PING (see client.processPing)
-		if c.opts.Protocol >= ClientProtoInfo && c.flags.isSet(firstPongSent) {
+		if c.hasFeature(FeatureAsyncInfo) && c.flags.isSet(firstPongSent) {
 			// sendInfo takes care of checking if the connection is still
 			// valid or not, so don't duplicate tests here.
 			c.enqueueProto(c.generateClientInfoJSON(s.copyInfo()))
@@ -583,7 +674,7 @@ func (s *Server) forwardNewRouteInfoToKnownServers(info *Info) {
 }
 
 // canImport is whether or not we will send a SUB for interest to the other side.
-// This is for ROUTER connections only.
+// This is for ROUTER and LEAF connections only.
 // Lock is held on entry.
 func (c *client) canImport(subject string) bool {
 	// Use pubAllowed() since this checks Publish permissions which
@@ -592,7 +683,7 @@ func (c *client) canImport(subject string) bool {
 }
 
 // canExport is whether or not we will accept a SUB from the remote for a given subject.
-// This is for ROUTER connections only.
+// This is for ROUTER and LEAF connections only.
 // Lock is held on entry
 func (c *client) canExport(subject string) bool {
 	// Use canSubscribe() since this checks Subscribe permissions which
@@ -601,7 +692,7 @@ func (c *client) canExport(subject string) bool {
 }
 
 // Initialize or reset cluster's permissions.
-// This is for ROUTER connections only.
+// This is for ROUTER and LEAF connections only.
 // Client lock is held on entry
 func (c *client) setRoutePermissions(perms *RoutePermissions) {
 	// Reset if some were set
@@ -1000,6 +1091,9 @@ func (c *client) sendRouteSubOrUnSubProtos(subs []*subscription, isSubProto, tra
 func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 	// Snapshot server options.
 	opts := s.getOpts()
+	// Tune the socket, whether accepted or dialed.
+	s.applySocketOpts(conn, opts.Cluster.Socket)
+	conn = s.faultConn(ROUTER, conn)
 
 	didSolicit := rURL != nil
 	r := &route{didSolicit: didSolicit}
@@ -1015,15 +1109,21 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 	s.mu.Lock()
 	s.generateRouteInfoJSON()
 	infoJSON := s.routeInfoJSON
+	nonce := s.routeInfo.Nonce
 	authRequired := s.routeInfo.AuthRequired
 	tlsRequired := s.routeInfo.TLSRequired
 	s.mu.Unlock()
 
+	// With nkey authentication, a soliciting route needs the nonce of the
+	// accepting side before it can send its CONNECT and INFO.
+	nkeyAuth := len(opts.Cluster.Nkeys) > 0
+
 	// Grab lock
 	c.mu.Lock()
 
 	// Initialize
 	c.initClient()
+	c.nonce = []byte(nonce)
 
 	if didSolicit {
 		// Do this before the TLS code, otherwise, in case of failure
@@ -1031,6 +1131,12 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 		r.url = rURL
 	} else {
 		c.flags.set(expectConnect)
+		// Reject routes while too many have not authenticated yet.
+		if authRequired && !c.trackPendingAuth(opts.Cluster.MaxPendingAuth) {
+			c.mu.Unlock()
+			c.maxPendingAuthExceeded()
+			return nil
+		}
 	}
 
 	// Check for TLS
@@ -1072,6 +1178,7 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 
 		// To be consistent with client, set this flag to indicate that handshake is done
 		c.flags.set(handshakeComplete)
+		c.trackPeerCert()
 
 		// Verify that the connection did not go away while we released the lock.
 		if c.isClosed() {
@@ -1125,15 +1232,20 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 		c.Debugf("TLS version %s, cipher suite %s", tlsVersion(cs.Version), tlsCipher(cs.CipherSuite))
 	}
 
-	// Queue Connect proto if we solicited the connection.
-	if didSolicit {
-		c.Debugf("Route connect msg sent")
-		c.sendRouteConnect(tlsRequired)
+	if didSolicit && nkeyAuth {
+		// Connect and info protos will be sent when receiving the INFO
+		// with the nonce to sign.
+		r.pendingInfo = infoJSON
+	} else {
+		// Queue Connect proto if we solicited the connection.
+		if didSolicit {
+			c.Debugf("Route connect msg sent")
+			c.sendRouteConnect(tlsRequired, _EMPTY_)
+		}
+		// Send our info to the other side.
+		// Our new version requires dynamic information for accounts and a nonce.
+		c.enqueueProto(infoJSON)
 	}
-
-	// Send our info to the other side.
-	// Our new version requires dynamic information for accounts and a nonce.
-	c.enqueueProto(infoJSON)
 	c.mu.Unlock()
 
 	c.Noticef("Route connection created")
@@ -1160,6 +1272,7 @@ func (s *Server) addRoute(c *client, info *Info) (bool, bool) {
 		s.remotes[id] = c
 		c.mu.Lock()
 		c.route.connectURLs = info.ClientConnectURLs
+		c.enablePriorityLane()
 		cid := c.cid
 		hash := string(c.route.hash)
 		c.mu.Unlock()
@@ -1279,6 +1392,14 @@ func (s *Server) updateRouteSubscriptionMap(acc *Account, sub *subscription, del
 	// Decide whether we need to send an update out to all the routes.
 	update := isq
 
+	// If interest updates are batched, routes will be updated when
+	// the batch is flushed.
+	if window := s.getOpts().Cluster.InterestBatchWindow; window > 0 {
+		s.batchRouteSubUpdate(acc, key, sub, delta, window)
+		accUnlock()
+		return
+	}
+
 	// This is where we do update to account. For queues we need to take
 	// special care that this order of updates is same as what is sent out
 	// over routes.
@@ -1363,7 +1484,108 @@ func (s *Server) updateRouteSubscriptionMap(acc *Account, sub *subscription, del
 	}
 }
 
+// routeSubUpdate is a pending interest update for a given key.
+type routeSubUpdate struct {
+	sub  *subscription
+	sent int32 // The count (or queue weight) the routes know about.
+}
+
+// batchRouteSubUpdate updates the route map and records that an update
+// for this key needs to be sent to the routes. The first update starts a
+// timer that will send all pending updates for this account at once.
+// Account lock is held on entry.
+func (s *Server) batchRouteSubUpdate(acc *Account, key string, sub *subscription, delta int32, window time.Duration) {
+	n := acc.rm[key]
+	if acc.rbatch == nil {
+		acc.rbatch = make(map[string]*routeSubUpdate)
+		time.AfterFunc(window, func() { s.flushRouteSubUpdates(acc) })
+	}
+	if u := acc.rbatch[key]; u != nil {
+		u.sub = sub
+	} else {
+		acc.rbatch[key] = &routeSubUpdate{sub: sub, sent: n}
+	}
+	if n += delta; n <= 0 {
+		delete(acc.rm, key)
+	} else {
+		acc.rm[key] = n
+	}
+}
+
+// flushRouteSubUpdates sends the pending interest updates for this account
+// to all routes, skipping the ones that resulted in no change. Subscribes
+// and unsubscribes are each coalesced into a single buffer per route.
+func (s *Server) flushRouteSubUpdates(acc *Account) {
+	// Serialize with queue weight updates.
+	acc.sqmu.Lock()
+	defer acc.sqmu.Unlock()
+
+	type update struct {
+		sub *subscription
+		n   int32
+	}
+	var updates []update
+	acc.mu.Lock()
+	for key, u := range acc.rbatch {
+		n := acc.rm[key]
+		if len(u.sub.queue) > 0 {
+			if n == u.sent {
+				continue
+			}
+			if n > 0 {
+				acc.lqws[key] = n
+			} else {
+				delete(acc.lqws, key)
+			}
+		} else if (n > 0) == (u.sent > 0) {
+			continue
+		}
+		updates = append(updates, update{u.sub, n})
+	}
+	acc.rbatch = nil
+	acc.mu.Unlock()
+
+	// Make copies outside of the account lock since we set the queue weight.
+	var subs, unsubs []*subscription
+	for _, u := range updates {
+		u.sub.client.mu.Lock()
+		nsub := *u.sub
+		u.sub.client.mu.Unlock()
+		nsub.qw = u.n
+		if u.n > 0 {
+			subs = append(subs, &nsub)
+		} else {
+			unsubs = append(unsubs, &nsub)
+		}
+	}
+
+	if len(subs) == 0 && len(unsubs) == 0 {
+		return
+	}
+
+	var _routes [32]*client
+	routes := _routes[:0]
+	s.mu.Lock()
+	for _, route := range s.routes {
+		routes = append(routes, route)
+	}
+	trace := atomic.LoadInt32(&s.logging.trace) == 1
+	s.mu.Unlock()
+
+	for _, route := range routes {
+		route.mu.Lock()
+		if len(unsubs) > 0 {
+			route.sendRouteSubOrUnSubProtos(unsubs, false, trace, route.importFilter)
+		}
+		if len(subs) > 0 {
+			route.sendRouteSubOrUnSubProtos(subs, true, trace, route.importFilter)
+		}
+		route.mu.Unlock()
+	}
+}
+
 func (s *Server) routeAcceptLoop(ch chan struct{}) {
+	defer s.acceptLoopStarted()()
 	defer func() {
 		if ch != nil {
 			close(ch)
@@ -1381,12 +1603,12 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 	}
 
 	hp := net.JoinHostPort(opts.Cluster.Host, strconv.Itoa(port))
-	l, e := net.Listen("tcp", hp)
+	l, e := s.listenOrInherit(ClusterListener, hp)
 	if e != nil {
 		s.Fatalf("Error listening on router port: %d - %v", opts.Cluster.Port, e)
 		return
 	}
-	s.Noticef("Listening for route connections on %s",
+	s.bannerf("Listening for route connections on %s",
 		net.JoinHostPort(opts.Cluster.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
 
 	s.mu.Lock()
@@ -1414,6 +1636,8 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 		MaxPayload:   s.info.MaxPayload,
 		Proto:        proto,
 		GatewayURL:   s.getGatewayURL(),
+		LNOC:         true,
+		PingTS:       true,
 	}
 	// Set this if only if advertise is not disabled
 	if !opts.Cluster.NoAdvertise {
@@ -1425,7 +1649,7 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 		opts.Cluster.Port = l.Addr().(*net.TCPAddr).Port
 	}
 	// Check for Auth items
-	if opts.Cluster.Username != "" {
+	if opts.Cluster.Username != "" || len(opts.Cluster.Nkeys) > 0 {
 		info.AuthRequired = true
 	}
 	// Check for permissions.
@@ -1461,10 +1685,15 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 	close(ch)
 	ch = nil
 
+	s.checkListenersReady()
+
 	tmpDelay := ACCEPT_MIN_SLEEP
 
+	defer s.acceptLoops.route.done()
 	for s.isRunning() {
+		s.acceptLoops.route.done()
 		conn, err := l.Accept()
+		s.acceptLoops.route.start()
 		if err != nil {
 			tmpDelay = s.acceptError("Route", err, tmpDelay)
 			continue
@@ -1515,6 +1744,9 @@ func (s *Server) StartRouting(clientListenReady chan struct{}) {
 
 	// Solicit Routes if needed.
 	s.solicitRoutes(s.getOpts().Routes)
+
+	// Report the load of this server to the routes if needed.
+	s.startLoadReports()
 }
 
 func (s *Server) reConnectToRoute(rURL *url.URL, rtype RouteType) {
@@ -1555,13 +1787,21 @@ func (s *Server) connectToRoute(rURL *url.URL, tryForEver, firstConnect bool) {
 
 	const connErrFmt = "Error trying to connect to route (attempt %v): %v"
 
+	if rURL != nil {
+		defer s.connectRetryDone("route", rURL.Host)
+	}
+
 	attempts := 0
 	for s.isRunning() && rURL != nil {
 		if tryForEver && !s.routeStillValid(rURL) {
 			return
 		}
 		s.Debugf("Trying to connect to route on %s", rURL.Host)
-		conn, err := net.DialTimeout("tcp", rURL.Host, DEFAULT_ROUTE_DIAL)
+		var conn net.Conn
+		addrs, err := s.resolveOutbound(net.DefaultResolver, rURL.Host)
+		if err == nil {
+			conn, err = s.dialOutbound("route", addrs, DEFAULT_ROUTE_DIAL)
+		}
 		if err != nil {
 			attempts++
 			if s.shouldReportConnectErr(firstConnect, attempts) {
@@ -1577,10 +1817,16 @@ func (s *Server) connectToRoute(rURL *url.URL, tryForEver, firstConnect bool) {
 					return
 				}
 			}
+			if opts.Cluster.Retry.exhausted(attempts) {
+				s.Errorf("Giving up connecting to route %s after %d attempts", rURL.Host, attempts)
+				return
+			}
+			delay := opts.Cluster.Retry.delay(routeConnectDelay, attempts)
+			s.connectRetry("route", rURL.Host, attempts, err, delay)
 			select {
 			case <-s.quitCh:
 				return
-			case <-time.After(routeConnectDelay):
+			case <-time.After(delay):
 				continue
 			}
 		}
@@ -1597,6 +1843,87 @@ func (s *Server) connectToRoute(rURL *url.URL, tryForEver, firstConnect bool) {
 	}
 }
 
+// signRouteNonce signs the nonce with the nkey of the given seed and
+// returns the public key and the signature.
+func signRouteNonce(seed, nonce string) (string, string, error) {
+	kp, err := nkeys.FromSeed([]byte(seed))
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	defer kp.Wipe()
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	sig, err := kp.Sign([]byte(nonce))
+	if err != nil {
+		return _EMPTY_, _EMPTY_, err
+	}
+	return pub, base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// verifyRouteNkey checks that the nkey is one of the cluster's nkeys
+// and that the signature of the nonce is valid.
+func (s *Server) verifyRouteNkey(nkey, sig string, nonce []byte) error {
+	opts := s.getOpts()
+	found := false
+	for _, k := range opts.Cluster.Nkeys {
+		if k == nkey {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("nkey %q not allowed", nkey)
+	}
+	rawSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return fmt.Errorf("signature not valid base64")
+	}
+	pub, err := nkeys.FromPublicKey(nkey)
+	if err != nil {
+		return err
+	}
+	if err := pub.Verify(nonce, rawSig); err != nil {
+		return fmt.Errorf("signature not verified")
+	}
+	return nil
+}
+
+// signedRouteInfoJSON returns the route INFO protocol with this server's
+// nkey and the signature of the given nonce.
+func (s *Server) signedRouteInfoJSON(nonce string) ([]byte, error) {
+	nkey, sig, err := signRouteNonce(s.getOpts().Cluster.NkeySeed, nonce)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	info := s.routeInfo
+	s.mu.Unlock()
+	info.Nonce = _EMPTY_
+	info.Nkey, info.Sig = nkey, sig
+	b, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf(InfoProto, b)), nil
+}
+
+// validateClusterNkeys checks that a seed is provided when cluster nkeys
+// are configured.
+func validateClusterNkeys(o *Options) error {
+	if len(o.Cluster.Nkeys) == 0 {
+		return nil
+	}
+	if o.Cluster.NkeySeed == _EMPTY_ {
+		return fmt.Errorf("cluster nkeys require a cluster nkey seed")
+	}
+	if _, _, err := signRouteNonce(o.Cluster.NkeySeed, "nonce"); err != nil {
+		return fmt.Errorf("invalid cluster nkey seed: %v", err)
+	}
+	return nil
+}
+
 func (c *client) isSolicitedRoute() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -14,10 +14,15 @@
 package server
 
 import (
+	"bufio"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
+	"os"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,6 +31,7 @@ import (
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 )
 
 func init() {
@@ -1259,3 +1265,846 @@ func TestRouteCloseTLSConnection(t *testing.T) {
 	route.closeConnection(SlowConsumerWriteDeadline)
 	ch <- true
 }
+
+func TestRouteNkeyAuthentication(t *testing.T) {
+	createSeed := func(t *testing.T) (string, string) {
+		t.Helper()
+		kp, err := nkeys.CreateServer()
+		if err != nil {
+			t.Fatalf("Error creating nkey: %v", err)
+		}
+		seed, _ := kp.Seed()
+		pub, _ := kp.PublicKey()
+		return string(seed), pub
+	}
+	seedA, pubA := createSeed(t)
+	seedB, pubB := createSeed(t)
+	seedC, _ := createSeed(t)
+	seedD, pubD := createSeed(t)
+
+	ob := DefaultOptions()
+	ob.Cluster.NkeySeed = seedB
+	ob.Cluster.Nkeys = []string{pubA, pubB, pubD}
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+
+	routes := RoutesFromStr(fmt.Sprintf("nats://%s:%d", ob.Cluster.Host, ob.Cluster.Port))
+
+	oa := DefaultOptions()
+	oa.Cluster.NkeySeed = seedA
+	oa.Cluster.Nkeys = []string{pubA, pubB}
+	oa.Routes = routes
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+
+	// A server whose nkey is not trusted can't join.
+	oc := DefaultOptions()
+	oc.Cluster.NkeySeed = seedC
+	oc.Cluster.Nkeys = []string{pubA, pubB}
+	oc.Routes = routes
+	sc := RunServer(oc)
+	defer sc.Shutdown()
+
+	time.Sleep(100 * time.Millisecond)
+	checkNumRoutes(t, sc, 0)
+	checkNumRoutes(t, sb, 1)
+
+	// A server that does not trust the accepting side won't use the route.
+	od := DefaultOptions()
+	od.Cluster.NkeySeed = seedD
+	od.Cluster.Nkeys = []string{pubD}
+	od.Routes = routes
+	sd := RunServer(od)
+	defer sd.Shutdown()
+
+	time.Sleep(100 * time.Millisecond)
+	checkNumRoutes(t, sd, 0)
+
+	// Nkeys require a seed.
+	oe := DefaultOptions()
+	oe.Cluster.Nkeys = []string{pubA}
+	if _, err := NewServer(oe); err == nil {
+		t.Fatal("Expected error with nkeys and no seed")
+	}
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		cluster {
+			listen: "127.0.0.1:-1"
+			nkey_seed: %q
+			nkeys: [%q, %q]
+		}
+	`, seedA, pubA, pubB)))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.Cluster.NkeySeed != seedA || len(opts.Cluster.Nkeys) != 2 {
+		t.Fatalf("Unexpected cluster nkey options: %+v", opts.Cluster)
+	}
+	bad := createConfFile(t, []byte(`cluster { nkeys: ["UABC"] }`))
+	defer os.Remove(bad)
+	if _, err := ProcessConfigFile(bad); err == nil {
+		t.Fatal("Expected error for invalid cluster nkey")
+	}
+}
+
+func TestRouteNkeyIgnoresUnsignedInfo(t *testing.T) {
+	kp, _ := nkeys.CreateServer()
+	seedA, _ := kp.Seed()
+	pubA, _ := kp.PublicKey()
+	kp, _ = nkeys.CreateServer()
+	seedB, _ := kp.Seed()
+	pubB, _ := kp.PublicKey()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	defer l.Close()
+
+	oa := DefaultOptions()
+	oa.Cluster.NkeySeed = string(seedA)
+	oa.Cluster.Nkeys = []string{pubA, pubB}
+	oa.Routes = RoutesFromStr(fmt.Sprintf("nats://%s", l.Addr()))
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+
+	// Act as the accepting side with nkey B.
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Error on accept: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	fmt.Fprintf(c, "INFO {\"server_id\":\"B\",\"nonce\":\"abc\"}\r\n")
+	br := bufio.NewReader(c)
+	var info Info
+	for info.Nonce == _EMPTY_ {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		if strings.HasPrefix(line, "INFO ") {
+			json.Unmarshal([]byte(line[5:]), &info)
+		}
+	}
+	// An INFO without signature, such as a cluster update, does not
+	// fail the verification.
+	fmt.Fprintf(c, "INFO {\"server_id\":\"B\",\"connect_urls\":[\"127.0.0.1:4222\"]}\r\n")
+	nkey, sig, err := signRouteNonce(string(seedB), info.Nonce)
+	if err != nil {
+		t.Fatalf("Error signing nonce: %v", err)
+	}
+	fmt.Fprintf(c, "INFO {\"server_id\":\"B\",\"nkey\":%q,\"sig\":%q}\r\n", nkey, sig)
+	checkNumRoutes(t, sa, 1)
+}
+
+func TestRouteInterestBatching(t *testing.T) {
+	window := 250 * time.Millisecond
+
+	ob := DefaultOptions()
+	ob.Cluster.InterestBatchWindow = window
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+
+	oa := DefaultOptions()
+	oa.Cluster.InterestBatchWindow = window
+	oa.Routes = RoutesFromStr(fmt.Sprintf("nats://%s:%d", ob.Cluster.Host, ob.Cluster.Port))
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", oa.Host, oa.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sl := sb.globalAccount().sl
+	inserts := sl.Stats().NumInserts
+
+	// Subscriptions that come and go within the window are not sent.
+	for i := 0; i < 100; i++ {
+		sub, _ := nc.SubscribeSync(fmt.Sprintf("churn.%d", i))
+		sub.Unsubscribe()
+	}
+	// Others are sent once the window expires.
+	for i := 0; i < 50; i++ {
+		nc.SubscribeSync(fmt.Sprintf("foo.%d", i))
+		nc.QueueSubscribeSync("bar", "queue")
+	}
+	nc.Flush()
+	if n := sl.Count(); n != 0 {
+		t.Fatalf("Expected no interest before the window expires, got %v", n)
+	}
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := sl.Count(); n != 51 {
+			return fmt.Errorf("Expected 51 subscriptions, got %v", n)
+		}
+		return nil
+	})
+	if n := sl.Stats().NumInserts - inserts; n != 51 {
+		t.Fatalf("Expected 51 inserts, got %v", n)
+	}
+	// The queue weight should be the final one.
+	r := sl.Match("bar")
+	if len(r.qsubs) != 1 || len(r.qsubs[0]) != 50 || r.qsubs[0][0].qw != 50 {
+		t.Fatalf("Expected a queue subscription with a weight of 50, got %+v", r.qsubs)
+	}
+
+	// Close the connection, interest should go away.
+	nc.Close()
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := sl.Count(); n != 0 {
+			return fmt.Errorf("Expected no subscription, got %v", n)
+		}
+		return nil
+	})
+}
+
+func TestRouteInterestSnapshotPriming(t *testing.T) {
+	snapFile := createConfFile(t, nil)
+	os.Remove(snapFile)
+	defer os.Remove(snapFile)
+
+	ob := DefaultOptions()
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+
+	newOptsA := func() *Options {
+		oa := DefaultOptions()
+		oa.InterestSnapshot = snapFile
+		oa.InterestSnapshotTTL = 500 * time.Millisecond
+		oa.Routes = RoutesFromStr(fmt.Sprintf("nats://%s:%d", ob.Cluster.Host, ob.Cluster.Port))
+		return oa
+	}
+	oa := newOptsA()
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+	checkClusterFormed(t, sa, sb)
+
+	connect := func(o *Options, name string) *nats.Conn {
+		t.Helper()
+		nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", o.Host, o.Port), nats.Name(name))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		return nc
+	}
+	nc := connect(oa, "durable")
+	nc.SubscribeSync("foo")
+	nc.QueueSubscribeSync("bar", "queue")
+	nc.Flush()
+	ncg := connect(oa, "gone")
+	ncg.SubscribeSync("baz")
+	ncg.Flush()
+	// Clients without a name are not persisted.
+	nca := connect(oa, "")
+	nca.SubscribeSync("anon")
+	nca.Flush()
+
+	sl := sb.globalAccount().sl
+	checkInterest := func(subject string, expected int) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			r := sl.Match(subject)
+			if n := len(r.psubs) + len(r.qsubs); n != expected {
+				return fmt.Errorf("Expected interest in %q to be %v, got %v", subject, expected, n)
+			}
+			return nil
+		})
+	}
+	checkInterest("foo", 1)
+	checkInterest("baz", 1)
+	checkInterest("anon", 1)
+
+	sa.Shutdown()
+	nc.Close()
+	ncg.Close()
+	nca.Close()
+	checkInterest("foo", 0)
+	checkInterest("baz", 0)
+	checkInterest("anon", 0)
+
+	// The restarted server sends the restored interest to the route
+	// before the clients reconnect.
+	oa = newOptsA()
+	sa = RunServer(oa)
+	defer sa.Shutdown()
+	checkClusterFormed(t, sa, sb)
+	checkInterest("foo", 1)
+	checkInterest("bar", 1)
+	checkInterest("baz", 1)
+	checkInterest("anon", 0)
+
+	// The reconnecting client takes over its interest, which is not
+	// removed when the restored interest expires.
+	nc = connect(oa, "durable")
+	defer nc.Close()
+	nc.SubscribeSync("foo")
+	nc.QueueSubscribeSync("bar", "queue")
+	nc.Flush()
+	sa.mu.Lock()
+	p := sa.primed
+	sa.mu.Unlock()
+	p.Lock()
+	_, primed := p.clients[primedInterestKey(globalAccountName, "durable")]
+	p.Unlock()
+	if primed {
+		t.Fatal("Expected restored interest of the reconnected client to be released")
+	}
+	checkInterest("baz", 0)
+	checkInterest("foo", 1)
+	checkInterest("bar", 1)
+}
+
+func TestRouteMaxControlLine(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		max_control_line: 512
+		cluster {
+			listen: "127.0.0.1:-1"
+			max_control_line: 8192
+		}
+		gateway {
+			name: "A"
+			listen: "127.0.0.1:-1"
+			max_control_line: 2048
+		}
+		leafnodes {
+			listen: "127.0.0.1:-1"
+			max_control_line: 1024
+		}
+	`))
+	defer os.Remove(conf)
+	optsA, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	for kind, expected := range map[int]int32{CLIENT: 512, ROUTER: 8192, GATEWAY: 2048, LEAF: 1024} {
+		if mcl := optsA.maxControlLine(kind); mcl != expected {
+			t.Fatalf("Expected max control line %d for kind %d, got %d", expected, kind, mcl)
+		}
+	}
+	optsA.NoLog, optsA.NoSigs = true, true
+	optsA.Gateway = GatewayOpts{}
+	optsA.LeafNode = LeafNodeOpts{}
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Cluster.Host = "127.0.0.1"
+	optsB.Cluster.Port = -1
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", optsA.Cluster.Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+
+	// Routes use the override, clients the server setting.
+	nc := natsConnect(t, sa.ClientURL())
+	defer nc.Close()
+	natsFlush(t, nc)
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		sa.mu.Lock()
+		defer sa.mu.Unlock()
+		for _, r := range sa.routes {
+			if mcl := atomic.LoadInt32(&r.mcl); mcl != 8192 {
+				return fmt.Errorf("Expected route max control line 8192, got %d", mcl)
+			}
+		}
+		for _, c := range sa.clients {
+			if mcl := atomic.LoadInt32(&c.mcl); mcl != 512 {
+				return fmt.Errorf("Expected client max control line 512, got %d", mcl)
+			}
+		}
+		return nil
+	})
+}
+
+func TestRouteConnectURLsLoadScores(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		max_connections: 10
+		cluster {
+			listen: "127.0.0.1:-1"
+			load_report_interval: "50ms"
+			connect_urls_order: "load"
+		}
+	`))
+	defer os.Remove(conf)
+	optsA, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if optsA.Cluster.LoadReportInterval != 50*time.Millisecond || optsA.Cluster.ConnectURLsOrder != ConnectURLsLoad {
+		t.Fatalf("Unexpected cluster options: %+v", optsA.Cluster)
+	}
+	optsA.NoLog, optsA.NoSigs = true, true
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Cluster.Host = "127.0.0.1"
+	optsB.Cluster.Port = -1
+	optsB.Cluster.ConnectURLsOrder = ConnectURLsLoad
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", optsA.Cluster.Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+
+	// With 6 out of 10 connections, the load of A is at least 60.
+	for i := 0; i < 6; i++ {
+		nc := natsConnect(t, sa.ClientURL())
+		defer nc.Close()
+	}
+	sa.mu.Lock()
+	urlA := sa.clientConnectURLs[0]
+	sa.mu.Unlock()
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		sb.mu.Lock()
+		defer sb.mu.Unlock()
+		if score, ok := sb.info.ConnectLoads[urlA]; !ok || score < 60 {
+			return fmt.Errorf("Expected load score of at least 60 for %q, got %v", urlA, sb.info.ConnectLoads)
+		}
+		return nil
+	})
+
+	// Clients get the scores in INFO.
+	c, err := net.Dial("tcp", net.JoinHostPort(optsB.Host, strconv.Itoa(optsB.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	l, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	var info Info
+	if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+		t.Fatalf("Error unmarshaling INFO: %v", err)
+	}
+	if score := info.ConnectLoads[urlA]; score < 60 {
+		t.Fatalf("Expected load score of at least 60 for %q, got %v", urlA, info.ConnectLoads)
+	}
+	if len(info.ClientConnectURLs) != 2 {
+		t.Fatalf("Expected 2 connect URLs, got %v", info.ClientConnectURLs)
+	}
+
+	// The least loaded server comes first most of the time.
+	info = Info{
+		ClientConnectURLs: []string{"a:4222", "b:4222"},
+		ConnectLoads:      map[string]int{"a:4222": 100, "b:4222": 0},
+	}
+	first := 0
+	for i := 0; i < 1000; i++ {
+		orderConnectURLs(ConnectURLsLoad, &info)
+		if info.ClientConnectURLs[0] == "b:4222" {
+			first++
+		}
+	}
+	if first < 900 {
+		t.Fatalf("Expected least loaded URL first most of the time, got %d out of 1000", first)
+	}
+	// While shuffled URLs come in any order.
+	first = 0
+	for i := 0; i < 1000; i++ {
+		orderConnectURLs(ConnectURLsShuffle, &info)
+		if info.ClientConnectURLs[0] == "b:4222" {
+			first++
+		}
+	}
+	if first < 300 || first > 700 {
+		t.Fatalf("Expected shuffled URLs, got %q first %d out of 1000 times", "b:4222", first)
+	}
+}
+
+func TestRouteWriteCork(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		cluster {
+			listen: "127.0.0.1:-1"
+			write_cork: "100ms"
+		}
+		gateway {
+			name: "A"
+			listen: "127.0.0.1:-1"
+			write_cork: "200us"
+		}
+	`))
+	defer os.Remove(conf)
+	optsA, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	for kind, expected := range map[int]time.Duration{CLIENT: 0, ROUTER: 100 * time.Millisecond, GATEWAY: 200 * time.Microsecond} {
+		if cork := optsA.writeCork(kind); cork != expected {
+			t.Fatalf("Expected write cork %v for kind %d, got %v", expected, kind, cork)
+		}
+	}
+	optsA.NoLog, optsA.NoSigs = true, true
+	optsA.Gateway = GatewayOpts{}
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Cluster.Host = "127.0.0.1"
+	optsB.Cluster.Port = -1
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", optsA.Cluster.Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+
+	ncb := natsConnect(t, sb.ClientURL())
+	defer ncb.Close()
+	sub := natsSubSync(t, ncb, "foo")
+	natsFlush(t, ncb)
+	checkExpectedSubs(t, 1, sa)
+
+	nca := natsConnect(t, sa.ClientURL())
+	defer nca.Close()
+
+	// A single message is held for the cork time.
+	start := time.Now()
+	natsPub(t, nca, "foo", []byte("hello"))
+	natsNexMsg(t, sub, time.Second)
+	if dur := time.Since(start); dur < 80*time.Millisecond {
+		t.Fatalf("Expected message to be held for the cork time, got it after %v", dur)
+	}
+
+	// A burst is coalesced and all of it is delivered.
+	for i := 0; i < 1000; i++ {
+		natsPub(t, nca, "foo", []byte("hello"))
+	}
+	for i := 0; i < 1000; i++ {
+		natsNexMsg(t, sub, time.Second)
+	}
+}
+
+func TestRouteConnectRetryPolicy(t *testing.T) {
+	rp := &RetryPolicy{Initial: 100 * time.Millisecond, Max: 300 * time.Millisecond}
+	for attempts, expected := range []time.Duration{100, 100, 200, 300, 300} {
+		if d := rp.delay(time.Second, attempts); d != expected*time.Millisecond {
+			t.Fatalf("Expected delay %v after %d attempts, got %v", expected*time.Millisecond, attempts, d)
+		}
+	}
+	rp.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := rp.delay(time.Second, 1); d < 50*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("Unexpected jittered delay %v", d)
+		}
+	}
+	if d := (*RetryPolicy)(nil).delay(time.Second, 5); d != time.Second {
+		t.Fatalf("Expected the fixed delay without a policy, got %v", d)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	deadPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		cluster {
+			listen: "127.0.0.1:-1"
+			routes: ["nats://127.0.0.1:%d"]
+			retry {
+				initial: "20ms"
+				max: "40ms"
+				jitter: 0.1
+				max_attempts: 4
+			}
+		}
+		gateway {
+			name: "A"
+			listen: "127.0.0.1:-1"
+			retry { max: "1m" }
+		}
+		leafnodes {
+			remotes [{url: "nats://127.0.0.1:%d", retry { max_attempts: 2 }}]
+		}
+	`, deadPort, deadPort)))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	expected := RetryPolicy{Initial: 20 * time.Millisecond, Max: 40 * time.Millisecond, Jitter: 0.1, MaxAttempts: 4}
+	if opts.Cluster.Retry == nil || *opts.Cluster.Retry != expected {
+		t.Fatalf("Expected cluster retry %+v, got %+v", expected, opts.Cluster.Retry)
+	}
+	if rp := opts.Gateway.Retry; rp == nil || *rp != (RetryPolicy{Max: time.Minute}) {
+		t.Fatalf("Unexpected gateway retry %+v", rp)
+	}
+	if rp := opts.LeafNode.Remotes[0].Retry; rp == nil || *rp != (RetryPolicy{MaxAttempts: 2}) {
+		t.Fatalf("Unexpected leafnode remote retry %+v", rp)
+	}
+	for _, bad := range []string{
+		`cluster { retry { jitter: 2 } }`,
+		`cluster { retry { initial: "2s", max: "1s" } }`,
+		`gateway { retry { max_attempts: -1 } }`,
+		`cluster { retry { foo: 1 } }`,
+	} {
+		conf := createConfFile(t, []byte(bad))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil {
+			t.Fatalf("Expected error for %q", bad)
+		}
+	}
+
+	// The route is retried with the policy, shown in varz, and given up on.
+	opts.NoLog, opts.NoSigs = true, true
+	opts.Gateway = GatewayOpts{}
+	opts.LeafNode = LeafNodeOpts{}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	remote := fmt.Sprintf("127.0.0.1:%d", deadPort)
+	checkFor(t, time.Second, 5*time.Millisecond, func() error {
+		v, _ := s.Varz(nil)
+		for _, cr := range v.ConnectRetries {
+			if cr.Kind == "route" && cr.Remote == remote && cr.Attempts >= 2 {
+				if cr.Delay < 36*time.Millisecond || cr.Delay > 44*time.Millisecond {
+					return fmt.Errorf("unexpected delay %v", cr.Delay)
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("route retry not found in %+v", v.ConnectRetries)
+	})
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if v, _ := s.Varz(nil); len(v.ConnectRetries) > 0 {
+			return fmt.Errorf("route still retried: %+v", v.ConnectRetries[0])
+		}
+		return nil
+	})
+}
+
+func TestRouteClockSkew(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.Cluster.Port = -1
+	optsA.PingInterval = 50 * time.Millisecond
+	optsA.ClockSkewThreshold = time.Second
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Cluster.Host = "127.0.0.1"
+	optsB.Cluster.Port = -1
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", optsA.Cluster.Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+
+	// Both servers have the same clock, so the skew is within the RTT.
+	var skew time.Duration
+	checkFor(t, 2*time.Second, 20*time.Millisecond, func() error {
+		rz, _ := sa.Routez(nil)
+		if len(rz.Routes) != 1 || rz.Routes[0].ClockSkew == _EMPTY_ {
+			return fmt.Errorf("clock skew not known yet")
+		}
+		var err error
+		skew, err = time.ParseDuration(rz.Routes[0].ClockSkew)
+		return err
+	})
+	if skew < -100*time.Millisecond || skew > 100*time.Millisecond {
+		t.Fatalf("Unexpected clock skew %v", skew)
+	}
+
+	// Simulate a remote clock 5s ahead.
+	l := &captureWarnLogger{warn: make(chan string, 10)}
+	sa.SetLogger(l, false, false)
+	var r *client
+	sa.mu.Lock()
+	for _, rt := range sa.routes {
+		r = rt
+	}
+	sa.mu.Unlock()
+	now := time.Now()
+	for i := 0; i < 20; i++ {
+		r.processTimedPong([]byte(fmt.Sprintf("%d %d", now.UnixNano(), now.Add(5*time.Second).UnixNano())))
+	}
+	select {
+	case w := <-l.warn:
+		if !strings.Contains(w, "Clock skew") {
+			t.Fatalf("Unexpected warning: %q", w)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected a clock skew warning")
+	}
+	select {
+	case w := <-l.warn:
+		t.Fatalf("Expected a single warning, got %q", w)
+	default:
+	}
+	r.mu.Lock()
+	skewStr := r.clockSkewString()
+	r.mu.Unlock()
+	if skew, _ := time.ParseDuration(skewStr); skew < time.Second || skew > 5*time.Second {
+		t.Fatalf("Unexpected clock skew %v", skewStr)
+	}
+}
+
+func TestRouteConnectURLsDamping(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		cluster {
+			listen: "127.0.0.1:-1"
+			connect_urls_damping: "100ms"
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.Cluster.ConnectURLsDamping != 100*time.Millisecond {
+		t.Fatalf("Unexpected connect urls damping: %v", opts.Cluster.ConnectURLsDamping)
+	}
+	opts.NoLog, opts.NoSigs = true, true
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, err := net.Dial("tcp", net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port)))
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	readLine := func(timeout time.Duration) (string, error) {
+		c.SetReadDeadline(time.Now().Add(timeout))
+		return br.ReadString('\n')
+	}
+	if _, err := readLine(time.Second); err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	c.Write([]byte("CONNECT {\"protocol\":1,\"verbose\":false}\r\nPING\r\n"))
+	if l, err := readLine(time.Second); err != nil || l != pongProto {
+		t.Fatalf("Expected PONG, got %q, %v", l, err)
+	}
+	expectNoInfo := func(timeout time.Duration) {
+		t.Helper()
+		if l, err := readLine(timeout); err == nil {
+			t.Fatalf("Expected no INFO, got %q", l)
+		}
+	}
+	expectInfo := func(urls ...string) {
+		t.Helper()
+		l, err := readLine(time.Second)
+		if err != nil {
+			t.Fatalf("Error reading INFO: %v", err)
+		}
+		var info Info
+		if err := json.Unmarshal([]byte(l[5:]), &info); err != nil {
+			t.Fatalf("Error unmarshaling INFO: %v", err)
+		}
+		got := info.ClientConnectURLs[1:]
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, urls) {
+			t.Fatalf("Expected connect URLs %v, got %v", urls, got)
+		}
+	}
+
+	// A burst of updates results in a single INFO.
+	s.addClientConnectURLsAndSendINFOToClients([]string{"a:4222"})
+	s.addClientConnectURLsAndSendINFOToClients([]string{"b:4222"})
+	s.removeClientConnectURLsAndSendINFOToClients([]string{"a:4222"})
+	s.addClientConnectURLsAndSendINFOToClients([]string{"c:4222"})
+	expectInfo("b:4222", "c:4222")
+	expectNoInfo(250 * time.Millisecond)
+
+	// A member leaving and coming back does not result in any INFO.
+	s.removeClientConnectURLsAndSendINFOToClients([]string{"b:4222"})
+	s.addClientConnectURLsAndSendINFOToClients([]string{"b:4222"})
+	expectNoInfo(250 * time.Millisecond)
+
+	// Updates that keep coming delay the INFO, but not indefinitely.
+	start := time.Now()
+	s.addClientConnectURLsAndSendINFOToClients([]string{"e:4222"})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			s.addClientConnectURLsAndSendINFOToClients([]string{"d:4222"})
+			s.removeClientConnectURLsAndSendINFOToClients([]string{"d:4222"})
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	expectInfo("b:4222", "c:4222", "e:4222")
+	if elapsed := time.Since(start); elapsed > 700*time.Millisecond {
+		t.Fatalf("INFO was delayed for %v", elapsed)
+	}
+	<-done
+}
+
+func TestRouteAdvertiseResolve(t *testing.T) {
+	var mu sync.Mutex
+	addrs := []string{"10.0.0.1"}
+	orgLookup := advertiseLookupHost
+	advertiseLookupHost = func(host string) ([]string, error) {
+		if host != "nats.example.com" {
+			return nil, fmt.Errorf("unknown host %q", host)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), addrs...), nil
+	}
+	defer func() { advertiseLookupHost = orgLookup }()
+
+	optsA := DefaultOptions()
+	optsA.ClientAdvertise = "nats.example.com:4222"
+	optsA.AdvertiseResolveInterval = 50 * time.Millisecond
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.Cluster.Port = -1
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	optsB := DefaultOptions()
+	optsB.Cluster.Host = "127.0.0.1"
+	optsB.Cluster.Port = -1
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", optsA.Cluster.Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+
+	checkURLs := func(expected ...string) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+			sa.mu.Lock()
+			urlsA := append([]string(nil), sa.clientConnectURLs...)
+			sa.mu.Unlock()
+			if !reflect.DeepEqual(urlsA, expected) {
+				return fmt.Errorf("Expected connect URLs %v, got %v", expected, urlsA)
+			}
+			sb.mu.Lock()
+			defer sb.mu.Unlock()
+			for _, url := range expected {
+				if _, ok := sb.clientConnectURLsMap[url]; !ok {
+					return fmt.Errorf("Expected %q in connect URLs of B, got %v", url, sb.info.ClientConnectURLs)
+				}
+			}
+			if n := len(sb.info.ClientConnectURLs); n != len(expected)+1 {
+				return fmt.Errorf("Expected %d connect URLs for B, got %v", len(expected)+1, sb.info.ClientConnectURLs)
+			}
+			return nil
+		})
+	}
+	checkURLs("10.0.0.1:4222")
+
+	mu.Lock()
+	addrs = []string{"10.0.0.3", "10.0.0.2"}
+	mu.Unlock()
+	checkURLs("10.0.0.2:4222", "10.0.0.3:4222")
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// The scheduler latency is how late a timer of this interval fires, the
+// highest of the last schedLatencySamples samples being reported.
+var schedLatencyInterval = 100 * time.Millisecond
+
+const schedLatencySamples = 10
+
+// RuntimeStats are the Go runtime metrics of the server process.
+type RuntimeStats struct {
+	Goroutines    int              `json:"goroutines"`
+	Subsystems    map[string]int64 `json:"subsystem_goroutines,omitempty"`
+	HeapAlloc     uint64           `json:"heap_alloc"`
+	HeapInuse     uint64           `json:"heap_inuse"`
+	HeapObjects   uint64           `json:"heap_objects"`
+	Sys           uint64           `json:"sys"`
+	NumGC         uint32           `json:"num_gc"`
+	GCPauseTotal  time.Duration    `json:"gc_pause_total"`
+	GCPauseLast   time.Duration    `json:"gc_pause_last"`
+	GCCPUFraction float64          `json:"gc_cpu_fraction"`
+	SchedLatency  time.Duration    `json:"sched_latency"`
+}
+
+// subsystemGoroutines counts the long lived go routines of the server:
+// the accept loops, and the read and write loops per connection kind.
+type subsystemGoroutines struct {
+	accept   int64
+	client   int64
+	route    int64
+	gateway  int64
+	leafnode int64
+}
+
+// loop returns the counter of the read and write loops of the given kind
+// of connection, nil if they are not counted.
+func (g *subsystemGoroutines) loop(kind int) *int64 {
+	switch kind {
+	case CLIENT:
+		return &g.client
+	case ROUTER:
+		return &g.route
+	case GATEWAY:
+		return &g.gateway
+	case LEAF:
+		return &g.leafnode
+	}
+	return nil
+}
+
+// loopStarted counts a read or write loop of the connection, and returns
+// the function to invoke when it exits.
+func (c *client) loopStarted() func() {
+	if c.srv == nil {
+		return func() {}
+	}
+	n := c.srv.goroutines.loop(c.kind)
+	if n == nil {
+		return func() {}
+	}
+	atomic.AddInt64(n, 1)
+	return func() { atomic.AddInt64(n, -1) }
+}
+
+// acceptLoopStarted counts an accept loop, and returns the function to
+// invoke when it exits.
+func (s *Server) acceptLoopStarted() func() {
+	atomic.AddInt64(&s.goroutines.accept, 1)
+	return func() { atomic.AddInt64(&s.goroutines.accept, -1) }
+}
+
+// startSchedLatency measures the scheduler latency until shutdown.
+func (s *Server) startSchedLatency() {
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		var samples [schedLatencySamples]time.Duration
+		for i := 0; ; i = (i + 1) % len(samples) {
+			start := time.Now()
+			select {
+			case <-time.After(schedLatencyInterval):
+			case <-s.quitCh:
+				return
+			}
+			if samples[i] = time.Since(start) - schedLatencyInterval; samples[i] < 0 {
+				samples[i] = 0
+			}
+			max := samples[0]
+			for _, l := range samples[1:] {
+				if l > max {
+					max = l
+				}
+			}
+			atomic.StoreInt64(&s.schedLatency, int64(max))
+		}
+	})
+}
+
+// runtimeStats returns the current Go runtime metrics.
+func (s *Server) runtimeStats() *RuntimeStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	rs := &RuntimeStats{
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAlloc:     ms.HeapAlloc,
+		HeapInuse:     ms.HeapInuse,
+		HeapObjects:   ms.HeapObjects,
+		Sys:           ms.Sys,
+		NumGC:         ms.NumGC,
+		GCPauseTotal:  time.Duration(ms.PauseTotalNs),
+		GCCPUFraction: ms.GCCPUFraction,
+		SchedLatency:  time.Duration(atomic.LoadInt64(&s.schedLatency)),
+	}
+	if ms.NumGC > 0 {
+		rs.GCPauseLast = time.Duration(ms.PauseNs[(ms.NumGC+255)%256])
+	}
+	g := &s.goroutines
+	for name, n := range map[string]*int64{
+		"accept":   &g.accept,
+		"client":   &g.client,
+		"route":    &g.route,
+		"gateway":  &g.gateway,
+		"leafnode": &g.leafnode,
+	} {
+		if v := atomic.LoadInt64(n); v > 0 {
+			if rs.Subsystems == nil {
+				rs.Subsystems = make(map[string]int64)
+			}
+			rs.Subsystems[name] = v
+		}
+	}
+	return rs
+}
+
+// HandleExpvar process HTTP requests for the varz in the format of the
+// expvar package, so that tools reading /debug/vars can poll the server.
+func (s *Server) HandleExpvar(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[ExpvarPath]++
+	s.mu.Unlock()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	v, err := s.Varz(nil)
+	if err != nil {
+		s.Errorf("Error getting varz for /debug/vars request: %v", err)
+	}
+	b, err := json.MarshalIndent(map[string]interface{}{
+		"cmdline":  os.Args,
+		"memstats": &ms,
+		"varz":     v,
+	}, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /debug/vars request: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// HandleMetrics process HTTP requests for the Go runtime metrics, in the
+// Prometheus text format.
+func (s *Server) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[MetricsPath]++
+	s.mu.Unlock()
+
+	rs := s.runtimeStats()
+	var b bytes.Buffer
+	metric := func(name, typ, help string, v interface{}) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, v)
+	}
+	metric("go_goroutines", "gauge", "Number of goroutines.", rs.Goroutines)
+	metric("go_memstats_heap_alloc_bytes", "gauge", "Heap bytes allocated and in use.", rs.HeapAlloc)
+	metric("go_memstats_heap_inuse_bytes", "gauge", "Heap bytes in in-use spans.", rs.HeapInuse)
+	metric("go_memstats_heap_objects", "gauge", "Number of allocated heap objects.", rs.HeapObjects)
+	metric("go_memstats_sys_bytes", "gauge", "Bytes obtained from the system.", rs.Sys)
+	metric("go_gc_cycles_total", "counter", "Number of completed GC cycles.", rs.NumGC)
+	metric("go_gc_pause_seconds_total", "counter", "Total GC pause time.", rs.GCPauseTotal.Seconds())
+	metric("go_gc_pause_last_seconds", "gauge", "Last GC pause time.", rs.GCPauseLast.Seconds())
+	metric("go_gc_cpu_fraction", "gauge", "Fraction of CPU time used by the GC.", rs.GCCPUFraction)
+	metric("go_sched_latency_seconds", "gauge", "Highest recent scheduler latency.", rs.SchedLatency.Seconds())
+
+	names := make([]string, 0, len(rs.Subsystems))
+	for name := range rs.Subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	b.WriteString("# HELP nats_subsystem_goroutines Number of long lived goroutines per subsystem.\n")
+	b.WriteString("# TYPE nats_subsystem_goroutines gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "nats_subsystem_goroutines{subsystem=%q} %d\n", name, rs.Subsystems[name])
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Protocol operations that the data of a client connection can start with.
+var clientProtoOps = [][]byte{
+	[]byte("CONNECT"), []byte("PUB"), []byte("SUB"), []byte("UNSUB"),
+	[]byte("PING"), []byte("PONG"), []byte("INFO"), []byte("+OK"), []byte("-ERR"),
+}
+
+// isProtoStart returns true if buf starts with a protocol operation, or
+// with the beginning of one.
+func isProtoStart(buf []byte) bool {
+	for _, op := range clientProtoOps {
+		n := len(op)
+		if len(buf) < n {
+			n = len(buf)
+		}
+		if bytes.EqualFold(buf[:n], op[:n]) {
+			return true
+		}
+	}
+	return false
+}
+
+// scannerResponses limits, server wide, the responses to the connections
+// of port scanners over the current second.
+type scannerResponses struct {
+	sync.Mutex
+	start time.Time
+	count int
+}
+
+// allow returns true if a response can be sent, with at most max
+// responses per second.
+func (r *scannerResponses) allow(max int) bool {
+	now := time.Now()
+	r.Lock()
+	defer r.Unlock()
+	if now.Sub(r.start) >= time.Second {
+		r.start, r.count = now, 0
+	}
+	if r.count >= max {
+		return false
+	}
+	r.count++
+	return true
+}
+
+// scannerProbe handles a client connection that sent data which is not
+// the NATS protocol before any CONNECT, such as a TLS or HTTP request of
+// a port scanner. Instead of the full parse error handling, the probe is
+// counted, and an error is sent and logged at debug level only within the
+// max_scanner_responses limit. The returned error closes the connection.
+func (c *client) scannerProbe(buf []byte) error {
+	s := c.srv
+	atomic.AddInt64(&s.scannerProbes, 1)
+	max := s.getOpts().MaxScannerResponses
+	if max == 0 {
+		max = DEFAULT_MAX_SCANNER_RESPONSES
+	}
+	if max > 0 && s.scanners.allow(max) {
+		c.sendErr("Unknown Protocol Operation")
+		c.Debugf("Closing connection sending non-protocol data: %s", protoSnippet(0, buf))
+	}
+	return ErrScannerProbe
+}
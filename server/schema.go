@@ -0,0 +1,593 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Policies applied to the messages that do not match the schema of their
+// subject.
+const (
+	// SchemaPolicyReject drops the message and sends an advisory. No error
+	// is sent to the client since clients close the connection on errors
+	// they do not know.
+	SchemaPolicyReject = "reject"
+	// SchemaPolicyTag delivers the message and sends an advisory.
+	SchemaPolicyTag = "tag"
+	// SchemaPolicyNone does not validate the messages of an account.
+	SchemaPolicyNone = "none"
+
+	// DEFAULT_SCHEMA_REFRESH is the default interval at which schemas are
+	// fetched again from the registry.
+	DEFAULT_SCHEMA_REFRESH = 5 * time.Minute
+)
+
+// Timeout of the requests to the schema registry.
+var schemaFetchTimeout = 10 * time.Second
+
+// SchemaValidationOpts enables the validation of the payloads published by
+// clients against JSON schemas fetched from a registry. The schema of a
+// subject is fetched from the registry URL followed by the schema name.
+// Until a schema has been fetched, messages on its subjects are delivered
+// without validation.
+type SchemaValidationOpts struct {
+	Registry string           `json:"registry"`
+	Refresh  time.Duration    `json:"refresh,omitempty"`
+	Policy   string           `json:"policy,omitempty"`
+	Subjects []*SubjectSchema `json:"subjects"`
+}
+
+// SubjectSchema is the name of the schema the payloads published on the
+// subjects matching a filter must match. The first filter matching a
+// subject applies.
+type SubjectSchema struct {
+	Subject string `json:"subject"`
+	Schema  string `json:"schema"`
+}
+
+func validateSchemaPolicy(policy string) error {
+	switch policy {
+	case SchemaPolicyReject, SchemaPolicyTag, SchemaPolicyNone:
+		return nil
+	}
+	return fmt.Errorf("invalid schema policy %q, expected %q, %q or %q",
+		policy, SchemaPolicyReject, SchemaPolicyTag, SchemaPolicyNone)
+}
+
+func (o *SchemaValidationOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	if !strings.HasPrefix(o.Registry, "http://") && !strings.HasPrefix(o.Registry, "https://") {
+		return fmt.Errorf("schema registry %q must be an http or https URL", o.Registry)
+	}
+	if o.Refresh < 0 {
+		return fmt.Errorf("schema refresh can't be negative")
+	}
+	if o.Policy != _EMPTY_ {
+		if err := validateSchemaPolicy(o.Policy); err != nil {
+			return err
+		}
+	}
+	for _, ss := range o.Subjects {
+		if !IsValidSubject(ss.Subject) {
+			return fmt.Errorf("invalid schema subject %q", ss.Subject)
+		}
+		if ss.Schema == _EMPTY_ {
+			return fmt.Errorf("missing schema for subject %q", ss.Subject)
+		}
+	}
+	return nil
+}
+
+// schemaValidation has the schemas fetched from the registry.
+type schemaValidation struct {
+	// Kept first for the alignment of the 64-bit atomics.
+	violations int64
+	// Set to 1 when enabled, checked without the lock.
+	enabled int32
+
+	sync.RWMutex
+	opts     *SchemaValidationOpts
+	schemas  map[string]*jsonSchema
+	advisory map[string]int64
+}
+
+// lookup returns the name and schema of the subject, with a nil schema
+// if it has none or if it has not been fetched yet.
+func (sv *schemaValidation) lookup(subject string) (string, *jsonSchema) {
+	sv.RLock()
+	defer sv.RUnlock()
+	if sv.opts == nil {
+		return _EMPTY_, nil
+	}
+	for _, ss := range sv.opts.Subjects {
+		if matchLiteral(subject, ss.Subject) {
+			return ss.Schema, sv.schemas[ss.Schema]
+		}
+	}
+	return _EMPTY_, nil
+}
+
+// policy returns the policy of the account, the one of the options if it
+// has none.
+func (sv *schemaValidation) policy(acc *Account) string {
+	if acc.schemaPolicy != _EMPTY_ {
+		return acc.schemaPolicy
+	}
+	sv.RLock()
+	defer sv.RUnlock()
+	if sv.opts == nil || sv.opts.Policy == _EMPTY_ {
+		return SchemaPolicyReject
+	}
+	return sv.opts.Policy
+}
+
+// startSchemaValidation fetches the schemas from the registry, and again
+// at the refresh interval.
+func (s *Server) startSchemaValidation() {
+	opts := s.getOpts().SchemaValidation
+	sv := &s.schemas
+	sv.Lock()
+	sv.opts = opts
+	sv.schemas = make(map[string]*jsonSchema)
+	sv.advisory = make(map[string]int64)
+	sv.Unlock()
+	atomic.StoreInt32(&sv.enabled, 1)
+
+	refresh := opts.Refresh
+	if refresh == 0 {
+		refresh = DEFAULT_SCHEMA_REFRESH
+	}
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		for {
+			s.fetchSchemas(opts)
+			select {
+			case <-time.After(refresh):
+			case <-s.quitCh:
+				return
+			}
+		}
+	})
+}
+
+// fetchSchemas fetches the schemas from the registry. A schema that can't
+// be fetched keeps its previous version.
+func (s *Server) fetchSchemas(opts *SchemaValidationOpts) {
+	hc := &http.Client{Timeout: schemaFetchTimeout}
+	base := strings.TrimSuffix(opts.Registry, "/")
+	fetched := make(map[string]*jsonSchema)
+	for _, ss := range opts.Subjects {
+		if _, ok := fetched[ss.Schema]; ok {
+			continue
+		}
+		sch, err := fetchSchema(hc, base+"/"+ss.Schema)
+		if err != nil {
+			s.Errorf("Error fetching schema %q: %v", ss.Schema, err)
+			continue
+		}
+		fetched[ss.Schema] = sch
+	}
+	s.schemas.Lock()
+	for name, sch := range fetched {
+		s.schemas.schemas[name] = sch
+	}
+	s.schemas.Unlock()
+}
+
+func fetchSchema(hc *http.Client, url string) (*jsonSchema, error) {
+	resp, err := hc.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	return compileSchema(v)
+}
+
+// checkSchema validates the payload of the message being processed against
+// the schema of its subject, and returns false if the message is rejected.
+func (c *client) checkSchema(msg []byte) bool {
+	s := c.srv
+	policy := s.schemas.policy(c.acc)
+	if policy == SchemaPolicyNone {
+		return true
+	}
+	subject := string(c.pa.subject)
+	name, sch := s.schemas.lookup(subject)
+	if sch == nil {
+		return true
+	}
+	var v interface{}
+	err := json.Unmarshal(msg[:len(msg)-LEN_CR_LF], &v)
+	if err == nil {
+		err = sch.validate(v, "$")
+	}
+	if err == nil {
+		return true
+	}
+
+	atomic.AddInt64(&s.schemas.violations, 1)
+	c.Debugf("Payload on subject %q does not match schema %q: %v", subject, name, err)
+	s.sendSchemaViolationEvent(&SchemaViolationEventMsg{
+		Account:  c.acc.Name,
+		Subject:  subject,
+		Schema:   name,
+		Error:    err.Error(),
+		Policy:   policy,
+		ClientID: c.cid,
+	})
+	return policy != SchemaPolicyReject
+}
+
+// sendSchemaViolationEvent sends an advisory for a message that does not
+// match its schema, at most once per second for an account's subject.
+func (s *Server) sendSchemaViolationEvent(m *SchemaViolationEventMsg) {
+	now := time.Now().UnixNano()
+	key := m.Account + " " + m.Subject
+	sv := &s.schemas
+	sv.Lock()
+	if now-sv.advisory[key] < int64(time.Second) {
+		sv.Unlock()
+		return
+	}
+	sv.advisory[key] = now
+	sv.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	subj := fmt.Sprintf(schemaViolationEventSubj, m.Account)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
+
+// jsonSchema is a compiled JSON schema. The supported keywords are type,
+// enum, const, properties, required, additionalProperties, items,
+// minItems, maxItems, minLength, maxLength, pattern, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, allOf, anyOf and oneOf.
+type jsonSchema struct {
+	types      []string
+	enum       []interface{}
+	properties map[string]*jsonSchema
+	required   []string
+	// nil allows any additional property, noProperties none.
+	additional *jsonSchema
+	items      *jsonSchema
+	minItems   int
+	maxItems   int
+	minLength  int
+	maxLength  int
+	pattern    *regexp.Regexp
+	minimum    *float64
+	maximum    *float64
+	exclMin    *float64
+	exclMax    *float64
+	allOf      []*jsonSchema
+	anyOf      []*jsonSchema
+	oneOf      []*jsonSchema
+	never      bool
+}
+
+// The additional properties schema when they are not allowed.
+var noProperties = &jsonSchema{never: true}
+
+// compileSchema compiles a JSON schema decoded with encoding/json.
+func compileSchema(v interface{}) (*jsonSchema, error) {
+	if b, ok := v.(bool); ok {
+		if b {
+			return &jsonSchema{maxItems: -1, maxLength: -1}, nil
+		}
+		return noProperties, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected schema to be an object, got %T", v)
+	}
+	sch := &jsonSchema{maxItems: -1, maxLength: -1}
+	for k, v := range m {
+		var err error
+		switch k {
+		case "type":
+			switch t := v.(type) {
+			case string:
+				sch.types = []string{t}
+			case []interface{}:
+				for _, e := range t {
+					s, ok := e.(string)
+					if !ok {
+						return nil, fmt.Errorf("expected type to be a string, got %T", e)
+					}
+					sch.types = append(sch.types, s)
+				}
+			default:
+				return nil, fmt.Errorf("expected type to be a string or an array, got %T", v)
+			}
+		case "enum":
+			if sch.enum, ok = v.([]interface{}); !ok {
+				return nil, fmt.Errorf("expected enum to be an array, got %T", v)
+			}
+		case "const":
+			sch.enum = []interface{}{v}
+		case "properties":
+			pm, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected properties to be an object, got %T", v)
+			}
+			sch.properties = make(map[string]*jsonSchema, len(pm))
+			for name, pv := range pm {
+				if sch.properties[name], err = compileSchema(pv); err != nil {
+					return nil, fmt.Errorf("property %q: %v", name, err)
+				}
+			}
+		case "required":
+			arr, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected required to be an array, got %T", v)
+			}
+			for _, e := range arr {
+				s, ok := e.(string)
+				if !ok {
+					return nil, fmt.Errorf("expected required property to be a string, got %T", e)
+				}
+				sch.required = append(sch.required, s)
+			}
+		case "additionalProperties":
+			sch.additional, err = compileSchema(v)
+		case "items":
+			sch.items, err = compileSchema(v)
+		case "minItems":
+			sch.minItems, err = schemaInt(k, v)
+		case "maxItems":
+			sch.maxItems, err = schemaInt(k, v)
+		case "minLength":
+			sch.minLength, err = schemaInt(k, v)
+		case "maxLength":
+			sch.maxLength, err = schemaInt(k, v)
+		case "pattern":
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("expected pattern to be a string, got %T", v)
+			}
+			sch.pattern, err = regexp.Compile(s)
+		case "minimum":
+			sch.minimum, err = schemaNumber(k, v)
+		case "maximum":
+			sch.maximum, err = schemaNumber(k, v)
+		case "exclusiveMinimum":
+			sch.exclMin, err = schemaNumber(k, v)
+		case "exclusiveMaximum":
+			sch.exclMax, err = schemaNumber(k, v)
+		case "allOf":
+			sch.allOf, err = compileSchemas(k, v)
+		case "anyOf":
+			sch.anyOf, err = compileSchemas(k, v)
+		case "oneOf":
+			sch.oneOf, err = compileSchemas(k, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sch, nil
+}
+
+func compileSchemas(k string, v interface{}) ([]*jsonSchema, error) {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected %s to be an array, got %T", k, v)
+	}
+	schs := make([]*jsonSchema, 0, len(arr))
+	for _, e := range arr {
+		sch, err := compileSchema(e)
+		if err != nil {
+			return nil, err
+		}
+		schs = append(schs, sch)
+	}
+	return schs, nil
+}
+
+func schemaNumber(k string, v interface{}) (*float64, error) {
+	f, ok := v.(float64)
+	if !ok {
+		return nil, fmt.Errorf("expected %s to be a number, got %T", k, v)
+	}
+	return &f, nil
+}
+
+func schemaInt(k string, v interface{}) (int, error) {
+	f, ok := v.(float64)
+	if !ok || f < 0 || f != math.Trunc(f) {
+		return 0, fmt.Errorf("expected %s to be a positive integer, got %v", k, v)
+	}
+	return int(f), nil
+}
+
+// schemaType returns the JSON type of a value decoded with encoding/json.
+func schemaType(v interface{}) string {
+	switch vv := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if vv == math.Trunc(vv) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// validate returns an error if the value does not match the schema, path
+// being where the value is in the payload.
+func (sch *jsonSchema) validate(v interface{}, path string) error {
+	if sch.never {
+		return fmt.Errorf("%s is not allowed", path)
+	}
+	if len(sch.types) > 0 {
+		t, ok := schemaType(v), false
+		for _, st := range sch.types {
+			if st == t || (st == "number" && t == "integer") {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s is of type %s, expected %s", path, t, strings.Join(sch.types, " or "))
+		}
+	}
+	if sch.enum != nil {
+		ok := false
+		for _, e := range sch.enum {
+			if schemaEqual(e, v) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s is not one of the allowed values", path)
+		}
+	}
+	switch vv := v.(type) {
+	case map[string]interface{}:
+		for _, name := range sch.required {
+			if _, ok := vv[name]; !ok {
+				return fmt.Errorf("%s is missing property %q", path, name)
+			}
+		}
+		for name, pv := range vv {
+			psch := sch.properties[name]
+			if psch == nil {
+				psch = sch.additional
+			}
+			if psch != nil {
+				if err := psch.validate(pv, path+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		if len(vv) < sch.minItems || (sch.maxItems >= 0 && len(vv) > sch.maxItems) {
+			return fmt.Errorf("%s has %d items", path, len(vv))
+		}
+		if sch.items != nil {
+			for i, e := range vv {
+				if err := sch.items.validate(e, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(vv)
+		if n < sch.minLength || (sch.maxLength >= 0 && n > sch.maxLength) {
+			return fmt.Errorf("%s has %d characters", path, n)
+		}
+		if sch.pattern != nil && !sch.pattern.MatchString(vv) {
+			return fmt.Errorf("%s does not match pattern %q", path, sch.pattern)
+		}
+	case float64:
+		if (sch.minimum != nil && vv < *sch.minimum) || (sch.maximum != nil && vv > *sch.maximum) ||
+			(sch.exclMin != nil && vv <= *sch.exclMin) || (sch.exclMax != nil && vv >= *sch.exclMax) {
+			return fmt.Errorf("%s is out of range", path)
+		}
+	}
+	for _, s := range sch.allOf {
+		if err := s.validate(v, path); err != nil {
+			return err
+		}
+	}
+	if len(sch.anyOf) > 0 {
+		ok := false
+		for _, s := range sch.anyOf {
+			if s.validate(v, path) == nil {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s does not match any of the schemas", path)
+		}
+	}
+	if len(sch.oneOf) > 0 {
+		n := 0
+		for _, s := range sch.oneOf {
+			if s.validate(v, path) == nil {
+				n++
+			}
+		}
+		if n != 1 {
+			return fmt.Errorf("%s matches %d of the schemas, expected one", path, n)
+		}
+	}
+	return nil
+}
+
+// schemaEqual compares two values decoded with encoding/json.
+func schemaEqual(a, b interface{}) bool {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for k, e := range av {
+			if f, ok := bv[k]; !ok || !schemaEqual(e, f) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !schemaEqual(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
@@ -0,0 +1,226 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+const testOrderSchema = `{
+	"type": "object",
+	"required": ["id", "qty"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "string", "pattern": "^[a-z]+-[0-9]+$"},
+		"qty": {"type": "integer", "minimum": 1, "maximum": 100},
+		"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "maxItems": 2},
+		"note": {"anyOf": [{"type": "null"}, {"type": "string", "maxLength": 5}]}
+	}
+}`
+
+func TestSchemaValidationConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		schema_validation {
+			registry: "http://127.0.0.1:8080/schemas/"
+			refresh: "1m"
+			policy: TAG
+			subjects: [
+				{subject: "orders.>", schema: "order.json"}
+			]
+		}
+		accounts { A { schema_policy: none } }
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	sv := opts.SchemaValidation
+	if sv == nil || sv.Registry != "http://127.0.0.1:8080/schemas/" || sv.Refresh != time.Minute ||
+		sv.Policy != SchemaPolicyTag || len(sv.Subjects) != 1 || *sv.Subjects[0] != (SubjectSchema{"orders.>", "order.json"}) {
+		t.Fatalf("Unexpected schema validation: %+v", sv)
+	}
+	if len(opts.Accounts) != 1 || opts.Accounts[0].schemaPolicy != SchemaPolicyNone {
+		t.Fatalf("Expected account schema policy to be set")
+	}
+
+	for _, test := range []struct {
+		conf string
+		err  string
+	}{
+		{`schema_validation { registry: "ftp://host" }`, "must be an http or https URL"},
+		{`schema_validation { registry: "http://host", policy: drop }`, "invalid schema policy"},
+		{`schema_validation { registry: "http://host", subjects: [{subject: "foo..bar", schema: "s"}] }`, "invalid schema subject"},
+		{`schema_validation { registry: "http://host", subjects: [{subject: "foo"}] }`, "missing schema"},
+		{`accounts { A { schema_policy: drop } }`, "invalid schema policy"},
+	} {
+		conf := createConfFile(t, []byte(test.conf))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected error containing %q for %s, got %v", test.err, test.conf, err)
+		}
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(testOrderSchema), &v); err != nil {
+		t.Fatalf("Error unmarshalling schema: %v", err)
+	}
+	sch, err := compileSchema(v)
+	if err != nil {
+		t.Fatalf("Error compiling schema: %v", err)
+	}
+	for _, test := range []struct {
+		payload string
+		err     string
+	}{
+		{`{"id": "abc-1", "qty": 1}`, ""},
+		{`{"id": "abc-1", "qty": 100, "tags": ["a", "b"], "note": null}`, ""},
+		{`{"id": "abc-1", "qty": 2, "note": "short"}`, ""},
+		{`[1, 2]`, "$ is of type array"},
+		{`{"id": "abc-1"}`, `missing property "qty"`},
+		{`{"id": "abc", "qty": 1}`, "$.id does not match pattern"},
+		{`{"id": "abc-1", "qty": 1.5}`, "$.qty is of type number"},
+		{`{"id": "abc-1", "qty": 101}`, "$.qty is out of range"},
+		{`{"id": "abc-1", "qty": 1, "tags": ["c"]}`, "$.tags[0] is not one of the allowed values"},
+		{`{"id": "abc-1", "qty": 1, "tags": ["a", "a", "a"]}`, "$.tags has 3 items"},
+		{`{"id": "abc-1", "qty": 1, "note": "too long"}`, "$.note does not match any"},
+		{`{"id": "abc-1", "qty": 1, "other": 1}`, "$.other is not allowed"},
+	} {
+		var v interface{}
+		if err := json.Unmarshal([]byte(test.payload), &v); err != nil {
+			t.Fatalf("Error unmarshalling %s: %v", test.payload, err)
+		}
+		err := sch.validate(v, "$")
+		if test.err == _EMPTY_ && err != nil {
+			t.Fatalf("Expected %s to be valid, got %v", test.payload, err)
+		} else if test.err != _EMPTY_ && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Fatalf("Expected error containing %q for %s, got %v", test.err, test.payload, err)
+		}
+	}
+}
+
+func TestSchemaValidation(t *testing.T) {
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/schemas/order.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(testOrderSchema))
+	}))
+	defer registry.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		accounts {
+			SYS { users: [{user: sys, password: pwd}] }
+			A { users: [{user: a, password: pwd}] }
+			B { users: [{user: b, password: pwd}], schema_policy: tag }
+			C { users: [{user: c, password: pwd}], schema_policy: none }
+		}
+		schema_validation {
+			registry: "%s/schemas"
+			subjects: [
+				{subject: "orders.*", schema: "order.json"}
+				{subject: "missing", schema: "missing.json"}
+			]
+		}
+	`, registry.URL)))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if _, sch := s.schemas.lookup("orders.new"); sch == nil {
+			return fmt.Errorf("Schema not fetched yet")
+		}
+		return nil
+	})
+
+	ncs := natsConnect(t, fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port))
+	defer ncs.Close()
+	advs := natsSubSync(t, ncs, fmt.Sprintf(schemaViolationEventSubj, "*"))
+	natsFlush(t, ncs)
+
+	valid, invalid := []byte(`{"id": "abc-1", "qty": 1}`), []byte(`{"id": "abc-1"}`)
+	for _, test := range []struct {
+		user      string
+		delivered bool
+		advisory  bool
+	}{
+		{"a", false, true},
+		{"b", true, true},
+		{"c", true, false},
+	} {
+		nc := natsConnect(t, fmt.Sprintf("nats://%s:pwd@%s:%d", test.user, opts.Host, opts.Port))
+		sub := natsSubSync(t, nc, ">")
+		natsFlush(t, nc)
+
+		natsPub(t, nc, "orders.new", valid)
+		natsPub(t, nc, "orders.new", invalid)
+		// Subjects without a schema, or whose schema could not be fetched,
+		// are not validated.
+		natsPub(t, nc, "missing", invalid)
+		natsPub(t, nc, "other", invalid)
+		natsFlush(t, nc)
+
+		expected := []string{"orders.new", "missing", "other"}
+		if test.delivered {
+			expected = []string{"orders.new", "orders.new", "missing", "other"}
+		}
+		for _, subj := range expected {
+			if m := natsNexMsg(t, sub, time.Second); m.Subject != subj {
+				t.Fatalf("Expected message on %q, got %q", subj, m.Subject)
+			}
+		}
+		if m, err := sub.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+			t.Fatalf("Unexpected message for %q: %v, %v", test.user, m, err)
+		}
+
+		if test.advisory {
+			m := natsNexMsg(t, advs, time.Second)
+			adv := SchemaViolationEventMsg{}
+			if err := json.Unmarshal(m.Data, &adv); err != nil {
+				t.Fatalf("Error unmarshalling advisory: %v", err)
+			}
+			if adv.Subject != "orders.new" || adv.Schema != "order.json" || adv.ClientID == 0 ||
+				!strings.Contains(adv.Error, `missing property "qty"`) {
+				t.Fatalf("Unexpected advisory: %+v", adv)
+			}
+		} else if m, err := advs.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+			t.Fatalf("Unexpected advisory for %q: %v, %v", test.user, m, err)
+		}
+		nc.Close()
+	}
+
+	v, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error on varz: %v", err)
+	}
+	if v.SchemaViolations != 2 {
+		t.Fatalf("Expected 2 schema violations, got %d", v.SchemaViolations)
+	}
+}
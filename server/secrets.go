@@ -0,0 +1,271 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum time allowed for a secret source to return a secret.
+	secretFetchTimeout = 5 * time.Second
+
+	// Environment variable holding the token sent to HTTP secret sources.
+	secretHTTPTokenEnv = "VAULT_TOKEN"
+)
+
+// SecretSource returns the secret designated by a reference. The reference
+// is what follows `<scheme>://` in the configuration, except for HTTP
+// sources that receive the full URL.
+type SecretSource interface {
+	FetchSecret(ref string) ([]byte, error)
+}
+
+// SecretSourceFunc is an adapter to use a function as a SecretSource.
+type SecretSourceFunc func(ref string) ([]byte, error)
+
+// FetchSecret implements SecretSource.
+func (f SecretSourceFunc) FetchSecret(ref string) ([]byte, error) {
+	return f(ref)
+}
+
+var secretSources = struct {
+	sync.RWMutex
+	m map[string]SecretSource
+}{
+	m: map[string]SecretSource{
+		"file":  SecretSourceFunc(fileSecret),
+		"env":   SecretSourceFunc(envSecret),
+		"exec":  SecretSourceFunc(execSecret),
+		"http":  SecretSourceFunc(httpSecret),
+		"https": SecretSourceFunc(httpSecret),
+	},
+}
+
+// RegisterSecretSource registers a source for secrets referenced in the
+// configuration as `<scheme>://<ref>`. It replaces any source previously
+// registered for this scheme, including the built-in ones.
+func RegisterSecretSource(scheme string, src SecretSource) {
+	secretSources.Lock()
+	secretSources.m[strings.ToLower(scheme)] = src
+	secretSources.Unlock()
+}
+
+// resolveSecret returns the secret designated by a `<scheme>://<ref>`
+// reference.
+func resolveSecret(ref string) ([]byte, error) {
+	i := strings.Index(ref, "://")
+	if i <= 0 {
+		return nil, fmt.Errorf("invalid secret reference %q, expected <scheme>://<ref>", ref)
+	}
+	scheme := strings.ToLower(ref[:i])
+	secretSources.RLock()
+	src := secretSources.m[scheme]
+	secretSources.RUnlock()
+	if src == nil {
+		return nil, fmt.Errorf("unknown secret source %q", scheme)
+	}
+	if scheme != "http" && scheme != "https" {
+		ref = ref[i+3:]
+	}
+	secret, err := src.FetchSecret(ref)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching secret from %q source: %v", scheme, err)
+	}
+	return secret, nil
+}
+
+// fileSecret returns the content of a file, such as the ones mounted
+// by an orchestrator on a memory backed file system.
+func fileSecret(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+// envSecret returns the value of an environment variable.
+func envSecret(name string) ([]byte, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %q not set", name)
+	}
+	return []byte(v), nil
+}
+
+// execSecret returns the standard output of a command.
+func execSecret(cmdline string) ([]byte, error) {
+	args := strings.Fields(cmdline)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no command specified")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// httpSecret returns the body of a GET request. If the VAULT_TOKEN
+// environment variable is set, it is sent in the `X-Vault-Token` header.
+// If the URL has a fragment, the response is expected to be a JSON object
+// and the secret is the string value of that field, looked up in `data.data`
+// and `data` first, as returned by Vault KV version 2 and 1 engines.
+func httpSecret(ref string) ([]byte, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	field := u.Fragment
+	u.Fragment = _EMPTY_
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv(secretHTTPTokenEnv); token != _EMPTY_ {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := (&http.Client{Timeout: secretFetchTimeout}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	if field == _EMPTY_ {
+		return body, nil
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("error parsing response: %v", err)
+	}
+	for _, obj := range []map[string]interface{}{nestedJSONObject(m, "data", "data"), nestedJSONObject(m, "data"), m} {
+		if v, ok := obj[field].(string); ok {
+			return []byte(v), nil
+		}
+	}
+	return nil, fmt.Errorf("field %q not found in response", field)
+}
+
+// nestedJSONObject returns the JSON object found following the given keys,
+// or nil if there is none.
+func nestedJSONObject(m map[string]interface{}, keys ...string) map[string]interface{} {
+	for _, k := range keys {
+		m, _ = m[k].(map[string]interface{})
+	}
+	return m
+}
+
+// startSecretsRefresh starts the routine that periodically fetches the
+// secrets referenced in the configuration file and reloads the
+// configuration when one of them has changed. It does nothing if already
+// started or if no secret is referenced.
+func (s *Server) startSecretsRefresh() {
+	opts := s.getOpts()
+	if len(opts.secretRefs) == 0 || opts.SecretsRefresh <= 0 {
+		return
+	}
+	s.mu.Lock()
+	if s.secretsRefreshStarted || s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+	s.secretsRefreshStarted = true
+	s.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		digests := secretDigests(opts.secretRefs, nil)
+		for {
+			opts = s.getOpts()
+			if opts.SecretsRefresh <= 0 {
+				s.mu.Lock()
+				s.secretsRefreshStarted = false
+				s.mu.Unlock()
+				return
+			}
+			select {
+			case <-time.After(opts.SecretsRefresh):
+			case <-s.quitCh:
+				return
+			}
+			if !s.refreshSecrets(digests) {
+				continue
+			}
+			s.Noticef("Secrets referenced in the configuration have changed, reloading")
+			if err := s.Reload(); err != nil {
+				s.Errorf("Error reloading configuration after a secret change: %v", err)
+			}
+			digests = secretDigests(s.getOpts().secretRefs, nil)
+		}
+	})
+}
+
+// refreshSecrets fetches the secrets referenced in the configuration and
+// returns true if any of them differs from the given digests. Secrets that
+// can't be fetched are reported and considered unchanged.
+func (s *Server) refreshSecrets(digests map[string][sha256.Size]byte) bool {
+	changed := false
+	secretDigests(s.getOpts().secretRefs, func(ref string, d [sha256.Size]byte, err error) {
+		if err != nil {
+			s.Warnf("Unable to refresh secret: %v", err)
+			return
+		}
+		if prev, ok := digests[ref]; !ok || prev != d {
+			changed = true
+		}
+	})
+	return changed
+}
+
+// secretDigests fetches the secrets designated by refs and returns their
+// digests, invoking cb, if not nil, for each of them.
+func secretDigests(refs []string, cb func(ref string, d [sha256.Size]byte, err error)) map[string][sha256.Size]byte {
+	digests := make(map[string][sha256.Size]byte, len(refs))
+	for _, ref := range refs {
+		secret, err := resolveSecret(ref)
+		var d [sha256.Size]byte
+		if err == nil {
+			d = sha256.Sum256(secret)
+			digests[ref] = d
+		}
+		if cb != nil {
+			cb(ref, d, err)
+		}
+	}
+	return digests
+}
@@ -0,0 +1,209 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSecretSources(t *testing.T) {
+	f, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("from_file")
+	f.Close()
+
+	os.Setenv("NATS_TEST_SECRET", "from_env")
+	defer os.Unsetenv("NATS_TEST_SECRET")
+	os.Setenv(secretHTTPTokenEnv, "s3cr3t")
+	defer os.Unsetenv(secretHTTPTokenEnv)
+
+	hs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s3cr3t" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/raw":
+			w.Write([]byte("from_http"))
+		case "/v1/secret/data/nats":
+			w.Write([]byte(`{"data":{"data":{"password":"from_vault"},"metadata":{"version":1}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer hs.Close()
+
+	RegisterSecretSource("test", SecretSourceFunc(func(ref string) ([]byte, error) {
+		return []byte("from_" + ref), nil
+	}))
+	defer func() {
+		secretSources.Lock()
+		delete(secretSources.m, "test")
+		secretSources.Unlock()
+	}()
+
+	for _, test := range []struct {
+		ref      string
+		expected string
+		err      string
+	}{
+		{"file://" + f.Name(), "from_file", ""},
+		{"env://NATS_TEST_SECRET", "from_env", ""},
+		{"exec://echo -n from_exec", "from_exec", ""},
+		{hs.URL + "/raw", "from_http", ""},
+		{hs.URL + "/v1/secret/data/nats#password", "from_vault", ""},
+		{"test://custom", "from_custom", ""},
+		{"env://NATS_TEST_MISSING_SECRET", "", "not set"},
+		{hs.URL + "/missing", "", "404"},
+		{hs.URL + "/v1/secret/data/nats#user", "", "not found"},
+		{"exec://false", "", "exit status"},
+		{"unknown://foo", "", "unknown secret source"},
+		{"foo", "", "invalid secret reference"},
+	} {
+		t.Run(test.ref, func(t *testing.T) {
+			secret, err := resolveSecret(test.ref)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(secret) != test.expected {
+				t.Fatalf("Expected secret %q, got %q", test.expected, secret)
+			}
+		})
+	}
+}
+
+func TestConfigSecrets(t *testing.T) {
+	os.Setenv("NATS_TEST_PASS", "env_pass")
+	defer os.Unsetenv("NATS_TEST_PASS")
+
+	pf, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	defer os.Remove(pf.Name())
+	pf.WriteString("file_pass\n")
+	pf.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		secrets_refresh: "1m"
+		tls {
+			cert_file: { secret: "file://../test/configs/certs/server-cert.pem" }
+			key_file: { secret: "exec://cat ../test/configs/certs/server-key.pem" }
+		}
+		authorization {
+			users = [
+				{user: alice, password: { secret: "env://NATS_TEST_PASS" }}
+				{user: bob, password: { secret: "file://%s" }}
+			]
+		}
+	`, pf.Name())))
+	defer os.Remove(conf)
+
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if opts.SecretsRefresh != time.Minute {
+		t.Fatalf("Expected secrets_refresh of 1m, got %v", opts.SecretsRefresh)
+	}
+	if opts.TLSConfig == nil || len(opts.TLSConfig.Certificates) != 1 {
+		t.Fatalf("Expected TLS certificate to be loaded, got %+v", opts.TLSConfig)
+	}
+	pass := map[string]string{}
+	for _, u := range opts.Users {
+		pass[u.Username] = u.Password
+	}
+	if pass["alice"] != "env_pass" || pass["bob"] != "file_pass" {
+		t.Fatalf("Unexpected passwords: %v", pass)
+	}
+	if len(opts.secretRefs) != 4 {
+		t.Fatalf("Expected 4 secret references, got %v", opts.secretRefs)
+	}
+
+	conf = createConfFile(t, []byte(`
+		authorization {
+			user: alice
+			password: { secret: "env://NATS_TEST_MISSING_PASS" }
+		}
+	`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "not set") {
+		t.Fatalf("Expected error about missing secret, got %v", err)
+	}
+}
+
+func TestSecretsRefreshReload(t *testing.T) {
+	pf, err := ioutil.TempFile("", "secret")
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	defer os.Remove(pf.Name())
+	pf.WriteString("pass1")
+	pf.Close()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		secrets_refresh: "50ms"
+		authorization {
+			user: alice
+			password: { secret: "file://%s" }
+		}
+	`, pf.Name())))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://127.0.0.1:%d", opts.Port)
+	nc, err := nats.Connect(url, nats.UserInfo("alice", "pass1"))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	nc.Close()
+
+	if err := ioutil.WriteFile(pf.Name(), []byte("pass2"), 0600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	checkFor(t, 2*time.Second, 20*time.Millisecond, func() error {
+		nc, err := nats.Connect(url, nats.UserInfo("alice", "pass2"))
+		if err != nil {
+			return err
+		}
+		nc.Close()
+		return nil
+	})
+	if nc, err := nats.Connect(url, nats.UserInfo("alice", "pass1")); err == nil {
+		nc.Close()
+		t.Fatal("Expected old password to be rejected")
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -31,6 +32,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	// Allow dynamic profiling.
@@ -60,11 +62,11 @@ var lameDuckModeInitialDelay = int64(lameDuckModeDefaultInitialDelay)
 type Info struct {
 	ID                string   `json:"server_id"`
 	Name              string   `json:"server_name"`
-	Version           string   `json:"version"`
+	Version           string   `json:"version,omitempty"`
 	Proto             int      `json:"proto"`
 	GitCommit         string   `json:"git_commit,omitempty"`
-	GoVersion         string   `json:"go"`
-	Host              string   `json:"host"`
+	GoVersion         string   `json:"go,omitempty"`
+	Host              string   `json:"host,omitempty"`
 	Port              int      `json:"port"`
 	AuthRequired      bool     `json:"auth_required,omitempty"`
 	TLSRequired       bool     `json:"tls_required,omitempty"`
@@ -76,10 +78,31 @@ type Info struct {
 	Nonce             string   `json:"nonce,omitempty"`
 	Cluster           string   `json:"cluster,omitempty"`
 	ClientConnectURLs []string `json:"connect_urls,omitempty"` // Contains URLs a client can connect to.
+	// ConnectLoads has the load score of the server of each connect URL,
+	// when known, so that clients can prefer less loaded servers.
+	ConnectLoads map[string]int `json:"connect_loads,omitempty"`
 
 	// Route Specific
 	Import *SubjectPermission `json:"import,omitempty"`
 	Export *SubjectPermission `json:"export,omitempty"`
+	Nkey   string             `json:"nkey,omitempty"` // Server nkey of the accepting side (sent by route's INFO)
+	Sig    string             `json:"sig,omitempty"`  // Signature of the soliciting side's nonce (sent by route's INFO)
+
+	// LNOC is set by routes and gateways that accept messages tagged with
+	// the cluster of the leaf node they come from (LMSG).
+	LNOC bool `json:"lnoc,omitempty"`
+
+	// PingTS is set by routes and gateways that accept a timestamp in the
+	// PING protocol, used to estimate the clock skew between servers.
+	PingTS bool `json:"ping_ts,omitempty"`
+
+	// LoadScore is the load of the server, from 0 to 100, periodically
+	// sent to the routes.
+	LoadScore *int `json:"load_score,omitempty"`
+
+	// ConnectURLsUpdate is set in the INFO sent to routes when the connect
+	// URLs of the server changed, see advertise_resolve_interval.
+	ConnectURLsUpdate bool `json:"connect_urls_update,omitempty"`
 
 	// Gateways Specific
 	Gateway           string   `json:"gateway,omitempty"`             // Name of the origin Gateway (sent by gateway's INFO)
@@ -91,54 +114,104 @@ type Info struct {
 
 	// LeafNode Specific
 	LeafNodeURLs []string `json:"leafnode_urls,omitempty"` // LeafNode URLs that the server can reconnect to.
+
+	// LameDuckMode is set in the INFO sent to clients to ask them to
+	// reconnect to another server.
+	LameDuckMode bool `json:"ldm,omitempty"`
+
+	// Compression is the compression that clients can enable in CONNECT.
+	Compression string `json:"compression,omitempty"`
+
+	// Features are the protocol features offered by the server.
+	Features Feature `json:"features,omitempty"`
 }
 
 // Server is our main struct.
 type Server struct {
 	gcid uint64
 	stats
-	mu               sync.Mutex
-	kp               nkeys.KeyPair
-	prand            *rand.Rand
-	info             Info
-	configFile       string
-	optsMu           sync.RWMutex
-	opts             *Options
-	running          bool
-	shutdown         bool
-	listener         net.Listener
-	gacc             *Account
-	sys              *internal
-	accounts         sync.Map
-	tmpAccounts      sync.Map // Temporarily stores accounts that are being built
-	activeAccounts   int32
-	accResolver      AccountResolver
-	clients          map[uint64]*client
-	routes           map[uint64]*client
-	routesByHash     sync.Map
-	hash             []byte
-	remotes          map[string]*client
-	leafs            map[uint64]*client
-	users            map[string]*User
-	nkeys            map[string]*NkeyUser
-	totalClients     uint64
-	closed           *closedRingBuffer
-	done             chan bool
-	start            time.Time
-	http             net.Listener
-	httpHandler      http.Handler
-	profiler         net.Listener
-	httpReqStats     map[string]uint64
-	routeListener    net.Listener
-	routeInfo        Info
-	routeInfoJSON    []byte
-	leafNodeListener net.Listener
-	leafNodeInfo     Info
-	leafNodeInfoJSON []byte
-	leafNodeOpts     struct {
+	lockProbe             int64
+	schedLatency          int64
+	goroutines            subsystemGoroutines
+	pendingAuths          [LEAF + 1]int64
+	latency               latencyStats
+	traffic               trafficStats
+	schemas               schemaValidation
+	acceptLoops           acceptLoops
+	watchdogStarted       bool
+	watermarksStarted     bool
+	usageStarted          bool
+	rateGuards            subjectRateGuards
+	subjectLimits         subjectLimits
+	certs                 certExpiries
+	retries               connectRetries
+	rates                 rollingRates
+	containerLimits       *ContainerLimits
+	interceptors          []*messageInterceptor
+	memPressure           int32
+	memPressureChecks     int
+	memMonStarted         bool
+	overloaded            int32
+	fdExhaustedLast       time.Time
+	admissionStarted      bool
+	advResolveStarted     bool
+	authBans              authBans
+	secretsRefreshStarted bool
+	mu                    sync.Mutex
+	kp                    nkeys.KeyPair
+	prand                 *rand.Rand
+	info                  Info
+	configFile            string
+	optsMu                sync.RWMutex
+	opts                  *Options
+	running               bool
+	shutdown              bool
+	listener              net.Listener
+	reuseListeners        []net.Listener
+	scanners              scannerResponses
+	inherited             map[string]net.Listener
+	upgrading             bool
+	gacc                  *Account
+	sys                   *internal
+	accounts              sync.Map
+	tmpAccounts           sync.Map // Temporarily stores accounts that are being built
+	activeAccounts        int32
+	accResolver           AccountResolver
+	clients               map[uint64]*client
+	durables              map[string]*durableConn
+	uniqueConns           map[string]*client
+	routes                map[uint64]*client
+	routesByHash          sync.Map
+	hash                  []byte
+	remotes               map[string]*client
+	leafs                 map[uint64]*client
+	users                 map[string]*User
+	nkeys                 map[string]*NkeyUser
+	oidc                  *oidcValidator
+	policy                atomic.Value
+	joinTokens            joinTokenTracker
+	totalClients          uint64
+	closed                *closedRingBuffer
+	done                  chan bool
+	start                 time.Time
+	http                  net.Listener
+	httpTCP               net.Listener // http before being wrapped for TLS
+	httpHandler           http.Handler
+	profiler              net.Listener
+	httpReqStats          map[string]uint64
+	routeListener         net.Listener
+	routeInfo             Info
+	routeInfoJSON         []byte
+	leafNodeListener      net.Listener
+	leafNodeInfo          Info
+	leafNodeInfoJSON      []byte
+	stompListener         net.Listener
+	grpcListener          net.Listener
+	leafNodeOpts          struct {
 		resolver    netResolver
 		dialTimeout time.Duration
 	}
+	dialState dialEndpoints
 
 	quitCh           chan struct{}
 	shutdownComplete chan struct{}
@@ -158,6 +231,8 @@ type Server struct {
 		trace       int32
 		debug       int32
 		traceSysAcc bool
+		// Levels set at runtime for the connections of each kind.
+		kinds [LEAF + 1]int32
 	}
 
 	clientConnectURLs []string
@@ -167,6 +242,12 @@ type Server struct {
 
 	lastCURLsUpdate int64
 
+	// Batch of connect URLs updates pending when they are damped.
+	curlsDamping connectURLsDamping
+
+	// Last load score of this server reported to the routes, -1 if none.
+	loadScoreLast int
+
 	// For Gateways
 	gatewayListener net.Listener // Accept listener
 	gateway         *srvGateway
@@ -180,6 +261,32 @@ type Server struct {
 	ldm   bool
 	ldmCh chan bool
 
+	// Set while new client connections are not accepted.
+	acceptPaused    time.Time
+	acceptPausedErr string
+
+	// Time of the last state snapshot, to rate limit them.
+	lastStateSnapshot time.Time
+
+	// Lifecycle hooks registered by embedders.
+	hooks          lifecycleHooks
+	listenersReady bool
+
+	// Interest restored from a snapshot, and serialization of its saving.
+	primed   *primedInterest
+	snapMu   sync.Mutex
+	snapTime time.Time
+
+	// Sessions migrated to this server, and the expiration of the ones
+	// migrated away from it.
+	migrated     map[string]*heldSession
+	migratedAway map[string]time.Time
+
+	// Memory profile state, restored or released on shutdown.
+	ballast       []byte
+	prevGCPercent int
+	gcPercentSet  bool
+
 	// Trusted public operator keys.
 	trustedKeys []string
 
@@ -212,6 +319,41 @@ type stats struct {
 	inBytes       int64
 	outBytes      int64
 	slowConsumers int64
+	memUsed       int64
+
+	subjectLimitViolations int64
+	protoStateViolations   int64
+	scannerProbes          int64
+	admissionRejected      int64
+	suppressedLoops        int64
+	suspendDropped         int64
+	fdExhaustedErrs        int64
+	handshakeFailures      int64
+
+	// Bytes of the compressed client connections.
+	compression compressionCounters
+}
+
+// subjectLimits are the limits on subjects used by clients, enforced by
+// the parser. A value of 0 means no limit.
+type subjectLimits struct {
+	maxLen    int32
+	maxTokens int32
+	maxReply  int32
+	// Set to 1 when the protocol of clients is strictly validated.
+	strict int32
+}
+
+// setSubjectLimits sets the subject limits from the options.
+func (s *Server) setSubjectLimits(opts *Options) {
+	atomic.StoreInt32(&s.subjectLimits.maxLen, opts.MaxSubjectLength)
+	atomic.StoreInt32(&s.subjectLimits.maxTokens, opts.MaxSubjectTokens)
+	atomic.StoreInt32(&s.subjectLimits.maxReply, opts.MaxReplyLength)
+	var strict int32
+	if opts.StrictProtocol {
+		strict = 1
+	}
+	atomic.StoreInt32(&s.subjectLimits.strict, strict)
 }
 
 // New will setup a new server struct after parsing the options.
@@ -260,6 +402,8 @@ func NewServer(opts *Options) (*Server, error) {
 		TLSRequired:  tlsReq,
 		TLSVerify:    verify,
 		MaxPayload:   opts.MaxPayload,
+		Compression:  opts.Compression,
+		Features:     serverFeatures(opts),
 	}
 
 	now := time.Now()
@@ -288,6 +432,7 @@ func NewServer(opts *Options) (*Server, error) {
 
 	// Used internally for quick look-ups.
 	s.clientConnectURLsMap = make(map[string]struct{})
+	s.loadScoreLast = -1
 
 	// Call this even if there is no gateway defined. It will
 	// initialize the structure so we don't have to check for
@@ -307,7 +452,9 @@ func NewServer(opts *Options) (*Server, error) {
 	s.setInfoHostPortAndGenerateJSON()
 
 	// For tracking clients
-	s.clients = make(map[uint64]*client)
+	s.clients = make(map[uint64]*client, opts.memoryProfile().conns)
+	s.durables = make(map[string]*durableConn)
+	s.uniqueConns = make(map[string]*client)
 
 	// For tracking closed clients.
 	s.closed = newClosedRingBuffer(opts.MaxClosedClients)
@@ -341,47 +488,35 @@ func NewServer(opts *Options) (*Server, error) {
 	if ar := opts.AccountResolver; ar != nil {
 		if ur, ok := ar.(*URLAccResolver); ok {
 			if _, err := ur.Fetch(""); err != nil {
-				return nil, err
+				// With a cache, accounts can be served while it is down.
+				if opts.ResolverCache == nil {
+					return nil, err
+				}
+				s.Warnf("Account resolver not reachable, using its cache: %v", err)
 			}
 		}
 	}
 
 	// In local config mode, check that leafnode configuration
 	// refers to account that exist.
-	if len(opts.TrustedOperators) == 0 {
-		checkAccountExists := func(accName string) error {
-			if accName == _EMPTY_ {
-				return nil
-			}
-			if _, ok := s.accounts.Load(accName); !ok {
-				return fmt.Errorf("cannot find account %q specified in leafnode authorization", accName)
-			}
-			return nil
-		}
-		if err := checkAccountExists(opts.LeafNode.Account); err != nil {
-			return nil, err
-		}
-		for _, lu := range opts.LeafNode.Users {
-			if lu.Account == nil {
-				continue
-			}
-			if err := checkAccountExists(lu.Account.Name); err != nil {
-				return nil, err
-			}
-		}
-		for _, r := range opts.LeafNode.Remotes {
-			if r.LocalAccount == _EMPTY_ {
-				continue
-			}
-			if _, ok := s.accounts.Load(r.LocalAccount); !ok {
-				return nil, fmt.Errorf("no local account %q for remote leafnode", r.LocalAccount)
-			}
-		}
+	if err := validateLeafNodeAccounts(opts, func(accName string) bool {
+		_, ok := s.accounts.Load(accName)
+		return ok
+	}); err != nil {
+		return nil, err
 	}
 
 	// Used to setup Authorization.
 	s.configureAuthorization()
 
+	s.rateGuards.setLimits(opts.SubjectRateLimits)
+	s.setSubjectLimits(opts)
+	if opts.ContainerLimits {
+		s.containerLimits = detectedContainerLimits()
+	}
+	s.setLatencySampling(opts.LatencySampling)
+	s.interceptors = newMessageInterceptors(opts)
+
 	// Start signal handler
 	s.handleSignals()
 
@@ -405,11 +540,113 @@ func validateOptions(o *Options) error {
 	if err := validateTrustedOperators(o); err != nil {
 		return err
 	}
+	if o.AccountTemplate != nil && o.AccountResolver == nil {
+		return fmt.Errorf("account template requires an account resolver to be configured")
+	}
 	// Check on leaf nodes which will require a system
 	// account when gateways are also configured.
 	if err := validateLeafNode(o); err != nil {
 		return err
 	}
+	// Check that route nkey authentication is properly configured.
+	if err := validateClusterNkeys(o); err != nil {
+		return err
+	}
+	if err := validateConnectURLsOrder(o); err != nil {
+		return err
+	}
+	if err := validateConfigStrictness(o); err != nil {
+		return err
+	}
+	if err := validateFirehoseSubjects(o); err != nil {
+		return err
+	}
+	if err := o.SubscriptionEvents.validate(); err != nil {
+		return err
+	}
+	for _, l := range o.SubjectRateLimits {
+		if err := l.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateCompression(o); err != nil {
+		return err
+	}
+	if err := validateMemoryProfile(o); err != nil {
+		return err
+	}
+	if err := o.ResolverCache.validate(o); err != nil {
+		return err
+	}
+	if err := validateClusterName(o); err != nil {
+		return err
+	}
+	if err := o.OutboundDial.validate(); err != nil {
+		return err
+	}
+	if o.ClientAcceptors < 0 {
+		return fmt.Errorf("client_acceptors can't be negative")
+	}
+	for _, so := range []*SocketOpts{o.Socket, o.Cluster.Socket, o.Gateway.Socket, o.LeafNode.Socket} {
+		if err := so.validate(); err != nil {
+			return err
+		}
+	}
+	if err := o.Gateway.AccountEgress.validate(); err != nil {
+		return err
+	}
+	for _, rp := range []*RetryPolicy{o.Cluster.Retry, o.Gateway.Retry} {
+		if err := rp.validate(); err != nil {
+			return err
+		}
+	}
+	for _, r := range o.LeafNode.Remotes {
+		if err := r.Retry.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateProxies(o); err != nil {
+		return err
+	}
+	if err := o.JoinTokens.validate(); err != nil {
+		return err
+	}
+	if err := o.AcceptErrors.validate(); err != nil {
+		return err
+	}
+	if err := o.Suspend.validate(); err != nil {
+		return err
+	}
+	if err := o.Admission.validate(); err != nil {
+		return err
+	}
+	if err := o.AuthBan.validate(); err != nil {
+		return err
+	}
+	if err := o.GRPC.validate(); err != nil {
+		return err
+	}
+	if err := o.Policy.validate(); err != nil {
+		return err
+	}
+	if err := o.Watermarks.validate(); err != nil {
+		return err
+	}
+	if err := o.TrafficStats.validate(); err != nil {
+		return err
+	}
+	if err := o.SchemaValidation.validate(); err != nil {
+		return err
+	}
+	if err := o.UniqueConnections.validate(); err != nil {
+		return err
+	}
+	if err := o.WritePacing.validate(); err != nil {
+		return err
+	}
+	if o.Cluster.MaxControlLine < 0 || o.Gateway.MaxControlLine < 0 || o.LeafNode.MaxControlLine < 0 {
+		return fmt.Errorf("max_control_line can't be negative")
+	}
 	// Check that gateway is properly configured. Returns no error
 	// if there is no gateway defined.
 	return validateGatewayOptions(o)
@@ -517,7 +754,21 @@ func (s *Server) configureAccounts() error {
 // properly formed but do not enforce expiration etc.
 func (s *Server) configureResolver() error {
 	opts := s.getOpts()
+	prev := s.accResolver
 	s.accResolver = opts.AccountResolver
+	if opts.AccountResolver != nil && opts.ResolverCache != nil {
+		cr, err := newCachingAccResolver(opts.AccountResolver, opts.ResolverCache)
+		if err != nil {
+			return err
+		}
+		// Keep the accounts still to reconcile on reload.
+		if pcr, ok := prev.(*cachingAccResolver); ok {
+			for _, name := range pcr.takeStale() {
+				cr.stale[name] = struct{}{}
+			}
+		}
+		s.accResolver = cr
+	}
 	if opts.AccountResolver != nil {
 		// For URL resolver, set the TLSConfig if specified.
 		if opts.AccountResolverTLSConfig != nil {
@@ -528,17 +779,66 @@ func (s *Server) configureResolver() error {
 				}
 			}
 		}
-		if len(opts.resolverPreloads) > 0 {
-			if _, ok := s.accResolver.(*MemAccResolver); !ok {
-				return fmt.Errorf("resolver preloads only available for resolver type MEM")
-			}
-			for k, v := range opts.resolverPreloads {
-				_, err := jwt.DecodeAccountClaims(v)
-				if err != nil {
-					return fmt.Errorf("preload account error for %q: %v", k, err)
-				}
-				s.accResolver.Store(k, v)
-			}
+		if err := validateResolverPreloads(opts); err != nil {
+			return err
+		}
+		for k, v := range opts.resolverPreloads {
+			s.accResolver.Store(k, v)
+		}
+	}
+	return nil
+}
+
+// validateResolverPreloads checks that the resolver preloads are used with
+// a memory resolver and are valid account JWTs.
+func validateResolverPreloads(opts *Options) error {
+	if len(opts.resolverPreloads) == 0 {
+		return nil
+	}
+	// A resolver cache wraps the resolver, which is then no longer a MEM one.
+	if _, ok := opts.AccountResolver.(*MemAccResolver); !ok || opts.ResolverCache != nil {
+		return fmt.Errorf("resolver preloads only available for resolver type MEM")
+	}
+	for k, v := range opts.resolverPreloads {
+		if _, err := jwt.DecodeAccountClaims(v); err != nil {
+			return fmt.Errorf("preload account error for %q: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// validateLeafNodeAccounts checks, in local config mode, that the leafnode
+// configuration refers to accounts for which exists returns true.
+func validateLeafNodeAccounts(opts *Options, exists func(accName string) bool) error {
+	if len(opts.TrustedOperators) != 0 {
+		return nil
+	}
+	checkAccountExists := func(accName string) error {
+		if accName == _EMPTY_ {
+			return nil
+		}
+		if !exists(accName) {
+			return fmt.Errorf("cannot find account %q specified in leafnode authorization", accName)
+		}
+		return nil
+	}
+	if err := checkAccountExists(opts.LeafNode.Account); err != nil {
+		return err
+	}
+	for _, lu := range opts.LeafNode.Users {
+		if lu.Account == nil {
+			continue
+		}
+		if err := checkAccountExists(lu.Account.Name); err != nil {
+			return err
+		}
+	}
+	for _, r := range opts.LeafNode.Remotes {
+		if r.LocalAccount == _EMPTY_ {
+			continue
+		}
+		if !exists(r.LocalAccount) {
+			return fmt.Errorf("no local account %q for remote leafnode", r.LocalAccount)
 		}
 	}
 	return nil
@@ -610,6 +910,20 @@ func (s *Server) processTrustedKeys() bool {
 	return true
 }
 
+// validTrustedKeys returns whether the stamped or configured trusted
+// operator keys are valid, as processTrustedKeys would find them.
+func validTrustedKeys(opts *Options) bool {
+	if trustedKeys != "" {
+		return len(opts.TrustedKeys) == 0 && len(checkTrustedKeyString(trustedKeys)) > 0
+	}
+	for _, key := range opts.TrustedKeys {
+		if !nkeys.IsValidPublicOperatorKey(key) {
+			return false
+		}
+	}
+	return true
+}
+
 // checkTrustedKeyString will check that the string is a valid array
 // of public operator nkeys.
 func checkTrustedKeyString(keys string) []string {
@@ -1016,6 +1330,13 @@ func (s *Server) updateAccountWithClaimJWT(acc *Account, claimJWT string) error
 	accClaims, _, err := s.verifyAccountClaims(claimJWT)
 	if err == nil && accClaims != nil {
 		acc.claimJWT = claimJWT
+		// The claims replace those of the account template, if used.
+		acc.mu.Lock()
+		if acc.template {
+			acc.template = false
+			acc.Issuer = accClaims.Issuer
+		}
+		acc.mu.Unlock()
 		s.updateAccountClaims(acc, accClaims)
 		return nil
 	}
@@ -1091,23 +1412,33 @@ func (s *Server) fetchAccount(name string) (*Account, error) {
 		}
 		return acc, nil
 	}
-	return nil, err
+	return s.fetchTemplateAccount(name, err)
 }
 
 // Start up the server, this will block.
 // Start via a Go routine if needed.
 func (s *Server) Start() {
-	s.Noticef("Starting nats-server version %s", VERSION)
+	s.bannerf("Starting nats-server version %s", VERSION)
 	s.Debugf("Go build version %s", s.info.GoVersion)
 	gc := gitCommit
 	if gc == "" {
 		gc = "not set"
 	}
-	s.Noticef("Git commit [%s]", gc)
+	s.bannerf("Git commit [%s]", gc)
+
+	// Size GOMAXPROCS from the CPU limit of the container, if any.
+	s.applyContainerLimits()
+
+	// Tune the GC and allocate the memory ballast of the memory profile.
+	s.applyMemoryProfile()
 
 	// Check for insecure configurations.op
 	s.checkAuthforWarnings()
 
+	// Report the deprecated and unknown fields of the configuration file.
+	s.logConfigWarnings()
+	s.logMessageInterceptors()
+
 	// Avoid RACE between Start() and Shutdown()
 	s.mu.Lock()
 	s.running = true
@@ -1147,6 +1478,10 @@ func (s *Server) Start() {
 		}
 	}
 
+	// Take the listeners of the process that started this one for an
+	// upgrade, if any.
+	s.inheritListeners()
+
 	// Start monitoring if needed
 	if err := s.StartMonitoring(); err != nil {
 		s.Fatalf("Can't start monitoring: %v", err)
@@ -1165,6 +1500,55 @@ func (s *Server) Start() {
 	// this server is configured with gateway or not.
 	s.startGWReplyMapExpiration()
 
+	// Start tracking memory used by connections if there is a limit.
+	if opts.MaxMemory > 0 {
+		s.startMemoryMonitor()
+	}
+
+	// Start refreshing the secrets referenced in the configuration if needed.
+	s.startSecretsRefresh()
+	s.startAdvertiseResolve()
+
+	// Start the watchdog if enabled.
+	if opts.Watchdog > 0 {
+		s.startWatchdog()
+	}
+
+	// Start admission control if enabled.
+	if opts.Admission != nil {
+		s.startAdmissionControl()
+	}
+
+	// Start checking the watermarks if enabled.
+	if opts.Watermarks != nil {
+		s.startWatermarks()
+	}
+
+	// Start publishing account usage if enabled.
+	if opts.AccountUsage != nil {
+		s.startAccountUsage()
+	}
+
+	// Start fetching the schemas if schema validation is enabled.
+	if opts.SchemaValidation != nil {
+		s.startSchemaValidation()
+	}
+
+	// Start tracking the traffic stats if enabled.
+	if opts.TrafficStats != nil {
+		s.startTrafficStats()
+	}
+
+	// Sample the counters for the rolling rates.
+	s.startRollingRates()
+
+	// Measure the scheduler latency reported in the runtime stats.
+	s.startSchedLatency()
+
+	// Restore the interest of clients from a previous run, if enabled.
+	// Do this before starting gateways and routes so that they get it.
+	s.startInterestSnapshot()
+
 	// Start up gateway if needed. Do this before starting the routes, because
 	// we want to resolve the gateway host:port so that this information can
 	// be sent to other routes.
@@ -1182,6 +1566,21 @@ func (s *Server) Start() {
 		<-ch
 	}
 
+	// Start up listen if we want to accept STOMP connections.
+	if opts.Stomp != nil && opts.Stomp.Port != 0 {
+		ch := make(chan struct{})
+		go s.stompAcceptLoop(ch)
+		<-ch
+	}
+
+	// Start the gRPC gateway if needed.
+	if opts.GRPC != nil && opts.GRPC.Port != 0 {
+		if err := s.startGRPC(); err != nil {
+			s.Fatalf("Can't start the gRPC gateway: %v", err)
+			return
+		}
+	}
+
 	// Solicit remote servers for leaf node connections.
 	if len(opts.LeafNode.Remotes) > 0 {
 		s.solicitLeafNodeRemotes(opts.LeafNode.Remotes)
@@ -1230,8 +1629,19 @@ func (s *Server) Shutdown() {
 
 	opts := s.getOpts()
 
+	// Save the interest of clients before closing them, unless already
+	// done when entering lame duck mode.
+	var snap *interestSnapshot
+	if opts.InterestSnapshot != _EMPTY_ && !s.ldm {
+		snap = s.interestSnapshot()
+	}
+	if s.primed != nil {
+		s.primed.tmr.Stop()
+	}
+
 	s.shutdown = true
 	s.running = false
+	s.releaseMemoryProfile()
 	s.grMu.Lock()
 	s.grRunning = false
 	s.grMu.Unlock()
@@ -1270,6 +1680,7 @@ func (s *Server) Shutdown() {
 		s.listener.Close()
 		s.listener = nil
 	}
+	s.closeReuseListeners()
 
 	// Kick leafnodes AcceptLoop()
 	if s.leafNodeListener != nil {
@@ -1278,6 +1689,20 @@ func (s *Server) Shutdown() {
 		s.leafNodeListener = nil
 	}
 
+	// Kick STOMP AcceptLoop()
+	if s.stompListener != nil {
+		doneExpected++
+		s.stompListener.Close()
+		s.stompListener = nil
+	}
+
+	// Kick the gRPC gateway
+	if s.grpcListener != nil {
+		doneExpected++
+		s.grpcListener.Close()
+		s.grpcListener = nil
+	}
+
 	// Kick route AcceptLoop()
 	if s.routeListener != nil {
 		doneExpected++
@@ -1307,13 +1732,16 @@ func (s *Server) Shutdown() {
 
 	s.mu.Unlock()
 
+	s.saveInterestSnapshot(opts.InterestSnapshot, snap)
+	s.shutdownPhase(ShutdownListenersClosed)
+
 	// Release go routines that wait on that channel
 	close(s.quitCh)
 
 	// Close client and route connections
 	for _, c := range conns {
 		c.setNoReconnect()
-		c.closeConnection(ServerShutdown)
+		c.closeWithReason(ServerShutdown, CloseReasonShutdown)
 	}
 
 	// Block until the accept loops exit
@@ -1324,6 +1752,7 @@ func (s *Server) Shutdown() {
 
 	// Wait for go routines to be done.
 	s.grWG.Wait()
+	s.shutdownPhase(ShutdownConnectionsClosed)
 
 	if opts.PortsFileDir != _EMPTY_ {
 		s.deletePortsFile(opts.PortsFileDir)
@@ -1340,6 +1769,7 @@ func (s *Server) Shutdown() {
 			l.Close()
 		}
 	}
+	s.shutdownPhase(ShutdownComplete)
 	// Notify that the shutdown is complete
 	close(s.shutdownComplete)
 }
@@ -1349,8 +1779,72 @@ func (s *Server) WaitForShutdown() {
 	<-s.shutdownComplete
 }
 
+// listen creates a TCP listener on hp. If the address is in use, say
+// because a previous instance of the server just exited and its
+// connections are in TIME_WAIT, binding is retried with backoff for up
+// to the configured `listen_retry` duration.
+func (s *Server) listen(hp string) (net.Listener, error) {
+	return s.listenWith(&net.ListenConfig{}, hp)
+}
+
+// listenOrInherit is like listen, but returns the listener of type lt
+// inherited from the process that started this one for an upgrade, if any.
+func (s *Server) listenOrInherit(lt, hp string) (net.Listener, error) {
+	if l := s.inheritedListener(lt, hp); l != nil {
+		return l, nil
+	}
+	return s.listen(hp)
+}
+
+// inheritedListener returns the listener of type lt inherited for an
+// upgrade, if it is bound to the port of hp. A listener bound to another
+// port is closed.
+func (s *Server) inheritedListener(lt, hp string) net.Listener {
+	s.mu.Lock()
+	l := s.inherited[lt]
+	delete(s.inherited, lt)
+	s.mu.Unlock()
+	if l == nil {
+		return nil
+	}
+	_, port, _ := net.SplitHostPort(hp)
+	if port != "0" && port != strconv.Itoa(l.Addr().(*net.TCPAddr).Port) {
+		s.Warnf("Closing inherited %s listener on %s, now configured on %s", lt, l.Addr(), hp)
+		l.Close()
+		return nil
+	}
+	return l
+}
+
+// listenWith is like listen, with the listen config lc.
+func (s *Server) listenWith(lc *net.ListenConfig, hp string) (net.Listener, error) {
+	l, err := lc.Listen(context.Background(), "tcp", hp)
+	if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+		return l, err
+	}
+	deadline := time.Now().Add(s.getOpts().ListenRetry)
+	delay := ACCEPT_MIN_SLEEP
+	for time.Now().Before(deadline) {
+		s.Warnf("Address %s in use, retrying in %v", hp, delay)
+		select {
+		case <-time.After(delay):
+		case <-s.quitCh:
+			return nil, err
+		}
+		if l, err = lc.Listen(context.Background(), "tcp", hp); err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			return l, err
+		}
+		delay *= 2
+		if delay > ACCEPT_MAX_SLEEP {
+			delay = ACCEPT_MAX_SLEEP
+		}
+	}
+	return nil, err
+}
+
 // AcceptLoop is exported for easier testing.
 func (s *Server) AcceptLoop(clr chan struct{}) {
+	defer s.acceptLoopStarted()()
 	// If we were to exit before the listener is setup properly,
 	// make sure we close the channel.
 	defer func() {
@@ -1363,25 +1857,50 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 	opts := s.getOpts()
 
 	hp := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
-	l, e := net.Listen("tcp", hp)
+	var e error
+	l := s.inheritedListener(ClientListener, hp)
+	if l == nil && opts.ClientAcceptors > 1 {
+		l, e = s.listenWith(reusePortListenConfig(), hp)
+	} else if l == nil {
+		l, e = s.listen(hp)
+	}
 	if e != nil {
 		s.Fatalf("Error listening on port: %s, %q", hp, e)
 		return
 	}
-	s.Noticef("Listening for client connections on %s",
-		net.JoinHostPort(opts.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+	hp = net.JoinHostPort(opts.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port))
+	s.bannerf("Listening for client connections on %s", hp)
+
+	// Bind the additional listeners to the port actually used.
+	var reuseListeners []net.Listener
+	for i := 1; i < opts.ClientAcceptors; i++ {
+		rl, err := reusePortListenConfig().Listen(context.Background(), "tcp", hp)
+		if err != nil {
+			l.Close()
+			for _, rl := range reuseListeners {
+				rl.Close()
+			}
+			s.Fatalf("Error listening on port: %s, %q", hp, err)
+			return
+		}
+		reuseListeners = append(reuseListeners, rl)
+	}
+	if len(reuseListeners) > 0 {
+		s.Noticef("Accepting client connections with %d SO_REUSEPORT listeners", opts.ClientAcceptors)
+	}
 
 	// Alert of TLS enabled.
 	if opts.TLSConfig != nil {
-		s.Noticef("TLS required for client connections")
+		s.bannerf("TLS required for client connections")
 	}
 
-	s.Noticef("Server id is %s", s.info.ID)
-	s.Noticef("Server is ready")
+	s.bannerf("Server id is %s", s.info.ID)
+	s.bannerf("Server is ready")
 
 	// Setup state that can enable shutdown
 	s.mu.Lock()
 	s.listener = l
+	s.reuseListeners = reuseListeners
 
 	// If server was started with RANDOM_PORT (-1), opts.Port would be equal
 	// to 0 at the beginning this function. So we need to get the actual port
@@ -1406,10 +1925,23 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 	close(clr)
 	clr = nil
 
+	s.checkListenersReady()
+
+	for _, rl := range reuseListeners {
+		rl := rl
+		s.startGoRoutine(func() {
+			s.acceptReusePortLoop(rl)
+			s.grWG.Done()
+		})
+	}
+
 	tmpDelay := ACCEPT_MIN_SLEEP
 
+	defer s.acceptLoops.client.done()
 	for s.isRunning() {
+		s.acceptLoops.client.done()
 		conn, err := l.Accept()
+		s.acceptLoops.client.start()
 		if err != nil {
 			if s.isLameDuckMode() {
 				// Signal that we are not accepting new clients
@@ -1430,6 +1962,38 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 	s.done <- true
 }
 
+// acceptReusePortLoop accepts client connections on an additional
+// SO_REUSEPORT listener, until the server is shutdown or enters lame duck
+// mode. Lame duck mode is signaled by the main accept loop.
+func (s *Server) acceptReusePortLoop(l net.Listener) {
+	defer s.acceptLoopStarted()()
+	tmpDelay := ACCEPT_MIN_SLEEP
+	for s.isRunning() {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isLameDuckMode() {
+				return
+			}
+			tmpDelay = s.acceptError("Client", err, tmpDelay)
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		s.startGoRoutine(func() {
+			s.createClient(conn)
+			s.grWG.Done()
+		})
+	}
+}
+
+// closeReuseListeners closes the additional SO_REUSEPORT client listeners.
+// Lock should be held.
+func (s *Server) closeReuseListeners() {
+	for _, l := range s.reuseListeners {
+		l.Close()
+	}
+	s.reuseListeners = nil
+}
+
 // This function sets the server's info Host/Port based on server Options.
 // Note that this function may be called during config reload, this is why
 // Host/Port may be reset to original Options if the ClientAdvertise option
@@ -1467,12 +2031,12 @@ func (s *Server) StartProfiler() {
 
 	hp := net.JoinHostPort(opts.Host, strconv.Itoa(port))
 
-	l, err := net.Listen("tcp", hp)
-	s.Noticef("profiling port: %d", l.Addr().(*net.TCPAddr).Port)
-
+	l, err := s.listen(hp)
 	if err != nil {
 		s.Fatalf("error starting profiler: %s", err)
+		return
 	}
+	s.Noticef("profiling port: %d", l.Addr().(*net.TCPAddr).Port)
 
 	srv := &http.Server{
 		Addr:           hp,
@@ -1539,14 +2103,24 @@ func (s *Server) StartMonitoring() error {
 
 // HTTP endpoints
 const (
-	RootPath     = "/"
-	VarzPath     = "/varz"
-	ConnzPath    = "/connz"
-	RoutezPath   = "/routez"
-	GatewayzPath = "/gatewayz"
-	LeafzPath    = "/leafz"
-	SubszPath    = "/subsz"
-	StackszPath  = "/stacksz"
+	RootPath      = "/"
+	VarzPath      = "/varz"
+	ConnzPath     = "/connz"
+	RoutezPath    = "/routez"
+	GatewayzPath  = "/gatewayz"
+	LeafzPath     = "/leafz"
+	SubszPath     = "/subsz"
+	StackszPath   = "/stacksz"
+	ReadyzPath    = "/readyz"
+	AccountzPath  = "/accountz"
+	KickPath      = "/connz/kick"
+	LogLevelPath  = "/loglevel"
+	AcceptPath    = "/accept"
+	IpqueueszPath = "/ipqueuesz"
+	AuthBanzPath  = "/authbanz"
+	PublishPath   = "/v1/publish/"
+	ExpvarPath    = "/debug/vars"
+	MetricsPath   = "/metrics"
 )
 
 // Start the monitoring server
@@ -1556,18 +2130,27 @@ func (s *Server) startMonitoring(secure bool) error {
 
 	// Used to track HTTP requests
 	s.httpReqStats = map[string]uint64{
-		RootPath:     0,
-		VarzPath:     0,
-		ConnzPath:    0,
-		RoutezPath:   0,
-		GatewayzPath: 0,
-		SubszPath:    0,
+		RootPath:      0,
+		VarzPath:      0,
+		ConnzPath:     0,
+		RoutezPath:    0,
+		GatewayzPath:  0,
+		SubszPath:     0,
+		ReadyzPath:    0,
+		AccountzPath:  0,
+		KickPath:      0,
+		LogLevelPath:  0,
+		AcceptPath:    0,
+		IpqueueszPath: 0,
+		AuthBanzPath:  0,
+		PublishPath:   0,
 	}
 
 	var (
 		hp           string
 		err          error
 		httpListener net.Listener
+		tcpListener  net.Listener
 		port         int
 	)
 
@@ -1582,7 +2165,10 @@ func (s *Server) startMonitoring(secure bool) error {
 		hp = net.JoinHostPort(opts.HTTPHost, strconv.Itoa(port))
 		config := opts.TLSConfig.Clone()
 		config.ClientAuth = tls.NoClientCert
-		httpListener, err = tls.Listen("tcp", hp, config)
+		if httpListener, err = s.listenOrInherit(MonitoringListener, hp); err == nil {
+			tcpListener = httpListener
+			httpListener = tls.NewListener(httpListener, config)
+		}
 
 	} else {
 		port = opts.HTTPPort
@@ -1590,14 +2176,15 @@ func (s *Server) startMonitoring(secure bool) error {
 			port = 0
 		}
 		hp = net.JoinHostPort(opts.HTTPHost, strconv.Itoa(port))
-		httpListener, err = net.Listen("tcp", hp)
+		httpListener, err = s.listenOrInherit(MonitoringListener, hp)
+		tcpListener = httpListener
 	}
 
 	if err != nil {
 		return fmt.Errorf("can't listen to the monitor port: %v", err)
 	}
 
-	s.Noticef("Starting %s monitor on %s", monitorProtocol,
+	s.bannerf("Starting %s monitor on %s", monitorProtocol,
 		net.JoinHostPort(opts.HTTPHost, strconv.Itoa(httpListener.Addr().(*net.TCPAddr).Port)))
 
 	mux := http.NewServeMux()
@@ -1620,6 +2207,26 @@ func (s *Server) startMonitoring(secure bool) error {
 	mux.HandleFunc("/subscriptionsz", s.HandleSubsz)
 	// Stacksz
 	mux.HandleFunc(StackszPath, s.HandleStacksz)
+	// Readyz
+	mux.HandleFunc(ReadyzPath, s.HandleReadyz)
+	// Accountz
+	mux.HandleFunc(AccountzPath, s.HandleAccountz)
+	// Kick
+	mux.HandleFunc(KickPath, s.HandleKick)
+	// LogLevel
+	mux.HandleFunc(LogLevelPath, s.HandleLogLevel)
+	// Accept
+	mux.HandleFunc(AcceptPath, s.HandleAccept)
+	// Ipqueuesz
+	mux.HandleFunc(IpqueueszPath, s.HandleIpqueuesz)
+	// AuthBanz
+	mux.HandleFunc(AuthBanzPath, s.HandleAuthBanz)
+	// Publish
+	mux.HandleFunc(PublishPath, s.HandlePublish)
+	// Expvar
+	mux.HandleFunc(ExpvarPath, s.HandleExpvar)
+	// Metrics
+	mux.HandleFunc(MetricsPath, s.HandleMetrics)
 
 	// Do not set a WriteTimeout because it could cause cURL/browser
 	// to return empty response or unable to display page if the
@@ -1631,6 +2238,7 @@ func (s *Server) startMonitoring(secure bool) error {
 	}
 	s.mu.Lock()
 	s.http = httpListener
+	s.httpTCP = tcpListener
 	s.httpHandler = mux
 	s.monitoringServer = srv
 	s.mu.Unlock()
@@ -1652,6 +2260,8 @@ func (s *Server) startMonitoring(secure bool) error {
 		s.done <- true
 	}()
 
+	s.checkListenersReady()
+
 	return nil
 }
 
@@ -1683,9 +2293,41 @@ func (s *Server) copyInfo() Info {
 	return info
 }
 
+// inProcessConn is the server side of a client connection created with
+// InProcessConn.
+type inProcessConn struct {
+	net.Conn
+}
+
+// InProcessConn returns a client connection to this server that does not
+// go through the network, which avoids the overhead of the loopback
+// interface and the need for a client port when embedding the server.
+// The connection is not subject to TLS. The caller is expected to read the
+// INFO protocol sent by the server right away, like with any connection.
+func (s *Server) InProcessConn() (net.Conn, error) {
+	if !s.isRunning() {
+		return nil, ErrServerNotRunning
+	}
+	conn, sconn := net.Pipe()
+	if !s.startGoRoutine(func() {
+		if c := s.createClient(&inProcessConn{sconn}); c == nil || !s.isRunning() {
+			sconn.Close()
+		}
+		s.grWG.Done()
+	}) {
+		conn.Close()
+		sconn.Close()
+		return nil, ErrServerNotRunning
+	}
+	return conn, nil
+}
+
 func (s *Server) createClient(conn net.Conn) *client {
 	// Snapshot server options.
 	opts := s.getOpts()
+	// Tune the socket, whether accepted or dialed.
+	s.applySocketOpts(conn, opts.Socket)
+	conn = s.faultConn(CLIENT, conn)
 
 	maxPay := int32(opts.MaxPayload)
 	maxSubs := int32(opts.MaxSubs)
@@ -1706,6 +2348,11 @@ func (s *Server) createClient(conn net.Conn) *client {
 	s.totalClients++
 	s.mu.Unlock()
 
+	// In-process connections do not go through the network.
+	if _, ok := conn.(*inProcessConn); ok {
+		info.TLSRequired = false
+	}
+
 	// Grab lock
 	c.mu.Lock()
 	if info.AuthRequired {
@@ -1725,6 +2372,18 @@ func (s *Server) createClient(conn net.Conn) *client {
 	// Unlock to register
 	c.mu.Unlock()
 
+	// Reject clients from source IPs banned after too many
+	// authentication failures.
+	if c.authBannedReject() {
+		return nil
+	}
+
+	// Defer or reject new clients while the server is overloaded.
+	if ao := opts.Admission; !s.admitClient(ao) {
+		c.overloadedReject(ao.retryAfter())
+		return nil
+	}
+
 	// Register with the server.
 	s.mu.Lock()
 	// If server is not running, Shutdown() may have already gathered the
@@ -1743,6 +2402,24 @@ func (s *Server) createClient(conn net.Conn) *client {
 		c.maxConnExceeded()
 		return nil
 	}
+	// Reject new clients while accepting connections is paused.
+	if !s.acceptPaused.IsZero() {
+		errTxt := s.acceptPausedErr
+		s.mu.Unlock()
+		c.acceptPausedReject(errTxt)
+		return nil
+	}
+	// Reject new clients while too many have not authenticated yet.
+	if info.AuthRequired {
+		c.mu.Lock()
+		tracked := c.trackPendingAuth(opts.MaxPendingAuth)
+		c.mu.Unlock()
+		if !tracked {
+			s.mu.Unlock()
+			c.maxPendingAuthExceeded()
+			return nil
+		}
+	}
 	s.clients[c.cid] = c
 	s.mu.Unlock()
 
@@ -1775,6 +2452,7 @@ func (s *Server) createClient(conn net.Conn) *client {
 
 		// Indicate that handshake is complete (used in monitoring)
 		c.flags.set(handshakeComplete)
+		c.trackPeerCert()
 	}
 
 	// The connection may have been closed
@@ -1795,6 +2473,9 @@ func (s *Server) createClient(conn net.Conn) *client {
 	// Set the Ping timer. Will be reset once connect was received.
 	c.setPingTimer()
 
+	// Set the timer of the maximum lifetime of the connection, if any.
+	c.setLifetimeTimer(opts.MaxConnectionLifetime)
+
 	// Spin up the read loop.
 	s.startGoRoutine(func() { c.readLoop() })
 
@@ -1857,7 +2538,7 @@ func (s *Server) saveClosedClient(c *client, nc net.Conn, reason ClosedState) {
 // If there was a change, an INFO protocol is sent to registered clients
 // that support async INFO protocols.
 func (s *Server) addClientConnectURLsAndSendINFOToClients(urls []string) {
-	s.updateServerINFOAndSendINFOToClients(urls, true)
+	s.updateServerINFOAndSendINFOToClients(urls, nil)
 }
 
 // Removes the given array of urls from the server's INFO.ClientConnectURLs
@@ -1865,44 +2546,58 @@ func (s *Server) addClientConnectURLsAndSendINFOToClients(urls []string) {
 // If there was a change, an INFO protocol is sent to registered clients
 // that support async INFO protocols.
 func (s *Server) removeClientConnectURLsAndSendINFOToClients(urls []string) {
-	s.updateServerINFOAndSendINFOToClients(urls, false)
+	s.updateServerINFOAndSendINFOToClients(nil, urls)
 }
 
-// Updates the server's Info object with the given array of URLs and re-generate
-// the infoJSON byte array, then send an (async) INFO protocol to clients that
-// support it.
-func (s *Server) updateServerINFOAndSendINFOToClients(urls []string, add bool) {
+// Updates the server's Info object with the given arrays of URLs added and
+// removed and re-generate the infoJSON byte array, then send an (async) INFO
+// protocol to clients that support it.
+func (s *Server) updateServerINFOAndSendINFOToClients(added, removed []string) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	// Will be set to true if we alter the server's Info object.
 	wasUpdated := false
-	remove := !add
-	for _, url := range urls {
-		_, present := s.clientConnectURLsMap[url]
-		if add && !present {
-			s.clientConnectURLsMap[url] = struct{}{}
-			wasUpdated = true
-		} else if remove && present {
+	damped := s.dampConnectURLs()
+	for _, url := range removed {
+		if _, present := s.clientConnectURLsMap[url]; present {
 			delete(s.clientConnectURLsMap, url)
 			wasUpdated = true
 		}
 	}
+	for _, url := range added {
+		if _, present := s.clientConnectURLsMap[url]; !present {
+			s.clientConnectURLsMap[url] = struct{}{}
+			wasUpdated = true
+		}
+	}
 	if wasUpdated {
-		// Recreate the info.ClientConnectURL array from the map
-		s.info.ClientConnectURLs = s.info.ClientConnectURLs[:0]
-		// Add this server client connect ULRs first...
-		s.info.ClientConnectURLs = append(s.info.ClientConnectURLs, s.clientConnectURLs...)
-		for url := range s.clientConnectURLsMap {
-			s.info.ClientConnectURLs = append(s.info.ClientConnectURLs, url)
+		s.rebuildClientConnectURLs()
+		// Send to all registered clients that support async INFO protocols,
+		// possibly later along with the updates that follow.
+		if damped {
+			s.scheduleConnectURLsUpdate()
+		} else {
+			s.sendAsyncInfoToClients()
 		}
-		// Update the time of this update
-		s.lastCURLsUpdate = time.Now().UnixNano()
-		// Send to all registered clients that support async INFO protocols.
-		s.sendAsyncInfoToClients()
 	}
 }
 
+// rebuildClientConnectURLs recreates the connect URLs of the server's Info
+// object from its own connect URLs and the ones of the routes.
+// Lock should be held.
+func (s *Server) rebuildClientConnectURLs() {
+	// Recreate the info.ClientConnectURL array from the map
+	s.info.ClientConnectURLs = s.info.ClientConnectURLs[:0]
+	// Add this server client connect ULRs first...
+	s.info.ClientConnectURLs = append(s.info.ClientConnectURLs, s.clientConnectURLs...)
+	for url := range s.clientConnectURLsMap {
+		s.info.ClientConnectURLs = append(s.info.ClientConnectURLs, url)
+	}
+	// Update the time of this update
+	s.lastCURLsUpdate = time.Now().UnixNano()
+}
+
 // Handle closing down a connection when the handshake has timedout.
 func tlsTimeout(c *client, conn *tls.Conn) {
 	c.mu.Lock()
@@ -1953,6 +2648,11 @@ func (s *Server) removeClient(c *client) {
 		if c.kind == CLIENT && c.opts.Protocol >= ClientProtoInfo {
 			updateProtoInfoCount = true
 		}
+		var durableKey string
+		if c.durable != nil {
+			durableKey = c.durable.key
+		}
+		uniqueKey := c.uniqueKey
 		c.mu.Unlock()
 
 		s.mu.Lock()
@@ -1960,6 +2660,13 @@ func (s *Server) removeClient(c *client) {
 		if updateProtoInfoCount {
 			s.cproto--
 		}
+		if dc := s.durables[durableKey]; dc != nil {
+			dc.active--
+			dc.lastSeen = time.Now()
+		}
+		if uniqueKey != _EMPTY_ && s.uniqueConns[uniqueKey] == c {
+			delete(s.uniqueConns, uniqueKey)
+		}
 		s.mu.Unlock()
 	case ROUTER:
 		s.removeRoute(c)
@@ -1970,6 +2677,67 @@ func (s *Server) removeClient(c *client) {
 	}
 }
 
+// Maximum number of durable client identities tracked by the server.
+const maxDurableConns = 10000
+
+// durableConn tracks the connections of clients that provided the same
+// durable ID in the same account.
+type durableConn struct {
+	connects int
+	active   int
+	lastSeen time.Time
+}
+
+// durableConnInfo is what a client knows about its durable identity
+// when it connected.
+type durableConnInfo struct {
+	key        string
+	reconnects int
+	lastSeen   time.Time
+}
+
+// trackDurableConn records a new connection of the client with the given
+// durable ID, which lets connz report how many times this identity
+// reconnected and when it was last seen before.
+func (s *Server) trackDurableConn(c *client, id string) {
+	c.mu.Lock()
+	key := id
+	if c.acc != nil {
+		key = c.acc.Name + " " + id
+	}
+	c.mu.Unlock()
+
+	di := &durableConnInfo{key: key}
+	s.mu.Lock()
+	dc := s.durables[key]
+	if dc == nil {
+		// Make room by forgetting an identity without connections.
+		if len(s.durables) >= maxDurableConns {
+			for k, odc := range s.durables {
+				if odc.active <= 0 {
+					delete(s.durables, k)
+					break
+				}
+			}
+		}
+		dc = &durableConn{}
+		if len(s.durables) < maxDurableConns {
+			s.durables[key] = dc
+		}
+	} else {
+		di.reconnects = dc.connects
+		di.lastSeen = dc.lastSeen
+	}
+	dc.connects++
+	dc.active++
+	dc.lastSeen = time.Now()
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.durable = di
+	c.mu.Unlock()
+}
+
 func (s *Server) removeFromTempClients(cid uint64) {
 	s.grMu.Lock()
 	delete(s.grTmpClients, cid)
@@ -2102,6 +2870,16 @@ func (s *Server) ClusterAddr() *net.TCPAddr {
 	return s.routeListener.Addr().(*net.TCPAddr)
 }
 
+// LeafNodeAddr returns the net.Addr object for the leafnode listener.
+func (s *Server) LeafNodeAddr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leafNodeListener == nil {
+		return nil
+	}
+	return s.leafNodeListener.Addr().(*net.TCPAddr)
+}
+
 // ProfilerAddr returns the net.Addr object for the profiler listener.
 func (s *Server) ProfilerAddr() *net.TCPAddr {
 	s.mu.Lock()
@@ -2113,16 +2891,14 @@ func (s *Server) ProfilerAddr() *net.TCPAddr {
 }
 
 // ReadyForConnections returns `true` if the server is ready to accept clients
-// and, if routing is enabled, route connections. If after the duration
-// `dur` the server is still not ready, returns `false`.
+// and, if configured, route, gateway, leafnode and monitoring connections.
+// If after the duration `dur` the server is still not ready, returns `false`.
+// See Readiness for the state of each listener.
 func (s *Server) ReadyForConnections(dur time.Duration) bool {
-	// Snapshot server options.
-	opts := s.getOpts()
-
 	end := time.Now().Add(dur)
 	for time.Now().Before(end) {
 		s.mu.Lock()
-		ok := s.listener != nil && (opts.Cluster.Port == 0 || s.routeListener != nil) && (opts.Gateway.Name == "" || s.gatewayListener != nil)
+		ok := allListenersReady(s.readiness())
 		s.mu.Unlock()
 		if ok {
 			return true
@@ -2132,6 +2908,172 @@ func (s *Server) ReadyForConnections(dur time.Duration) bool {
 	return false
 }
 
+// ShutdownPhase identifies a step of the server shutdown, reported to
+// the hooks registered with OnShutdownPhase.
+type ShutdownPhase int
+
+const (
+	// ShutdownListenersClosed is reported once the server no longer
+	// accepts connections, before existing connections are closed.
+	ShutdownListenersClosed ShutdownPhase = iota
+	// ShutdownConnectionsClosed is reported once all connections have
+	// been closed.
+	ShutdownConnectionsClosed
+	// ShutdownComplete is reported when the shutdown is complete, right
+	// before WaitForShutdown returns.
+	ShutdownComplete
+)
+
+func (p ShutdownPhase) String() string {
+	switch p {
+	case ShutdownListenersClosed:
+		return "Listeners Closed"
+	case ShutdownConnectionsClosed:
+		return "Connections Closed"
+	case ShutdownComplete:
+		return "Complete"
+	}
+	return "Unknown Phase"
+}
+
+type lifecycleHooks struct {
+	listenersReady []func()
+	lameDuck       []func()
+	shutdown       []func(ShutdownPhase)
+}
+
+// OnListenersReady registers a function invoked once all configured
+// listeners have been started, that is, when ReadyForConnections would
+// return true. It is invoked right away if that is already the case.
+// Hooks are invoked without any server lock held, but must not block.
+func (s *Server) OnListenersReady(f func()) {
+	s.mu.Lock()
+	ready := s.listenersReady
+	if !ready {
+		s.hooks.listenersReady = append(s.hooks.listenersReady, f)
+	}
+	s.mu.Unlock()
+	if ready {
+		f()
+	}
+}
+
+// OnLameDuck registers a function invoked when the server enters lame
+// duck mode, once it has stopped accepting clients and before it starts
+// closing them.
+func (s *Server) OnLameDuck(f func()) {
+	s.mu.Lock()
+	s.hooks.lameDuck = append(s.hooks.lameDuck, f)
+	s.mu.Unlock()
+}
+
+// OnShutdownPhase registers a function invoked for each phase of the
+// server shutdown. See ShutdownPhase.
+func (s *Server) OnShutdownPhase(f func(ShutdownPhase)) {
+	s.mu.Lock()
+	s.hooks.shutdown = append(s.hooks.shutdown, f)
+	s.mu.Unlock()
+}
+
+// checkListenersReady logs that the server is ready and invokes the
+// listeners ready hooks, once, when all configured listeners have been
+// started.
+func (s *Server) checkListenersReady() {
+	s.mu.Lock()
+	if s.listenersReady {
+		s.mu.Unlock()
+		return
+	}
+	readiness := s.readiness()
+	if !allListenersReady(readiness) {
+		s.mu.Unlock()
+		return
+	}
+	s.listenersReady = true
+	hooks := s.hooks.listenersReady
+	s.hooks.listenersReady = nil
+	s.mu.Unlock()
+
+	var listeners []string
+	for _, lt := range listenerTypes {
+		if r := readiness[lt]; r.Configured {
+			listeners = append(listeners, lt+" on "+r.Addr)
+		}
+	}
+	s.bannerf("Server is ready, listening for %s", strings.Join(listeners, ", "))
+	s.writeStartupReport(readiness)
+
+	for _, f := range hooks {
+		f()
+	}
+}
+
+// Listener types reported by Readiness.
+const (
+	ClientListener     = "client"
+	ClusterListener    = "cluster"
+	GatewayListener    = "gateway"
+	LeafNodeListener   = "leafnode"
+	MonitoringListener = "monitoring"
+)
+
+var listenerTypes = []string{ClientListener, ClusterListener, GatewayListener, LeafNodeListener, MonitoringListener}
+
+// ListenerReadiness is the state of a listener reported by Readiness.
+type ListenerReadiness struct {
+	Configured bool   `json:"configured"`
+	Ready      bool   `json:"ready"`
+	Addr       string `json:"addr,omitempty"`
+}
+
+// Readiness reports, for each listener type, whether the listener is
+// configured and whether it is bound and accepting connections.
+func (s *Server) Readiness() map[string]*ListenerReadiness {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readiness()
+}
+
+// Server lock is held on entry.
+func (s *Server) readiness() map[string]*ListenerReadiness {
+	opts := s.getOpts()
+	state := func(configured bool, l net.Listener) *ListenerReadiness {
+		r := &ListenerReadiness{Configured: configured, Ready: l != nil}
+		if l != nil {
+			r.Addr = l.Addr().String()
+		}
+		return r
+	}
+	return map[string]*ListenerReadiness{
+		ClientListener:     state(true, s.listener),
+		ClusterListener:    state(opts.Cluster.Port != 0, s.routeListener),
+		GatewayListener:    state(opts.Gateway.Port != 0, s.gatewayListener),
+		LeafNodeListener:   state(opts.LeafNode.Port != 0, s.leafNodeListener),
+		MonitoringListener: state(opts.HTTPPort != 0 || opts.HTTPSPort != 0, s.http),
+	}
+}
+
+// allListenersReady returns true if all configured listeners are ready.
+func allListenersReady(readiness map[string]*ListenerReadiness) bool {
+	for _, r := range readiness {
+		if r.Configured && !r.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// shutdownPhase invokes the shutdown hooks for the given phase.
+func (s *Server) shutdownPhase(phase ShutdownPhase) {
+	s.mu.Lock()
+	hooks := s.hooks.shutdown
+	s.mu.Unlock()
+	s.Debugf("Shutdown phase: %v", phase)
+	for _, f := range hooks {
+		f(phase)
+	}
+}
+
 // ID returns the server's ID
 func (s *Server) ID() string {
 	s.mu.Lock()
@@ -2139,13 +3081,16 @@ func (s *Server) ID() string {
 	return s.info.ID
 }
 
-func (s *Server) startGoRoutine(f func()) {
+func (s *Server) startGoRoutine(f func()) bool {
+	var started bool
 	s.grMu.Lock()
 	if s.grRunning {
 		s.grWG.Add(1)
 		go f()
+		started = true
 	}
 	s.grMu.Unlock()
+	return started
 }
 
 func (s *Server) numClosedConns() int {
@@ -2179,6 +3124,10 @@ func (s *Server) getClientConnectURLs() []string {
 
 	// short circuit if client advertise is set
 	if opts.ClientAdvertise != "" {
+		// Advertise the addresses of the host name if asked to.
+		if resolved := resolvedAdvertise(opts, opts.Port); resolved != nil {
+			return resolved
+		}
 		// just use the info host/port. This is updated in s.New()
 		urls = append(urls, net.JoinHostPort(s.info.Host, strconv.Itoa(s.info.Port)))
 	} else {
@@ -2445,6 +3394,149 @@ func (s *Server) serviceListeners() []net.Listener {
 	return listeners
 }
 
+// ClientRedirect selects the clients to send an INFO with a given list of
+// connect URLs, so that they reconnect to other servers, for instance to
+// rebalance the load after scaling up a cluster.
+type ClientRedirect struct {
+	// CIDs of the clients to redirect. All clients if empty.
+	CIDs []uint64 `json:"cids,omitempty"`
+	// Account, if set, restricts the redirect to the clients of this account.
+	Account string `json:"account,omitempty"`
+	// Limit, if positive, is the maximum number of clients redirected.
+	Limit int `json:"limit,omitempty"`
+	// ConnectURLs, as host:port, sent to the clients. Defaults to the
+	// server's list.
+	ConnectURLs []string `json:"connect_urls,omitempty"`
+	// Exclude lists URLs removed from the connect URLs.
+	Exclude []string `json:"exclude,omitempty"`
+	// LameDuckMode asks the clients to reconnect now.
+	LameDuckMode bool `json:"ldm,omitempty"`
+}
+
+// RedirectClients sends the selected clients an INFO protocol with the
+// filtered list of connect URLs and returns the number of clients it was
+// sent to. Only clients that support asynchronous INFO protocols are
+// considered.
+func (s *Server) RedirectClients(r *ClientRedirect) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.shutdown {
+		return 0, ErrServerNotRunning
+	}
+	info := s.copyInfo()
+	if len(r.ConnectURLs) > 0 {
+		info.ClientConnectURLs = append([]string(nil), r.ConnectURLs...)
+	}
+	if len(r.Exclude) > 0 {
+		urls := info.ClientConnectURLs[:0:0]
+		for _, u := range info.ClientConnectURLs {
+			excluded := false
+			for _, e := range r.Exclude {
+				if u == e {
+					excluded = true
+					break
+				}
+			}
+			if !excluded {
+				urls = append(urls, u)
+			}
+		}
+		info.ClientConnectURLs = urls
+	}
+	if len(info.ClientConnectURLs) == 0 && !r.LameDuckMode {
+		return 0, fmt.Errorf("no connect URL left to redirect clients to")
+	}
+	info.LameDuckMode = r.LameDuckMode
+
+	clients := s.clients
+	if len(r.CIDs) > 0 {
+		clients = make(map[uint64]*client, len(r.CIDs))
+		for _, cid := range r.CIDs {
+			if c := s.clients[cid]; c != nil {
+				clients[cid] = c
+			}
+		}
+	}
+	n := 0
+	for _, c := range clients {
+		if r.Limit > 0 && n >= r.Limit {
+			break
+		}
+		c.mu.Lock()
+		if c.hasFeature(FeatureAsyncInfo) && c.flags.isSet(firstPongSent) &&
+			(!info.LameDuckMode || c.hasFeature(FeatureLameDuckMode)) &&
+			(r.Account == _EMPTY_ || (c.acc != nil && c.acc.Name == r.Account)) {
+			c.enqueueProto(c.generateClientInfoJSON(info))
+			n++
+		}
+		c.mu.Unlock()
+	}
+	return n, nil
+}
+
+// ClientKick selects the clients to forcibly disconnect, for instance to
+// remove a misbehaving client without restarting the server.
+type ClientKick struct {
+	// CIDs of the clients to disconnect.
+	CIDs []uint64 `json:"cids,omitempty"`
+	// User, if set, selects the clients authenticated with this user name
+	// or nkey.
+	User string `json:"user,omitempty"`
+	// Account, if set, restricts the kick to the clients of this account.
+	Account string `json:"account,omitempty"`
+	// Reason is the close reason reported for the connections, as shown
+	// in connz, for instance "Slow Consumer (Pending Bytes)". Defaults to
+	// "Kicked by Admin".
+	Reason string `json:"reason,omitempty"`
+}
+
+// KickClients closes the selected client connections and returns the
+// number of connections closed. At least one CID or a user is required.
+func (s *Server) KickClients(k *ClientKick) (int, error) {
+	if len(k.CIDs) == 0 && k.User == _EMPTY_ {
+		return 0, fmt.Errorf("no client selected, a cid or user is required")
+	}
+	reason := AdminKick
+	if k.Reason != _EMPTY_ {
+		var err error
+		if reason, err = closedStateFromString(k.Reason); err != nil {
+			return 0, err
+		}
+	}
+
+	s.mu.Lock()
+	if s.shutdown {
+		s.mu.Unlock()
+		return 0, ErrServerNotRunning
+	}
+	clients := s.clients
+	if len(k.CIDs) > 0 {
+		clients = make(map[uint64]*client, len(k.CIDs))
+		for _, cid := range k.CIDs {
+			if c := s.clients[cid]; c != nil {
+				clients[cid] = c
+			}
+		}
+	}
+	var kicked []*client
+	for _, c := range clients {
+		c.mu.Lock()
+		if (k.User == _EMPTY_ || c.opts.Username == k.User || c.opts.Nkey == k.User) &&
+			(k.Account == _EMPTY_ || (c.acc != nil && c.acc.Name == k.Account)) {
+			kicked = append(kicked, c)
+		}
+		c.mu.Unlock()
+	}
+	s.mu.Unlock()
+
+	for _, c := range kicked {
+		c.Noticef("Connection kicked by admin")
+		c.closeWithReason(reason, CloseReasonAdminKick)
+	}
+	return len(kicked), nil
+}
+
 // Returns true if in lame duck mode.
 func (s *Server) isLameDuckMode() bool {
 	s.mu.Lock()
@@ -2466,12 +3558,28 @@ func (s *Server) lameDuckMode() {
 	s.ldmCh = make(chan bool, 1)
 	s.listener.Close()
 	s.listener = nil
+	s.closeReuseListeners()
+	// Save the interest of clients before they are closed.
+	snapFile := s.getOpts().InterestSnapshot
+	var snap *interestSnapshot
+	if snapFile != _EMPTY_ {
+		snap = s.interestSnapshot()
+	}
 	s.mu.Unlock()
 
+	s.saveInterestSnapshot(snapFile, snap)
+
 	// Wait for accept loop to be done to make sure that no new
 	// client can connect
 	<-s.ldmCh
 
+	s.mu.Lock()
+	hooks := s.hooks.lameDuck
+	s.mu.Unlock()
+	for _, f := range hooks {
+		f()
+	}
+
 	s.mu.Lock()
 	// Need to recheck few things
 	if s.shutdown || len(s.clients) == 0 {
@@ -2522,7 +3630,7 @@ func (s *Server) lameDuckMode() {
 		return
 	}
 	for i, client := range clients {
-		client.closeConnection(ServerShutdown)
+		client.closeWithReason(ServerShutdown, CloseReasonLameDuck)
 		if i == len(clients)-1 {
 			break
 		}
@@ -2546,21 +3654,30 @@ func (s *Server) lameDuckMode() {
 }
 
 // If given error is a net.Error and is temporary, sleeps for the given
-// delay and double it, but cap it to ACCEPT_MAX_SLEEP. The sleep is
+// delay and double it, within the bounds of the accept_errors option,
+// ACCEPT_MIN_SLEEP and ACCEPT_MAX_SLEEP by default. The sleep is
 // interrupted if the server is shutdown.
 // An error message is displayed depending on the type of error.
 // Returns the new (or unchanged) delay.
 func (s *Server) acceptError(acceptName string, err error, tmpDelay time.Duration) time.Duration {
 	if ne, ok := err.(net.Error); ok && ne.Temporary() {
-		s.Errorf("Temporary %s Accept Error(%v), sleeping %dms", acceptName, ne, tmpDelay/time.Millisecond)
+		ao := s.getOpts().AcceptErrors
+		if min := ao.minSleep(); tmpDelay < min {
+			tmpDelay = min
+		}
+		if isFDExhausted(err) {
+			s.fdExhausted(acceptName, err)
+		} else {
+			s.Errorf("Temporary %s Accept Error(%v), sleeping %dms", acceptName, ne, tmpDelay/time.Millisecond)
+		}
 		select {
 		case <-time.After(tmpDelay):
 		case <-s.quitCh:
 			return tmpDelay
 		}
 		tmpDelay *= 2
-		if tmpDelay > ACCEPT_MAX_SLEEP {
-			tmpDelay = ACCEPT_MAX_SLEEP
+		if max := ao.maxSleep(); tmpDelay > max {
+			tmpDelay = max
 		}
 	} else if s.isRunning() {
 		s.Errorf("%s Accept error: %v", acceptName, err)
@@ -2569,33 +3686,11 @@ func (s *Server) acceptError(acceptName string, err error, tmpDelay time.Duratio
 }
 
 func (s *Server) getRandomIP(resolver netResolver, url string) (string, error) {
-	host, port, err := net.SplitHostPort(url)
+	addrs, err := s.resolveOutbound(resolver, url)
 	if err != nil {
 		return "", err
 	}
-	// If already an IP, skip.
-	if net.ParseIP(host) != nil {
-		return url, nil
-	}
-	ips, err := resolver.LookupHost(context.Background(), host)
-	if err != nil {
-		return "", fmt.Errorf("lookup for host %q: %v", host, err)
-	}
-	var address string
-	if len(ips) == 0 {
-		s.Warnf("Unable to get IP for %s, will try with %s: %v", host, url, err)
-		address = url
-	} else {
-		var ip string
-		if len(ips) == 1 {
-			ip = ips[0]
-		} else {
-			ip = ips[rand.Int31n(int32(len(ips)))]
-		}
-		// add the port
-		address = net.JoinHostPort(ip, port)
-	}
-	return address, nil
+	return addrs[0], nil
 }
 
 // Returns true for the first attempt and depending on the nature
@@ -14,8 +14,11 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -23,9 +26,11 @@ import (
 	"net/url"
 	"os"
 	"runtime"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -1012,6 +1017,163 @@ func TestGetRandomIP(t *testing.T) {
 	}
 }
 
+func TestOutboundDial(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		outbound_dial {
+			resolve_timeout: "2s"
+			prefer: IPv6
+			happy_eyeballs: true
+			fallback_delay: "50ms"
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	expected := OutboundDialOpts{
+		ResolveTimeout: 2 * time.Second,
+		Prefer:         DialPreferIPv6,
+		HappyEyeballs:  true,
+		FallbackDelay:  50 * time.Millisecond,
+	}
+	if opts.OutboundDial != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, opts.OutboundDial)
+	}
+	conf = createConfFile(t, []byte(`outbound_dial { prefer: ipv5 }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "invalid outbound dial preference") {
+		t.Fatalf("Expected error about preference, got %v", err)
+	}
+
+	s := &Server{opts: opts, quitCh: make(chan struct{})}
+	resolver := &myDummyDNSResolver{ips: []string{"1.2.3.4", "::1", "2.2.3.4", "::2"}}
+	for i := 0; i < 10; i++ {
+		addrs, err := s.resolveOutbound(resolver, "localhost:4222")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(addrs) != 4 || isIPv4(addrs[0]) || isIPv4(addrs[1]) || !isIPv4(addrs[2]) || !isIPv4(addrs[3]) {
+			t.Fatalf("Expected IPv6 addresses first, got %v", addrs)
+		}
+		if addrs = interleaveFamilies(addrs); isIPv4(addrs[0]) || !isIPv4(addrs[1]) || isIPv4(addrs[2]) || !isIPv4(addrs[3]) {
+			t.Fatalf("Expected IP families to alternate, got %v", addrs)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	good := l.Addr().String()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	bad := closed.Addr().String()
+	closed.Close()
+
+	// With happy eyeballs, the connection succeeds even if the first
+	// address can't be connected to.
+	conn, err := s.dialOutbound("route", []string{bad, good}, time.Second)
+	if err != nil {
+		t.Fatalf("Error dialing: %v", err)
+	}
+	conn.Close()
+	eps := s.outboundEndpoints()
+	if len(eps) != 2 {
+		t.Fatalf("Expected 2 endpoints, got %+v", eps)
+	}
+	for _, ep := range eps {
+		if ep.Kind != "route" {
+			t.Fatalf("Unexpected kind: %+v", ep)
+		}
+		switch ep.Address {
+		case good:
+			if ep.Failures != 0 || ep.Backoff != nil {
+				t.Fatalf("Unexpected state for %s: %+v", good, ep)
+			}
+		case bad:
+			if ep.Failures != 1 || ep.LastError == _EMPTY_ || ep.Backoff == nil {
+				t.Fatalf("Unexpected state for %s: %+v", bad, ep)
+			}
+		default:
+			t.Fatalf("Unexpected endpoint: %+v", ep)
+		}
+	}
+
+	// The endpoint in backoff is now dialed last.
+	_, port, _ := net.SplitHostPort(bad)
+	resolver.ips = []string{"127.0.0.1", "127.0.0.2"}
+	for i := 0; i < 10; i++ {
+		addrs, err := s.resolveOutbound(resolver, net.JoinHostPort("localhost", port))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if addrs[1] != bad {
+			t.Fatalf("Expected %s to be last, got %v", bad, addrs)
+		}
+	}
+
+	// Without happy eyeballs, only the first address is dialed.
+	opts.OutboundDial.HappyEyeballs = false
+	if _, err := s.dialOutbound("gateway", []string{bad, good}, time.Second); err == nil {
+		t.Fatal("Expected dial to fail")
+	}
+	for _, ep := range s.outboundEndpoints() {
+		if ep.Address == bad && (ep.Kind != "gateway" || ep.Failures != 2) {
+			t.Fatalf("Unexpected state for %s: %+v", bad, ep)
+		}
+	}
+}
+
+type inProcessDialer struct {
+	s *Server
+}
+
+func (d *inProcessDialer) Dial(network, address string) (net.Conn, error) {
+	return d.s.InProcessConn()
+}
+
+func TestInProcessConn(t *testing.T) {
+	opts := DefaultOptions()
+	opts.TLSConfig = &tls.Config{}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	// The connection is in-process, so TLS is not required.
+	nc, err := nats.Connect("nats://in-process:4222", nats.SetCustomDialer(&inProcessDialer{s}))
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	defer nc.Close()
+	sub := natsSubSync(t, nc, "foo")
+	natsPub(t, nc, "foo", []byte("hello"))
+	if msg := natsNexMsg(t, sub, time.Second); string(msg.Data) != "hello" {
+		t.Fatalf("Unexpected message: %q", msg.Data)
+	}
+	if n := s.NumClients(); n != 1 {
+		t.Fatalf("Expected 1 client, got %v", n)
+	}
+	nc.Close()
+	checkClientsCount(t, s, 0)
+
+	s.Shutdown()
+	if _, err := s.InProcessConn(); err != ErrServerNotRunning {
+		t.Fatalf("Expected error %v, got %v", ErrServerNotRunning, err)
+	}
+}
+
 type slowWriteConn struct {
 	net.Conn
 }
@@ -1543,3 +1705,822 @@ func TestReconnectErrorReports(t *testing.T) {
 		})
 	}
 }
+
+func TestMemoryPressureShedding(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	// A connection that we pretend uses a lot of memory.
+	c, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port), 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("CONNECT {\"verbose\":false}\r\nPING\r\n")); err != nil {
+		t.Fatalf("Error sending protocols to server: %v", err)
+	}
+	// Wait for the PONG so that we know the readLoop is running.
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 512)
+	if n, err := c.Read(buf); err != nil || !strings.Contains(string(buf[:n]), "PONG") {
+		if n, err = c.Read(buf); err != nil || !strings.Contains(string(buf[:n]), "PONG") {
+			t.Fatalf("Expected PONG, got %q (err=%v)", buf[:n], err)
+		}
+	}
+	checkClientsCount(t, s, 1)
+	s.mu.Lock()
+	var big *client
+	for _, cl := range s.clients {
+		big = cl
+	}
+	s.mu.Unlock()
+	big.mu.Lock()
+	big.in.rsz = 3 * 1024 * 1024
+	big.mu.Unlock()
+
+	nc, err := nats.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	limit := int64(3200 * 1024)
+	// Above the pause threshold, but under the limit, reads are paused.
+	s.checkMemoryPressure(limit)
+	if atomic.LoadInt32(&s.memPressure) != 1 {
+		t.Fatal("Expected server to be under memory pressure")
+	}
+	// The readLoop may already be waiting on a read, so the pause
+	// applies after that one.
+	nc.FlushTimeout(100 * time.Millisecond)
+	if err := nc.FlushTimeout(100 * time.Millisecond); err == nil {
+		t.Fatal("Expected reads to be paused")
+	}
+	if v, _ := s.Varz(nil); v.MemoryUsed < 3*1024*1024 {
+		t.Fatalf("Unexpected memory used in varz: %v", v.MemoryUsed)
+	}
+
+	// Pausing reads does not help, so the worst offender is closed.
+	for i := 0; i < memoryShedChecks; i++ {
+		s.checkMemoryPressure(limit)
+	}
+	if atomic.LoadInt32(&s.memPressure) != 0 {
+		t.Fatal("Expected memory pressure to be cleared")
+	}
+	if err := nc.FlushTimeout(time.Second); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+	conns, _ := s.Connz(&ConnzOptions{State: ConnClosed})
+	if len(conns.Conns) != 1 || conns.Conns[0].Cid != big.cid || conns.Conns[0].Reason != MemoryPressure.String() {
+		t.Fatalf("Expected connection to be closed due to memory pressure, got %+v", conns.Conns)
+	}
+}
+
+func TestAdmissionControl(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		admission {
+			max_rss: 1
+			retry_after: "2s"
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if ao := opts.Admission; ao == nil || ao.MaxRSS != 1 || ao.RetryAfter != 2*time.Second {
+		t.Fatalf("Unexpected admission options: %+v", ao)
+	}
+	// The resident memory is always above 1 byte.
+	s.checkAdmission(opts.Admission)
+	if atomic.LoadInt32(&s.overloaded) != 1 {
+		t.Fatal("Expected server to be overloaded")
+	}
+
+	c, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port), 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(c)
+	if _, err := br.ReadString('\n'); err != nil {
+		t.Fatalf("Error reading INFO: %v", err)
+	}
+	if l, err := br.ReadString('\n'); err != nil || l != "-ERR 'Server Overloaded, Retry After 2s'\r\n" {
+		t.Fatalf("Expected error, got %q, %v", l, err)
+	}
+	checkClosedConns(t, s, 1, time.Second)
+	if cc := s.closedClients(); cc[0].Reason != ServerOverloaded.String() {
+		t.Fatalf("Unexpected closed reason: %q", cc[0].Reason)
+	}
+	if v, _ := s.Varz(nil); !v.Overloaded || v.AdmissionRejected != 1 {
+		t.Fatalf("Unexpected varz: overloaded=%v rejected=%v", v.Overloaded, v.AdmissionRejected)
+	}
+
+	// With a high threshold, the server is no longer overloaded on the
+	// next check, and a deferred connection is then admitted.
+	reloadUpdateConfig(t, s, conf, `
+		listen: "127.0.0.1:-1"
+		admission {
+			max_rss: 1000GB
+			defer: "5s"
+		}
+	`)
+	s.setOverloaded(true, "test")
+	start := time.Now()
+	nc, err := nats.Connect(s.ClientURL(), nats.Timeout(5*time.Second))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	if dur := time.Since(start); dur < admissionDeferWait {
+		t.Fatalf("Expected connection to be deferred, took %v", dur)
+	}
+	if v, _ := s.Varz(nil); v.Overloaded || v.AdmissionRejected != 1 {
+		t.Fatalf("Unexpected varz: overloaded=%v rejected=%v", v.Overloaded, v.AdmissionRejected)
+	}
+}
+
+func TestWatchdogStalls(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		watchdog: "100ms"
+		write_deadline: "100ms"
+		system_account: SYS
+		accounts {
+			SYS { users: [{user: sys, password: pwd}] }
+			A { users: [{user: a, password: pwd}] }
+		}
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	l := &captureErrorLogger{errCh: make(chan string, 100)}
+	s.SetLogger(l, false, false)
+
+	url := func(user string) string {
+		return fmt.Sprintf("nats://%s:pwd@%s:%d", user, opts.Host, opts.Port)
+	}
+	ncs, err := nats.Connect(url("sys"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncs.Close()
+	events, _ := ncs.SubscribeSync(fmt.Sprintf(serverStallEventSubj, s.ID()))
+	ncs.Flush()
+
+	nc, err := nats.Connect(url("a"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	var c *client
+	s.mu.Lock()
+	for _, cli := range s.clients {
+		if cli.opts.Username == "a" {
+			c = cli
+		}
+	}
+	s.mu.Unlock()
+
+	expectError := func(substr string) {
+		t.Helper()
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case e := <-l.errCh:
+				if strings.Contains(e, substr) {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("Expected error containing %q", substr)
+			}
+		}
+	}
+
+	// Hold the client lock so that its write loop gets stuck when it
+	// wakes up, which happens at least every second.
+	c.mu.Lock()
+	expectError(fmt.Sprintf("write loop of cid %d stalled", c.cid))
+	c.mu.Unlock()
+
+	msg, err := events.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Expected stall advisory: %v", err)
+	}
+	m := ServerStallEventMsg{}
+	if err := json.Unmarshal(msg.Data, &m); err != nil {
+		t.Fatalf("Error unmarshalling stall advisory: %v", err)
+	}
+	if m.Server.ID != s.ID() || m.Kind != stallWriteLoop || m.ClientID != c.cid || m.Duration < 200*time.Millisecond {
+		t.Fatalf("Unexpected stall advisory: %+v", m)
+	}
+
+	// A stuck server lock is reported, without advisory.
+	s.mu.Lock()
+	expectError("server lock stalled")
+	s.mu.Unlock()
+	if msg, err := events.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Unexpected stall advisory: %s", msg.Data)
+	}
+}
+
+func TestServerLifecycleHooks(t *testing.T) {
+	atomic.StoreInt64(&lameDuckModeInitialDelay, 0)
+	defer atomic.StoreInt64(&lameDuckModeInitialDelay, lameDuckModeDefaultInitialDelay)
+
+	opts := DefaultOptions()
+	opts.LeafNode.Host = "127.0.0.1"
+	opts.LeafNode.Port = -1
+	opts.LameDuckDuration = time.Millisecond
+	s := New(opts)
+	if s == nil {
+		t.Fatal("Failed to create server")
+	}
+
+	var mu sync.Mutex
+	var events []string
+	record := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+	ready := make(chan struct{})
+	s.OnListenersReady(func() {
+		// All listeners must be available to the hook.
+		s.mu.Lock()
+		ok := s.listener != nil && s.routeListener != nil && s.leafNodeListener != nil
+		s.mu.Unlock()
+		if !ok {
+			t.Errorf("Expected all listeners to be ready")
+		}
+		record("ready")
+		close(ready)
+	})
+	s.OnLameDuck(func() { record("ldm") })
+	s.OnShutdownPhase(func(p ShutdownPhase) { record(p.String()) })
+
+	go s.Start()
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Listeners ready hook not invoked")
+	}
+	// Registered once ready, the hook is invoked right away.
+	readyAgain := false
+	s.OnListenersReady(func() { readyAgain = true })
+	if !readyAgain {
+		t.Fatal("Expected listeners ready hook to be invoked on registration")
+	}
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	s.lameDuckMode()
+	s.WaitForShutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	expected := []string{"ready", "ldm",
+		ShutdownListenersClosed.String(), ShutdownConnectionsClosed.String(), ShutdownComplete.String()}
+	if strings.Join(events, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected hooks %v, got %v", expected, events)
+	}
+}
+
+func TestServerListenRetry(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+
+	opts := DefaultOptions()
+	opts.Port = port
+	opts.Cluster.Port = 0
+	opts.ListenRetry = 5 * time.Second
+	s := New(opts)
+	defer s.Shutdown()
+	go s.Start()
+
+	time.Sleep(100 * time.Millisecond)
+	if s.ReadyForConnections(50 * time.Millisecond) {
+		t.Fatal("Server should not be ready while the port is in use")
+	}
+	l.Close()
+	if !s.ReadyForConnections(5 * time.Second) {
+		t.Fatal("Server should be ready once the port is released")
+	}
+	if addr := s.Addr().(*net.TCPAddr); addr.Port != port {
+		t.Fatalf("Expected server to listen on port %d, got %d", port, addr.Port)
+	}
+}
+
+func TestSocketOpts(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		socket {
+			no_delay: false
+			keep_alive: "30s"
+			recv_buffer: 1MB
+			send_buffer: 512KB
+		}
+		cluster {
+			listen: "127.0.0.1:-1"
+			socket {
+				keep_alive: false
+			}
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	expected := SocketOpts{
+		DisableNoDelay: true,
+		KeepAlive:      30 * time.Second,
+		RecvBuffer:     1024 * 1024,
+		SendBuffer:     512 * 1024,
+	}
+	if opts.Socket == nil || *opts.Socket != expected {
+		t.Fatalf("Expected %+v, got %+v", expected, opts.Socket)
+	}
+	if so := opts.Cluster.Socket; so == nil || *so != (SocketOpts{KeepAlive: -1}) {
+		t.Fatalf("Expected cluster keepalives to be disabled, got %+v", so)
+	}
+	if opts.Gateway.Socket != nil || opts.LeafNode.Socket != nil {
+		t.Fatalf("Expected no gateway and leafnode socket options")
+	}
+	conf = createConfFile(t, []byte(`socket { recv_buffer: -1 }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "can't be negative") {
+		t.Fatalf("Expected error about buffer size, got %v", err)
+	}
+
+	// Connections are usable with the tuned sockets.
+	opts.NoLog, opts.NoSigs = true, true
+	s := RunServer(opts)
+	defer s.Shutdown()
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+}
+
+func TestClientAcceptors(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Port = -1
+	opts.ClientAcceptors = 4
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	s.mu.Lock()
+	nrl := len(s.reuseListeners)
+	s.mu.Unlock()
+	if nrl != 3 {
+		t.Fatalf("Expected 3 additional listeners, got %v", nrl)
+	}
+	// The connections are spread among the listeners by the kernel, they
+	// must all be accepted.
+	for i := 0; i < 20; i++ {
+		nc := natsConnect(t, s.ClientURL())
+		if err := nc.Flush(); err != nil {
+			t.Fatalf("Error on flush: %v", err)
+		}
+		nc.Close()
+	}
+
+	s.Shutdown()
+	s.mu.Lock()
+	nrl = len(s.reuseListeners)
+	s.mu.Unlock()
+	if nrl != 0 {
+		t.Fatalf("Expected additional listeners to be closed, got %v", nrl)
+	}
+	if _, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", opts.Port)); err == nil {
+		t.Fatal("Expected connection to fail after shutdown")
+	}
+}
+
+func TestAcceptFDExhausted(t *testing.T) {
+	opts := DefaultOptions()
+	opts.AcceptErrors = &AcceptErrorOpts{
+		MinSleep:  time.Millisecond,
+		MaxSleep:  3 * time.Millisecond,
+		CloseIdle: 1,
+	}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	idle := natsConnect(t, s.ClientURL())
+	defer idle.Close()
+	active := natsConnect(t, s.ClientURL())
+	defer active.Close()
+	time.Sleep(10 * time.Millisecond)
+	natsPub(t, active, "foo", []byte("hello"))
+	natsFlush(t, active)
+
+	emfile := &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	if !isFDExhausted(emfile) {
+		t.Fatalf("Expected error to be detected as file descriptors exhaustion")
+	}
+	// The backoff is within the configured bounds.
+	if d := s.acceptError("Client", emfile, ACCEPT_MIN_SLEEP); d != 3*time.Millisecond {
+		t.Fatalf("Expected delay to be capped, got %v", d)
+	}
+	if d := s.acceptError("Client", emfile, 0); d != 2*time.Millisecond {
+		t.Fatalf("Expected delay to start at the minimum, got %v", d)
+	}
+
+	// The most idle connection was closed, only once.
+	conns := s.closedClients()
+	if len(conns) != 1 || conns[0].Reason != FileDescriptorsExhausted.String() || conns[0].Cid != 1 {
+		t.Fatalf("Unexpected closed connections: %+v", conns)
+	}
+	if n := s.NumClients(); n != 1 {
+		t.Fatalf("Expected 1 client, got %d", n)
+	}
+	v, _ := s.Varz(nil)
+	if v.FDExhausted != 2 {
+		t.Fatalf("Expected 2 errors in varz, got %d", v.FDExhausted)
+	}
+}
+
+type captureNoticeLogger struct {
+	DummyLogger
+	sync.Mutex
+	notices []string
+}
+
+func (l *captureNoticeLogger) Noticef(format string, v ...interface{}) {
+	l.Lock()
+	l.notices = append(l.notices, fmt.Sprintf(format, v...))
+	l.Unlock()
+}
+
+func TestServerQuietStartupReport(t *testing.T) {
+	defer func() { FlagSnapshot = nil }()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fopts, err := ConfigureOptions(fs, []string{"-q", "--startup_report", "report.json"}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Error configuring options: %v", err)
+	}
+	if !fopts.Quiet || fopts.StartupReport != "report.json" {
+		t.Fatalf("Unexpected options: quiet=%v startup_report=%q", fopts.Quiet, fopts.StartupReport)
+	}
+
+	dir, err := ioutil.TempDir("", "startup_report")
+	if err != nil {
+		t.Fatalf("Error creating dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := DefaultOptions()
+	opts.HTTPHost = "127.0.0.1"
+	opts.HTTPPort = -1
+	opts.Quiet = true
+	opts.StartupReport = dir + "/report.json"
+	s := New(opts)
+	if s == nil {
+		t.Fatal("Failed to create server")
+	}
+	l := &captureNoticeLogger{}
+	s.SetLogger(l, false, false)
+	ready := make(chan struct{})
+	s.OnListenersReady(func() { close(ready) })
+	go s.Start()
+	defer s.Shutdown()
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Server not ready")
+	}
+
+	l.Lock()
+	for _, n := range l.notices {
+		if strings.Contains(n, "Listening for") || strings.Contains(n, "Server is ready") {
+			t.Fatalf("Unexpected startup banner in quiet mode: %q", n)
+		}
+	}
+	l.Unlock()
+
+	data, err := ioutil.ReadFile(opts.StartupReport)
+	if err != nil {
+		t.Fatalf("Error reading startup report: %v", err)
+	}
+	r := StartupReport{}
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatalf("Error unmarshalling startup report: %v", err)
+	}
+	if r.ID != s.ID() || r.Version != VERSION || r.Options == nil || r.Options.Host != "127.0.0.1" {
+		t.Fatalf("Unexpected startup report: %s", data)
+	}
+	if r.Listeners[ClientListener] != s.Addr().String() || r.Listeners[MonitoringListener] == _EMPTY_ {
+		t.Fatalf("Unexpected listeners: %v", r.Listeners)
+	}
+	if _, ok := r.Listeners[GatewayListener]; ok {
+		t.Fatalf("Unexpected gateway listener: %v", r.Listeners)
+	}
+	if !r.Features["monitoring"] || r.Features["gateway"] {
+		t.Fatalf("Unexpected features: %v", r.Features)
+	}
+}
+
+func TestServerContainerLimits(t *testing.T) {
+	write := func(t *testing.T, root string, files map[string]string) {
+		t.Helper()
+		for name, content := range files {
+			path := root + "/" + name
+			if err := os.MkdirAll(path[:strings.LastIndex(path, "/")], 0755); err != nil {
+				t.Fatalf("Error creating dir: %v", err)
+			}
+			if err := ioutil.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+				t.Fatalf("Error writing file: %v", err)
+			}
+		}
+	}
+	for _, test := range []struct {
+		name    string
+		files   map[string]string
+		cpus    float64
+		memory  int64
+		source  string
+		pending int64
+	}{
+		{"none", nil, 0, 0, _EMPTY_, MAX_PENDING_SIZE},
+		{"cgroup2", map[string]string{"cpu.max": "150000 100000", "memory.max": "536870912"},
+			1.5, 512 * 1024 * 1024, "cgroup2", 8 * 1024 * 1024},
+		{"cgroup2 no limits", map[string]string{"cpu.max": "max 100000", "memory.max": "max"},
+			0, 0, _EMPTY_, MAX_PENDING_SIZE},
+		{"cgroup1", map[string]string{
+			"cpu/cpu.cfs_quota_us":         "50000",
+			"cpu/cpu.cfs_period_us":        "100000",
+			"memory/memory.limit_in_bytes": "17179869184"},
+			0.5, 16 * 1024 * 1024 * 1024, "cgroup1", MAX_PENDING_SIZE},
+		{"cgroup1 no limits", map[string]string{
+			"cpu/cpu.cfs_quota_us":         "-1",
+			"cpu/cpu.cfs_period_us":        "100000",
+			"memory/memory.limit_in_bytes": "9223372036854771712"},
+			0, 0, _EMPTY_, MAX_PENDING_SIZE},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := ioutil.TempDir("", "cgroup")
+			if err != nil {
+				t.Fatalf("Error creating dir: %v", err)
+			}
+			defer os.RemoveAll(root)
+			write(t, root, test.files)
+
+			cl := readContainerLimits(root)
+			if test.source == _EMPTY_ {
+				if cl != nil {
+					t.Fatalf("Expected no limits, got %+v", cl)
+				}
+			} else if cl == nil || cl.Source != test.source || cl.CPUs != test.cpus || cl.Memory != test.memory {
+				t.Fatalf("Unexpected limits: %+v", cl)
+			} else if cl.CPUs > 0 && (cl.GOMAXPROCS < 1 || cl.GOMAXPROCS > runtime.NumCPU()) {
+				t.Fatalf("Unexpected GOMAXPROCS: %v", cl.GOMAXPROCS)
+			}
+			if mp := cl.maxPending(); mp != test.pending {
+				t.Fatalf("Expected max pending %v, got %v", test.pending, mp)
+			}
+		})
+	}
+}
+
+func TestServerContainerLimitsOptIn(t *testing.T) {
+	// Not detected unless enabled.
+	opts := DefaultOptions()
+	s := New(opts)
+	if s.containerLimits != nil || opts.MaxPending != MAX_PENDING_SIZE {
+		t.Fatalf("Unexpected limits %+v and max pending %v", s.containerLimits, opts.MaxPending)
+	}
+
+	// The values in use are logged once applied.
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	l := &captureNoticeLogger{}
+	s.SetLogger(l, false, false)
+	s.containerLimits = &ContainerLimits{Source: "cgroup2", CPUs: 1, GOMAXPROCS: 1}
+	s.applyContainerLimits()
+	expected := fmt.Sprintf("Using GOMAXPROCS=%d max_pending=%d", runtime.GOMAXPROCS(0), MAX_PENDING_SIZE)
+	l.Lock()
+	defer l.Unlock()
+	if len(l.notices) != 2 || l.notices[1] != expected {
+		t.Fatalf("Expected notice %q, got %q", expected, l.notices)
+	}
+}
+
+func TestServerMemoryProfile(t *testing.T) {
+	if os.Getenv("GOGC") != _EMPTY_ {
+		t.Skip("GOGC is set in the environment")
+	}
+	for _, test := range []struct {
+		name string
+		opts *Options
+		err  string
+	}{
+		{"unknown profile", &Options{MemoryProfile: "huge"}, "unknown memory profile"},
+		{"invalid gc percent", &Options{GCPercent: -2}, "gc_percent"},
+		{"negative ballast", &Options{MemoryBallast: -1}, "memory_ballast"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := validateOptions(test.opts); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error about %q, got %v", test.err, err)
+			}
+		})
+	}
+
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		max_connections: 100
+		memory_profile: Medium
+		memory_ballast: 1024
+	`))
+	defer os.Remove(conf)
+	opts := LoadConfig(conf)
+	if opts.MemoryProfile != MemoryProfileMedium || opts.MemoryBallast != 1024 {
+		t.Fatalf("Unexpected options: profile=%q ballast=%v", opts.MemoryProfile, opts.MemoryBallast)
+	}
+	mp := opts.memoryProfile()
+	if mp.conns != 100 || mp.gcPercent != 150 || mp.ballast != 1024 {
+		t.Fatalf("Unexpected memory profile: %+v", mp)
+	}
+
+	orig := debug.SetGCPercent(100)
+	defer debug.SetGCPercent(orig)
+	s := RunServer(opts)
+	if gcp := debug.SetGCPercent(150); gcp != 150 {
+		t.Fatalf("Expected GC percent to be 150, got %v", gcp)
+	}
+	s.mu.Lock()
+	ballast := len(s.ballast)
+	s.mu.Unlock()
+	if ballast != 1024 {
+		t.Fatalf("Expected ballast of 1024 bytes, got %v", ballast)
+	}
+	s.Shutdown()
+	if gcp := debug.SetGCPercent(orig); gcp != 100 {
+		t.Fatalf("Expected GC percent to be restored to 100, got %v", gcp)
+	}
+	if s.ballast != nil {
+		t.Fatalf("Expected ballast to be released")
+	}
+}
+
+func TestUniqueConnections(t *testing.T) {
+	for _, policy := range []string{UniqueConnReject, UniqueConnEvict} {
+		t.Run(policy, func(t *testing.T) {
+			conf := createConfFile(t, []byte(fmt.Sprintf(`
+				listen: "127.0.0.1:-1"
+				accounts {
+					A { users: [{user: a, password: pwd}, {user: b, password: pwd}] }
+					B { users: [{user: c, password: pwd}] }
+				}
+				unique_connections { policy: %s }
+			`, policy)))
+			defer os.Remove(conf)
+			s, opts := RunServerWithConfig(conf)
+			defer s.Shutdown()
+
+			connect := func(user string) (*nats.Conn, error) {
+				return nats.Connect(fmt.Sprintf("nats://%s:pwd@%s:%d", user, opts.Host, opts.Port),
+					nats.NoReconnect())
+			}
+			nc1, err := connect("a")
+			if err != nil {
+				t.Fatalf("Error on connect: %v", err)
+			}
+			defer nc1.Close()
+			// Other users of the account, or of other accounts, are not affected.
+			for _, user := range []string{"b", "c"} {
+				nc, err := connect(user)
+				if err != nil {
+					t.Fatalf("Error on connect for %q: %v", user, err)
+				}
+				defer nc.Close()
+			}
+
+			nc2, err := connect("a")
+			if policy == UniqueConnReject {
+				if err == nil || !strings.Contains(err.Error(), ErrDuplicateConnection.Error()) {
+					t.Fatalf("Expected duplicate connection error, got %v", err)
+				}
+				if !nc1.IsConnected() {
+					t.Fatal("Expected first connection to be kept")
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Error on connect: %v", err)
+				}
+				defer nc2.Close()
+				checkFor(t, time.Second, 15*time.Millisecond, func() error {
+					if !nc1.IsClosed() {
+						return fmt.Errorf("Expected first connection to be closed")
+					}
+					return nil
+				})
+				// The identity can still connect once the connection is closed.
+				nc2.Close()
+				checkClientsCount(t, s, 2)
+				nc3, err := connect("a")
+				if err != nil {
+					t.Fatalf("Error on connect: %v", err)
+				}
+				nc3.Close()
+			}
+
+			connz, err := s.Connz(&ConnzOptions{State: ConnClosed})
+			if err != nil {
+				t.Fatalf("Error on connz: %v", err)
+			}
+			found := false
+			for _, ci := range connz.Conns {
+				if ci.Reason == DuplicateConnection.String() {
+					found = true
+				}
+			}
+			if !found {
+				t.Fatalf("Expected a connection closed as duplicate")
+			}
+		})
+	}
+
+	conf := createConfFile(t, []byte(`unique_connections { by: name }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), "invalid unique connection identity") {
+		t.Fatalf("Expected error for invalid identity, got %v", err)
+	}
+}
+
+func TestMaxPendingAuth(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Username = "user"
+	opts.Password = "pwd"
+	opts.MaxPendingAuth = 2
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	addr := fmt.Sprintf("%s:%d", opts.Host, opts.Port)
+	dial := func() (net.Conn, *bufio.Reader) {
+		t.Helper()
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Error on dial: %v", err)
+		}
+		br := bufio.NewReader(c)
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		if l, err := br.ReadString('\n'); err != nil || !strings.HasPrefix(l, "INFO ") {
+			t.Fatalf("Expected INFO, got %q, %v", l, err)
+		}
+		return c, br
+	}
+	c1, br1 := dial()
+	defer c1.Close()
+	c2, _ := dial()
+	defer c2.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.pendingAuth(CLIENT); n != 2 {
+			return fmt.Errorf("Expected 2 connections pending authentication, got %d", n)
+		}
+		return nil
+	})
+
+	// The next one is rejected until one of the pending ones authenticates.
+	c3, br3 := dial()
+	defer c3.Close()
+	if l, _ := br3.ReadString('\n'); !strings.Contains(l, ErrTooManyPendingAuth.Error()) {
+		t.Fatalf("Expected pending authentications error, got %q", l)
+	}
+	c1.Write([]byte("CONNECT {\"verbose\":false,\"user\":\"user\",\"pass\":\"pwd\"}\r\nPING\r\n"))
+	if l, _ := br1.ReadString('\n'); l != "PONG\r\n" {
+		t.Fatalf("Expected PONG, got %q", l)
+	}
+	if n := s.pendingAuth(CLIENT); n != 1 {
+		t.Fatalf("Expected 1 connection pending authentication, got %d", n)
+	}
+	nc := natsConnect(t, fmt.Sprintf("nats://user:pwd@%s", addr))
+	defer nc.Close()
+
+	// Closed connections are no longer pending.
+	c2.Close()
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if n := s.pendingAuth(CLIENT); n != 0 {
+			return fmt.Errorf("Expected no connection pending authentication, got %d", n)
+		}
+		return nil
+	})
+	conns := s.closedClients()
+	if len(conns) == 0 || conns[0].Reason != MaxPendingAuthExceeded.String() {
+		t.Fatalf("Unexpected closed connections: %+v", conns)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servertest
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// DefaultTimeout is the default time to wait for a protocol from the
+// server.
+const DefaultTimeout = 2 * time.Second
+
+// ConnectOpts are the fields of the CONNECT protocol sent by Conn.
+type ConnectOpts struct {
+	Name     string `json:"name,omitempty"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Token    string `json:"auth_token,omitempty"`
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Protocol int    `json:"protocol"`
+	// NoEcho prevents the client from receiving its own messages.
+	NoEcho bool `json:"-"`
+}
+
+// Msg is a message received by a Conn.
+type Msg struct {
+	Subject string
+	Sid     string
+	Reply   string
+	Data    []byte
+}
+
+// Conn is a client connection speaking the raw NATS protocol, to check
+// exactly what the server sends.
+type Conn struct {
+	net.Conn
+	// Info is the INFO protocol received when connecting.
+	Info server.Info
+
+	t       TB
+	br      *bufio.Reader
+	pending []*Msg
+}
+
+// Connect connects a client to the server.
+func Connect(t TB, s *server.Server, opts *ConnectOpts) *Conn {
+	t.Helper()
+	addr := s.Addr()
+	if addr == nil {
+		t.Fatalf("Server does not accept clients")
+	}
+	nc, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("Error connecting to %s: %v", addr, err)
+	}
+	return NewConn(t, nc, opts)
+}
+
+// ConnectInProcess connects a client to the server without going through
+// the network.
+func ConnectInProcess(t TB, s *server.Server, opts *ConnectOpts) *Conn {
+	t.Helper()
+	nc, err := s.InProcessConn()
+	if err != nil {
+		t.Fatalf("Error creating in-process connection: %v", err)
+	}
+	return NewConn(t, nc, opts)
+}
+
+// NewConn performs the client handshake over the connection to a server.
+func NewConn(t TB, nc net.Conn, opts *ConnectOpts) *Conn {
+	t.Helper()
+	c := &Conn{Conn: nc, t: t, br: bufio.NewReader(nc)}
+	line := c.readLine(DefaultTimeout)
+	if !strings.HasPrefix(line, "INFO ") {
+		c.Close()
+		t.Fatalf("Expected INFO, got %q", line)
+	}
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &c.Info); err != nil {
+		c.Close()
+		t.Fatalf("Error unmarshalling INFO: %v", err)
+	}
+	co := ConnectOpts{Protocol: server.ClientProtoInfo}
+	if opts != nil {
+		co = *opts
+	}
+	b, _ := json.Marshal(struct {
+		*ConnectOpts
+		Echo bool `json:"echo"`
+	}{&co, !co.NoEcho})
+	c.Send(fmt.Sprintf("CONNECT %s\r\n", b))
+	c.Flush()
+	return c
+}
+
+// Send writes the raw protocol to the server.
+func (c *Conn) Send(proto string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.Conn, proto); err != nil {
+		c.t.Fatalf("Error writing to server: %v", err)
+	}
+}
+
+// Sub subscribes to the subject, in a queue group if not empty.
+func (c *Conn) Sub(subject, queue, sid string) {
+	c.t.Helper()
+	if queue != "" {
+		c.Send(fmt.Sprintf("SUB %s %s %s\r\n", subject, queue, sid))
+	} else {
+		c.Send(fmt.Sprintf("SUB %s %s\r\n", subject, sid))
+	}
+}
+
+// Unsub removes the subscription.
+func (c *Conn) Unsub(sid string) {
+	c.t.Helper()
+	c.Send(fmt.Sprintf("UNSUB %s\r\n", sid))
+}
+
+// Pub publishes a message, with a reply subject if not empty.
+func (c *Conn) Pub(subject, reply string, data []byte) {
+	c.t.Helper()
+	if reply != "" {
+		c.Send(fmt.Sprintf("PUB %s %s %d\r\n%s\r\n", subject, reply, len(data), data))
+	} else {
+		c.Send(fmt.Sprintf("PUB %s %d\r\n%s\r\n", subject, len(data), data))
+	}
+}
+
+// Flush sends a PING and waits for the PONG, so that the protocols sent
+// before have been processed by the server. Messages received in the
+// meantime are returned by NextMsg.
+func (c *Conn) Flush() {
+	c.t.Helper()
+	c.Send("PING\r\n")
+	for {
+		if m := c.readProto(DefaultTimeout, "PONG"); m != nil {
+			c.pending = append(c.pending, m)
+		} else {
+			return
+		}
+	}
+}
+
+// NextMsg returns the next message received, failing the test if none
+// is received within the timeout.
+func (c *Conn) NextMsg(timeout time.Duration) *Msg {
+	c.t.Helper()
+	if len(c.pending) > 0 {
+		m := c.pending[0]
+		c.pending = c.pending[1:]
+		return m
+	}
+	m := c.readProto(timeout, "")
+	if m == nil {
+		c.t.Fatalf("Expected a message")
+	}
+	return m
+}
+
+// ExpectNoMsg fails the test if a message is received within the timeout.
+func (c *Conn) ExpectNoMsg(timeout time.Duration) {
+	c.t.Helper()
+	if len(c.pending) > 0 {
+		c.t.Fatalf("Unexpected message: %+v", c.pending[0])
+	}
+	c.SetReadDeadline(time.Now().Add(timeout))
+	_, err := c.br.Peek(1)
+	c.SetReadDeadline(time.Time{})
+	if err == nil {
+		c.t.Fatalf("Unexpected protocol: %q", c.readLine(DefaultTimeout))
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		c.t.Fatalf("Error reading from server: %v", err)
+	}
+}
+
+// readProto reads protocols until a message, returned, or the expected
+// protocol, in which case nil is returned. PINGs are answered, errors
+// fail the test.
+func (c *Conn) readProto(timeout time.Duration, expected string) *Msg {
+	c.t.Helper()
+	for {
+		line := c.readLine(timeout)
+		switch {
+		case expected != "" && line == expected:
+			return nil
+		case line == "PING":
+			c.Send("PONG\r\n")
+		case line == "+OK", line == "PONG", strings.HasPrefix(line, "INFO "):
+		case strings.HasPrefix(line, "-ERR"):
+			c.t.Fatalf("Error from server: %s", line)
+		case strings.HasPrefix(line, "MSG "):
+			return c.readMsg(line, timeout)
+		default:
+			c.t.Fatalf("Unexpected protocol: %q", line)
+		}
+	}
+}
+
+func (c *Conn) readMsg(line string, timeout time.Duration) *Msg {
+	c.t.Helper()
+	args := strings.Fields(line)[1:]
+	m := &Msg{}
+	switch len(args) {
+	case 3:
+		m.Subject, m.Sid = args[0], args[1]
+	case 4:
+		m.Subject, m.Sid, m.Reply = args[0], args[1], args[2]
+	default:
+		c.t.Fatalf("Invalid message: %q", line)
+	}
+	size, err := strconv.Atoi(args[len(args)-1])
+	if err != nil {
+		c.t.Fatalf("Invalid message size: %q", line)
+	}
+	m.Data = make([]byte, size+2)
+	c.SetReadDeadline(time.Now().Add(timeout))
+	_, err = io.ReadFull(c.br, m.Data)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.t.Fatalf("Error reading message payload: %v", err)
+	}
+	m.Data = m.Data[:size]
+	return m
+}
+
+func (c *Conn) readLine(timeout time.Duration) string {
+	c.t.Helper()
+	c.SetReadDeadline(time.Now().Add(timeout))
+	line, err := c.br.ReadString('\n')
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		c.t.Fatalf("Error reading from server: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
@@ -0,0 +1,261 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package servertest provides support for the integration tests of
+// programs embedding the NATS server: options builders, helpers to run
+// servers and a raw protocol client.
+package servertest
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// TB is the subset of testing.TB used by this package, so that it can be
+// used from tests and benchmarks.
+type TB interface {
+	Helper()
+	Fatalf(format string, args ...interface{})
+}
+
+// Option modifies the options of a server.
+type Option func(o *server.Options)
+
+// DefaultOptions returns options for a server listening for clients on a
+// random port of the loopback interface, without logging or signal
+// handling.
+func DefaultOptions() *server.Options {
+	return &server.Options{
+		Host:                  "127.0.0.1",
+		Port:                  server.RANDOM_PORT,
+		NoLog:                 true,
+		NoSigs:                true,
+		DisableShortFirstPing: true,
+	}
+}
+
+// NewOptions returns the default options modified by the given options.
+func NewOptions(opts ...Option) *server.Options {
+	o := DefaultOptions()
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// WithServerName sets the name of the server.
+func WithServerName(name string) Option {
+	return func(o *server.Options) {
+		o.ServerName = name
+	}
+}
+
+// WithUser requires clients to authenticate with this user and password.
+func WithUser(user, password string) Option {
+	return func(o *server.Options) {
+		o.Username = user
+		o.Password = password
+	}
+}
+
+// WithLogging enables the logging of the server, with debug and trace
+// messages if requested.
+func WithLogging(debug, trace bool) Option {
+	return func(o *server.Options) {
+		o.NoLog = false
+		o.Debug = debug
+		o.Trace = trace
+	}
+}
+
+// WithMonitoring enables the monitoring endpoint on a random port.
+func WithMonitoring() Option {
+	return func(o *server.Options) {
+		o.HTTPHost = "127.0.0.1"
+		o.HTTPPort = server.RANDOM_PORT
+	}
+}
+
+// WithCluster enables the route listener on a random port, and
+// connects to the routes, if any.
+func WithCluster(routes ...*url.URL) Option {
+	return func(o *server.Options) {
+		o.Cluster.Host = "127.0.0.1"
+		o.Cluster.Port = server.RANDOM_PORT
+		o.Routes = append(o.Routes, routes...)
+	}
+}
+
+// WithGateway enables the gateway listener on a random port with the
+// name of the local cluster.
+func WithGateway(name string) Option {
+	return func(o *server.Options) {
+		o.Gateway.Name = name
+		o.Gateway.Host = "127.0.0.1"
+		o.Gateway.Port = server.RANDOM_PORT
+	}
+}
+
+// WithGatewayRemote connects to the gateway of the named cluster. It has
+// to be used after WithGateway.
+func WithGatewayRemote(name string, urls ...*url.URL) Option {
+	return func(o *server.Options) {
+		o.Gateway.Gateways = append(o.Gateway.Gateways, &server.RemoteGatewayOpts{Name: name, URLs: urls})
+	}
+}
+
+// WithLeafNodes enables the leafnode listener on a random port.
+func WithLeafNodes() Option {
+	return func(o *server.Options) {
+		o.LeafNode.Host = "127.0.0.1"
+		o.LeafNode.Port = server.RANDOM_PORT
+	}
+}
+
+// WithLeafNodeRemote connects as a leafnode to one of the urls, binding
+// the connection to the local account if not empty.
+func WithLeafNodeRemote(localAccount string, urls ...*url.URL) Option {
+	return func(o *server.Options) {
+		o.LeafNode.Remotes = append(o.LeafNode.Remotes, &server.RemoteLeafOpts{LocalAccount: localAccount, URLs: urls})
+	}
+}
+
+// RunServer starts a server with the given options, the default ones if
+// nil, and waits for it to accept connections. The caller is responsible
+// for shutting down the server.
+func RunServer(t TB, opts *server.Options) *server.Server {
+	t.Helper()
+	if opts == nil {
+		opts = DefaultOptions()
+	}
+	s, err := server.NewServer(opts)
+	if err != nil {
+		t.Fatalf("Error creating server: %v", err)
+	}
+	if !opts.NoLog {
+		s.ConfigureLogger()
+	}
+	go s.Start()
+	if !s.ReadyForConnections(10 * time.Second) {
+		s.Shutdown()
+		t.Fatalf("Server not ready for connections")
+	}
+	return s
+}
+
+// RunServerWithConfig starts a server with the options of a
+// configuration file.
+func RunServerWithConfig(t TB, configFile string) (*server.Server, *server.Options) {
+	t.Helper()
+	opts, err := server.ProcessConfigFile(configFile)
+	if err != nil {
+		t.Fatalf("Error processing configuration file: %v", err)
+	}
+	opts.NoSigs = true
+	return RunServer(t, opts), opts
+}
+
+// RouteURL returns the URL to connect routes to the server, nil if the
+// server does not accept routes.
+func RouteURL(s *server.Server) *url.URL {
+	addr := s.ClusterAddr()
+	if addr == nil {
+		return nil
+	}
+	return &url.URL{Scheme: "nats", Host: addr.String()}
+}
+
+// GatewayURL returns the URL to connect gateways to the server, nil if
+// the server does not accept gateways.
+func GatewayURL(s *server.Server) *url.URL {
+	addr := s.GatewayAddr()
+	if addr == nil {
+		return nil
+	}
+	return &url.URL{Scheme: "nats", Host: addr.String()}
+}
+
+// LeafNodeURL returns the URL to connect leafnodes to the server, nil if
+// the server does not accept leafnodes.
+func LeafNodeURL(s *server.Server) *url.URL {
+	addr := s.LeafNodeAddr()
+	if addr == nil {
+		return nil
+	}
+	return &url.URL{Scheme: "nats", Host: addr.String()}
+}
+
+// MonitorURL returns the base URL of the monitoring endpoint of the
+// server, empty if monitoring is not enabled.
+func MonitorURL(s *server.Server) string {
+	addr := s.MonitorAddr()
+	if addr == nil {
+		return ""
+	}
+	return fmt.Sprintf("http://%s/", addr)
+}
+
+// WaitFor calls f every interval until it returns nil, failing the test
+// with the last error if it still does not after totalWait.
+func WaitFor(t TB, totalWait, interval time.Duration, f func() error) {
+	t.Helper()
+	timeout := time.Now().Add(totalWait)
+	var err error
+	for time.Now().Before(timeout) {
+		err = f()
+		if err == nil {
+			return
+		}
+		time.Sleep(interval)
+	}
+	t.Fatalf("%v", err)
+}
+
+// WaitForRoutes waits for the server to have the expected number of
+// routes.
+func WaitForRoutes(t TB, s *server.Server, expected int) {
+	t.Helper()
+	WaitFor(t, 5*time.Second, 15*time.Millisecond, func() error {
+		if n := s.NumRoutes(); n != expected {
+			return fmt.Errorf("Expected %v routes, got %v", expected, n)
+		}
+		return nil
+	})
+}
+
+// WaitForLeafNodes waits for the server to have the expected number of
+// leafnode connections.
+func WaitForLeafNodes(t TB, s *server.Server, expected int) {
+	t.Helper()
+	WaitFor(t, 5*time.Second, 15*time.Millisecond, func() error {
+		if n := s.NumLeafNodes(); n != expected {
+			return fmt.Errorf("Expected %v leafnodes, got %v", expected, n)
+		}
+		return nil
+	})
+}
+
+// WaitForOutboundGateways waits for the server to have the expected
+// number of outbound gateway connections.
+func WaitForOutboundGateways(t TB, s *server.Server, expected int) {
+	t.Helper()
+	WaitFor(t, 5*time.Second, 15*time.Millisecond, func() error {
+		if n := s.NumOutboundGateways(); n != expected {
+			return fmt.Errorf("Expected %v outbound gateways, got %v", expected, n)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,85 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package servertest
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestClusterAndLeafNode(t *testing.T) {
+	s1 := RunServer(t, NewOptions(WithServerName("s1"), WithCluster(), WithLeafNodes(), WithMonitoring()))
+	defer s1.Shutdown()
+	s2 := RunServer(t, NewOptions(WithServerName("s2"), WithCluster(RouteURL(s1))))
+	defer s2.Shutdown()
+	leaf := RunServer(t, NewOptions(WithUser("user", "pwd"), WithLeafNodeRemote("", LeafNodeURL(s1))))
+	defer leaf.Shutdown()
+
+	WaitForRoutes(t, s1, 1)
+	WaitForRoutes(t, s2, 1)
+	WaitForLeafNodes(t, s1, 1)
+
+	resp, err := http.Get(MonitorURL(s1) + "varz")
+	if err != nil {
+		t.Fatalf("Error getting varz: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status: %v", resp.StatusCode)
+	}
+
+	sub := Connect(t, s2, nil)
+	defer sub.Close()
+	if sub.Info.Port == 0 {
+		t.Fatalf("Expected INFO to be set, got %+v", sub.Info)
+	}
+	sub.Sub("foo", "", "1")
+	sub.Sub("bar", "queue", "2")
+	sub.Flush()
+
+	pub := Connect(t, leaf, &ConnectOpts{User: "user", Pass: "pwd", NoEcho: true})
+	defer pub.Close()
+	pub.Sub("foo", "", "1")
+	pub.Flush()
+	// Wait for the interest of the subscriber to reach the leafnode.
+	WaitFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := leaf.NumSubscriptions(); n < 3 {
+			return fmt.Errorf("Expected 3 subscriptions, got %v", n)
+		}
+		return nil
+	})
+
+	pub.Pub("foo", "reply", []byte("hello"))
+	pub.Flush()
+	m := sub.NextMsg(time.Second)
+	if m.Subject != "foo" || m.Sid != "1" || m.Reply != "reply" || string(m.Data) != "hello" {
+		t.Fatalf("Unexpected message: %+v", m)
+	}
+	pub.ExpectNoMsg(50 * time.Millisecond)
+}
+
+func TestInProcessConn(t *testing.T) {
+	s := RunServer(t, nil)
+	defer s.Shutdown()
+
+	c := ConnectInProcess(t, s, nil)
+	defer c.Close()
+	c.Sub("foo", "", "1")
+	c.Pub("foo", "", []byte("hello"))
+	if m := c.NextMsg(time.Second); string(m.Data) != "hello" {
+		t.Fatalf("Unexpected message: %+v", m)
+	}
+}
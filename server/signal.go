@@ -40,7 +40,7 @@ func (s *Server) handleSignals() {
 	}
 	c := make(chan os.Signal, 1)
 
-	signal.Notify(c, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP, syscall.SIGTTIN)
 
 	go func() {
 		for {
@@ -56,6 +56,11 @@ func (s *Server) handleSignals() {
 					s.ReOpenLogFile()
 				case syscall.SIGUSR2:
 					go s.lameDuckMode()
+				case syscall.SIGTTIN:
+					// Binary upgrade.
+					if err := s.Upgrade(); err != nil {
+						s.Errorf("Failed to upgrade server: %v", err)
+					}
 				case syscall.SIGHUP:
 					// Config reload.
 					if err := s.Reload(); err != nil {
@@ -113,6 +118,8 @@ func ProcessSignal(command Command, pidStr string) error {
 		err = kill(pid, syscall.SIGHUP)
 	case commandLDMode:
 		err = kill(pid, syscall.SIGUSR2)
+	case CommandUpgrade:
+		err = kill(pid, syscall.SIGTTIN)
 	default:
 		err = fmt.Errorf("unknown signal %q", command)
 	}
@@ -0,0 +1,78 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// SocketOpts tune the TCP connections accepted by a listener, and the ones
+// dialed to the remotes of the same kind. The system defaults are kept for
+// the zero values.
+type SocketOpts struct {
+	// DisableNoDelay disables TCP_NODELAY, so that small writes are
+	// coalesced by the kernel.
+	DisableNoDelay bool `json:"-"`
+	// KeepAlive is the TCP keepalive period, keepalives are disabled if
+	// negative.
+	KeepAlive time.Duration `json:"-"`
+	// RecvBuffer and SendBuffer are the sizes of the SO_RCVBUF and
+	// SO_SNDBUF socket buffers.
+	RecvBuffer int `json:"-"`
+	SendBuffer int `json:"-"`
+}
+
+func (o *SocketOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.RecvBuffer < 0 || o.SendBuffer < 0 {
+		return fmt.Errorf("socket buffer sizes can't be negative")
+	}
+	return nil
+}
+
+// applySocketOpts applies the options to the connection if it is a TCP
+// connection.
+func (s *Server) applySocketOpts(conn net.Conn, so *SocketOpts) {
+	if so == nil {
+		return
+	}
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	var err error
+	if so.DisableNoDelay {
+		err = tc.SetNoDelay(false)
+	}
+	if err == nil && so.KeepAlive < 0 {
+		err = tc.SetKeepAlive(false)
+	} else if err == nil && so.KeepAlive > 0 {
+		if err = tc.SetKeepAlive(true); err == nil {
+			err = tc.SetKeepAlivePeriod(so.KeepAlive)
+		}
+	}
+	if err == nil && so.RecvBuffer > 0 {
+		err = tc.SetReadBuffer(so.RecvBuffer)
+	}
+	if err == nil && so.SendBuffer > 0 {
+		err = tc.SetWriteBuffer(so.SendBuffer)
+	}
+	if err != nil {
+		s.Warnf("Error setting socket options of %s: %v", conn.RemoteAddr(), err)
+	}
+}
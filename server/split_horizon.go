@@ -0,0 +1,112 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// Messages received from a leaf node are tagged with the name of the
+// cluster of the leaf node when they are sent over routes and gateways,
+// with the LMSG protocol instead of RMSG:
+//
+//	LMSG <origin> <account> <subject> [reply] <size>
+//
+// The servers receiving them do not deliver them to the leaf node
+// connections of that same cluster, which already got them from the
+// originating server. This prevents duplicates and loops when a cluster
+// has leaf node connections to several servers of a hub, or to several
+// hubs joined by gateways.
+
+// validateClusterName checks that the cluster name can be used in the
+// LMSG protocol.
+func validateClusterName(o *Options) error {
+	if name := o.Cluster.Name; strings.ContainsAny(name, " \t\r\n") {
+		return fmt.Errorf("cluster name %q can not contain spaces", name)
+	}
+	return nil
+}
+
+// clusterName returns the name of the cluster of this server, used to tag
+// the messages coming from it: the cluster name if set, otherwise its
+// gateway name, if any.
+func clusterName(o *Options) string {
+	if o.Cluster.Name != _EMPTY_ {
+		return o.Cluster.Name
+	}
+	return o.Gateway.Name
+}
+
+// processRoutedOriginMsgArgs processes an inbound LMSG specification from
+// a route or gateway.
+func (c *client) processRoutedOriginMsgArgs(trace bool, arg []byte) error {
+	if trace {
+		c.traceInOp("LMSG", arg)
+	}
+	i := bytes.IndexAny(arg, " \t")
+	if i <= 0 {
+		return fmt.Errorf("processRoutedOriginMsgArgs Parse Error: '%s'", arg)
+	}
+	if err := c.processRoutedMsgArgs(false, arg[i+1:]); err != nil {
+		return err
+	}
+	c.pa.origin = arg[:i]
+	c.pa.arg = arg
+	return nil
+}
+
+// msgOrigin returns the cluster the message being processed comes from,
+// if it came from a leaf node, empty otherwise.
+func (c *client) msgOrigin() string {
+	switch c.kind {
+	case LEAF:
+		return c.leaf.remoteCluster
+	case ROUTER, GATEWAY:
+		if len(c.pa.origin) > 0 {
+			return string(c.pa.origin)
+		}
+		if c.kind == GATEWAY {
+			return c.gw.name
+		}
+	}
+	return _EMPTY_
+}
+
+// isLeafLoop returns true if the message, coming from origin, would be
+// sent back to the cluster of the leaf node connection lc. This is
+// counted as a suppressed loop.
+func (c *client) isLeafLoop(lc *client, origin string) bool {
+	if origin == _EMPTY_ || lc.leaf.remoteCluster != origin {
+		return false
+	}
+	atomic.AddInt64(&c.srv.suppressedLoops, 1)
+	return true
+}
+
+// supportsOrigin returns true if the route or outbound gateway connection
+// accepts messages tagged with their origin cluster.
+func (c *client) supportsOrigin() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch c.kind {
+	case ROUTER:
+		return c.route != nil && c.route.lnoc
+	case GATEWAY:
+		return c.gw != nil && c.gw.lnoc
+	}
+	return false
+}
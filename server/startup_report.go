@@ -0,0 +1,102 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// StartupReportStdout writes the startup report to the standard output
+// when used as the startup report destination.
+const StartupReportStdout = "-"
+
+// StartupReport is written, as a single line of JSON, once all the
+// listeners of the server are ready, for orchestration tooling.
+type StartupReport struct {
+	ID         string            `json:"server_id"`
+	Name       string            `json:"server_name"`
+	Version    string            `json:"version"`
+	GitCommit  string            `json:"git_commit,omitempty"`
+	GoVersion  string            `json:"go"`
+	Start      time.Time         `json:"start"`
+	ConfigFile string            `json:"config_file,omitempty"`
+	Listeners  map[string]string `json:"listeners"`
+	Features   map[string]bool   `json:"features"`
+	Options    *Options          `json:"options"`
+}
+
+// bannerf logs the startup messages, unless quiet.
+func (s *Server) bannerf(format string, v ...interface{}) {
+	if opts := s.getOpts(); opts != nil && opts.Quiet {
+		return
+	}
+	s.Noticef(format, v...)
+}
+
+// writeStartupReport writes the startup report, if enabled, with the
+// addresses of the listeners from their readiness.
+func (s *Server) writeStartupReport(readiness map[string]*ListenerReadiness) {
+	opts := s.getOpts()
+	if opts.StartupReport == _EMPTY_ {
+		return
+	}
+	r := &StartupReport{
+		Version:   VERSION,
+		GitCommit: gitCommit,
+		Listeners: make(map[string]string),
+		Options:   opts,
+	}
+	for lt, lr := range readiness {
+		if lr.Configured {
+			r.Listeners[lt] = lr.Addr
+		}
+	}
+	s.mu.Lock()
+	r.ID = s.info.ID
+	r.Name = s.info.Name
+	r.GoVersion = s.info.GoVersion
+	r.Start = s.start
+	r.ConfigFile = s.configFile
+	r.Features = map[string]bool{
+		"auth":             s.info.AuthRequired,
+		"tls":              s.info.TLSRequired,
+		"tls_verify":       s.info.TLSVerify,
+		"cluster":          opts.Cluster.Port != 0,
+		"gateway":          opts.Gateway.Port != 0,
+		"leafnode":         opts.LeafNode.Port != 0,
+		"leafnode_remotes": len(opts.LeafNode.Remotes) > 0,
+		"monitoring":       opts.HTTPPort != 0 || opts.HTTPSPort != 0,
+		"system_account":   s.sys != nil && s.sys.account != nil,
+		"operator_mode":    len(s.trustedKeys) > 0,
+	}
+	s.mu.Unlock()
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		s.Errorf("Error marshaling startup report: %v", err)
+		return
+	}
+	b = append(b, '\n')
+	if opts.StartupReport == StartupReportStdout {
+		_, err = os.Stdout.Write(b)
+	} else {
+		err = ioutil.WriteFile(opts.StartupReport, b, 0666)
+	}
+	if err != nil {
+		s.Errorf("Error writing startup report: %v", err)
+	}
+}
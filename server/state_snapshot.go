@@ -0,0 +1,158 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Minimum interval between two state snapshots, which are expensive to
+// collect on a busy server.
+var stateSnapshotInterval = 10 * time.Second
+
+// StateSnapshot is the full state of the server, for offline analysis
+// during incidents: its connections with their subscriptions, routes,
+// gateways, leafnodes, interest and accounts.
+type StateSnapshot struct {
+	ID       string    `json:"server_id"`
+	Now      time.Time `json:"now"`
+	Varz     *Varz     `json:"varz"`
+	Connz    *Connz    `json:"connz"`
+	Routez   *Routez   `json:"routez"`
+	Gatewayz *Gatewayz `json:"gatewayz"`
+	Leafz    *Leafz    `json:"leafz"`
+	Subsz    *Subsz    `json:"subsz"`
+	Accountz *Accountz `json:"accountz"`
+}
+
+// StateSnapshotRequest asks for a snapshot of the server state.
+type StateSnapshotRequest struct {
+	// File writes the snapshot, gzip compressed, in the directory set
+	// with `state_snapshot_dir` instead of returning it in the response.
+	File bool `json:"file,omitempty"`
+}
+
+// StateSnapshotResponse is the response to a state snapshot request,
+// with either the snapshot or the file it was written to.
+type StateSnapshotResponse struct {
+	Server   string         `json:"server_id"`
+	File     string         `json:"file,omitempty"`
+	Snapshot *StateSnapshot `json:"snapshot,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// StateSnapshot collects the state of the server. No more than one
+// snapshot is taken per stateSnapshotInterval.
+func (s *Server) StateSnapshot() (*StateSnapshot, error) {
+	s.mu.Lock()
+	if since := time.Since(s.lastStateSnapshot); since < stateSnapshotInterval {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("state snapshot rate limited, retry in %v", (stateSnapshotInterval - since).Round(time.Second))
+	}
+	s.lastStateSnapshot = time.Now()
+	nc := len(s.clients)
+	s.mu.Unlock()
+
+	ss := &StateSnapshot{ID: s.ID(), Now: time.Now()}
+	var err error
+	if ss.Varz, err = s.Varz(nil); err != nil {
+		return nil, err
+	}
+	if ss.Connz, err = s.Connz(&ConnzOptions{Subscriptions: true, Username: true, Limit: nc + 1}); err != nil {
+		return nil, err
+	}
+	if ss.Routez, err = s.Routez(&RoutezOptions{Subscriptions: true}); err != nil {
+		return nil, err
+	}
+	if ss.Gatewayz, err = s.Gatewayz(&GatewayzOptions{Accounts: true}); err != nil {
+		return nil, err
+	}
+	if ss.Leafz, err = s.Leafz(&LeafzOptions{Subscriptions: true}); err != nil {
+		return nil, err
+	}
+	if ss.Subsz, err = s.Subsz(&SubszOptions{Subscriptions: true, Limit: s.gacc.TotalSubs() + 1}); err != nil {
+		return nil, err
+	}
+	if ss.Accountz, err = s.Accountz(nil); err != nil {
+		return nil, err
+	}
+	return ss, nil
+}
+
+// writeStateSnapshot writes the snapshot, gzip compressed, to a new file
+// in the snapshot directory and returns its path.
+func (s *Server) writeStateSnapshot(ss *StateSnapshot) (string, error) {
+	dir := s.getOpts().StateSnapshotDir
+	if dir == _EMPTY_ {
+		return _EMPTY_, errors.New("state snapshot directory not configured")
+	}
+	name := filepath.Join(dir, fmt.Sprintf("state_%s_%s.json.gz", ss.ID, ss.Now.UTC().Format("20060102T150405.000")))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	zw := gzip.NewWriter(f)
+	err = json.NewEncoder(zw).Encode(ss)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name)
+		return _EMPTY_, err
+	}
+	return name, nil
+}
+
+// stateSnapshotReq is a request to snapshot the state of the server.
+func (s *Server) stateSnapshotReq(sub *subscription, _ *client, subject, reply string, msg []byte) {
+	if !s.eventsRunning() || reply == _EMPTY_ {
+		return
+	}
+	resp := &StateSnapshotResponse{Server: s.ID()}
+	req := &StateSnapshotRequest{}
+	if len(msg) > 0 {
+		if err := json.Unmarshal(msg, req); err != nil {
+			resp.Error = fmt.Sprintf("Error unmarshalling state snapshot request: %v", err)
+			s.sendInternalMsgLocked(reply, _EMPTY_, nil, resp)
+			return
+		}
+	}
+	// Collect the snapshot off the internal send loop.
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		ss, err := s.StateSnapshot()
+		switch {
+		case err != nil:
+			resp.Error = err.Error()
+		case req.File:
+			if resp.File, err = s.writeStateSnapshot(ss); err != nil {
+				resp.Error = fmt.Sprintf("Error writing state snapshot: %v", err)
+			} else {
+				s.Noticef("Wrote state snapshot to %q", resp.File)
+			}
+		default:
+			resp.Snapshot = ss
+		}
+		s.sendInternalMsgLocked(reply, _EMPTY_, nil, resp)
+	})
+}
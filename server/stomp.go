@@ -0,0 +1,714 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The STOMP listener accepts STOMP 1.2 connections and bridges each of them
+// to an in-process NATS client connection, which is authenticated with the
+// login and passcode of the STOMP CONNECT frame. Destinations map to
+// subjects: "/topic/foo.bar" is the subject "foo.bar", "/queue/foo" is the
+// subject "foo" with the queue group "foo" for subscriptions, and any other
+// destination has its leading "/" removed and the other "/" replaced by ".".
+// Delivery is at-most-once like for any NATS subscription: ACK and NACK
+// frames are accepted but a NACK, or a missing ACK, does not redeliver the
+// message. Transactions and heart-beats are not supported.
+
+const (
+	stompVersion       = "1.2"
+	stompMaxLine       = 32 * 1024
+	stompTopicPrefix   = "/topic/"
+	stompQueuePrefix   = "/queue/"
+	stompAckAuto       = "auto"
+	stompAckClient     = "client"
+	stompAckIndividual = "client-individual"
+)
+
+// StompOpts are options for the STOMP listener.
+type StompOpts struct {
+	Host string `json:"addr,omitempty"`
+	Port int    `json:"port,omitempty"`
+}
+
+// stompAcceptLoop starts the STOMP listener and accepts the connections
+// until the server is shutdown.
+func (s *Server) stompAcceptLoop(ch chan struct{}) {
+	defer s.acceptLoopStarted()()
+	defer func() {
+		if ch != nil {
+			close(ch)
+		}
+	}()
+
+	// Snapshot server options.
+	opts := s.getOpts()
+
+	port := opts.Stomp.Port
+	if port == -1 {
+		port = 0
+	}
+	hp := net.JoinHostPort(opts.Stomp.Host, strconv.Itoa(port))
+	l, e := s.listen(hp)
+	if e != nil {
+		s.Fatalf("Error listening on STOMP port: %d - %v", opts.Stomp.Port, e)
+		return
+	}
+	s.bannerf("Listening for STOMP connections on %s",
+		net.JoinHostPort(opts.Stomp.Host, strconv.Itoa(l.Addr().(*net.TCPAddr).Port)))
+
+	s.mu.Lock()
+	// If we have selected a random port, write it back to options.
+	if port == 0 {
+		opts.Stomp.Port = l.Addr().(*net.TCPAddr).Port
+	}
+	s.stompListener = l
+	s.mu.Unlock()
+
+	// Let them know we are up
+	close(ch)
+	ch = nil
+
+	tmpDelay := ACCEPT_MIN_SLEEP
+	for s.isRunning() {
+		conn, err := l.Accept()
+		if err != nil {
+			tmpDelay = s.acceptError("STOMP", err, tmpDelay)
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		s.startGoRoutine(func() {
+			s.serveStomp(conn)
+			s.grWG.Done()
+		})
+	}
+	s.Debugf("STOMP accept loop exiting..")
+	s.done <- true
+}
+
+// StompAddr returns the net.Addr object for the STOMP listener.
+func (s *Server) StompAddr() *net.TCPAddr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stompListener == nil {
+		return nil
+	}
+	return s.stompListener.Addr().(*net.TCPAddr)
+}
+
+// stompFrame is a STOMP frame. Only the first occurrence of a repeated
+// header is kept, as required by the specification.
+type stompFrame struct {
+	cmd  string
+	hdrs map[string]string
+	body []byte
+}
+
+// stompSub is a subscription of a STOMP connection.
+type stompSub struct {
+	id   string
+	dest string
+	sid  string
+	ack  string
+}
+
+// stompReceipt is a receipt to send once the NATS connection replied to the
+// PING that follows the frame it was requested for.
+type stompReceipt struct {
+	id    string
+	close bool
+}
+
+// stompConn bridges a STOMP connection to an in-process NATS connection.
+type stompConn struct {
+	srv  *Server
+	conn net.Conn
+	br   *bufio.Reader
+	wmu  sync.Mutex
+	nc   net.Conn
+	nbr  *bufio.Reader
+	nmu  sync.Mutex
+	once sync.Once
+
+	mu       sync.Mutex
+	subs     map[string]*stompSub
+	sids     map[string]*stompSub
+	sid      uint64
+	msgID    uint64
+	receipts []stompReceipt
+}
+
+// serveStomp bridges an accepted STOMP connection until either side closes.
+func (s *Server) serveStomp(conn net.Conn) {
+	c := &stompConn{
+		srv:  s,
+		conn: conn,
+		br:   bufio.NewReaderSize(conn, stompMaxLine),
+		subs: make(map[string]*stompSub),
+		sids: make(map[string]*stompSub),
+	}
+	nc, err := s.InProcessConn()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	c.nc, c.nbr = nc, bufio.NewReaderSize(nc, stompMaxLine)
+	if err := c.connect(); err != nil {
+		s.Debugf("STOMP connection from %s rejected: %v", conn.RemoteAddr(), err)
+		c.sendError(err.Error())
+		c.close()
+		return
+	}
+	if !s.startGoRoutine(func() {
+		c.natsReadLoop()
+		s.grWG.Done()
+	}) {
+		c.close()
+		return
+	}
+	c.stompReadLoop()
+}
+
+// close closes both sides of the bridge.
+func (c *stompConn) close() {
+	c.once.Do(func() {
+		c.conn.Close()
+		c.nc.Close()
+	})
+}
+
+// connect reads the CONNECT frame of the STOMP client and sends it as the
+// CONNECT protocol of the NATS connection. The CONNECTED frame is sent back
+// once the server has replied to the PING that follows.
+func (c *stompConn) connect() error {
+	line, err := readProtoLine(c.nbr)
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("server not ready")
+	}
+	// Do not wait for the CONNECT frame longer than for the CONNECT
+	// protocol of a client, nor after the server is shutdown.
+	s, opts := c.srv, c.srv.getOpts()
+	timeout := secondsToDuration(opts.AuthTimeout)
+	if timeout <= 0 {
+		timeout = AUTH_TIMEOUT
+	}
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-s.quitCh:
+			c.close()
+		case <-done:
+		}
+	}()
+	f, err := readStompFrame(c.br, int(opts.MaxPayload))
+	close(done)
+	if err != nil {
+		return err
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	if f.cmd != "CONNECT" && f.cmd != "STOMP" {
+		return fmt.Errorf("expected CONNECT frame, got %q", f.cmd)
+	}
+	if av, ok := f.hdrs["accept-version"]; ok && !stompAcceptsVersion(av) {
+		return fmt.Errorf("supported protocol version is %s", stompVersion)
+	}
+	co := &clientOpts{
+		Echo:     true,
+		Name:     "stomp:" + c.conn.RemoteAddr().String(),
+		Lang:     "stomp",
+		Version:  stompVersion,
+		Protocol: ClientProtoInfo,
+	}
+	if login := f.hdrs["login"]; login != _EMPTY_ {
+		co.Username, co.Password = login, f.hdrs["passcode"]
+	} else {
+		co.Authorization = f.hdrs["passcode"]
+	}
+	b, _ := json.Marshal(co)
+	if err := c.natsSend(fmt.Sprintf("CONNECT %s\r\nPING\r\n", b), nil); err != nil {
+		return err
+	}
+	for {
+		line, err := readProtoLine(c.nbr)
+		if err != nil {
+			return fmt.Errorf("connection closed")
+		}
+		switch {
+		case line == "PONG":
+			return c.sendFrame("CONNECTED", [][2]string{
+				{"version", stompVersion},
+				{"heart-beat", "0,0"},
+				{"server", "nats-server/" + VERSION},
+			}, nil)
+		case line == "PING":
+			c.natsSend("PONG\r\n", nil)
+		case strings.HasPrefix(line, "-ERR "):
+			return errors.New(protoErrText(line))
+		}
+	}
+}
+
+func stompAcceptsVersion(versions string) bool {
+	for _, v := range strings.Split(versions, ",") {
+		if strings.TrimSpace(v) == stompVersion {
+			return true
+		}
+	}
+	return false
+}
+
+// stompReadLoop processes the frames of the STOMP client.
+func (c *stompConn) stompReadLoop() {
+	maxPayload := int(c.srv.getOpts().MaxPayload)
+	for {
+		f, err := readStompFrame(c.br, maxPayload)
+		if err != nil {
+			if !isStompIOError(err) {
+				c.sendError(err.Error())
+			}
+			c.close()
+			return
+		}
+		if f.cmd == "DISCONNECT" {
+			if rid := f.hdrs["receipt"]; rid != _EMPTY_ {
+				// The NATS read loop closes the bridge after the receipt.
+				if err := c.receipt(rid, true); err == nil {
+					return
+				}
+			}
+			c.close()
+			return
+		}
+		if err := c.processFrame(f); err != nil {
+			c.sendError(err.Error())
+			c.close()
+			return
+		}
+		if rid := f.hdrs["receipt"]; rid != _EMPTY_ {
+			if err := c.receipt(rid, false); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// isStompIOError returns true if the error is from reading the connection,
+// as opposed to an invalid frame.
+func isStompIOError(err error) bool {
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF || err == io.ErrClosedPipe
+}
+
+// processFrame translates a frame of the STOMP client to NATS protocols.
+func (c *stompConn) processFrame(f *stompFrame) error {
+	switch f.cmd {
+	case "SEND":
+		subject, _, err := stompSubject(f.hdrs["destination"])
+		if err != nil {
+			return err
+		}
+		if !IsValidLiteralSubject(subject) {
+			return fmt.Errorf("invalid destination %q for SEND", f.hdrs["destination"])
+		}
+		if _, ok := f.hdrs["transaction"]; ok {
+			return fmt.Errorf("transactions are not supported")
+		}
+		proto := "PUB " + subject
+		if rt, ok := f.hdrs["reply-to"]; ok {
+			reply, _, err := stompSubject(rt)
+			if err != nil || !IsValidLiteralSubject(reply) {
+				return fmt.Errorf("invalid reply-to %q", rt)
+			}
+			proto += " " + reply
+		}
+		return c.natsSend(fmt.Sprintf("%s %d\r\n", proto, len(f.body)), f.body)
+	case "SUBSCRIBE":
+		id, dest := f.hdrs["id"], f.hdrs["destination"]
+		if id == _EMPTY_ {
+			return fmt.Errorf("missing id header in SUBSCRIBE")
+		}
+		subject, queue, err := stompSubject(dest)
+		if err != nil {
+			return err
+		}
+		if !IsValidSubject(subject) {
+			return fmt.Errorf("invalid destination %q for SUBSCRIBE", dest)
+		}
+		ack := f.hdrs["ack"]
+		switch ack {
+		case _EMPTY_:
+			ack = stompAckAuto
+		case stompAckAuto, stompAckClient, stompAckIndividual:
+		default:
+			return fmt.Errorf("invalid ack mode %q", ack)
+		}
+		c.mu.Lock()
+		if c.subs[id] != nil {
+			c.mu.Unlock()
+			return fmt.Errorf("duplicate subscription id %q", id)
+		}
+		c.sid++
+		sub := &stompSub{id: id, dest: dest, sid: strconv.FormatUint(c.sid, 10), ack: ack}
+		c.subs[id], c.sids[sub.sid] = sub, sub
+		c.mu.Unlock()
+		if queue != _EMPTY_ {
+			return c.natsSend(fmt.Sprintf("SUB %s %s %s\r\n", subject, queue, sub.sid), nil)
+		}
+		return c.natsSend(fmt.Sprintf("SUB %s %s\r\n", subject, sub.sid), nil)
+	case "UNSUBSCRIBE":
+		id := f.hdrs["id"]
+		c.mu.Lock()
+		sub := c.subs[id]
+		if sub != nil {
+			delete(c.subs, id)
+			delete(c.sids, sub.sid)
+		}
+		c.mu.Unlock()
+		if sub == nil {
+			return fmt.Errorf("unknown subscription id %q", id)
+		}
+		return c.natsSend(fmt.Sprintf("UNSUB %s\r\n", sub.sid), nil)
+	case "ACK", "NACK":
+		// Nothing is redelivered, so only check that the message exists.
+		n, err := strconv.ParseUint(f.hdrs["id"], 10, 64)
+		c.mu.Lock()
+		last := c.msgID
+		c.mu.Unlock()
+		if err != nil || n == 0 || n > last {
+			return fmt.Errorf("unknown message id %q in %s", f.hdrs["id"], f.cmd)
+		}
+		return nil
+	case "BEGIN", "COMMIT", "ABORT":
+		return fmt.Errorf("transactions are not supported")
+	default:
+		return fmt.Errorf("unknown command %q", f.cmd)
+	}
+}
+
+// receipt sends a PING to the NATS connection, to send the RECEIPT frame
+// once all the protocols before it have been processed.
+func (c *stompConn) receipt(id string, close bool) error {
+	c.mu.Lock()
+	c.receipts = append(c.receipts, stompReceipt{id: id, close: close})
+	c.mu.Unlock()
+	return c.natsSend("PING\r\n", nil)
+}
+
+// natsReadLoop processes the protocols of the NATS connection.
+func (c *stompConn) natsReadLoop() {
+	defer c.close()
+	for {
+		line, err := readProtoLine(c.nbr)
+		if err != nil {
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			if err := c.processMsg(line); err != nil {
+				return
+			}
+		case line == "PING":
+			if err := c.natsSend("PONG\r\n", nil); err != nil {
+				return
+			}
+		case line == "PONG":
+			c.mu.Lock()
+			var r stompReceipt
+			if len(c.receipts) > 0 {
+				r = c.receipts[0]
+				c.receipts = c.receipts[1:]
+			}
+			c.mu.Unlock()
+			if r.id == _EMPTY_ {
+				continue
+			}
+			if err := c.sendFrame("RECEIPT", [][2]string{{"receipt-id", r.id}}, nil); err != nil || r.close {
+				return
+			}
+		case strings.HasPrefix(line, "-ERR "):
+			c.sendError(protoErrText(line))
+			return
+		}
+	}
+}
+
+// processMsg sends a MESSAGE frame for the MSG protocol in line.
+func (c *stompConn) processMsg(line string) error {
+	subject, sid, reply, payload, err := readMsgProto(c.nbr, line)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	sub := c.sids[sid]
+	if sub == nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.msgID++
+	msgID := strconv.FormatUint(c.msgID, 10)
+	c.mu.Unlock()
+
+	dest := subject
+	switch {
+	case strings.HasPrefix(sub.dest, stompTopicPrefix):
+		dest = stompTopicPrefix + subject
+	case strings.HasPrefix(sub.dest, stompQueuePrefix):
+		dest = stompQueuePrefix + subject
+	}
+	hdrs := [][2]string{
+		{"subscription", sub.id},
+		{"message-id", msgID},
+		{"destination", dest},
+	}
+	if reply != _EMPTY_ {
+		hdrs = append(hdrs, [2]string{"reply-to", reply})
+	}
+	if sub.ack != stompAckAuto {
+		hdrs = append(hdrs, [2]string{"ack", msgID})
+	}
+	return c.sendFrame("MESSAGE", hdrs, payload)
+}
+
+// readMsgProto parses the MSG protocol in line and reads its payload.
+func readMsgProto(br *bufio.Reader, line string) (subject, sid, reply string, payload []byte, err error) {
+	args := strings.Fields(strings.TrimPrefix(line, "MSG "))
+	if len(args) != 3 && len(args) != 4 {
+		return _EMPTY_, _EMPTY_, _EMPTY_, nil, fmt.Errorf("invalid MSG %q", line)
+	}
+	size, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || size < 0 {
+		return _EMPTY_, _EMPTY_, _EMPTY_, nil, fmt.Errorf("invalid MSG %q", line)
+	}
+	payload = make([]byte, size+2)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return _EMPTY_, _EMPTY_, _EMPTY_, nil, err
+	}
+	if len(args) == 4 {
+		reply = args[2]
+	}
+	return args[0], args[1], reply, payload[:size], nil
+}
+
+// protoErrText returns the error text of a -ERR protocol.
+func protoErrText(line string) string {
+	return strings.Trim(strings.TrimPrefix(line, "-ERR "), " '")
+}
+
+// stompSubject returns the subject, and the queue group if any, that a
+// destination maps to.
+func stompSubject(dest string) (string, string, error) {
+	var subject, queue string
+	switch {
+	case strings.HasPrefix(dest, stompTopicPrefix):
+		subject = dest[len(stompTopicPrefix):]
+	case strings.HasPrefix(dest, stompQueuePrefix):
+		subject = dest[len(stompQueuePrefix):]
+		queue = subject
+	default:
+		subject = strings.Replace(strings.TrimPrefix(dest, "/"), "/", ".", -1)
+	}
+	if subject == _EMPTY_ || strings.ContainsAny(subject, " \t\r\n") {
+		return _EMPTY_, _EMPTY_, fmt.Errorf("invalid destination %q", dest)
+	}
+	return subject, queue, nil
+}
+
+// natsSend writes the protocol, and the payload if not nil, to the NATS
+// connection.
+func (c *stompConn) natsSend(proto string, payload []byte) error {
+	c.nmu.Lock()
+	defer c.nmu.Unlock()
+	if _, err := io.WriteString(c.nc, proto); err != nil {
+		return err
+	}
+	if payload == nil {
+		return nil
+	}
+	if _, err := c.nc.Write(payload); err != nil {
+		return err
+	}
+	_, err := io.WriteString(c.nc, CR_LF)
+	return err
+}
+
+// sendError sends an ERROR frame to the STOMP client.
+func (c *stompConn) sendError(msg string) {
+	c.sendFrame("ERROR", [][2]string{{"message", msg}}, nil)
+}
+
+// sendFrame writes a frame to the STOMP client.
+func (c *stompConn) sendFrame(cmd string, hdrs [][2]string, body []byte) error {
+	var b bytes.Buffer
+	b.WriteString(cmd)
+	b.WriteByte('\n')
+	for _, h := range hdrs {
+		if cmd == "CONNECTED" {
+			b.WriteString(h[0] + ":" + h[1])
+		} else {
+			b.WriteString(stompEscape(h[0]) + ":" + stompEscape(h[1]))
+		}
+		b.WriteByte('\n')
+	}
+	if body != nil {
+		b.WriteString("content-length:" + strconv.Itoa(len(body)) + "\n")
+	}
+	b.WriteByte('\n')
+	b.Write(body)
+	b.WriteByte(0)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if wd := c.srv.getOpts().WriteDeadline; wd > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(wd))
+	}
+	_, err := c.conn.Write(b.Bytes())
+	return err
+}
+
+// readProtoLine reads a line, without its end of line.
+func readProtoLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return _EMPTY_, fmt.Errorf("line too long")
+	} else if err != nil {
+		return _EMPTY_, err
+	}
+	return strings.TrimSuffix(string(line[:len(line)-1]), "\r"), nil
+}
+
+// readStompFrame reads a frame, skipping the heart-beats before it. The
+// body can not be larger than max bytes.
+func readStompFrame(br *bufio.Reader, max int) (*stompFrame, error) {
+	f := &stompFrame{hdrs: make(map[string]string)}
+	for f.cmd == _EMPTY_ {
+		line, err := readProtoLine(br)
+		if err != nil {
+			return nil, err
+		}
+		f.cmd = line
+	}
+	for {
+		line, err := readProtoLine(br)
+		if err != nil {
+			return nil, err
+		}
+		if line == _EMPTY_ {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("invalid header %q", line)
+		}
+		k, v := line[:i], line[i+1:]
+		// Headers of the CONNECT frames are not escaped.
+		if f.cmd != "CONNECT" {
+			if k, err = stompUnescape(k); err == nil {
+				v, err = stompUnescape(v)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if _, ok := f.hdrs[k]; !ok {
+			f.hdrs[k] = v
+		}
+	}
+	if cl, ok := f.hdrs["content-length"]; ok {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid content-length %q", cl)
+		}
+		if max > 0 && n > max {
+			return nil, ErrMaxPayload
+		}
+		f.body = make([]byte, n+1)
+		if _, err := io.ReadFull(br, f.body); err != nil {
+			return nil, err
+		}
+		if f.body[n] != 0 {
+			return nil, fmt.Errorf("frame not terminated by a NULL octet")
+		}
+		f.body = f.body[:n]
+		return f, nil
+	}
+	for {
+		chunk, err := br.ReadSlice(0)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		f.body = append(f.body, chunk...)
+		if err == nil {
+			f.body = f.body[:len(f.body)-1]
+			break
+		}
+		if max > 0 && len(f.body) > max {
+			return nil, ErrMaxPayload
+		}
+	}
+	if max > 0 && len(f.body) > max {
+		return nil, ErrMaxPayload
+	}
+	return f, nil
+}
+
+var stompEscaper = strings.NewReplacer("\\", "\\\\", "\r", "\\r", "\n", "\\n", ":", "\\c")
+
+func stompEscape(s string) string {
+	return stompEscaper.Replace(s)
+}
+
+func stompUnescape(s string) (string, error) {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i++; i == len(s) {
+			return _EMPTY_, fmt.Errorf("invalid escape in header %q", s)
+		}
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'r':
+			b.WriteByte('\r')
+		case 'n':
+			b.WriteByte('\n')
+		case 'c':
+			b.WriteByte(':')
+		default:
+			return _EMPTY_, fmt.Errorf("invalid escape in header %q", s)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestStompParseConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		stomp {
+			listen: "127.0.0.1:61613"
+		}
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	if so := opts.Stomp; so == nil || so.Host != "127.0.0.1" || so.Port != 61613 {
+		t.Fatalf("Unexpected stomp options: %+v", so)
+	}
+
+	conf = createConfFile(t, []byte(`stomp { port: 61613, heartbeat: 10 }`))
+	defer os.Remove(conf)
+	if _, err := ProcessConfigFile(conf); err == nil {
+		t.Fatal("Expected error for unknown field")
+	}
+}
+
+type stompTestConn struct {
+	t  *testing.T
+	nc net.Conn
+	br *bufio.Reader
+}
+
+func stompTestConnect(t *testing.T, s *Server, hdrs string) *stompTestConn {
+	t.Helper()
+	nc, err := net.Dial("tcp", s.StompAddr().String())
+	if err != nil {
+		t.Fatalf("Error connecting: %v", err)
+	}
+	c := &stompTestConn{t: t, nc: nc, br: bufio.NewReader(nc)}
+	c.send("CONNECT\naccept-version:1.2\nhost:localhost\n" + hdrs + "\n\x00")
+	return c
+}
+
+func (c *stompTestConn) send(frame string) {
+	c.t.Helper()
+	if _, err := c.nc.Write([]byte(frame)); err != nil {
+		c.t.Fatalf("Error sending frame: %v", err)
+	}
+}
+
+func (c *stompTestConn) expect(cmd string) *stompFrame {
+	c.t.Helper()
+	c.nc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := readStompFrame(c.br, 0)
+	if err != nil {
+		c.t.Fatalf("Error reading frame: %v", err)
+	}
+	if f.cmd != cmd {
+		c.t.Fatalf("Expected %s frame, got %s %v", cmd, f.cmd, f.hdrs)
+	}
+	return f
+}
+
+func TestStompBridge(t *testing.T) {
+	o := DefaultOptions()
+	o.Stomp = &StompOpts{Host: "127.0.0.1", Port: -1}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	c := stompTestConnect(t, s, "")
+	defer c.nc.Close()
+	if f := c.expect("CONNECTED"); f.hdrs["version"] != "1.2" {
+		t.Fatalf("Unexpected version: %q", f.hdrs["version"])
+	}
+
+	nc := natsConnect(t, fmt.Sprintf("nats://%s:%d", o.Host, o.Port))
+	defer nc.Close()
+
+	// Subscribe with a wildcard and client acks.
+	c.send("SUBSCRIBE\nid:0\ndestination:/topic/foo.*\nack:client\nreceipt:r1\n\n\x00")
+	if f := c.expect("RECEIPT"); f.hdrs["receipt-id"] != "r1" {
+		t.Fatalf("Unexpected receipt: %v", f.hdrs)
+	}
+	natsPubReq(t, nc, "foo.bar", "reply", []byte("hello"))
+	f := c.expect("MESSAGE")
+	if f.hdrs["subscription"] != "0" || f.hdrs["destination"] != "/topic/foo.bar" ||
+		f.hdrs["reply-to"] != "reply" || f.hdrs["ack"] != f.hdrs["message-id"] || string(f.body) != "hello" {
+		t.Fatalf("Unexpected message: %v %q", f.hdrs, f.body)
+	}
+	c.send("ACK\nid:" + f.hdrs["ack"] + "\nreceipt:r2\n\n\x00")
+	c.expect("RECEIPT")
+
+	// Send to a queue, with a body that has a NULL octet.
+	sub := natsSubSync(t, nc, "baz")
+	natsFlush(t, nc)
+	c.send("SEND\ndestination:/queue/baz\nreply-to:/topic/foo.reply\ncontent-length:3\n\na\x00b\x00")
+	if m := natsNexMsg(t, sub, time.Second); string(m.Data) != "a\x00b" || m.Reply != "foo.reply" {
+		t.Fatalf("Unexpected message: %q reply %q", m.Data, m.Reply)
+	}
+	// Which we also get since the subscription matches the reply subject.
+	natsPub(t, nc, "foo.baz", nil)
+	if f := c.expect("MESSAGE"); f.hdrs["destination"] != "/topic/foo.baz" {
+		t.Fatalf("Unexpected message: %v", f.hdrs)
+	}
+
+	// No more messages once unsubscribed.
+	c.send("UNSUBSCRIBE\nid:0\n\n\x00SEND\ndestination:foo/bat\nreceipt:r3\n\nx\x00")
+	c.expect("RECEIPT")
+
+	// Acking an unknown message is an error.
+	c.send("ACK\nid:100\n\n\x00")
+	if f := c.expect("ERROR"); f.hdrs["message"] == "" {
+		t.Fatalf("Expected error message: %v", f.hdrs)
+	}
+
+	c = stompTestConnect(t, s, "")
+	defer c.nc.Close()
+	c.expect("CONNECTED")
+	c.send("DISCONNECT\nreceipt:bye\n\n\x00")
+	if f := c.expect("RECEIPT"); f.hdrs["receipt-id"] != "bye" {
+		t.Fatalf("Unexpected receipt: %v", f.hdrs)
+	}
+	if _, err := c.br.ReadByte(); err == nil {
+		t.Fatal("Expected connection to be closed")
+	}
+}
+
+func TestStompAuth(t *testing.T) {
+	o := DefaultOptions()
+	o.Username, o.Password = "user", "pwd"
+	o.Stomp = &StompOpts{Host: "127.0.0.1", Port: -1}
+	s := RunServer(o)
+	defer s.Shutdown()
+
+	c := stompTestConnect(t, s, "login:user\npasscode:bad\n")
+	defer c.nc.Close()
+	if f := c.expect("ERROR"); f.hdrs["message"] != "Authorization Violation" {
+		t.Fatalf("Unexpected error: %v", f.hdrs)
+	}
+
+	c = stompTestConnect(t, s, "login:user\npasscode:pwd\n")
+	defer c.nc.Close()
+	c.expect("CONNECTED")
+}
@@ -0,0 +1,145 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_SUBJECT_QUOTA_WINDOW is the default window over which the
+// distinct subjects published to by an account are counted.
+const DEFAULT_SUBJECT_QUOTA_WINDOW = time.Minute
+
+// subjectQuota limits the number of distinct subjects the clients of an
+// account may publish to within a window. Publishing to a subject already
+// seen in the current window is always allowed.
+type subjectQuota struct {
+	sync.Mutex
+	max      int
+	window   time.Duration
+	start    time.Time
+	subjects map[string]struct{}
+	exceeded bool
+}
+
+func newSubjectQuota(max int, window time.Duration) *subjectQuota {
+	if window <= 0 {
+		window = DEFAULT_SUBJECT_QUOTA_WINDOW
+	}
+	return &subjectQuota{max: max, window: window, subjects: make(map[string]struct{})}
+}
+
+// allow returns false if the subject is new and the account has already
+// published to the maximum number of subjects in the current window. The
+// second boolean is true the first time this happens in the window.
+func (q *subjectQuota) allow(subject string) (bool, bool) {
+	now := time.Now()
+	q.Lock()
+	defer q.Unlock()
+	if now.Sub(q.start) >= q.window {
+		q.start = now
+		q.subjects = make(map[string]struct{}, len(q.subjects))
+		q.exceeded = false
+	}
+	if _, ok := q.subjects[subject]; ok {
+		return true, false
+	}
+	if len(q.subjects) >= q.max {
+		first := !q.exceeded
+		q.exceeded = true
+		return false, first
+	}
+	q.subjects[subject] = struct{}{}
+	return true, false
+}
+
+// SetSubjectQuota limits the number of distinct subjects this account's
+// clients may publish to within window, DEFAULT_SUBJECT_QUOTA_WINDOW if 0.
+// Messages published to new subjects over the limit are rejected. A max
+// of 0 removes the limit.
+func (a *Account) SetSubjectQuota(max int, window time.Duration) error {
+	if max < 0 {
+		return fmt.Errorf("subject quota max_subjects can't be negative")
+	}
+	if window < 0 {
+		return fmt.Errorf("subject quota window can't be negative")
+	}
+	var q *subjectQuota
+	if max > 0 {
+		q = newSubjectQuota(max, window)
+	}
+	a.mu.Lock()
+	a.setSubjectQuota(q)
+	a.mu.Unlock()
+	return nil
+}
+
+// Account lock is held on entry if the account is registered.
+func (a *Account) setSubjectQuota(q *subjectQuota) {
+	a.quota = q
+	if q != nil {
+		atomic.StoreInt32(&a.quotaOn, 1)
+	} else {
+		atomic.StoreInt32(&a.quotaOn, 0)
+	}
+}
+
+// checkSubjectQuota returns false if the message being processed has to be
+// rejected because its subject is over the account's subject quota.
+func (c *client) checkSubjectQuota() bool {
+	acc := c.acc
+	acc.mu.RLock()
+	q := acc.quota
+	acc.mu.RUnlock()
+	if q == nil {
+		return true
+	}
+	allowed, first := q.allow(string(c.pa.subject))
+	if allowed {
+		return true
+	}
+	// Reported as a permissions violation so that clients don't treat it
+	// as a protocol error and reconnect.
+	c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q, Maximum Account Subjects Exceeded", c.pa.subject))
+	if first {
+		m := &SubjectQuotaEventMsg{
+			Account:     acc.Name,
+			Subject:     string(c.pa.subject),
+			MaxSubjects: q.max,
+			Window:      q.window,
+			ClientID:    c.cid,
+		}
+		c.Warnf("Account %q is over its quota of %d subjects per %v, rejecting %q",
+			m.Account, m.MaxSubjects, m.Window, m.Subject)
+		c.srv.sendSubjectQuotaEvent(m)
+	} else {
+		c.Debugf("Account %q is over its subject quota, rejecting %q", acc.Name, c.pa.subject)
+	}
+	return false
+}
+
+// sendSubjectQuotaEvent sends an advisory for an account over its subject
+// quota.
+func (s *Server) sendSubjectQuotaEvent(m *SubjectQuotaEventMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	subj := fmt.Sprintf(subjectQuotaEventSubj, m.Account)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
@@ -0,0 +1,238 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Actions taken when a subject exceeds its maximum message rate.
+const (
+	// SubjectRateAdvisory only sends an advisory, messages are delivered.
+	SubjectRateAdvisory = "advisory"
+	// SubjectRateThrottle pauses the publisher until the next second.
+	SubjectRateThrottle = "throttle"
+	// SubjectRateSample delivers one out of `sample` messages over the limit.
+	SubjectRateSample = "sample"
+
+	// Default number of messages over the limit for each one delivered
+	// with the sample action.
+	DEFAULT_SUBJECT_RATE_SAMPLE = 10
+)
+
+// How long idle subject rates are kept before being removed.
+const subjectRateExpiration = 2 * time.Second
+
+// Number of shards of the tracked subject rates.
+const subjectRateShards = 32
+
+// SubjectRateLimit limits the rate of messages published by clients on
+// the subjects matching a filter. The rate is tracked for each account
+// and subject, not for the filter as a whole.
+type SubjectRateLimit struct {
+	Subject string `json:"subject"`
+	MaxRate int64  `json:"max_rate"`
+	Action  string `json:"action"`
+	Sample  int    `json:"sample,omitempty"`
+}
+
+func (l *SubjectRateLimit) validate() error {
+	if !IsValidSubject(l.Subject) {
+		return fmt.Errorf("invalid subject %q", l.Subject)
+	}
+	if l.MaxRate <= 0 {
+		return fmt.Errorf("max_rate for subject %q must be positive", l.Subject)
+	}
+	switch l.Action {
+	case SubjectRateAdvisory, SubjectRateThrottle, SubjectRateSample:
+	default:
+		return fmt.Errorf("invalid action %q for subject %q, expected %q, %q or %q",
+			l.Action, l.Subject, SubjectRateAdvisory, SubjectRateThrottle, SubjectRateSample)
+	}
+	if l.Sample < 0 {
+		return fmt.Errorf("sample for subject %q can't be negative", l.Subject)
+	}
+	return nil
+}
+
+// subjectRateGuards tracks the rate of messages published on subjects that
+// have a rate limit. The limits are matched without any lock, and the
+// rates of the limited subjects are spread over shards, each with its own
+// lock, so that publishers of different subjects rarely contend.
+type subjectRateGuards struct {
+	// Set to 1 when there are limits, checked without the lock.
+	enabled int32
+	// The []*SubjectRateLimit, replaced, never modified.
+	limits atomic.Value
+	shards [subjectRateShards]subjectRateShard
+}
+
+// subjectRateShard holds the rates of some of the limited subjects.
+type subjectRateShard struct {
+	sync.Mutex
+	rates map[subjectRateKey]*subjectRate
+	swept int64
+}
+
+type subjectRateKey struct {
+	account string
+	subject string
+}
+
+// subjectRate is the rate of an account's subject over the current second.
+type subjectRate struct {
+	limit *SubjectRateLimit
+	start int64
+	count int64
+	over  int64
+}
+
+// setLimits replaces the rate limits, resetting the tracked rates.
+func (g *subjectRateGuards) setLimits(limits []*SubjectRateLimit) {
+	g.limits.Store(limits)
+	for i := range g.shards {
+		sh := &g.shards[i]
+		sh.Lock()
+		sh.rates = make(map[subjectRateKey]*subjectRate)
+		sh.Unlock()
+	}
+	if len(limits) > 0 {
+		atomic.StoreInt32(&g.enabled, 1)
+	} else {
+		atomic.StoreInt32(&g.enabled, 0)
+	}
+}
+
+// limit returns the first rate limit whose filter matches the subject.
+func (g *subjectRateGuards) limit(subject string) *SubjectRateLimit {
+	limits, _ := g.limits.Load().([]*SubjectRateLimit)
+	for _, l := range limits {
+		if subjectIsSubsetMatch(subject, l.Subject) {
+			return l
+		}
+	}
+	return nil
+}
+
+// shard returns the shard of the account's subject, using FNV-1a.
+func (g *subjectRateGuards) shard(account, subject string) *subjectRateShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(account); i++ {
+		h = (h ^ uint32(account[i])) * 16777619
+	}
+	for i := 0; i < len(subject); i++ {
+		h = (h ^ uint32(subject[i])) * 16777619
+	}
+	return &g.shards[h%subjectRateShards]
+}
+
+// check counts a message published on the account's subject. If the
+// subject is over its limit, it returns for how long the publisher should
+// be paused or whether the message should be dropped, depending on the
+// limit action. An advisory is returned when the limit is first exceeded
+// in the current second.
+func (g *subjectRateGuards) check(account, subject string) (time.Duration, bool, *SubjectRateEventMsg) {
+	limit := g.limit(subject)
+	if limit == nil {
+		return 0, false, nil
+	}
+	now := time.Now().UnixNano()
+	sh := g.shard(account, subject)
+
+	sh.Lock()
+	defer sh.Unlock()
+
+	if now-sh.swept > int64(subjectRateExpiration) {
+		for k, r := range sh.rates {
+			if now-r.start > int64(subjectRateExpiration) {
+				delete(sh.rates, k)
+			}
+		}
+		sh.swept = now
+	}
+
+	key := subjectRateKey{account, subject}
+	r := sh.rates[key]
+	if r == nil || r.limit != limit {
+		r = &subjectRate{limit: limit, start: now}
+		sh.rates[key] = r
+	}
+	if now-r.start >= int64(time.Second) {
+		r.start, r.count, r.over = now, 0, 0
+	}
+	r.count++
+	if r.count <= r.limit.MaxRate {
+		return 0, false, nil
+	}
+	r.over++
+
+	var adv *SubjectRateEventMsg
+	if r.over == 1 {
+		adv = &SubjectRateEventMsg{
+			Account: account,
+			Subject: subject,
+			Filter:  r.limit.Subject,
+			MaxRate: r.limit.MaxRate,
+			Action:  r.limit.Action,
+		}
+	}
+	switch r.limit.Action {
+	case SubjectRateThrottle:
+		return time.Duration(r.start + int64(time.Second) - now), false, adv
+	case SubjectRateSample:
+		sample := int64(r.limit.Sample)
+		if sample == 0 {
+			sample = DEFAULT_SUBJECT_RATE_SAMPLE
+		}
+		return 0, r.over%sample != 0, adv
+	}
+	return 0, false, adv
+}
+
+// checkSubjectRate applies the rate limit of the subject of the message
+// being processed, if any, and returns true if the message should be
+// dropped. The client is paused here if the subject has to be throttled.
+func (c *client) checkSubjectRate() bool {
+	s := c.srv
+	delay, drop, adv := s.rateGuards.check(c.acc.Name, string(c.pa.subject))
+	if adv != nil {
+		adv.ClientID = c.cid
+		c.Warnf("Subject %q of account %q is over its limit of %d msgs/sec, action is %s",
+			adv.Subject, adv.Account, adv.MaxRate, adv.Action)
+		s.sendSubjectRateEvent(adv)
+	}
+	if delay > 0 {
+		// Deliver what has been processed so far before pausing.
+		c.flushClients(0)
+		select {
+		case <-time.After(delay):
+		case <-s.quitCh:
+		}
+	}
+	return drop
+}
+
+// sendSubjectRateEvent sends an advisory for a subject over its limit.
+func (s *Server) sendSubjectRateEvent(m *SubjectRateEventMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	subj := fmt.Sprintf(subjectRateEventSubj, m.Account)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
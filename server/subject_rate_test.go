@@ -0,0 +1,202 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSubjectRateLimitsConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		subject_rate_limits [
+			{subject: "foo.*", max_rate: 100, action: throttle}
+			{subject: "bar.>", max_rate: 10, action: SAMPLE, sample: 5}
+			{subject: "baz", max_rate: 1}
+		]
+	`))
+	defer os.Remove(conf)
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Error processing config: %v", err)
+	}
+	expected := []*SubjectRateLimit{
+		{Subject: "foo.*", MaxRate: 100, Action: SubjectRateThrottle},
+		{Subject: "bar.>", MaxRate: 10, Action: SubjectRateSample, Sample: 5},
+		{Subject: "baz", MaxRate: 1, Action: SubjectRateAdvisory},
+	}
+	if len(opts.SubjectRateLimits) != len(expected) {
+		t.Fatalf("Expected %d limits, got %d", len(expected), len(opts.SubjectRateLimits))
+	}
+	for i, l := range opts.SubjectRateLimits {
+		if *l != *expected[i] {
+			t.Fatalf("Expected limit %+v, got %+v", expected[i], l)
+		}
+	}
+
+	for _, test := range []struct {
+		limit string
+		err   string
+	}{
+		{`{subject: "foo..bar", max_rate: 1}`, "invalid subject"},
+		{`{subject: "foo", max_rate: 0}`, "must be positive"},
+		{`{subject: "foo", max_rate: 1, action: block}`, "invalid action"},
+		{`{subject: "foo", max_rate: 1, sample: -1}`, "can't be negative"},
+	} {
+		conf := createConfFile(t, []byte(fmt.Sprintf("subject_rate_limits [%s]", test.limit)))
+		defer os.Remove(conf)
+		if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected error containing %q for %s, got %v", test.err, test.limit, err)
+		}
+	}
+}
+
+func TestSubjectRateLimits(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		accounts {
+			SYS { users: [{user: sys, password: pwd}] }
+			A { users: [{user: a, password: pwd}] }
+		}
+		subject_rate_limits [
+			{subject: "sample.*", max_rate: 10, action: sample, sample: 5}
+			{subject: "throttle.>", max_rate: 20, action: throttle}
+		]
+	`))
+	defer os.Remove(conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ncs := natsConnect(t, fmt.Sprintf("nats://sys:pwd@%s:%d", opts.Host, opts.Port))
+	defer ncs.Close()
+	advs := natsSubSync(t, ncs, fmt.Sprintf(subjectRateEventSubj, "A"))
+	natsFlush(t, ncs)
+
+	nc := natsConnect(t, fmt.Sprintf("nats://a:pwd@%s:%d", opts.Host, opts.Port))
+	defer nc.Close()
+	sub := natsSubSync(t, nc, ">")
+	if err := sub.SetPendingLimits(-1, -1); err != nil {
+		t.Fatalf("Error setting pending limits: %v", err)
+	}
+	natsFlush(t, nc)
+
+	expectAdvisory := func(subject, action string) {
+		t.Helper()
+		msg := natsNexMsg(t, advs, time.Second)
+		adv := SubjectRateEventMsg{}
+		if err := json.Unmarshal(msg.Data, &adv); err != nil {
+			t.Fatalf("Error unmarshalling advisory: %v", err)
+		}
+		if adv.Account != "A" || adv.Subject != subject || adv.Action != action || adv.ClientID == 0 {
+			t.Fatalf("Unexpected advisory: %+v", adv)
+		}
+		if msg, err := advs.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+			t.Fatalf("Expected a single advisory, got %v, %v", msg, err)
+		}
+	}
+	expectMsgs := func(expected int) {
+		t.Helper()
+		checkFor(t, time.Second, 15*time.Millisecond, func() error {
+			if n, _, _ := sub.Pending(); n != expected {
+				return fmt.Errorf("Expected %d messages, got %d", expected, n)
+			}
+			return nil
+		})
+		for i := 0; i < expected; i++ {
+			natsNexMsg(t, sub, time.Second)
+		}
+	}
+
+	// Messages over the limit are sampled, this assumes that they are
+	// all published within the same second.
+	for i := 0; i < 60; i++ {
+		natsPub(t, nc, "sample.foo", []byte("hello"))
+	}
+	natsFlush(t, nc)
+	expectMsgs(10 + 50/5)
+	expectAdvisory("sample.foo", SubjectRateSample)
+
+	// Subjects not matching a limit are not affected.
+	for i := 0; i < 60; i++ {
+		natsPub(t, nc, "other", []byte("hello"))
+	}
+	natsFlush(t, nc)
+	expectMsgs(60)
+
+	// The publisher is paused until the next second when throttled.
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		natsPub(t, nc, "throttle.foo.bar", []byte("hello"))
+	}
+	natsFlush(t, nc)
+	if dur := time.Since(start); dur < 900*time.Millisecond {
+		t.Fatalf("Expected publisher to be throttled, took %v", dur)
+	}
+	expectMsgs(30)
+	expectAdvisory("throttle.foo.bar", SubjectRateThrottle)
+
+	// Removing the limits on reload.
+	reloadUpdateConfig(t, s, conf, `
+		listen: "127.0.0.1:-1"
+		system_account: SYS
+		accounts {
+			SYS { users: [{user: sys, password: pwd}] }
+			A { users: [{user: a, password: pwd}] }
+		}
+	`)
+	for i := 0; i < 60; i++ {
+		natsPub(t, nc, "sample.foo", []byte("hello"))
+	}
+	natsFlush(t, nc)
+	expectMsgs(60)
+}
+
+func TestSubjectRateGuardsTrackLimitedSubjectsOnly(t *testing.T) {
+	var g subjectRateGuards
+	g.setLimits([]*SubjectRateLimit{{Subject: "limited.>", MaxRate: 1, Action: SubjectRateSample}})
+
+	tracked := func() int {
+		n := 0
+		for i := range g.shards {
+			g.shards[i].Lock()
+			n += len(g.shards[i].rates)
+			g.shards[i].Unlock()
+		}
+		return n
+	}
+	for i := 0; i < 10; i++ {
+		if _, drop, adv := g.check("A", fmt.Sprintf("other.%d", i)); drop || adv != nil {
+			t.Fatalf("Unexpected limit for an unlimited subject")
+		}
+	}
+	if n := tracked(); n != 0 {
+		t.Fatalf("Expected no tracked subject, got %d", n)
+	}
+	g.check("A", "limited.foo")
+	g.check("B", "limited.foo")
+	if _, drop, adv := g.check("A", "limited.foo"); !drop || adv == nil {
+		t.Fatalf("Expected the message to be dropped with an advisory")
+	}
+	if n := tracked(); n != 2 {
+		t.Fatalf("Expected 2 tracked subjects, got %d", n)
+	}
+}
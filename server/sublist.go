@@ -49,6 +49,9 @@ const (
 	slCacheSweep = 512
 	// plistMin is our lower bounds to create a fast plist for Match.
 	plistMin = 256
+	// slMaxPrefixGens bounds the number of subject prefixes with their own
+	// generation, changes of subjects with other prefixes bump the global one.
+	slMaxPrefixGens = 4096
 )
 
 // SublistResult is a result structure better optimized for queue subs.
@@ -60,7 +63,13 @@ type SublistResult struct {
 // A Sublist stores and efficiently retrieves subscriptions.
 type Sublist struct {
 	sync.RWMutex
+	// genid is bumped when subscriptions starting with a wildcard change,
+	// which may affect any subject. Other changes bump the generation of
+	// the first token of their subject, in pgenids, so that caches of
+	// unrelated subjects stay valid. See genidFor.
 	genid     uint64
+	pgenids   sync.Map
+	npgenids  int32
 	matches   uint64
 	cacheHits uint64
 	inserts   uint64
@@ -215,12 +224,53 @@ func (s *Sublist) Insert(sub *subscription) error {
 	s.inserts++
 
 	s.addToCache(subject, sub)
-	atomic.AddUint64(&s.genid, 1)
+	s.bumpGenid(subject)
 
 	s.Unlock()
 	return nil
 }
 
+// subjectPrefix returns the first token of the subject.
+func subjectPrefix(subject string) string {
+	if i := strings.IndexByte(subject, btsep); i >= 0 {
+		return subject[:i]
+	}
+	return subject
+}
+
+// bumpGenid invalidates the cached results of the subjects that may be
+// matched by a subscription on this subject.
+func (s *Sublist) bumpGenid(subject string) {
+	prefix := subjectPrefix(subject)
+	if len(prefix) == 1 && (prefix[0] == pwc || prefix[0] == fwc) {
+		atomic.AddUint64(&s.genid, 1)
+		return
+	}
+	v, ok := s.pgenids.Load(prefix)
+	if !ok {
+		if atomic.LoadInt32(&s.npgenids) >= slMaxPrefixGens {
+			atomic.AddUint64(&s.genid, 1)
+			return
+		}
+		var loaded bool
+		if v, loaded = s.pgenids.LoadOrStore(prefix, new(uint64)); !loaded {
+			atomic.AddInt32(&s.npgenids, 1)
+		}
+	}
+	atomic.AddUint64(v.(*uint64), 1)
+}
+
+// genidFor returns the generation of the results of the literal subject,
+// which changes when they may have changed. Since the global and prefix
+// generations only increase, so does their sum.
+func (s *Sublist) genidFor(subject string) uint64 {
+	genid := atomic.LoadUint64(&s.genid)
+	if v, ok := s.pgenids.Load(subjectPrefix(subject)); ok {
+		genid += atomic.LoadUint64(v.(*uint64))
+	}
+	return genid
+}
+
 // Deep copy
 func copyResult(r *SublistResult) *SublistResult {
 	nr := &SublistResult{}
@@ -339,7 +389,9 @@ func (s *Sublist) Match(subject string) *SublistResult {
 	if len(result.psubs) == 0 && len(result.qsubs) == 0 {
 		result = emptyResult
 	}
-	if s.cache != nil {
+	// Replies of muxed requests are matched once, caching them would only
+	// evict the subjects that are published to repeatedly.
+	if s.cache != nil && !isMuxReply(subject) {
 		s.cache.Store(subject, result)
 		n = atomic.AddInt32(&s.cacheNum, 1)
 	}
@@ -380,7 +432,7 @@ func (s *Sublist) UpdateRemoteQSub(sub *subscription) {
 	// the genid so L1 will be flushed.
 	s.Lock()
 	s.removeFromCache(string(sub.subject), sub)
-	atomic.AddUint64(&s.genid, 1)
+	s.bumpGenid(string(sub.subject))
 	s.Unlock()
 }
 
@@ -540,7 +592,7 @@ func (s *Sublist) remove(sub *subscription, shouldLock bool) error {
 		}
 	}
 	s.removeFromCache(subject, sub)
-	atomic.AddUint64(&s.genid, 1)
+	s.bumpGenid(subject)
 
 	return nil
 }
@@ -569,6 +621,7 @@ func (s *Sublist) checkNodeForClientSubs(n *node, c *client) {
 		if sub.client == c {
 			if s.removeFromNode(n, sub) {
 				s.removeFromCache(string(sub.subject), sub)
+				s.bumpGenid(string(sub.subject))
 				removed++
 			}
 		}
@@ -579,6 +632,7 @@ func (s *Sublist) checkNodeForClientSubs(n *node, c *client) {
 			if sub.client == c {
 				if s.removeFromNode(n, sub) {
 					s.removeFromCache(string(sub.subject), sub)
+					s.bumpGenid(string(sub.subject))
 					removed++
 				}
 			}
@@ -606,11 +660,7 @@ func (s *Sublist) removeClientSubs(l *level, c *client) {
 // RemoveAllForClient will remove all subscriptions for a given client.
 func (s *Sublist) RemoveAllForClient(c *client) {
 	s.Lock()
-	removes := s.removes
 	s.removeClientSubs(s.root, c)
-	if s.removes != removes {
-		atomic.AddUint64(&s.genid, 1)
-	}
 	s.Unlock()
 }
 
@@ -915,6 +965,25 @@ func isSubsetMatch(tokens []string, test string) bool {
 	return len(tokens) == len(tts)
 }
 
+// subjectsIntersect returns whether some subject matches both of the
+// given subjects, either of which may contain wildcards. So foo.* and
+// *.bar intersect, but not foo.> and bar.>.
+func subjectsIntersect(s1, s2 string) bool {
+	t1, t2 := strings.Split(s1, tsep), strings.Split(s2, tsep)
+	for i := 0; i < len(t1) && i < len(t2); i++ {
+		a, b := t1[i], t2[i]
+		if a == string(fwc) || b == string(fwc) {
+			return true
+		}
+		if a != b && a != string(pwc) && b != string(pwc) {
+			return false
+		}
+	}
+	// A full wildcard matches at least one token, so subjects of different
+	// lengths without one in common do not intersect.
+	return len(t1) == len(t2)
+}
+
 // matchLiteral is used to test literal subjects, those that do not have any
 // wildcards, with a target subject. This is used in the cache layer.
 func matchLiteral(literal, subject string) bool {
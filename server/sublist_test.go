@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"reflect"
 	"runtime"
 	"strconv"
 	"strings"
@@ -316,6 +317,54 @@ func testSublistRemoveCleanupWildcards(t *testing.T, s *Sublist) {
 	verifyNumLevels(s, 0, t)
 }
 
+func TestSublistGenidForPrefixes(t *testing.T) {
+	s := NewSublistWithCache()
+	changed := func(f func(), subjects ...string) map[string]bool {
+		t.Helper()
+		before := make(map[string]uint64)
+		for _, subject := range subjects {
+			before[subject] = s.genidFor(subject)
+		}
+		f()
+		res := make(map[string]bool)
+		for _, subject := range subjects {
+			res[subject] = s.genidFor(subject) != before[subject]
+		}
+		return res
+	}
+	check := func(res map[string]bool, expected map[string]bool) {
+		t.Helper()
+		if !reflect.DeepEqual(res, expected) {
+			t.Fatalf("Expected changes %v, got %v", expected, res)
+		}
+	}
+
+	foo, qfoo, pwc, fwc := newSub("foo.bar"), newQSub("foo", "q"), newSub("*.bar"), newSub(">")
+	check(changed(func() { s.Insert(foo) }, "foo.bar", "foo", "bar"),
+		map[string]bool{"foo.bar": true, "foo": true, "bar": false})
+	check(changed(func() { s.Insert(qfoo) }, "foo.bar", "bar.baz"),
+		map[string]bool{"foo.bar": true, "bar.baz": false})
+	check(changed(func() { s.Insert(pwc) }, "foo.bar", "bar.baz"),
+		map[string]bool{"foo.bar": true, "bar.baz": true})
+	check(changed(func() { s.Insert(fwc) }, "foo.bar", "bar.baz"),
+		map[string]bool{"foo.bar": true, "bar.baz": true})
+	check(changed(func() { s.Remove(foo) }, "foo", "bar.baz"),
+		map[string]bool{"foo": true, "bar.baz": false})
+	check(changed(func() { s.UpdateRemoteQSub(qfoo) }, "foo", "bar.baz"),
+		map[string]bool{"foo": true, "bar.baz": false})
+	check(changed(func() { s.RemoveBatch([]*subscription{qfoo, pwc}) }, "foo", "bar.baz"),
+		map[string]bool{"foo": true, "bar.baz": true})
+
+	// Past the maximum number of prefixes, the global generation is used.
+	for i := 0; i < slMaxPrefixGens; i++ {
+		s.Insert(newSub(fmt.Sprintf("p%d", i)))
+	}
+	check(changed(func() { s.Insert(newSub("new.prefix")) }, "new.prefix", "p0"),
+		map[string]bool{"new.prefix": true, "p0": true})
+	check(changed(func() { s.Insert(newSub("p0.bar")) }, "p0", "p1"),
+		map[string]bool{"p0": true, "p1": false})
+}
+
 func TestSublistRemoveWithLargeSubs(t *testing.T) {
 	testSublistRemoveWithLargeSubs(t, NewSublistWithCache())
 }
@@ -415,6 +464,21 @@ func testSublistInvalidSubjectsInsert(t *testing.T, s *Sublist) {
 	}
 }
 
+func TestSublistNoCacheMuxReplies(t *testing.T) {
+	s := NewSublistWithCache()
+	s.Insert(newSub("_INBOX.abc.*"))
+	for i := 0; i < 10; i++ {
+		verifyLen(s.Match(fmt.Sprintf("_INBOX.abc.%d", i)).psubs, 1, t)
+	}
+	if cc := s.CacheCount(); cc != 0 {
+		t.Fatalf("Expected muxed replies to not be cached, got %d", cc)
+	}
+	verifyLen(s.Match("_INBOX.abc").psubs, 0, t)
+	if cc := s.CacheCount(); cc != 1 {
+		t.Fatalf("Expected cache count of 1, got %d", cc)
+	}
+}
+
 func TestSublistCache(t *testing.T) {
 	s := NewSublistWithCache()
 
@@ -1069,6 +1133,37 @@ func TestIsSubsetMatch(t *testing.T) {
 	}
 }
 
+func TestSubjectsIntersect(t *testing.T) {
+	for _, test := range []struct {
+		s1     string
+		s2     string
+		result bool
+	}{
+		{"foo.bar", "foo.bar", true},
+		{"foo.bar", "foo.baz", false},
+		{"foo.*", "*.bar", true},
+		{"foo.*", "foo.bar.baz", false},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "bar.>", false},
+		{"foo.>", "foo", false},
+		{">", "foo", true},
+		{"telemetry.>", "telemetry.internal.>", true},
+		{"telemetry.metrics.>", "telemetry.internal.>", false},
+		{"telemetry.*.cpu", "telemetry.internal.>", true},
+	} {
+		t.Run("", func(t *testing.T) {
+			if res := subjectsIntersect(test.s1, test.s2); res != test.result {
+				t.Fatalf("Subjects %q and %q intersect should be %v, got %v",
+					test.s1, test.s2, test.result, res)
+			}
+			if res := subjectsIntersect(test.s2, test.s1); res != test.result {
+				t.Fatalf("Subjects %q and %q intersect should be %v, got %v",
+					test.s2, test.s1, test.result, res)
+			}
+		})
+	}
+}
+
 // -- Benchmarks Setup --
 
 var benchSublistSubs []*subscription
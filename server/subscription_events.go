@@ -0,0 +1,156 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DEFAULT_SUBSCRIPTION_EVENTS_MAX_RATE is the default maximum number of
+// subscription advisories sent per second for an account.
+const DEFAULT_SUBSCRIPTION_EVENTS_MAX_RATE = 100
+
+// Types of subscription advisories, also the last token of their subject.
+const (
+	SubscriptionCreated = "CREATED"
+	SubscriptionDeleted = "DELETED"
+)
+
+// SubscriptionEventOpts enables advisories on the creation and deletion of
+// the subscriptions of clients, to build catalogs of the subjects in use.
+type SubscriptionEventOpts struct {
+	// Accounts restricts the advisories to these accounts, all if empty.
+	Accounts []string `json:"accounts,omitempty"`
+	// MaxRate is the maximum number of advisories sent per second for an
+	// account, DEFAULT_SUBSCRIPTION_EVENTS_MAX_RATE if 0, unlimited if
+	// negative.
+	MaxRate int64 `json:"max_rate,omitempty"`
+	// Sample, if greater than 1, sends one advisory out of Sample.
+	Sample int `json:"sample,omitempty"`
+}
+
+func (se *SubscriptionEventOpts) validate() error {
+	if se == nil {
+		return nil
+	}
+	if se.Sample < 0 {
+		return fmt.Errorf("subscription events sample can't be negative")
+	}
+	return nil
+}
+
+func (se *SubscriptionEventOpts) forAccount(name string) bool {
+	if len(se.Accounts) == 0 {
+		return true
+	}
+	for _, acc := range se.Accounts {
+		if acc == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (se *SubscriptionEventOpts) maxRate() int64 {
+	if se.MaxRate == 0 {
+		return DEFAULT_SUBSCRIPTION_EVENTS_MAX_RATE
+	}
+	return se.MaxRate
+}
+
+// subEventLimiter samples and rate limits the subscription advisories of
+// an account.
+type subEventLimiter struct {
+	sync.Mutex
+	start   int64
+	count   int64
+	seen    int64
+	dropped int64
+}
+
+// allow returns true if an advisory is to be sent, along with the number
+// of advisories dropped because of the rate since the last one sent.
+func (l *subEventLimiter) allow(se *SubscriptionEventOpts, now int64) (bool, int64) {
+	l.Lock()
+	defer l.Unlock()
+	l.seen++
+	if se.Sample > 1 && l.seen%int64(se.Sample) != 0 {
+		return false, 0
+	}
+	if now-l.start >= int64(time.Second) {
+		l.start, l.count = now, 0
+	}
+	if max := se.maxRate(); max > 0 && l.count >= max {
+		l.dropped++
+		return false, 0
+	}
+	l.count++
+	dropped := l.dropped
+	l.dropped = 0
+	return true, dropped
+}
+
+// subscriptionEvent sends, if enabled, an advisory for the creation or
+// deletion of the subscriptions of this client.
+// Lock should not be held.
+func (c *client) subscriptionEvent(acc *Account, kind string, subs ...*subscription) {
+	s := c.srv
+	if c.kind != CLIENT || s == nil || acc == nil || len(subs) == 0 {
+		return
+	}
+	opts := s.getOpts()
+	if opts == nil {
+		return
+	}
+	se := opts.SubscriptionEvents
+	if se == nil || !se.forAccount(acc.Name) {
+		return
+	}
+	c.mu.Lock()
+	name, user := c.opts.Name, c.opts.Username
+	if user == _EMPTY_ {
+		user = c.opts.Nkey
+	}
+	c.mu.Unlock()
+
+	for _, sub := range subs {
+		send, dropped := acc.subEvents.allow(se, time.Now().UnixNano())
+		if !send {
+			continue
+		}
+		s.sendSubscriptionEvent(&SubscriptionEventMsg{
+			Type:       kind,
+			Account:    acc.Name,
+			Subject:    string(sub.subject),
+			Queue:      string(sub.queue),
+			ClientID:   c.cid,
+			ClientName: name,
+			User:       user,
+			Dropped:    dropped,
+		})
+	}
+}
+
+// sendSubscriptionEvent sends a subscription advisory.
+func (s *Server) sendSubscriptionEvent(m *SubscriptionEventMsg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	subj := fmt.Sprintf(subscriptionEventSubj, m.Account, m.Type)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
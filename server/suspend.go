@@ -0,0 +1,95 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// DEFAULT_SUSPEND_MAX is the default time a client connection can stay
+// suspended before being closed as stale.
+const DEFAULT_SUSPEND_MAX = 10 * time.Minute
+
+// SuspendOpts parks client connections that stop answering PINGs while
+// nothing is pending for them, instead of closing them as stale. This is
+// typically a mobile application or a browser tab put in the background,
+// whose timers are suspended. The connection resumes as soon as the
+// client sends anything, for instance the PONG of one of the PINGs the
+// server keeps sending.
+type SuspendOpts struct {
+	// MaxDuration is how long a connection can stay suspended before it
+	// is closed as stale, DEFAULT_SUSPEND_MAX if 0.
+	MaxDuration time.Duration `json:"max_duration,omitempty"`
+	// Buffer keeps queuing the messages of a suspended connection, up to
+	// the maximum pending size, instead of dropping them.
+	Buffer bool `json:"buffer,omitempty"`
+}
+
+func (o *SuspendOpts) validate() error {
+	if o != nil && o.MaxDuration < 0 {
+		return fmt.Errorf("suspend max duration can not be negative")
+	}
+	return nil
+}
+
+func (o *SuspendOpts) maxDuration() time.Duration {
+	if o.MaxDuration > 0 {
+		return o.MaxDuration
+	}
+	return DEFAULT_SUSPEND_MAX
+}
+
+// suspendStale is called instead of closing a stale client connection. It
+// returns true if the connection is, or stays, suspended.
+// Lock should be held
+func (c *client) suspendStale(now time.Time) bool {
+	so := c.srv.getOpts().Suspend
+	if so == nil || c.kind != CLIENT {
+		return false
+	}
+	if c.ping.suspended.IsZero() {
+		// A connection that has data pending is not just idle.
+		if c.out.pb > 0 {
+			return false
+		}
+		c.ping.suspended = now
+		c.Debugf("Suspended Client Connection")
+		return true
+	}
+	return now.Sub(c.ping.suspended) < so.maxDuration()
+}
+
+// resume is called when data is received from a suspended connection.
+// Lock should be held
+func (c *client) resume() {
+	c.Debugf("Resumed Client Connection after %v", time.Since(c.ping.suspended).Round(time.Millisecond))
+	c.ping.suspended = time.Time{}
+	c.ping.out = 0
+}
+
+// dropSuspended returns true if messages are dropped instead of delivered
+// to this connection because it is suspended. These are counted.
+// Lock should be held
+func (c *client) dropSuspended() bool {
+	if c.ping.suspended.IsZero() {
+		return false
+	}
+	if so := c.srv.getOpts().Suspend; so != nil && so.Buffer {
+		return false
+	}
+	atomic.AddInt64(&c.srv.suspendDropped, 1)
+	return true
+}
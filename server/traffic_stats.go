@@ -0,0 +1,351 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DEFAULT_TRAFFIC_STATS_WINDOW is the default duration of the sliding
+	// window of the traffic stats.
+	DEFAULT_TRAFFIC_STATS_WINDOW = time.Minute
+	// DEFAULT_TRAFFIC_STATS_TOP is the default number of top publishers
+	// and subscribers reported.
+	DEFAULT_TRAFFIC_STATS_TOP = 10
+)
+
+// The sliding window is made of that many slices, the oldest being
+// dropped each time a new one starts.
+const trafficSlices = 6
+
+// Bucket i of a message size histogram counts the sizes under 1 << i,
+// the last one counts all the others.
+const sizeBuckets = 28
+
+// TrafficStatsOpts enables the traffic stats reported in varz: the
+// distribution of the sizes of the messages published by clients, and
+// the connections that published and received the most bytes, over a
+// sliding window.
+type TrafficStatsOpts struct {
+	// Window is the duration of the sliding window,
+	// DEFAULT_TRAFFIC_STATS_WINDOW if not set.
+	Window time.Duration `json:"window,omitempty"`
+	// Top is the number of top publishers and subscribers reported,
+	// DEFAULT_TRAFFIC_STATS_TOP if not set.
+	Top int `json:"top,omitempty"`
+}
+
+func (ts *TrafficStatsOpts) validate() error {
+	if ts == nil {
+		return nil
+	}
+	if ts.Window < 0 {
+		return fmt.Errorf("traffic stats window can't be negative")
+	}
+	if ts.Top < 0 {
+		return fmt.Errorf("traffic stats top can't be negative")
+	}
+	return nil
+}
+
+func (ts *TrafficStatsOpts) window() time.Duration {
+	if ts.Window > 0 {
+		return ts.Window
+	}
+	return DEFAULT_TRAFFIC_STATS_WINDOW
+}
+
+func (ts *TrafficStatsOpts) top() int {
+	if ts.Top > 0 {
+		return ts.Top
+	}
+	return DEFAULT_TRAFFIC_STATS_TOP
+}
+
+// TrafficStats are the traffic stats over the last window.
+type TrafficStats struct {
+	Window         time.Duration     `json:"window"`
+	MsgSizes       *MsgSizeHistogram `json:"msg_sizes,omitempty"`
+	TopPublishers  []*TopTalker      `json:"top_publishers,omitempty"`
+	TopSubscribers []*TopTalker      `json:"top_subscribers,omitempty"`
+}
+
+// MsgSizeHistogram summarizes the payload sizes of the messages published
+// by clients. The percentiles are the upper bound of the histogram bucket
+// they fall in.
+type MsgSizeHistogram struct {
+	Count uint64 `json:"count"`
+	Mean  int64  `json:"mean"`
+	P50   int64  `json:"p50"`
+	P90   int64  `json:"p90"`
+	P99   int64  `json:"p99"`
+	Max   int64  `json:"max"`
+}
+
+// TopTalker is a connection with the bytes and messages it published, or
+// received, over the window.
+type TopTalker struct {
+	CID     uint64 `json:"cid"`
+	Kind    string `json:"kind"`
+	Name    string `json:"name,omitempty"`
+	Account string `json:"account,omitempty"`
+	Host    string `json:"host,omitempty"`
+	Bytes   int64  `json:"bytes"`
+	Msgs    int64  `json:"msgs"`
+}
+
+// sizeHistogram is a histogram of message sizes updated atomically.
+type sizeHistogram struct {
+	buckets [sizeBuckets]uint64
+	sum     uint64
+	max     int64
+}
+
+func (h *sizeHistogram) record(size int) {
+	i := bits.Len(uint(size))
+	if i >= sizeBuckets {
+		i = sizeBuckets - 1
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddUint64(&h.sum, uint64(size))
+	for {
+		max := atomic.LoadInt64(&h.max)
+		if int64(size) <= max || atomic.CompareAndSwapInt64(&h.max, max, int64(size)) {
+			break
+		}
+	}
+}
+
+func (h *sizeHistogram) reset() {
+	for i := range h.buckets {
+		atomic.StoreUint64(&h.buckets[i], 0)
+	}
+	atomic.StoreUint64(&h.sum, 0)
+	atomic.StoreInt64(&h.max, 0)
+}
+
+// connTraffic are the cumulative counters of a connection.
+type connTraffic struct {
+	talker   TopTalker
+	inMsgs   int64
+	inBytes  int64
+	outMsgs  int64
+	outBytes int64
+}
+
+// trafficStats tracks the traffic of the server over a sliding window.
+type trafficStats struct {
+	// Kept first for the alignment of the 64-bit atomics.
+	slices [trafficSlices]sizeHistogram
+	cur    uint32
+	on     int32
+
+	sync.Mutex
+	started bool
+	// Counters of the connections at the start of each slice.
+	snaps [trafficSlices]map[uint64]*connTraffic
+	pubs  []*TopTalker
+	subs  []*TopTalker
+}
+
+// recordMsgSize records the size of a message published by a client.
+func (s *Server) recordMsgSize(size int) {
+	if s == nil || atomic.LoadInt32(&s.traffic.on) == 0 {
+		return
+	}
+	s.traffic.slices[atomic.LoadUint32(&s.traffic.cur)].record(size)
+}
+
+// startTrafficStats starts, or stops, tracking the traffic according to
+// the options.
+func (s *Server) startTrafficStats() {
+	ts := &s.traffic
+	opts := s.getOpts().TrafficStats
+	if opts == nil {
+		atomic.StoreInt32(&ts.on, 0)
+		ts.Lock()
+		ts.pubs, ts.subs = nil, nil
+		ts.Unlock()
+		return
+	}
+	atomic.StoreInt32(&ts.on, 1)
+
+	ts.Lock()
+	started := ts.started
+	ts.started = true
+	ts.Unlock()
+	if started {
+		return
+	}
+	s.rotateTraffic()
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		for {
+			interval := DEFAULT_TRAFFIC_STATS_WINDOW
+			if opts := s.getOpts().TrafficStats; opts != nil {
+				interval = opts.window()
+			}
+			select {
+			case <-time.After(interval / trafficSlices):
+			case <-s.quitCh:
+				return
+			}
+			if atomic.LoadInt32(&ts.on) == 1 {
+				s.rotateTraffic()
+			}
+		}
+	})
+}
+
+// rotateTraffic starts a new slice of the window, dropping the oldest one,
+// and updates the top talkers from the counters of the connections since
+// the start of the window.
+func (s *Server) rotateTraffic() {
+	opts := s.getOpts().TrafficStats
+	if opts == nil {
+		return
+	}
+	now := s.connTraffic()
+
+	ts := &s.traffic
+	ts.Lock()
+	defer ts.Unlock()
+	next := (atomic.LoadUint32(&ts.cur) + 1) % trafficSlices
+	ts.slices[next].reset()
+	atomic.StoreUint32(&ts.cur, next)
+
+	// The snapshot being replaced is the oldest one, from about a window ago.
+	oldest := ts.snaps[next]
+	ts.snaps[next] = now
+	var pubs, subs []*TopTalker
+	for cid, ct := range now {
+		var prev connTraffic
+		if p := oldest[cid]; p != nil {
+			prev = *p
+		}
+		if b := ct.inBytes - prev.inBytes; b > 0 {
+			t := ct.talker
+			t.Bytes, t.Msgs = b, ct.inMsgs-prev.inMsgs
+			pubs = append(pubs, &t)
+		}
+		if b := ct.outBytes - prev.outBytes; b > 0 {
+			t := ct.talker
+			t.Bytes, t.Msgs = b, ct.outMsgs-prev.outMsgs
+			subs = append(subs, &t)
+		}
+	}
+	ts.pubs, ts.subs = topTalkers(pubs, opts.top()), topTalkers(subs, opts.top())
+}
+
+func topTalkers(talkers []*TopTalker, top int) []*TopTalker {
+	sort.Slice(talkers, func(i, j int) bool {
+		if talkers[i].Bytes != talkers[j].Bytes {
+			return talkers[i].Bytes > talkers[j].Bytes
+		}
+		return talkers[i].CID < talkers[j].CID
+	})
+	if len(talkers) > top {
+		talkers = talkers[:top]
+	}
+	return talkers
+}
+
+// connTraffic returns the cumulative counters of the client and leafnode
+// connections.
+func (s *Server) connTraffic() map[uint64]*connTraffic {
+	s.mu.Lock()
+	conns := make([]*client, 0, len(s.clients)+len(s.leafs))
+	for _, c := range s.clients {
+		conns = append(conns, c)
+	}
+	for _, c := range s.leafs {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	m := make(map[uint64]*connTraffic, len(conns))
+	for _, c := range conns {
+		ct := &connTraffic{
+			inMsgs:  atomic.LoadInt64(&c.inMsgs),
+			inBytes: atomic.LoadInt64(&c.inBytes),
+		}
+		c.mu.Lock()
+		ct.talker = TopTalker{
+			CID:  c.cid,
+			Kind: c.typeString(),
+			Name: c.opts.Name,
+			Host: c.host,
+		}
+		if c.acc != nil {
+			ct.talker.Account = c.acc.Name
+		}
+		ct.outMsgs, ct.outBytes = c.outMsgs, c.outBytes
+		c.mu.Unlock()
+		m[ct.talker.CID] = ct
+	}
+	return m
+}
+
+// trafficStats returns the traffic stats over the last window, nil if not
+// enabled.
+func (s *Server) trafficStats() *TrafficStats {
+	opts := s.getOpts().TrafficStats
+	if opts == nil || atomic.LoadInt32(&s.traffic.on) == 0 {
+		return nil
+	}
+	ts := &s.traffic
+	var buckets [sizeBuckets]uint64
+	var count, sum uint64
+	var max int64
+	for i := range ts.slices {
+		h := &ts.slices[i]
+		for j := range buckets {
+			n := atomic.LoadUint64(&h.buckets[j])
+			buckets[j] += n
+			count += n
+		}
+		sum += atomic.LoadUint64(&h.sum)
+		if m := atomic.LoadInt64(&h.max); m > max {
+			max = m
+		}
+	}
+	st := &TrafficStats{Window: opts.window()}
+	if count > 0 {
+		mh := &MsgSizeHistogram{Count: count, Mean: int64(sum / count), Max: max}
+		percentile := func(p uint64) int64 {
+			var n uint64
+			for i, c := range buckets {
+				if n += c; n*100 >= count*p {
+					if bound := int64(1) << uint(i); i < sizeBuckets-1 && bound < max {
+						return bound
+					}
+					return max
+				}
+			}
+			return max
+		}
+		mh.P50, mh.P90, mh.P99 = percentile(50), percentile(90), percentile(99)
+		st.MsgSizes = mh
+	}
+	ts.Lock()
+	st.TopPublishers, st.TopSubscribers = ts.pubs, ts.subs
+	ts.Unlock()
+	return st
+}
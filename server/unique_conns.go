@@ -0,0 +1,121 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+)
+
+// Client identities that can be limited to a single connection.
+const (
+	// UniqueConnByUser limits each user or nkey to one connection.
+	UniqueConnByUser = "user"
+	// UniqueConnByDurable limits each durable connection ID to one
+	// connection.
+	UniqueConnByDurable = "durable"
+)
+
+// Policies applied to a new connection of an identity already connected.
+const (
+	// UniqueConnReject rejects the new connection.
+	UniqueConnReject = "reject"
+	// UniqueConnEvict closes the existing connection.
+	UniqueConnEvict = "evict"
+)
+
+// UniqueConnOpts limits clients to one active connection per identity in
+// an account. Clients without an identity, for instance users of a server
+// without authentication, are not limited.
+type UniqueConnOpts struct {
+	By     string `json:"by"`
+	Policy string `json:"policy"`
+}
+
+func (o *UniqueConnOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	switch o.By {
+	case UniqueConnByUser, UniqueConnByDurable:
+	default:
+		return fmt.Errorf("invalid unique connection identity %q, expected %q or %q",
+			o.By, UniqueConnByUser, UniqueConnByDurable)
+	}
+	switch o.Policy {
+	case UniqueConnReject, UniqueConnEvict:
+	default:
+		return fmt.Errorf("invalid unique connection policy %q, expected %q or %q",
+			o.Policy, UniqueConnReject, UniqueConnEvict)
+	}
+	return nil
+}
+
+// uniqueConnKey returns the identity of the client in its account, empty
+// if it has none.
+// Lock is held on entry.
+func (c *client) uniqueConnKey(by string) string {
+	var id string
+	switch by {
+	case UniqueConnByUser:
+		if c.user != nil {
+			id = c.user.Nkey
+		} else {
+			id = c.opts.Username
+		}
+	case UniqueConnByDurable:
+		id = c.opts.DurableID
+	}
+	if id == _EMPTY_ || c.acc == nil {
+		return _EMPTY_
+	}
+	return c.acc.Name + " " + id
+}
+
+// checkUniqueConn enforces the single connection per identity of a client
+// that has just connected. It returns an error if the client is rejected,
+// after closing it.
+func (s *Server) checkUniqueConn(c *client) error {
+	uo := s.getOpts().UniqueConnections
+	if uo == nil {
+		return nil
+	}
+	c.mu.Lock()
+	key := c.uniqueConnKey(uo.By)
+	c.mu.Unlock()
+	if key == _EMPTY_ {
+		return nil
+	}
+
+	s.mu.Lock()
+	old := s.uniqueConns[key]
+	if old != nil && uo.Policy == UniqueConnReject {
+		s.mu.Unlock()
+		c.sendErrAndDebug(ErrDuplicateConnection.Error())
+		c.closeConnection(DuplicateConnection)
+		return ErrDuplicateConnection
+	}
+	s.uniqueConns[key] = c
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.uniqueKey = key
+	c.mu.Unlock()
+
+	if old != nil {
+		old.Noticef("Replaced by connection %d of the same %s", c.cid, uo.By)
+		old.sendErr(ErrDuplicateConnection.Error())
+		old.closeConnection(DuplicateConnection)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Environment of the upgraded process, with the listeners it inherits
+	// as a comma separated list of <listener type>=<fd>, and the fd to
+	// write to once its listeners are ready.
+	upgradeListenersEnv = "NATS_UPGRADE_LISTENERS"
+	upgradeReadyEnv     = "NATS_UPGRADE_READY_FD"
+
+	// upgradeReadyTimeout is how long the upgraded process has to become
+	// ready, after which it is killed and the upgrade is aborted.
+	upgradeReadyTimeout = 30 * time.Second
+)
+
+// Upgrade starts a new process of the server executable, with the same
+// arguments, that inherits the client, cluster, gateway, leafnode and
+// monitoring listeners. Once the new process is ready, this server enters lame duck
+// mode to drain its connections. Since the listening sockets are never
+// closed, connections pending in the accept queues are not dropped.
+// The upgrade is aborted if the new process exits or is not ready after
+// upgradeReadyTimeout.
+func (s *Server) Upgrade() error {
+	s.mu.Lock()
+	if s.shutdown || s.ldm || s.upgrading {
+		s.mu.Unlock()
+		return errors.New("server is shutting down or already upgrading")
+	}
+	s.upgrading = true
+	listeners := map[string]net.Listener{
+		ClientListener:   s.listener,
+		ClusterListener:  s.routeListener,
+		GatewayListener:  s.gatewayListener,
+		LeafNodeListener: s.leafNodeListener,
+		// The listener of monitoring over TLS is wrapped.
+		MonitoringListener: s.httpTCP,
+	}
+	s.mu.Unlock()
+
+	pid, err := s.startUpgradedProcess(listeners)
+	if err != nil {
+		s.mu.Lock()
+		s.upgrading = false
+		s.mu.Unlock()
+		return err
+	}
+	s.Noticef("Upgraded server process %d is ready, draining connections", pid)
+	go s.lameDuckMode()
+	return nil
+}
+
+// startUpgradedProcess starts the new process and waits for it to be ready.
+func (s *Server) startUpgradedProcess(listeners map[string]net.Listener) (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+	// The inherited files start at fd 3 in the new process.
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var inherited []string
+	for _, lt := range listenerTypes {
+		tl, ok := listeners[lt].(*net.TCPListener)
+		if !ok {
+			continue
+		}
+		f, err := tl.File()
+		if err != nil {
+			return 0, fmt.Errorf("error getting %s listener file: %v", lt, err)
+		}
+		inherited = append(inherited, fmt.Sprintf("%s=%d", lt, 3+len(files)))
+		files = append(files, f)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		upgradeListenersEnv+"="+strings.Join(inherited, ","),
+		fmt.Sprintf("%s=%d", upgradeReadyEnv, 2+len(files)))
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	// Close our end of the pipe so that reading fails if the new process
+	// exits before being ready.
+	w.Close()
+	files = files[:len(files)-1]
+
+	ready := make(chan error, 1)
+	go func() {
+		var b [1]byte
+		_, err := r.Read(b[:])
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeReadyTimeout):
+		err = errors.New("timeout")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("upgraded server process %d not ready: %v", cmd.Process.Pid, err)
+	}
+	// Reap the new process if it exits before this one.
+	go cmd.Wait()
+	return cmd.Process.Pid, nil
+}
+
+// inheritListeners takes the listeners passed by the process that started
+// this one for an upgrade, and signals it once all listeners are ready.
+func (s *Server) inheritListeners() {
+	env := os.Getenv(upgradeListenersEnv)
+	readyFd := os.Getenv(upgradeReadyEnv)
+	if env == _EMPTY_ && readyFd == _EMPTY_ {
+		return
+	}
+	// Only the first server of the process inherits them.
+	os.Unsetenv(upgradeListenersEnv)
+	os.Unsetenv(upgradeReadyEnv)
+
+	inherited := make(map[string]net.Listener)
+	for _, e := range strings.Split(env, ",") {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		fd, err := strconv.Atoi(kv[1])
+		if err != nil {
+			s.Errorf("Invalid inherited %s listener fd %q", kv[0], kv[1])
+			continue
+		}
+		f := os.NewFile(uintptr(fd), kv[0])
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			s.Errorf("Error inheriting %s listener: %v", kv[0], err)
+			continue
+		}
+		s.Noticef("Inherited %s listener on %s", kv[0], l.Addr())
+		inherited[kv[0]] = l
+	}
+	s.mu.Lock()
+	s.inherited = inherited
+	s.mu.Unlock()
+
+	if fd, err := strconv.Atoi(readyFd); err == nil {
+		f := os.NewFile(uintptr(fd), "upgrade ready")
+		s.OnListenersReady(func() {
+			// Listeners not used with the current configuration.
+			s.mu.Lock()
+			for lt, l := range s.inherited {
+				s.Warnf("Closing inherited %s listener not configured anymore", lt)
+				l.Close()
+			}
+			s.inherited = nil
+			s.mu.Unlock()
+			f.Write([]byte{1})
+			f.Close()
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUpgradeInheritListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer l.Close()
+	// Not configured, so closed by the server once ready.
+	unused, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer unused.Close()
+	lf, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Error getting listener file: %v", err)
+	}
+	defer lf.Close()
+	uf, err := unused.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("Error getting listener file: %v", err)
+	}
+	defer uf.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Error creating pipe: %v", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// The server takes ownership of the fds, so give it copies.
+	dup := func(f *os.File) int {
+		t.Helper()
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			t.Fatalf("Error duplicating fd: %v", err)
+		}
+		return fd
+	}
+	os.Setenv(upgradeListenersEnv, fmt.Sprintf("%s=%d,%s=%d", ClientListener, dup(lf), GatewayListener, dup(uf)))
+	os.Setenv(upgradeReadyEnv, fmt.Sprintf("%d", dup(w)))
+	defer os.Unsetenv(upgradeListenersEnv)
+	defer os.Unsetenv(upgradeReadyEnv)
+
+	// The configured port is random, so the inherited one is used.
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	if os.Getenv(upgradeListenersEnv) != _EMPTY_ || os.Getenv(upgradeReadyEnv) != _EMPTY_ {
+		t.Fatal("Expected upgrade environment to be cleared")
+	}
+	if port := l.Addr().(*net.TCPAddr).Port; s.Addr().(*net.TCPAddr).Port != port {
+		t.Fatalf("Expected server to listen on inherited port %d, got %v", port, s.Addr())
+	}
+	r.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var b [1]byte
+	if n, err := r.Read(b[:]); n != 1 || err != nil {
+		t.Fatalf("Expected ready notification, got %v, %v", n, err)
+	}
+	s.mu.Lock()
+	inherited := len(s.inherited)
+	s.mu.Unlock()
+	if inherited != 0 {
+		t.Fatalf("Expected unused inherited listeners to be closed, got %v", inherited)
+	}
+
+	// Connections pending on the original listener are accepted by the
+	// server.
+	nc := natsConnect(t, fmt.Sprintf("nats://%s", l.Addr()))
+	defer nc.Close()
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+}
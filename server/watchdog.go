@@ -0,0 +1,242 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// How often the watchdog checks for stalls, at most.
+	watchdogMaxInterval = time.Second
+
+	// Kinds of stalls reported by the watchdog.
+	stallServerLock = "server_lock"
+	stallAcceptLoop = "accept_loop"
+	stallWriteLoop  = "write_loop"
+)
+
+// stallTracker records when a loop started to work on something, so that
+// the watchdog can detect that it has been stuck on it for too long.
+type stallTracker struct {
+	busy int64
+}
+
+func (t *stallTracker) start() {
+	atomic.StoreInt64(&t.busy, time.Now().UnixNano())
+}
+
+func (t *stallTracker) done() {
+	atomic.StoreInt64(&t.busy, 0)
+}
+
+// stalledFor returns for how long the loop has been working on the
+// current item, or 0 if idle.
+func (t *stallTracker) stalledFor(now int64) time.Duration {
+	if busy := atomic.LoadInt64(&t.busy); busy != 0 {
+		return time.Duration(now - busy)
+	}
+	return 0
+}
+
+// acceptLoops tracks the accept loops of the server.
+type acceptLoops struct {
+	client   stallTracker
+	route    stallTracker
+	leafnode stallTracker
+	gateway  stallTracker
+}
+
+// startWatchdog starts the routine that detects stalled write loops,
+// accept loops, or server lock, and reports them. It does nothing if
+// already started.
+func (s *Server) startWatchdog() {
+	s.mu.Lock()
+	if s.watchdogStarted || s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+	s.watchdogStarted = true
+	s.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		reported := make(map[string]bool)
+		for {
+			threshold := s.getOpts().Watchdog
+			interval := threshold / 4
+			if interval <= 0 || interval > watchdogMaxInterval {
+				interval = watchdogMaxInterval
+			}
+			select {
+			case <-time.After(interval):
+			case <-s.quitCh:
+				return
+			}
+			if threshold > 0 {
+				s.checkStalls(threshold, reported)
+			}
+		}
+	})
+}
+
+// stall describes something found stuck by the watchdog.
+type stall struct {
+	kind string
+	desc string
+	dur  time.Duration
+	cid  uint64
+}
+
+// checkStalls looks for stalls longer than threshold and reports the ones
+// that were not already reported. Stalls that are resolved are removed
+// from reported.
+// This is invoked from the watchdog routine only.
+func (s *Server) checkStalls(threshold time.Duration, reported map[string]bool) {
+	var stalls []*stall
+
+	// If the server lock can't be acquired, nothing else can be checked.
+	if dur, ok := s.probeServerLock(threshold); !ok {
+		stalls = append(stalls, &stall{kind: stallServerLock, desc: "server lock", dur: dur})
+	} else {
+		now := time.Now().UnixNano()
+		for _, al := range []struct {
+			name string
+			t    *stallTracker
+		}{
+			{"client", &s.acceptLoops.client},
+			{"route", &s.acceptLoops.route},
+			{"leafnode", &s.acceptLoops.leafnode},
+			{"gateway", &s.acceptLoops.gateway},
+		} {
+			if dur := al.t.stalledFor(now); dur > threshold {
+				stalls = append(stalls, &stall{kind: stallAcceptLoop, desc: al.name + " accept loop", dur: dur})
+			}
+		}
+
+		// Writes may legitimately block for up to the write deadline.
+		wthreshold := threshold + s.getOpts().WriteDeadline
+		for _, c := range s.writeLoopConns() {
+			if dur := c.out.wl.stalledFor(now); dur > wthreshold {
+				stalls = append(stalls, &stall{kind: stallWriteLoop, desc: fmt.Sprintf("write loop of cid %d", c.cid), dur: dur, cid: c.cid})
+			}
+		}
+	}
+
+	current := make(map[string]bool, len(stalls))
+	var newStalls []*stall
+	for _, st := range stalls {
+		current[st.desc] = true
+		if !reported[st.desc] {
+			reported[st.desc] = true
+			newStalls = append(newStalls, st)
+		}
+	}
+	for desc := range reported {
+		if !current[desc] {
+			delete(reported, desc)
+			s.Noticef("Watchdog: %s is no longer stalled", desc)
+		}
+	}
+	if len(newStalls) == 0 {
+		return
+	}
+	for _, st := range newStalls {
+		s.Errorf("Watchdog: %s stalled for %v", st.desc, st.dur)
+	}
+	var b bytes.Buffer
+	pprof.Lookup("goroutine").WriteTo(&b, 2)
+	s.Errorf("Watchdog: goroutine dump:\n%s", b.String())
+
+	// Advisories can't be sent if the server lock is stuck.
+	if newStalls[0].kind == stallServerLock {
+		return
+	}
+	for _, st := range newStalls {
+		s.sendStallEvent(st)
+	}
+}
+
+// probeServerLock returns false if the server lock could not be acquired
+// within threshold, along with how long it has been waited for. Only one
+// probe is outstanding at a time, so a stuck lock is reported as long as
+// it is held.
+func (s *Server) probeServerLock(threshold time.Duration) (time.Duration, bool) {
+	if start := atomic.LoadInt64(&s.lockProbe); start != 0 {
+		dur := time.Duration(time.Now().UnixNano() - start)
+		return dur, dur <= threshold
+	}
+	start := time.Now().UnixNano()
+	atomic.StoreInt64(&s.lockProbe, start)
+	acquired := make(chan struct{})
+	go func() {
+		s.mu.Lock()
+		s.mu.Unlock()
+		atomic.StoreInt64(&s.lockProbe, 0)
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return 0, true
+	case <-time.After(threshold):
+		return time.Duration(time.Now().UnixNano() - start), false
+	}
+}
+
+// writeLoopConns returns the connections that have a write loop.
+func (s *Server) writeLoopConns() []*client {
+	var conns []*client
+	s.mu.Lock()
+	for _, c := range s.clients {
+		conns = append(conns, c)
+	}
+	for _, c := range s.routes {
+		conns = append(conns, c)
+	}
+	for _, c := range s.leafs {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+	s.gateway.RLock()
+	for _, c := range s.gateway.in {
+		conns = append(conns, c)
+	}
+	for _, c := range s.gateway.outo {
+		conns = append(conns, c)
+	}
+	s.gateway.RUnlock()
+	return conns
+}
+
+// sendStallEvent sends an advisory for a stall found by the watchdog.
+func (s *Server) sendStallEvent(st *stall) {
+	m := &ServerStallEventMsg{
+		Kind:        st.kind,
+		Description: st.desc,
+		Duration:    st.dur,
+		ClientID:    st.cid,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	subj := fmt.Sprintf(serverStallEventSubj, s.info.ID)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
@@ -0,0 +1,180 @@
+// Copyright 2020 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server/pse"
+)
+
+// DEFAULT_WATERMARK_INTERVAL is the default interval at which watermarks
+// are checked.
+const DEFAULT_WATERMARK_INTERVAL = 5 * time.Second
+
+// Percentage of the high watermark used as low watermark when not set.
+const defaultLowWatermarkPercent = 90
+
+// Metrics watched by watermarks.
+const (
+	WatermarkConnections   = "connections"
+	WatermarkSubscriptions = "subscriptions"
+	WatermarkMemory        = "memory"
+)
+
+// States reported by watermark advisories.
+const (
+	WatermarkHigh   = "high"
+	WatermarkNormal = "normal"
+)
+
+// Watermark is a threshold for a metric. An advisory is sent when the
+// value reaches High, and again when it goes back to Low or below.
+type Watermark struct {
+	High int64 `json:"high"`
+	// Low is 90% of High if 0.
+	Low int64 `json:"low,omitempty"`
+}
+
+func (w Watermark) low() int64 {
+	if w.Low > 0 {
+		return w.Low
+	}
+	return w.High * defaultLowWatermarkPercent / 100
+}
+
+// WatermarkOpts are the watermarks of server wide metrics, a zero
+// Watermark disables the one of a metric.
+type WatermarkOpts struct {
+	// Interval between checks, DEFAULT_WATERMARK_INTERVAL if 0.
+	Interval      time.Duration `json:"interval,omitempty"`
+	Connections   Watermark     `json:"connections,omitempty"`
+	Subscriptions Watermark     `json:"subscriptions,omitempty"`
+	// Memory is the resident memory of the process, in bytes.
+	Memory Watermark `json:"memory,omitempty"`
+}
+
+func (o *WatermarkOpts) validate() error {
+	if o == nil {
+		return nil
+	}
+	for _, w := range []struct {
+		name string
+		w    Watermark
+	}{
+		{WatermarkConnections, o.Connections},
+		{WatermarkSubscriptions, o.Subscriptions},
+		{WatermarkMemory, o.Memory},
+	} {
+		if w.w.High < 0 || w.w.Low < 0 {
+			return fmt.Errorf("%s watermarks can not be negative", w.name)
+		}
+		if w.w.Low > 0 && w.w.Low >= w.w.High {
+			return fmt.Errorf("%s low watermark must be lower than the high watermark", w.name)
+		}
+	}
+	return nil
+}
+
+// startWatermarks starts the routine that checks the watermarks. It does
+// nothing if already started.
+func (s *Server) startWatermarks() {
+	s.mu.Lock()
+	if s.watermarksStarted || s.shutdown {
+		s.mu.Unlock()
+		return
+	}
+	s.watermarksStarted = true
+	s.mu.Unlock()
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+
+		high := make(map[string]bool)
+		for {
+			interval := DEFAULT_WATERMARK_INTERVAL
+			wo := s.getOpts().Watermarks
+			if wo != nil && wo.Interval > 0 {
+				interval = wo.Interval
+			}
+			select {
+			case <-time.After(interval):
+			case <-s.quitCh:
+				return
+			}
+			if wo = s.getOpts().Watermarks; wo != nil {
+				s.checkWatermarks(wo, high)
+			}
+		}
+	})
+}
+
+// checkWatermarks sends an advisory for each metric that reached its high
+// watermark, or went back to its low one, since the last check. The
+// metrics currently above their high watermark are kept in high.
+// This is invoked from the watermarks routine only.
+func (s *Server) checkWatermarks(wo *WatermarkOpts, high map[string]bool) {
+	s.mu.Lock()
+	conns := int64(len(s.clients))
+	subs := int64(s.numSubscriptions())
+	s.mu.Unlock()
+	var mem int64
+	if wo.Memory.High > 0 {
+		var pcpu float64
+		var vss int64
+		pse.ProcUsage(&pcpu, &mem, &vss)
+	}
+
+	for _, m := range []struct {
+		metric string
+		w      Watermark
+		value  int64
+	}{
+		{WatermarkConnections, wo.Connections, conns},
+		{WatermarkSubscriptions, wo.Subscriptions, subs},
+		{WatermarkMemory, wo.Memory, mem},
+	} {
+		switch {
+		case m.w.High <= 0:
+			delete(high, m.metric)
+		case !high[m.metric] && m.value >= m.w.High:
+			high[m.metric] = true
+			s.Warnf("Watermark: %s at %d, reached the high watermark of %d", m.metric, m.value, m.w.High)
+			s.sendWatermarkEvent(m.metric, WatermarkHigh, m.value, m.w)
+		case high[m.metric] && m.value <= m.w.low():
+			delete(high, m.metric)
+			s.Noticef("Watermark: %s at %d, back to the low watermark of %d", m.metric, m.value, m.w.low())
+			s.sendWatermarkEvent(m.metric, WatermarkNormal, m.value, m.w)
+		}
+	}
+}
+
+// sendWatermarkEvent sends an advisory for a metric crossing a watermark.
+func (s *Server) sendWatermarkEvent(metric, state string, value int64, w Watermark) {
+	m := &ServerWatermarkEventMsg{
+		Metric: metric,
+		State:  state,
+		Value:  value,
+		High:   w.High,
+		Low:    w.low(),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.eventsEnabled() {
+		return
+	}
+	subj := fmt.Sprintf(serverWatermarkEventSubj, s.info.ID, metric)
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
@@ -146,6 +146,34 @@ func Benchmark_____Pub32K_Payload(b *testing.B) {
 	benchPub(b, psub, s)
 }
 
+// Benchmark the +OK sent for each PUB of a verbose client.
+func Benchmark_VerbosePub0b_Payload(b *testing.B) {
+	b.StopTimer()
+	s := runBenchServer()
+	defer s.Shutdown()
+	c := createClientConn(b, "127.0.0.1", PERF_PORT)
+	defer c.Close()
+	checkInfoMsg(b, c)
+	sendProto(b, c, "CONNECT {\"verbose\":true}\r\n")
+	expectResult(b, c, okRe)
+
+	ch := make(chan bool)
+	expected := b.N*len("+OK\r\n") + len("PONG\r\n")
+	go drainConnection(b, c, ch, expected)
+
+	bw := bufio.NewWriterSize(c, defaultSendBufSize)
+	sendOp := []byte("PUB a 0\r\n\r\n")
+	b.SetBytes(int64(len(sendOp)))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		bw.Write(sendOp)
+	}
+	bw.WriteString("PING\r\n")
+	bw.Flush()
+	<-ch
+	b.StopTimer()
+}
+
 func drainConnection(b *testing.B, c net.Conn, ch chan bool, expected int) {
 	buf := make([]byte, defaultRecBufSize)
 	bytes := 0
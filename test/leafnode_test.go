@@ -117,10 +117,8 @@ func TestLeafNodeSplitBuffer(t *testing.T) {
 
 	lc := createLeafConn(t, opts.LeafNode.Host, opts.LeafNode.Port)
 	defer lc.Close()
-	sendProto(t, lc, "CONNECT {}\r\n")
-	checkLeafNodeConnected(t, s)
-
 	leafSend, leafExpect := setupLeaf(t, lc, 2)
+	checkLeafNodeConnected(t, s)
 
 	leafSend("LS+ reply\r\nPING\r\n")
 	leafExpect(pongRe)
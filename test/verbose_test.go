@@ -50,9 +50,9 @@ func TestVerboseConnect(t *testing.T) {
 
 	expect(okRe)
 
-	// Connect
+	// A second CONNECT is rejected.
 	send("CONNECT {\"verbose\":true,\"pedantic\":true,\"tls_required\":false}\r\n")
-	expect(okRe)
+	expect(errRe)
 }
 
 func TestVerbosePubSub(t *testing.T) {
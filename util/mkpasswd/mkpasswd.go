@@ -24,12 +24,13 @@ import (
 	"math/big"
 	"syscall"
 
+	"github.com/nats-io/nats-server/v2/server"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/ssh/terminal"
 )
 
 func usage() {
-	fmt.Printf("Usage: mkpasswd [-p <stdin password>] [-c COST] \n")
+	fmt.Printf("Usage: mkpasswd [-p <stdin password>] [-a bcrypt|argon2id] [-c COST] \n")
 	flag.PrintDefaults()
 }
 
@@ -45,6 +46,7 @@ const (
 func main() {
 	var pw = flag.Bool("p", false, "Input password via stdin")
 	var cost = flag.Int("c", DefaultCost, fmt.Sprintf("The cost weight, range of %d-%d", bcrypt.MinCost, bcrypt.MaxCost))
+	var algo = flag.String("a", server.PasswordHashBcrypt, "The hashing algorithm, bcrypt or argon2id")
 
 	log.SetFlags(0)
 	flag.Usage = usage
@@ -73,11 +75,11 @@ func main() {
 		fmt.Printf("pass: %s\n", password)
 	}
 
-	cb, err := bcrypt.GenerateFromPassword([]byte(password), *cost)
+	hash, err := server.HashPassword(password, &server.PasswordHashingOpts{Algorithm: *algo, BcryptCost: *cost})
 	if err != nil {
-		log.Fatalf("Error producing bcrypt hash: %v\n", err)
+		log.Fatalf("Error producing %s hash: %v\n", *algo, err)
 	}
-	fmt.Printf("bcrypt hash: %s\n", cb)
+	fmt.Printf("%s hash: %s\n", *algo, hash)
 }
 
 func genPassword() string {